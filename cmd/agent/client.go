@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -17,15 +20,28 @@ type APIClient struct {
 	client  *http.Client
 }
 
-// NewAPIClient creates a new API client
+// NewAPIClient creates a new API client. A unix:// base URL, like
+// unix:///var/run/mingyue-agent/agent.sock, reaches the agent over its Unix
+// socket.
 func NewAPIClient(baseURL, apiKey, user string) *APIClient {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	if socket, ok := strings.CutPrefix(baseURL, "unix://"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		baseURL = "http://localhost"
+	}
+
 	return &APIClient{
 		baseURL: baseURL,
 		apiKey:  apiKey,
 		user:    user,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		client:  client,
 	}
 }
 
@@ -55,6 +71,54 @@ func (c *APIClient) Request(method, path string, body interface{}) (*APIResponse
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+
+	respBody, _, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(respBody)
+}
+
+// PostRaw posts a body that is not JSON, like a YAML document
+func (c *APIClient) PostRaw(path, contentType string, body []byte) (*APIResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	respBody, _, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(respBody)
+}
+
+// GetRaw makes a GET request for a body that is not JSON, like a YAML
+// document. Error responses are still JSON.
+func (c *APIClient) GetRaw(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	respBody, status, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		_, err := decodeResponse(respBody)
+		if err == nil {
+			err = fmt.Errorf("API error: status %d", status)
+		}
+		return nil, err
+	}
+	return respBody, nil
+}
+
+// send adds the credentials to a request, sends it and returns the
+// response body and status
+func (c *APIClient) send(req *http.Request) ([]byte, int, error) {
 	if c.apiKey != "" {
 		req.Header.Set("X-API-Key", c.apiKey)
 	}
@@ -64,15 +128,19 @@ func (c *APIClient) Request(method, path string, body interface{}) (*APIResponse
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, 0, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, 0, fmt.Errorf("failed to read response: %w", err)
 	}
+	return respBody, resp.StatusCode, nil
+}
 
+// decodeResponse parses a standard API response, returning its error
+func decodeResponse(respBody []byte) (*APIResponse, error) {
 	var apiResp APIResponse
 	if err := json.Unmarshal(respBody, &apiResp); err != nil {
 		return nil, fmt.Errorf("failed to parse response: %w", err)
@@ -38,6 +38,11 @@ func (w *loggingResponseWriter) Write(data []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func requestLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -100,6 +105,7 @@ This is useful for local debugging to observe raw handler behavior without the f
 			if err != nil {
 				return fmt.Errorf("create HTTP handlers: %w", err)
 			}
+			defer handler.Stop()
 
 			var output io.Writer = os.Stdout
 			if logFile != "" {
@@ -118,12 +124,15 @@ This is useful for local debugging to observe raw handler behavior without the f
 			}
 
 			srv := &http.Server{
-				Addr:         fmt.Sprintf("%s:%d", cfg.Server.ListenAddr, cfg.Server.HTTPPort),
 				Handler:      finalHandler,
 				ReadTimeout:  15 * time.Second,
 				WriteTimeout: 15 * time.Second,
 				IdleTimeout:  60 * time.Second,
 			}
+			listeners, err := server.ListenHTTP(cfg)
+			if err != nil {
+				return err
+			}
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
@@ -131,16 +140,13 @@ This is useful for local debugging to observe raw handler behavior without the f
 			sigCh := make(chan os.Signal, 1)
 			signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-			errCh := make(chan error, 1)
-			go func() {
-				if cfg.API.TLSCert != "" && cfg.API.TLSKey != "" {
-					errCh <- srv.ListenAndServeTLS(cfg.API.TLSCert, cfg.API.TLSKey)
-					return
-				}
-				errCh <- srv.ListenAndServe()
-			}()
-
-			log.Printf("API server listening on %s", srv.Addr)
+			errCh := make(chan error, len(listeners))
+			for _, lis := range listeners {
+				go func() {
+					errCh <- lis.Serve(srv)
+				}()
+				log.Printf("API server listening on %s", lis.URL())
+			}
 
 			select {
 			case sig := <-sigCh:
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -37,17 +38,17 @@ func authTokenCreateCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			name := args[0]
 			if localMode {
-				_, dataDir, err := loadLocalConfig()
+				cfg, dataDir, err := loadLocalConfig()
 				if err != nil {
 					return err
 				}
-				mgr, err := localAuthManager(dataDir)
+				mgr, err := localAuthManager(cfg, dataDir)
 				if err != nil {
 					return err
 				}
 
 				expiresAt := time.Now().Add(time.Duration(expiresIn) * time.Second)
-				token, err := mgr.CreateToken(userID, name, nil, expiresAt)
+				token, err := mgr.CreateToken(context.Background(), userID, name, nil, expiresAt)
 				if err != nil {
 					return err
 				}
@@ -106,11 +107,11 @@ func authTokenListCmd() *cobra.Command {
 		Short: "List all API tokens",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if localMode {
-				_, dataDir, err := loadLocalConfig()
+				cfg, dataDir, err := loadLocalConfig()
 				if err != nil {
 					return err
 				}
-				mgr, err := localAuthManager(dataDir)
+				mgr, err := localAuthManager(cfg, dataDir)
 				if err != nil {
 					return err
 				}
@@ -182,15 +183,15 @@ func authTokenRevokeCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			tokenID := args[0]
 			if localMode {
-				_, dataDir, err := loadLocalConfig()
+				cfg, dataDir, err := loadLocalConfig()
 				if err != nil {
 					return err
 				}
-				mgr, err := localAuthManager(dataDir)
+				mgr, err := localAuthManager(cfg, dataDir)
 				if err != nil {
 					return err
 				}
-				if err := mgr.RevokeToken(tokenID); err != nil {
+				if err := mgr.RevokeToken(context.Background(), tokenID); err != nil {
 					return err
 				}
 			} else {
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/KOPElan/mingyue-agent/internal/bundle"
+	"github.com/spf13/cobra"
+)
+
+func bundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Declarative configuration bundles",
+		Long: `Export the shares, network disks and tasks managed by the agent as a YAML
+bundle, and apply bundles to make the agent match them. Bundles can be kept
+in git and applied from CI to manage a server GitOps-style.
+
+Network disk passwords are never exported; add them to the bundle, or leave
+them out to keep the current passwords.`,
+	}
+
+	cmd.AddCommand(bundleExportCmd())
+	cmd.AddCommand(bundleDiffCmd())
+	cmd.AddCommand(bundleApplyCmd())
+
+	return cmd
+}
+
+func bundleExportCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export managed objects as a YAML bundle",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if localMode {
+				return fmt.Errorf("bundles are only available through the API")
+			}
+
+			data, err := getAPIClient().GetRaw("/api/v1/config/bundle")
+			if err != nil {
+				return err
+			}
+			if output == "" || output == "-" {
+				_, err := os.Stdout.Write(data)
+				return err
+			}
+			if err := os.WriteFile(output, data, 0600); err != nil {
+				return fmt.Errorf("write bundle: %w", err)
+			}
+			fmt.Printf("Bundle written to %s\n", output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write the bundle to this file instead of stdout")
+
+	return cmd
+}
+
+func bundleDiffCmd() *cobra.Command {
+	var (
+		file  string
+		prune bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Show the changes applying a bundle would make",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return postBundle("/api/v1/config/bundle/diff", file, prune)
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Bundle file, or - for stdin")
+	cmd.Flags().BoolVar(&prune, "prune", false, "Delete objects missing from the sections in the bundle")
+	cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+func bundleApplyCmd() *cobra.Command {
+	var (
+		file  string
+		prune bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Make the agent match a bundle",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return postBundle("/api/v1/config/bundle/apply", file, prune)
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Bundle file, or - for stdin")
+	cmd.Flags().BoolVar(&prune, "prune", false, "Delete objects missing from the sections in the bundle")
+	cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+// postBundle sends a bundle file to the diff or apply endpoint and prints
+// the changes
+func postBundle(path, file string, prune bool) error {
+	if localMode {
+		return fmt.Errorf("bundles are only available through the API")
+	}
+
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return fmt.Errorf("read bundle: %w", err)
+	}
+	if prune {
+		path += "?prune=true"
+	}
+
+	resp, apiErr := getAPIClient().PostRaw(path, "application/yaml", data)
+	if resp == nil {
+		return apiErr
+	}
+
+	var result struct {
+		Changes []*bundle.Change `json:"changes"`
+		Applied bool             `json:"applied"`
+	}
+	if len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, &result); err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+
+	if len(result.Changes) == 0 && apiErr == nil {
+		fmt.Println("No changes")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tKIND\tKEY\tFIELDS\tERROR")
+	for _, change := range result.Changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			change.Action, change.Kind, change.Key, strings.Join(change.Fields, ","), change.Error)
+	}
+	w.Flush()
+
+	if apiErr != nil {
+		return apiErr
+	}
+	if result.Applied {
+		fmt.Printf("Applied %d changes\n", len(result.Changes))
+	}
+	return nil
+}
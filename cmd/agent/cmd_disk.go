@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -39,7 +40,7 @@ func diskListCmd() *cobra.Command {
 					return err
 				}
 				mgr := localDiskManager(cfg)
-				result, err := mgr.ListDisks()
+				result, err := mgr.ListDisks(context.Background())
 				if err != nil {
 					return err
 				}
@@ -83,7 +84,7 @@ func diskPartitionsCmd() *cobra.Command {
 					return err
 				}
 				mgr := localDiskManager(cfg)
-				result, err := mgr.ListPartitions()
+				result, err := mgr.ListPartitions(context.Background())
 				if err != nil {
 					return err
 				}
@@ -135,7 +136,7 @@ func diskSmartCmd() *cobra.Command {
 					return err
 				}
 				mgr := localDiskManager(cfg)
-				smart, err := mgr.GetSMARTInfo(device)
+				smart, err := mgr.GetSMARTInfo(context.Background(), device)
 				if err != nil {
 					return err
 				}
@@ -206,7 +207,7 @@ func diskMountCmd() *cobra.Command {
 					return err
 				}
 				mgr := localDiskManager(cfg)
-				if err := mgr.Mount(diskmanager.MountOptions{
+				if err := mgr.Mount(context.Background(), diskmanager.MountOptions{
 					Device:     device,
 					MountPoint: mountPoint,
 					FileSystem: filesystem,
@@ -251,7 +252,7 @@ func diskUnmountCmd() *cobra.Command {
 					return err
 				}
 				mgr := localDiskManager(cfg)
-				if err := mgr.Unmount(target, force); err != nil {
+				if err := mgr.Unmount(context.Background(), target, force); err != nil {
 					return err
 				}
 			} else {
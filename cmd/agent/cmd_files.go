@@ -30,12 +30,15 @@ func filesCmd() *cobra.Command {
 }
 
 func filesListCmd() *cobra.Command {
-	return &cobra.Command{
+	var opts filemanager.ListOptions
+
+	cmd := &cobra.Command{
 		Use:   "list <path>",
 		Short: "List files in a directory",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			path := args[0]
+			opts.Path = path
 			var files []filemanager.FileInfo
 
 			if localMode {
@@ -44,14 +47,27 @@ func filesListCmd() *cobra.Command {
 					return err
 				}
 				mgr := localFileManager(cfg)
-				result, err := mgr.List(context.Background(), filemanager.ListOptions{Path: path}, localUser())
+				result, err := mgr.List(context.Background(), opts, localUser())
 				if err != nil {
 					return err
 				}
 				files = result
 			} else {
 				client := getAPIClient()
-				resp, err := client.Get(fmt.Sprintf("/api/v1/files/list?path=%s", url.QueryEscape(path)))
+				query := url.Values{"path": {path}, "limit": {"1000"}}
+				if opts.SortBy != "" {
+					query.Set("sort", opts.SortBy)
+				}
+				if opts.SortOrder != "" {
+					query.Set("order", opts.SortOrder)
+				}
+				if opts.Pattern != "" {
+					query.Set("pattern", opts.Pattern)
+				}
+				if opts.NoHidden {
+					query.Set("hidden", "false")
+				}
+				resp, err := client.Get("/api/v1/files/list?" + query.Encode())
 				if err != nil {
 					return err
 				}
@@ -80,6 +96,13 @@ func filesListCmd() *cobra.Command {
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&opts.SortBy, "sort", "", "Sort by name, size or mtime")
+	cmd.Flags().StringVar(&opts.SortOrder, "order", "", "Sort order, asc or desc")
+	cmd.Flags().StringVar(&opts.Pattern, "pattern", "", "Only list names matching this glob")
+	cmd.Flags().BoolVar(&opts.NoHidden, "no-hidden", false, "Leave out dotfiles")
+
+	return cmd
 }
 
 func filesInfoCmd() *cobra.Command {
@@ -209,7 +232,7 @@ func filesCopyCmd() *cobra.Command {
 					return err
 				}
 				mgr := localFileManager(cfg)
-				if err := mgr.Copy(context.Background(), src, dst, localUser()); err != nil {
+				if _, err := mgr.Copy(context.Background(), src, dst, localUser()); err != nil {
 					return err
 				}
 			} else {
@@ -96,8 +96,8 @@ func requiredPaths(cfg *config.Config) []string {
 	logDir := agentLogDir(cfg)
 	paths := []string{
 		filepath.Dir(cfg.NetDisk.StateFile),
-		filepath.Dir(cfg.Network.HistoryFile),
-		cfg.ShareMgr.BackupDir,
+		filepath.Dir(cfg.Network.HistoryDB),
+		cfg.History.Dir,
 		filepath.Dir(cfg.ShareMgr.StateFile),
 		filepath.Dir(cfg.Server.UDSPath),
 		logDir,
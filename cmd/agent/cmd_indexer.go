@@ -38,11 +38,11 @@ func indexerScanCmd() *cobra.Command {
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if localMode {
-				_, dataDir, err := loadLocalConfig()
+				cfg, dataDir, err := loadLocalConfig()
 				if err != nil {
 					return err
 				}
-				idx, err := localIndexer(dataDir)
+				idx, err := localIndexer(cfg, dataDir)
 				if err != nil {
 					return err
 				}
@@ -106,11 +106,11 @@ func indexerSearchCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			query := args[0]
 			if localMode {
-				_, dataDir, err := loadLocalConfig()
+				cfg, dataDir, err := loadLocalConfig()
 				if err != nil {
 					return err
 				}
-				idx, err := localIndexer(dataDir)
+				idx, err := localIndexer(cfg, dataDir)
 				if err != nil {
 					return err
 				}
@@ -181,11 +181,11 @@ func indexerStatsCmd() *cobra.Command {
 		Short: "Get indexer statistics",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if localMode {
-				_, dataDir, err := loadLocalConfig()
+				cfg, dataDir, err := loadLocalConfig()
 				if err != nil {
 					return err
 				}
-				idx, err := localIndexer(dataDir)
+				idx, err := localIndexer(cfg, dataDir)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/preflight"
+	"github.com/spf13/cobra"
+)
+
+func preflightCmd() *cobra.Command {
+	var configFile string
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "preflight",
+		Short: "Check that the agent can start with a config",
+		Long: `Run the startup self-test without starting the agent.
+
+Checks config values, directory permissions, external tools used by enabled
+subsystems, HTTP/gRPC/UDS listeners and database integrity. The same checks
+run when the daemon starts; only fatal issues prevent startup.
+
+Examples:
+  mingyue-agent preflight
+  mingyue-agent preflight --config /path/to/config.yaml --json`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resolvedConfig := resolveConfigPath(configFile)
+			cfg, err := config.Load(resolvedConfig)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+
+			report := preflight.Run(cfg)
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(report); err != nil {
+					return fmt.Errorf("encode report: %w", err)
+				}
+			} else {
+				report.Print(os.Stdout)
+			}
+
+			if report.HasFatal() {
+				return fmt.Errorf("%d fatal issue(s) found", report.Fatal)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&configFile, "config", "c", defaultConfigPath, "Path to config file")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+
+	return cmd
+}
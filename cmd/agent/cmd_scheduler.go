@@ -112,7 +112,7 @@ func schedulerAddCmd() *cobra.Command {
 					Enabled:  enabled,
 					Params:   map[string]interface{}{},
 				}
-				if err := sched.AddTask(task); err != nil {
+				if err := sched.AddTask(context.Background(), task); err != nil {
 					return err
 				}
 				fmt.Printf("Task added with ID: %s\n", task.ID)
@@ -169,7 +169,7 @@ func schedulerRemoveCmd() *cobra.Command {
 				if err != nil {
 					return err
 				}
-				if err := sched.DeleteTask(taskID); err != nil {
+				if err := sched.DeleteTask(context.Background(), taskID); err != nil {
 					return err
 				}
 			} else {
@@ -10,6 +10,7 @@ import (
 	"github.com/KOPElan/mingyue-agent/internal/config"
 	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
 	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
 	"github.com/KOPElan/mingyue-agent/internal/indexer"
 	"github.com/KOPElan/mingyue-agent/internal/monitor"
 	"github.com/KOPElan/mingyue-agent/internal/scheduler"
@@ -50,11 +51,34 @@ func applyLocalOverrides(cfg *config.Config, dataDir string) {
 	}
 
 	cfg.NetDisk.StateFile = filepath.Join(dataDir, "netdisk-state.json")
+	cfg.Network.HistoryDB = filepath.Join(dataDir, "network-history.db")
 	cfg.Network.HistoryFile = filepath.Join(dataDir, "network-history.json")
-	cfg.ShareMgr.BackupDir = filepath.Join(dataDir, "share-backups")
+	cfg.History.Dir = filepath.Join(dataDir, "config-history")
 	cfg.ShareMgr.StateFile = filepath.Join(dataDir, "share-state.json")
+	cfg.ShareMgr.TemplateDir = filepath.Join(dataDir, "share-templates")
+	cfg.ShareMgr.StatsFile = filepath.Join(dataDir, "share-stats.json")
+	cfg.Rsync.ConfigFile = filepath.Join(dataDir, "rsyncd.conf")
+	cfg.Rsync.SecretsFile = filepath.Join(dataDir, "rsyncd.secrets")
+	cfg.Rsync.StateFile = filepath.Join(dataDir, "rsync-state.json")
+	cfg.PortMap.StateFile = filepath.Join(dataDir, "portmap-state.json")
+	cfg.WAN.HistoryFile = filepath.Join(dataDir, "wan-history.json")
 	cfg.Server.UDSPath = filepath.Join(dataDir, "agent.sock")
 	cfg.Audit.LogPath = filepath.Join(dataDir, "audit.log")
+	cfg.Audit.WebhookFile = filepath.Join(dataDir, "webhooks.json")
+	cfg.Alerts.StateFile = filepath.Join(dataDir, "alerts.json")
+	cfg.Reports.Dir = filepath.Join(dataDir, "reports")
+	cfg.Crash.Dir = filepath.Join(dataDir, "crashes")
+	cfg.Security.UploadPolicyFile = filepath.Join(dataDir, "upload-policies.json")
+	cfg.Security.UploadSessionDir = filepath.Join(dataDir, "upload-sessions")
+	cfg.Security.TrashDir = filepath.Join(dataDir, "trash")
+	cfg.Security.MaintenanceFile = filepath.Join(dataDir, "maintenance.json")
+	cfg.Security.AuthDB = filepath.Join(dataDir, "auth.db")
+	cfg.Scheduler.DBPath = filepath.Join(dataDir, "scheduler.db")
+	cfg.Scheduler.SyncStateFile = filepath.Join(dataDir, "scheduler-sync.json")
+	cfg.Scheduler.RulesFile = filepath.Join(dataDir, "rules.json")
+	cfg.Plugins.SocketDir = filepath.Join(dataDir, "plugins")
+	cfg.Indexer.DBPath = filepath.Join(dataDir, "indexer.db")
+	cfg.Indexer.ThumbnailDir = filepath.Join(dataDir, "thumbnails")
 
 	cwd, err := os.Getwd()
 	if err == nil && cwd != "" {
@@ -85,7 +109,10 @@ func localUser() string {
 }
 
 func localFileManager(cfg *config.Config) *filemanager.Manager {
-	return filemanager.New(cfg.Security.AllowedPaths, nil)
+	fileMgr := filemanager.New(cfg.Security.AllowedPaths, nil)
+	fileMgr.SetFollowEscapingSymlinks(cfg.Security.FollowSymlinks)
+	fileMgr.SetIgnore(ignore.New(cfg.Ignore.Patterns))
+	return fileMgr
 }
 
 func localDiskManager(cfg *config.Config) *diskmanager.Manager {
@@ -96,11 +123,14 @@ func localMonitor() *monitor.Monitor {
 	return monitor.New()
 }
 
-func localIndexer(dataDir string) (*indexer.Indexer, error) {
+func localIndexer(cfg *config.Config, dataDir string) (*indexer.Indexer, error) {
 	if err := ensureLocalDataDir(dataDir); err != nil {
 		return nil, err
 	}
-	return indexer.New(filepath.Join(dataDir, "indexer.db"))
+	return indexer.New(&indexer.Config{
+		DBPath: filepath.Join(dataDir, "indexer.db"),
+		Ignore: ignore.New(cfg.Ignore.Patterns),
+	})
 }
 
 func localScheduler(dataDir string) (*scheduler.Scheduler, error) {
@@ -112,12 +142,13 @@ func localScheduler(dataDir string) (*scheduler.Scheduler, error) {
 	})
 }
 
-func localAuthManager(dataDir string) (*auth.AuthManager, error) {
+func localAuthManager(cfg *config.Config, dataDir string) (*auth.AuthManager, error) {
 	if err := ensureLocalDataDir(dataDir); err != nil {
 		return nil, err
 	}
 	return auth.New(auth.Config{
-		DBPath: filepath.Join(dataDir, "auth.db"),
+		DBPath:    filepath.Join(dataDir, "auth.db"),
+		DBKeyFile: cfg.Security.AuthDBKeyFile,
 	})
 }
 
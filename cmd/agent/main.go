@@ -74,7 +74,7 @@ local privileged operations capabilities.`,
 	}
 
 	// Add global flags
-	rootCmd.PersistentFlags().StringVar(&apiURL, "api-url", "http://localhost:8080", "API server URL")
+	rootCmd.PersistentFlags().StringVar(&apiURL, "api-url", "http://localhost:8080", "API server URL, or unix:// and the path of the agent's Unix socket")
 	rootCmd.PersistentFlags().StringVar(&apiKey, "api-key", "", "API authentication key")
 	rootCmd.PersistentFlags().StringVar(&apiUser, "user", "", "User identifier for requests")
 	rootCmd.PersistentFlags().BoolVar(&localMode, "local", false, "Execute commands using local business logic instead of HTTP API")
@@ -85,6 +85,7 @@ local privileged operations capabilities.`,
 	rootCmd.AddCommand(startCmd())
 	rootCmd.AddCommand(apiCmd())
 	rootCmd.AddCommand(versionCmd())
+	rootCmd.AddCommand(preflightCmd())
 
 	// Add management commands
 	rootCmd.AddCommand(filesCmd())
@@ -92,6 +93,7 @@ local privileged operations capabilities.`,
 	rootCmd.AddCommand(monitorCmd())
 	rootCmd.AddCommand(indexerCmd())
 	rootCmd.AddCommand(schedulerCmd())
+	rootCmd.AddCommand(bundleCmd())
 	rootCmd.AddCommand(authCmd())
 	rootCmd.AddCommand(fixPermissionsCmd())
 
@@ -136,6 +138,7 @@ The daemon will run in the foreground and can be stopped with Ctrl+C (SIGINT) or
 				return fmt.Errorf("failed to load config: %w", err)
 			}
 
+			daemon.Version = version
 			d, err := daemon.New(cfg)
 			if err != nil {
 				return fmt.Errorf("failed to create daemon: %w", err)
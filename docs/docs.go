@@ -22,16 +22,36 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/healthz": {
+        "/alerts": {
             "get": {
-                "description": "Returns the current health status of the agent",
+                "description": "Lists open alerts, newest first; include_resolved=true also lists recently resolved ones",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "health"
+                    "alerts"
+                ],
+                "summary": "List alerts",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Include resolved alerts",
+                        "name": "include_resolved",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the page to return",
+                        "name": "page_token",
+                        "in": "query"
+                    }
                 ],
-                "summary": "Health check endpoint",
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -44,7 +64,10 @@ const docTemplate = `{
                                     "type": "object",
                                     "properties": {
                                         "data": {
-                                            "$ref": "#/definitions/internal_api.HealthResponse"
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_alerts.Alert"
+                                            }
                                         }
                                     }
                                 }
@@ -54,14 +77,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/register": {
+        "/alerts/ack": {
             "post": {
-                "security": [
-                    {
-                        "UserAuth": []
-                    }
-                ],
-                "description": "Registers the agent and returns registration information",
+                "description": "Marks an open alert as seen; it stays listed until the condition clears",
                 "consumes": [
                     "application/json"
                 ],
@@ -69,9 +87,20 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "registration"
+                    "alerts"
+                ],
+                "summary": "Acknowledge an alert",
+                "parameters": [
+                    {
+                        "description": "Alert to acknowledge",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.AcknowledgeAlertRequest"
+                        }
+                    }
                 ],
-                "summary": "Register agent with WebUI",
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -84,15 +113,21 @@ const docTemplate = `{
                                     "type": "object",
                                     "properties": {
                                         "data": {
-                                            "$ref": "#/definitions/internal_api.RegistrationInfo"
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_alerts.Alert"
                                         }
                                     }
                                 }
                             ]
                         }
                     },
-                    "405": {
-                        "description": "Method Not Allowed",
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
                         "schema": {
                             "$ref": "#/definitions/internal_api.Response"
                         }
@@ -100,80 +135,6063 @@ const docTemplate = `{
                 }
             }
         },
-        "/status": {
-            "get": {
-                "description": "Returns the current status and uptime of the agent",
+        "/alerts/silence": {
+            "post": {
+                "description": "Mutes an alert for a period, including recurrences; a duration of 0 lifts the silence",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "status"
+                    "alerts"
+                ],
+                "summary": "Silence an alert",
+                "parameters": [
+                    {
+                        "description": "Alert and silence duration",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.SilenceAlertRequest"
+                        }
+                    }
                 ],
-                "summary": "Get agent status",
                 "responses": {
                     "200": {
                         "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_alerts.Alert"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "$ref": "#/definitions/internal_api.Response"
                         }
                     },
-                    "405": {
-                        "description": "Method Not Allowed",
+                    "404": {
+                        "description": "Not Found",
                         "schema": {
                             "$ref": "#/definitions/internal_api.Response"
                         }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "internal_api.HealthResponse": {
-            "type": "object",
-            "properties": {
-                "status": {
-                    "type": "string"
-                },
-                "timestamp": {
-                    "type": "string"
+        },
+        "/auth/bans": {
+            "get": {
+                "description": "Lists source IPs currently banned from the API",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "List banned IPs",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_auth.Ban"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
                 },
-                "version": {
-                    "type": "string"
-                }
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
             }
         },
-        "internal_api.RegistrationInfo": {
-            "type": "object",
-            "properties": {
-                "agent_id": {
-                    "type": "string"
-                },
-                "api_urls": {
-                    "type": "array",
-                    "items": {
-                        "type": "string"
+        "/auth/bans/add": {
+            "post": {
+                "description": "Bans a source IP from the API, permanently when no duration is given",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Ban IP",
+                "parameters": [
+                    {
+                        "description": "Ban request",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.BanIPRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_auth.Ban"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
                     }
                 },
-                "hostname": {
-                    "type": "string"
-                },
-                "start_time": {
-                    "type": "string"
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/bans/remove": {
+            "delete": {
+                "description": "Lifts the ban on a source IP",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Unban IP",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "IP address",
+                        "name": "ip",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
                 },
-                "version": {
-                    "type": "string"
-                }
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
             }
         },
-        "internal_api.Response": {
-            "type": "object",
-            "properties": {
-                "data": {},
-                "error": {
-                    "type": "string"
+        "/auth/sessions": {
+            "get": {
+                "description": "Lists the sessions of a user, most recently used first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "List sessions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID (default: the caller)",
+                        "name": "user_id",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/internal_api.SessionInfo"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
                 },
-                "success": {
-                    "type": "boolean"
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/sessions/create": {
+            "post": {
+                "description": "Creates a new user session",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Create session",
+                "parameters": [
+                    {
+                        "description": "Session request",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.CreateSessionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_auth.Session"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/auth/sessions/refresh": {
+            "post": {
+                "description": "Trades a refresh token for a new session token and refresh token",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Refresh session",
+                "parameters": [
+                    {
+                        "description": "Refresh request",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.RefreshSessionRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_auth.Session"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/auth/sessions/revoke": {
+            "delete": {
+                "description": "Revokes a user session",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Revoke session",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Session ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/sessions/revoke-others": {
+            "post": {
+                "description": "Revokes every session of a user except the one making the request",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Revoke other sessions",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID (default: the caller)",
+                        "name": "user_id",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/tokens": {
+            "get": {
+                "description": "Lists all API tokens for a user",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "List API tokens",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User ID",
+                        "name": "user_id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_auth.Token"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/tokens/bulk": {
+            "post": {
+                "description": "Creates several tokens at once and returns them as a bundle. Either all tokens are created or none are.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Provision API tokens in bulk",
+                "parameters": [
+                    {
+                        "description": "Tokens to create",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.CreateTokensRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.TokenBundle"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/tokens/create": {
+            "post": {
+                "description": "Creates a new API token for authentication",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Create API token",
+                "parameters": [
+                    {
+                        "description": "Token request",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.CreateTokenRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_auth.Token"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/auth/tokens/revoke": {
+            "delete": {
+                "description": "Revokes an API token",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Revoke API token",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Token ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/capabilities": {
+            "get": {
+                "description": "Returns the enabled subsystems, integrations and plugins",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "status"
+                ],
+                "summary": "Get agent capabilities",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.Capabilities"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/config/bundle": {
+            "get": {
+                "description": "Returns the shares, network disks and tasks of the enabled features as a YAML bundle. Network disk passwords are left out.",
+                "produces": [
+                    "application/yaml"
+                ],
+                "tags": [
+                    "config"
+                ],
+                "summary": "Export managed objects",
+                "responses": {
+                    "200": {
+                        "description": "YAML bundle",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/config/bundle/apply": {
+            "post": {
+                "description": "Creates, updates and, with prune, deletes objects until the agent matches a YAML or JSON bundle. Applying the same bundle again changes nothing. Failed changes carry an error and do not stop the others.",
+                "consumes": [
+                    "application/yaml"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "config"
+                ],
+                "summary": "Apply a bundle",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Delete objects missing from the sections in the bundle",
+                        "name": "prune",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.BundleResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.BundleResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/config/bundle/diff": {
+            "post": {
+                "description": "Returns the changes applying a YAML or JSON bundle would make, without making them",
+                "consumes": [
+                    "application/yaml"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "config"
+                ],
+                "summary": "Diff a bundle",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Delete objects missing from the sections in the bundle",
+                        "name": "prune",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.BundleResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/config/history": {
+            "get": {
+                "description": "Returns recorded changes of configuration files written by the agent, most recent first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "config"
+                ],
+                "summary": "List configuration changes",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only changes of this file",
+                        "name": "path",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_configrepo.Commit"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "501": {
+                        "description": "Not Implemented",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/config/history/diff": {
+            "get": {
+                "description": "Returns a recorded change with its unified diff",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "config"
+                ],
+                "summary": "Show a configuration change",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Commit ID",
+                        "name": "commit",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.ConfigChangeDiff"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/config/history/revert": {
+            "post": {
+                "description": "Puts files back to their content as of a recorded change and reloads the services reading them. The revert is recorded as a new change. Managers keep their own state, so shares or modules listed by the API are not reverted.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "config"
+                ],
+                "summary": "Revert configuration files",
+                "parameters": [
+                    {
+                        "description": "Revert request",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.RevertHistoryRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "type": "string"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/crashes": {
+            "get": {
+                "description": "Lists reports of previous runs that ended in a panic or fatal error, newest first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "crashes"
+                ],
+                "summary": "List crash reports",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the page to return",
+                        "name": "page_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_crashreport.Summary"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/crashes/delete": {
+            "delete": {
+                "description": "Deletes a crash report once it has been looked into",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "crashes"
+                ],
+                "summary": "Delete a crash report",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Report ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/crashes/get": {
+            "get": {
+                "description": "Returns a crash report with the runtime output, goroutine stacks and the end of the log of the crashed run",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "crashes"
+                ],
+                "summary": "Get a crash report",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Report ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_crashreport.Report"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/hooks/{token}": {
+            "post": {
+                "description": "Starts the task whose hook token is in the path and returns at once. The optional body sets params the task lists in hook_params. No other credentials are needed; unknown tokens count as failed authentications.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Trigger a task through its hook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Hook token",
+                        "name": "token",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Params to override",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.HookRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/indexer/changes": {
+            "get": {
+                "description": "Lists files added, changed and removed in the index since a cursor, so clients can keep their own copy of it. Cursor 0, or one older than the removals the index remembers, returns the whole index with reset set.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "Get index changes",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Cursor returned by the previous call, 0 for the whole index",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum changes to return (default 1000, max 10000)",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.ChangeSet"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/indexer/dedupe": {
+            "post": {
+                "description": "Links the duplicates of each set to its first file, after comparing their contents. Sets default to the duplicate report below path.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "Replace duplicate files with hard links",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_filemanager.DedupeResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/indexer/duplicates": {
+            "get": {
+                "description": "Lists indexed files with the same size and MD5 hash, largest waste first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "Report duplicate files",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only files below this directory",
+                        "name": "path",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Minimum file size in bytes",
+                        "name": "min_size",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 100,
+                        "description": "Sets to return",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.DuplicateReport"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/indexer/enrich": {
+            "post": {
+                "description": "Sends the indexed images not tagged since they changed to the configured enrichment service and stores the tags and faces it returns",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "Enrich indexed files",
+                "parameters": [
+                    {
+                        "description": "Files to enrich",
+                        "name": "body",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.EnrichOptions"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.EnrichResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "501": {
+                        "description": "Not Implemented",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/indexer/scan": {
+            "post": {
+                "description": "Scans specified paths and indexes file metadata",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "Scan files for indexing",
+                "parameters": [
+                    {
+                        "description": "Scan options",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.ScanOptions"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.ScanResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/indexer/search": {
+            "get": {
+                "description": "Searches indexed files by name and path, and by the tags enrichers found",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "Search indexed files",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Search query, required without tag",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Only files with all of these tags or face names",
+                        "name": "tag",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 50,
+                        "description": "Result limit",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Result offset",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.FileMetadata"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/indexer/tags": {
+            "get": {
+                "description": "Lists the tags and face names of indexed files with the number of files that have each",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "indexer"
+                ],
+                "summary": "List tags",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only files below this directory",
+                        "name": "path",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.TagCount"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/monitor/endpoints": {
+            "get": {
+                "description": "Returns request counts, errors and latency of every endpoint since the agent started, slowest first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "monitor"
+                ],
+                "summary": "Get per-endpoint request metrics",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the page to return",
+                        "name": "page_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_telemetry.EndpointStats"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/monitor/traces/slow": {
+            "get": {
+                "description": "Returns the slowest recent requests broken down into the spans of their phases and commands; requires tracing to be enabled",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "monitor"
+                ],
+                "summary": "Get slow request traces",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Return only this trace",
+                        "name": "trace_id",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_telemetry.Trace"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/network/portmap": {
+            "get": {
+                "description": "Discovers the router if needed and reports its external address and the mappings",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Get port mapping status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_portmap.Status"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/network/portmap/add": {
+            "post": {
+                "description": "Requests a port mapping with UPnP IGD or NAT-PMP and keeps renewing it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Map a port on the router",
+                "parameters": [
+                    {
+                        "description": "Mapping",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_portmap.Request"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_portmap.Mapping"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/network/portmap/refresh": {
+            "post": {
+                "description": "Forgets the discovered router and requests all mappings again",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Rediscover the router",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_portmap.Status"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/network/portmap/remove": {
+            "delete": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Release a port mapping",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Mapping ID, like tcp-8443",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/network/wan": {
+            "get": {
+                "description": "Returns the latest probe of each target and the latest speedtest",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Get internet quality",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.Status"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/network/wan/history": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Get internet quality history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only probes of this target; speedtests are omitted",
+                        "name": "target",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Hours of history (default 24)",
+                        "name": "hours",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.History"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/network/wan/probe": {
+            "post": {
+                "description": "Probes all targets without waiting for the next interval",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Probe internet quality now",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.Result"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/network/wan/speedtest": {
+            "post": {
+                "description": "Downloads the configured speedtest file and records the throughput",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "network"
+                ],
+                "summary": "Run a speedtest",
+                "parameters": [
+                    {
+                        "description": "Options",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.SpeedtestRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.SpeedResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_jobs.Job"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/overview": {
+            "get": {
+                "description": "Returns agent status, system stats, shares, a disk summary, open alerts and running tasks in one response. Sections are loaded concurrently; a section that fails or times out is left out and its error listed in errors, so the response is still successful. Shares, disks and tasks also need shares:read, disk:read and scheduler:read; sections the token lacks the scope for are listed in errors.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "monitoring"
+                ],
+                "summary": "Get dashboard overview",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Comma-separated sections to include: status, stats, shares, disks, alerts, tasks (default all)",
+                        "name": "sections",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.Overview"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/query": {
+            "get": {
+                "description": "Returns the selected resources, trimmed to the selected fields, e.g. \"shares{name,healthy} disks{device,smart{temperature}}\". A resource without braces is returned whole. Resources load concurrently; one that fails, times out or needs a scope the token lacks is left out and its error listed under errors.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "monitoring"
+                ],
+                "summary": "Query several resources",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Selection, for GET requests",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "description": "Selection, for POST requests",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.QueryRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            },
+            "post": {
+                "description": "Returns the selected resources, trimmed to the selected fields, e.g. \"shares{name,healthy} disks{device,smart{temperature}}\". A resource without braces is returned whole. Resources load concurrently; one that fails, times out or needs a scope the token lacks is left out and its error listed under errors.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "monitoring"
+                ],
+                "summary": "Query several resources",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Selection, for GET requests",
+                        "name": "q",
+                        "in": "query"
+                    },
+                    {
+                        "description": "Selection, for POST requests",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.QueryRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/register": {
+            "post": {
+                "description": "Registers the agent and returns registration information",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "registration"
+                ],
+                "summary": "Register agent with WebUI",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.RegistrationInfo"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/reports": {
+            "get": {
+                "description": "Lists stored reports, newest first; the files API serves their HTML and JSON files",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "reports"
+                ],
+                "summary": "List reports",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the page to return",
+                        "name": "page_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_reports.Info"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/reports/generate": {
+            "post": {
+                "description": "Generates a report now instead of waiting for a scheduled report task",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "reports"
+                ],
+                "summary": "Generate a report",
+                "parameters": [
+                    {
+                        "description": "Period covered",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.GenerateReportRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_reports.Info"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_jobs.Job"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/modules": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "List rsync modules",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Page size",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Token of the page to return",
+                        "name": "page_token",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Module"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/modules/add": {
+            "post": {
+                "description": "Exports a directory as an rsync daemon module",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Add an rsync module",
+                "parameters": [
+                    {
+                        "description": "Module",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Module"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Module"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/modules/remove": {
+            "delete": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Remove an rsync module",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Module name",
+                        "name": "name",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/modules/update": {
+            "put": {
+                "description": "Replaces the settings of a module; its name can't change",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Update an rsync module",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Module name",
+                        "name": "name",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "description": "Module",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Module"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Module"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/start": {
+            "post": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Start the rsync daemon",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Status"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/status": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Get rsync daemon status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Status"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/stop": {
+            "post": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Stop the rsync daemon",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rsyncd.Status"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/users": {
+            "get": {
+                "description": "Lists the names of users in the rsync secrets file",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "List rsync users",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "type": "string"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/users/remove": {
+            "delete": {
+                "description": "Removes a user no module allows any more",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Remove an rsync user",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "User name",
+                        "name": "name",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rsync/users/set": {
+            "post": {
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rsync"
+                ],
+                "summary": "Create an rsync user or change its password",
+                "parameters": [
+                    {
+                        "description": "User",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.SetRsyncUserRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rules": {
+            "get": {
+                "description": "Returns all file-event automation rules",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rules"
+                ],
+                "summary": "List automation rules",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Rule"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/rules/add": {
+            "post": {
+                "description": "Creates a rule running scheduler task handlers when matching files change",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rules"
+                ],
+                "summary": "Add an automation rule",
+                "parameters": [
+                    {
+                        "description": "Rule",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Rule"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Rule"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/rules/delete": {
+            "delete": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rules"
+                ],
+                "summary": "Delete an automation rule",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Rule ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/rules/get": {
+            "get": {
+                "description": "Returns a rule with its trigger counts",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rules"
+                ],
+                "summary": "Get an automation rule",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Rule ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Rule"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/rules/update": {
+            "put": {
+                "description": "Replaces the definition of a rule, keeping its trigger counts",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rules"
+                ],
+                "summary": "Update an automation rule",
+                "parameters": [
+                    {
+                        "description": "Rule",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Rule"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Rule"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/scheduler/history": {
+            "get": {
+                "description": "Returns execution history for a task",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Get task execution history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "default": 10,
+                        "description": "Limit",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.TaskExecution"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/scheduler/sync": {
+            "get": {
+                "description": "Returns the state of task definition sync with the portal",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Get portal sync status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.SyncStatus"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/scheduler/sync/run": {
+            "post": {
+                "description": "Pulls task definitions from the portal and pushes pending execution results",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Sync tasks with the portal now",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.SyncResult"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/scheduler/tasks": {
+            "get": {
+                "description": "Returns all scheduled tasks",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "List all tasks",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    }
+                }
+            }
+        },
+        "/scheduler/tasks/add": {
+            "post": {
+                "description": "Creates a new scheduled task",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Add a new task",
+                "parameters": [
+                    {
+                        "description": "Task configuration",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/scheduler/tasks/delete": {
+            "delete": {
+                "description": "Deletes a scheduled task",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Delete a task",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/scheduler/tasks/execute": {
+            "post": {
+                "description": "Manually triggers task execution",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Execute a task manually",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.TaskExecution"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/scheduler/tasks/get": {
+            "get": {
+                "description": "Returns details of a specific task",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Get task details",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/scheduler/tasks/hook": {
+            "post": {
+                "description": "POST gives the task a new hook token, replacing any earlier one; the token is only shown in this response. DELETE revokes it.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Create or revoke a task hook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.TaskHook"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            },
+            "delete": {
+                "description": "POST gives the task a new hook token, replacing any earlier one; the token is only shown in this response. DELETE revokes it.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Create or revoke a task hook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.TaskHook"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/scheduler/tasks/preview": {
+            "get": {
+                "description": "Returns when a task will be started next, moved out of blackout windows",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Preview the next runs of a task",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Task ID",
+                        "name": "id",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of runs (default 5, at most 50)",
+                        "name": "count",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.TaskPreview"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/scheduler/tasks/update": {
+            "put": {
+                "description": "Updates an existing scheduled task",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "scheduler"
+                ],
+                "summary": "Update a task",
+                "parameters": [
+                    {
+                        "description": "Task configuration",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/status": {
+            "get": {
+                "description": "Returns the current status and uptime of the agent",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "status"
+                ],
+                "summary": "Get agent status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/internal_api.AgentStatus"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "405": {
+                        "description": "Method Not Allowed",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                }
+            }
+        },
+        "/thumbnail/cleanup": {
+            "post": {
+                "description": "Removes old or excess thumbnails from cache",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "thumbnail"
+                ],
+                "summary": "Cleanup thumbnail cache",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        },
+        "/thumbnail/generate": {
+            "post": {
+                "description": "Generates a thumbnail for the specified file",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "thumbnail"
+                ],
+                "summary": "Generate thumbnail for file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "File path",
+                        "name": "path",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/internal_api.Response"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_thumbnail.ThumbnailInfo"
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_api.Response"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "UserAuth": []
+                    }
+                ]
+            }
+        }
+    },
+    "definitions": {
+        "github_com_KOPElan_mingyue-agent_internal_alerts.Alert": {
+            "type": "object",
+            "properties": {
+                "acknowledged_at": {
+                    "type": "string"
+                },
+                "acknowledged_by": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "occurrences": {
+                    "description": "Times the condition was raised",
+                    "type": "integer"
+                },
+                "raised_at": {
+                    "type": "string"
+                },
+                "resolved_at": {
+                    "type": "string"
+                },
+                "resource": {
+                    "type": "string"
+                },
+                "severity": {
+                    "type": "string"
+                },
+                "silenced_by": {
+                    "type": "string"
+                },
+                "silenced_until": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_auth.Ban": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "created_by": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "description": "Zero for permanent bans",
+                    "type": "string"
+                },
+                "failures": {
+                    "type": "integer"
+                },
+                "ip": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_auth.Session": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "ip": {
+                    "type": "string"
+                },
+                "last_used": {
+                    "type": "string"
+                },
+                "refresh_expires_at": {
+                    "type": "string"
+                },
+                "refresh_token": {
+                    "description": "Only shown on creation and refresh",
+                    "type": "string"
+                },
+                "token": {
+                    "description": "Only shown on creation and refresh",
+                    "type": "string"
+                },
+                "user_agent": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_auth.Token": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "last_used": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "rate_limit_kbps": {
+                    "description": "RateLimitKBps caps file transfers made with the token; 0 uses the\nagent's default",
+                    "type": "integer"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "token": {
+                    "description": "Only shown on creation",
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_bundle.Change": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "fields": {
+                    "description": "Fields an update changes",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "key": {
+                    "description": "type/name of shares, mount point of network disks, ID of tasks",
+                    "type": "string"
+                },
+                "kind": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_configrepo.Commit": {
+            "type": "object",
+            "properties": {
+                "files": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                },
+                "reason": {
+                    "description": "Why, as given by the client",
+                    "type": "string"
+                },
+                "request_id": {
+                    "type": "string"
+                },
+                "summary": {
+                    "description": "What the agent changed",
+                    "type": "string"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "user": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_crashreport.Report": {
+            "type": "object",
+            "properties": {
+                "arch": {
+                    "type": "string"
+                },
+                "go_version": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "log_tail": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "os": {
+                    "type": "string"
+                },
+                "output": {
+                    "description": "Full runtime output with goroutine stacks",
+                    "type": "string"
+                },
+                "panic": {
+                    "description": "First line, like \"panic: runtime error: ...\"",
+                    "type": "string"
+                },
+                "pid": {
+                    "type": "integer"
+                },
+                "started_at": {
+                    "type": "string"
+                },
+                "submit_error": {
+                    "type": "string"
+                },
+                "submitted": {
+                    "type": "boolean"
+                },
+                "submitted_at": {
+                    "type": "string"
+                },
+                "time": {
+                    "description": "When the crash output was written",
+                    "type": "string"
+                },
+                "truncated": {
+                    "type": "boolean"
+                },
+                "version": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_crashreport.Summary": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
+                },
+                "panic": {
+                    "type": "string"
+                },
+                "submitted": {
+                    "type": "boolean"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_diskmanager.MountOptionSets": {
+            "type": "object",
+            "properties": {
+                "common": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "filesystems": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        }
+                    }
+                },
+                "presets": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_diskmanager.Partition": {
+            "type": "object",
+            "properties": {
+                "available": {
+                    "type": "integer"
+                },
+                "device": {
+                    "type": "string"
+                },
+                "filesystem": {
+                    "type": "string"
+                },
+                "label": {
+                    "type": "string"
+                },
+                "mount_point": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "read_only": {
+                    "type": "boolean"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "used": {
+                    "type": "integer"
+                },
+                "used_percent": {
+                    "type": "number"
+                },
+                "uuid": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_filemanager.DedupeLink": {
+            "type": "object",
+            "properties": {
+                "kept": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_filemanager.DedupeResult": {
+            "type": "object",
+            "properties": {
+                "dry_run": {
+                    "type": "boolean"
+                },
+                "linked": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_filemanager.DedupeLink"
+                    }
+                },
+                "saved_bytes": {
+                    "description": "Space freed; files with other hard links free none",
+                    "type": "integer"
+                },
+                "skipped": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_filemanager.DedupeSkip"
+                    }
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_filemanager.DedupeSkip": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.ChangeSet": {
+            "type": "object",
+            "properties": {
+                "added": {
+                    "description": "Files new since the cursor",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.FileMetadata"
+                    }
+                },
+                "changed": {
+                    "description": "Files changed since the cursor",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.FileMetadata"
+                    }
+                },
+                "cursor": {
+                    "description": "Pass to the next call",
+                    "type": "integer"
+                },
+                "more": {
+                    "description": "More changes follow the cursor",
+                    "type": "boolean"
+                },
+                "removed": {
+                    "description": "Paths of files removed since the cursor",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "reset": {
+                    "description": "Added holds every file; drop everything else first",
+                    "type": "boolean"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.DuplicateReport": {
+            "type": "object",
+            "properties": {
+                "files": {
+                    "description": "Files in the sets returned",
+                    "type": "integer"
+                },
+                "sets": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.DuplicateSet"
+                    }
+                },
+                "wasted_bytes": {
+                    "description": "Space all copies but one take in the sets returned",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.DuplicateSet": {
+            "type": "object",
+            "properties": {
+                "md5_hash": {
+                    "type": "string"
+                },
+                "paths": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "wasted_bytes": {
+                    "description": "Size of all copies but one",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.EnrichOptions": {
+            "type": "object",
+            "properties": {
+                "force": {
+                    "description": "Enrich files again even if unchanged, such as after the service was upgraded",
+                    "type": "boolean"
+                },
+                "limit": {
+                    "description": "Files to enrich in this pass; 0 for all",
+                    "type": "integer"
+                },
+                "path": {
+                    "description": "Only files below this directory; all if empty",
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.EnrichResult": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "integer"
+                },
+                "files": {
+                    "description": "Files sent to enrichers",
+                    "type": "integer"
+                },
+                "tagged": {
+                    "description": "Files that got at least one tag",
+                    "type": "integer"
+                },
+                "tags": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.FileMetadata": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "integer"
+                },
+                "indexed_at": {
+                    "type": "string"
+                },
+                "is_dir": {
+                    "type": "boolean"
+                },
+                "md5_hash": {
+                    "type": "string"
+                },
+                "mime_type": {
+                    "type": "string"
+                },
+                "mod_time": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "tags": {
+                    "description": "Set by searches",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_indexer.Tag"
+                    }
+                },
+                "thumbnail_url": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.ScanOptions": {
+            "type": "object",
+            "properties": {
+                "extensions": {
+                    "description": "Filter by file extensions",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "incremental": {
+                    "type": "boolean"
+                },
+                "paths": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "recursive": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.ScanResult": {
+            "type": "object",
+            "properties": {
+                "completed_at": {
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "integer"
+                },
+                "files_added": {
+                    "type": "integer"
+                },
+                "files_scanned": {
+                    "type": "integer"
+                },
+                "files_updated": {
+                    "type": "integer"
+                },
+                "started_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.Tag": {
+            "type": "object",
+            "properties": {
+                "box": {
+                    "description": "x, y, width and height of a face in pixels",
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "confidence": {
+                    "type": "number"
+                },
+                "kind": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_indexer.TagCount": {
+            "type": "object",
+            "properties": {
+                "files": {
+                    "type": "integer"
+                },
+                "kind": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_jobs.Job": {
+            "type": "object",
+            "properties": {
+                "cancelable": {
+                    "description": "Cancelable jobs stop when canceled with Cancel",
+                    "type": "boolean"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "finished_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "progress": {
+                    "description": "Progress is the latest progress the job reported with SetProgress"
+                },
+                "resource": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_maintenance.Status": {
+            "type": "object",
+            "properties": {
+                "changed_at": {
+                    "type": "string"
+                },
+                "enabled": {
+                    "type": "boolean"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "user": {
+                    "description": "Who last toggled the switch",
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_monitor.CPUStats": {
+            "type": "object",
+            "properties": {
+                "cores": {
+                    "type": "integer"
+                },
+                "load_avg_1": {
+                    "type": "number"
+                },
+                "load_avg_15": {
+                    "type": "number"
+                },
+                "load_avg_5": {
+                    "type": "number"
+                },
+                "usage_percent": {
+                    "type": "number"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_monitor.DiskStats": {
+            "type": "object",
+            "properties": {
+                "free": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                },
+                "used": {
+                    "type": "integer"
+                },
+                "used_percent": {
+                    "type": "number"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_monitor.MemoryStats": {
+            "type": "object",
+            "properties": {
+                "available": {
+                    "type": "integer"
+                },
+                "swap_total": {
+                    "type": "integer"
+                },
+                "swap_used": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                },
+                "used": {
+                    "type": "integer"
+                },
+                "used_percent": {
+                    "type": "number"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_monitor.ProcessStats": {
+            "type": "object",
+            "properties": {
+                "goroutines": {
+                    "type": "integer"
+                },
+                "mem_alloc": {
+                    "type": "integer"
+                },
+                "mem_sys": {
+                    "type": "integer"
+                },
+                "num_gc": {
+                    "type": "integer"
+                },
+                "open_files": {
+                    "type": "integer"
+                },
+                "pid": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_monitor.SystemStats": {
+            "type": "object",
+            "properties": {
+                "cpu": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_monitor.CPUStats"
+                },
+                "disk": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_monitor.DiskStats"
+                },
+                "memory": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_monitor.MemoryStats"
+                },
+                "process": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_monitor.ProcessStats"
+                },
+                "uptime": {
+                    "type": "number"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_portmap.Mapping": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "external_port": {
+                    "description": "Requested port; the router may assign another",
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "internal_port": {
+                    "type": "integer"
+                },
+                "lease_sec": {
+                    "description": "Granted lease; 0 does not expire",
+                    "type": "integer"
+                },
+                "mapped_port": {
+                    "type": "integer"
+                },
+                "protocol": {
+                    "type": "string"
+                },
+                "renew_at": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_portmap.Request": {
+            "type": "object",
+            "properties": {
+                "description": {
+                    "type": "string"
+                },
+                "external_port": {
+                    "description": "Same as InternalPort if 0",
+                    "type": "integer"
+                },
+                "internal_port": {
+                    "type": "integer"
+                },
+                "protocol": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_portmap.Status": {
+            "type": "object",
+            "properties": {
+                "available": {
+                    "type": "boolean"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "external_ip": {
+                    "type": "string"
+                },
+                "gateway": {
+                    "type": "string"
+                },
+                "mappings": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_portmap.Mapping"
+                    }
+                },
+                "method": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_reports.Info": {
+            "type": "object",
+            "properties": {
+                "generated_at": {
+                    "type": "string"
+                },
+                "html_path": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "json_path": {
+                    "type": "string"
+                },
+                "since": {
+                    "type": "string"
+                },
+                "summary": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_reports.Summary"
+                },
+                "until": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_reports.Summary": {
+            "type": "object",
+            "properties": {
+                "backups_failed": {
+                    "type": "integer"
+                },
+                "backups_ok": {
+                    "type": "integer"
+                },
+                "changes": {
+                    "description": "Successful changes in the audit log",
+                    "type": "integer"
+                },
+                "disks": {
+                    "type": "integer"
+                },
+                "full_volumes": {
+                    "description": "Volumes at least 90% full",
+                    "type": "integer"
+                },
+                "open_alerts": {
+                    "type": "integer"
+                },
+                "unhealthy_disks": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_rsyncd.Module": {
+            "type": "object",
+            "properties": {
+                "comment": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "hosts_allow": {
+                    "description": "Addresses, CIDRs or host names; any host if empty",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "name": {
+                    "type": "string"
+                },
+                "options": {
+                    "description": "Further rsyncd.conf parameters, like \"uid\"",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "path": {
+                    "type": "string"
+                },
+                "read_only": {
+                    "type": "boolean"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "users": {
+                    "description": "Users allowed in; anyone if empty",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_rsyncd.Status": {
+            "type": "object",
+            "properties": {
+                "modules": {
+                    "type": "integer"
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "service": {
+                    "type": "string"
+                },
+                "state": {
+                    "description": "As reported by systemctl is-active",
+                    "type": "string"
+                },
+                "users": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_rules.Action": {
+            "type": "object",
+            "properties": {
+                "params": {
+                    "type": "object",
+                    "additionalProperties": true
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_rules.Rule": {
+            "type": "object",
+            "properties": {
+                "actions": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_rules.Action"
+                    }
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "enabled": {
+                    "type": "boolean"
+                },
+                "events": {
+                    "description": "file.created by default",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                },
+                "last_error": {
+                    "type": "string"
+                },
+                "last_triggered": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "path": {
+                    "description": "Directory watched, with everything below it",
+                    "type": "string"
+                },
+                "pattern": {
+                    "description": "Glob matched against file names, like *.jpg",
+                    "type": "string"
+                },
+                "triggered": {
+                    "type": "integer"
+                },
+                "updated_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_scheduler.Blackout": {
+            "type": "object",
+            "properties": {
+                "days": {
+                    "description": "Days limits the window to the weekdays it starts on, as mon, tue,\n... sun; it applies every day when empty",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "end": {
+                    "description": "HH:MM",
+                    "type": "string"
+                },
+                "start": {
+                    "description": "HH:MM",
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_scheduler.ResourceUsage": {
+            "type": "object",
+            "properties": {
+                "peak_rss_bytes": {
+                    "type": "integer"
+                },
+                "read_bytes": {
+                    "description": "Read from storage",
+                    "type": "integer"
+                },
+                "shared": {
+                    "type": "boolean"
+                },
+                "system_cpu_seconds": {
+                    "type": "number"
+                },
+                "unsupported": {
+                    "description": "Only wall time is measured on this platform",
+                    "type": "boolean"
+                },
+                "user_cpu_seconds": {
+                    "type": "number"
+                },
+                "wall_seconds": {
+                    "type": "number"
+                },
+                "write_bytes": {
+                    "description": "Written to storage",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_scheduler.SyncResult": {
+            "type": "object",
+            "properties": {
+                "added": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "conflicts": {
+                    "description": "Portal tasks whose ID is taken by a local-owned task",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "deferred": {
+                    "description": "Changed portal tasks skipped because they are running",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "removed": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "reported": {
+                    "type": "integer"
+                },
+                "updated": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_scheduler.SyncStatus": {
+            "type": "object",
+            "properties": {
+                "agent_id": {
+                    "type": "string"
+                },
+                "interval": {
+                    "type": "string"
+                },
+                "last_error": {
+                    "type": "string"
+                },
+                "last_reported_execution": {
+                    "type": "integer"
+                },
+                "last_result": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.SyncResult"
+                },
+                "last_success": {
+                    "type": "string"
+                },
+                "last_sync": {
+                    "type": "string"
+                },
+                "portal_url": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_scheduler.Task": {
+            "type": "object",
+            "properties": {
+                "blackouts": {
+                    "description": "Blackouts are windows in which the task is not started on schedule,\non top of the global ones unless IgnoreGlobalBlackouts is set",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Blackout"
+                    }
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "enabled": {
+                    "type": "boolean"
+                },
+                "hook": {
+                    "description": "Hook is set while the task has a hook token, with which it can be\ntriggered through /api/v1/hooks/\u003ctoken\u003e. HookParams names the params\na hook request may override.",
+                    "type": "boolean"
+                },
+                "hook_params": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                },
+                "ignore_global_blackouts": {
+                    "type": "boolean"
+                },
+                "last_run": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "next_run": {
+                    "type": "string"
+                },
+                "params": {
+                    "type": "object",
+                    "additionalProperties": true
+                },
+                "schedule": {
+                    "description": "cron-like format",
+                    "type": "string"
+                },
+                "source": {
+                    "description": "local or portal",
+                    "type": "string"
+                },
+                "stalled": {
+                    "description": "Stalled is set while a run has not sent a heartbeat for the stall\ntimeout",
+                    "type": "boolean"
+                },
+                "status": {
+                    "description": "idle, running, failed",
+                    "type": "string"
+                },
+                "type": {
+                    "description": "e.g., \"scan\", \"cleanup\", \"backup\"",
+                    "type": "string"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "version": {
+                    "description": "Version counts changes to the settings of the task, not its runs.\nUpdates that carry a version fail with ErrTaskConflict once the task\nhas changed since it was read.",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_scheduler.TaskExecution": {
+            "type": "object",
+            "properties": {
+                "completed_at": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "result": {
+                    "type": "object",
+                    "additionalProperties": true
+                },
+                "started_at": {
+                    "type": "string"
+                },
+                "status": {
+                    "description": "running, success, failed",
+                    "type": "string"
+                },
+                "task_id": {
+                    "type": "string"
+                },
+                "usage": {
+                    "description": "Set once completed",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.ResourceUsage"
+                        }
+                    ]
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_sharemanager.AccessMode": {
+            "type": "string",
+            "enum": [
+                "ro",
+                "rw"
+            ],
+            "x-enum-varnames": [
+                "AccessModeReadOnly",
+                "AccessModeReadWrite"
+            ]
+        },
+        "github_com_KOPElan_mingyue-agent_internal_sharemanager.Share": {
+            "type": "object",
+            "properties": {
+                "access_mode": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_sharemanager.AccessMode"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "delete_at": {
+                    "description": "DeleteAt is set while the share is pending deletion. It keeps being\nserved until then so live clients are not cut off by mistake.",
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "dlna": {
+                    "description": "Publish to TVs and media players through miniDLNA",
+                    "type": "boolean"
+                },
+                "dlna_media": {
+                    "description": "Index only audio, video or pictures",
+                    "type": "string"
+                },
+                "enabled": {
+                    "type": "boolean"
+                },
+                "groups": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "healthy": {
+                    "type": "boolean"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "imported": {
+                    "description": "Adopted from the existing system configuration",
+                    "type": "boolean"
+                },
+                "last_checked": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "options": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "path": {
+                    "type": "string"
+                },
+                "type": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_sharemanager.ShareType"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_sharemanager.ShareType": {
+            "type": "string",
+            "enum": [
+                "samba",
+                "nfs"
+            ],
+            "x-enum-varnames": [
+                "ShareTypeSamba",
+                "ShareTypeNFS"
+            ]
+        },
+        "github_com_KOPElan_mingyue-agent_internal_telemetry.EndpointStats": {
+            "type": "object",
+            "properties": {
+                "avg_ms": {
+                    "type": "number"
+                },
+                "client_errors": {
+                    "description": "4xx responses",
+                    "type": "integer"
+                },
+                "count": {
+                    "type": "integer"
+                },
+                "last_at": {
+                    "type": "string"
+                },
+                "max_ms": {
+                    "type": "number"
+                },
+                "method": {
+                    "type": "string"
+                },
+                "p50_ms": {
+                    "description": "Estimated from the histogram",
+                    "type": "number"
+                },
+                "p95_ms": {
+                    "type": "number"
+                },
+                "p99_ms": {
+                    "type": "number"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "server_errors": {
+                    "description": "5xx responses",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_telemetry.SpanData": {
+            "type": "object",
+            "properties": {
+                "attributes": {
+                    "type": "object",
+                    "additionalProperties": true
+                },
+                "duration_ms": {
+                    "type": "number"
+                },
+                "end": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "kind": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "parent_id": {
+                    "type": "string"
+                },
+                "span_id": {
+                    "type": "string"
+                },
+                "start": {
+                    "type": "string"
+                },
+                "trace_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_telemetry.Trace": {
+            "type": "object",
+            "properties": {
+                "duration_ms": {
+                    "type": "number"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "spans": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_telemetry.SpanData"
+                    }
+                },
+                "start": {
+                    "type": "string"
+                },
+                "trace_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_thumbnail.ThumbnailInfo": {
+            "type": "object",
+            "properties": {
+                "accessed_at": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "mime_type": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "source_path": {
+                    "type": "string"
+                },
+                "thumb_path": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_wanprobe.History": {
+            "type": "object",
+            "properties": {
+                "probes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.Result"
+                    }
+                },
+                "speedtests": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.SpeedResult"
+                    }
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_wanprobe.Result": {
+            "type": "object",
+            "properties": {
+                "degraded": {
+                    "type": "boolean"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "jitter_ms": {
+                    "type": "number"
+                },
+                "latency_ms": {
+                    "description": "Mean round trip",
+                    "type": "number"
+                },
+                "loss_percent": {
+                    "type": "number"
+                },
+                "max_ms": {
+                    "type": "number"
+                },
+                "method": {
+                    "description": "icmp or tcp",
+                    "type": "string"
+                },
+                "min_ms": {
+                    "type": "number"
+                },
+                "reasons": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "received": {
+                    "type": "integer"
+                },
+                "sent": {
+                    "type": "integer"
+                },
+                "target": {
+                    "type": "string"
+                },
+                "time": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_wanprobe.SpeedResult": {
+            "type": "object",
+            "properties": {
+                "bytes": {
+                    "type": "integer"
+                },
+                "degraded": {
+                    "type": "boolean"
+                },
+                "download_mbps": {
+                    "type": "number"
+                },
+                "duration_ms": {
+                    "type": "integer"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_wanprobe.Status": {
+            "type": "object",
+            "properties": {
+                "degraded": {
+                    "type": "boolean"
+                },
+                "interval_sec": {
+                    "type": "integer"
+                },
+                "speedtest": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.SpeedResult"
+                },
+                "targets": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.Result"
+                    }
+                },
+                "thresholds": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_wanprobe.Thresholds"
+                }
+            }
+        },
+        "github_com_KOPElan_mingyue-agent_internal_wanprobe.Thresholds": {
+            "type": "object",
+            "properties": {
+                "jitter_ms": {
+                    "type": "number"
+                },
+                "latency_ms": {
+                    "type": "number"
+                },
+                "loss_percent": {
+                    "type": "number"
+                },
+                "min_download_mbps": {
+                    "type": "number"
+                }
+            }
+        },
+        "internal_api.AcknowledgeAlertRequest": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.AgentStatus": {
+            "type": "object",
+            "properties": {
+                "hostname": {
+                    "type": "string"
+                },
+                "maintenance": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_maintenance.Status"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "uptime": {
+                    "type": "number"
+                }
+            }
+        },
+        "internal_api.BanIPRequest": {
+            "type": "object",
+            "properties": {
+                "duration": {
+                    "description": "seconds, 0 for a permanent ban",
+                    "type": "integer"
+                },
+                "ip": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.BundleResult": {
+            "type": "object",
+            "properties": {
+                "applied": {
+                    "type": "boolean"
+                },
+                "changes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_bundle.Change"
+                    }
+                }
+            }
+        },
+        "internal_api.Capabilities": {
+            "type": "object",
+            "properties": {
+                "integrations": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "boolean"
+                    }
+                },
+                "mount_options": {
+                    "description": "MountOptions lists the accepted disk mount options when disk\nmanagement is enabled",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_diskmanager.MountOptionSets"
+                        }
+                    ]
+                },
+                "plugins": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "subsystems": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "boolean"
+                    }
+                },
+                "version": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.ConfigChangeDiff": {
+            "type": "object",
+            "properties": {
+                "diff": {
+                    "type": "string"
+                },
+                "files": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "string"
+                },
+                "reason": {
+                    "description": "Why, as given by the client",
+                    "type": "string"
+                },
+                "request_id": {
+                    "type": "string"
+                },
+                "summary": {
+                    "description": "What the agent changed",
+                    "type": "string"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "user": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.CreateSessionRequest": {
+            "type": "object",
+            "properties": {
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.CreateTokenRequest": {
+            "type": "object",
+            "properties": {
+                "expires_in": {
+                    "description": "seconds",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "rate_limit_kbps": {
+                    "description": "File transfer cap, 0 for the agent default",
+                    "type": "integer"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.CreateTokensRequest": {
+            "type": "object",
+            "properties": {
+                "tokens": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_api.CreateTokenRequest"
+                    }
+                }
+            }
+        },
+        "internal_api.DiskSummary": {
+            "type": "object",
+            "properties": {
+                "disks": {
+                    "type": "integer"
+                },
+                "fullest": {
+                    "description": "Fullest is the mounted partition with the highest usage",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_diskmanager.Partition"
+                        }
+                    ]
+                },
+                "mounted": {
+                    "type": "integer"
+                },
+                "partitions": {
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                },
+                "used": {
+                    "type": "integer"
+                },
+                "used_percent": {
+                    "type": "number"
+                }
+            }
+        },
+        "internal_api.GenerateReportRequest": {
+            "type": "object",
+            "properties": {
+                "async": {
+                    "type": "boolean"
+                },
+                "period_hours": {
+                    "type": "number"
+                }
+            }
+        },
+        "internal_api.HookRequest": {
+            "type": "object",
+            "properties": {
+                "params": {
+                    "type": "object",
+                    "additionalProperties": true
+                }
+            }
+        },
+        "internal_api.Overview": {
+            "type": "object",
+            "properties": {
+                "alerts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_alerts.Alert"
+                    }
+                },
+                "disks": {
+                    "$ref": "#/definitions/internal_api.DiskSummary"
+                },
+                "errors": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "shares": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_sharemanager.Share"
+                    }
+                },
+                "stats": {
+                    "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_monitor.SystemStats"
+                },
+                "status": {
+                    "$ref": "#/definitions/internal_api.AgentStatus"
+                },
+                "tasks": {
+                    "$ref": "#/definitions/internal_api.RunningTasks"
+                }
+            }
+        },
+        "internal_api.QueryRequest": {
+            "type": "object",
+            "properties": {
+                "query": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.RefreshSessionRequest": {
+            "type": "object",
+            "properties": {
+                "refresh_token": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.RegistrationInfo": {
+            "type": "object",
+            "properties": {
+                "agent_id": {
+                    "type": "string"
+                },
+                "api_urls": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "hostname": {
+                    "type": "string"
+                },
+                "start_time": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.Response": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string"
+                },
+                "data": {},
+                "details": {},
+                "error": {
+                    "type": "string"
+                },
+                "next_page_token": {
+                    "description": "NextPageToken is set on list responses that have more pages",
+                    "type": "string"
+                },
+                "success": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "internal_api.RevertHistoryRequest": {
+            "type": "object",
+            "properties": {
+                "commit": {
+                    "type": "string"
+                },
+                "paths": {
+                    "description": "Defaults to every file the commit changed",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "internal_api.RunningTasks": {
+            "type": "object",
+            "properties": {
+                "jobs": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_jobs.Job"
+                    }
+                },
+                "scheduled": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_KOPElan_mingyue-agent_internal_scheduler.Task"
+                    }
+                }
+            }
+        },
+        "internal_api.SessionInfo": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "current": {
+                    "description": "The session making the request",
+                    "type": "boolean"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "ip": {
+                    "type": "string"
+                },
+                "last_used": {
+                    "type": "string"
+                },
+                "refresh_expires_at": {
+                    "type": "string"
+                },
+                "refresh_token": {
+                    "description": "Only shown on creation and refresh",
+                    "type": "string"
+                },
+                "token": {
+                    "description": "Only shown on creation and refresh",
+                    "type": "string"
+                },
+                "user_agent": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.SetRsyncUserRequest": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "password": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.SilenceAlertRequest": {
+            "type": "object",
+            "properties": {
+                "duration_min": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.SpeedtestRequest": {
+            "type": "object",
+            "properties": {
+                "async": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "internal_api.TaskHook": {
+            "type": "object",
+            "properties": {
+                "path": {
+                    "type": "string"
+                },
+                "task_id": {
+                    "type": "string"
+                },
+                "token": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.TaskPreview": {
+            "type": "object",
+            "properties": {
+                "runs": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "task_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_api.TokenBundle": {
+            "type": "object",
+            "properties": {
+                "agent": {
+                    "description": "Hostname of the issuing agent",
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "tokens": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_api.TokenBundleEntry"
+                    }
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_api.TokenBundleEntry": {
+            "type": "object",
+            "properties": {
+                "expires_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "rate_limit_kbps": {
+                    "type": "integer"
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "token": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
                 }
             }
         }
@@ -0,0 +1,286 @@
+package advisor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/netmanager"
+	"github.com/KOPElan/mingyue-agent/internal/sharemanager"
+)
+
+// Severity represents how urgently a finding should be addressed
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityLow      Severity = "low"
+	SeverityMedium   Severity = "medium"
+	SeverityHigh     Severity = "high"
+	SeverityCritical Severity = "critical"
+)
+
+var severityRank = map[Severity]int{
+	SeverityCritical: 0,
+	SeverityHigh:     1,
+	SeverityMedium:   2,
+	SeverityLow:      3,
+	SeverityInfo:     4,
+}
+
+// Finding represents a single security issue detected by the advisor
+type Finding struct {
+	ID          string                 `json:"id"`
+	Category    string                 `json:"category"`
+	Severity    Severity               `json:"severity"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Remediation string                 `json:"remediation"`
+	Resource    string                 `json:"resource,omitempty"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+}
+
+// severityPenalty is the number of points a finding deducts from the posture score
+var severityPenalty = map[Severity]int{
+	SeverityCritical: 30,
+	SeverityHigh:     15,
+	SeverityMedium:   8,
+	SeverityLow:      3,
+	SeverityInfo:     0,
+}
+
+// Report is the result of running all advisor checks
+type Report struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Score       int              `json:"score"`
+	Grade       string           `json:"grade"`
+	Summary     map[Severity]int `json:"summary"`
+	Findings    []Finding        `json:"findings"`
+}
+
+// Advisor inspects agent and system configuration for security issues
+type Advisor struct {
+	agent        *config.Config
+	shares       *sharemanager.Manager
+	network      *netmanager.Manager
+	wanInterface string
+	sshdConfig   string
+}
+
+// Config represents security advisor configuration
+type Config struct {
+	Agent        *config.Config
+	Shares       *sharemanager.Manager
+	Network      *netmanager.Manager
+	WANInterface string // Defaults to the interface carrying the default route
+	SSHDConfig   string
+}
+
+// sharePorts lists the TCP ports a share protocol is reachable on
+var sharePorts = map[sharemanager.ShareType][]int{
+	sharemanager.ShareTypeSamba: {445, 139},
+	sharemanager.ShareTypeNFS:   {2049},
+}
+
+// New creates a new security advisor
+func New(cfg *Config) *Advisor {
+	sshdConfig := cfg.SSHDConfig
+	if sshdConfig == "" {
+		sshdConfig = "/etc/ssh/sshd_config"
+	}
+
+	return &Advisor{
+		agent:        cfg.Agent,
+		shares:       cfg.Shares,
+		network:      cfg.Network,
+		wanInterface: cfg.WANInterface,
+		sshdConfig:   sshdConfig,
+	}
+}
+
+// Run executes all checks and returns findings ordered by severity together
+// with a posture score from 0 to 100. When category is not empty only findings
+// in that category are returned and scored.
+func (a *Advisor) Run(ctx context.Context, category string) *Report {
+	checks := []func() []Finding{
+		a.checkAgentConfig,
+		a.checkSocketPermissions,
+		func() []Finding { return a.checkGuestShareExposure(ctx) },
+		a.checkOpenExports,
+		a.checkSSHPasswordAuth,
+	}
+
+	findings := []Finding{}
+	for _, check := range checks {
+		if ctx.Err() != nil {
+			break
+		}
+		findings = append(findings, check()...)
+	}
+
+	if category != "" {
+		filtered := []Finding{}
+		for _, finding := range findings {
+			if finding.Category == category {
+				filtered = append(filtered, finding)
+			}
+		}
+		findings = filtered
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank[findings[i].Severity] < severityRank[findings[j].Severity]
+	})
+
+	score := 100
+	summary := map[Severity]int{}
+	for _, finding := range findings {
+		summary[finding.Severity]++
+		score -= severityPenalty[finding.Severity]
+	}
+	if score < 0 {
+		score = 0
+	}
+
+	return &Report{
+		GeneratedAt: time.Now(),
+		Score:       score,
+		Grade:       grade(score),
+		Summary:     summary,
+		Findings:    findings,
+	}
+}
+
+func grade(score int) string {
+	switch {
+	case score >= 90:
+		return "A"
+	case score >= 75:
+		return "B"
+	case score >= 60:
+		return "C"
+	case score >= 40:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+// checkGuestShareExposure warns about guest-accessible shares whose protocol
+// ports are reachable from the WAN interface
+func (a *Advisor) checkGuestShareExposure(ctx context.Context) []Finding {
+	if a.shares == nil || a.network == nil {
+		return nil
+	}
+
+	guestShares := []*sharemanager.Share{}
+	for _, share := range a.shares.ListShares() {
+		if share.Enabled && share.GuestAccess() {
+			guestShares = append(guestShares, share)
+		}
+	}
+	if len(guestShares) == 0 {
+		return nil
+	}
+
+	wan := a.wanInterface
+	if wan == "" {
+		detected, err := a.network.DefaultRouteInterface()
+		if err != nil {
+			return []Finding{{
+				ID:          "network.wan_unknown",
+				Category:    "network",
+				Severity:    SeverityLow,
+				Title:       "WAN interface could not be determined",
+				Description: fmt.Sprintf("Guest share exposure could not be verified: %v", err),
+				Remediation: "Set network.wan_interface in the agent configuration.",
+			}}
+		}
+		wan = detected
+	}
+
+	wanAddrs := map[string]bool{}
+	if iface, err := a.network.GetInterface(ctx, wan); err == nil {
+		for _, addr := range iface.IPAddresses {
+			wanAddrs[addr] = true
+		}
+	}
+
+	ports, err := a.network.ListListeningPorts(ctx)
+	if err != nil {
+		return []Finding{{
+			ID:          "network.ports_unknown",
+			Category:    "network",
+			Severity:    SeverityLow,
+			Title:       "Listening ports could not be inspected",
+			Description: fmt.Sprintf("Guest share exposure could not be verified: %v", err),
+			Remediation: "Install iproute2 (ss) or net-tools (netstat) on the host.",
+		}}
+	}
+
+	findings := []Finding{}
+	for _, share := range guestShares {
+		for _, port := range sharePorts[share.Type] {
+			if !listensOn(ports, port, wanAddrs) {
+				continue
+			}
+
+			filtered, err := a.network.IsPortFiltered(ctx, wan, port, "tcp")
+			if filtered {
+				continue
+			}
+
+			description := fmt.Sprintf("Share %q allows guest access and %s port %d accepts connections on WAN interface %s.",
+				share.Name, share.Type, port, wan)
+			if err != nil {
+				description += " Firewall rules could not be read, so no filtering is assumed."
+			}
+
+			findings = append(findings, Finding{
+				ID:          "share.guest_wan_exposed",
+				Category:    "shares",
+				Severity:    SeverityCritical,
+				Title:       "Guest share reachable from WAN",
+				Description: description,
+				Remediation: fmt.Sprintf("Disable guest access on share %q or block port %d/tcp on %s.", share.Name, port, wan),
+				Resource:    share.ID,
+				Details: map[string]interface{}{
+					"share":     share.Name,
+					"path":      share.Path,
+					"type":      share.Type,
+					"port":      port,
+					"interface": wan,
+				},
+			})
+			break
+		}
+	}
+
+	return findings
+}
+
+// listensOn reports whether any socket listens on port on a wildcard address
+// or one of the given interface addresses
+func listensOn(ports []netmanager.PortInfo, port int, addrs map[string]bool) bool {
+	for _, p := range ports {
+		if p.Port != port || !strings.HasPrefix(p.Protocol, "tcp") {
+			continue
+		}
+
+		addr := strings.Trim(p.Address, "[]")
+		if i := strings.Index(addr, "%"); i >= 0 {
+			addr = addr[:i]
+		}
+		switch addr {
+		case "", "*", "0.0.0.0", "::":
+			return true
+		}
+		if addrs[addr] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package advisor
+
+import (
+	"testing"
+
+	"github.com/KOPElan/mingyue-agent/internal/netmanager"
+)
+
+func TestListensOn(t *testing.T) {
+	wan := map[string]bool{"203.0.113.5": true, "2001:db8::5": true}
+
+	tests := []struct {
+		name  string
+		ports []netmanager.PortInfo
+		want  bool
+	}{
+		{"none", nil, false},
+		{"ipv4 wildcard", []netmanager.PortInfo{{Protocol: "tcp", Address: "0.0.0.0", Port: 445}}, true},
+		{"ipv6 wildcard", []netmanager.PortInfo{{Protocol: "tcp6", Address: "[::]", Port: 445}}, true},
+		{"wan address", []netmanager.PortInfo{{Protocol: "tcp", Address: "203.0.113.5", Port: 445}}, true},
+		{"wan ipv6 zone", []netmanager.PortInfo{{Protocol: "tcp6", Address: "[2001:db8::5%eth0]", Port: 445}}, true},
+		{"lan address", []netmanager.PortInfo{{Protocol: "tcp", Address: "192.168.1.2", Port: 445}}, false},
+		{"loopback", []netmanager.PortInfo{{Protocol: "tcp", Address: "127.0.0.1", Port: 445}}, false},
+		{"other port", []netmanager.PortInfo{{Protocol: "tcp", Address: "0.0.0.0", Port: 22}}, false},
+		{"udp", []netmanager.PortInfo{{Protocol: "udp", Address: "0.0.0.0", Port: 445}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listensOn(tt.ports, 445, wan); got != tt.want {
+				t.Fatalf("listensOn = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
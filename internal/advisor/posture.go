@@ -0,0 +1,250 @@
+package advisor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/sharemanager"
+)
+
+// checkAgentConfig reports insecure agent configuration settings
+func (a *Advisor) checkAgentConfig() []Finding {
+	if a.agent == nil {
+		return nil
+	}
+
+	findings := []Finding{}
+
+	if a.agent.NetDisk.EncryptionKey == config.DefaultEncryptionKey {
+		findings = append(findings, Finding{
+			ID:          "agent.default_encryption_key",
+			Category:    "agent",
+			Severity:    SeverityCritical,
+			Title:       "Default credential encryption key in use",
+			Description: "Network disk credentials are encrypted with the key shipped in the default configuration, so anyone with the state file can decrypt them.",
+			Remediation: "Set netdisk.encryption_key to a random 32-byte value and re-add network disk credentials.",
+		})
+	}
+
+	if !a.agent.Security.TokenAuth {
+		findings = append(findings, Finding{
+			ID:          "agent.auth_disabled",
+			Category:    "agent",
+			Severity:    SeverityHigh,
+			Title:       "Token authentication disabled",
+			Description: "API requests without a token or session are served, and the caller may name any user in the X-User header.",
+			Remediation: "Set security.token_auth to true so requests without credentials are rejected, and issue API tokens to clients.",
+		})
+	}
+
+	if a.agent.API.EnableHTTP {
+		for _, l := range a.agent.HTTPListeners() {
+			host, _, _ := net.SplitHostPort(l.Addr)
+			if l.TLS() || isLoopback(host) {
+				continue
+			}
+			findings = append(findings, Finding{
+				ID:          "agent.http_without_tls",
+				Category:    "agent",
+				Severity:    SeverityMedium,
+				Title:       "HTTP API served without TLS",
+				Description: fmt.Sprintf("The HTTP API listens on %s without TLS, exposing tokens and file contents on the network.", l.Addr),
+				Remediation: "Configure api.tls_cert and api.tls_key, or listen on 127.0.0.1 only.",
+			})
+			break
+		}
+	}
+
+	if a.agent.FTP.Enabled && !a.agent.FTP.RequireTLS {
+		findings = append(findings, Finding{
+			ID:          "agent.ftp_without_tls",
+			Category:    "agent",
+			Severity:    SeverityMedium,
+			Title:       "FTP logins allowed without TLS",
+			Description: "The FTP drop server accepts the device password in plain text.",
+			Remediation: "Set ftp.require_tls to true if the devices support FTPS.",
+		})
+	}
+
+	if !a.agent.Audit.Enabled {
+		findings = append(findings, Finding{
+			ID:          "agent.audit_disabled",
+			Category:    "agent",
+			Severity:    SeverityMedium,
+			Title:       "Audit logging disabled",
+			Description: "Operations performed through the agent are not recorded.",
+			Remediation: "Set audit.enabled to true.",
+		})
+	}
+
+	if !a.agent.Security.RequireConfirm {
+		findings = append(findings, Finding{
+			ID:          "agent.confirm_disabled",
+			Category:    "agent",
+			Severity:    SeverityLow,
+			Title:       "Dangerous operations do not require confirmation",
+			Description: "Destructive operations such as formatting disks run without an explicit confirmation.",
+			Remediation: "Set security.require_confirm to true.",
+		})
+	}
+
+	return findings
+}
+
+// checkSocketPermissions reports a Unix domain socket writable by any local user
+func (a *Advisor) checkSocketPermissions() []Finding {
+	if a.agent == nil || !a.agent.API.EnableUDS {
+		return nil
+	}
+
+	info, err := os.Stat(a.agent.Server.UDSPath)
+	if err != nil {
+		return nil
+	}
+
+	if info.Mode().Perm()&0002 == 0 {
+		return nil
+	}
+
+	return []Finding{{
+		ID:          "agent.uds_world_writable",
+		Category:    "agent",
+		Severity:    SeverityHigh,
+		Title:       "API socket writable by all local users",
+		Description: fmt.Sprintf("%s has mode %04o, so any local user can issue API requests.", a.agent.Server.UDSPath, info.Mode().Perm()),
+		Remediation: fmt.Sprintf("Restrict the socket with chmod 0660 %s and grant access through its group.", a.agent.Server.UDSPath),
+		Resource:    a.agent.Server.UDSPath,
+	}}
+}
+
+// checkOpenExports reports NFS shares exported to every host
+func (a *Advisor) checkOpenExports() []Finding {
+	if a.shares == nil {
+		return nil
+	}
+
+	findings := []Finding{}
+	for _, share := range a.shares.ListShares() {
+		if !share.Enabled || share.Type != sharemanager.ShareTypeNFS {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			ID:          "share.nfs_export_any_host",
+			Category:    "shares",
+			Severity:    SeverityMedium,
+			Title:       "NFS share exported to any host",
+			Description: fmt.Sprintf("Share %q (%s) is exported to * and can be mounted by every host that reaches port 2049.", share.Name, share.Path),
+			Remediation: "Restrict port 2049/tcp to trusted networks with the host firewall.",
+			Resource:    share.ID,
+		})
+	}
+
+	return findings
+}
+
+// checkSSHPasswordAuth reports an SSH server accepting password logins
+func (a *Advisor) checkSSHPasswordAuth() []Finding {
+	settings, err := readSSHDConfig(a.sshdConfig)
+	if err != nil {
+		// No SSH server configured
+		return nil
+	}
+
+	findings := []Finding{}
+
+	// OpenSSH enables password authentication unless disabled
+	if value, ok := settings["passwordauthentication"]; !ok || value == "yes" {
+		findings = append(findings, Finding{
+			ID:          "system.ssh_password_auth",
+			Category:    "system",
+			Severity:    SeverityHigh,
+			Title:       "SSH password authentication enabled",
+			Description: "The SSH server accepts passwords, which allows brute-force login attempts.",
+			Remediation: fmt.Sprintf("Set PasswordAuthentication no in %s after installing SSH keys, then reload sshd.", a.sshdConfig),
+			Resource:    a.sshdConfig,
+		})
+	}
+
+	if settings["permitrootlogin"] == "yes" {
+		findings = append(findings, Finding{
+			ID:          "system.ssh_root_login",
+			Category:    "system",
+			Severity:    SeverityMedium,
+			Title:       "SSH root login permitted",
+			Description: "The root account can log in over SSH.",
+			Remediation: fmt.Sprintf("Set PermitRootLogin prohibit-password or no in %s.", a.sshdConfig),
+			Resource:    a.sshdConfig,
+		})
+	}
+
+	return findings
+}
+
+// readSSHDConfig returns the effective global sshd settings keyed by lowercase
+// keyword. As in sshd, the first value obtained for a keyword wins and
+// Include directives are expanded in place.
+func readSSHDConfig(path string) (map[string]string, error) {
+	settings := make(map[string]string)
+	if err := parseSSHDConfigFile(path, settings, 0); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func parseSSHDConfigFile(path string, settings map[string]string, depth int) error {
+	if depth > 8 {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		keyword := strings.ToLower(fields[0])
+
+		switch keyword {
+		case "match":
+			// Settings below Match apply to specific connections only
+			return nil
+		case "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join("/etc/ssh", pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					parseSSHDConfigFile(match, settings, depth+1)
+				}
+			}
+		default:
+			if _, exists := settings[keyword]; !exists {
+				settings[keyword] = strings.ToLower(fields[1])
+			}
+		}
+	}
+
+	return nil
+}
+
+func isLoopback(addr string) bool {
+	return addr == "127.0.0.1" || addr == "::1" || addr == "localhost"
+}
@@ -0,0 +1,169 @@
+package advisor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+)
+
+func TestReadSSHDConfig(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sshd_config.d"), 0755)
+	os.WriteFile(filepath.Join(dir, "sshd_config.d", "10-keys.conf"), []byte("PasswordAuthentication no\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "sshd_config.d", "20-root.conf"), []byte("PermitRootLogin yes\nMatch User backup\n  PubkeyAuthentication no\n"), 0644)
+	main := filepath.Join(dir, "sshd_config")
+	os.WriteFile(main, []byte(`# Drop-ins come first so they override the defaults below
+Include `+filepath.Join(dir, "sshd_config.d", "*.conf")+`
+
+  passwordauthentication yes
+PermitRootLogin prohibit-password
+X11Forwarding
+Port 2222
+
+Match Address 10.0.0.0/8
+	PasswordAuthentication yes
+	AllowTcpForwarding YES
+`), 0644)
+
+	settings, err := readSSHDConfig(main)
+	if err != nil {
+		t.Fatalf("readSSHDConfig: %v", err)
+	}
+
+	want := map[string]string{
+		"passwordauthentication": "no",
+		"permitrootlogin":        "yes",
+		"port":                   "2222",
+	}
+	if len(settings) != len(want) {
+		t.Fatalf("expected %v, got %v", want, settings)
+	}
+	for key, value := range want {
+		if settings[key] != value {
+			t.Errorf("%s: expected %q, got %q", key, value, settings[key])
+		}
+	}
+
+	if _, err := readSSHDConfig(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error for a missing config")
+	}
+}
+
+func TestCheckSSHPasswordAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"defaults", "Port 22\n", []string{"system.ssh_password_auth"}},
+		{"keys only", "PasswordAuthentication no\n", nil},
+		{"root with passwords", "PasswordAuthentication yes\nPermitRootLogin yes\n", []string{"system.ssh_password_auth", "system.ssh_root_login"}},
+		{"root with keys", "PasswordAuthentication no\nPermitRootLogin prohibit-password\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sshd_config")
+			os.WriteFile(path, []byte(tt.config), 0644)
+
+			findings := New(&Config{SSHDConfig: path}).checkSSHPasswordAuth()
+			if ids := findingIDs(findings); !equalIDs(ids, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, ids)
+			}
+		})
+	}
+
+	if findings := New(&Config{SSHDConfig: filepath.Join(t.TempDir(), "missing")}).checkSSHPasswordAuth(); len(findings) != 0 {
+		t.Fatalf("expected no findings without an SSH server, got %v", findingIDs(findings))
+	}
+}
+
+func TestRunScore(t *testing.T) {
+	sshd := filepath.Join(t.TempDir(), "sshd_config")
+	os.WriteFile(sshd, []byte("PasswordAuthentication no\n"), 0644)
+
+	secure := func() *config.Config {
+		return &config.Config{
+			Security: config.SecurityConfig{TokenAuth: true, RequireConfirm: true},
+			Audit:    config.AuditConfig{Enabled: true},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(cfg *config.Config)
+		category string
+		score    int
+		grade    string
+		first    string
+	}{
+		{"secure", func(cfg *config.Config) {}, "", 100, "A", ""},
+		{"no confirmation", func(cfg *config.Config) { cfg.Security.RequireConfirm = false }, "", 97, "A", "agent.confirm_disabled"},
+		{"auth disabled", func(cfg *config.Config) { cfg.Security.TokenAuth = false }, "", 85, "B", "agent.auth_disabled"},
+		{"ordered by severity", func(cfg *config.Config) {
+			cfg.Security.RequireConfirm = false
+			cfg.Audit.Enabled = false
+			cfg.NetDisk.EncryptionKey = config.DefaultEncryptionKey
+		}, "", 59, "D", "agent.default_encryption_key"},
+		{"failing grade", func(cfg *config.Config) {
+			cfg.NetDisk.EncryptionKey = config.DefaultEncryptionKey
+			cfg.Security.TokenAuth = false
+			cfg.Security.RequireConfirm = false
+			cfg.Audit.Enabled = false
+			cfg.FTP = config.FTPConfig{Enabled: true}
+			cfg.API.EnableHTTP = true
+			cfg.Server.ListenAddr = "0.0.0.0"
+			cfg.Server.HTTPPort = 8080
+		}, "", 28, "F", "agent.default_encryption_key"},
+		{"other category", func(cfg *config.Config) { cfg.Security.TokenAuth = false }, "system", 100, "A", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := secure()
+			tt.modify(cfg)
+
+			report := New(&Config{Agent: cfg, SSHDConfig: sshd}).Run(context.Background(), tt.category)
+			if report.Score != tt.score || report.Grade != tt.grade {
+				t.Fatalf("expected score %d grade %s, got %d %s with %v", tt.score, tt.grade, report.Score, report.Grade, findingIDs(report.Findings))
+			}
+			first := ""
+			if len(report.Findings) > 0 {
+				first = report.Findings[0].ID
+			}
+			if first != tt.first {
+				t.Fatalf("expected %q first, got %v", tt.first, findingIDs(report.Findings))
+			}
+			total := 0
+			for _, count := range report.Summary {
+				total += count
+			}
+			if total != len(report.Findings) {
+				t.Fatalf("summary %v does not add up to %d findings", report.Summary, len(report.Findings))
+			}
+		})
+	}
+}
+
+func findingIDs(findings []Finding) []string {
+	ids := []string{}
+	for _, finding := range findings {
+		ids = append(ids, finding.ID)
+	}
+	return ids
+}
+
+func equalIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
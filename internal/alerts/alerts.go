@@ -0,0 +1,413 @@
+// Package alerts turns health events into alerts that stay open until the
+// condition clears. Operators can acknowledge an alert or silence it for a
+// while; alerts resolve on their own once the disk, share or mount is
+// healthy again. Alerts survive restarts.
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// Alert sources
+const (
+	SourceSMART    = "smart"     // A disk failed its SMART health check
+	SourceShare    = "share"     // A Samba or NFS share is unhealthy
+	SourceNetDisk  = "netdisk"   // A network mount is unreachable
+	SourceLowSpace = "low_space" // The root filesystem is nearly full
+	SourceWAN      = "wan"       // The internet connection is degraded
+	SourceTask     = "task"      // A scheduled task stopped sending heartbeats
+)
+
+// Severities
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert states
+const (
+	StateActive       = "active"
+	StateAcknowledged = "acknowledged"
+	StateResolved     = "resolved"
+)
+
+var (
+	// ErrNotFound is returned for unknown alert IDs
+	ErrNotFound = errors.New("alert not found")
+	// ErrResolved is returned when acknowledging an alert that has cleared
+	ErrResolved = errors.New("alert is resolved")
+)
+
+// Alert is a condition that needs attention. Its ID is derived from the
+// source and resource, so a condition that recurs reopens the same alert.
+type Alert struct {
+	ID             string    `json:"id"`
+	Source         string    `json:"source"`
+	Resource       string    `json:"resource"`
+	Severity       string    `json:"severity"`
+	Message        string    `json:"message"`
+	State          string    `json:"state"`
+	RaisedAt       time.Time `json:"raised_at"`
+	ResolvedAt     time.Time `json:"resolved_at,omitempty"`
+	AcknowledgedBy string    `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt time.Time `json:"acknowledged_at,omitempty"`
+	SilencedBy     string    `json:"silenced_by,omitempty"`
+	SilencedUntil  time.Time `json:"silenced_until,omitempty"`
+	Occurrences    int       `json:"occurrences"` // Times the condition was raised
+}
+
+// Silenced reports whether notifications for the alert are muted at now
+func (a *Alert) Silenced(now time.Time) bool {
+	return now.Before(a.SilencedUntil)
+}
+
+// Manager tracks alerts raised from events on the bus
+type Manager struct {
+	stateFile      string
+	lowDiskPercent float64
+	retention      time.Duration
+	bus            *events.Bus
+	alerts         map[string]*Alert
+	mu             sync.RWMutex
+	stopCh         chan struct{}
+	wg             sync.WaitGroup
+}
+
+// Config represents alert manager configuration
+type Config struct {
+	StateFile      string
+	LowDiskPercent float64       // Root filesystem usage that raises a low_space alert
+	Retention      time.Duration // How long resolved alerts are kept
+	Bus            *events.Bus
+}
+
+// New creates an alert manager, restoring alerts from StateFile
+func New(cfg *Config) (*Manager, error) {
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "/var/lib/mingyue-agent/alerts.json"
+	}
+
+	lowDiskPercent := cfg.LowDiskPercent
+	if lowDiskPercent == 0 {
+		lowDiskPercent = 90
+	}
+
+	retention := cfg.Retention
+	if retention == 0 {
+		retention = 7 * 24 * time.Hour
+	}
+
+	m := &Manager{
+		stateFile:      stateFile,
+		lowDiskPercent: lowDiskPercent,
+		retention:      retention,
+		bus:            cfg.Bus,
+		alerts:         make(map[string]*Alert),
+		stopCh:         make(chan struct{}),
+	}
+
+	var alerts []*Alert
+	if err := statefile.Read(stateFile, &alerts); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+	for _, alert := range alerts {
+		m.alerts[alert.ID] = alert
+	}
+	return m, nil
+}
+
+// Start watches the bus for disk.smart, share.health, netdisk.health,
+// system.stats, wan.quality, wan.speedtest and task.health events
+func (m *Manager) Start() {
+	if m.bus == nil {
+		return
+	}
+	sub := m.bus.Subscribe(&events.Filter{
+		Types: []string{"disk.smart", "share.health", "netdisk.health", "system.stats", "wan.quality", "wan.speedtest", "task.health"},
+	}, 256)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer sub.Close()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case event, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				m.handle(event)
+			}
+		}
+	}()
+}
+
+// Stop stops watching the bus
+func (m *Manager) Stop() {
+	close(m.stopCh)
+	m.wg.Wait()
+}
+
+// healthEvent holds the fields of the health events the manager reads.
+// Event data is decoded through JSON so that maps and structs look alike.
+type healthEvent struct {
+	Device     string `json:"device"`
+	Model      string `json:"model"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	MountPoint string `json:"mount_point"`
+	Target     string `json:"target"`
+	Message    string `json:"message"`
+	Healthy    bool   `json:"healthy"`
+	Disk       struct {
+		UsedPercent float64 `json:"used_percent"`
+	} `json:"disk"`
+}
+
+func (m *Manager) handle(event *events.Event) {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return
+	}
+	var health healthEvent
+	if err := json.Unmarshal(data, &health); err != nil {
+		return
+	}
+
+	switch event.Type {
+	case "disk.smart":
+		m.Observe(SourceSMART, health.Device, !health.Healthy, SeverityCritical,
+			fmt.Sprintf("disk %s (%s) failed its SMART health check", health.Device, health.Model))
+	case "share.health":
+		m.Observe(SourceShare, health.ID, !health.Healthy, SeverityWarning,
+			fmt.Sprintf("share %s (%s) is unhealthy", health.Name, health.Path))
+	case "netdisk.health":
+		m.Observe(SourceNetDisk, health.ID, !health.Healthy, SeverityWarning,
+			fmt.Sprintf("network disk %s at %s is unreachable", health.Name, health.MountPoint))
+	case "system.stats":
+		// Stats without disk figures carry no information about space
+		if health.Disk.UsedPercent == 0 {
+			return
+		}
+		m.Observe(SourceLowSpace, "/", health.Disk.UsedPercent >= m.lowDiskPercent, SeverityWarning,
+			fmt.Sprintf("root filesystem is %.0f%% full", health.Disk.UsedPercent))
+	case "wan.quality", "wan.speedtest":
+		m.Observe(SourceWAN, health.Target, !health.Healthy, SeverityWarning, health.Message)
+	case "task.health":
+		m.Observe(SourceTask, health.ID, !health.Healthy, SeverityWarning, health.Message)
+	}
+}
+
+// Observe records the current state of a condition. A firing condition
+// raises its alert, or reopens it if it had resolved; a clear condition
+// resolves an open alert. Silenced alerts change state but publish no
+// alert.raised events.
+func (m *Manager) Observe(source, resource string, firing bool, severity, message string) {
+	if resource == "" {
+		return
+	}
+	id := source + ":" + resource
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alert, exists := m.alerts[id]
+	open := exists && alert.State != StateResolved
+
+	var eventType string
+	switch {
+	case firing && open:
+		// Still firing; keep the newest message, such as a fuller disk
+		if alert.Message == message && alert.Severity == severity {
+			return
+		}
+		alert.Message = message
+		alert.Severity = severity
+	case firing:
+		if !exists {
+			alert = &Alert{ID: id, Source: source, Resource: resource}
+			m.alerts[id] = alert
+		}
+		alert.Severity = severity
+		alert.Message = message
+		alert.State = StateActive
+		alert.RaisedAt = now
+		alert.ResolvedAt = time.Time{}
+		alert.AcknowledgedBy = ""
+		alert.AcknowledgedAt = time.Time{}
+		alert.Occurrences++
+		if !alert.Silenced(now) {
+			eventType = "alert.raised"
+		}
+	case open:
+		alert.State = StateResolved
+		alert.ResolvedAt = now
+		eventType = "alert.resolved"
+	default:
+		return
+	}
+
+	m.prune(now)
+	if err := m.save(); err != nil {
+		// The alert is still tracked in memory until the next save
+		log.Printf("warning: save alerts: %v", err)
+	}
+	if eventType != "" {
+		m.bus.Publish(eventType, *alert)
+	}
+}
+
+// List returns open alerts, newest first. With includeResolved, alerts that
+// resolved within the retention period are listed too.
+func (m *Manager) List(includeResolved bool) []*Alert {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	alerts := []*Alert{}
+	for _, alert := range m.alerts {
+		if alert.State == StateResolved && !includeResolved {
+			continue
+		}
+		listed := *alert
+		alerts = append(alerts, &listed)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].RaisedAt.Equal(alerts[j].RaisedAt) {
+			return alerts[i].RaisedAt.After(alerts[j].RaisedAt)
+		}
+		return alerts[i].ID < alerts[j].ID
+	})
+	return alerts
+}
+
+// Get returns an alert by ID
+func (m *Manager) Get(id string) (*Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	alert, ok := m.alerts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *alert
+	return &found, nil
+}
+
+// Acknowledge marks an open alert as seen by user. It stays listed until
+// the condition clears.
+func (m *Manager) Acknowledge(id, user string) (*Alert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alert, ok := m.alerts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if alert.State == StateResolved {
+		return nil, ErrResolved
+	}
+
+	updated := *alert
+	updated.State = StateAcknowledged
+	updated.AcknowledgedBy = user
+	updated.AcknowledgedAt = time.Now()
+	if err := m.update(&updated); err != nil {
+		return nil, err
+	}
+
+	m.bus.Publish("alert.acknowledged", updated)
+	return &updated, nil
+}
+
+// Silence mutes an alert for duration, including when it resolves and
+// recurs in the meantime. A zero duration lifts the silence.
+func (m *Manager) Silence(id, user string, duration time.Duration) (*Alert, error) {
+	if duration < 0 {
+		return nil, fmt.Errorf("duration must not be negative")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	alert, ok := m.alerts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	updated := *alert
+	if duration == 0 {
+		updated.SilencedBy = ""
+		updated.SilencedUntil = time.Time{}
+	} else {
+		updated.SilencedBy = user
+		updated.SilencedUntil = time.Now().Add(duration)
+	}
+	if err := m.update(&updated); err != nil {
+		return nil, err
+	}
+
+	m.bus.Publish("alert.silenced", updated)
+	return &updated, nil
+}
+
+// update replaces an alert and saves the state, restoring the previous
+// alert if saving fails. The caller holds m.mu.
+func (m *Manager) update(alert *Alert) error {
+	previous := m.alerts[alert.ID]
+	stored := *alert
+	m.alerts[alert.ID] = &stored
+	if err := m.save(); err != nil {
+		m.alerts[alert.ID] = previous
+		return err
+	}
+	return nil
+}
+
+// prune drops resolved alerts older than the retention period unless they
+// are still silenced. The caller holds m.mu.
+func (m *Manager) prune(now time.Time) {
+	for id, alert := range m.alerts {
+		if alert.State == StateResolved && now.Sub(alert.ResolvedAt) > m.retention && !alert.Silenced(now) {
+			delete(m.alerts, id)
+		}
+	}
+}
+
+// save writes all alerts to the state file. The caller holds m.mu.
+func (m *Manager) save() error {
+	if err := os.MkdirAll(filepath.Dir(m.stateFile), 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	alerts := make([]*Alert, 0, len(m.alerts))
+	for _, alert := range m.alerts {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].ID < alerts[j].ID })
+
+	data, err := json.MarshalIndent(alerts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := statefile.Write(m.stateFile, data, statefile.PrivateMode); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
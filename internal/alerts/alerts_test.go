@@ -0,0 +1,107 @@
+package alerts
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+func TestAlertLifecycle(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "alerts.json")
+	bus := events.NewBus(100)
+	sub := bus.Subscribe(&events.Filter{Types: []string{"alert.*"}}, 16)
+	defer sub.Close()
+
+	m, err := New(&Config{StateFile: stateFile, Bus: bus})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	m.handle(&events.Event{Type: "disk.smart", Data: map[string]interface{}{
+		"device": "/dev/sda", "model": "WD Red", "healthy": false,
+	}})
+	listed := m.List(false)
+	if len(listed) != 1 || listed[0].ID != "smart:/dev/sda" || listed[0].State != StateActive {
+		t.Fatalf("expected an active SMART alert, got %+v", listed)
+	}
+	if event := <-sub.C; event.Type != "alert.raised" {
+		t.Fatalf("expected alert.raised, got %s", event.Type)
+	}
+
+	acked, err := m.Acknowledge("smart:/dev/sda", "admin")
+	if err != nil {
+		t.Fatalf("Acknowledge: %v", err)
+	}
+	if acked.State != StateAcknowledged || acked.AcknowledgedBy != "admin" {
+		t.Fatalf("unexpected acknowledged alert: %+v", acked)
+	}
+	<-sub.C
+
+	// Restarts keep the acknowledgment
+	reloaded, err := New(&Config{StateFile: stateFile})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if alert, err := reloaded.Get("smart:/dev/sda"); err != nil || alert.State != StateAcknowledged {
+		t.Fatalf("expected acknowledged alert after reload, got %+v, %v", alert, err)
+	}
+
+	m.handle(&events.Event{Type: "disk.smart", Data: map[string]interface{}{
+		"device": "/dev/sda", "healthy": true,
+	}})
+	if len(m.List(false)) != 0 || len(m.List(true)) != 1 {
+		t.Fatalf("expected the alert to resolve")
+	}
+	if event := <-sub.C; event.Type != "alert.resolved" {
+		t.Fatalf("expected alert.resolved, got %s", event.Type)
+	}
+	if _, err := m.Acknowledge("smart:/dev/sda", "admin"); !errors.Is(err, ErrResolved) {
+		t.Fatalf("expected ErrResolved, got %v", err)
+	}
+	if _, err := m.Acknowledge("smart:/dev/sdb", "admin"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSilencedAlertRecursQuietly(t *testing.T) {
+	bus := events.NewBus(100)
+	m, err := New(&Config{StateFile: filepath.Join(t.TempDir(), "alerts.json"), LowDiskPercent: 80, Bus: bus})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stats := func(usedPercent float64) *events.Event {
+		return &events.Event{Type: "system.stats", Data: map[string]interface{}{
+			"disk": map[string]interface{}{"used_percent": usedPercent},
+		}}
+	}
+	m.handle(stats(50))
+	if len(m.List(true)) != 0 {
+		t.Fatalf("expected no alert below the threshold")
+	}
+	m.handle(stats(85))
+	if _, err := m.Silence("low_space:/", "admin", time.Hour); err != nil {
+		t.Fatalf("Silence: %v", err)
+	}
+	m.handle(stats(70))
+
+	sub := bus.Subscribe(&events.Filter{Types: []string{"alert.raised"}}, 16)
+	defer sub.Close()
+	m.handle(stats(95))
+
+	alert, err := m.Get("low_space:/")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if alert.State != StateActive || alert.Occurrences != 2 || !alert.Silenced(time.Now()) {
+		t.Fatalf("expected a silenced recurrence, got %+v", alert)
+	}
+	select {
+	case event := <-sub.C:
+		t.Fatalf("silenced alert published %s", event.Type)
+	default:
+	}
+}
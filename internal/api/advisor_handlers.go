@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/advisor"
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+// AdvisorHandlers provides HTTP handlers for the security advisor
+type AdvisorHandlers struct {
+	advisor *advisor.Advisor
+	audit   *audit.Logger
+}
+
+// NewAdvisorHandlers creates a new security advisor handlers instance
+func NewAdvisorHandlers(adv *advisor.Advisor, auditLogger *audit.Logger) *AdvisorHandlers {
+	return &AdvisorHandlers{
+		advisor: adv,
+		audit:   auditLogger,
+	}
+}
+
+func (h *AdvisorHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/security/advisor", h.GetReport)
+}
+
+// GetReport handles GET /api/v1/security/advisor
+func (h *AdvisorHandlers) GetReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	category := r.URL.Query().Get("category")
+	report := h.advisor.Run(r.Context(), category)
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "security.advisor",
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"category": category,
+				"findings": len(report.Findings),
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+	})
+}
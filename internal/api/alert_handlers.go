@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/alerts"
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+// AlertHandlers provides HTTP handlers for the alert center
+type AlertHandlers struct {
+	manager *alerts.Manager
+	audit   *audit.Logger
+}
+
+// NewAlertHandlers creates a new alert handlers instance
+func NewAlertHandlers(manager *alerts.Manager, auditLogger *audit.Logger) *AlertHandlers {
+	return &AlertHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+func (h *AlertHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/alerts", h.ListAlerts)
+	mux.HandleFunc("/api/v1/alerts/ack", h.AcknowledgeAlert)
+	mux.HandleFunc("/api/v1/alerts/silence", h.SilenceAlert)
+}
+
+// ListAlerts godoc
+// @Summary List alerts
+// @Description Lists open alerts, newest first; include_resolved=true also lists recently resolved ones
+// @Tags alerts
+// @Produce json
+// @Param include_resolved query bool false "Include resolved alerts"
+// @Param limit query int false "Page size"
+// @Param page_token query string false "Token of the page to return"
+// @Success 200 {object} Response{data=[]alerts.Alert}
+// @Router /alerts [get]
+func (h *AlertHandlers) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	includeResolved := r.URL.Query().Get("include_resolved") == "true"
+	writePage(w, h.manager.List(includeResolved), page)
+}
+
+// AcknowledgeAlertRequest acknowledges an open alert
+type AcknowledgeAlertRequest struct {
+	ID string `json:"id"`
+}
+
+// AcknowledgeAlert godoc
+// @Summary Acknowledge an alert
+// @Description Marks an open alert as seen; it stays listed until the condition clears
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param request body AcknowledgeAlertRequest true "Alert to acknowledge"
+// @Success 200 {object} Response{data=alerts.Alert}
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Router /alerts/ack [post]
+func (h *AlertHandlers) AcknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req AcknowledgeAlertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.ID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "id is required",
+		})
+		return
+	}
+
+	alert, err := h.manager.Acknowledge(req.ID, getUser(r))
+	h.logAlert(r, "alert.acknowledge", req.ID, err, nil)
+	if err != nil {
+		writeJSON(w, alertErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    alert,
+	})
+}
+
+// SilenceAlertRequest mutes an alert for DurationMin minutes; 0 lifts the
+// silence
+type SilenceAlertRequest struct {
+	ID          string `json:"id"`
+	DurationMin int    `json:"duration_min"`
+}
+
+// SilenceAlert godoc
+// @Summary Silence an alert
+// @Description Mutes an alert for a period, including recurrences; a duration of 0 lifts the silence
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param request body SilenceAlertRequest true "Alert and silence duration"
+// @Success 200 {object} Response{data=alerts.Alert}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /alerts/silence [post]
+func (h *AlertHandlers) SilenceAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req SilenceAlertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.ID == "" || req.DurationMin < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "id is required and duration_min must not be negative",
+		})
+		return
+	}
+
+	duration := time.Duration(req.DurationMin) * time.Minute
+	alert, err := h.manager.Silence(req.ID, getUser(r), duration)
+	action := "alert.silence"
+	if req.DurationMin == 0 {
+		action = "alert.unsilence"
+	}
+	h.logAlert(r, action, req.ID, err, map[string]interface{}{"duration_min": req.DurationMin})
+	if err != nil {
+		writeJSON(w, alertErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    alert,
+	})
+}
+
+func (h *AlertHandlers) logAlert(r *http.Request, action, id string, err error, details map[string]interface{}) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      getUser(r),
+		Action:    action,
+		Resource:  id,
+		Result:    "success",
+		SourceIP:  r.RemoteAddr,
+		Details:   details,
+	}
+	if err != nil {
+		entry.Result = "error"
+		if entry.Details == nil {
+			entry.Details = map[string]interface{}{}
+		}
+		entry.Details["error"] = err.Error()
+	}
+	h.audit.Log(r.Context(), entry)
+}
+
+// alertErrorStatus maps alert errors to HTTP status codes
+func alertErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, alerts.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, alerts.ErrResolved):
+		return http.StatusConflict
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
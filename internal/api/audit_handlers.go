@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+// AuditHandlers provides HTTP handlers for querying the audit log
+type AuditHandlers struct {
+	audit *audit.Logger
+}
+
+// NewAuditHandlers creates a new audit handlers instance
+func NewAuditHandlers(auditLogger *audit.Logger) *AuditHandlers {
+	return &AuditHandlers{
+		audit: auditLogger,
+	}
+}
+
+func (h *AuditHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/audit/query", h.Query)
+}
+
+// Query handles GET /api/v1/audit/query
+func (h *AuditHandlers) Query(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.QueryFilter{
+		User:         query.Get("user"),
+		Impersonator: query.Get("impersonator"),
+		Action:       query.Get("action"),
+		Resource:     query.Get("resource"),
+		Result:       query.Get("result"),
+	}
+
+	// Fetch one entry past the page to know whether another page follows
+	filter.Limit = page.offset + page.limit + 1
+
+	for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid " + param + ": expected RFC3339 timestamp",
+			})
+			return
+		}
+		*target = parsed
+	}
+
+	entries, err := h.audit.Query(filter)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "failed to query audit log: " + err.Error(),
+		})
+		return
+	}
+
+	writePage(w, entries, page)
+}
@@ -2,6 +2,8 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -23,23 +25,76 @@ func NewAuthHandlers(authMgr *auth.AuthManager, auditLogger *audit.Logger) *Auth
 
 func (h *AuthHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/auth/tokens/create", h.CreateToken)
+	mux.HandleFunc("/api/v1/auth/tokens/bulk", h.CreateTokens)
 	mux.HandleFunc("/api/v1/auth/tokens", h.ListTokens)
 	mux.HandleFunc("/api/v1/auth/tokens/revoke", h.RevokeToken)
+	mux.HandleFunc("/api/v1/auth/sessions", h.ListSessions)
 	mux.HandleFunc("/api/v1/auth/sessions/create", h.CreateSession)
+	mux.HandleFunc("/api/v1/auth/sessions/refresh", h.RefreshSession)
 	mux.HandleFunc("/api/v1/auth/sessions/revoke", h.RevokeSession)
+	mux.HandleFunc("/api/v1/auth/sessions/revoke-others", h.RevokeOtherSessions)
+	mux.HandleFunc("/api/v1/auth/bans", h.ListBans)
+	mux.HandleFunc("/api/v1/auth/bans/add", h.BanIP)
+	mux.HandleFunc("/api/v1/auth/bans/remove", h.UnbanIP)
 }
 
 type CreateTokenRequest struct {
-	UserID    string   `json:"user_id"`
-	Name      string   `json:"name"`
-	Scopes    []string `json:"scopes"`
-	ExpiresIn int      `json:"expires_in"` // seconds
+	UserID        string   `json:"user_id"`
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresIn     int      `json:"expires_in"`      // seconds
+	RateLimitKBps int      `json:"rate_limit_kbps"` // File transfer cap, 0 for the agent default
+}
+
+// maxBulkTokens bounds a single bulk token request
+const maxBulkTokens = 100
+
+// CreateTokensRequest provisions several tokens, typically service accounts
+// such as "monitoring" or "backup-agent" with their own scopes
+type CreateTokensRequest struct {
+	Tokens []CreateTokenRequest `json:"tokens"`
+}
+
+// TokenBundle is the machine-readable result of a bulk request. It holds the
+// only copy of the token secrets.
+type TokenBundle struct {
+	Version   int                `json:"version"`
+	Agent     string             `json:"agent"` // Hostname of the issuing agent
+	CreatedAt time.Time          `json:"created_at"`
+	Tokens    []TokenBundleEntry `json:"tokens"`
+}
+
+// TokenBundleEntry is one provisioned token
+type TokenBundleEntry struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	Name          string    `json:"name"`
+	Scopes        []string  `json:"scopes"`
+	Token         string    `json:"token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	RateLimitKBps int       `json:"rate_limit_kbps,omitempty"`
 }
 
 type CreateSessionRequest struct {
 	UserID string `json:"user_id"`
 }
 
+type RefreshSessionRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SessionInfo is a session as listed for device management
+type SessionInfo struct {
+	*auth.Session
+	Current bool `json:"current"` // The session making the request
+}
+
+type BanIPRequest struct {
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"` // seconds, 0 for a permanent ban
+}
+
 // CreateToken godoc
 // @Summary Create API token
 // @Description Creates a new API token for authentication
@@ -64,14 +119,24 @@ func (h *AuthHandlers) CreateToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	expiresAt := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
-	if req.ExpiresIn == 0 {
-		expiresAt = time.Now().Add(365 * 24 * time.Hour) // Default 1 year
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error(), Code: "invalid_scope"})
+		return
+	}
+	if req.RateLimitKBps < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "rate_limit_kbps must not be negative"})
+		return
 	}
 
-	token, err := h.auth.CreateToken(req.UserID, req.Name, req.Scopes, expiresAt)
+	tokens, err := h.auth.CreateTokens(r.Context(), []auth.TokenSpec{{
+		UserID:        req.UserID,
+		Name:          req.Name,
+		Scopes:        req.Scopes,
+		ExpiresAt:     tokenExpiry(req.ExpiresIn),
+		RateLimitKBps: req.RateLimitKBps,
+	}})
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -86,7 +151,7 @@ func (h *AuthHandlers) CreateToken(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	writeJSON(w, http.StatusOK, Response{Success: true, Data: token})
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: tokens[0]})
 }
 
 // ListTokens godoc
@@ -106,6 +171,11 @@ func (h *AuthHandlers) ListTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
 		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "user_id required"})
@@ -118,7 +188,187 @@ func (h *AuthHandlers) ListTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, Response{Success: true, Data: tokens})
+	writePage(w, tokens, page)
+}
+
+// CreateTokens godoc
+// @Summary Provision API tokens in bulk
+// @Description Creates several tokens at once and returns them as a bundle. Either all tokens are created or none are.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body CreateTokensRequest true "Tokens to create"
+// @Success 200 {object} Response{data=TokenBundle}
+// @Failure 400 {object} Response
+// @Failure 500 {object} Response
+// @Router /auth/tokens/bulk [post]
+// @Security UserAuth
+func (h *AuthHandlers) CreateTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req CreateTokensRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+	if len(req.Tokens) == 0 || len(req.Tokens) > maxBulkTokens {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   fmt.Sprintf("between 1 and %d tokens required", maxBulkTokens),
+		})
+		return
+	}
+
+	specs := make([]auth.TokenSpec, 0, len(req.Tokens))
+	names := make(map[string]bool, len(req.Tokens))
+	for i, t := range req.Tokens {
+		if t.UserID == "" || t.Name == "" {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("token %d: user_id and name required", i),
+			})
+			return
+		}
+		key := t.UserID + "/" + t.Name
+		if names[key] {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("token %d: duplicate name %q for user %q", i, t.Name, t.UserID),
+			})
+			return
+		}
+		names[key] = true
+		if t.RateLimitKBps < 0 {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("token %d: rate_limit_kbps must not be negative", i),
+			})
+			return
+		}
+		if err := auth.ValidateScopes(t.Scopes); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("token %d: %v", i, err),
+				Code:    "invalid_scope",
+			})
+			return
+		}
+		specs = append(specs, auth.TokenSpec{
+			UserID:        t.UserID,
+			Name:          t.Name,
+			Scopes:        t.Scopes,
+			ExpiresAt:     tokenExpiry(t.ExpiresIn),
+			RateLimitKBps: t.RateLimitKBps,
+		})
+	}
+
+	tokens, err := h.auth.CreateTokens(r.Context(), specs)
+	if err != nil {
+		if h.audit != nil {
+			h.audit.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      getUser(r),
+				Action:    "create_tokens",
+				Resource:  "auth",
+				Result:    "error",
+				SourceIP:  r.RemoteAddr,
+				Details:   map[string]interface{}{"count": len(specs), "error": err.Error()},
+			})
+		}
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	hostname, _ := getHostname()
+	bundle := TokenBundle{
+		Version:   1,
+		Agent:     hostname,
+		CreatedAt: time.Now().UTC(),
+		Tokens:    make([]TokenBundleEntry, 0, len(tokens)),
+	}
+	ids := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		bundle.Tokens = append(bundle.Tokens, TokenBundleEntry{
+			ID:            token.ID,
+			UserID:        token.UserID,
+			Name:          token.Name,
+			Scopes:        token.Scopes,
+			Token:         token.Token,
+			ExpiresAt:     token.ExpiresAt,
+			RateLimitKBps: token.RateLimitKBps,
+		})
+		ids = append(ids, token.ID)
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "create_tokens",
+			Resource:  "auth",
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details:   map[string]interface{}{"count": len(tokens), "token_ids": ids},
+		})
+	}
+
+	// The bundle carries secrets; keep it out of caches
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: bundle})
+}
+
+// RevokeOtherSessions godoc
+// @Summary Revoke other sessions
+// @Description Revokes every session of a user except the one making the request
+// @Tags auth
+// @Produce json
+// @Param user_id query string false "User ID (default: the caller)"
+// @Success 200 {object} Response
+// @Failure 500 {object} Response
+// @Router /auth/sessions/revoke-others [post]
+// @Security UserAuth
+func (h *AuthHandlers) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		userID = getUser(r)
+	}
+
+	revoked, err := h.auth.RevokeOtherSessions(r.Context(), userID, r.Header.Get(sessionHeader))
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "revoke_other_sessions",
+			Resource:  userID,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details:   map[string]interface{}{"revoked": revoked},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: map[string]interface{}{"revoked": revoked}})
+}
+
+// tokenExpiry turns a lifetime in seconds into an expiry time, defaulting
+// to one year
+func tokenExpiry(expiresIn int) time.Time {
+	if expiresIn == 0 {
+		return time.Now().Add(365 * 24 * time.Hour)
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
 }
 
 // RevokeToken godoc
@@ -144,8 +394,8 @@ func (h *AuthHandlers) RevokeToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.auth.RevokeToken(tokenID); err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	if err := h.auth.RevokeToken(r.Context(), tokenID); err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -185,10 +435,9 @@ func (h *AuthHandlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	expiresAt := time.Now().Add(24 * time.Hour) // 24 hour session
-	session, err := h.auth.CreateSession(req.UserID, r.RemoteAddr, r.UserAgent(), expiresAt)
+	session, err := h.auth.CreateSession(r.Context(), req.UserID, r.RemoteAddr, r.UserAgent())
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -203,9 +452,109 @@ func (h *AuthHandlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: session})
+}
+
+// RefreshSession godoc
+// @Summary Refresh session
+// @Description Trades a refresh token for a new session token and refresh token
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body RefreshSessionRequest true "Refresh request"
+// @Success 200 {object} Response{data=auth.Session}
+// @Failure 400 {object} Response
+// @Failure 401 {object} Response
+// @Failure 500 {object} Response
+// @Router /auth/sessions/refresh [post]
+func (h *AuthHandlers) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req RefreshSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "refresh_token required"})
+		return
+	}
+
+	session, err := h.auth.RefreshSession(r.Context(), req.RefreshToken, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		status := errorStatus(err, http.StatusInternalServerError)
+		code := ""
+		switch {
+		case errors.Is(err, auth.ErrRefreshTokenReused):
+			status, code = http.StatusUnauthorized, "refresh_token_reused"
+		case errors.Is(err, auth.ErrInvalidRefreshToken):
+			status, code = http.StatusUnauthorized, "invalid_refresh_token"
+		}
+		if h.audit != nil && code != "" {
+			h.audit.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      "anonymous",
+				Action:    "refresh_session",
+				Resource:  "auth",
+				Result:    "failed",
+				SourceIP:  r.RemoteAddr,
+				Details:   map[string]interface{}{"error": err.Error()},
+			})
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error(), Code: code})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      session.UserID,
+			Action:    "refresh_session",
+			Resource:  session.ID,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
 	writeJSON(w, http.StatusOK, Response{Success: true, Data: session})
 }
 
+// ListSessions godoc
+// @Summary List sessions
+// @Description Lists the sessions of a user, most recently used first
+// @Tags auth
+// @Produce json
+// @Param user_id query string false "User ID (default: the caller)"
+// @Success 200 {object} Response{data=[]SessionInfo}
+// @Router /auth/sessions [get]
+// @Security UserAuth
+func (h *AuthHandlers) ListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		userID = getUser(r)
+	}
+
+	current := r.Header.Get(sessionHeader)
+	sessions := h.auth.ListSessions(userID)
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, SessionInfo{Session: session, Current: session.ID == current})
+	}
+
+	writePage(w, infos, page)
+}
+
 // RevokeSession godoc
 // @Summary Revoke session
 // @Description Revokes a user session
@@ -229,8 +578,8 @@ func (h *AuthHandlers) RevokeSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.auth.RevokeSession(sessionID); err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	if err := h.auth.RevokeSession(r.Context(), sessionID); err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -246,3 +595,113 @@ func (h *AuthHandlers) RevokeSession(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, Response{Success: true})
 }
+
+// ListBans godoc
+// @Summary List banned IPs
+// @Description Lists source IPs currently banned from the API
+// @Tags auth
+// @Produce json
+// @Success 200 {object} Response{data=[]auth.Ban}
+// @Router /auth/bans [get]
+// @Security UserAuth
+func (h *AuthHandlers) ListBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	writePage(w, h.auth.ListBans(), page)
+}
+
+// BanIP godoc
+// @Summary Ban IP
+// @Description Bans a source IP from the API, permanently when no duration is given
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body BanIPRequest true "Ban request"
+// @Success 200 {object} Response{data=auth.Ban}
+// @Failure 400 {object} Response
+// @Router /auth/bans/add [post]
+// @Security UserAuth
+func (h *AuthHandlers) BanIP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req BanIPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Duration < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "duration must not be negative"})
+		return
+	}
+
+	ban, err := h.auth.BanIP(req.IP, req.Reason, getUser(r), time.Duration(req.Duration)*time.Second)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			User:     getUser(r),
+			Action:   "ban_ip",
+			Resource: req.IP,
+			Result:   "success",
+			SourceIP: r.RemoteAddr,
+			Details:  map[string]interface{}{"reason": req.Reason, "duration": req.Duration},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: ban})
+}
+
+// UnbanIP godoc
+// @Summary Unban IP
+// @Description Lifts the ban on a source IP
+// @Tags auth
+// @Produce json
+// @Param ip query string true "IP address"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /auth/bans/remove [delete]
+// @Security UserAuth
+func (h *AuthHandlers) UnbanIP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ip required"})
+		return
+	}
+
+	if err := h.auth.UnbanIP(ip); err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			User:     getUser(r),
+			Action:   "unban_ip",
+			Resource: ip,
+			Result:   "success",
+			SourceIP: r.RemoteAddr,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
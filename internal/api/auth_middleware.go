@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+)
+
+// sessionHeader carries the ID of the session a request was authenticated
+// with
+const sessionHeader = "X-Session-ID"
+
+// tokenContextKey carries the API token a request was authenticated with
+type tokenContextKey struct{}
+
+// requestToken returns the API token r was authenticated with, or nil for
+// sessions and unauthenticated requests
+func requestToken(r *http.Request) *auth.Token {
+	token, _ := r.Context().Value(tokenContextKey{}).(*auth.Token)
+	return token
+}
+
+// impersonateHeader names the user an administrator acts as. The caller
+// needs a token granted the auth:impersonate scope.
+const impersonateHeader = "X-Impersonate-User"
+
+// AuthGuard rejects requests from banned source IPs and validates bearer
+// tokens, X-API-Key credentials or basic authentication passwords when
+// present. When the auth manager requires authentication, requests without
+// credentials are rejected except on openPath routes. Rejected requests
+// count towards the automatic ban threshold of the auth manager; successful
+// ones identify the caller through the X-User header. Tokens with scopes
+// must hold the scope that routeScopes requires for the route. Callers
+// whose token grants auth:impersonate act as the user in
+// X-Impersonate-User, and audit entries name both users. Requests over the
+// Unix socket without credentials are served as the local user who
+// connected if LocalTrust trusts that user.
+func AuthGuard(authMgr *auth.AuthManager, auditLogger *audit.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+
+		if ban, banned := authMgr.IsBanned(ip); banned {
+			writeJSON(w, http.StatusForbidden, Response{
+				Success: false,
+				Error:   "source address is banned",
+				Code:    "ip_banned",
+				Details: map[string]interface{}{"expires_at": ban.ExpiresAt},
+			})
+			return
+		}
+
+		// Only set below, for requests authenticated with a session
+		r.Header.Del(sessionHeader)
+
+		// Office suites send their WOPI access token as a bearer token,
+		// which the WOPI handlers check themselves
+		if strings.HasPrefix(r.URL.Path, wopiPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		credential := r.Header.Get("X-API-Key")
+		if header := r.Header.Get("Authorization"); header != "" {
+			credential = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		}
+		// WebDAV clients send it as the password of basic authentication
+		if _, password, ok := r.BasicAuth(); ok {
+			credential = password
+		}
+		impersonate := r.Header.Get(impersonateHeader)
+		if peer, ok := localPeer(r); ok && peer.Trusted && credential == "" && impersonate == "" {
+			trustLocal(r, peer)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if credential == "" {
+			if impersonate != "" {
+				writeJSON(w, http.StatusUnauthorized, Response{
+					Success: false,
+					Error:   "impersonation requires credentials",
+				})
+				return
+			}
+			if authMgr.RequireAuth() && !openPath(r.URL.Path) {
+				// WebDAV clients send a first request without credentials
+				// to be challenged
+				if strings.HasPrefix(r.URL.Path, webdavPath) {
+					w.Header().Set("WWW-Authenticate", webdavChallenge)
+				} else {
+					recordAuthFailure(authMgr, auditLogger, r, ip)
+				}
+				writeJSON(w, http.StatusUnauthorized, Response{
+					Success: false,
+					Error:   "authentication required",
+					Code:    "auth_required",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID := ""
+		var scopes []string
+		if token, err := authMgr.ValidateToken(credential); err == nil {
+			userID = token.UserID
+			scopes = token.Scopes
+			r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token))
+		} else if session, err := authMgr.ValidateSession(r.Context(), credential); err == nil {
+			userID = session.UserID
+			r.Header.Set(sessionHeader, session.ID)
+		}
+
+		if userID == "" {
+			recordAuthFailure(authMgr, auditLogger, r, ip)
+
+			if strings.HasPrefix(r.URL.Path, webdavPath) {
+				w.Header().Set("WWW-Authenticate", webdavChallenge)
+			}
+			writeJSON(w, http.StatusUnauthorized, Response{
+				Success: false,
+				Error:   "invalid credentials",
+			})
+			return
+		}
+
+		authMgr.RecordAuthSuccess(ip)
+
+		// Sessions and tokens created without scopes have full access
+		if required := requiredScope(r); len(scopes) > 0 && !auth.Grants(scopes, required) {
+			if auditLogger != nil {
+				auditLogger.Log(r.Context(), &audit.Entry{
+					Timestamp: time.Now(),
+					User:      userID,
+					Action:    "auth.denied",
+					Resource:  r.URL.Path,
+					Result:    "failed",
+					SourceIP:  r.RemoteAddr,
+					Details:   map[string]interface{}{"required_scope": required},
+				})
+			}
+			writeJSON(w, http.StatusForbidden, Response{
+				Success: false,
+				Error:   "token lacks the required scope",
+				Code:    "insufficient_scope",
+				Details: map[string]interface{}{"required_scope": required},
+			})
+			return
+		}
+
+		if impersonate != "" {
+			// Unlike route scopes, sessions and unscoped tokens do not get
+			// it implicitly
+			if !auth.Grants(scopes, auth.ScopeImpersonate) {
+				writeJSON(w, http.StatusForbidden, Response{
+					Success: false,
+					Error:   "token lacks the required scope",
+					Code:    "insufficient_scope",
+					Details: map[string]interface{}{"required_scope": auth.ScopeImpersonate},
+				})
+				return
+			}
+
+			// Entries logged while serving the request name both users
+			r = r.WithContext(audit.WithImpersonator(r.Context(), userID))
+			if auditLogger != nil {
+				auditLogger.Log(r.Context(), &audit.Entry{
+					Timestamp: time.Now(),
+					User:      impersonate,
+					Action:    "auth.impersonate",
+					Resource:  r.URL.Path,
+					Result:    "success",
+					SourceIP:  r.RemoteAddr,
+					Details:   map[string]interface{}{"method": r.Method},
+				})
+			}
+			userID = impersonate
+		}
+
+		r.Header.Set("X-User", userID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordAuthFailure counts a rejected request towards the ban threshold of
+// its source IP and audits the failure and any ban it caused
+func recordAuthFailure(authMgr *auth.AuthManager, auditLogger *audit.Logger, r *http.Request, ip string) {
+	ban, err := authMgr.RecordAuthFailure(ip)
+	if auditLogger != nil {
+		auditLogger.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      "anonymous",
+			Action:    "auth.failed",
+			Resource:  r.URL.Path,
+			Result:    "failed",
+			SourceIP:  r.RemoteAddr,
+		})
+		if ban != nil {
+			auditLogger.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      "system",
+				Action:    "auth.ban",
+				Resource:  ip,
+				Result:    "success",
+				SourceIP:  r.RemoteAddr,
+				Details: map[string]interface{}{
+					"reason":     ban.Reason,
+					"expires_at": ban.ExpiresAt,
+				},
+			})
+		} else if err != nil {
+			auditLogger.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      "system",
+				Action:    "auth.ban",
+				Resource:  ip,
+				Result:    "error",
+				SourceIP:  r.RemoteAddr,
+				Details:   map[string]interface{}{"error": err.Error()},
+			})
+		}
+	}
+}
+
+// openPath reports whether path is served without credentials even when
+// authentication is required: health checks, the API documentation, and
+// session refresh and task hooks, whose tokens are checked by the handlers
+func openPath(path string) bool {
+	switch {
+	case path == "/healthz", path == "/api/v1/auth/sessions/refresh":
+		return true
+	case strings.HasPrefix(path, "/swagger/"), strings.HasPrefix(path, hooksPath):
+		return true
+	}
+	return false
+}
+
+// clientIP returns the source IP of r without the port. Requests over the
+// Unix domain socket have no address and yield an empty string.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/bundle"
+)
+
+// maxBundleBody limits the size of an uploaded bundle
+const maxBundleBody = 1 << 20
+
+// BundleHandlers provides HTTP handlers for exporting and applying
+// declarative bundles of the objects managed by the agent
+type BundleHandlers struct {
+	manager *bundle.Manager
+	audit   *audit.Logger
+}
+
+// BundleResult is the outcome of diffing or applying a bundle
+type BundleResult struct {
+	Changes []*bundle.Change `json:"changes"`
+	Applied bool             `json:"applied"`
+}
+
+// NewBundleHandlers creates a new bundle handlers instance
+func NewBundleHandlers(manager *bundle.Manager, auditLogger *audit.Logger) *BundleHandlers {
+	return &BundleHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+// Register registers bundle routes
+func (h *BundleHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/config/bundle", h.ExportBundle)
+	mux.HandleFunc("/api/v1/config/bundle/diff", h.DiffBundle)
+	mux.HandleFunc("/api/v1/config/bundle/apply", h.ApplyBundle)
+}
+
+// ExportBundle godoc
+// @Summary Export managed objects
+// @Description Returns the shares, network disks and tasks of the enabled features as a YAML bundle. Network disk passwords are left out.
+// @Tags config
+// @Produce application/yaml
+// @Success 200 {string} string "YAML bundle"
+// @Router /config/bundle [get]
+func (h *BundleHandlers) ExportBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	data, err := h.manager.Export().Marshal()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", `attachment; filename="mingyue-bundle.yaml"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// DiffBundle godoc
+// @Summary Diff a bundle
+// @Description Returns the changes applying a YAML or JSON bundle would make, without making them
+// @Tags config
+// @Accept application/yaml
+// @Produce json
+// @Param prune query bool false "Delete objects missing from the sections in the bundle"
+// @Success 200 {object} Response{data=BundleResult}
+// @Failure 400 {object} Response
+// @Router /config/bundle/diff [post]
+func (h *BundleHandlers) DiffBundle(w http.ResponseWriter, r *http.Request) {
+	b, prune, ok := h.readBundle(w, r)
+	if !ok {
+		return
+	}
+
+	changes, err := h.manager.Diff(b, prune)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: BundleResult{Changes: changes}})
+}
+
+// ApplyBundle godoc
+// @Summary Apply a bundle
+// @Description Creates, updates and, with prune, deletes objects until the agent matches a YAML or JSON bundle. Applying the same bundle again changes nothing. Failed changes carry an error and do not stop the others.
+// @Tags config
+// @Accept application/yaml
+// @Produce json
+// @Param prune query bool false "Delete objects missing from the sections in the bundle"
+// @Success 200 {object} Response{data=BundleResult}
+// @Failure 400 {object} Response
+// @Failure 500 {object} Response{data=BundleResult}
+// @Router /config/bundle/apply [post]
+func (h *BundleHandlers) ApplyBundle(w http.ResponseWriter, r *http.Request) {
+	b, prune, ok := h.readBundle(w, r)
+	if !ok {
+		return
+	}
+
+	if isCheck(r) {
+		changes, err := h.manager.Diff(b, prune)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+			return
+		}
+		writeCheck(w, CheckResult{Changes: changes})
+		return
+	}
+
+	changes, err := h.manager.Apply(r.Context(), b, prune)
+	if errors.Is(err, bundle.ErrInvalid) {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if h.audit != nil {
+		result, details := "success", map[string]interface{}{
+			"prune":   prune,
+			"changes": len(changes),
+		}
+		if err != nil {
+			result = "error"
+			details["error"] = err.Error()
+		}
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "config.bundle_apply",
+			Resource:  "bundle",
+			Result:    result,
+			SourceIP:  r.RemoteAddr,
+			Details:   details,
+		})
+	}
+
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
+			Success: false,
+			Data:    BundleResult{Changes: changes, Applied: true},
+			Error:   "failed to apply bundle: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: BundleResult{Changes: changes, Applied: true}})
+}
+
+// readBundle reads the bundle posted to diff or apply and the prune flag
+func (h *BundleHandlers) readBundle(w http.ResponseWriter, r *http.Request) (*bundle.Bundle, bool, bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return nil, false, false
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBundleBody))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "read bundle: " + err.Error()})
+		return nil, false, false
+	}
+	b, err := bundle.Parse(data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return nil, false, false
+	}
+	return b, r.URL.Query().Get("prune") == "true", true
+}
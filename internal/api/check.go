@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/KOPElan/mingyue-agent/internal/bundle"
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+)
+
+// CheckResult is returned instead of applying a change when the request has
+// check=true. Changed reports whether the request would change anything, so
+// configuration management tools such as Ansible can report changed or ok
+// without side effects.
+type CheckResult struct {
+	Check   bool             `json:"check"`
+	Changed bool             `json:"changed"`
+	Fields  []string         `json:"fields,omitempty"`  // Settings that would change
+	Plan    *dryrun.Plan     `json:"plan,omitempty"`    // Files and commands, where the endpoint can plan them
+	Changes []*bundle.Change `json:"changes,omitempty"` // Bundle changes, for bundle apply
+}
+
+// checkPaths are the endpoints that support check
+var checkPaths = map[string]bool{
+	"/api/v1/shares/add":             true,
+	"/api/v1/shares/update":          true,
+	"/api/v1/shares/remove":          true,
+	"/api/v1/shares/enable":          true,
+	"/api/v1/shares/disable":         true,
+	"/api/v1/netdisk/mount":          true,
+	"/api/v1/netdisk/unmount":        true,
+	"/api/v1/scheduler/tasks/add":    true,
+	"/api/v1/scheduler/tasks/update": true,
+	"/api/v1/scheduler/tasks/delete": true,
+	"/api/v1/config/bundle/apply":    true,
+	maintenancePath:                  true,
+}
+
+// isCheck reports whether the request asks for check mode with the check
+// query parameter
+func isCheck(r *http.Request) bool {
+	check, _ := strconv.ParseBool(r.URL.Query().Get("check"))
+	return check
+}
+
+// writeCheck responds to a check
+func writeCheck(w http.ResponseWriter, result CheckResult) {
+	result.Check = true
+	result.Changed = result.Changed || len(result.Fields) > 0 || len(result.Changes) > 0
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: result})
+}
+
+// CheckGuard rejects check requests to endpoints that change state but do
+// not support check, so a check never applies a change by mistake
+func CheckGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isCheck(r) && !checkPaths[r.URL.Path] {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "check mode is not supported by this endpoint",
+				Code:    "check_unsupported",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// diffFields returns the JSON names of the fields that differ between
+// current and desired. Empty and missing values are equal.
+func diffFields(current, desired interface{}, names ...string) []string {
+	currentFields, desiredFields := jsonFields(current), jsonFields(desired)
+
+	var fields []string
+	for _, name := range names {
+		a, b := currentFields[name], desiredFields[name]
+		if isEmpty(a) && isEmpty(b) {
+			continue
+		}
+		if !reflect.DeepEqual(a, b) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// setFields returns the names of the fields of v that are not empty, for
+// partial updates that leave empty fields alone
+func setFields(v interface{}, names ...string) []string {
+	fields := jsonFields(v)
+
+	var set []string
+	for _, name := range names {
+		if !isEmpty(fields[name]) {
+			set = append(set, name)
+		}
+	}
+	return set
+}
+
+func jsonFields(v interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if data, err := json.Marshal(v); err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/cluster"
+)
+
+// ClusterHandlers provides HTTP handlers for sibling agent discovery and proxying
+type ClusterHandlers struct {
+	manager *cluster.Manager
+	audit   *audit.Logger
+}
+
+// NewClusterHandlers creates a new cluster handlers instance
+func NewClusterHandlers(manager *cluster.Manager, auditLogger *audit.Logger) *ClusterHandlers {
+	return &ClusterHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+func (h *ClusterHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/cluster/agents", h.ListAgents)
+	mux.HandleFunc("/api/v1/cluster/agents/refresh", h.RefreshAgents)
+	mux.HandleFunc(cluster.ProxyPrefix, h.Proxy)
+}
+
+// ListAgents handles GET /api/v1/cluster/agents
+func (h *ClusterHandlers) ListAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	writePage(w, h.manager.ListPeers(), page)
+}
+
+// RefreshAgents handles POST /api/v1/cluster/agents/refresh
+func (h *ClusterHandlers) RefreshAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	if !h.manager.IsGateway() {
+		writeJSON(w, http.StatusServiceUnavailable, Response{
+			Success: false,
+			Error:   "this agent is not configured as a gateway",
+		})
+		return
+	}
+
+	peers, err := h.manager.Refresh(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "failed to discover agents: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    peers,
+	})
+}
+
+// Proxy handles /api/v1/cluster/proxy/<agent id>/api/... by forwarding the
+// request to the sibling agent
+func (h *ClusterHandlers) Proxy(w http.ResponseWriter, r *http.Request) {
+	if !h.manager.IsGateway() {
+		writeJSON(w, http.StatusServiceUnavailable, Response{
+			Success: false,
+			Error:   "this agent is not configured as a gateway",
+		})
+		return
+	}
+
+	// Proxied event streams and downloads outlive the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	status, err := h.manager.ServeProxy(w, r)
+	if err != nil {
+		writeJSON(w, status, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	// Reads are audited by the sibling; record changes made through the gateway here too
+	if h.audit != nil && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		result := "success"
+		if err != nil {
+			result = "failed"
+		}
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "cluster.proxy",
+			Resource:  r.URL.Path,
+			Result:    result,
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"method": r.Method,
+			},
+		})
+	}
+}
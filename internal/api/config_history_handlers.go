@@ -0,0 +1,204 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/configrepo"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
+)
+
+// RecordChanges attributes configuration changes made while serving a
+// request to its user, the reason in the X-Change-Reason header and its
+// request ID. The ID is taken from X-Request-ID, or the trace ID when the
+// client sends none, and is echoed in the response.
+func RecordChanges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = telemetry.FromContext(r.Context()).TraceID()
+		}
+		if requestID == "" {
+			id := make([]byte, 8)
+			rand.Read(id)
+			requestID = hex.EncodeToString(id)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := configrepo.WithChange(r.Context(), configrepo.Change{
+			User:      getUser(r),
+			Reason:    r.Header.Get("X-Change-Reason"),
+			RequestID: requestID,
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ConfigHistoryHandlers provides HTTP handlers for the history of
+// configuration files written by the agent
+type ConfigHistoryHandlers struct {
+	repo  *configrepo.Repo
+	audit *audit.Logger
+}
+
+// NewConfigHistoryHandlers creates a new configuration history handlers
+// instance
+func NewConfigHistoryHandlers(repo *configrepo.Repo, auditLogger *audit.Logger) *ConfigHistoryHandlers {
+	return &ConfigHistoryHandlers{
+		repo:  repo,
+		audit: auditLogger,
+	}
+}
+
+// Register registers configuration history routes
+func (h *ConfigHistoryHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/config/history", h.ListHistory)
+	mux.HandleFunc("/api/v1/config/history/diff", h.DiffHistory)
+	mux.HandleFunc("/api/v1/config/history/revert", h.RevertHistory)
+}
+
+// ListHistory godoc
+// @Summary List configuration changes
+// @Description Returns recorded changes of configuration files written by the agent, most recent first
+// @Tags config
+// @Produce json
+// @Param path query string false "Only changes of this file"
+// @Success 200 {object} Response{data=[]configrepo.Commit}
+// @Failure 501 {object} Response
+// @Router /config/history [get]
+func (h *ConfigHistoryHandlers) ListHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	commits, err := h.repo.Log(r.Context(), r.URL.Query().Get("path"), page.offset+page.limit+1)
+	if err != nil {
+		writeJSON(w, historyErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writePage(w, commits, page)
+}
+
+// DiffHistory godoc
+// @Summary Show a configuration change
+// @Description Returns a recorded change with its unified diff
+// @Tags config
+// @Produce json
+// @Param commit query string true "Commit ID"
+// @Success 200 {object} Response{data=ConfigChangeDiff}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /config/history/diff [get]
+func (h *ConfigHistoryHandlers) DiffHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("commit")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "commit is required"})
+		return
+	}
+
+	commit, err := h.repo.Get(r.Context(), id)
+	if err != nil {
+		writeJSON(w, historyErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+	diff, err := h.repo.Diff(r.Context(), commit.ID)
+	if err != nil {
+		writeJSON(w, historyErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: ConfigChangeDiff{Commit: commit, Diff: diff}})
+}
+
+// ConfigChangeDiff is a recorded configuration change with its diff
+type ConfigChangeDiff struct {
+	*configrepo.Commit
+	Diff string `json:"diff"`
+}
+
+// RevertHistoryRequest puts configuration files back to a recorded version
+type RevertHistoryRequest struct {
+	Commit string   `json:"commit"`
+	Paths  []string `json:"paths,omitempty"` // Defaults to every file the commit changed
+}
+
+// RevertHistory godoc
+// @Summary Revert configuration files
+// @Description Puts files back to their content as of a recorded change and reloads the services reading them. The revert is recorded as a new change. Managers keep their own state, so shares or modules listed by the API are not reverted.
+// @Tags config
+// @Accept json
+// @Produce json
+// @Param body body RevertHistoryRequest true "Revert request"
+// @Success 200 {object} Response{data=[]string}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /config/history/revert [post]
+// @Security UserAuth
+func (h *ConfigHistoryHandlers) RevertHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req RevertHistoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Commit == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "commit is required"})
+		return
+	}
+
+	reverted, err := h.repo.Revert(r.Context(), req.Commit, req.Paths...)
+	if h.audit != nil {
+		entry := &audit.Entry{
+			User:     getUser(r),
+			Action:   "config.revert",
+			Resource: req.Commit,
+			Result:   "success",
+			SourceIP: r.RemoteAddr,
+			Details:  map[string]interface{}{"paths": reverted},
+		}
+		if err != nil {
+			entry.Result = "failure"
+			entry.Details["error"] = err.Error()
+		}
+		h.audit.Log(r.Context(), entry)
+	}
+	if err != nil {
+		// Files were reverted even if a service failed to reload
+		writeJSON(w, historyErrorStatus(err), Response{Success: false, Error: err.Error(), Details: reverted})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: reverted})
+}
+
+// historyErrorStatus maps configuration history errors to HTTP status codes
+func historyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, configrepo.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, configrepo.ErrDisabled):
+		return http.StatusNotImplemented
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/crashreport"
+)
+
+// CrashHandlers provides HTTP handlers for crash reports
+type CrashHandlers struct {
+	crashes *crashreport.Manager
+	audit   *audit.Logger
+}
+
+// NewCrashHandlers creates a new crash handlers instance
+func NewCrashHandlers(crashes *crashreport.Manager, auditLogger *audit.Logger) *CrashHandlers {
+	return &CrashHandlers{
+		crashes: crashes,
+		audit:   auditLogger,
+	}
+}
+
+func (h *CrashHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/crashes", h.ListCrashes)
+	mux.HandleFunc("/api/v1/crashes/get", h.GetCrash)
+	mux.HandleFunc("/api/v1/crashes/delete", h.DeleteCrash)
+}
+
+// ListCrashes godoc
+// @Summary List crash reports
+// @Description Lists reports of previous runs that ended in a panic or fatal error, newest first
+// @Tags crashes
+// @Produce json
+// @Param limit query int false "Page size"
+// @Param page_token query string false "Token of the page to return"
+// @Success 200 {object} Response{data=[]crashreport.Summary}
+// @Router /crashes [get]
+func (h *CrashHandlers) ListCrashes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	summaries, err := h.crashes.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "failed to list crash reports: " + err.Error(),
+		})
+		return
+	}
+	writePage(w, summaries, page)
+}
+
+// GetCrash godoc
+// @Summary Get a crash report
+// @Description Returns a crash report with the runtime output, goroutine stacks and the end of the log of the crashed run
+// @Tags crashes
+// @Produce json
+// @Param id query string true "Report ID"
+// @Success 200 {object} Response{data=crashreport.Report}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /crashes/get [get]
+func (h *CrashHandlers) GetCrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "report ID required",
+		})
+		return
+	}
+
+	report, err := h.crashes.Get(id)
+	if err != nil {
+		writeJSON(w, crashErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+	})
+}
+
+// DeleteCrash godoc
+// @Summary Delete a crash report
+// @Description Deletes a crash report once it has been looked into
+// @Tags crashes
+// @Produce json
+// @Param id query string true "Report ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /crashes/delete [delete]
+func (h *CrashHandlers) DeleteCrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "report ID required",
+		})
+		return
+	}
+
+	err := h.crashes.Delete(id)
+	h.logCrash(r, "crash.delete", id, err)
+	if err != nil {
+		writeJSON(w, crashErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *CrashHandlers) logCrash(r *http.Request, action, resource string, err error) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      getUser(r),
+		Action:    action,
+		Resource:  resource,
+		Result:    "success",
+		SourceIP:  r.RemoteAddr,
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Details = map[string]interface{}{"error": err.Error()}
+	}
+	h.audit.Log(r.Context(), entry)
+}
+
+// crashErrorStatus maps crash report errors to HTTP status codes
+func crashErrorStatus(err error) int {
+	if errors.Is(err, crashreport.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
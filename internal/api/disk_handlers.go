@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
@@ -29,6 +30,15 @@ func (h *DiskHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/disk/mount", h.Mount)
 	mux.HandleFunc("/api/v1/disk/unmount", h.Unmount)
 	mux.HandleFunc("/api/v1/disk/smart", h.GetSMART)
+	mux.HandleFunc("/api/v1/disk/partition-table", h.GetPartitionTable)
+	mux.HandleFunc("/api/v1/disk/partitions/create", h.changePartition(diskmanager.PartitionCreate))
+	mux.HandleFunc("/api/v1/disk/partitions/delete", h.changePartition(diskmanager.PartitionDelete))
+	mux.HandleFunc("/api/v1/disk/partitions/resize", h.changePartition(diskmanager.PartitionResize))
+	mux.HandleFunc("/api/v1/disk/format", h.Format)
+	mux.HandleFunc("/api/v1/disk/luks/format", h.FormatLUKS)
+	mux.HandleFunc("/api/v1/disk/luks/open", h.OpenLUKS)
+	mux.HandleFunc("/api/v1/disk/luks/close", h.CloseLUKS)
+	mux.HandleFunc("/api/v1/disk/luks/forget", h.ForgetLUKSKey)
 }
 
 // ListPartitions handles GET /api/v1/disk/partitions
@@ -41,7 +51,13 @@ func (h *DiskHandlers) ListPartitions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	partitions, err := h.manager.ListPartitions()
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := cacheContext(r)
+	partitions, err := h.manager.ListPartitions(ctx)
 	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
@@ -54,7 +70,7 @@ func (h *DiskHandlers) ListPartitions(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to list partitions: " + err.Error(),
 		})
@@ -70,10 +86,8 @@ func (h *DiskHandlers) ListPartitions(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	writeJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    partitions,
-	})
+	setCacheHeaders(w, ctx)
+	writePage(w, partitions, page)
 }
 
 // ListDisks handles GET /api/v1/disk/list
@@ -86,7 +100,13 @@ func (h *DiskHandlers) ListDisks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	disks, err := h.manager.ListDisks()
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := cacheContext(r)
+	disks, err := h.manager.ListDisks(ctx)
 	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
@@ -99,7 +119,7 @@ func (h *DiskHandlers) ListDisks(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to list disks: " + err.Error(),
 		})
@@ -115,10 +135,8 @@ func (h *DiskHandlers) ListDisks(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	writeJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    disks,
-	})
+	setCacheHeaders(w, ctx)
+	writePage(w, disks, page)
 }
 
 // Mount handles POST /api/v1/disk/mount
@@ -148,7 +166,7 @@ func (h *DiskHandlers) Mount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.manager.Mount(opts)
+	err := h.manager.Mount(r.Context(), opts)
 	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
@@ -163,7 +181,15 @@ func (h *DiskHandlers) Mount(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		if errors.Is(err, diskmanager.ErrInvalidOption) {
+			writeJSON(w, http.StatusUnprocessableEntity, Response{
+				Success: false,
+				Error:   err.Error(),
+				Code:    "invalid_mount_option",
+			})
+			return
+		}
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to mount: " + err.Error(),
 		})
@@ -222,7 +248,7 @@ func (h *DiskHandlers) Unmount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.manager.Unmount(req.Target, req.Force)
+	err := h.manager.Unmount(r.Context(), req.Target, req.Force)
 	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
@@ -237,7 +263,7 @@ func (h *DiskHandlers) Unmount(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to unmount: " + err.Error(),
 		})
@@ -284,7 +310,8 @@ func (h *DiskHandlers) GetSMART(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	smartInfo, err := h.manager.GetSMARTInfo(device)
+	ctx := cacheContext(r)
+	smartInfo, err := h.manager.GetSMARTInfo(ctx, device)
 	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
@@ -298,7 +325,7 @@ func (h *DiskHandlers) GetSMART(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to get SMART info: " + err.Error(),
 		})
@@ -315,8 +342,467 @@ func (h *DiskHandlers) GetSMART(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	setCacheHeaders(w, ctx)
 	writeJSON(w, http.StatusOK, Response{
 		Success: true,
 		Data:    smartInfo,
 	})
 }
+
+// GetPartitionTable handles GET /api/v1/disk/partition-table
+func (h *DiskHandlers) GetPartitionTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "device parameter is required",
+		})
+		return
+	}
+
+	table, err := h.manager.GetPartitionTable(r.Context(), device)
+	if err != nil {
+		writePartitionError(w, "failed to read partition table: ", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    table,
+	})
+}
+
+// changePartition handles POST /api/v1/disk/partitions/{create,delete,resize}.
+// Without a confirmation token the change is planned and a token issued;
+// sending the request again with the token applies it.
+func (h *DiskHandlers) changePartition(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, Response{
+				Success: false,
+				Error:   "method not allowed",
+			})
+			return
+		}
+
+		var req diskmanager.PartitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid request body: " + err.Error(),
+			})
+			return
+		}
+		req.Action = action
+		if req.Device == "" {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "device is required",
+			})
+			return
+		}
+
+		if isDryRun(r) {
+			plan, err := h.manager.PlanPartitionChange(r.Context(), &req)
+			if err != nil {
+				writePartitionError(w, "failed to plan partition change: ", err)
+				return
+			}
+			writePlan(w, plan)
+			return
+		}
+
+		if req.ConfirmToken == "" {
+			change, err := h.manager.RequestPartitionChange(r.Context(), &req)
+			if err != nil {
+				writePartitionError(w, "failed to plan partition change: ", err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, Response{
+				Success: true,
+				Data:    change,
+			})
+			return
+		}
+
+		table, err := h.manager.ApplyPartitionChange(r.Context(), &req)
+		if h.audit != nil {
+			entry := &audit.Entry{
+				Timestamp: time.Now(),
+				User:      getUser(r),
+				Action:    "disk.partition_" + action,
+				Resource:  req.Device,
+				Result:    "success",
+				SourceIP:  r.RemoteAddr,
+				Details: map[string]interface{}{
+					"number": req.Number,
+					"start":  req.Start,
+					"size":   req.Size,
+				},
+			}
+			if err != nil {
+				entry.Result = "error"
+				entry.Details["error"] = err.Error()
+			}
+			h.audit.Log(r.Context(), entry)
+		}
+		if err != nil {
+			writePartitionError(w, "failed to change partitions: ", err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, Response{
+			Success: true,
+			Data:    table,
+		})
+	}
+}
+
+// Format handles POST /api/v1/disk/format. Every attempt past validation
+// of the body is audited, including refused ones.
+func (h *DiskHandlers) Format(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req diskmanager.FormatOptions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.Device == "" || req.FileSystem == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "device and filesystem are required",
+		})
+		return
+	}
+
+	if isDryRun(r) {
+		plan, err := h.manager.PlanFormat(r.Context(), &req)
+		if err != nil {
+			writeFormatError(w, err)
+			return
+		}
+		writePlan(w, plan)
+		return
+	}
+
+	started := time.Now()
+	result, err := h.manager.Format(r.Context(), &req)
+	if h.audit != nil {
+		entry := &audit.Entry{
+			Timestamp: started,
+			User:      getUser(r),
+			Action:    "disk.format",
+			Resource:  req.Device,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"filesystem":  req.FileSystem,
+				"label":       req.Label,
+				"uuid":        req.UUID,
+				"duration_ms": time.Since(started).Milliseconds(),
+			},
+		}
+		if result != nil {
+			entry.Details["previous_filesystem"] = result.Previous
+			if result.UUID != "" {
+				entry.Details["uuid"] = result.UUID
+			}
+		}
+		if err != nil {
+			entry.Result = "error"
+			entry.Details["error"] = err.Error()
+		}
+		h.audit.Log(r.Context(), entry)
+	}
+	if err != nil {
+		writeFormatError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// writeFormatError responds to a refused or failed format
+func writeFormatError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err, http.StatusInternalServerError), ""
+	switch {
+	case errors.Is(err, diskmanager.ErrInvalidFormat):
+		status, code = http.StatusUnprocessableEntity, "invalid_format"
+	case errors.Is(err, diskmanager.ErrConfirmPhrase):
+		status, code = http.StatusUnprocessableEntity, "confirmation_required"
+	case errors.Is(err, diskmanager.ErrSystemDevice):
+		status, code = http.StatusForbidden, "system_device"
+	case errors.Is(err, diskmanager.ErrPartitionBusy):
+		status, code = http.StatusConflict, "device_busy"
+	}
+	writeJSON(w, status, Response{
+		Success: false,
+		Error:   "failed to format: " + err.Error(),
+		Code:    code,
+	})
+}
+
+// FormatLUKS handles POST /api/v1/disk/luks/format
+func (h *DiskHandlers) FormatLUKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req diskmanager.LUKSFormatOptions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.Device == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "device is required",
+		})
+		return
+	}
+
+	if isDryRun(r) {
+		plan, err := h.manager.PlanLUKSFormat(r.Context(), &req)
+		if err != nil {
+			writeLUKSError(w, "failed to create LUKS volume: ", err)
+			return
+		}
+		writePlan(w, plan)
+		return
+	}
+
+	volume, err := h.manager.FormatLUKS(r.Context(), &req)
+	h.auditLUKS(r, "disk.luks_format", req.Device, map[string]interface{}{
+		"label":      req.Label,
+		"key_source": luksKeySource(req.Passphrase, req.Keyfile),
+		"remember":   req.Remember,
+	}, volume, err)
+	if err != nil {
+		writeLUKSError(w, "failed to create LUKS volume: ", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    volume,
+	})
+}
+
+// OpenLUKS handles POST /api/v1/disk/luks/open
+func (h *DiskHandlers) OpenLUKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req diskmanager.LUKSOpenOptions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.Device == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "device is required",
+		})
+		return
+	}
+
+	volume, err := h.manager.OpenLUKS(r.Context(), &req)
+	h.auditLUKS(r, "disk.luks_open", req.Device, map[string]interface{}{
+		"name":       req.Name,
+		"key_source": luksKeySource(req.Passphrase, req.Keyfile),
+		"remember":   req.Remember,
+	}, volume, err)
+	if err != nil {
+		writeLUKSError(w, "failed to open LUKS volume: ", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    volume,
+	})
+}
+
+// CloseLUKS handles POST /api/v1/disk/luks/close
+func (h *DiskHandlers) CloseLUKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "name is required",
+		})
+		return
+	}
+
+	err := h.manager.CloseLUKS(r.Context(), req.Name)
+	h.auditLUKS(r, "disk.luks_close", "/dev/mapper/"+req.Name, map[string]interface{}{}, nil, err)
+	if err != nil {
+		writeLUKSError(w, "failed to close LUKS volume: ", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]string{"message": "LUKS volume closed"},
+	})
+}
+
+// ForgetLUKSKey handles POST /api/v1/disk/luks/forget
+func (h *DiskHandlers) ForgetLUKSKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req struct {
+		Device string `json:"device"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Device == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "device is required",
+		})
+		return
+	}
+
+	err := h.manager.ForgetLUKSKey(r.Context(), req.Device)
+	h.auditLUKS(r, "disk.luks_forget", req.Device, map[string]interface{}{}, nil, err)
+	if err != nil {
+		writeLUKSError(w, "failed to forget LUKS key: ", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]string{"message": "LUKS key forgotten"},
+	})
+}
+
+// auditLUKS logs a LUKS operation. Details never hold keys.
+func (h *DiskHandlers) auditLUKS(r *http.Request, action, resource string, details map[string]interface{}, volume *diskmanager.LUKSVolume, err error) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      getUser(r),
+		Action:    action,
+		Resource:  resource,
+		Result:    "success",
+		SourceIP:  r.RemoteAddr,
+		Details:   details,
+	}
+	if volume != nil {
+		entry.Details["uuid"] = volume.UUID
+		if volume.Mapper != "" {
+			entry.Details["mapper"] = volume.Mapper
+		}
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Details["error"] = err.Error()
+	}
+	h.audit.Log(r.Context(), entry)
+}
+
+// luksKeySource names the kind of key a LUKS request uses
+func luksKeySource(passphrase, keyfile string) string {
+	switch {
+	case passphrase != "":
+		return "passphrase"
+	case keyfile != "":
+		return "keyfile"
+	}
+	return "stored"
+}
+
+// writeLUKSError responds to a failed LUKS operation
+func writeLUKSError(w http.ResponseWriter, prefix string, err error) {
+	status, code := errorStatus(err, http.StatusInternalServerError), ""
+	switch {
+	case errors.Is(err, diskmanager.ErrInvalidLUKS), errors.Is(err, diskmanager.ErrInvalidFormat):
+		status, code = http.StatusUnprocessableEntity, "invalid_luks"
+	case errors.Is(err, diskmanager.ErrConfirmPhrase):
+		status, code = http.StatusUnprocessableEntity, "confirmation_required"
+	case errors.Is(err, diskmanager.ErrNoLUKSKey):
+		status, code = http.StatusUnprocessableEntity, "key_required"
+	case errors.Is(err, diskmanager.ErrWrongLUKSKey):
+		status, code = http.StatusForbidden, "wrong_key"
+	case errors.Is(err, diskmanager.ErrSystemDevice):
+		status, code = http.StatusForbidden, "system_device"
+	case errors.Is(err, diskmanager.ErrPartitionBusy):
+		status, code = http.StatusConflict, "device_busy"
+	}
+	writeJSON(w, status, Response{
+		Success: false,
+		Error:   prefix + err.Error(),
+		Code:    code,
+	})
+}
+
+// writePartitionError responds to a failed partition table read or change
+func writePartitionError(w http.ResponseWriter, prefix string, err error) {
+	status, code := errorStatus(err, http.StatusInternalServerError), ""
+	switch {
+	case errors.Is(err, diskmanager.ErrInvalidPartition):
+		status, code = http.StatusUnprocessableEntity, "invalid_partition"
+	case errors.Is(err, diskmanager.ErrPartitionBusy):
+		status, code = http.StatusConflict, "partition_busy"
+	case errors.Is(err, diskmanager.ErrConfirmation):
+		status, code = http.StatusConflict, "confirmation_invalid"
+	}
+	writeJSON(w, status, Response{
+		Success: false,
+		Error:   prefix + err.Error(),
+		Code:    code,
+	})
+}
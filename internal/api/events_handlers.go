@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+// sseHeartbeatInterval keeps idle streams alive through proxies
+const sseHeartbeatInterval = 15 * time.Second
+
+// EventHandlers provides HTTP handlers for the agent event stream
+type EventHandlers struct {
+	bus *events.Bus
+}
+
+// NewEventHandlers creates a new event handlers instance
+func NewEventHandlers(bus *events.Bus) *EventHandlers {
+	return &EventHandlers{
+		bus: bus,
+	}
+}
+
+func (h *EventHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/events/sse", h.StreamSSE)
+}
+
+// parseEventFilter reads the subscription filter shared by event stream endpoints
+func parseEventFilter(r *http.Request) *events.Filter {
+	return events.ParseFilter(r.URL.Query().Get("types"))
+}
+
+// StreamSSE handles GET /api/v1/events/sse
+func (h *EventHandlers) StreamSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastID uint64
+	resume := lastEventID != ""
+	if resume {
+		parsed, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid Last-Event-ID",
+			})
+			return
+		}
+		lastID = parsed
+	}
+
+	// Streams outlive the server write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	filter := parseEventFilter(r)
+	var sub *events.Subscription
+	var missed []*events.Event
+	complete := true
+	if resume {
+		sub, missed, complete = h.bus.SubscribeFrom(lastID, filter, 256)
+		// The ID may be from before a restart, and larger than the IDs
+		// to come
+		if !complete {
+			lastID = 0
+		}
+	} else {
+		sub = h.bus.Subscribe(filter, 256)
+		lastID = h.bus.LastID()
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Tell the client to reload state when events it missed are gone
+	if !complete {
+		fmt.Fprintf(w, "event: resync\ndata: {}\n\n")
+	}
+
+	for _, event := range missed {
+		if err := writeSSEEvent(w, event); err != nil {
+			return
+		}
+		lastID = event.ID
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if event.ID <= lastID {
+				continue
+			}
+			if err := writeSSEEvent(w, event); err != nil {
+				return
+			}
+			lastID = event.ID
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeSSEEvent(w http.ResponseWriter, event *events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -1,18 +1,30 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/events"
 	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/throttle"
 )
 
 type FileAPI struct {
 	manager       *filemanager.Manager
 	audit         *audit.Logger
+	jobs          *jobs.Manager
+	bus           *events.Bus
 	maxUploadSize int64
+	transfers     *transferLimiter
 }
 
 func NewFileAPI(manager *filemanager.Manager, auditLogger *audit.Logger, maxUploadSize int64) *FileAPI {
@@ -20,9 +32,15 @@ func NewFileAPI(manager *filemanager.Manager, auditLogger *audit.Logger, maxUplo
 		manager:       manager,
 		audit:         auditLogger,
 		maxUploadSize: maxUploadSize,
+		transfers:     newTransferLimiter(),
 	}
 }
 
+// SetJobs enables recursive copies and moves as background jobs
+func (api *FileAPI) SetJobs(manager *jobs.Manager) {
+	api.jobs = manager
+}
+
 func (api *FileAPI) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/files/list", api.handleList)
 	mux.HandleFunc("/api/v1/files/info", api.handleInfo)
@@ -32,10 +50,46 @@ func (api *FileAPI) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/files/copy", api.handleCopy)
 	mux.HandleFunc("/api/v1/files/move", api.handleMove)
 	mux.HandleFunc("/api/v1/files/upload", api.handleUpload)
+	mux.HandleFunc("/api/v1/files/upload/sessions", api.handleListUploads)
+	mux.HandleFunc("/api/v1/files/upload/start", api.handleStartUpload)
+	mux.HandleFunc("/api/v1/files/upload/status", api.handleUploadStatus)
+	mux.HandleFunc("/api/v1/files/upload/chunk", api.handleUploadChunk)
+	mux.HandleFunc("/api/v1/files/upload/finalize", api.handleFinalizeUpload)
+	mux.HandleFunc("/api/v1/files/upload/abort", api.handleAbortUpload)
 	mux.HandleFunc("/api/v1/files/download", api.handleDownload)
+	mux.HandleFunc("/api/v1/files/download/segments", api.handleDownloadSegments)
 	mux.HandleFunc("/api/v1/files/symlink", api.handleSymlink)
 	mux.HandleFunc("/api/v1/files/hardlink", api.handleHardlink)
 	mux.HandleFunc("/api/v1/files/checksum", api.handleChecksum)
+	mux.HandleFunc("/api/v1/files/preview", api.handlePreview)
+	mux.HandleFunc("/api/v1/files/text", api.handleText)
+	mux.HandleFunc("/api/v1/files/locks", api.handleListLocks)
+	mux.HandleFunc("/api/v1/files/locks/acquire", api.handleAcquireLock)
+	mux.HandleFunc("/api/v1/files/locks/steal", api.handleAcquireLock)
+	mux.HandleFunc("/api/v1/files/locks/refresh", api.handleRefreshLock)
+	mux.HandleFunc("/api/v1/files/locks/release", api.handleReleaseLock)
+	mux.HandleFunc("/api/v1/files/policies", api.handleListPolicies)
+	mux.HandleFunc("/api/v1/files/policies/set", api.handleSetPolicy)
+	mux.HandleFunc("/api/v1/files/policies/remove", api.handleRemovePolicy)
+	mux.HandleFunc("/api/v1/files/quota", api.handleQuota)
+	mux.HandleFunc("/api/v1/files/trash", api.handleListTrash)
+	mux.HandleFunc("/api/v1/files/trash/restore", api.handleRestoreTrash)
+	mux.HandleFunc("/api/v1/files/trash/purge", api.handlePurgeTrash)
+	mux.HandleFunc("/api/v1/files/trash/empty", api.handleEmptyTrash)
+	mux.HandleFunc("/api/v1/files/versions", api.handleListVersions)
+	mux.HandleFunc("/api/v1/files/versions/restore", api.handleRestoreVersion)
+	mux.HandleFunc("/api/v1/files/jobs", api.handleListFileJobs)
+	mux.HandleFunc("/api/v1/files/jobs/copy", api.handleStartFileJob)
+	mux.HandleFunc("/api/v1/files/jobs/move", api.handleStartFileJob)
+	mux.HandleFunc(checksumJobPath, api.handleStartChecksumJob)
+	mux.HandleFunc("/api/v1/files/jobs/status", api.handleFileJobStatus)
+	mux.HandleFunc("/api/v1/files/jobs/cancel", api.handleCancelFileJob)
+	mux.HandleFunc("/api/v1/files/permissions", api.handlePermissions)
+	mux.HandleFunc("/api/v1/files/usage", api.handleUsage)
+	mux.HandleFunc("/api/v1/files/grep", api.handleGrep)
+	mux.HandleFunc("/api/v1/files/watch", api.handleWatch)
+	mux.HandleFunc("/api/v1/files/batch", api.handleBatch)
+	mux.HandleFunc("/api/v1/files/transfer-limits", api.handleTransferLimits)
 }
 
 func (api *FileAPI) handleList(w http.ResponseWriter, r *http.Request) {
@@ -44,24 +98,45 @@ func (api *FileAPI) handleList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
 	path := r.URL.Query().Get("path")
 	if path == "" {
 		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
 		return
 	}
 
+	query := r.URL.Query()
 	opts := filemanager.ListOptions{
-		Path: path,
+		Path:      path,
+		Offset:    page.offset,
+		Limit:     page.limit + 1, // One more tells whether there is a next page
+		SortBy:    query.Get("sort"),
+		SortOrder: query.Get("order"),
+		Pattern:   query.Get("pattern"),
+		NoHidden:  query.Get("hidden") == "false",
 	}
 
 	user := getUser(r)
 	files, err := api.manager.List(r.Context(), opts, user)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		status := http.StatusInternalServerError
+		if errors.Is(err, filemanager.ErrInvalidListOptions) {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, Response{Success: true, Data: files})
+	next := ""
+	if len(files) > page.limit {
+		files = files[:page.limit]
+		next = encodePageToken(page.offset + page.limit)
+	}
+	writePageData(w, files, next, page)
 }
 
 func (api *FileAPI) handleInfo(w http.ResponseWriter, r *http.Request) {
@@ -116,7 +191,8 @@ func (api *FileAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Path string `json:"path"`
+		Path      string `json:"path"`
+		Permanent bool   `json:"permanent"` // Skip the trash
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
@@ -124,7 +200,11 @@ func (api *FileAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUser(r)
-	if err := api.manager.Delete(r.Context(), req.Path, user); err != nil {
+	deleteFn := api.manager.Delete
+	if req.Permanent {
+		deleteFn = api.manager.DeletePermanently
+	}
+	if err := deleteFn(r.Context(), req.Path, user); err != nil {
 		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
 		return
 	}
@@ -172,12 +252,18 @@ func (api *FileAPI) handleCopy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUser(r)
-	if err := api.manager.Copy(r.Context(), req.SrcPath, req.DstPath, user); err != nil {
+	result, err := api.manager.Copy(r.Context(), req.SrcPath, req.DstPath, user)
+	if err != nil {
+		var policyErr *filemanager.PolicyError
+		if errors.As(err, &policyErr) {
+			writeJSON(w, policyErrorStatus(policyErr), Response{Success: false, Error: policyErr.Message, Code: policyErr.Code, Details: policyErr.Details})
+			return
+		}
 		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, Response{Success: true})
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: result})
 }
 
 func (api *FileAPI) handleMove(w http.ResponseWriter, r *http.Request) {
@@ -226,60 +312,439 @@ func (api *FileAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	expectedSHA256 := r.URL.Query().Get("sha256")
+	if expectedSHA256 == "" {
+		expectedSHA256 = r.Header.Get("X-Content-SHA256")
+	}
+
+	query := r.URL.Query()
 	opts := filemanager.UploadOptions{
-		Path:    path,
-		MaxSize: maxSize,
+		Path:           path,
+		MaxSize:        maxSize,
+		ExpectedSHA256: expectedSHA256,
+		LockID:         lockID(r),
+		Preallocate:    query.Get("preallocate") == "true",
+		Sparse:         query.Get("sparse") == "true",
+	}
+	if opts.Preallocate && r.ContentLength > 0 {
+		opts.Size = r.ContentLength
 	}
 
 	user := getUser(r)
-	if err := api.manager.Upload(r.Context(), r.Body, opts, user); err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	buckets, done := api.transfers.buckets(r, directionUpload)
+	defer done()
+	body := throttle.Reader(r.Context(), r.Body, buckets...)
+	if err := api.manager.Upload(r.Context(), body, opts, user); err != nil {
+		writeUploadError(w, err, nil)
 		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{Success: true})
 }
 
-func (api *FileAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
+// maxUploadLimit returns the upload size limit of r: the configured maximum,
+// lowered by a max_size query parameter
+func (api *FileAPI) maxUploadLimit(r *http.Request) int64 {
+	maxSize := api.maxUploadSize
+	if maxSize <= 0 {
+		maxSize = 10 * 1024 * 1024 * 1024
+	}
+	if maxSizeStr := r.URL.Query().Get("max_size"); maxSizeStr != "" {
+		if size, err := strconv.ParseInt(maxSizeStr, 10, 64); err == nil && size < maxSize {
+			maxSize = size
+		}
+	}
+	return maxSize
+}
+
+// writeUploadError writes the response for a failed upload. Offset
+// mismatches carry the offset to resume at from session.
+func writeUploadError(w http.ResponseWriter, err error, session *filemanager.UploadSession) {
+	var policyErr *filemanager.PolicyError
+	var locked *filemanager.LockedError
+	switch {
+	case errors.As(err, &locked):
+		writeJSON(w, http.StatusLocked, Response{Success: false, Error: err.Error(), Code: "locked", Details: locked.Holder})
+	case errors.As(err, &policyErr):
+		writeJSON(w, policyErrorStatus(policyErr), Response{Success: false, Error: policyErr.Message, Code: policyErr.Code, Details: policyErr.Details})
+	case errors.Is(err, filemanager.ErrUploadOffsetMismatch) && session != nil:
+		writeJSON(w, http.StatusConflict, Response{Success: false, Error: err.Error(), Code: "offset_mismatch", Details: session})
+	default:
+		writeJSON(w, uploadErrorStatus(err), Response{Success: false, Error: err.Error()})
+	}
+}
+
+// policyErrorStatus maps rejected uploads and copies to HTTP status codes
+func policyErrorStatus(policyErr *filemanager.PolicyError) int {
+	switch policyErr.Code {
+	case filemanager.PolicyFileTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case filemanager.PolicyQuotaExceeded, filemanager.PolicyInsufficientSpace:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// uploadErrorStatus maps chunked upload errors to HTTP status codes
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, filemanager.ErrUploadNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, filemanager.ErrUploadBusy), errors.Is(err, filemanager.ErrUploadOffsetMismatch), errors.Is(err, filemanager.ErrUploadIncomplete):
+		return http.StatusConflict
+	case errors.Is(err, filemanager.ErrUploadsDisabled):
+		return http.StatusNotImplemented
+	case errors.Is(err, filemanager.ErrSparsePreallocated):
+		return http.StatusBadRequest
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
+
+// StartUploadRequest starts a chunked upload
+type StartUploadRequest struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`      // Optional; may also be given when finalizing
+	Preallocate bool   `json:"preallocate"` // Reserve the disk for the whole upload up front
+	Sparse      bool   `json:"sparse"`      // Write runs of zeros as holes, for VM images
+}
+
+func (api *FileAPI) handleListUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := api.manager.ListUploads(getUser(r))
+	if err != nil {
+		writeUploadError(w, err, nil)
+		return
+	}
+	writePage(w, sessions, page)
+}
+
+func (api *FileAPI) handleStartUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req StartUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+	if req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+	if req.Size < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "size must not be negative"})
+		return
+	}
+
+	opts := filemanager.UploadOptions{
+		Path:           req.Path,
+		Size:           req.Size,
+		MaxSize:        api.maxUploadLimit(r),
+		ExpectedSHA256: req.SHA256,
+		Preallocate:    req.Preallocate,
+		Sparse:         req.Sparse,
+	}
+	session, err := api.manager.StartUpload(r.Context(), opts, getUser(r))
+	if err != nil {
+		writeUploadError(w, err, nil)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, Response{Success: true, Data: session})
+}
+
+func (api *FileAPI) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
 		return
 	}
 
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+
+	session, err := api.manager.GetUpload(id, getUser(r))
+	if err != nil {
+		writeUploadError(w, err, nil)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: session})
+}
+
+func (api *FileAPI) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "offset required"})
+		return
+	}
+
+	buckets, done := api.transfers.buckets(r, directionUpload)
+	defer done()
+	body := throttle.Reader(r.Context(), r.Body, buckets...)
+	session, err := api.manager.UploadChunk(r.Context(), id, offset, body, getUser(r))
+	if err != nil {
+		writeUploadError(w, err, session)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: session})
+}
+
+func (api *FileAPI) handleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+	expectedSHA256 := r.URL.Query().Get("sha256")
+	if expectedSHA256 == "" {
+		expectedSHA256 = r.Header.Get("X-Content-SHA256")
+	}
+
+	session, err := api.manager.FinalizeUpload(r.Context(), id, expectedSHA256, getUser(r))
+	if err != nil {
+		writeUploadError(w, err, session)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: session})
+}
+
+func (api *FileAPI) handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+
+	if err := api.manager.AbortUpload(r.Context(), id, getUser(r)); err != nil {
+		writeUploadError(w, err, nil)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (api *FileAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
 	path := r.URL.Query().Get("path")
 	if path == "" {
 		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
 		return
 	}
 
-	info, err := api.manager.GetInfo(r.Context(), path, getUser(r))
-	if err != nil {
-		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: "file not found"})
+	if format := r.URL.Query().Get("archive"); format != "" {
+		api.downloadArchive(w, r, path, format)
 		return
 	}
 
+	// Keep the file open while serving so parallel range requests of a
+	// download manager share it
+	handle, ok := api.openDownload(w, path)
+	if !ok {
+		return
+	}
+	defer handle.Close()
+	info := handle.Info()
+
 	opts := filemanager.DownloadOptions{
 		Path: path,
 	}
+	etag := filemanager.ETag(info)
+	status := http.StatusOK
+	length := info.Size
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
 
+	// A Range with a stale If-Range validator gets the whole file, so a
+	// client never appends bytes of a newer version to an older one
 	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
+	if rangeHeader != "" && ifRangeMatches(r.Header.Get("If-Range"), etag, info.ModTime) {
 		start, end, err := filemanager.ParseRangeHeader(rangeHeader, info.Size)
+		if errors.Is(err, filemanager.ErrRangeNotSatisfiable) {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(info.Size, 10))
+			writeJSON(w, http.StatusRequestedRangeNotSatisfiable, Response{Success: false, Error: err.Error()})
+			return
+		}
 		if err == nil {
+			opts.Partial = true
 			opts.RangeStart = start
 			opts.RangeEnd = end
+			status = http.StatusPartialContent
+			length = end - start + 1
 			w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(info.Size, 10))
-			w.WriteHeader(http.StatusPartialContent)
 		}
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+info.Name+"\"")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
 
 	user := getUser(r)
-	if _, err := api.manager.Download(r.Context(), w, opts, user); err != nil {
+	buckets, done := api.transfers.buckets(r, directionDownload)
+	defer done()
+	out := throttle.Writer(r.Context(), w, buckets...)
+	if _, err := api.manager.Download(r.Context(), out, opts, user); err != nil {
+		return
+	}
+}
+
+// downloadArchive streams path, usually a directory, as a tar or zip
+// archive built on the fly. Its size is not known up front, so it has no
+// Content-Length and can't be resumed with ranges.
+func (api *FileAPI) downloadArchive(w http.ResponseWriter, r *http.Request, path, format string) {
+	if err := filemanager.ValidateArchiveFormat(format); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+	info, err := api.manager.GetInfo(r.Context(), path, getUser(r))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: "file not found"})
+		return
+	}
+
+	w.Header().Set("Content-Type", filemanager.ArchiveContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+info.Name+"."+format+"\"")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	buckets, done := api.transfers.buckets(r, directionDownload)
+	defer done()
+	out := throttle.Writer(r.Context(), w, buckets...)
+	if _, err := api.manager.Archive(r.Context(), out, path, format, getUser(r)); err != nil {
+		// Drop the connection, so the client sees the archive is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// openDownload opens path for downloading, writing an error response if
+// it can't be
+func (api *FileAPI) openDownload(w http.ResponseWriter, path string) (*filemanager.DownloadHandle, bool) {
+	handle, err := api.manager.OpenDownload(path)
+	if errors.Is(err, filemanager.ErrIsDirectory) {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: "file not found"})
+		return nil, false
+	}
+	return handle, true
+}
+
+// DownloadSegments lists byte ranges for downloading a file over several
+// connections
+type DownloadSegments struct {
+	Size     int64                 `json:"size"`
+	ETag     string                `json:"etag"`
+	Segments []filemanager.Segment `json:"segments"`
+}
+
+// handleDownloadSegments recommends how to split a download of path into
+// ranges fetched in parallel. Clients should send the returned ETag in
+// If-Range with each range, so a file changing mid-download is noticed.
+func (api *FileAPI) handleDownloadSegments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+	connections := 4
+	if value := r.URL.Query().Get("connections"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > filemanager.MaxSegments {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "connections must be between 1 and " + strconv.Itoa(filemanager.MaxSegments),
+			})
+			return
+		}
+		connections = n
+	}
+
+	handle, ok := api.openDownload(w, path)
+	if !ok {
 		return
 	}
+	defer handle.Close()
+	info := handle.Info()
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: DownloadSegments{
+			Size:     info.Size,
+			ETag:     filemanager.ETag(info),
+			Segments: filemanager.Segments(info.Size, connections),
+		},
+	})
+}
+
+// ifRangeMatches reports whether an If-Range header allows a partial
+// response. An entity tag must match etag exactly, since weak tags never
+// qualify; a date must equal the file's modification time.
+func ifRangeMatches(ifRange, etag string, modTime time.Time) bool {
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	case strings.HasPrefix(ifRange, "\""):
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Equal(modTime.UTC().Truncate(time.Second))
 }
 
 func (api *FileAPI) handleSymlink(w http.ResponseWriter, r *http.Request) {
@@ -343,19 +808,761 @@ func (api *FileAPI) handleChecksum(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getUser(r)
-	checksum, err := api.manager.GetChecksum(r.Context(), path, user)
+	algorithm := r.URL.Query().Get("algorithm")
+	checksum, err := api.manager.GetChecksum(r.Context(), path, algorithm, user, nil)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, filemanager.ErrUnknownAlgorithm) {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if algorithm == "" {
+		algorithm = filemanager.ChecksumMD5
+	}
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: map[string]string{"checksum": checksum, "algorithm": algorithm}})
+}
+
+// handlePreview returns the start of a text file, or the dimensions and
+// EXIF tags of an image, or the codecs and duration of a video, so the
+// portal can show a file without downloading it
+func (api *FileAPI) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+	maxBytes := 0
+	if value := r.URL.Query().Get("max_kb"); value != "" {
+		kb, err := strconv.Atoi(value)
+		if err != nil || kb < 1 || kb<<10 > filemanager.MaxPreviewBytes {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "max_kb must be between 1 and " + strconv.Itoa(filemanager.MaxPreviewBytes>>10),
+			})
+			return
+		}
+		maxBytes = kb << 10
+	}
+
+	preview, err := api.manager.Preview(r.Context(), path, maxBytes, getUser(r))
+	if errors.Is(err, filemanager.ErrIsDirectory) {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
 	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: "file not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: preview})
+}
+
+// handleText reads a text file for editing on GET and saves it on PUT
+func (api *FileAPI) handleText(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+			return
+		}
+		text, err := api.manager.ReadText(r.Context(), path, getUser(r))
+		if err != nil {
+			writeTextError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: text})
+	case http.MethodPut:
+		var req struct {
+			Path           string `json:"path"`
+			Content        string `json:"content"`
+			ExpectedSHA256 string `json:"expected_sha256"`
+			LockID         string `json:"lock_id"`
+			Create         bool   `json:"create"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 2*filemanager.MaxTextFileSize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+			return
+		}
+		if req.Path == "" {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+			return
+		}
+		if req.LockID == "" {
+			req.LockID = lockID(r)
+		}
+		edit, err := api.manager.WriteText(r.Context(), req.Path, req.Content, req.ExpectedSHA256, req.LockID, req.Create, getUser(r))
+		if err != nil {
+			writeTextError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: edit})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+	}
+}
+
+// writeTextError writes the response for a failed text read or edit
+func writeTextError(w http.ResponseWriter, err error) {
+	var policyErr *filemanager.PolicyError
+	var locked *filemanager.LockedError
+	switch {
+	case errors.As(err, &locked):
+		writeJSON(w, http.StatusLocked, Response{Success: false, Error: err.Error(), Code: "locked", Details: locked.Holder})
+	case errors.As(err, &policyErr):
+		writeJSON(w, policyErrorStatus(policyErr), Response{Success: false, Error: policyErr.Message, Code: policyErr.Code, Details: policyErr.Details})
+	case errors.Is(err, filemanager.ErrTextChanged):
+		writeJSON(w, http.StatusConflict, Response{Success: false, Error: err.Error(), Code: "text_changed"})
+	case errors.Is(err, filemanager.ErrNotText):
+		writeJSON(w, http.StatusUnsupportedMediaType, Response{Success: false, Error: err.Error()})
+	case errors.Is(err, filemanager.ErrIsDirectory):
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+	case errors.Is(err, fs.ErrNotExist):
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: "file not found"})
+	default:
 		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	}
+}
+
+func (api *FileAPI) handleListPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, Response{Success: true, Data: map[string]string{"checksum": checksum}})
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: api.manager.ListUploadPolicies()})
 }
 
-func getUser(r *http.Request) string {
-	user := r.Header.Get("X-User")
-	if user == "" {
-		user = "anonymous"
+func (api *FileAPI) handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
 	}
-	return user
+
+	statuses, err := api.manager.Quotas(r.Context())
+	if err != nil {
+		status := errorStatus(err, http.StatusInternalServerError)
+		if errors.Is(err, filemanager.ErrQuotasDisabled) {
+			status = http.StatusNotImplemented
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: statuses})
+}
+
+func (api *FileAPI) handleSetPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var policy filemanager.UploadPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+
+	user := getUser(r)
+	if err := api.manager.SetUploadPolicy(r.Context(), &policy, user); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: policy})
+}
+
+func (api *FileAPI) handleRemovePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+
+	user := getUser(r)
+	if err := api.manager.RemoveUploadPolicy(r.Context(), req.Path, user); err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func getUser(r *http.Request) string {
+	user := r.Header.Get("X-User")
+	if user == "" {
+		user = "anonymous"
+	}
+	return user
+}
+
+// trashErrorStatus maps trash errors to HTTP status codes
+func trashErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, filemanager.ErrTrashNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, filemanager.ErrTrashConflict):
+		return http.StatusConflict
+	case errors.Is(err, filemanager.ErrTrashDisabled):
+		return http.StatusNotImplemented
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
+
+// RestoreTrashRequest restores a trash item
+type RestoreTrashRequest struct {
+	ID   string `json:"id"`
+	Path string `json:"path"` // Optional; defaults to where it was deleted from
+}
+
+func (api *FileAPI) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	items, err := api.manager.ListTrash()
+	if err != nil {
+		writeJSON(w, trashErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+	writePage(w, items, page)
+}
+
+func (api *FileAPI) handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req RestoreTrashRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+	if req.ID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+
+	item, err := api.manager.RestoreTrash(r.Context(), req.ID, req.Path, getUser(r))
+	if err != nil {
+		writeJSON(w, trashErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: item})
+}
+
+func (api *FileAPI) handlePurgeTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+
+	if err := api.manager.PurgeTrash(r.Context(), id, getUser(r)); err != nil {
+		writeJSON(w, trashErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (api *FileAPI) handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	count, freed, err := api.manager.EmptyTrash(r.Context(), getUser(r))
+	if err != nil {
+		writeJSON(w, trashErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: map[string]interface{}{"purged": count, "freed_bytes": freed}})
+}
+
+// Types of file jobs; other jobs are not listed under /api/v1/files/jobs
+const (
+	fileJobCopy     = "file.copy"
+	fileJobMove     = "file.move"
+	fileJobChecksum = "file.checksum"
+)
+
+// FileJobRequest starts a recursive copy or move
+type FileJobRequest struct {
+	SrcPath   string `json:"src_path"`
+	DstPath   string `json:"dst_path"`
+	Overwrite bool   `json:"overwrite"` // Merge into an existing directory, replacing files
+}
+
+// checksumJobPath starts checksum jobs, which only read, so they need no
+// write scope and run in maintenance mode
+const checksumJobPath = "/api/v1/files/jobs/checksum"
+
+// ChecksumJobRequest starts hashing a file in the background
+type ChecksumJobRequest struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"` // md5 (default), sha1, sha256 or blake3
+}
+
+func isFileJob(job *jobs.Job) bool {
+	return job.Type == fileJobCopy || job.Type == fileJobMove || job.Type == fileJobChecksum
+}
+
+func (api *FileAPI) handleStartFileJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+	if api.jobs == nil {
+		writeJSON(w, http.StatusNotImplemented, Response{Success: false, Error: "file jobs are not enabled"})
+		return
+	}
+
+	var req FileJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+	if req.SrcPath == "" || req.DstPath == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "src_path and dst_path required"})
+		return
+	}
+
+	run, jobType := api.manager.CopyTree, fileJobCopy
+	if strings.HasSuffix(r.URL.Path, "/move") {
+		run, jobType = api.manager.MoveTree, fileJobMove
+	}
+	user := getUser(r)
+	opts := filemanager.TreeOptions{Overwrite: req.Overwrite}
+	job := api.jobs.SubmitCancelable(jobType, req.SrcPath, func(ctx context.Context) error {
+		return run(ctx, req.SrcPath, req.DstPath, opts, user, func(p filemanager.TransferProgress) {
+			jobs.SetProgress(ctx, p)
+		})
+	})
+
+	writeJSON(w, http.StatusAccepted, Response{Success: true, Data: job})
+}
+
+// handleStartChecksumJob hashes a file as a background job, so clients need
+// not hold a request open while a large file is read. The checksum is in
+// the progress of the finished job.
+func (api *FileAPI) handleStartChecksumJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+	if api.jobs == nil {
+		writeJSON(w, http.StatusNotImplemented, Response{Success: false, Error: "file jobs are not enabled"})
+		return
+	}
+
+	var req ChecksumJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+	if req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+	switch req.Algorithm {
+	case "", filemanager.ChecksumMD5, filemanager.ChecksumSHA1, filemanager.ChecksumSHA256, filemanager.ChecksumBLAKE3:
+	default:
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "unknown checksum algorithm: " + req.Algorithm})
+		return
+	}
+
+	user := getUser(r)
+	job := api.jobs.SubmitCancelable(fileJobChecksum, req.Path, func(ctx context.Context) error {
+		_, err := api.manager.GetChecksum(ctx, req.Path, req.Algorithm, user, func(p filemanager.ChecksumProgress) {
+			jobs.SetProgress(ctx, p)
+		})
+		return err
+	})
+
+	writeJSON(w, http.StatusAccepted, Response{Success: true, Data: job})
+}
+
+func (api *FileAPI) handleListFileJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	fileJobs := []*jobs.Job{}
+	if api.jobs != nil {
+		for _, job := range api.jobs.List() {
+			if isFileJob(job) {
+				fileJobs = append(fileJobs, job)
+			}
+		}
+	}
+	writePage(w, fileJobs, page)
+}
+
+func (api *FileAPI) handleFileJobStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	job, ok := api.fileJob(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: job})
+}
+
+func (api *FileAPI) handleCancelFileJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	if _, ok := api.fileJob(w, r); !ok {
+		return
+	}
+	job, err := api.jobs.Cancel(r.URL.Query().Get("id"))
+	if err != nil {
+		writeJSON(w, jobErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, Response{Success: true, Data: job})
+}
+
+// fileJob looks up the file job named by the id parameter and answers the
+// request if there is none
+func (api *FileAPI) fileJob(w http.ResponseWriter, r *http.Request) (*jobs.Job, bool) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return nil, false
+	}
+	if api.jobs == nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: "file job not found"})
+		return nil, false
+	}
+	job, err := api.jobs.Get(id)
+	if err == nil && !isFileJob(job) {
+		err = fmt.Errorf("%w: %s", jobs.ErrNotFound, id)
+	}
+	if err != nil {
+		writeJSON(w, jobErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return nil, false
+	}
+	return job, true
+}
+
+// SetPermissionsRequest changes the permissions of a file
+type SetPermissionsRequest struct {
+	Path string `json:"path"`
+	filemanager.PermissionChange
+}
+
+// permissionsErrorStatus maps permission errors to HTTP status codes
+func permissionsErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, filemanager.ErrInvalidPermissions):
+		return http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
+
+func (api *FileAPI) handlePermissions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+			return
+		}
+
+		perms, err := api.manager.GetPermissions(r.Context(), path, getUser(r))
+		if err != nil {
+			writeJSON(w, permissionsErrorStatus(err), Response{Success: false, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: perms})
+	case http.MethodPost:
+		var req SetPermissionsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+			return
+		}
+		if req.Path == "" {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+			return
+		}
+
+		perms, err := api.manager.SetPermissions(r.Context(), req.Path, req.PermissionChange, getUser(r))
+		if err != nil {
+			writeJSON(w, permissionsErrorStatus(err), Response{Success: false, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: perms})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+	}
+}
+
+func (api *FileAPI) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+	depth := 1
+	if value := r.URL.Query().Get("depth"); value != "" {
+		var err error
+		if depth, err = strconv.Atoi(value); err != nil || depth < 0 || depth > filemanager.MaxUsageDepth {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: fmt.Sprintf("depth must be between 0 and %d", filemanager.MaxUsageDepth)})
+			return
+		}
+	}
+
+	ctx := cacheContext(r)
+	usage, err := api.manager.Usage(ctx, path, depth, getUser(r))
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	setCacheHeaders(w, ctx)
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: usage})
+}
+
+// GrepLine is one line of a content search stream: a match, the summary
+// that ends a finished search, or the error that ended it early
+type GrepLine struct {
+	Type string `json:"type"` // match, summary or error
+	*filemanager.GrepMatch
+	Summary *filemanager.GrepSummary `json:"summary,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+}
+
+func (api *FileAPI) handleGrep(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	opts := filemanager.GrepOptions{
+		Path:       query.Get("path"),
+		Pattern:    query.Get("pattern"),
+		IgnoreCase: query.Get("ignore_case") == "true",
+	}
+	if opts.Path == "" || opts.Pattern == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path and pattern required"})
+		return
+	}
+	if value := query.Get("ext"); value != "" {
+		opts.Extensions = strings.Split(value, ",")
+	}
+	for name, target := range map[string]*int{"context": &opts.Context, "max_matches": &opts.MaxMatches} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid " + name})
+				return
+			}
+			*target = n
+		}
+	}
+	if value := query.Get("max_size"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid max_size"})
+			return
+		}
+		opts.MaxFileSize = n
+	}
+
+	// The stream starts with the first match, so errors found before it
+	// are still answered with a status code
+	rc := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	summary, err := api.manager.Grep(r.Context(), opts, getUser(r), func(match *filemanager.GrepMatch) error {
+		start()
+		if err := encoder.Encode(GrepLine{Type: "match", GrepMatch: match}); err != nil {
+			return err
+		}
+		rc.Flush()
+		return nil
+	})
+	if err != nil && !started {
+		status := errorStatus(err, http.StatusBadRequest)
+		if summary != nil {
+			status = errorStatus(err, http.StatusInternalServerError)
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	start()
+	if err != nil {
+		encoder.Encode(GrepLine{Type: "error", Error: err.Error()})
+		return
+	}
+	encoder.Encode(GrepLine{Type: "summary", Summary: summary})
+}
+
+// BatchRequest runs several file operations in one call
+type BatchRequest struct {
+	Operations    []filemanager.BatchOp `json:"operations"`
+	Transactional bool                  `json:"transactional"` // Undo everything if one operation fails
+}
+
+func (api *FileAPI) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+
+	report, err := api.manager.Batch(r.Context(), req.Operations, req.Transactional, getUser(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, filemanager.ErrInvalidBatch) {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Per-item outcomes are in the report; the batch itself succeeded
+	// only if every operation did
+	resp := Response{Success: report.Failed == 0, Data: report}
+	if report.Failed > 0 {
+		resp.Error = fmt.Sprintf("%d of %d operations failed", report.Failed, len(req.Operations))
+		if report.RolledBack {
+			resp.Error += "; all changes were rolled back"
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// versionErrorStatus maps file versioning errors to HTTP status codes
+func versionErrorStatus(err error) int {
+	var locked *filemanager.LockedError
+	switch {
+	case errors.Is(err, filemanager.ErrVersionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, filemanager.ErrVersioningDisabled):
+		return http.StatusNotImplemented
+	case errors.As(err, &locked):
+		return http.StatusLocked
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
+
+// RestoreVersionRequest restores a previous version of a file
+type RestoreVersionRequest struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+func (api *FileAPI) handleListVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+
+	versions, err := api.manager.ListVersions(r.Context(), path, getUser(r))
+	if err != nil {
+		writeJSON(w, versionErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: versions})
+}
+
+func (api *FileAPI) handleRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req RestoreVersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request"})
+		return
+	}
+	if req.Path == "" || req.ID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path and id required"})
+		return
+	}
+
+	version, err := api.manager.RestoreVersion(r.Context(), req.Path, req.ID, getUser(r))
+	if err != nil {
+		writeJSON(w, versionErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: version})
 }
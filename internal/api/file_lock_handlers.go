@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+)
+
+// lockRequest is the body of lock acquire, steal and refresh requests
+type lockRequest struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	Session    string `json:"session"`
+	TTLSeconds int    `json:"ttl_seconds"` // 0 for the default
+}
+
+func (req *lockRequest) ttl() time.Duration {
+	return time.Duration(req.TTLSeconds) * time.Second
+}
+
+// lockID returns the ID of the lock a write request holds, from its lock_id
+// parameter or X-Lock-ID header
+func lockID(r *http.Request) string {
+	if id := r.URL.Query().Get("lock_id"); id != "" {
+		return id
+	}
+	return r.Header.Get("X-Lock-ID")
+}
+
+func (api *FileAPI) handleListLocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: api.manager.ListLocks(r.URL.Query().Get("path"))})
+}
+
+// handleAcquireLock handles both acquiring and stealing locks, which
+// differ only in whether another holder is replaced
+func (api *FileAPI) handleAcquireLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+
+	acquire := api.manager.AcquireLock
+	if r.URL.Path == "/api/v1/files/locks/steal" {
+		acquire = api.manager.StealLock
+	}
+	lock, err := acquire(r.Context(), req.Path, req.Session, req.ttl(), getUser(r))
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: lock})
+}
+
+func (api *FileAPI) handleRefreshLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+
+	lock, err := api.manager.RefreshLock(req.ID, req.ttl())
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: lock})
+}
+
+func (api *FileAPI) handleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "id required"})
+		return
+	}
+
+	if err := api.manager.ReleaseLock(r.Context(), req.ID, getUser(r)); err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+// writeLockError writes the response for a failed lock request. Conflicts
+// carry the current holder.
+func writeLockError(w http.ResponseWriter, err error) {
+	var locked *filemanager.LockedError
+	switch {
+	case errors.As(err, &locked):
+		writeJSON(w, http.StatusConflict, Response{Success: false, Error: err.Error(), Code: "locked", Details: locked.Holder})
+	case errors.Is(err, filemanager.ErrLockNotFound):
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+	}
+}
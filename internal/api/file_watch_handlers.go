@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
+)
+
+// fileWatchFilter selects the events streamed by file watches
+var fileWatchFilter = &events.Filter{Types: []string{watcher.EventCreated, watcher.EventModified, watcher.EventDeleted}}
+
+// SetEventBus enables live file watches, streaming the file events
+// published on bus
+func (api *FileAPI) SetEventBus(bus *events.Bus) {
+	api.bus = bus
+}
+
+// handleWatch handles GET /api/v1/files/watch. It streams changes below a
+// directory as Server-Sent Events, or over a WebSocket when the client
+// asks for an upgrade.
+func (api *FileAPI) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+	if api.bus == nil {
+		writeJSON(w, http.StatusNotImplemented, Response{Success: false, Error: watcher.ErrUnsupported.Error()})
+		return
+	}
+
+	// Subscribe first so nothing is missed once the watch is in place
+	sub := api.bus.Subscribe(fileWatchFilter, 256)
+	defer sub.Close()
+
+	release, err := api.manager.Watch(r.Context(), path, getUser(r))
+	if err != nil {
+		status := errorStatus(err, http.StatusBadRequest)
+		if errors.Is(err, watcher.ErrUnsupported) {
+			status = http.StatusNotImplemented
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
+		return
+	}
+	defer release()
+	dir := filepath.Clean(path)
+
+	// Streams outlive the server timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		server := websocket.Server{
+			Handshake: checkWebSocketOrigin,
+			Handler: func(ws *websocket.Conn) {
+				streamWatchWebSocket(ws, sub, dir)
+			},
+		}
+		server.ServeHTTP(hijackWriter{ResponseWriter: w, rc: rc}, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !watchedEvent(event, dir) {
+				continue
+			}
+			if err := writeSSEEvent(w, event); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// streamWatchWebSocket sends the file events below dir as JSON text
+// messages until the client goes away. Messages from the client are
+// ignored.
+func streamWatchWebSocket(ws *websocket.Conn, sub *events.Subscription, dir string) {
+	defer ws.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			ws.PayloadType = websocket.PingFrame
+			_, err := ws.Write(nil)
+			ws.PayloadType = websocket.TextFrame
+			if err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !watchedEvent(event, dir) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if err := websocket.Message.Send(ws, string(data)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchedEvent reports whether event is about a path below dir
+func watchedEvent(event *events.Event, dir string) bool {
+	file, ok := event.Data.(*watcher.FileEvent)
+	if !ok || file.Path == dir {
+		return false
+	}
+	return dir == "/" || strings.HasPrefix(file.Path, dir+string(filepath.Separator))
+}
+
+// checkWebSocketOrigin refuses WebSocket connections opened by pages of
+// other sites. Clients that send no Origin, like scripts, are accepted.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host != r.Host {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	config.Origin = parsed
+	return nil
+}
+
+// hijackWriter lets the WebSocket server take over connections whose
+// writer is wrapped by middleware
+type hijackWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.rc.Hijack()
+}
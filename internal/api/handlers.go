@@ -1,20 +1,33 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/cache"
 	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
 )
 
 type Response struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+
+	// NextPageToken is set on list responses that have more pages
+	NextPageToken string `json:"next_page_token,omitempty"`
 }
 
 type HealthResponse struct {
@@ -23,6 +36,19 @@ type HealthResponse struct {
 	Version   string    `json:"version"`
 }
 
+// Capabilities reports which subsystems and integrations are enabled so
+// clients can hide features a minimal install does not serve
+type Capabilities struct {
+	Version      string          `json:"version"`
+	Subsystems   map[string]bool `json:"subsystems"`
+	Integrations map[string]bool `json:"integrations"`
+	Plugins      []string        `json:"plugins"`
+
+	// MountOptions lists the accepted disk mount options when disk
+	// management is enabled
+	MountOptions *diskmanager.MountOptionSets `json:"mount_options,omitempty"`
+}
+
 type RegistrationInfo struct {
 	AgentID   string    `json:"agent_id"`
 	Hostname  string    `json:"hostname"`
@@ -34,6 +60,7 @@ type RegistrationInfo struct {
 func RegisterHTTPHandlers(mux *http.ServeMux, auditLogger *audit.Logger, cfg *config.Config) {
 	mux.HandleFunc("/api/v1/register", registrationHandler(auditLogger, cfg))
 	mux.HandleFunc("/api/v1/status", statusHandler)
+	mux.HandleFunc("/api/v1/capabilities", capabilitiesHandler(cfg))
 }
 
 // registrationHandler godoc
@@ -91,7 +118,7 @@ func registrationHandler(auditLogger *audit.Logger, cfg *config.Config) http.Han
 // @Description Returns the current status and uptime of the agent
 // @Tags status
 // @Produce json
-// @Success 200 {object} Response
+// @Success 200 {object} Response{data=AgentStatus}
 // @Failure 405 {object} Response
 // @Router /status [get]
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -103,15 +130,127 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hostname, _ := getHostname()
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: agentStatus()})
+}
+
+// capabilitiesHandler godoc
+// @Summary Get agent capabilities
+// @Description Returns the enabled subsystems, integrations and plugins
+// @Tags status
+// @Produce json
+// @Success 200 {object} Response{data=Capabilities}
+// @Failure 405 {object} Response
+// @Router /capabilities [get]
+func capabilitiesHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, Response{
+				Success: false,
+				Error:   "method not allowed",
+			})
+			return
+		}
+
+		caps := Capabilities{
+			Version:      "1.0.0",
+			Subsystems:   map[string]bool{},
+			Integrations: map[string]bool{},
+			Plugins:      []string{},
+		}
+		if cfg != nil {
+			caps.Subsystems = cfg.Features.Map()
+			caps.Integrations = map[string]bool{
+				"mqtt":              cfg.MQTT.Enabled,
+				"ftp":               cfg.FTP.Enabled,
+				"sftp":              cfg.SFTP.Enabled,
+				"portal_sync":       cfg.Features.Scheduler && cfg.Scheduler.PortalURL != "",
+				"cluster_gateway":   cfg.Cluster.Gateway,
+				"cluster_advertise": cfg.Cluster.Advertise,
+				"token_auth":        cfg.Security.TokenAuth,
+			}
+			if cfg.Features.Disks {
+				caps.MountOptions = diskmanager.AllowedMountOptions()
+			}
+			for _, entry := range cfg.Plugins.Entries {
+				if entry.Enabled {
+					caps.Plugins = append(caps.Plugins, entry.Name)
+				}
+			}
+		}
 
-	status := map[string]interface{}{
-		"hostname": hostname,
-		"uptime":   time.Since(time.Now()).Seconds(),
-		"status":   "running",
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: caps})
 	}
+}
+
+// DryRunResult is returned instead of applying a change when the request
+// has dry_run=true
+type DryRunResult struct {
+	DryRun bool         `json:"dry_run"`
+	Plan   *dryrun.Plan `json:"plan"`
+}
+
+// dryRunPaths are the endpoints that support dry_run
+var dryRunPaths = map[string]bool{
+	"/api/v1/shares/add":     true,
+	"/api/v1/shares/update":  true,
+	"/api/v1/netdisk/mount":  true,
+	"/api/v1/network/config": true,
+
+	"/api/v1/disk/partitions/create": true,
+	"/api/v1/disk/partitions/delete": true,
+	"/api/v1/disk/partitions/resize": true,
+	"/api/v1/disk/format":            true,
+	"/api/v1/disk/luks/format":       true,
+}
 
-	writeJSON(w, http.StatusOK, Response{Success: true, Data: status})
+// isDryRun reports whether the request asks for a dry run with the
+// dry_run query parameter
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// writePlan responds to a dry run
+func writePlan(w http.ResponseWriter, plan *dryrun.Plan) {
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    DryRunResult{DryRun: true, Plan: plan},
+	})
+}
+
+// errorStatus returns 504 when err was caused by a deadline, such as an
+// external command or database call timing out, and fallback otherwise
+func errorStatus(err error, fallback int) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return fallback
+}
+
+// cacheContext returns the context for reads that may be served from a
+// manager's cache. "Cache-Control: no-cache" on the request skips cached
+// values.
+func cacheContext(r *http.Request) context.Context {
+	ctx := cache.WithFreshness(r.Context())
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		ctx = cache.WithRefresh(ctx)
+	}
+	return ctx
+}
+
+// setCacheHeaders tells the client how old the data read with ctx is and
+// how long it stays fresh
+func setCacheHeaders(w http.ResponseWriter, ctx context.Context) {
+	age, maxAge, ok := cache.Freshness(ctx)
+	if !ok {
+		return
+	}
+	if maxAge < time.Second {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
 }
 
 func writeJSON(w http.ResponseWriter, status int, data interface{}) {
@@ -120,6 +259,18 @@ func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// startTime is when the agent process started
+var startTime = time.Now()
+
+func agentStatus() *AgentStatus {
+	hostname, _ := getHostname()
+	return &AgentStatus{
+		Hostname: hostname,
+		Uptime:   time.Since(startTime).Seconds(),
+		Status:   "running",
+	}
+}
+
 func getHostname() (string, error) {
 	hostname, err := os.Hostname()
 	if err != nil || hostname == "" {
@@ -133,19 +284,31 @@ func buildAPIURLs(cfg *config.Config, hostname string) []string {
 		return nil
 	}
 
-	host := cfg.Server.ListenAddr
-	if host == "" || host == "0.0.0.0" || host == "::" {
-		if hostname != "" {
-			host = hostname
-		} else {
-			host = "localhost"
+	var urls []string
+	seen := make(map[string]bool)
+	for _, l := range cfg.HTTPListeners() {
+		host, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			continue
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			if hostname != "" {
+				host = hostname
+			} else {
+				host = "localhost"
+			}
 		}
-	}
 
-	scheme := "http"
-	if cfg.API.TLSCert != "" && cfg.API.TLSKey != "" {
-		scheme = "https"
-	}
+		scheme := "http"
+		if l.TLS() {
+			scheme = "https"
+		}
 
-	return []string{fmt.Sprintf("%s://%s:%d/api/v1", scheme, host, cfg.Server.HTTPPort)}
+		url := fmt.Sprintf("%s://%s/api/v1", scheme, net.JoinHostPort(host, port))
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
 }
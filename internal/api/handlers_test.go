@@ -1,9 +1,54 @@
 package api
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/KOPElan/mingyue-agent/internal/alerts"
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/cluster"
 	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+	"github.com/KOPElan/mingyue-agent/internal/indexer"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/maintenance"
+	"github.com/KOPElan/mingyue-agent/internal/netdisk"
+	"github.com/KOPElan/mingyue-agent/internal/plugins"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
+	"github.com/KOPElan/mingyue-agent/pkg/plugin"
+	"golang.org/x/net/websocket"
 )
 
 func TestBuildAPIURLsDisabled(t *testing.T) {
@@ -41,3 +86,3522 @@ func TestBuildAPIURLsUsesHostnameAndTLS(t *testing.T) {
 		t.Fatalf("expected %q, got %q", expected, urls[0])
 	}
 }
+
+func TestBuildAPIURLsListeners(t *testing.T) {
+	cfg := &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{
+				{Addr: "0.0.0.0:8443"},
+				{Addr: "[::]:8443"},
+				{Addr: "[fd00::2]:8080", NoTLS: true},
+			},
+		},
+		API: config.APIConfig{
+			EnableHTTP: true,
+			TLSCert:    "/tmp/cert.pem",
+			TLSKey:     "/tmp/key.pem",
+		},
+	}
+
+	urls := buildAPIURLs(cfg, "agent-host")
+	expected := []string{"https://agent-host:8443/api/v1", "http://[fd00::2]:8080/api/v1"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("expected %v, got %v", expected, urls)
+	}
+}
+
+func TestCapabilitiesReflectFeatures(t *testing.T) {
+	cfg := &config.Config{
+		Features: config.FeaturesConfig{
+			Files:    true,
+			ShareMgr: false,
+		},
+		Plugins: config.PluginsConfig{
+			Entries: []config.PluginConfig{
+				{Name: "transmission", Enabled: true},
+				{Name: "disabled", Enabled: false},
+			},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(cfg)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/capabilities", nil))
+
+	var resp struct {
+		Data Capabilities `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	if !resp.Data.Subsystems["files"] || resp.Data.Subsystems["sharemgr"] {
+		t.Fatalf("unexpected subsystems: %v", resp.Data.Subsystems)
+	}
+	if len(resp.Data.Plugins) != 1 || resp.Data.Plugins[0] != "transmission" {
+		t.Fatalf("expected only enabled plugins, got %v", resp.Data.Plugins)
+	}
+	if resp.Data.MountOptions != nil {
+		t.Fatalf("mount options should be omitted when disks are disabled")
+	}
+}
+
+func TestMaintenanceGuard(t *testing.T) {
+	mode, err := maintenance.New(&maintenance.Config{
+		StateFile: filepath.Join(t.TempDir(), "maintenance.json"),
+	})
+	if err != nil {
+		t.Fatalf("maintenance.New: %v", err)
+	}
+	if _, err := mode.Set(true, "admin", "backup"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	guard := MaintenanceGuard(mode, next)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/api/v1/disk/list", http.StatusNoContent},
+		{http.MethodPost, "/api/v1/disk/mount", http.StatusServiceUnavailable},
+		{http.MethodDelete, "/api/v1/webhooks/remove", http.StatusServiceUnavailable},
+		{http.MethodPost, "/api/v1/maintenance", http.StatusNoContent},
+		{http.MethodPost, "/api/v1/auth/sessions/refresh", http.StatusNoContent},
+		{http.MethodPost, "/api/v1/shares/add?dry_run=true", http.StatusNoContent},
+		{http.MethodPost, "/api/v1/files/delete?dry_run=true", http.StatusServiceUnavailable},
+		{http.MethodPost, "/api/v1/netdisk/mount?check=true", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		guard.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.status, rec.Code)
+		}
+	}
+
+	if _, err := mode.Set(false, "admin", ""); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	guard.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/disk/mount", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected requests to pass after maintenance ends, got %d", rec.Code)
+	}
+}
+
+func TestWritePageFollowsTokens(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+
+	var got []int
+	token := ""
+	for pages := 0; pages < 5; pages++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs?limit=2&page_token="+token, nil)
+		page, err := parsePage(req)
+		if err != nil {
+			t.Fatalf("parsePage: %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		writePage(rec, items, page)
+		var resp struct {
+			Data          []int  `json:"data"`
+			NextPageToken string `json:"next_page_token"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if len(resp.Data) > 2 {
+			t.Fatalf("expected at most 2 items, got %v", resp.Data)
+		}
+		got = append(got, resp.Data...)
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+	if len(got) != len(items) {
+		t.Fatalf("expected %v across pages, got %v", items, got)
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "page_token=bogus"} {
+		if _, err := parsePage(httptest.NewRequest(http.MethodGet, "/api/v1/jobs?"+query, nil)); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+	page, _ := parsePage(httptest.NewRequest(http.MethodGet, "/api/v1/jobs?limit=5000", nil))
+	if page.limit != maxPageSize {
+		t.Errorf("expected limit capped at %d, got %d", maxPageSize, page.limit)
+	}
+}
+
+func TestWritePageSelectsFields(t *testing.T) {
+	type share struct {
+		Name    string `json:"name"`
+		Path    string `json:"path"`
+		Enabled bool   `json:"enabled"`
+	}
+	shares := []share{{"media", "/data/media", true}, {"backup", "/data/backup", false}}
+
+	page, err := parsePage(httptest.NewRequest(http.MethodGet, "/api/v1/shares?fields=name,+enabled,unknown", nil))
+	if err != nil {
+		t.Fatalf("parsePage: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	writePage(rec, shares, page)
+
+	var resp struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(resp.Data) != 2 {
+		t.Fatalf("expected 2 items, got %v", resp.Data)
+	}
+	for _, item := range resp.Data {
+		if len(item) != 2 || item["name"] == nil || item["enabled"] == nil {
+			t.Errorf("expected only name and enabled, got %v", item)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("raw bytes"))
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: "hello"})
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil)
+	req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzipped response, got headers %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(gz).Decode(&resp); err != nil || resp.Data != "hello" {
+		t.Fatalf("expected the JSON body after decompression, got %+v (%v)", resp, err)
+	}
+
+	for _, tt := range []struct {
+		path, accept string
+	}{
+		{"/api/v1/jobs", ""},
+		{"/api/v1/jobs", "gzip;q=0"},
+		{"/download", "gzip"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s with Accept-Encoding %q: expected no compression", tt.path, tt.accept)
+		}
+		if body, _ := io.ReadAll(rec.Body); len(body) == 0 {
+			t.Errorf("%s with Accept-Encoding %q: empty body", tt.path, tt.accept)
+		}
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{http.MethodGet, "/healthz", ""},
+		{http.MethodGet, "/api/v1/files/list", "files:read"},
+		{http.MethodPost, "/api/v1/files/delete", "files:write"},
+		{http.MethodPut, "/api/v1/files/transfer-limits", "system:admin"},
+		{http.MethodGet, "/api/v1/shares", "shares:read"},
+		{http.MethodDelete, "/api/v1/shares/remove", "shares:admin"},
+		{http.MethodPost, "/api/v1/rsync/start", "shares:admin"},
+		{http.MethodPost, "/api/v1/network/config", "network:admin"},
+		{http.MethodGet, "/api/v1/auth/tokens", "auth:admin"},
+		{http.MethodPost, "/api/v1/maintenance", "system:admin"},
+		{http.MethodPost, "/api/v1/alerts/ack", "monitor:write"},
+		{http.MethodGet, "/api/v1/cluster/proxy/nas-02/api/v1/status", "cluster:read"},
+		{http.MethodPost, "/api/v1/query", ""},
+		{http.MethodPost, "/api/v1/hooks/secret", ""},
+		{http.MethodPost, "/api/v1/scheduler/tasks/hook", "scheduler:admin"},
+		{http.MethodGet, "/api/v1/rules", "scheduler:read"},
+		{http.MethodPost, "/api/v1/rules/add", "scheduler:admin"},
+		{"PROPFIND", "/webdav/data/", "files:read"},
+		{"MKCOL", "/webdav/data/photos", "files:write"},
+		{http.MethodGet, "/api/v1/unknown", "*"},
+	}
+	for _, tt := range tests {
+		if got := requiredScope(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.scope {
+			t.Errorf("%s %s: expected %q, got %q", tt.method, tt.path, tt.scope, got)
+		}
+	}
+}
+
+func TestAuthGuardImpersonation(t *testing.T) {
+	dir := t.TempDir()
+	authMgr, err := auth.New(auth.Config{DBPath: filepath.Join(dir, "auth.db")})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	defer authMgr.Close()
+	auditLogger, err := audit.New(filepath.Join(dir, "audit.log"), false, "", true)
+	if err != nil {
+		t.Fatalf("audit.New: %v", err)
+	}
+
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+	support, err := authMgr.CreateToken(ctx, "admin", "support", []string{"files:read", "auth:impersonate"}, expiresAt)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	reader, err := authMgr.CreateToken(ctx, "carol", "reader", []string{"files:read"}, expiresAt)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	var servedAs string
+	guard := AuthGuard(authMgr, auditLogger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servedAs = getUser(r)
+		auditLogger.Log(r.Context(), &audit.Entry{User: getUser(r), Action: "list", Resource: "/data", Result: "success"})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(token, as string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/list?path=/data", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set(impersonateHeader, as)
+		rec := httptest.NewRecorder()
+		guard.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request("", "bob"); code != http.StatusUnauthorized {
+		t.Errorf("anonymous impersonation: expected 401, got %d", code)
+	}
+	if code := request(reader.Token, "bob"); code != http.StatusForbidden {
+		t.Errorf("impersonation without scope: expected 403, got %d", code)
+	}
+	unscoped, err := authMgr.CreateToken(ctx, "carol", "full access", nil, expiresAt)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if code := request(unscoped.Token, "bob"); code != http.StatusForbidden {
+		t.Errorf("impersonation with an unscoped token: expected 403, got %d", code)
+	}
+	session, err := authMgr.CreateSession(ctx, "carol", "192.0.2.1", "browser")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if code := request(session.Token, "bob"); code != http.StatusForbidden {
+		t.Errorf("impersonation with a session: expected 403, got %d", code)
+	}
+	if servedAs != "" {
+		t.Fatalf("expected rejected impersonations not to be served, got %q", servedAs)
+	}
+
+	if code := request(support.Token, "bob"); code != http.StatusNoContent {
+		t.Fatalf("impersonation with scope: expected 204, got %d", code)
+	}
+	if servedAs != "bob" {
+		t.Errorf("expected the request to be served as bob, got %q", servedAs)
+	}
+
+	entries, err := auditLogger.Query(audit.QueryFilter{Impersonator: "admin"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the impersonation and the action to be audited, got %d entries", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.User != "bob" || entry.Impersonator != "admin" {
+			t.Errorf("expected user bob and impersonator admin, got %q and %q", entry.User, entry.Impersonator)
+		}
+	}
+}
+
+func TestAuthGuardRequiresAuth(t *testing.T) {
+	authMgr, err := auth.New(auth.Config{DBPath: filepath.Join(t.TempDir(), "auth.db"), RequireAuth: true})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	defer authMgr.Close()
+	reader, err := authMgr.CreateToken(context.Background(), "carol", "reader", []string{"files:read"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	guard := AuthGuard(authMgr, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		user     string
+		expected int
+	}{
+		{"anonymous read", http.MethodGet, "/api/v1/files/list?path=/data", "", "", http.StatusUnauthorized},
+		{"anonymous with X-User", http.MethodPost, "/api/v1/disk/format", "", "admin", http.StatusUnauthorized},
+		{"scoped token outside its scope", http.MethodPost, "/api/v1/disk/format", reader.Token, "", http.StatusForbidden},
+		{"scoped token within its scope", http.MethodGet, "/api/v1/files/list?path=/data", reader.Token, "", http.StatusNoContent},
+		{"health check", http.MethodGet, "/healthz", "", "", http.StatusNoContent},
+		{"task hook", http.MethodPost, "/api/v1/hooks/secret", "", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.user != "" {
+				req.Header.Set("X-User", tt.user)
+			}
+			rec := httptest.NewRecorder()
+			guard.ServeHTTP(rec, req)
+			if rec.Code != tt.expected {
+				t.Fatalf("expected %d, got %d", tt.expected, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAuthGuardBansAnonymousCallers(t *testing.T) {
+	authMgr, err := auth.New(auth.Config{DBPath: filepath.Join(t.TempDir(), "auth.db"), RequireAuth: true, MaxFailures: 2})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	defer authMgr.Close()
+
+	guard := AuthGuard(authMgr, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	var codes []int
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/list?path=/data", nil)
+		req.RemoteAddr = "192.0.2.9:40000"
+		rec := httptest.NewRecorder()
+		guard.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	expected := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusForbidden}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Fatalf("expected %v, got %v", expected, codes)
+	}
+}
+
+func TestAuthGuardTrustsLocalPeer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are read on Linux only")
+	}
+	dir := t.TempDir()
+	authMgr, err := auth.New(auth.Config{DBPath: filepath.Join(dir, "auth.db"), RequireAuth: true})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	defer authMgr.Close()
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("current user: %v", err)
+	}
+
+	var servedAs string
+	guard := AuthGuard(authMgr, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servedAs = getUser(r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// serve returns a function making requests over a socket whose peers
+	// are trusted as configured
+	serve := func(name string, trust *LocalTrust) func(as string) (int, string) {
+		socket := filepath.Join(dir, name)
+		lis, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		srv := &http.Server{Handler: guard, ConnContext: trust.ConnContext}
+		go srv.Serve(lis)
+		t.Cleanup(func() { srv.Close() })
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}}
+		return func(as string) (int, string) {
+			servedAs = ""
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/v1/files/list", nil)
+			if as != "" {
+				req.Header.Set("X-User", as)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request over the socket: %v", err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode, servedAs
+		}
+	}
+
+	trusted := serve("trusted.sock", &LocalTrust{UIDs: []int{os.Geteuid()}, GID: -1})
+	if code, got := trusted(""); code != http.StatusNoContent || got != current.Username {
+		t.Fatalf("expected the request to be served as %q, got %d as %q", current.Username, code, got)
+	}
+	// Only root may name the user it acts as
+	expected := current.Username
+	if os.Geteuid() == 0 {
+		expected = "bob"
+	}
+	if _, got := trusted("bob"); got != expected {
+		t.Fatalf("expected the request to be served as %q, got %q", expected, got)
+	}
+
+	untrusted := serve("untrusted.sock", &LocalTrust{GID: -1})
+	if code, got := untrusted("bob"); code != http.StatusUnauthorized || got != "" {
+		t.Fatalf("expected an untrusted peer without credentials to get 401, got %d as %q", code, got)
+	}
+}
+
+func TestDownloadResumesWithIfRange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "movie.mkv")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+
+	download := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/download?path="+path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	full := download(nil)
+	etag := full.Header().Get("ETag")
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" || etag == "" {
+		t.Fatalf("expected a full response advertising ranges, got %d %v", full.Code, full.Header())
+	}
+
+	for _, tt := range []struct {
+		rangeHeader, ifRange string
+		status               int
+		body                 string
+	}{
+		{"bytes=4-", etag, http.StatusPartialContent, "456789"},
+		{"bytes=2-3", "", http.StatusPartialContent, "23"},
+		{"bytes=-3", full.Header().Get("Last-Modified"), http.StatusPartialContent, "789"},
+		{"bytes=4-", `"stale"`, http.StatusOK, "0123456789"},
+		{"bytes=4-", "W/" + etag, http.StatusOK, "0123456789"},
+		{"bytes=0-1,4-5", "", http.StatusOK, "0123456789"},
+		{"bytes=10-", "", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		rec := download(http.Header{"Range": {tt.rangeHeader}, "If-Range": {tt.ifRange}})
+		if rec.Code != tt.status {
+			t.Errorf("Range %q If-Range %q: expected status %d, got %d", tt.rangeHeader, tt.ifRange, tt.status, rec.Code)
+			continue
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("Range %q If-Range %q: expected body %q, got %q", tt.rangeHeader, tt.ifRange, tt.body, rec.Body.String())
+		}
+	}
+
+	// Rewriting the file invalidates the tag a client resumes with
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if rec := download(http.Header{"Range": {"bytes=4-"}, "If-Range": {etag}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected the whole file after a change, got %d", rec.Code)
+	}
+}
+
+func TestDownloadSegments(t *testing.T) {
+	segments := filemanager.Segments(100<<20+5, 4)
+	if len(segments) != 4 || segments[0].Start != 0 || segments[3].End != 100<<20+4 {
+		t.Fatalf("expected 4 segments covering the file, got %+v", segments)
+	}
+	for i := 1; i < len(segments); i++ {
+		if segments[i].Start != segments[i-1].End+1 || segments[i].Start%(1<<20) != 0 {
+			t.Fatalf("expected contiguous MiB-aligned segments, got %+v", segments)
+		}
+	}
+	if segments := filemanager.Segments(1<<20, 8); len(segments) != 1 {
+		t.Fatalf("expected a small file to stay in one segment, got %+v", segments)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "small.bin")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+
+	for _, tt := range []struct {
+		query  string
+		status int
+	}{
+		{"?path=" + path + "&connections=4", http.StatusOK},
+		{"?path=" + path + "&connections=17", http.StatusBadRequest},
+		{"?path=" + dir, http.StatusBadRequest},
+		{"?path=" + filepath.Join(dir, "missing"), http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/download/segments"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.query, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestChunkedUploadResumes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disc.iso")
+	manager := filemanager.New([]string{dir}, nil)
+	if err := manager.SetUploadSessions(t.TempDir(), time.Hour); err != nil {
+		t.Fatalf("SetUploadSessions: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	do := func(method, target, body string) (*httptest.ResponseRecorder, filemanager.UploadSession) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var resp struct {
+			Data    filemanager.UploadSession `json:"data"`
+			Details filemanager.UploadSession `json:"details"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if resp.Data.ID == "" {
+			return rec, resp.Details
+		}
+		return rec, resp.Data
+	}
+
+	content := "0123456789abcdef"
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+
+	rec, session := do(http.MethodPost, "/api/v1/files/upload/start", `{"path":"`+path+`","size":16}`)
+	if rec.Code != http.StatusCreated || session.ID == "" {
+		t.Fatalf("expected a session, got %d %s", rec.Code, rec.Body.String())
+	}
+	chunk := "/api/v1/files/upload/chunk?id=" + session.ID + "&offset="
+
+	if rec, session = do(http.MethodPut, chunk+"0", content[:6]); rec.Code != http.StatusOK || session.Received != 6 {
+		t.Fatalf("expected 6 bytes received, got %d %s", rec.Code, rec.Body.String())
+	}
+	// A retried chunk at a stale offset is refused with the offset to resume at
+	if rec, session = do(http.MethodPut, chunk+"0", content[:6]); rec.Code != http.StatusConflict || session.Received != 6 {
+		t.Fatalf("expected an offset mismatch, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := do(http.MethodPost, "/api/v1/files/upload/finalize?id="+session.ID, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("expected an incomplete upload to be refused, got %d", rec.Code)
+	}
+	if rec, _ := do(http.MethodPut, chunk+"6", content[6:]+"overflow"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a chunk past the size to be refused, got %d", rec.Code)
+	}
+	if rec, session = do(http.MethodGet, "/api/v1/files/upload/status?id="+session.ID, ""); session.Received != 16 {
+		t.Fatalf("expected the chunk up to the size to be kept, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec, _ := do(http.MethodPost, "/api/v1/files/upload/finalize?id="+session.ID+"&sha256="+checksum, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected the upload to finalize, got %d %s", rec.Code, rec.Body.String())
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != content {
+		t.Fatalf("expected the uploaded file, got %q (%v)", data, err)
+	}
+	if rec, _ := do(http.MethodGet, "/api/v1/files/upload/status?id="+session.ID, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected the session to be gone, got %d", rec.Code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only the uploaded file to remain, got %d entries", len(entries))
+	}
+}
+
+func TestFileQuotas(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared")
+	os.MkdirAll(shared, 0755)
+	os.WriteFile(filepath.Join(shared, "old.bin"), make([]byte, 600), 0644)
+
+	manager := filemanager.New([]string{dir}, nil)
+	if err := manager.SetUploadSessions(t.TempDir(), time.Hour); err != nil {
+		t.Fatalf("SetUploadSessions: %v", err)
+	}
+	if err := manager.SetQuotas(&filemanager.QuotaConfig{
+		StateFile: filepath.Join(t.TempDir(), "quota.json"),
+		Rescan:    time.Nanosecond,
+		Users:     []filemanager.QuotaLimit{{Subject: "alice", Soft: 100, Hard: 300, Grace: time.Nanosecond}},
+		Dirs:      []filemanager.QuotaLimit{{Subject: shared, Hard: 1000}},
+	}); err != nil {
+		t.Fatalf("SetQuotas: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Past the soft limit, within the grace period
+	if rec := do(http.MethodPost, "/api/v1/files/upload?path="+filepath.Join(dir, "a.bin"), strings.Repeat("a", 200)); rec.Code != http.StatusOK {
+		t.Fatalf("expected the upload under the hard limit, got %d %s", rec.Code, rec.Body.String())
+	}
+	// The grace period has run out, so the soft limit holds
+	rec := do(http.MethodPost, "/api/v1/files/upload?path="+filepath.Join(dir, "b.bin"), "b")
+	if rec.Code != http.StatusInsufficientStorage || !strings.Contains(rec.Body.String(), filemanager.PolicyQuotaExceeded) {
+		t.Fatalf("expected the upload past the expired grace period to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.bin")); !os.IsNotExist(err) {
+		t.Fatal("expected the refused upload to leave nothing behind")
+	}
+
+	// The directory quota counts files already there
+	rec = do(http.MethodPost, "/api/v1/files/upload/start", `{"path":"`+filepath.Join(shared, "c.bin")+`","size":500}`)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected the session past the directory quota to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Deleted files stop counting, but copies may not pass the hard limit
+	os.Remove(filepath.Join(dir, "a.bin"))
+	rec = do(http.MethodPost, "/api/v1/files/copy", `{"src_path":"`+filepath.Join(shared, "old.bin")+`","dst_path":"`+filepath.Join(dir, "copy.bin")+`"}`)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected a copy over the hard limit to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodGet, "/api/v1/files/quota", "")
+	var resp struct {
+		Data []*filemanager.QuotaStatus `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || len(resp.Data) != 2 {
+		t.Fatalf("expected two quotas, got %d %s", rec.Code, rec.Body.String())
+	}
+	if user := resp.Data[0]; user.Kind != filemanager.QuotaKindUser || user.Used != 0 || user.State != filemanager.QuotaOK {
+		t.Fatalf("expected alice back under quota, got %+v", user)
+	}
+	if shared := resp.Data[1]; shared.Kind != filemanager.QuotaKindDir || shared.Used != 600 {
+		t.Fatalf("unexpected directory quota %+v", shared)
+	}
+}
+
+func TestUploadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	photos := filepath.Join(dir, "photos")
+
+	manager := filemanager.New([]string{dir}, nil)
+	store, err := filemanager.NewPolicyStore(filepath.Join(t.TempDir(), "policies.json"))
+	if err != nil {
+		t.Fatalf("NewPolicyStore: %v", err)
+	}
+	manager.SetPolicyStore(store)
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	do := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/policies/set", `{"path":"`+photos+`","allowed_extensions":["jpg"],"max_size":8}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("set policy: %d %s", rec.Code, rec.Body.String())
+	}
+
+	sum := sha256.Sum256([]byte("pixels"))
+	for _, tt := range []struct {
+		name   string
+		target string
+		body   string
+		header http.Header
+		status int
+		code   string
+	}{
+		{"allowed", "/api/v1/files/upload?path=" + filepath.Join(photos, "a.jpg"), "pixels", nil, http.StatusOK, ""},
+		{"checksum query", "/api/v1/files/upload?path=" + filepath.Join(photos, "b.jpg") + "&sha256=" + hex.EncodeToString(sum[:]), "pixels", nil, http.StatusOK, ""},
+		{"checksum header", "/api/v1/files/upload?path=" + filepath.Join(photos, "c.jpg"), "pixels", http.Header{"X-Content-Sha256": {strings.ToUpper(hex.EncodeToString(sum[:]))}}, http.StatusOK, ""},
+		{"checksum mismatch", "/api/v1/files/upload?path=" + filepath.Join(photos, "d.jpg") + "&sha256=" + strings.Repeat("0", 64), "pixels", nil, http.StatusUnprocessableEntity, filemanager.PolicyChecksumMismatch},
+		{"extension", "/api/v1/files/upload?path=" + filepath.Join(photos, "e.exe"), "pixels", nil, http.StatusUnprocessableEntity, filemanager.PolicyExtensionNotAllowed},
+		{"too large", "/api/v1/files/upload?path=" + filepath.Join(photos, "f.jpg"), "too many pixels", nil, http.StatusRequestEntityTooLarge, filemanager.PolicyFileTooLarge},
+		{"outside policy", "/api/v1/files/upload?path=" + filepath.Join(dir, "g.exe"), "too many pixels", nil, http.StatusOK, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(http.MethodPost, tt.target, tt.body, tt.header)
+			var resp Response
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != tt.status || resp.Code != tt.code {
+				t.Fatalf("expected %d %q, got %d %s", tt.status, tt.code, rec.Code, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				path, _ := url.QueryUnescape(strings.TrimPrefix(strings.SplitN(tt.target, "&", 2)[0], "/api/v1/files/upload?path="))
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Fatalf("expected the rejected upload to leave nothing behind at %s", path)
+				}
+			}
+		})
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/policies/remove", `{"path":"`+photos+`"}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("remove policy: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/v1/files/upload?path="+filepath.Join(photos, "h.exe"), "pixels", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected uploads to pass once the policy is removed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNetDiskPendingDeletion(t *testing.T) {
+	mnt := t.TempDir()
+	manager, err := netdisk.New(&netdisk.Config{
+		AllowedMountPoints: []string{mnt},
+		EncryptionKey:      "test-key",
+		StateFile:          filepath.Join(t.TempDir(), "state.json"),
+		DeleteGrace:        time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("netdisk.New: %v", err)
+	}
+	defer manager.Stop()
+	if err := manager.AddShare(&netdisk.Share{ID: "nas", Name: "NAS", Protocol: netdisk.ProtocolNFS, Host: "192.0.2.10", Path: "/export", MountPoint: filepath.Join(mnt, "nas")}); err != nil {
+		t.Fatalf("AddShare: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewNetDiskHandlers(manager, nil).Register(mux)
+
+	do := func(method, target string) (*httptest.ResponseRecorder, *netdisk.Share) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		var resp struct {
+			Data *netdisk.Share `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp.Data
+	}
+
+	if rec, _ := do(http.MethodPost, "/api/v1/netdisk/shares/restore?id=nas"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected restoring a live share to conflict, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := do(http.MethodPost, "/api/v1/netdisk/shares/remove/confirm?id=nas"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected confirming a live share to conflict, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec, share := do(http.MethodDelete, "/api/v1/netdisk/shares/remove?id=nas")
+	if rec.Code != http.StatusAccepted || share == nil || share.DeleteAt == nil || time.Until(*share.DeleteAt) < 59*time.Minute {
+		t.Fatalf("expected the deletion to be scheduled in an hour, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := do(http.MethodPost, "/api/v1/netdisk/shares/restore?id=nas"); rec.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", rec.Code, rec.Body.String())
+	}
+	if shares := manager.ListShares(); len(shares) != 1 || shares[0].DeleteAt != nil {
+		t.Fatalf("expected the restored share to stay, got %+v", shares)
+	}
+
+	do(http.MethodDelete, "/api/v1/netdisk/shares/remove?id=nas")
+	if rec, _ := do(http.MethodPost, "/api/v1/netdisk/shares/remove/confirm?id=nas"); rec.Code != http.StatusOK {
+		t.Fatalf("confirm: %d %s", rec.Code, rec.Body.String())
+	}
+	if shares := manager.ListShares(); len(shares) != 0 {
+		t.Fatalf("expected the confirmed share to be deleted, got %+v", shares)
+	}
+	if rec, _ := do(http.MethodPost, "/api/v1/netdisk/shares/restore?id=nas"); rec.Code < 400 {
+		t.Fatalf("expected restoring a deleted share to fail, got %d", rec.Code)
+	}
+}
+
+func TestOverviewToleratesMissingSections(t *testing.T) {
+	jobMgr := jobs.New(&jobs.Config{})
+	release := make(chan struct{})
+	defer close(release)
+	jobMgr.Submit("report", "weekly", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	handler := NewOverviewHandlers(OverviewConfig{Jobs: jobMgr})
+	rec := httptest.NewRecorder()
+	handler.GetOverview(rec, httptest.NewRequest(http.MethodGet, "/api/v1/overview?sections=status,shares,tasks", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 despite missing sections, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Data Overview `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	overview := resp.Data
+	if overview.Status == nil || overview.Status.Status != "running" {
+		t.Fatalf("expected the status section, got %+v", overview.Status)
+	}
+	if overview.Tasks == nil || len(overview.Tasks.Jobs) != 1 || overview.Tasks.Jobs[0].Type != "report" {
+		t.Fatalf("expected the running job, got %+v", overview.Tasks)
+	}
+	if overview.Shares != nil || overview.Errors["shares"] == "" {
+		t.Fatalf("expected shares to be reported as unavailable, got %+v", overview.Errors)
+	}
+	if _, ok := overview.Errors["stats"]; ok || overview.Stats != nil {
+		t.Fatal("expected sections that were not requested to be left out")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.GetOverview(rec, httptest.NewRequest(http.MethodGet, "/api/v1/overview?sections=status,nope", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown section, got %d", rec.Code)
+	}
+}
+
+func TestTrashRestoresDeletedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photos", "cat.jpg")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("meow"), 0644)
+
+	manager := filemanager.New([]string{dir}, nil)
+	if err := manager.SetTrash(t.TempDir(), 24*time.Hour); err != nil {
+		t.Fatalf("SetTrash: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	trashItems := func() []filemanager.TrashItem {
+		var resp struct {
+			Data []filemanager.TrashItem `json:"data"`
+		}
+		json.Unmarshal(do(http.MethodGet, "/api/v1/files/trash", "").Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/delete", `{"path":"`+path+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be gone, got %v", err)
+	}
+	items := trashItems()
+	if len(items) != 1 || items[0].Path != path || items[0].Size != 4 {
+		t.Fatalf("expected the file in the trash, got %+v", items)
+	}
+	if rec := do(http.MethodGet, "/api/v1/files/list?path="+filepath.Join(dir, filemanager.TrashDirName), ""); rec.Code == http.StatusOK {
+		t.Fatal("expected the trash to be out of reach of the file APIs")
+	}
+
+	// Restoring never overwrites a file created in the meantime
+	os.WriteFile(path, []byte("new cat"), 0644)
+	if rec := do(http.MethodPost, "/api/v1/files/trash/restore", `{"id":"`+items[0].ID+`"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected a conflict, got %d %s", rec.Code, rec.Body.String())
+	}
+	restored := filepath.Join(dir, "photos", "cat (restored).jpg")
+	if rec := do(http.MethodPost, "/api/v1/files/trash/restore", `{"id":"`+items[0].ID+`","path":"`+restored+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", rec.Code, rec.Body.String())
+	}
+	if data, err := os.ReadFile(restored); err != nil || string(data) != "meow" {
+		t.Fatalf("expected the restored file, got %q (%v)", data, err)
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/delete", `{"path":"`+path+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	items = trashItems()
+	if len(items) != 1 {
+		t.Fatalf("expected one item, got %+v", items)
+	}
+	if rec := do(http.MethodDelete, "/api/v1/files/trash/purge?id="+items[0].ID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("purge: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(items[0].TrashPath); !os.IsNotExist(err) || len(trashItems()) != 0 {
+		t.Fatalf("expected the item to be purged, got %v", err)
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/delete", `{"path":"`+restored+`","permanent":true}`); rec.Code != http.StatusOK || len(trashItems()) != 0 {
+		t.Fatalf("expected a permanent delete to skip the trash, got %d", rec.Code)
+	}
+}
+
+func TestOverviewFiltersSectionsByScope(t *testing.T) {
+	jobMgr := jobs.New(&jobs.Config{})
+	handler := NewOverviewHandlers(OverviewConfig{Jobs: jobMgr})
+
+	get := func(scopes ...string) Overview {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/overview?sections=status,shares,disks,tasks", nil)
+		req = req.WithContext(context.WithValue(req.Context(), tokenContextKey{}, &auth.Token{Scopes: scopes}))
+		rec := httptest.NewRecorder()
+		handler.GetOverview(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Data Overview `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	overview := get(auth.ScopeMonitorRead)
+	if overview.Status == nil {
+		t.Fatal("expected the status section for a monitor token")
+	}
+	if overview.Tasks != nil {
+		t.Fatalf("expected no tasks without scheduler:read, got %+v", overview.Tasks)
+	}
+	for section, scope := range map[string]string{"shares": "shares:read", "disks": "disk:read", "tasks": "scheduler:read"} {
+		if overview.Errors[section] != "token lacks the required scope "+scope {
+			t.Errorf("expected %s to need %s, got %q", section, scope, overview.Errors[section])
+		}
+	}
+
+	overview = get(auth.ScopeMonitorRead, auth.ScopeSchedulerRead)
+	if overview.Tasks == nil || overview.Errors["tasks"] != "" {
+		t.Fatalf("expected the tasks section with scheduler:read, got %+v", overview.Errors)
+	}
+	if overview.Errors["shares"] != "token lacks the required scope shares:read" {
+		t.Fatalf("expected shares to stay filtered, got %q", overview.Errors["shares"])
+	}
+
+	// Unscoped tokens see everything; shares are only missing because they are disabled
+	overview = get()
+	if overview.Tasks == nil || overview.Errors["shares"] != "not enabled" {
+		t.Fatalf("expected full access without scopes, got %+v", overview.Errors)
+	}
+}
+
+func TestQuerySelectsFieldsPerScope(t *testing.T) {
+	jobMgr := jobs.New(&jobs.Config{})
+	release := make(chan struct{})
+	defer close(release)
+	jobMgr.Submit("speedtest", "wan", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	handler := NewQueryHandlers(QueryConfig{OverviewConfig: OverviewConfig{Jobs: jobMgr}})
+
+	do := func(req *http.Request, scopes ...string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+		if scopes != nil {
+			req = req.WithContext(context.WithValue(req.Context(), tokenContextKey{}, &auth.Token{Scopes: scopes}))
+		}
+		rec := httptest.NewRecorder()
+		handler.Query(rec, req)
+		var resp struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp.Data
+	}
+
+	rec, data := do(httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(`{"query":"status{status} jobs{type,state}"}`)), auth.ScopeMonitorRead)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("query: %d %s", rec.Code, rec.Body.String())
+	}
+	if string(data["status"]) != `{"status":"running"}` || string(data["jobs"]) != `[{"state":"running","type":"speedtest"}]` {
+		t.Fatalf("expected only the selected fields, got %s", rec.Body.String())
+	}
+
+	// Resources the token may not read are left out, not the whole query
+	rec, data = do(httptest.NewRequest(http.MethodGet, "/api/v1/query?q=status,jobs{id}", nil), auth.ScopeDiskRead)
+	if rec.Code != http.StatusOK || data["status"] != nil || !strings.Contains(string(data["errors"]), "monitor:read") {
+		t.Fatalf("expected status to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	for _, q := range []string{"status{", "shares{name}"} {
+		if rec, _ := do(httptest.NewRequest(http.MethodGet, "/api/v1/query?q="+url.QueryEscape(q), nil)); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected %q to be refused, got %d", q, rec.Code)
+		}
+	}
+}
+
+func TestFileJobsCopyTree(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "album")
+	os.MkdirAll(filepath.Join(src, "raw"), 0750)
+	os.WriteFile(filepath.Join(src, "cover.jpg"), []byte("cover"), 0640)
+	os.WriteFile(filepath.Join(src, "raw", "0001.dng"), bytes.Repeat([]byte("x"), 3<<20), 0600)
+	os.Symlink("cover.jpg", filepath.Join(src, "front.jpg"))
+	taken := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "cover.jpg"), taken, taken)
+	os.Chtimes(filepath.Join(src, "raw"), taken, taken)
+
+	jobMgr := jobs.New(&jobs.Config{})
+	fileAPI := NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0)
+	fileAPI.SetJobs(jobMgr)
+	mux := http.NewServeMux()
+	fileAPI.Register(mux)
+
+	start := func(path, body string) jobs.Job {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Data jobs.Job `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data
+	}
+	wait := func(id string) map[string]interface{} {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/jobs/status?id="+id, nil))
+			var resp struct {
+				Data struct {
+					State    string                 `json:"state"`
+					Error    string                 `json:"error"`
+					Progress map[string]interface{} `json:"progress"`
+				} `json:"data"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp.Data.State == jobs.StateSucceeded {
+				return resp.Data.Progress
+			}
+			if resp.Data.State != jobs.StateRunning {
+				t.Fatalf("job %s ended %s: %s", id, resp.Data.State, resp.Data.Error)
+			}
+		}
+		t.Fatalf("job %s did not finish", id)
+		return nil
+	}
+
+	copied := filepath.Join(dir, "backup", "album")
+	job := start("/api/v1/files/jobs/copy", `{"src_path":"`+src+`","dst_path":"`+copied+`"}`)
+	progress := wait(job.ID)
+	if progress["files_done"] != float64(3) || progress["bytes_done"] != float64(3<<20+5) || progress["files_remaining"] != float64(0) {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+
+	info, err := os.Stat(filepath.Join(copied, "cover.jpg"))
+	if err != nil || info.Mode().Perm() != 0640 || !info.ModTime().Equal(taken) {
+		t.Fatalf("expected mode and time to be kept, got %v (%v)", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(copied, "raw")); err != nil || info.Mode().Perm() != 0750 || !info.ModTime().Equal(taken) {
+		t.Fatalf("expected the directory mode and time to be kept, got %v (%v)", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(copied, "front.jpg")); err != nil || target != "cover.jpg" {
+		t.Fatalf("expected the link to be copied as a link, got %q (%v)", target, err)
+	}
+
+	// Copying again needs overwrite
+	rec := httptest.NewRecorder()
+	job = start("/api/v1/files/jobs/copy", `{"src_path":"`+src+`","dst_path":"`+copied+`"}`)
+	if finished := waitFinishedJob(t, jobMgr, job.ID); finished.State != jobs.StateFailed || !strings.Contains(finished.Error, "already exists") {
+		t.Fatalf("expected the existing destination to be refused, got %+v", finished)
+	}
+
+	moved := filepath.Join(dir, "archive")
+	wait(start("/api/v1/files/jobs/move", `{"src_path":"`+src+`","dst_path":"`+moved+`"}`).ID)
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected the source to be moved away, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(moved, "cover.jpg")); err != nil || string(data) != "cover" {
+		t.Fatalf("expected the moved tree, got %q (%v)", data, err)
+	}
+
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/files/jobs/cancel?id="+job.ID, nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected a finished job not to be cancelable, got %d", rec.Code)
+	}
+}
+
+func TestFileChecksums(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	os.WriteFile(path, []byte("hello"), 0644)
+
+	jobMgr := jobs.New(&jobs.Config{})
+	fileAPI := NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0)
+	fileAPI.SetJobs(jobMgr)
+	mux := http.NewServeMux()
+	fileAPI.Register(mux)
+
+	expected := map[string]string{
+		"":       "5d41402abc4b2a76b9719d911017c592",
+		"sha1":   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"blake3": "ea8f163db38682925e4491c5e58d4bb3506ef8c14eb78a86e908c5624a67200f",
+	}
+	for algorithm, sum := range expected {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/checksum?path="+url.QueryEscape(path)+"&algorithm="+algorithm, nil))
+		var resp struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Data["checksum"] != sum {
+			t.Errorf("%q: expected %s, got %d %s", algorithm, sum, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/checksum?path="+url.QueryEscape(path)+"&algorithm=crc32", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown algorithm, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/files/jobs/checksum", strings.NewReader(`{"path":"`+path+`","algorithm":"sha256"}`)))
+	var started struct {
+		Data jobs.Job `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &started); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("start checksum job: %d %s", rec.Code, rec.Body.String())
+	}
+	job := waitFinishedJob(t, jobMgr, started.Data.ID)
+	progress, ok := job.Progress.(filemanager.ChecksumProgress)
+	if job.State != jobs.StateSucceeded || !ok || progress.Checksum != expected["sha256"] || progress.BytesDone != 5 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+}
+
+func waitFinishedJob(t *testing.T, m *jobs.Manager, id string) *jobs.Job {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if job, err := m.Get(id); err == nil && job.State != jobs.StateRunning {
+			return job
+		}
+	}
+	t.Fatalf("job %s did not finish", id)
+	return nil
+}
+
+func TestHookTriggersTask(t *testing.T) {
+	sched, err := scheduler.New(scheduler.Config{DBPath: filepath.Join(t.TempDir(), "scheduler.db")})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+
+	ran := make(chan map[string]interface{}, 1)
+	sched.RegisterHandler("index", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		ran <- params
+		return nil, nil
+	})
+	task := &scheduler.Task{
+		ID:         "camera",
+		Name:       "Index camera uploads",
+		Type:       "index",
+		Params:     map[string]interface{}{"path": "/srv/camera", "depth": float64(1)},
+		Enabled:    true,
+		HookParams: []string{"path"},
+	}
+	if err := sched.AddTask(context.Background(), task); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	NewSchedulerHandlers(sched, nil).Register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/scheduler/tasks/hook?id=camera", nil))
+	var created struct {
+		Data TaskHook `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || rec.Code != http.StatusOK || created.Data.Token == "" {
+		t.Fatalf("create hook: %d %s", rec.Code, rec.Body.String())
+	}
+
+	trigger := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := trigger(created.Data.Path, `{"params":{"depth":5}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a param the hook may not set, got %d", rec.Code)
+	}
+	if rec := trigger("/api/v1/hooks/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown token, got %d", rec.Code)
+	}
+	if rec := trigger(created.Data.Path, `{"params":{"path":"/srv/camera/2026-10-16"}}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case params := <-ran:
+		if params["path"] != "/srv/camera/2026-10-16" || params["depth"] != float64(1) {
+			t.Fatalf("unexpected params %v", params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not run")
+	}
+	if task.Params["path"] != "/srv/camera" {
+		t.Fatal("hook params must not change the task")
+	}
+
+	// Revoked tokens stop working
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/scheduler/tasks/hook?id=camera", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete hook: %d", rec.Code)
+	}
+	if rec := trigger(created.Data.Path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after revoking, got %d", rec.Code)
+	}
+}
+
+func TestCheckMode(t *testing.T) {
+	sched, err := scheduler.New(scheduler.Config{DBPath: filepath.Join(t.TempDir(), "scheduler.db")})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+	sched.RegisterHandler("noop", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	if err := sched.AddTask(context.Background(), &scheduler.Task{
+		ID: "cleanup", Name: "Cleanup", Type: "noop", Params: map[string]interface{}{"days": 30}, Enabled: true,
+	}); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	NewSchedulerHandlers(sched, nil).Register(mux)
+	handler := CheckGuard(mux)
+
+	check := func(method, path, body string) (int, CheckResult) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var resp struct {
+			Data CheckResult `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Data
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		status  int
+		changed bool
+		fields  int
+	}{
+		{http.MethodPost, "/api/v1/scheduler/tasks/add?check=true", `{"id":"cleanup","name":"Cleanup","type":"noop","params":{"days":30},"enabled":true}`, http.StatusOK, false, 0},
+		{http.MethodPost, "/api/v1/scheduler/tasks/add?check=true", `{"id":"backup","name":"Backup","type":"noop"}`, http.StatusOK, true, 0},
+		{http.MethodPost, "/api/v1/scheduler/tasks/add?check=true", `{"id":"cleanup","name":"Other","type":"noop"}`, http.StatusConflict, false, 0},
+		{http.MethodPut, "/api/v1/scheduler/tasks/update?check=true", `{"id":"cleanup","name":"Cleanup","type":"noop","params":{"days":7},"enabled":true}`, http.StatusOK, true, 1},
+		{http.MethodDelete, "/api/v1/scheduler/tasks/delete?id=cleanup&check=true", "", http.StatusOK, true, 0},
+		{http.MethodDelete, "/api/v1/scheduler/tasks/delete?id=missing&check=true", "", http.StatusOK, false, 0},
+		{http.MethodPost, "/api/v1/scheduler/tasks/execute?id=cleanup&check=true", "", http.StatusBadRequest, false, 0},
+	}
+	for _, tt := range tests {
+		status, result := check(tt.method, tt.path, tt.body)
+		if status != tt.status {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.status, status)
+			continue
+		}
+		if status == http.StatusOK && (!result.Check || result.Changed != tt.changed || len(result.Fields) != tt.fields) {
+			t.Errorf("%s %s: unexpected result %+v", tt.method, tt.path, result)
+		}
+	}
+
+	// Nothing was changed
+	task, err := sched.GetTask("cleanup")
+	if err != nil || task.Params["days"] != 30 {
+		t.Fatalf("check changed the task: %+v, %v", task, err)
+	}
+	if _, err := sched.GetTask("backup"); err == nil {
+		t.Fatal("check added a task")
+	}
+}
+
+func TestTaskUpdateDuringRun(t *testing.T) {
+	sched, err := scheduler.New(scheduler.Config{DBPath: filepath.Join(t.TempDir(), "scheduler.db")})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+	started, release := make(chan struct{}), make(chan struct{})
+	sched.RegisterHandler("wait", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	})
+	if err := sched.AddTask(context.Background(), &scheduler.Task{ID: "backup", Name: "Backup", Type: "wait", Schedule: "daily", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	NewSchedulerHandlers(sched, nil).Register(mux)
+	update := func(body string) (int, scheduler.Task) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/scheduler/tasks/update", strings.NewReader(body)))
+		var resp struct {
+			Data    scheduler.Task `json:"data"`
+			Details scheduler.Task `json:"details"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code == http.StatusConflict {
+			return rec.Code, resp.Details
+		}
+		return rec.Code, resp.Data
+	}
+	run := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := sched.ExecuteTask(context.Background(), "backup")
+			done <- err
+		}()
+		<-started
+		return done
+	}
+
+	// An update while the task runs is kept when the run ends
+	done := run()
+	code, task := update(`{"id":"backup","name":"Nightly backup","type":"wait","schedule":"daily","enabled":true,"version":1}`)
+	if code != http.StatusOK || task.Version != 2 || task.Status != "running" {
+		t.Fatalf("unexpected update: %d %+v", code, task)
+	}
+	code, current := update(`{"id":"backup","name":"Stale","type":"wait","schedule":"daily","enabled":true,"version":1}`)
+	if code != http.StatusConflict || current.Version != 2 || current.Name != "Nightly backup" {
+		t.Errorf("expected 409 with the current task, got %d %+v", code, current)
+	}
+	release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := sched.GetTask("backup"); stored.Name != "Nightly backup" || stored.Status != "success" || stored.Version != 2 || stored.LastRun == nil {
+		t.Errorf("expected the update and the run to both be kept, got %+v", stored)
+	}
+
+	// A task deleted while it runs stays deleted
+	done = run()
+	if err := sched.DeleteTask(context.Background(), "backup"); err != nil {
+		t.Fatal(err)
+	}
+	release <- struct{}{}
+	<-done
+	if _, err := sched.GetTask("backup"); !errors.Is(err, scheduler.ErrTaskNotFound) {
+		t.Errorf("expected the deleted task to stay deleted, got %v", err)
+	}
+	if code, _ := update(`{"id":"backup","name":"Backup","type":"wait"}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 updating a deleted task, got %d", code)
+	}
+}
+
+func TestTaskPreview(t *testing.T) {
+	// A global window covering the first hourly run moves it to the end
+	now := time.Now()
+	blackout := scheduler.Blackout{
+		Start: now.Add(30 * time.Minute).Format("15:04"),
+		End:   now.Add(3 * time.Hour).Format("15:04"),
+	}
+	sched, err := scheduler.New(scheduler.Config{
+		DBPath:    filepath.Join(t.TempDir(), "scheduler.db"),
+		Blackouts: []scheduler.Blackout{blackout},
+	})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+	sched.RegisterHandler("noop", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	mux := http.NewServeMux()
+	NewSchedulerHandlers(sched, nil).Register(mux)
+
+	add := func(body string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/scheduler/tasks/add", strings.NewReader(body)))
+		return rec.Code
+	}
+	preview := func(id string) []time.Time {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/scheduler/tasks/preview?id="+id+"&count=4", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("preview %s: %d %s", id, rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Data TaskPreview `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data.Runs
+	}
+
+	if code := add(`{"id":"scan","name":"Scan","type":"noop","schedule":"hourly","enabled":true}`); code != http.StatusOK {
+		t.Fatalf("add scan: %d", code)
+	}
+	runs := preview("scan")
+	if len(runs) != 4 {
+		t.Fatalf("expected 4 runs, got %v", runs)
+	}
+	if got := runs[0].Local().Format("15:04"); got != blackout.End {
+		t.Errorf("expected the first run at %s, got %s", blackout.End, got)
+	}
+	for i := 1; i < len(runs); i++ {
+		if runs[i].Sub(runs[i-1]) != time.Hour {
+			t.Errorf("expected hourly runs after the window, got %v", runs)
+		}
+	}
+
+	// A task ignoring the global windows runs in an hour
+	if code := add(`{"id":"backup","name":"Backup","type":"noop","schedule":"hourly","ignore_global_blackouts":true}`); code != http.StatusOK {
+		t.Fatalf("add backup: %d", code)
+	}
+	if runs := preview("backup"); runs[0].Sub(now) > time.Hour+time.Minute {
+		t.Errorf("expected the global window to be ignored, got %v", runs)
+	}
+
+	if code := add(`{"id":"bad","name":"Bad","type":"noop","blackouts":[{"start":"19:00","end":"25:00"}]}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid window, got %d", code)
+	}
+}
+
+func TestTaskUsage(t *testing.T) {
+	sched, err := scheduler.New(scheduler.Config{DBPath: filepath.Join(t.TempDir(), "scheduler.db")})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+	sched.RegisterHandler("busy", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); {
+		}
+		return nil, nil
+	})
+	if err := sched.AddTask(context.Background(), &scheduler.Task{ID: "scan", Name: "Scan", Type: "busy"}); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	NewSchedulerHandlers(sched, nil).Register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/scheduler/tasks/execute?id=scan", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("execute: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/scheduler/history?id=scan", nil))
+	var resp struct {
+		Data []scheduler.TaskExecution `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Data) != 1 || resp.Data[0].Usage == nil {
+		t.Fatalf("expected one execution with usage, got %s", rec.Body.String())
+	}
+	usage := resp.Data[0].Usage
+	if usage.WallSeconds < 0.05 || usage.Shared {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+	if !usage.Unsupported && (usage.UserCPU+usage.SystemCPU <= 0 || usage.PeakRSSBytes <= 0) {
+		t.Errorf("expected CPU time and a peak RSS, got %+v", usage)
+	}
+}
+
+func TestStalledTask(t *testing.T) {
+	bus := events.NewBus(100)
+	sub := bus.Subscribe(&events.Filter{Types: []string{"task.health"}}, 16)
+	defer sub.Close()
+	alertMgr, err := alerts.New(&alerts.Config{StateFile: filepath.Join(t.TempDir(), "alerts.json"), Bus: bus})
+	if err != nil {
+		t.Fatalf("alerts.New: %v", err)
+	}
+	alertMgr.Start()
+	defer alertMgr.Stop()
+
+	sched, err := scheduler.New(scheduler.Config{
+		DBPath:        filepath.Join(t.TempDir(), "scheduler.db"),
+		StallTimeout:  200 * time.Millisecond,
+		CancelStalled: true,
+	})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	sched.SetBus(bus)
+	sched.Start(context.Background())
+	defer sched.Stop(context.Background())
+
+	// One handler beats while it works, the other hangs
+	sched.RegisterHandler("beating", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		for i := 0; i < 6; i++ {
+			time.Sleep(100 * time.Millisecond)
+			scheduler.Heartbeat(ctx)
+		}
+		return nil, nil
+	})
+	sched.RegisterHandler("hung", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	for _, task := range []*scheduler.Task{{ID: "scan", Name: "Scan", Type: "beating"}, {ID: "stuck", Name: "Stuck", Type: "hung"}} {
+		if err := sched.AddTask(context.Background(), task); err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+	}
+
+	if execution, err := sched.ExecuteTask(context.Background(), "scan"); err != nil || execution.Status != "success" {
+		t.Fatalf("expected the beating task to succeed, got %+v, %v", execution, err)
+	}
+
+	execution, err := sched.ExecuteTask(context.Background(), "stuck")
+	if err == nil || !strings.Contains(execution.Error, "no heartbeat") {
+		t.Fatalf("expected the hung task to be canceled, got %+v, %v", execution, err)
+	}
+	for _, healthy := range []bool{false, true} {
+		select {
+		case event := <-sub.C:
+			data := event.Data.(map[string]interface{})
+			if data["id"] != "stuck" || data["healthy"] != healthy {
+				t.Fatalf("unexpected task.health event %+v", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no task.health event with healthy=%v", healthy)
+		}
+	}
+
+	// The alert resolves once the run ended
+	deadline := time.Now().Add(time.Second)
+	for {
+		alert, err := alertMgr.Get("task:stuck")
+		if err == nil && alert.State == alerts.StateResolved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a resolved task alert, got %+v, %v", alert, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadArchive(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "photos")
+	os.MkdirAll(filepath.Join(dir, "2026"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(dir, "2026", "b.jpg"), []byte("bbbbb"), 0644)
+	os.Symlink("a.jpg", filepath.Join(dir, "latest.jpg"))
+
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{root}, nil), nil, 0).Register(mux)
+
+	download := func(format string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/download?path="+url.QueryEscape(dir)+"&archive="+format, nil))
+		return rec
+	}
+
+	rec := download("tar")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("tar: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	entries := map[string]string{}
+	tr := tar.NewReader(rec.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		entries[header.Name] = string(data) + header.Linkname
+	}
+	expected := map[string]string{
+		"photos/": "", "photos/2026/": "", "photos/2026/b.jpg": "bbbbb", "photos/a.jpg": "aaa", "photos/latest.jpg": "a.jpg",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("tar: expected %v, got %v", expected, entries)
+	}
+
+	rec = download("zip")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("zip: %d", rec.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("read zip: %v", err)
+	}
+	entries = map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		entries[f.Name] = string(data)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("zip: expected %v, got %v", expected, entries)
+	}
+
+	if rec := download("rar"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+}
+
+func TestFilePreview(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, data, 0644)
+		return path
+	}
+
+	// A JPEG with an EXIF segment naming the camera and its orientation
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 4, 3)), nil)
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+	tiff = append(tiff, 0x0F, 0x01, 2, 0, 6, 0, 0, 0, 38, 0, 0, 0) // Make, ASCII, at 38
+	tiff = append(tiff, 0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0)  // Orientation, SHORT
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "Canon\x00"...)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	exif := append([]byte{0xFF, 0xD8, 0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(app1)+2))...)
+	exif = append(append(exif, app1...), jpg.Bytes()[2:]...)
+
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 5, 2)))
+
+	// The limit falls inside a two-byte character
+	long := "x" + strings.Repeat("é", 1024)
+
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+	preview := func(path, query string) (int, filemanager.Preview) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/preview?path="+url.QueryEscape(path)+query, nil))
+		var resp struct {
+			Data filemanager.Preview `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Data
+	}
+
+	tests := []struct {
+		path     string
+		query    string
+		kind     string
+		encoding string
+		content  string
+	}{
+		{write("notes.txt", []byte("hello\n")), "", filemanager.PreviewText, "utf-8", "hello\n"},
+		{write("long.txt", []byte(long)), "&max_kb=1", filemanager.PreviewText, "utf-8", long[:1023]},
+		{write("latin1.txt", []byte("caf\xe9\n")), "", filemanager.PreviewText, "iso-8859-1", "café\n"},
+		{write("utf16.txt", []byte{0xFF, 0xFE, 'h', 0, 'i', 0}), "", filemanager.PreviewText, "utf-16le", "hi"},
+		{write("blob.bin", []byte{0x7F, 'E', 'L', 'F', 0, 1, 2}), "", filemanager.PreviewBinary, "", ""},
+		{write("photo.jpg", exif), "", filemanager.PreviewImage, "", ""},
+		{write("chart.png", pngData.Bytes()), "", filemanager.PreviewImage, "", ""},
+	}
+	for _, tt := range tests {
+		code, p := preview(tt.path, tt.query)
+		if code != http.StatusOK || p.Kind != tt.kind {
+			t.Errorf("%s: expected %s, got %d %+v", tt.path, tt.kind, code, p)
+			continue
+		}
+		if tt.kind == filemanager.PreviewText && (p.Text.Encoding != tt.encoding || p.Text.Content != tt.content) {
+			t.Errorf("%s: expected %s %q, got %s %q", tt.path, tt.encoding, tt.content, p.Text.Encoding, p.Text.Content)
+		}
+	}
+
+	_, p := preview(filepath.Join(dir, "long.txt"), "&max_kb=1")
+	if !p.Text.Truncated {
+		t.Error("expected long.txt to be truncated")
+	}
+	_, p = preview(filepath.Join(dir, "photo.jpg"), "")
+	if p.Image.Width != 4 || p.Image.Height != 3 || p.Image.EXIF["make"] != "Canon" || p.Image.EXIF["orientation"] != "6" {
+		t.Errorf("photo.jpg: unexpected image preview %+v", p.Image)
+	}
+	_, p = preview(filepath.Join(dir, "chart.png"), "")
+	if p.Image.Format != "png" || p.Image.Width != 5 || p.Image.Height != 2 {
+		t.Errorf("chart.png: unexpected image preview %+v", p.Image)
+	}
+
+	if code, _ := preview(dir, ""); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a directory, got %d", code)
+	}
+	if code, _ := preview(filepath.Join(dir, "notes.txt"), "&max_kb=4096"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for max_kb over the limit, got %d", code)
+	}
+}
+
+func TestTextEdit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "blob.bin"), []byte{0x7F, 'E', 'L', 'F', 0}, 0644)
+
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+	read := func(path string) (int, filemanager.TextFile) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/text?path="+url.QueryEscape(path), nil))
+		var resp struct {
+			Data filemanager.TextFile `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Data
+	}
+	write := func(body map[string]interface{}) (int, filemanager.TextEdit) {
+		data, _ := json.Marshal(body)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/files/text", bytes.NewReader(data)))
+		var resp struct {
+			Data filemanager.TextEdit `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Data
+	}
+
+	code, text := read(path)
+	if code != http.StatusOK || text.Content != "one\ntwo\nthree\n" || text.SHA256 == "" {
+		t.Fatalf("unexpected read: %d %+v", code, text)
+	}
+
+	code, edit := write(map[string]interface{}{"path": path, "content": "one\n2\n2b\nthree\n", "expected_sha256": text.SHA256})
+	if code != http.StatusOK || edit.LinesAdded != 2 || edit.LinesRemoved != 1 || edit.FirstChange != 2 {
+		t.Fatalf("unexpected edit: %d %+v", code, edit)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("expected permissions to be kept, got %v", info.Mode().Perm())
+	}
+
+	// The checksum read first no longer matches
+	code, _ = write(map[string]interface{}{"path": path, "content": "lost\n", "expected_sha256": text.SHA256})
+	if code != http.StatusConflict {
+		t.Errorf("expected 409 for a stale checksum, got %d", code)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "one\n2\n2b\nthree\n" {
+		t.Errorf("expected the file to be unchanged, got %q", data)
+	}
+
+	newPath := filepath.Join(dir, "new.txt")
+	if code, _ := write(map[string]interface{}{"path": newPath, "content": "x"}); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing file without create, got %d", code)
+	}
+	if code, edit := write(map[string]interface{}{"path": newPath, "content": "x", "create": true}); code != http.StatusOK || !edit.Created {
+		t.Errorf("expected the file to be created, got %d %+v", code, edit)
+	}
+
+	if code, _ := read(filepath.Join(dir, "blob.bin")); code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for a binary file, got %d", code)
+	}
+	big := strings.Repeat("x", filemanager.MaxTextFileSize+1)
+	if code, _ := write(map[string]interface{}{"path": path, "content": big}); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for text over the limit, got %d", code)
+	}
+	if code, _ := read(dir); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a directory, got %d", code)
+	}
+}
+
+func TestFileLocks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+	post := func(endpoint, user string, body map[string]interface{}) (int, filemanager.FileLock) {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files/locks/"+endpoint, bytes.NewReader(data))
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var resp struct {
+			Data    filemanager.FileLock `json:"data"`
+			Details filemanager.FileLock `json:"details"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code == http.StatusConflict {
+			return rec.Code, resp.Details
+		}
+		return rec.Code, resp.Data
+	}
+	list := func() []filemanager.FileLock {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/locks?path="+url.QueryEscape(dir), nil))
+		var resp struct {
+			Data []filemanager.FileLock `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	code, alice := post("acquire", "alice", map[string]interface{}{"path": path, "session": "tab1"})
+	if code != http.StatusOK || alice.ID == "" || alice.Owner != "alice" {
+		t.Fatalf("unexpected acquire: %d %+v", code, alice)
+	}
+	if code, again := post("acquire", "alice", map[string]interface{}{"path": path, "session": "tab1", "ttl_seconds": 600}); code != http.StatusOK || again.ID != alice.ID {
+		t.Errorf("expected the same session to extend its lock, got %d %+v", code, again)
+	}
+	code, holder := post("acquire", "bob", map[string]interface{}{"path": path, "session": "tab2"})
+	if code != http.StatusConflict || holder.Owner != "alice" || holder.ID != "" {
+		t.Errorf("expected 409 naming alice without the lock id, got %d %+v", code, holder)
+	}
+	if code, _ := post("acquire", "bob", map[string]interface{}{"path": path, "ttl_seconds": 86400}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a ttl over the limit, got %d", code)
+	}
+
+	if locks := list(); len(locks) != 1 || locks[0].Path != path || locks[0].ID != "" {
+		t.Errorf("unexpected locks %+v", locks)
+	}
+
+	code, bob := post("steal", "bob", map[string]interface{}{"path": path, "session": "tab2"})
+	if code != http.StatusOK || bob.Owner != "bob" {
+		t.Fatalf("unexpected steal: %d %+v", code, bob)
+	}
+	if code, _ := post("refresh", "alice", map[string]interface{}{"id": alice.ID}); code != http.StatusNotFound {
+		t.Errorf("expected 404 refreshing a stolen lock, got %d", code)
+	}
+	if code, _ := post("release", "bob", map[string]interface{}{"id": bob.ID}); code != http.StatusOK {
+		t.Errorf("expected release to succeed, got %d", code)
+	}
+	if locks := list(); len(locks) != 0 {
+		t.Errorf("expected no locks after release, got %+v", locks)
+	}
+
+	// Listings show the lock, and writes need its id
+	os.WriteFile(path, []byte("draft\n"), 0644)
+	_, alice = post("acquire", "alice", map[string]interface{}{"path": path, "session": "tab1"})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/list?path="+url.QueryEscape(dir), nil))
+	var listing struct {
+		Data []filemanager.FileInfo `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &listing)
+	if len(listing.Data) != 1 || listing.Data[0].Lock == nil || listing.Data[0].Lock.Owner != "alice" || listing.Data[0].Lock.ID != "" {
+		t.Errorf("expected the listing to show alice's lock, got %s", rec.Body.String())
+	}
+	save := func(body string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/files/text", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := save(`{"path":"` + path + `","content":"bob\n"}`); code != http.StatusLocked {
+		t.Errorf("expected 423 saving without the lock, got %d", code)
+	}
+	if code := save(`{"path":"` + path + `","content":"alice\n","lock_id":"` + alice.ID + `"}`); code != http.StatusOK {
+		t.Errorf("expected the lock holder to save, got %d", code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(path), strings.NewReader("upload")))
+	if rec.Code != http.StatusLocked {
+		t.Errorf("expected 423 uploading over a locked file, got %d", rec.Code)
+	}
+
+	// Locks expire on their own
+	m := filemanager.New([]string{dir}, nil)
+	if _, err := m.AcquireLock(context.Background(), path, "", time.Second, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := m.AcquireLock(context.Background(), path, "", 0, "bob"); err != nil {
+		t.Errorf("expected the expired lock to be gone, got %v", err)
+	}
+}
+
+func TestLockedFileWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	os.WriteFile(path, []byte("draft\n"), 0644)
+
+	manager := filemanager.New([]string{dir}, nil)
+	lock, err := manager.AcquireLock(context.Background(), path, "tab1", 0, "alice")
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	save := func(lockID string) *http.Request {
+		body := `{"path":"` + path + `","content":"saved\n"` + lockID + `}`
+		return httptest.NewRequest(http.MethodPut, "/api/v1/files/text", strings.NewReader(body))
+	}
+	upload := func(query string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(path)+query, strings.NewReader("uploaded\n"))
+	}
+	withHeader := func(req *http.Request, id string) *http.Request {
+		req.Header.Set("X-Lock-ID", id)
+		return req
+	}
+
+	for _, tt := range []struct {
+		name    string
+		req     *http.Request
+		content string
+	}{
+		{"save without lock", save(""), ""},
+		{"save with wrong lock", save(`,"lock_id":"stale"`), ""},
+		{"save with lock", save(`,"lock_id":"` + lock.ID + `"`), "saved\n"},
+		{"save with lock header", withHeader(save(""), lock.ID), "saved\n"},
+		{"upload without lock", upload(""), ""},
+		{"upload with wrong lock", withHeader(upload(""), "stale"), ""},
+		{"upload with lock", upload("&lock_id=" + lock.ID), "uploaded\n"},
+		{"upload with lock header", withHeader(upload(""), lock.ID), "uploaded\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(path, []byte("draft\n"), 0644)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, tt.req)
+
+			data, _ := os.ReadFile(path)
+			if tt.content == "" {
+				var resp struct {
+					Code    string               `json:"code"`
+					Details filemanager.FileLock `json:"details"`
+				}
+				json.Unmarshal(rec.Body.Bytes(), &resp)
+				if rec.Code != http.StatusLocked || resp.Code != "locked" || resp.Details.Owner != "alice" || resp.Details.ID != "" {
+					t.Fatalf("expected 423 naming alice without the lock id, got %d %s", rec.Code, rec.Body.String())
+				}
+				if string(data) != "draft\n" {
+					t.Fatalf("expected the locked file to be unchanged, got %q", data)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK || string(data) != tt.content {
+				t.Fatalf("expected the lock holder's write, got %d %s with %q", rec.Code, rec.Body.String(), data)
+			}
+		})
+	}
+
+	// Once released, anyone may write again
+	if err := manager.ReleaseLock(context.Background(), lock.ID, "alice"); err != nil {
+		t.Fatalf("ReleaseLock: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, upload(""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected uploads after release, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("photo"), 1000)
+	write := func(name string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, content, mode)
+		os.Chmod(path, mode)
+		return path
+	}
+	a, b, c, d := write("a.jpg", 0644), write("b.jpg", 0644), write("c.jpg", 0600), write("d.jpg", 0644)
+	os.WriteFile(filepath.Join(dir, "unique.jpg"), []byte("other"), 0644)
+
+	idx, err := indexer.New(&indexer.Config{DBPath: filepath.Join(t.TempDir(), "index.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if _, err := idx.Scan(context.Background(), indexer.ScanOptions{Paths: []string{dir}, Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	// d changes after the scan, so the index is stale
+	os.WriteFile(d, bytes.Repeat([]byte("PHOTO"), 1000), 0644)
+
+	mux := http.NewServeMux()
+	handlers := NewIndexerHandlers(idx, nil, nil)
+	handlers.SetFileManager(filemanager.New([]string{dir}, nil))
+	handlers.Register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/indexer/duplicates?path="+url.QueryEscape(dir), nil))
+	var report struct {
+		Data indexer.DuplicateReport `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if rec.Code != http.StatusOK || len(report.Data.Sets) != 1 || report.Data.WastedBytes != 3*int64(len(content)) {
+		t.Fatalf("unexpected report: %d %s", rec.Code, rec.Body.String())
+	}
+	if paths := report.Data.Sets[0].Paths; !reflect.DeepEqual(paths, []string{a, b, c, d}) {
+		t.Errorf("unexpected duplicates %v", paths)
+	}
+
+	dedupe := func(body string) filemanager.DedupeResult {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/indexer/dedupe", strings.NewReader(body)))
+		var resp struct {
+			Data filemanager.DedupeResult `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("dedupe: %d %s", rec.Code, rec.Body.String())
+		}
+		return resp.Data
+	}
+	reasons := func(result filemanager.DedupeResult) map[string]string {
+		reasons := map[string]string{}
+		for _, skip := range result.Skipped {
+			reasons[skip.Path] = skip.Reason
+		}
+		return reasons
+	}
+	sameFile := func(x, y string) bool {
+		xi, _ := os.Stat(x)
+		yi, _ := os.Stat(y)
+		return os.SameFile(xi, yi)
+	}
+
+	body := `{"path":"` + dir + `","dry_run":true}`
+	result := dedupe(body)
+	if len(result.Linked) != 1 || result.Linked[0].Path != b || result.SavedBytes != int64(len(content)) {
+		t.Errorf("unexpected dry run %+v", result)
+	}
+	if r := reasons(result); r[c] != filemanager.DedupeMetaDiffers || r[d] != filemanager.DedupeContentDiffers {
+		t.Errorf("unexpected skips %v", r)
+	}
+	if sameFile(a, b) {
+		t.Fatal("dry run linked files")
+	}
+
+	result = dedupe(strings.Replace(body, "true", "false", 1))
+	if len(result.Linked) != 1 || !sameFile(a, b) {
+		t.Fatalf("expected b to be linked to a, got %+v", result)
+	}
+	if data, _ := os.ReadFile(d); bytes.Equal(data, content) {
+		t.Error("expected d to be left alone")
+	}
+	if r := reasons(dedupe(body)); r[b] != filemanager.DedupeAlreadyLinked {
+		t.Errorf("expected b to be reported as linked, got %v", r)
+	}
+}
+
+func TestFileListPages(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"c.jpg", "a.jpg", "b.txt", ".hidden.jpg", "d.jpg"} {
+		os.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte("x"), i+1), 0644)
+	}
+
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+
+	list := func(query string) ([]string, string, int) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/list?path="+url.QueryEscape(dir)+"&"+query, nil))
+		var resp struct {
+			Data          []filemanager.FileInfo `json:"data"`
+			NextPageToken string                 `json:"next_page_token"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		var names []string
+		for _, file := range resp.Data {
+			names = append(names, file.Name)
+		}
+		return names, resp.NextPageToken, rec.Code
+	}
+
+	names, next, _ := list("pattern=*.jpg&hidden=false&limit=2")
+	if strings.Join(names, ",") != "a.jpg,c.jpg" || next == "" {
+		t.Fatalf("unexpected first page %v, next %q", names, next)
+	}
+	names, next, _ = list("pattern=*.jpg&hidden=false&limit=2&page_token=" + next)
+	if strings.Join(names, ",") != "d.jpg" || next != "" {
+		t.Fatalf("unexpected last page %v, next %q", names, next)
+	}
+
+	names, _, _ = list("sort=size&order=desc")
+	if strings.Join(names, ",") != "d.jpg,.hidden.jpg,b.txt,a.jpg,c.jpg" {
+		t.Fatalf("unexpected size order %v", names)
+	}
+
+	for _, query := range []string{"sort=owner", "order=up", "pattern=[a"} {
+		if _, _, status := list(query); status != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", query, status)
+		}
+	}
+}
+
+func TestFilePermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	os.WriteFile(path, []byte("q3"), 0644)
+	os.Symlink(path, filepath.Join(dir, "link"))
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	auditLogger, err := audit.New(auditFile, false, "", true)
+	if err != nil {
+		t.Fatalf("audit.New: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, auditLogger), nil, 0).Register(mux)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/v1/files/permissions", `{"path":"`+path+`","mode":"2750"}`)
+	var resp struct {
+		Data filemanager.Permissions `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("set permissions: %d %s", rec.Code, rec.Body.String())
+	}
+	if resp.Data.Mode != "2750" {
+		t.Fatalf("expected mode 2750, got %s", resp.Data.Mode)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0750 || info.Mode()&os.ModeSetgid == 0 {
+		t.Fatalf("expected the file mode to change, got %v", info.Mode())
+	}
+	auditLogger.Close()
+	if data, _ := os.ReadFile(auditFile); !strings.Contains(string(data), `"mode":"0644"`) || !strings.Contains(string(data), `"mode":"2750"`) {
+		t.Fatalf("expected the audit entry to hold both modes, got %s", data)
+	}
+
+	for _, body := range []string{
+		`{"path":"` + path + `","mode":"999"}`,
+		`{"path":"` + path + `","set_xattrs":{"security.selinux":"x"}}`,
+		`{"path":"` + path + `","set_acl":["user:alice:rwx,other::rwx"]}`,
+		`{"path":"` + filepath.Join(dir, "link") + `","mode":"0777"}`,
+	} {
+		if rec := do(http.MethodPost, "/api/v1/files/permissions", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := do(http.MethodGet, "/api/v1/files/permissions?path=/etc/passwd", ""); rec.Code == http.StatusOK {
+		t.Fatal("expected paths outside the allowed directories to be refused")
+	}
+}
+
+func TestFileUsage(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "photos", "2026"), 0755)
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "photos", "2026", "a.jpg"), make([]byte, 3000), 0644)
+	os.WriteFile(filepath.Join(dir, "photos", "b.jpg"), make([]byte, 2000), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "c.txt"), make([]byte, 100), 0644)
+	// Hard links take no extra space
+	os.Link(filepath.Join(dir, "photos", "b.jpg"), filepath.Join(dir, "vacation.jpg"))
+
+	manager := filemanager.New([]string{dir}, nil)
+	manager.SetUsageCache(time.Minute)
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	get := func(target string) (*httptest.ResponseRecorder, *filemanager.DirUsage) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var resp struct {
+			Data *filemanager.DirUsage `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp.Data
+	}
+
+	rec, usage := get("/api/v1/files/usage?path=" + dir)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("usage: %d %s", rec.Code, rec.Body.String())
+	}
+	if usage.Size != 5100 || usage.Files != 4 || usage.Dirs != 3 {
+		t.Fatalf("unexpected totals %+v", usage)
+	}
+	if len(usage.Children) != 2 || usage.Children[0].Name != "photos" || usage.Children[0].Size != 5000 {
+		t.Fatalf("expected photos first, got %+v", usage.Children)
+	}
+	if usage.Children[0].Children != nil {
+		t.Fatal("expected depth 1 to stop below the first level")
+	}
+	if rec.Header().Get("Cache-Control") == "" {
+		t.Fatal("expected cache headers")
+	}
+
+	// Cached until asked to recompute
+	os.WriteFile(filepath.Join(dir, "docs", "d.txt"), make([]byte, 900), 0644)
+	if _, usage := get("/api/v1/files/usage?path=" + dir); usage.Size != 5100 {
+		t.Fatalf("expected the cached report, got %d", usage.Size)
+	}
+	_, usage = get("/api/v1/files/usage?path=" + dir + "&depth=2")
+	if usage.Size != 6000 || len(usage.Children[0].Children) != 1 {
+		t.Fatalf("expected a fresh report two levels deep, got %+v", usage)
+	}
+
+	if rec, _ := get("/api/v1/files/usage?path=" + dir + "&depth=99"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a depth over the limit, got %d", rec.Code)
+	}
+}
+
+func TestFileBatch(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "album"), 0755)
+
+	manager := filemanager.New([]string{dir}, nil)
+	if err := manager.SetTrash(t.TempDir(), 0); err != nil {
+		t.Fatalf("SetTrash: %v", err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	batch := func(body string) (*httptest.ResponseRecorder, *filemanager.BatchReport) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/files/batch", strings.NewReader(body)))
+		var resp struct {
+			Data *filemanager.BatchReport `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp.Data
+	}
+	p := func(name string) string { return filepath.Join(dir, name) }
+	exists := func(name string) bool {
+		_, err := os.Lstat(p(name))
+		return err == nil
+	}
+
+	// A transaction whose last operation fails leaves everything as it was
+	rec, report := batch(`{"transactional":true,"operations":[
+		{"op":"rename","path":"` + p("a.txt") + `","dst_path":"` + p("a2.txt") + `"},
+		{"op":"copy","path":"` + p("b.txt") + `","dst_path":"` + p("album/b.txt") + `"},
+		{"op":"delete","path":"` + p("c.txt") + `"},
+		{"op":"move","path":"` + p("missing.txt") + `","dst_path":"` + p("album/missing.txt") + `"},
+		{"op":"delete","path":"` + p("b.txt") + `"}]}`)
+	if rec.Code != http.StatusOK || report == nil {
+		t.Fatalf("batch: %d %s", rec.Code, rec.Body.String())
+	}
+	if !report.RolledBack || report.Succeeded != 0 || report.Failed != 1 {
+		t.Fatalf("expected a rolled back transaction, got %+v", report)
+	}
+	if !report.Results[0].RolledBack || report.Results[3].Error == "" || !report.Results[4].Skipped {
+		t.Fatalf("unexpected results %+v", report.Results)
+	}
+	if !exists("a.txt") || exists("a2.txt") || exists("album/b.txt") || !exists("c.txt") {
+		t.Fatal("expected the transaction to leave no changes")
+	}
+
+	// Without a transaction, the other operations still run
+	_, report = batch(`{"operations":[
+		{"op":"move","path":"` + p("missing.txt") + `","dst_path":"` + p("album/missing.txt") + `"},
+		{"op":"move","path":"` + p("a.txt") + `","dst_path":"` + p("album/a.txt") + `"},
+		{"op":"delete","path":"` + p("c.txt") + `","permanent":true}]}`)
+	if report.Succeeded != 2 || report.Failed != 1 || report.Results[0].Success {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if !exists("album/a.txt") || exists("c.txt") {
+		t.Fatal("expected the successful operations to take effect")
+	}
+
+	for _, body := range []string{
+		`{"operations":[]}`,
+		`{"operations":[{"op":"chmod","path":"` + p("b.txt") + `"}]}`,
+		`{"transactional":true,"operations":[{"op":"delete","path":"` + p("b.txt") + `","permanent":true}]}`,
+	} {
+		if rec, _ := batch(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestFileGrep(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "notes"), 0755)
+	os.WriteFile(filepath.Join(dir, "notes", "todo.md"), []byte("buy milk\nfix backup\ncall Bob\nbackup photos\nrest\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "log.txt"), []byte("BACKUP done\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "image.bin"), []byte("backup\x00\x01"), 0644)
+
+	manager := filemanager.New([]string{dir}, nil)
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+
+	grep := func(query string) (*httptest.ResponseRecorder, []GrepLine) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/grep?path="+dir+"&"+query, nil))
+		var lines []GrepLine
+		for _, raw := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			var line GrepLine
+			json.Unmarshal([]byte(raw), &line)
+			lines = append(lines, line)
+		}
+		return rec, lines
+	}
+
+	rec, lines := grep("pattern=back%5Bu%5Dp&ignore_case=true&context=1")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("grep: %d %s", rec.Code, rec.Body.String())
+	}
+	if len(lines) != 4 || lines[3].Type != "summary" {
+		t.Fatalf("expected 3 matches and a summary, got %s", rec.Body.String())
+	}
+	if lines[0].Path != filepath.Join(dir, "log.txt") || lines[0].Text != "BACKUP done" {
+		t.Fatalf("unexpected first match %+v", lines[0].GrepMatch)
+	}
+	second := lines[1].GrepMatch
+	if second.Line != 2 || len(second.Before) != 1 || second.Before[0] != "buy milk" || len(second.After) != 1 || second.After[0] != "call Bob" {
+		t.Fatalf("unexpected context %+v", second)
+	}
+	if summary := lines[3].Summary; summary.Matches != 3 || summary.FilesSkipped != 1 || summary.Truncated {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	_, lines = grep("pattern=backup&ext=md&max_matches=1")
+	if len(lines) != 2 || lines[0].Line != 2 || !lines[1].Summary.Truncated {
+		t.Fatalf("expected one truncated match, got %+v", lines)
+	}
+
+	for _, query := range []string{"pattern=%28", "pattern=x&context=99", "pattern="} {
+		if rec, _ := grep(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "photos"), 0755)
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+
+	bus := events.NewBus(100)
+	fileWatcher, err := watcher.New(watcher.Config{}, bus)
+	if errors.Is(err, watcher.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("watcher.New: %v", err)
+	}
+	defer fileWatcher.Close()
+
+	manager := filemanager.New([]string{dir}, nil)
+	manager.SetWatcher(fileWatcher)
+	fileAPI := NewFileAPI(manager, nil, 0)
+	fileAPI.SetEventBus(bus)
+	mux := http.NewServeMux()
+	fileAPI.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/files/watch?path=" + filepath.Join(dir, "photos"))
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("watch: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Changes outside the watched directory are not sent
+	os.WriteFile(filepath.Join(dir, "docs", "notes.txt"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "photos", "a.jpg"), []byte("jpeg"), 0644)
+
+	lines := bufio.NewScanner(resp.Body)
+	var eventType string
+	for lines.Scan() {
+		if value, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+			eventType = value
+		}
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			if eventType != watcher.EventCreated || !strings.Contains(data, filepath.Join(dir, "photos", "a.jpg")) {
+				t.Fatalf("unexpected event %s %s", eventType, data)
+			}
+			break
+		}
+	}
+
+	origin := "http://" + strings.TrimPrefix(server.URL, "http://")
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/files/watch?path="+dir, "", origin)
+	if err != nil {
+		t.Fatalf("websocket watch: %v", err)
+	}
+	defer ws.Close()
+	os.Remove(filepath.Join(dir, "docs", "notes.txt"))
+	var event events.Event
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &event); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if event.Type != watcher.EventDeleted {
+		t.Fatalf("expected a delete event, got %+v", event)
+	}
+
+	if _, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/files/watch?path="+dir, "", "http://example.com"); err == nil {
+		t.Fatal("expected connections from other origins to be refused")
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/watch?path=/etc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 outside the allowed paths, got %d", rec.Code)
+	}
+}
+
+func TestWOPI(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.docx")
+	if err := os.WriteFile(path, []byte("draft"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	NewWOPIHandlers(filemanager.New([]string{dir}, nil), 0).Register(mux)
+	issue := func(readOnly bool) WOPITokenResponse {
+		data, _ := json.Marshal(map[string]interface{}{"path": path, "read_only": readOnly})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files/wopi/token", bytes.NewReader(data))
+		req.Header.Set("X-User", "alice")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var resp struct {
+			Data WOPITokenResponse `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || resp.Data.WOPIAccess == nil || resp.Data.AccessToken == "" {
+			t.Fatalf("unexpected token response: %d %s", rec.Code, rec.Body.String())
+		}
+		return resp.Data
+	}
+	access := issue(false)
+	if !strings.HasSuffix(access.WOPISrc, "/wopi/files/"+access.FileID) {
+		t.Errorf("unexpected wopi_src %q", access.WOPISrc)
+	}
+	wopi := func(method, suffix, token string, headers map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/wopi/files/"+access.FileID+suffix+"?access_token="+token, strings.NewReader(body))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	token := access.AccessToken
+
+	if rec := wopi(http.MethodGet, "", "wrong", nil, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong token, got %d", rec.Code)
+	}
+
+	rec := wopi(http.MethodGet, "", token, nil, "")
+	var info filemanager.WOPIFileInfo
+	json.Unmarshal(rec.Body.Bytes(), &info)
+	if rec.Code != http.StatusOK || info.BaseFileName != "report.docx" || info.Size != 5 || !info.UserCanWrite || !info.SupportsLocks {
+		t.Fatalf("unexpected CheckFileInfo: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := wopi(http.MethodGet, "/contents", token, nil, ""); rec.Code != http.StatusOK || rec.Body.String() != "draft" || rec.Header().Get("X-WOPI-ItemVersion") != info.Version {
+		t.Errorf("unexpected GetFile: %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("X-WOPI-ItemVersion"))
+	}
+
+	// Saving a file that isn't empty needs the lock
+	put := map[string]string{"X-WOPI-Override": "PUT", "X-WOPI-Lock": "L1"}
+	if rec := wopi(http.MethodPost, "/contents", token, put, "final"); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 saving without a lock, got %d", rec.Code)
+	}
+	if rec := wopi(http.MethodPost, "", token, map[string]string{"X-WOPI-Override": "LOCK", "X-WOPI-Lock": "L1"}, ""); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected LOCK: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = wopi(http.MethodPost, "", token, map[string]string{"X-WOPI-Override": "LOCK", "X-WOPI-Lock": "L2"}, "")
+	if rec.Code != http.StatusConflict || rec.Header().Get("X-WOPI-Lock") != "L1" {
+		t.Errorf("expected 409 with the current lock, got %d %q", rec.Code, rec.Header().Get("X-WOPI-Lock"))
+	}
+	if rec := wopi(http.MethodPost, "", token, map[string]string{"X-WOPI-Override": "GET_LOCK"}, ""); rec.Header().Get("X-WOPI-Lock") != "L1" {
+		t.Errorf("expected GET_LOCK to return L1, got %q", rec.Header().Get("X-WOPI-Lock"))
+	}
+	rec = wopi(http.MethodPost, "/contents", token, put, "final")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-WOPI-ItemVersion") == "" {
+		t.Fatalf("unexpected PutFile: %d %s", rec.Code, rec.Body.String())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "final" {
+		t.Errorf("expected the file to be saved, got %q", data)
+	}
+
+	if rec := wopi(http.MethodPost, "", token, map[string]string{"X-WOPI-Override": "LOCK", "X-WOPI-Lock": "L2", "X-WOPI-OldLock": "L1"}, ""); rec.Code != http.StatusOK {
+		t.Errorf("unexpected unlock and relock: %d", rec.Code)
+	}
+	if rec := wopi(http.MethodPost, "", token, map[string]string{"X-WOPI-Override": "UNLOCK", "X-WOPI-Lock": "L1"}, ""); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 unlocking with the old lock, got %d", rec.Code)
+	}
+	if rec := wopi(http.MethodPost, "", token, map[string]string{"X-WOPI-Override": "UNLOCK", "X-WOPI-Lock": "L2"}, ""); rec.Code != http.StatusOK {
+		t.Errorf("unexpected UNLOCK: %d", rec.Code)
+	}
+
+	readOnly := issue(true).AccessToken
+	if rec := wopi(http.MethodPost, "", readOnly, map[string]string{"X-WOPI-Override": "LOCK", "X-WOPI-Lock": "L3"}, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 locking with a read-only token, got %d", rec.Code)
+	}
+}
+
+func TestSparseUpload(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"up", "copy"} {
+		os.Mkdir(filepath.Join(dir, sub), 0755)
+	}
+	manager := filemanager.New([]string{dir}, nil)
+	if err := manager.SetUploadSessions(t.TempDir(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	diskSize := func(path string) int64 {
+		rec := do(http.MethodGet, "/api/v1/files/usage?depth=0&path="+url.QueryEscape(path), "")
+		var resp struct {
+			Data filemanager.DirUsage `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data.DiskSize
+	}
+
+	// A mostly empty image, with data at both ends
+	const size = 8 << 20
+	image := make([]byte, size)
+	copy(image, "QFI\xfb")
+	copy(image[size-3:], "end")
+	path := filepath.Join(dir, "up", "disk.qcow2")
+	if rec := do(http.MethodPost, "/api/v1/files/upload?sparse=true&path="+url.QueryEscape(path), string(image)); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected upload: %d %s", rec.Code, rec.Body.String())
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, image) {
+		t.Fatal("expected the sparse upload to keep the content")
+	}
+	if got := diskSize(filepath.Join(dir, "up")); got >= size/2 {
+		t.Skipf("filesystem does not keep holes (%d bytes allocated)", got)
+	}
+
+	rec := do(http.MethodPost, "/api/v1/files/copy", `{"src_path":"`+path+`","dst_path":"`+filepath.Join(dir, "copy", "disk.qcow2")+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected copy: %d %s", rec.Code, rec.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "copy", "disk.qcow2")); !bytes.Equal(data, image) {
+		t.Fatal("expected the copy to keep the content")
+	}
+	if got := diskSize(filepath.Join(dir, "copy")); got >= size/2 {
+		t.Errorf("expected the copy of a sparse file to stay sparse, %d bytes allocated", got)
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/upload/start", `{"path":"`+path+`","size":10,"sparse":true,"preallocate":true}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a sparse preallocated upload, got %d", rec.Code)
+	}
+	rec = do(http.MethodPost, "/api/v1/files/upload/start", `{"path":"`+filepath.Join(dir, "up", "big.img")+`","size":1048576,"preallocate":true}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected preallocated start: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	var calls int
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "image/jpeg" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"tags":[{"name":"cat","confidence":0.97}],"faces":[{"name":"alice","confidence":0.9,"box":[1,2,3,4]},{"confidence":0.5}]}`))
+	}))
+	defer service.Close()
+
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "photo.jpg")
+	os.WriteFile(photo, []byte("not really a jpeg"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+
+	idx, err := indexer.New(&indexer.Config{DBPath: filepath.Join(t.TempDir(), "index.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if _, err := idx.Scan(context.Background(), indexer.ScanOptions{Paths: []string{dir}, Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	NewIndexerHandlers(idx, nil, nil).Register(mux)
+	enrich := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/indexer/enrich", strings.NewReader(`{"path":"`+dir+`"}`)))
+		return rec
+	}
+
+	if rec := enrich(); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without enrichers, got %d", rec.Code)
+	}
+
+	idx.AddEnricher(indexer.NewHTTPEnricher(service.URL, "secret", 5*time.Second, 0))
+	rec := enrich()
+	var result struct {
+		Data indexer.EnrichResult `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	if rec.Code != http.StatusOK || result.Data.Files != 1 || result.Data.Tags != 3 || calls != 1 {
+		t.Fatalf("unexpected enrichment: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/indexer/search?tag=cat&tag=alice", nil))
+	var search struct {
+		Data []*indexer.FileMetadata `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &search)
+	if rec.Code != http.StatusOK || len(search.Data) != 1 || search.Data[0].Path != photo || len(search.Data[0].Tags) != 3 {
+		t.Fatalf("unexpected search results: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/indexer/search?tag=dog", nil))
+	search.Data = nil
+	json.Unmarshal(rec.Body.Bytes(), &search)
+	if rec.Code != http.StatusOK || len(search.Data) != 0 {
+		t.Fatalf("expected no files tagged dog: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/indexer/tags?path="+url.QueryEscape(dir), nil))
+	var tags struct {
+		Data []indexer.TagCount `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &tags)
+	if rec.Code != http.StatusOK || len(tags.Data) != 2 {
+		t.Fatalf("unexpected tags: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Unchanged files are not sent again
+	rec = enrich()
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	if rec.Code != http.StatusOK || result.Data.Files != 0 || calls != 1 {
+		t.Fatalf("expected nothing to enrich: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(outside, "passwd"), []byte("root:x:0:0"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(dir, "passwd"))
+	os.Symlink(outside, filepath.Join(dir, "etc"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(dir, "dangling"))
+	os.Symlink("notes.txt", filepath.Join(dir, "inside"))
+
+	manager := filemanager.New([]string{dir}, nil)
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	download := func(path string) *httptest.ResponseRecorder {
+		return do(http.MethodGet, "/api/v1/files/download?path="+url.QueryEscape(path), "")
+	}
+
+	if rec := download(filepath.Join(dir, "inside")); rec.Code != http.StatusOK || rec.Body.String() != "notes" {
+		t.Fatalf("expected symlinks within the allowed paths to be followed: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range []string{filepath.Join(dir, "passwd"), filepath.Join(dir, "etc", "passwd")} {
+		if rec := download(path); rec.Code == http.StatusOK {
+			t.Errorf("expected %s to be refused: %s", path, rec.Body.String())
+		}
+	}
+	if rec := do(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(filepath.Join(dir, "dangling")), "data"); rec.Code == http.StatusOK {
+		t.Errorf("expected writes through a dangling symlink to be refused: %s", rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(outside, "missing")); err == nil {
+		t.Error("file created outside the allowed paths")
+	}
+	body := fmt.Sprintf(`{"target":"../%s/passwd","link_path":%q}`, filepath.Base(outside), filepath.Join(dir, "new"))
+	if rec := do(http.MethodPost, "/api/v1/files/symlink", body); rec.Code == http.StatusOK {
+		t.Errorf("expected a symlink leading outside to be refused: %s", rec.Body.String())
+	}
+
+	// Escaping symlinks themselves can still be removed
+	if rec := do(http.MethodPost, "/api/v1/files/delete", fmt.Sprintf(`{"path":%q}`, filepath.Join(dir, "passwd"))); rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(outside, "passwd")); err != nil {
+		t.Errorf("symlink target was deleted: %v", err)
+	}
+
+	manager.SetFollowEscapingSymlinks(true)
+	if rec := download(filepath.Join(dir, "etc", "passwd")); rec.Code != http.StatusOK {
+		t.Errorf("expected escaping symlinks to be followed when enabled: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "app", "node_modules", "left-pad"), 0755)
+	os.MkdirAll(filepath.Join(dir, "photos", "cache"), 0755)
+	os.WriteFile(filepath.Join(dir, "app", "node_modules", "left-pad", "index.js"), make([]byte, 5000), 0644)
+	os.WriteFile(filepath.Join(dir, "app", "main.js"), make([]byte, 100), 0644)
+	os.WriteFile(filepath.Join(dir, "photos", "a.jpg"), make([]byte, 1000), 0644)
+	os.WriteFile(filepath.Join(dir, "photos", "cache", "thumb.jpg"), make([]byte, 300), 0644)
+	matcher := ignore.New([]string{"node_modules"})
+	dbPath := filepath.Join(t.TempDir(), "index.db")
+
+	idx, err := indexer.New(&indexer.Config{DBPath: dbPath, Ignore: matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { idx.Close() }()
+	scan := func() {
+		if _, err := idx.Scan(context.Background(), indexer.ScanOptions{Paths: []string{dir}, Recursive: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexed := func(query string) int {
+		results, err := idx.Search(context.Background(), query, 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results)
+	}
+
+	scan()
+	if indexed("left-pad") != 0 || indexed("main.js") != 1 || indexed("thumb.jpg") != 1 {
+		t.Fatal("expected only node_modules to be left out of the index")
+	}
+
+	// Ignore files apply from the next scan on, which drops what they
+	// ignore from the index. A new matcher doesn't wait for its cache.
+	os.WriteFile(filepath.Join(dir, "photos", ignore.FileName), []byte("cache/\n"), 0644)
+	matcher = ignore.New([]string{"node_modules"})
+	idx.Close()
+	idx, err = indexer.New(&indexer.Config{DBPath: dbPath, Ignore: matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan()
+	if indexed("thumb.jpg") != 0 || indexed("a.jpg") != 1 {
+		t.Fatal("expected the .mingyueignore file to be honored")
+	}
+
+	manager := filemanager.New([]string{dir}, nil)
+	manager.SetIgnore(matcher)
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/usage?path="+dir, nil))
+	var resp struct {
+		Data *filemanager.DirUsage `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Data.Size != 1100+int64(len("cache/\n")) || resp.Data.Ignored != 2 {
+		t.Fatalf("unexpected usage: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "movie.mkv")
+	os.WriteFile(path, make([]byte, 96*1024), 0644)
+	mux := http.NewServeMux()
+	NewFileAPI(filemanager.New([]string{dir}, nil), nil, 0).Register(mux)
+
+	setLimits := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/files/transfer-limits", strings.NewReader(body)))
+		return rec
+	}
+	download := func(query string) time.Duration {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/download?path="+path+query, nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != 96*1024 {
+			t.Fatalf("download: %d", rec.Code)
+		}
+		return time.Since(start)
+	}
+
+	if elapsed := download(""); elapsed > 300*time.Millisecond {
+		t.Fatalf("expected no limit by default, took %s", elapsed)
+	}
+	// The first 64 KiB are covered by the burst
+	if elapsed := download("&rate_kbps=64"); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected rate_kbps to limit the download, took %s", elapsed)
+	}
+
+	if rec := setLimits(`{"global":{"download_kbps":-1}}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", rec.Code)
+	}
+	if rec := setLimits(`{"global":{"download_kbps":64}}`); rec.Code != http.StatusOK {
+		t.Fatalf("set limits: %d %s", rec.Code, rec.Body.String())
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files/transfer-limits", nil))
+	var resp struct {
+		Data TransferLimits `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.Global.DownloadKBps != 64 {
+		t.Fatalf("unexpected limits %s", rec.Body.String())
+	}
+	if elapsed := download(""); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected the global limit to apply, took %s", elapsed)
+	}
+}
+
+func TestIndexChanges(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"keep.txt", "edit.txt", "gone.txt"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	idx, err := indexer.New(&indexer.Config{DBPath: filepath.Join(t.TempDir(), "index.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	scan := func() {
+		if _, err := idx.Scan(context.Background(), indexer.ScanOptions{Paths: []string{dir}, Recursive: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan()
+
+	mux := http.NewServeMux()
+	NewIndexerHandlers(idx, nil, nil).Register(mux)
+	changes := func(query string) (int, indexer.ChangeSet) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/indexer/changes?"+query, nil))
+		var result struct {
+			Data indexer.ChangeSet `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return rec.Code, result.Data
+	}
+	names := func(files []*indexer.FileMetadata) []string {
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// The first sync pages through the whole index
+	code, first := changes("cursor=0&limit=2")
+	if code != http.StatusOK || !first.Reset || !first.More || len(first.Added) != 2 {
+		t.Fatalf("unexpected first page: %d %+v", code, first)
+	}
+	code, second := changes(fmt.Sprintf("cursor=%d&limit=2", first.Cursor))
+	if code != http.StatusOK || second.Reset || second.More || len(second.Added)+len(second.Changed) != 2 {
+		t.Fatalf("unexpected second page: %d %+v", code, second)
+	}
+
+	// Rescanning unchanged files changes nothing
+	scan()
+	if _, unchanged := changes(fmt.Sprintf("cursor=%d", second.Cursor)); len(unchanged.Added)+len(unchanged.Changed)+len(unchanged.Removed) != 0 {
+		t.Fatalf("expected no changes after rescanning, got %+v", unchanged)
+	}
+
+	os.WriteFile(filepath.Join(dir, "edit.txt"), []byte("edited"), 0644)
+	os.WriteFile(filepath.Join(dir, "new.txt"), []byte("new"), 0644)
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	scan()
+	if _, err := idx.CleanupOrphans(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	code, delta := changes(fmt.Sprintf("cursor=%d", second.Cursor))
+	if code != http.StatusOK || delta.Reset || delta.More {
+		t.Fatalf("unexpected delta: %d %+v", code, delta)
+	}
+	if got := names(delta.Added); !reflect.DeepEqual(got, []string{"new.txt"}) {
+		t.Errorf("expected new.txt added, got %v", got)
+	}
+	if got := names(delta.Changed); !reflect.DeepEqual(got, []string{"edit.txt"}) {
+		t.Errorf("expected edit.txt changed, got %v", got)
+	}
+	if !reflect.DeepEqual(delta.Removed, []string{filepath.Join(dir, "gone.txt")}) {
+		t.Errorf("expected gone.txt removed, got %v", delta.Removed)
+	}
+
+	if _, caughtUp := changes(fmt.Sprintf("cursor=%d", delta.Cursor)); caughtUp.Cursor != delta.Cursor || len(caughtUp.Added)+len(caughtUp.Changed)+len(caughtUp.Removed) != 0 {
+		t.Errorf("expected no changes after the last cursor, got %+v", caughtUp)
+	}
+	for _, query := range []string{"cursor=-1", "cursor=abc", fmt.Sprintf("cursor=%d", delta.Cursor+100)} {
+		if code, _ := changes(query); code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", query, code)
+		}
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "old.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	fileMgr := filemanager.New([]string{dir}, nil)
+	mux := http.NewServeMux()
+	NewWebDAVHandlers(fileMgr, 16).Register(mux)
+	dav := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("any", "token")
+		req.Header.Set("X-User", "alice")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PROPFIND", "/webdav/", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("expected a basic challenge without credentials, got %d %v", rec.Code, rec.Header())
+	}
+
+	// The allowed directory is a folder at the root
+	rec = dav("PROPFIND", "/webdav/", "", map[string]string{"Depth": "1"})
+	if rec.Code != http.StatusMultiStatus || !strings.Contains(rec.Body.String(), "<D:href>/webdav/data/</D:href>") {
+		t.Fatalf("unexpected root listing: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = dav("PROPFIND", "/webdav/data/", "", map[string]string{"Depth": "1"})
+	if rec.Code != http.StatusMultiStatus || !strings.Contains(rec.Body.String(), "/webdav/data/docs/") || strings.Contains(rec.Body.String(), "escape") {
+		t.Fatalf("unexpected folder listing: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := dav(http.MethodPut, "/webdav/data/docs/new.txt", "hello", nil); rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := dav(http.MethodGet, "/webdav/data/docs/new.txt", "", nil); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("unexpected GET: %d %q", rec.Code, rec.Body.String())
+	}
+	if info, err := os.Stat(filepath.Join(dir, "docs", "new.txt")); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("expected the upload to be readable like other files, got %v %v", info, err)
+	}
+
+	// Uploads over the size limit leave the file as it was
+	if rec := dav(http.MethodPut, "/webdav/data/docs/old.txt", strings.Repeat("x", 17), nil); rec.Code < 400 {
+		t.Errorf("expected an oversized upload to fail, got %d", rec.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "docs", "old.txt")); string(data) != "old" {
+		t.Errorf("expected the file to be unchanged, got %q", data)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "docs", ".*.tmp")); len(leftovers) != 0 {
+		t.Errorf("expected the partial upload to be removed, got %v", leftovers)
+	}
+
+	// So do uploads to locked files
+	if _, err := fileMgr.AcquireLock(context.Background(), filepath.Join(dir, "docs", "old.txt"), "tab", 0, "bob"); err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	if rec := dav(http.MethodPut, "/webdav/data/docs/old.txt", "new", nil); rec.Code < 400 {
+		t.Errorf("expected an upload to a locked file to fail, got %d", rec.Code)
+	}
+
+	if rec := dav("MKCOL", "/webdav/data/missing/sub", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 creating a folder in a missing one, got %d", rec.Code)
+	}
+	if rec := dav("MKCOL", "/webdav/data/photos", "", nil); rec.Code != http.StatusCreated {
+		t.Errorf("unexpected MKCOL: %d", rec.Code)
+	}
+	if rec := dav("MOVE", "/webdav/data/docs/new.txt", "", map[string]string{"Destination": "/webdav/data/photos/new.txt"}); rec.Code != http.StatusCreated {
+		t.Errorf("unexpected MOVE: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photos", "new.txt")); err != nil {
+		t.Errorf("expected the file to be moved: %v", err)
+	}
+	if rec := dav(http.MethodDelete, "/webdav/data/photos", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("unexpected DELETE: %d", rec.Code)
+	}
+	if rec := dav(http.MethodDelete, "/webdav/data", "", nil); rec.Code < 400 {
+		t.Errorf("expected deleting the allowed directory to fail, got %d", rec.Code)
+	}
+	if rec := dav(http.MethodGet, "/webdav/data/escape/", "", nil); rec.Code < 400 {
+		t.Errorf("expected a symlink out of the allowed paths to be refused, got %d", rec.Code)
+	}
+}
+
+// fakeClamd answers INSTREAM commands on a unix socket, finding malware in
+// streams that contain "EICAR"
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "clamd.ctl")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if bytes.Contains(data, []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestUploadMalwareScan(t *testing.T) {
+	dir := t.TempDir()
+	quarantine := t.TempDir()
+	manager := filemanager.New([]string{dir}, nil)
+	if err := manager.SetUploadSessions(t.TempDir(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.SetScanner(filemanager.NewClamdScanner(fakeClamd(t), time.Second, 1024), quarantine); err != nil {
+		t.Fatal(err)
+	}
+	recorded := map[string]string{}
+	manager.SetScanRecorder(func(ctx context.Context, path string, result *filemanager.ScanResult) {
+		recorded[path] = result.Verdict
+	})
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	clean := filepath.Join(dir, "clean.txt")
+	if rec := do(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(clean), "hello"); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected upload: %d %s", rec.Code, rec.Body.String())
+	}
+	if recorded[clean] != filemanager.ScanClean {
+		t.Errorf("expected the clean verdict to be recorded, got %q", recorded[clean])
+	}
+
+	infected := filepath.Join(dir, "invoice.pdf")
+	rec := do(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(infected), "X5O EICAR test")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), filemanager.PolicyMalwareDetected) {
+		t.Fatalf("expected the infected upload to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(infected); !os.IsNotExist(err) {
+		t.Error("expected the infected upload not to be stored")
+	}
+	if entries, _ := os.ReadDir(quarantine); len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), "-invoice.pdf") {
+		t.Errorf("expected the infected upload in quarantine, got %v", entries)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the clean file to remain, got %d entries", len(entries))
+	}
+
+	// Chunked uploads are scanned when they are finalized
+	rec = do(http.MethodPost, "/api/v1/files/upload/start", `{"path":"`+filepath.Join(dir, "chunked.bin")+`","size":5}`)
+	var start struct {
+		Data filemanager.UploadSession `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &start)
+	do(http.MethodPut, "/api/v1/files/upload/chunk?id="+start.Data.ID+"&offset=0", "EICAR")
+	if rec := do(http.MethodPost, "/api/v1/files/upload/finalize?id="+start.Data.ID, ""); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected the infected chunked upload to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Files past the size limit aren't scanned
+	large := filepath.Join(dir, "large.bin")
+	if rec := do(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(large), "EICAR"+strings.Repeat("a", 2048)); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected upload: %d %s", rec.Code, rec.Body.String())
+	}
+	if recorded[large] != filemanager.ScanSkipped {
+		t.Errorf("expected the large upload to be skipped, got %q", recorded[large])
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	dir := t.TempDir()
+	docs := filepath.Join(dir, "docs")
+	os.Mkdir(docs, 0755)
+	manager := filemanager.New([]string{dir}, nil)
+	manager.SetVersioning([]filemanager.VersionDir{{Path: docs, Keep: 2}})
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	versions := func(path string) []filemanager.FileVersion {
+		var resp struct {
+			Data []filemanager.FileVersion `json:"data"`
+		}
+		json.Unmarshal(do(http.MethodGet, "/api/v1/files/versions?path="+url.QueryEscape(path), "").Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	path := filepath.Join(docs, "report.txt")
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if rec := do(http.MethodPost, "/api/v1/files/upload?path="+url.QueryEscape(path), content); rec.Code != http.StatusOK {
+			t.Fatalf("unexpected upload: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	// Only the last two replaced contents are kept
+	kept := versions(path)
+	if len(kept) != 2 || kept[0].Size != int64(len("three")) || kept[1].Size != int64(len("two")) {
+		t.Fatalf("expected the versions three and two, got %+v", kept)
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/versions/restore", `{"path":"`+path+`","id":"`+kept[1].ID+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected restore: %d %s", rec.Code, rec.Body.String())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "two" {
+		t.Fatalf("expected the restored content, got %q", data)
+	}
+	// The replaced content can be restored in turn
+	if kept = versions(path); len(kept) != 2 || kept[0].Size != int64(len("four")) {
+		t.Fatalf("expected the replaced content as the newest version, got %+v", kept)
+	}
+
+	if rec := do(http.MethodPost, "/api/v1/files/versions/restore", `{"path":"`+path+`","id":"20000101T000000.000000000Z"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown version, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/v1/files/versions?path="+url.QueryEscape(filepath.Join(dir, "other.txt")), ""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501 outside versioned directories, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/v1/files/list?path="+url.QueryEscape(filepath.Join(docs, filemanager.VersionsDirName)), ""); rec.Code == http.StatusOK {
+		t.Error("expected the version store to be out of reach of the file APIs")
+	}
+}
+
+func TestCopyReflink(t *testing.T) {
+	dir := t.TempDir()
+	manager := filemanager.New([]string{dir}, nil)
+	mux := http.NewServeMux()
+	NewFileAPI(manager, nil, 0).Register(mux)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	src := filepath.Join(dir, "movie.mkv")
+	content := bytes.Repeat([]byte("frame"), 1<<16)
+	os.WriteFile(src, content, 0644)
+
+	// Whether the copy is cloned depends on the filesystem of the test;
+	// either way the copy must hold the content and stay independent
+	dst := filepath.Join(dir, "copy.mkv")
+	rec := do(http.MethodPost, "/api/v1/files/copy", `{"src_path":"`+src+`","dst_path":"`+dst+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected copy: %d %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Data filemanager.CopyResult `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.Bytes != int64(len(content)) {
+		t.Errorf("expected %d bytes copied, got %+v", len(content), resp.Data)
+	}
+	if data, _ := os.ReadFile(dst); !bytes.Equal(data, content) {
+		t.Fatal("expected the copy to hold the content")
+	}
+	os.WriteFile(dst, []byte("changed"), 0644)
+	if data, _ := os.ReadFile(src); !bytes.Equal(data, content) {
+		t.Fatal("expected changing the copy to leave the source alone")
+	}
+}
+
+func TestClusterProxy(t *testing.T) {
+	var forwarded *http.Request
+	sibling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: "pong"})
+	}))
+	defer sibling.Close()
+
+	newMux := func(gateway bool) *http.ServeMux {
+		manager, err := cluster.New(&cluster.Config{
+			AgentID:     "gw",
+			Gateway:     gateway,
+			StaticPeers: map[string]string{"nas2": sibling.URL + "/"},
+			PeerToken:   "peer-secret",
+		})
+		if err != nil {
+			t.Fatalf("cluster.New: %v", err)
+		}
+		mux := http.NewServeMux()
+		NewClusterHandlers(manager, nil).Register(mux)
+		return mux
+	}
+	mux := newMux(true)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/cluster/agents", nil))
+	var list struct {
+		Data []cluster.Peer `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != http.StatusOK || len(list.Data) != 1 || list.Data[0].ID != "nas2" || list.Data[0].URL != sibling.URL || !list.Data[0].Online {
+		t.Fatalf("expected the static peer, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/cluster/proxy/nas2/api/v1/ping?verbose=1", nil)
+	req.Header.Set("Authorization", "Bearer caller-token")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "pong") {
+		t.Fatalf("expected the sibling's answer, got %d %s", rec.Code, rec.Body.String())
+	}
+	if forwarded.URL.Path != "/api/v1/ping" || forwarded.URL.RawQuery != "verbose=1" {
+		t.Fatalf("expected the agent prefix to be stripped, got %s", forwarded.URL)
+	}
+	if forwarded.Header.Get(cluster.GatewayHeader) != "gw" || forwarded.Header.Get("X-API-Key") != "peer-secret" || forwarded.Header.Get("Authorization") != "" {
+		t.Fatalf("expected the gateway header and peer token instead of the caller's credentials, got %v", forwarded.Header)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		mux    *http.ServeMux
+		path   string
+		header string
+		status int
+	}{
+		{"unknown agent", mux, "/api/v1/cluster/proxy/nas9/api/v1/ping", "", http.StatusNotFound},
+		{"not an api path", mux, "/api/v1/cluster/proxy/nas2/admin", "", http.StatusBadRequest},
+		{"already proxied", mux, "/api/v1/cluster/proxy/nas2/api/v1/ping", "other-gw", http.StatusLoopDetected},
+		{"not a gateway", newMux(false), "/api/v1/cluster/proxy/nas2/api/v1/ping", "", http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(cluster.GatewayHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			tt.mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status || forwarded != nil {
+				t.Fatalf("expected %d without reaching the sibling, got %d %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+// echoPlugin answers every routed request with what the agent forwarded
+type echoPlugin struct{}
+
+func (echoPlugin) Describe(ctx context.Context) (*plugin.Manifest, error) {
+	return &plugin.Manifest{
+		Name:    "echo",
+		Version: "1.0",
+		Routes:  []plugin.Route{{Method: http.MethodPost, Path: "/say/"}},
+	}, nil
+}
+
+func (echoPlugin) HandleHTTP(ctx context.Context, req *plugin.HTTPRequest) (*plugin.HTTPResponse, error) {
+	body, _ := json.Marshal(req)
+	return &plugin.HTTPResponse{
+		Status:  http.StatusCreated,
+		Headers: map[string][]string{"X-Plugin": {"echo"}},
+		Body:    body,
+	}, nil
+}
+
+func (echoPlugin) RunTask(ctx context.Context, req *plugin.TaskRequest) (*plugin.TaskResponse, error) {
+	return &plugin.TaskResponse{}, nil
+}
+
+func (echoPlugin) HandleEvent(ctx context.Context, event *plugin.Event) error {
+	return nil
+}
+
+// TestPluginProcess is the plugin process started by TestPluginRoutes
+func TestPluginProcess(t *testing.T) {
+	if os.Getenv("MINGYUE_TEST_PLUGIN") != "1" {
+		t.Skip("only runs as a plugin process")
+	}
+	plugin.Serve(echoPlugin{})
+	os.Exit(0)
+}
+
+func TestPluginRoutes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugins talk over unix sockets")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %v", err)
+	}
+
+	manager, err := plugins.New(&plugins.Config{
+		SocketDir: t.TempDir(),
+		Plugins: []plugins.Definition{{
+			Name:    "echo",
+			Command: executable,
+			Args:    []string{"-test.run=^TestPluginProcess$"},
+			Env:     []string{"MINGYUE_TEST_PLUGIN=1"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("plugins.New: %v", err)
+	}
+	if err := manager.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer manager.Stop()
+
+	mux := http.NewServeMux()
+	NewPluginHandlers(manager, nil).Register(mux)
+
+	var list struct {
+		Data []plugins.Status `json:"data"`
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/plugins", nil))
+		json.Unmarshal(rec.Body.Bytes(), &list)
+		if len(list.Data) == 1 && list.Data[0].State == "running" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the plugin to start, got %s", rec.Body.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if list.Data[0].Manifest == nil || list.Data[0].Manifest.Version != "1.0" || list.Data[0].PID == 0 {
+		t.Fatalf("expected the running plugin's manifest and pid, got %+v", list.Data[0])
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/plugins/echo/say/hello?loud=1", strings.NewReader("hi"))
+	req.Header.Set("X-User", "alice")
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Plugin") != "echo" {
+		t.Fatalf("expected the plugin's status and headers, got %d %v %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	var forwarded plugin.HTTPRequest
+	json.Unmarshal(rec.Body.Bytes(), &forwarded)
+	if forwarded.Path != "/say/hello" || forwarded.Query["loud"][0] != "1" || string(forwarded.Body) != "hi" || forwarded.User != "alice" {
+		t.Fatalf("expected the route path, query, body and user, got %+v", forwarded)
+	}
+	if _, exists := forwarded.Headers["Authorization"]; exists {
+		t.Fatal("expected the caller's credentials to be stripped")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"unknown plugin", http.MethodPost, "/api/v1/plugins/other/say/hello", http.StatusNotFound},
+		{"undeclared path", http.MethodPost, "/api/v1/plugins/echo/shout", http.StatusNotFound},
+		{"undeclared method", http.MethodGet, "/api/v1/plugins/echo/say/hello", http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("X-Plugin") != "" {
+				t.Fatalf("expected %d from the agent, got %d %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNetDiskMountJobs(t *testing.T) {
+	// A port nothing listens on makes the host probe fail immediately
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)
+	lis.Close()
+
+	mnt := t.TempDir()
+	manager, err := netdisk.New(&netdisk.Config{
+		AllowedMountPoints: []string{mnt},
+		EncryptionKey:      "test-key",
+		StateFile:          filepath.Join(t.TempDir(), "state.json"),
+	})
+	if err != nil {
+		t.Fatalf("netdisk.New: %v", err)
+	}
+	defer manager.Stop()
+	if err := manager.AddShare(&netdisk.Share{ID: "nas", Name: "NAS", Protocol: netdisk.ProtocolNFS, Host: "127.0.0.1", Path: "/export", MountPoint: filepath.Join(mnt, "nas"), Options: map[string]string{"port": port}}); err != nil {
+		t.Fatalf("AddShare: %v", err)
+	}
+
+	handler := NewNetDiskHandlers(manager, nil)
+	jobMgr := jobs.New(&jobs.Config{})
+	handler.SetJobs(jobMgr)
+	mux := http.NewServeMux()
+	handler.Register(mux)
+	NewJobHandlers(jobMgr).Register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/netdisk/mount", strings.NewReader(`{"id":"nas"}`)))
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "host unreachable") {
+		t.Fatalf("expected an unreachable host to answer 504, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/netdisk/mount", strings.NewReader(`{"id":"nas","async":true}`)))
+	var started struct {
+		Data jobs.Job `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &started)
+	if rec.Code != http.StatusAccepted || started.Data.ID == "" || started.Data.Type != "netdisk.mount" || started.Data.Resource != "nas" {
+		t.Fatalf("expected a mount job, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var job struct {
+		Data jobs.Job `json:"data"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Data.State == "" || job.Data.State == jobs.StateRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the mount job to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/status?id="+started.Data.ID, nil))
+		json.Unmarshal(rec.Body.Bytes(), &job)
+	}
+	if job.Data.State != jobs.StateFailed || !strings.Contains(job.Data.Error, "host unreachable") || job.Data.FinishedAt == nil {
+		t.Fatalf("expected the job to fail on the host probe, got %+v", job.Data)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/status?id=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown job to answer 404, got %d %s", rec.Code, rec.Body.String())
+	}
+}
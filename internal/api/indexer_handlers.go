@@ -3,10 +3,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
 	"github.com/KOPElan/mingyue-agent/internal/indexer"
 	"github.com/KOPElan/mingyue-agent/internal/thumbnail"
 )
@@ -15,6 +18,7 @@ type IndexerHandlers struct {
 	indexer   *indexer.Indexer
 	thumbnail *thumbnail.Generator
 	audit     *audit.Logger
+	files     *filemanager.Manager
 }
 
 func NewIndexerHandlers(idx *indexer.Indexer, thumb *thumbnail.Generator, auditLogger *audit.Logger) *IndexerHandlers {
@@ -25,9 +29,20 @@ func NewIndexerHandlers(idx *indexer.Indexer, thumb *thumbnail.Generator, auditL
 	}
 }
 
+// SetFileManager limits duplicate reports to the allowed paths of files
+// and enables deduplication
+func (h *IndexerHandlers) SetFileManager(files *filemanager.Manager) {
+	h.files = files
+}
+
 func (h *IndexerHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/indexer/scan", h.ScanFiles)
 	mux.HandleFunc("/api/v1/indexer/search", h.SearchFiles)
+	mux.HandleFunc("/api/v1/indexer/duplicates", h.Duplicates)
+	mux.HandleFunc("/api/v1/indexer/dedupe", h.Dedupe)
+	mux.HandleFunc("/api/v1/indexer/enrich", h.Enrich)
+	mux.HandleFunc("/api/v1/indexer/tags", h.Tags)
+	mux.HandleFunc("/api/v1/indexer/changes", h.Changes)
 	mux.HandleFunc("/api/v1/thumbnail/generate", h.GenerateThumbnail)
 	mux.HandleFunc("/api/v1/thumbnail/cleanup", h.CleanupCache)
 }
@@ -58,7 +73,7 @@ func (h *IndexerHandlers) ScanFiles(w http.ResponseWriter, r *http.Request) {
 
 	result, err := h.indexer.Scan(r.Context(), opts)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -78,10 +93,11 @@ func (h *IndexerHandlers) ScanFiles(w http.ResponseWriter, r *http.Request) {
 
 // SearchFiles godoc
 // @Summary Search indexed files
-// @Description Searches indexed files by query string
+// @Description Searches indexed files by name and path, and by the tags enrichers found
 // @Tags indexer
 // @Produce json
-// @Param q query string true "Search query"
+// @Param q query string false "Search query, required without tag"
+// @Param tag query []string false "Only files with all of these tags or face names"
 // @Param limit query int false "Result limit" default(50)
 // @Param offset query int false "Result offset" default(0)
 // @Success 200 {object} Response{data=[]indexer.FileMetadata}
@@ -95,8 +111,9 @@ func (h *IndexerHandlers) SearchFiles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := r.URL.Query().Get("q")
-	if query == "" {
-		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "query parameter required"})
+	tags := r.URL.Query()["tag"]
+	if query == "" && len(tags) == 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "query or tag parameter required"})
 		return
 	}
 
@@ -107,15 +124,243 @@ func (h *IndexerHandlers) SearchFiles(w http.ResponseWriter, r *http.Request) {
 
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
 
-	results, err := h.indexer.Search(r.Context(), query, limit, offset)
+	var results []*indexer.FileMetadata
+	var err error
+	if len(tags) > 0 {
+		results, err = h.indexer.SearchByTags(r.Context(), query, tags, limit, offset)
+	} else {
+		results, err = h.indexer.Search(r.Context(), query, limit, offset)
+	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{Success: true, Data: results})
 }
 
+// duplicateOptions returns the options of a duplicate report below path,
+// limited to the allowed paths when file management is enabled
+func (h *IndexerHandlers) duplicateOptions(path string, minSize int64, limit int) indexer.DuplicateOptions {
+	opts := indexer.DuplicateOptions{Path: path, MinSize: minSize, Limit: limit}
+	if h.files != nil {
+		opts.Allow = func(path string) bool { return h.files.ValidatePath(path) == nil }
+	}
+	return opts
+}
+
+// Duplicates godoc
+// @Summary Report duplicate files
+// @Description Lists indexed files with the same size and MD5 hash, largest waste first
+// @Tags indexer
+// @Produce json
+// @Param path query string false "Only files below this directory"
+// @Param min_size query int false "Minimum file size in bytes"
+// @Param limit query int false "Sets to return" default(100)
+// @Success 200 {object} Response{data=indexer.DuplicateReport}
+// @Failure 400 {object} Response
+// @Failure 500 {object} Response
+// @Router /indexer/duplicates [get]
+func (h *IndexerHandlers) Duplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	var minSize int64
+	if value := query.Get("min_size"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid min_size"})
+			return
+		}
+		minSize = n
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+
+	report, err := h.indexer.Duplicates(r.Context(), h.duplicateOptions(query.Get("path"), minSize, limit))
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: report})
+}
+
+// Dedupe godoc
+// @Summary Replace duplicate files with hard links
+// @Description Links the duplicates of each set to its first file, after comparing their contents. Sets default to the duplicate report below path.
+// @Tags indexer
+// @Accept json
+// @Produce json
+// @Success 200 {object} Response{data=filemanager.DedupeResult}
+// @Failure 400 {object} Response
+// @Failure 503 {object} Response
+// @Router /indexer/dedupe [post]
+// @Security UserAuth
+func (h *IndexerHandlers) Dedupe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+	if h.files == nil {
+		writeJSON(w, http.StatusServiceUnavailable, Response{Success: false, Error: "file management is disabled"})
+		return
+	}
+
+	var req struct {
+		Path    string     `json:"path"`
+		MinSize int64      `json:"min_size"`
+		Sets    [][]string `json:"sets"`
+		DryRun  bool       `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	sets := req.Sets
+	if len(sets) == 0 {
+		report, err := h.indexer.Duplicates(r.Context(), h.duplicateOptions(req.Path, req.MinSize, 0))
+		if err != nil {
+			writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+			return
+		}
+		for _, set := range report.Sets {
+			sets = append(sets, set.Paths)
+		}
+	}
+
+	result, err := h.files.Dedupe(r.Context(), sets, req.DryRun, getUser(r))
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: result})
+}
+
+// Enrich godoc
+// @Summary Enrich indexed files
+// @Description Sends the indexed images not tagged since they changed to the configured enrichment service and stores the tags and faces it returns
+// @Tags indexer
+// @Accept json
+// @Produce json
+// @Param body body indexer.EnrichOptions false "Files to enrich"
+// @Success 200 {object} Response{data=indexer.EnrichResult}
+// @Failure 501 {object} Response
+// @Failure 502 {object} Response
+// @Router /indexer/enrich [post]
+// @Security UserAuth
+func (h *IndexerHandlers) Enrich(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var opts indexer.EnrichOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	result, err := h.indexer.Enrich(r.Context(), opts)
+	if h.audit != nil {
+		entry := &audit.Entry{
+			User:     getUser(r),
+			Action:   "enrich_files",
+			Resource: "indexer",
+			Result:   "success",
+			SourceIP: r.RemoteAddr,
+			Details:  map[string]interface{}{"path": opts.Path, "force": opts.Force},
+		}
+		if err != nil {
+			entry.Result = "failed"
+			entry.Details["error"] = err.Error()
+		}
+		h.audit.Log(r.Context(), entry)
+	}
+	switch {
+	case errors.Is(err, indexer.ErrNoEnrichers):
+		writeJSON(w, http.StatusNotImplemented, Response{Success: false, Error: err.Error()})
+	case errors.Is(err, indexer.ErrEnricherUnavailable):
+		// What was done before the service failed is kept
+		writeJSON(w, http.StatusBadGateway, Response{Success: false, Error: err.Error(), Details: result})
+	case err != nil:
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error(), Details: result})
+	default:
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: result})
+	}
+}
+
+// Tags godoc
+// @Summary List tags
+// @Description Lists the tags and face names of indexed files with the number of files that have each
+// @Tags indexer
+// @Produce json
+// @Param path query string false "Only files below this directory"
+// @Success 200 {object} Response{data=[]indexer.TagCount}
+// @Failure 500 {object} Response
+// @Router /indexer/tags [get]
+func (h *IndexerHandlers) Tags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	tags, err := h.indexer.Tags(r.Context(), r.URL.Query().Get("path"))
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: tags})
+}
+
+// Changes godoc
+// @Summary Get index changes
+// @Description Lists files added, changed and removed in the index since a cursor, so clients can keep their own copy of it. Cursor 0, or one older than the removals the index remembers, returns the whole index with reset set.
+// @Tags indexer
+// @Produce json
+// @Param cursor query int false "Cursor returned by the previous call, 0 for the whole index"
+// @Param limit query int false "Maximum changes to return (default 1000, max 10000)"
+// @Success 200 {object} Response{data=indexer.ChangeSet}
+// @Failure 400 {object} Response
+// @Failure 500 {object} Response
+// @Router /indexer/changes [get]
+func (h *IndexerHandlers) Changes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var cursor int64
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(value, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid cursor"})
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	changes, err := h.indexer.Changes(r.Context(), cursor, limit)
+	if errors.Is(err, indexer.ErrInvalidCursor) {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: changes})
+}
+
 // GenerateThumbnail godoc
 // @Summary Generate thumbnail for file
 // @Description Generates a thumbnail for the specified file
@@ -141,12 +386,12 @@ func (h *IndexerHandlers) GenerateThumbnail(w http.ResponseWriter, r *http.Reque
 
 	thumbInfo, err := h.thumbnail.Generate(r.Context(), path)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
 	// Update indexer with thumbnail URL
-	if err := h.indexer.UpdateThumbnailURL(path, thumbInfo.ThumbPath); err != nil {
+	if err := h.indexer.UpdateThumbnailURL(r.Context(), path, thumbInfo.ThumbPath); err != nil {
 		// Non-fatal, log but continue
 	}
 
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+)
+
+// JobHandlers provides HTTP handlers for background jobs
+type JobHandlers struct {
+	manager *jobs.Manager
+}
+
+// NewJobHandlers creates a new job handlers instance
+func NewJobHandlers(manager *jobs.Manager) *JobHandlers {
+	return &JobHandlers{
+		manager: manager,
+	}
+}
+
+func (h *JobHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/jobs", h.ListJobs)
+	mux.HandleFunc("/api/v1/jobs/status", h.GetJob)
+}
+
+// ListJobs handles GET /api/v1/jobs
+func (h *JobHandlers) ListJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	writePage(w, h.manager.List(), page)
+}
+
+// GetJob handles GET /api/v1/jobs/status?id=
+func (h *JobHandlers) GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "job id is required",
+		})
+		return
+	}
+
+	job, err := h.manager.Get(id)
+	if err != nil {
+		writeJSON(w, jobErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    job,
+	})
+}
+
+// jobErrorStatus maps job errors to HTTP status codes
+func jobErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, jobs.ErrNotCancelable):
+		return http.StatusConflict
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/maintenance"
+)
+
+// maintenancePath is the maintenance switch itself, which stays writable
+const maintenancePath = "/api/v1/maintenance"
+
+// Signing in stays possible so an admin can turn maintenance mode off, and
+// queries and checksum jobs only read even when they are posted
+var maintenanceExempt = map[string]bool{
+	maintenancePath:                 true,
+	"/api/v1/auth/sessions/create":  true,
+	"/api/v1/auth/sessions/refresh": true,
+	queryPath:                       true,
+	checksumJobPath:                 true,
+}
+
+// MaintenanceGuard rejects requests that change state with 503 while
+// maintenance mode is on. GET, HEAD and OPTIONS requests, dry runs, checks,
+// signing in and the maintenance switch itself are always served.
+func MaintenanceGuard(mode *maintenance.Mode, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Dry runs and checks change nothing, but only where the endpoint
+		// honors them
+		preview := dryRunPaths[r.URL.Path] && isDryRun(r) || checkPaths[r.URL.Path] && isCheck(r)
+		if maintenanceExempt[r.URL.Path] || preview || !mode.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		status := mode.Status()
+		writeJSON(w, http.StatusServiceUnavailable, Response{
+			Success: false,
+			Error:   "agent is in maintenance mode",
+			Code:    "maintenance_mode",
+			Details: status,
+		})
+	})
+}
+
+// MaintenanceHandlers provides HTTP handlers for the maintenance switch
+type MaintenanceHandlers struct {
+	mode  *maintenance.Mode
+	audit *audit.Logger
+}
+
+// NewMaintenanceHandlers creates a new maintenance handlers instance
+func NewMaintenanceHandlers(mode *maintenance.Mode, auditLogger *audit.Logger) *MaintenanceHandlers {
+	return &MaintenanceHandlers{
+		mode:  mode,
+		audit: auditLogger,
+	}
+}
+
+func (h *MaintenanceHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc(maintenancePath, h.Maintenance)
+}
+
+// SetMaintenanceRequest turns maintenance mode on or off
+type SetMaintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason"`
+}
+
+// Maintenance handles GET and POST /api/v1/maintenance
+func (h *MaintenanceHandlers) Maintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, Response{
+			Success: true,
+			Data:    h.mode.Status(),
+		})
+	case http.MethodPost:
+		h.setMaintenance(w, r)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+	}
+}
+
+func (h *MaintenanceHandlers) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req SetMaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	if isCheck(r) {
+		writeCheck(w, CheckResult{Changed: h.mode.Enabled() != req.Enabled})
+		return
+	}
+
+	action := "maintenance.disable"
+	if req.Enabled {
+		action = "maintenance.enable"
+	}
+
+	status, err := h.mode.Set(req.Enabled, getUser(r), req.Reason)
+	if err != nil {
+		if h.audit != nil {
+			h.audit.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      getUser(r),
+				Action:    action,
+				Resource:  "agent",
+				Result:    "error",
+				SourceIP:  r.RemoteAddr,
+				Details: map[string]interface{}{
+					"error":  err.Error(),
+					"reason": req.Reason,
+				},
+			})
+		}
+		writeJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "failed to set maintenance mode: " + err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    action,
+			Resource:  "agent",
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details:   map[string]interface{}{"reason": req.Reason},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    status,
+	})
+}
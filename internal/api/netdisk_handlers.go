@@ -1,17 +1,21 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
 	"github.com/KOPElan/mingyue-agent/internal/netdisk"
 )
 
 // NetDiskHandlers provides HTTP handlers for network disk operations
 type NetDiskHandlers struct {
 	manager *netdisk.Manager
+	jobs    *jobs.Manager
 	audit   *audit.Logger
 }
 
@@ -23,13 +27,22 @@ func NewNetDiskHandlers(manager *netdisk.Manager, auditLogger *audit.Logger) *Ne
 	}
 }
 
+// SetJobs enables asynchronous mount and unmount requests
+func (h *NetDiskHandlers) SetJobs(manager *jobs.Manager) {
+	h.jobs = manager
+}
+
 func (h *NetDiskHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/netdisk/shares", h.ListShares)
 	mux.HandleFunc("/api/v1/netdisk/shares/add", h.AddShare)
 	mux.HandleFunc("/api/v1/netdisk/shares/remove", h.RemoveShare)
+	mux.HandleFunc("/api/v1/netdisk/shares/remove/confirm", h.ConfirmRemoveShare)
+	mux.HandleFunc("/api/v1/netdisk/shares/restore", h.RestoreShare)
+	mux.HandleFunc("/api/v1/netdisk/shares/import", h.ImportShares)
 	mux.HandleFunc("/api/v1/netdisk/mount", h.MountShare)
 	mux.HandleFunc("/api/v1/netdisk/unmount", h.UnmountShare)
 	mux.HandleFunc("/api/v1/netdisk/status", h.GetShareStatus)
+	mux.HandleFunc("/api/v1/netdisk/probe", h.ProbeShare)
 }
 
 // ListShares handles GET /api/v1/netdisk/shares
@@ -42,6 +55,11 @@ func (h *NetDiskHandlers) ListShares(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
 	shares := h.manager.ListShares()
 
 	if h.audit != nil {
@@ -57,10 +75,7 @@ func (h *NetDiskHandlers) ListShares(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	writeJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    shares,
-	})
+	writePage(w, shares, page)
 }
 
 // AddShare handles POST /api/v1/netdisk/shares
@@ -140,6 +155,50 @@ func (h *NetDiskHandlers) AddShare(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ImportShares handles POST /api/v1/netdisk/shares/import
+func (h *NetDiskHandlers) ImportShares(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	report, err := h.manager.ImportFstab(r.Context())
+	if err != nil {
+		h.logResult(r.Context(), getUser(r), r.RemoteAddr, "netdisk.import", "", err)
+		writeJSON(w, netDiskErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to import shares: " + err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		ids := make([]string, 0, len(report.Imported))
+		for _, share := range report.Imported {
+			ids = append(ids, share.ID)
+		}
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "netdisk.import",
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"share_ids": ids,
+				"skipped":   len(report.Skipped),
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+	})
+}
+
 // RemoveShare handles DELETE /api/v1/netdisk/shares/{id}
 func (h *NetDiskHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
@@ -159,7 +218,8 @@ func (h *NetDiskHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.RemoveShare(id); err != nil {
+	share, err := h.manager.RemoveShare(r.Context(), id)
+	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -173,7 +233,7 @@ func (h *NetDiskHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, netDiskErrorStatus(err), Response{
 			Success: false,
 			Error:   "failed to remove share: " + err.Error(),
 		})
@@ -188,12 +248,60 @@ func (h *NetDiskHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 			Resource:  id,
 			Result:    "success",
 			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"delete_at": share.DeleteAt,
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusAccepted, Response{
+		Success: true,
+		Data:    share,
+	})
+}
+
+// ConfirmRemoveShare handles POST /api/v1/netdisk/shares/remove/confirm
+func (h *NetDiskHandlers) ConfirmRemoveShare(w http.ResponseWriter, r *http.Request) {
+	h.pendingDelete(w, r, "netdisk.remove_share_confirm", "share removed", h.manager.ConfirmRemoveShare)
+}
+
+// RestoreShare handles POST /api/v1/netdisk/shares/restore
+func (h *NetDiskHandlers) RestoreShare(w http.ResponseWriter, r *http.Request) {
+	h.pendingDelete(w, r, "netdisk.restore_share", "share restored", h.manager.RestoreShare)
+}
+
+// pendingDelete confirms or cancels the deletion of a share
+func (h *NetDiskHandlers) pendingDelete(w http.ResponseWriter, r *http.Request, action, message string, fn func(ctx context.Context, id string) error) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "share id is required",
 		})
+		return
+	}
+
+	err := fn(r.Context(), id)
+	h.logResult(r.Context(), getUser(r), r.RemoteAddr, action, id, err)
+	if err != nil {
+		writeJSON(w, netDiskErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{
 		Success: true,
-		Data:    map[string]interface{}{"message": "share removed"},
+		Data:    map[string]interface{}{"message": message},
 	})
 }
 
@@ -208,7 +316,8 @@ func (h *NetDiskHandlers) MountShare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		ID string `json:"id"`
+		ID    string `json:"id"`
+		Async bool   `json:"async"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, http.StatusBadRequest, Response{
@@ -218,36 +327,47 @@ func (h *NetDiskHandlers) MountShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.Mount(req.ID); err != nil {
-		if h.audit != nil {
-			h.audit.Log(r.Context(), &audit.Entry{
-				Timestamp: time.Now(),
-				User:      getUser(r),
-				Action:    "netdisk.mount",
-				Resource:  req.ID,
-				Result:    "error",
-				SourceIP:  r.RemoteAddr,
-				Details: map[string]interface{}{
-					"error": err.Error(),
-				},
+	if isCheck(r) {
+		h.checkMounted(w, req.ID, true)
+		return
+	}
+
+	if isDryRun(r) {
+		plan, err := h.manager.PlanMount(req.ID)
+		if err != nil {
+			writeJSON(w, netDiskErrorStatus(err), Response{
+				Success: false,
+				Error:   "failed to plan mount: " + err.Error(),
 			})
+			return
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
-			Success: false,
-			Error:   "failed to mount share: " + err.Error(),
+		writePlan(w, plan)
+		return
+	}
+
+	if req.Async && h.jobs != nil {
+		user, sourceIP, impersonator := getUser(r), r.RemoteAddr, audit.Impersonator(r.Context())
+		job := h.jobs.Submit("netdisk.mount", req.ID, func(ctx context.Context) error {
+			ctx = audit.WithImpersonator(ctx, impersonator)
+			err := h.manager.Mount(ctx, req.ID)
+			h.logResult(ctx, user, sourceIP, "netdisk.mount", req.ID, err)
+			return err
+		})
+		writeJSON(w, http.StatusAccepted, Response{
+			Success: true,
+			Data:    job,
 		})
 		return
 	}
 
-	if h.audit != nil {
-		h.audit.Log(r.Context(), &audit.Entry{
-			Timestamp: time.Now(),
-			User:      getUser(r),
-			Action:    "netdisk.mount",
-			Resource:  req.ID,
-			Result:    "success",
-			SourceIP:  r.RemoteAddr,
+	err := h.manager.Mount(r.Context(), req.ID)
+	h.logResult(r.Context(), getUser(r), r.RemoteAddr, "netdisk.mount", req.ID, err)
+	if err != nil {
+		writeJSON(w, netDiskErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to mount share: " + err.Error(),
 		})
+		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{
@@ -267,7 +387,8 @@ func (h *NetDiskHandlers) UnmountShare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		ID string `json:"id"`
+		ID    string `json:"id"`
+		Async bool   `json:"async"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, http.StatusBadRequest, Response{
@@ -277,36 +398,34 @@ func (h *NetDiskHandlers) UnmountShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.Unmount(req.ID); err != nil {
-		if h.audit != nil {
-			h.audit.Log(r.Context(), &audit.Entry{
-				Timestamp: time.Now(),
-				User:      getUser(r),
-				Action:    "netdisk.unmount",
-				Resource:  req.ID,
-				Result:    "error",
-				SourceIP:  r.RemoteAddr,
-				Details: map[string]interface{}{
-					"error": err.Error(),
-				},
-			})
-		}
-		writeJSON(w, http.StatusInternalServerError, Response{
-			Success: false,
-			Error:   "failed to unmount share: " + err.Error(),
+	if isCheck(r) {
+		h.checkMounted(w, req.ID, false)
+		return
+	}
+
+	if req.Async && h.jobs != nil {
+		user, sourceIP, impersonator := getUser(r), r.RemoteAddr, audit.Impersonator(r.Context())
+		job := h.jobs.Submit("netdisk.unmount", req.ID, func(ctx context.Context) error {
+			ctx = audit.WithImpersonator(ctx, impersonator)
+			err := h.manager.Unmount(ctx, req.ID)
+			h.logResult(ctx, user, sourceIP, "netdisk.unmount", req.ID, err)
+			return err
+		})
+		writeJSON(w, http.StatusAccepted, Response{
+			Success: true,
+			Data:    job,
 		})
 		return
 	}
 
-	if h.audit != nil {
-		h.audit.Log(r.Context(), &audit.Entry{
-			Timestamp: time.Now(),
-			User:      getUser(r),
-			Action:    "netdisk.unmount",
-			Resource:  req.ID,
-			Result:    "success",
-			SourceIP:  r.RemoteAddr,
+	err := h.manager.Unmount(r.Context(), req.ID)
+	h.logResult(r.Context(), getUser(r), r.RemoteAddr, "netdisk.unmount", req.ID, err)
+	if err != nil {
+		writeJSON(w, netDiskErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to unmount share: " + err.Error(),
 		})
+		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{
@@ -348,3 +467,106 @@ func (h *NetDiskHandlers) GetShareStatus(w http.ResponseWriter, r *http.Request)
 		Data:    status,
 	})
 }
+
+// ProbeShare handles GET /api/v1/netdisk/probe. It logs in to the server
+// without mounting the share and says whether the host, the credentials,
+// the share or its directory is the problem.
+func (h *NetDiskHandlers) ProbeShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "share id is required",
+		})
+		return
+	}
+
+	result, err := h.manager.Probe(r.Context(), id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "share not found: " + err.Error(),
+		})
+		return
+	}
+	h.logResult(r.Context(), getUser(r), r.RemoteAddr, "netdisk.probe", id, result.Err())
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    result,
+	})
+}
+
+// checkMounted reports whether mounting or unmounting a share would change
+// it, with the mount commands when it would be mounted
+func (h *NetDiskHandlers) checkMounted(w http.ResponseWriter, id string, mounted bool) {
+	share, err := h.manager.GetShareStatus(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "share not found: " + err.Error(),
+		})
+		return
+	}
+	if share.Mounted == mounted {
+		writeCheck(w, CheckResult{})
+		return
+	}
+
+	result := CheckResult{Changed: true}
+	if mounted {
+		if result.Plan, err = h.manager.PlanMount(id); err != nil {
+			writeJSON(w, netDiskErrorStatus(err), Response{
+				Success: false,
+				Error:   "failed to plan mount: " + err.Error(),
+			})
+			return
+		}
+	}
+	writeCheck(w, result)
+}
+
+// logResult records the outcome of an operation on a share
+func (h *NetDiskHandlers) logResult(ctx context.Context, user, sourceIP, action, id string, err error) {
+	if h.audit == nil {
+		return
+	}
+
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    action,
+		Resource:  id,
+		Result:    "success",
+		SourceIP:  sourceIP,
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Details = map[string]interface{}{
+			"error": err.Error(),
+		}
+	}
+	h.audit.Log(ctx, entry)
+}
+
+// netDiskErrorStatus maps network disk errors to HTTP status codes
+func netDiskErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, netdisk.ErrBusy), errors.Is(err, netdisk.ErrNotPendingDelete):
+		return http.StatusConflict
+	case errors.Is(err, netdisk.ErrHostUnreachable):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, netdisk.ErrAuthFailed), errors.Is(err, netdisk.ErrShareNotFound),
+		errors.Is(err, netdisk.ErrAccessDenied):
+		return http.StatusBadGateway
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
@@ -29,6 +32,8 @@ func (h *NetManagerHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/network/config", h.SetIPConfig)
 	mux.HandleFunc("/api/v1/network/rollback", h.RollbackConfig)
 	mux.HandleFunc("/api/v1/network/history", h.ListConfigHistory)
+	mux.HandleFunc("/api/v1/network/history/diff", h.DiffConfigHistory)
+	mux.HandleFunc("/api/v1/network/history/export", h.ExportConfigHistory)
 	mux.HandleFunc("/api/v1/network/enable", h.EnableInterface)
 	mux.HandleFunc("/api/v1/network/disable", h.DisableInterface)
 	mux.HandleFunc("/api/v1/network/ports", h.ListListeningPorts)
@@ -45,7 +50,13 @@ func (h *NetManagerHandlers) ListInterfaces(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	interfaces, err := h.manager.ListInterfaces()
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := cacheContext(r)
+	interfaces, err := h.manager.ListInterfaces(ctx)
 	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
@@ -59,7 +70,7 @@ func (h *NetManagerHandlers) ListInterfaces(w http.ResponseWriter, r *http.Reque
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to list interfaces: " + err.Error(),
 		})
@@ -79,10 +90,8 @@ func (h *NetManagerHandlers) ListInterfaces(w http.ResponseWriter, r *http.Reque
 		})
 	}
 
-	writeJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    interfaces,
-	})
+	setCacheHeaders(w, ctx)
+	writePage(w, interfaces, page)
 }
 
 // GetInterface handles GET /api/v1/network/interfaces/{name}
@@ -104,7 +113,7 @@ func (h *NetManagerHandlers) GetInterface(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	iface, err := h.manager.GetInterface(name)
+	iface, err := h.manager.GetInterface(r.Context(), name)
 	if err != nil {
 		writeJSON(w, http.StatusNotFound, Response{
 			Success: false,
@@ -142,8 +151,18 @@ func (h *NetManagerHandlers) SetIPConfig(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if isDryRun(r) {
+		plan, err := h.manager.PlanIPConfig(r.Context(), &req.Config)
+		if err != nil {
+			writeIPConfigError(w, err)
+			return
+		}
+		writePlan(w, plan)
+		return
+	}
+
 	user := getUser(r)
-	if err := h.manager.SetIPConfig(&req.Config, user, req.Reason); err != nil {
+	if err := h.manager.SetIPConfig(r.Context(), &req.Config, user, req.Reason); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -158,10 +177,7 @@ func (h *NetManagerHandlers) SetIPConfig(w http.ResponseWriter, r *http.Request)
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
-			Success: false,
-			Error:   "failed to set IP config: " + err.Error(),
-		})
+		writeIPConfigError(w, err)
 		return
 	}
 
@@ -210,7 +226,7 @@ func (h *NetManagerHandlers) RollbackConfig(w http.ResponseWriter, r *http.Reque
 	}
 
 	user := getUser(r)
-	if err := h.manager.RollbackConfig(req.HistoryID, user); err != nil {
+	if err := h.manager.RollbackConfig(r.Context(), req.HistoryID, user); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -224,7 +240,7 @@ func (h *NetManagerHandlers) RollbackConfig(w http.ResponseWriter, r *http.Reque
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to rollback config: " + err.Error(),
 		})
@@ -258,8 +274,23 @@ func (h *NetManagerHandlers) ListConfigHistory(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	iface := r.URL.Query().Get("interface")
-	history := h.manager.ListConfigHistory(iface)
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	history, err := h.manager.ListConfigHistory(r.Context(), filter)
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
+			Success: false,
+			Error:   "failed to list history: " + err.Error(),
+		})
+		return
+	}
 
 	writeJSON(w, http.StatusOK, Response{
 		Success: true,
@@ -267,6 +298,137 @@ func (h *NetManagerHandlers) ListConfigHistory(w http.ResponseWriter, r *http.Re
 	})
 }
 
+// DiffConfigHistory handles GET /api/v1/network/history/diff?from=&to=
+func (h *NetManagerHandlers) DiffConfigHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "from and to history ids are required",
+		})
+		return
+	}
+
+	diff, err := h.manager.DiffConfigHistory(r.Context(), from, to)
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusNotFound), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    diff,
+	})
+}
+
+// ExportConfigHistory handles GET /api/v1/network/history/export?format=csv|json
+func (h *NetManagerHandlers) ExportConfigHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = netmanager.ExportJSON
+	}
+	contentType := "application/json"
+	switch format {
+	case netmanager.ExportJSON:
+	case netmanager.ExportCSV:
+		contentType = "text/csv"
+	default:
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "format must be json or csv",
+		})
+		return
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Query first so errors can still be reported as JSON
+	history, err := h.manager.ListConfigHistory(r.Context(), filter)
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
+			Success: false,
+			Error:   "failed to export history: " + err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "network.export_history",
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"format": format,
+				"count":  len(history),
+			},
+		})
+	}
+
+	filename := fmt.Sprintf("network-history-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.WriteHeader(http.StatusOK)
+	netmanager.WriteConfigHistory(w, format, history)
+}
+
+// parseHistoryFilter reads interface, since, until and limit query parameters
+func parseHistoryFilter(r *http.Request) (*netmanager.HistoryFilter, error) {
+	query := r.URL.Query()
+	filter := &netmanager.HistoryFilter{
+		Interface: query.Get("interface"),
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		filter.Limit = limit
+	}
+
+	for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: expected RFC3339 timestamp", param)
+		}
+		*target = parsed
+	}
+
+	return filter, nil
+}
+
 // EnableInterface handles POST /api/v1/network/enable
 func (h *NetManagerHandlers) EnableInterface(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -289,7 +451,7 @@ func (h *NetManagerHandlers) EnableInterface(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if err := h.manager.EnableInterface(req.Interface); err != nil {
+	if err := h.manager.EnableInterface(r.Context(), req.Interface); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -303,7 +465,7 @@ func (h *NetManagerHandlers) EnableInterface(w http.ResponseWriter, r *http.Requ
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to enable interface: " + err.Error(),
 		})
@@ -349,7 +511,7 @@ func (h *NetManagerHandlers) DisableInterface(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if err := h.manager.DisableInterface(req.Interface); err != nil {
+	if err := h.manager.DisableInterface(r.Context(), req.Interface); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -363,7 +525,7 @@ func (h *NetManagerHandlers) DisableInterface(w http.ResponseWriter, r *http.Req
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to disable interface: " + err.Error(),
 		})
@@ -397,19 +559,21 @@ func (h *NetManagerHandlers) ListListeningPorts(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	ports, err := h.manager.ListListeningPorts()
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	ports, err := h.manager.ListListeningPorts(r.Context())
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to list ports: " + err.Error(),
 		})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    ports,
-	})
+	writePage(w, ports, page)
 }
 
 // GetTrafficStats handles GET /api/v1/network/traffic
@@ -422,9 +586,9 @@ func (h *NetManagerHandlers) GetTrafficStats(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	stats, err := h.manager.GetTrafficStats()
+	stats, err := h.manager.GetTrafficStats(r.Context())
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to get traffic stats: " + err.Error(),
 		})
@@ -436,3 +600,25 @@ func (h *NetManagerHandlers) GetTrafficStats(w http.ResponseWriter, r *http.Requ
 		Data:    stats,
 	})
 }
+
+// writeIPConfigError reports a rejected or failed IP configuration, with the
+// offending field for validation errors
+func writeIPConfigError(w http.ResponseWriter, err error) {
+	var validationErr *netmanager.ValidationError
+	if errors.As(err, &validationErr) {
+		details := map[string]interface{}{"field": validationErr.Field}
+		for key, value := range validationErr.Details {
+			details[key] = value
+		}
+		status := http.StatusUnprocessableEntity
+		if validationErr.Code == netmanager.AddressConflict {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, Response{Success: false, Error: validationErr.Message, Code: validationErr.Code, Details: details})
+		return
+	}
+	writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
+		Success: false,
+		Error:   "failed to set IP config: " + err.Error(),
+	})
+}
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/alerts"
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/maintenance"
+	"github.com/KOPElan/mingyue-agent/internal/monitor"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/sharemanager"
+)
+
+// Overview sections, also accepted by the sections query parameter
+const (
+	OverviewStatus = "status"
+	OverviewStats  = "stats"
+	OverviewShares = "shares"
+	OverviewDisks  = "disks"
+	OverviewAlerts = "alerts"
+	OverviewTasks  = "tasks"
+)
+
+var overviewSections = []string{OverviewStatus, OverviewStats, OverviewShares, OverviewDisks, OverviewAlerts, OverviewTasks}
+
+// overviewScopes is the scope each section needs beyond monitor:read, which
+// the route itself requires. They match the scopes of the routes and query
+// resources serving the same data.
+var overviewScopes = map[string]string{
+	OverviewShares: auth.ScopeSharesRead,
+	OverviewDisks:  auth.ScopeDiskRead,
+	OverviewTasks:  auth.ScopeSchedulerRead,
+}
+
+// overviewTimeout bounds each section so one slow source, like a hung
+// lsblk, does not hold up the whole dashboard
+const overviewTimeout = 10 * time.Second
+
+// OverviewConfig lists the sources of the overview. Nil sources belong to
+// disabled features; their sections are reported as unavailable.
+type OverviewConfig struct {
+	Monitor     *monitor.Monitor
+	Disks       *diskmanager.Manager
+	Shares      *sharemanager.Manager
+	Alerts      *alerts.Manager
+	Scheduler   *scheduler.Scheduler
+	Jobs        *jobs.Manager
+	Maintenance *maintenance.Mode
+}
+
+// OverviewHandlers serves everything the dashboard shows on load in one
+// request
+type OverviewHandlers struct {
+	cfg OverviewConfig
+}
+
+// Overview is the dashboard bootstrap. Sections that failed or were not
+// requested are null; failures are listed in Errors by section.
+type Overview struct {
+	Status *AgentStatus          `json:"status,omitempty"`
+	Stats  *monitor.SystemStats  `json:"stats,omitempty"`
+	Shares []*sharemanager.Share `json:"shares"`
+	Disks  *DiskSummary          `json:"disks,omitempty"`
+	Alerts []*alerts.Alert       `json:"alerts"`
+	Tasks  *RunningTasks         `json:"tasks,omitempty"`
+	Errors map[string]string     `json:"errors,omitempty"`
+}
+
+// AgentStatus is what /api/v1/status reports, plus maintenance mode
+type AgentStatus struct {
+	Hostname    string              `json:"hostname"`
+	Uptime      float64             `json:"uptime"`
+	Status      string              `json:"status"`
+	Maintenance *maintenance.Status `json:"maintenance,omitempty"`
+}
+
+// DiskSummary totals the mounted partitions
+type DiskSummary struct {
+	Disks       int     `json:"disks"`
+	Partitions  int     `json:"partitions"`
+	Mounted     int     `json:"mounted"`
+	Total       uint64  `json:"total"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+
+	// Fullest is the mounted partition with the highest usage
+	Fullest *diskmanager.Partition `json:"fullest,omitempty"`
+}
+
+// RunningTasks lists the background jobs and scheduled tasks in progress
+type RunningTasks struct {
+	Jobs      []*jobs.Job       `json:"jobs"`
+	Scheduled []*scheduler.Task `json:"scheduled"`
+}
+
+// NewOverviewHandlers creates a new overview handlers instance
+func NewOverviewHandlers(cfg OverviewConfig) *OverviewHandlers {
+	return &OverviewHandlers{cfg: cfg}
+}
+
+func (h *OverviewHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/overview", h.GetOverview)
+}
+
+// overviewResult is the outcome of loading one section
+type overviewResult struct {
+	section string
+	apply   func(*Overview)
+	err     error
+}
+
+// GetOverview godoc
+// @Summary Get dashboard overview
+// @Description Returns agent status, system stats, shares, a disk summary, open alerts and running tasks in one response. Sections are loaded concurrently; a section that fails or times out is left out and its error listed in errors, so the response is still successful. Shares, disks and tasks also need shares:read, disk:read and scheduler:read; sections the token lacks the scope for are listed in errors.
+// @Tags monitoring
+// @Produce json
+// @Param sections query string false "Comma-separated sections to include: status, stats, shares, disks, alerts, tasks (default all)"
+// @Success 200 {object} Response{data=Overview}
+// @Failure 400 {object} Response
+// @Failure 405 {object} Response
+// @Router /overview [get]
+// @Security UserAuth
+func (h *OverviewHandlers) GetOverview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	sections := overviewSections
+	if raw := r.URL.Query().Get("sections"); raw != "" {
+		sections = nil
+		for _, section := range strings.Split(raw, ",") {
+			section = strings.TrimSpace(section)
+			if !slices.Contains(overviewSections, section) {
+				writeJSON(w, http.StatusBadRequest, Response{
+					Success: false,
+					Error:   fmt.Sprintf("unknown section %q", section),
+				})
+				return
+			}
+			if !slices.Contains(sections, section) {
+				sections = append(sections, section)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(cacheContext(r), overviewTimeout)
+	defer cancel()
+
+	overview := &Overview{}
+	token := requestToken(r)
+	var pending []string
+	for _, section := range sections {
+		// Sessions and tokens created without scopes have full access
+		if scope, ok := overviewScopes[section]; ok && token != nil && len(token.Scopes) > 0 && !auth.Grants(token.Scopes, scope) {
+			overview.addError(section, fmt.Errorf("token lacks the required scope %s", scope))
+			continue
+		}
+		pending = append(pending, section)
+	}
+
+	// Buffered so sections finishing after the timeout do not block
+	results := make(chan overviewResult, len(pending))
+	for _, section := range pending {
+		go func() {
+			apply, err := h.load(ctx, section)
+			results <- overviewResult{section: section, apply: apply, err: err}
+		}()
+	}
+
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			pending = slices.DeleteFunc(pending, func(s string) bool { return s == result.section })
+			if result.err != nil {
+				overview.addError(result.section, result.err)
+				continue
+			}
+			result.apply(overview)
+		case <-ctx.Done():
+			for _, section := range pending {
+				overview.addError(section, ctx.Err())
+			}
+			pending = nil
+		}
+	}
+
+	setCacheHeaders(w, ctx)
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: overview})
+}
+
+func (o *Overview) addError(section string, err error) {
+	if o.Errors == nil {
+		o.Errors = make(map[string]string)
+	}
+	o.Errors[section] = err.Error()
+}
+
+// load reads one section and returns how to add it to the overview. It
+// runs concurrently with the other sections, so it must not touch the
+// overview itself.
+func (h *OverviewHandlers) load(ctx context.Context, section string) (func(*Overview), error) {
+	switch section {
+	case OverviewStatus:
+		status := agentStatus()
+		if h.cfg.Maintenance != nil {
+			mode := h.cfg.Maintenance.Status()
+			status.Maintenance = &mode
+		}
+		return func(o *Overview) { o.Status = status }, nil
+
+	case OverviewStats:
+		if h.cfg.Monitor == nil {
+			return nil, errUnavailable
+		}
+		stats, err := h.cfg.Monitor.GetStats()
+		if err != nil {
+			return nil, err
+		}
+		return func(o *Overview) { o.Stats = stats }, nil
+
+	case OverviewShares:
+		if h.cfg.Shares == nil {
+			return nil, errUnavailable
+		}
+		shares := h.cfg.Shares.ListShares()
+		return func(o *Overview) { o.Shares = shares }, nil
+
+	case OverviewDisks:
+		if h.cfg.Disks == nil {
+			return nil, errUnavailable
+		}
+		summary, err := summarizeDisks(ctx, h.cfg.Disks)
+		if err != nil {
+			return nil, err
+		}
+		return func(o *Overview) { o.Disks = summary }, nil
+
+	case OverviewAlerts:
+		if h.cfg.Alerts == nil {
+			return nil, errUnavailable
+		}
+		open := h.cfg.Alerts.List(false)
+		if open == nil {
+			open = []*alerts.Alert{}
+		}
+		return func(o *Overview) { o.Alerts = open }, nil
+
+	case OverviewTasks:
+		tasks := &RunningTasks{Jobs: []*jobs.Job{}, Scheduled: []*scheduler.Task{}}
+		if h.cfg.Jobs != nil {
+			for _, job := range h.cfg.Jobs.List() {
+				if job.State == jobs.StateRunning {
+					tasks.Jobs = append(tasks.Jobs, job)
+				}
+			}
+		}
+		if h.cfg.Scheduler != nil {
+			for _, task := range h.cfg.Scheduler.ListTasks() {
+				if task.Status == "running" {
+					tasks.Scheduled = append(tasks.Scheduled, task)
+				}
+			}
+		}
+		return func(o *Overview) { o.Tasks = tasks }, nil
+	}
+	return nil, fmt.Errorf("unknown section %q", section)
+}
+
+// errUnavailable marks sections whose feature is disabled
+var errUnavailable = errors.New("not enabled")
+
+func summarizeDisks(ctx context.Context, disks *diskmanager.Manager) (*DiskSummary, error) {
+	devices, err := disks.ListDisks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list disks: %w", err)
+	}
+	partitions, err := disks.ListPartitions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list partitions: %w", err)
+	}
+
+	summary := &DiskSummary{Disks: len(devices), Partitions: len(partitions)}
+	for i := range partitions {
+		p := &partitions[i]
+		if p.MountPoint == "" {
+			continue
+		}
+		summary.Mounted++
+		summary.Total += p.Size
+		summary.Used += p.Used
+		if summary.Fullest == nil || p.UsedPct > summary.Fullest.UsedPct {
+			fullest := *p
+			summary.Fullest = &fullest
+		}
+	}
+	if summary.Total > 0 {
+		summary.UsedPercent = float64(summary.Used) / float64(summary.Total) * 100
+	}
+	return summary, nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Page sizes for list endpoints that take limit and page_token
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// page is the part of a list a client asked for
+type page struct {
+	offset int
+	limit  int
+	fields []string // Top-level JSON fields to keep in each item, nil for all
+}
+
+// parsePage reads the limit, page_token and fields query parameters. limit
+// defaults to defaultPageSize and is capped at maxPageSize.
+func parsePage(r *http.Request) (page, error) {
+	p := page{limit: defaultPageSize}
+	query := r.URL.Query()
+
+	for _, field := range strings.Split(query.Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			p.fields = append(p.fields, field)
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return p, errors.New("invalid limit")
+		}
+		p.limit = min(limit, maxPageSize)
+	}
+
+	if token := query.Get("page_token"); token != "" {
+		offset, err := decodePageToken(token)
+		if err != nil {
+			return p, errors.New("invalid page_token")
+		}
+		p.offset = offset
+	}
+	return p, nil
+}
+
+// readPage parses the page parameters and answers 400 when they are invalid
+func readPage(w http.ResponseWriter, r *http.Request) (page, bool) {
+	p, err := parsePage(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    "invalid_page",
+		})
+		return p, false
+	}
+	return p, true
+}
+
+// paginate cuts the requested page out of items and returns the token for
+// the next one, or "" on the last page
+func paginate[T any](items []T, p page) ([]T, string) {
+	if p.offset >= len(items) {
+		return []T{}, ""
+	}
+	end := p.offset + p.limit
+	if end >= len(items) {
+		return items[p.offset:], ""
+	}
+	return items[p.offset:end], encodePageToken(end)
+}
+
+// writePage answers with one page of items, trimmed to the requested fields
+func writePage[T any](w http.ResponseWriter, items []T, p page) {
+	data, next := paginate(items, p)
+	writePageData(w, data, next, p)
+}
+
+// writePageData answers with a page that was already cut out of the list,
+// for endpoints that page on the server side
+func writePageData[T any](w http.ResponseWriter, data []T, next string, p page) {
+	if p.fields == nil {
+		writeJSON(w, http.StatusOK, Response{
+			Success:       true,
+			Data:          data,
+			NextPageToken: next,
+		})
+		return
+	}
+
+	sparse, err := selectFields(data, p.fields)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "failed to select fields: " + err.Error(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{
+		Success:       true,
+		Data:          sparse,
+		NextPageToken: next,
+	})
+}
+
+// selectFields drops every top-level JSON field of each item that is not in
+// fields. Unknown field names are ignored.
+func selectFields[T any](items []T, fields []string) ([]map[string]json.RawMessage, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		keep[field] = true
+	}
+	for _, object := range objects {
+		for key := range object {
+			if !keep[key] {
+				delete(object, key)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// Page tokens are opaque to clients; they carry the offset of the next page
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+func decodePageToken(token string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < 3 || string(data[:2]) != "o:" {
+		return 0, errors.New("malformed page token")
+	}
+	offset, err := strconv.Atoi(string(data[2:]))
+	if err != nil || offset < 0 {
+		return 0, errors.New("malformed page token")
+	}
+	return offset, nil
+}
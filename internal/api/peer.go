@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/user"
+	"slices"
+	"strconv"
+)
+
+// LocalPeer is the local user at the other end of a Unix socket connection
+type LocalPeer struct {
+	UID     int // -1 if unknown
+	Name    string
+	Trusted bool // Served without credentials
+}
+
+// LocalTrust names the local users trusted on the Unix socket without
+// credentials. Other peers authenticate as they would over TCP.
+type LocalTrust struct {
+	UIDs []int
+	GID  int // Members of this group are trusted too; -1 for none
+}
+
+// peerContextKey carries the LocalPeer of a request over the Unix socket
+type peerContextKey struct{}
+
+// ConnContext marks the requests of a Unix socket connection as local,
+// identifying the connecting user where the system tells. Set it as the
+// ConnContext of the socket's server.
+func (t *LocalTrust) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	peer := &LocalPeer{UID: -1}
+	if uid, gid, err := peerCred(c); err == nil {
+		peer.UID = uid
+		peer.Name = strconv.Itoa(uid)
+		u, err := user.LookupId(peer.Name)
+		if err == nil {
+			peer.Name = u.Username
+		}
+		peer.Trusted = slices.Contains(t.UIDs, uid) || (t.GID >= 0 && (gid == t.GID || memberOf(u, t.GID)))
+	}
+	return context.WithValue(ctx, peerContextKey{}, peer)
+}
+
+// memberOf reports whether u belongs to the group gid
+func memberOf(u *user.User, gid int) bool {
+	if u == nil {
+		return false
+	}
+	groups, err := u.GroupIds()
+	return err == nil && slices.Contains(groups, strconv.Itoa(gid))
+}
+
+// localPeer returns the peer of a request over the Unix socket
+func localPeer(r *http.Request) (*LocalPeer, bool) {
+	peer, ok := r.Context().Value(peerContextKey{}).(*LocalPeer)
+	return peer, ok
+}
+
+// trustLocal applies the local trust policy to a request over the Unix
+// socket without credentials from a trusted peer: it is served as the
+// connecting user, or as X-User for root, who may act as anyone on the
+// machine anyway
+func trustLocal(r *http.Request, peer *LocalPeer) {
+	switch {
+	case peer.UID == 0 && r.Header.Get("X-User") != "":
+	case peer.Name != "":
+		r.Header.Set("X-User", peer.Name)
+	default:
+		r.Header.Set("X-User", "local")
+	}
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		r.RemoteAddr = "unix"
+	}
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package api
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred returns the user and group IDs of the process at the other end
+// of a Unix socket connection
+func peerCred(c net.Conn) (uid, gid int, err error) {
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return -1, -1, errors.New("not a Unix socket connection")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, -1, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return -1, -1, err
+	}
+	if credErr != nil {
+		return -1, -1, credErr
+	}
+	return int(cred.Uid), int(cred.Gid), nil
+}
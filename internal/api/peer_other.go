@@ -0,0 +1,14 @@
+//go:build !linux
+
+package api
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCred is only implemented on Linux; elsewhere socket peers are
+// unknown and not trusted
+func peerCred(c net.Conn) (uid, gid int, err error) {
+	return -1, -1, errors.New("peer credentials are not supported")
+}
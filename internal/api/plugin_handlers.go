@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/plugins"
+)
+
+// PluginHandlers provides HTTP handlers for plugin status and plugin routes
+type PluginHandlers struct {
+	manager *plugins.Manager
+	audit   *audit.Logger
+}
+
+// NewPluginHandlers creates a new plugin handlers instance
+func NewPluginHandlers(manager *plugins.Manager, auditLogger *audit.Logger) *PluginHandlers {
+	return &PluginHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+func (h *PluginHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/plugins", h.ListPlugins)
+	mux.HandleFunc(plugins.RoutePrefix, h.Route)
+}
+
+// ListPlugins handles GET /api/v1/plugins
+func (h *PluginHandlers) ListPlugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	writePage(w, h.manager.List(), page)
+}
+
+// Route handles /api/v1/plugins/<name>/... by forwarding the request to the plugin
+func (h *PluginHandlers) Route(w http.ResponseWriter, r *http.Request) {
+	status, err := h.manager.Handle(w, r, getUser(r))
+	if err != nil {
+		writeJSON(w, status, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+}
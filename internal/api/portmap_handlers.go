@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/portmap"
+)
+
+// PortMapHandlers provides HTTP handlers for router port mappings
+type PortMapHandlers struct {
+	manager *portmap.Manager
+	audit   *audit.Logger
+}
+
+// NewPortMapHandlers creates a new port mapping handlers instance
+func NewPortMapHandlers(manager *portmap.Manager, auditLogger *audit.Logger) *PortMapHandlers {
+	return &PortMapHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+func (h *PortMapHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/network/portmap", h.Status)
+	mux.HandleFunc("/api/v1/network/portmap/add", h.Add)
+	mux.HandleFunc("/api/v1/network/portmap/remove", h.Remove)
+	mux.HandleFunc("/api/v1/network/portmap/refresh", h.Refresh)
+}
+
+// Status godoc
+// @Summary Get port mapping status
+// @Description Discovers the router if needed and reports its external address and the mappings
+// @Tags network
+// @Produce json
+// @Success 200 {object} Response{data=portmap.Status}
+// @Router /network/portmap [get]
+func (h *PortMapHandlers) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.Status(r.Context()),
+	})
+}
+
+// Add godoc
+// @Summary Map a port on the router
+// @Description Requests a port mapping with UPnP IGD or NAT-PMP and keeps renewing it
+// @Tags network
+// @Accept json
+// @Produce json
+// @Param request body portmap.Request true "Mapping"
+// @Success 201 {object} Response{data=portmap.Mapping}
+// @Failure 400 {object} Response
+// @Failure 409 {object} Response
+// @Failure 503 {object} Response
+// @Router /network/portmap/add [post]
+func (h *PortMapHandlers) Add(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req portmap.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	mapping, err := h.manager.Add(r.Context(), &req)
+	details := map[string]interface{}{
+		"protocol":      req.Protocol,
+		"internal_port": req.InternalPort,
+		"external_port": req.ExternalPort,
+	}
+	if mapping != nil {
+		details["mapped_port"] = mapping.MappedPort
+	}
+	h.logPortMap(r, "portmap.add", fmt.Sprintf("%s-%d", req.Protocol, req.InternalPort), err, details)
+	if err != nil {
+		writeJSON(w, portMapErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to map port: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Data:    mapping,
+	})
+}
+
+// Remove godoc
+// @Summary Release a port mapping
+// @Tags network
+// @Produce json
+// @Param id query string true "Mapping ID, like tcp-8443"
+// @Success 200 {object} Response
+// @Failure 404 {object} Response
+// @Router /network/portmap/remove [delete]
+func (h *PortMapHandlers) Remove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "id is required",
+		})
+		return
+	}
+
+	err := h.manager.Remove(r.Context(), id)
+	h.logPortMap(r, "portmap.remove", id, err, nil)
+	if err != nil {
+		writeJSON(w, portMapErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to remove mapping: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+// Refresh godoc
+// @Summary Rediscover the router
+// @Description Forgets the discovered router and requests all mappings again
+// @Tags network
+// @Produce json
+// @Success 200 {object} Response{data=portmap.Status}
+// @Router /network/portmap/refresh [post]
+func (h *PortMapHandlers) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	status := h.manager.Refresh(r.Context())
+	h.logPortMap(r, "portmap.refresh", status.Gateway, nil, map[string]interface{}{
+		"available": status.Available,
+	})
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    status,
+	})
+}
+
+func (h *PortMapHandlers) logPortMap(r *http.Request, action, resource string, err error, details map[string]interface{}) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      getUser(r),
+		Action:    action,
+		Resource:  resource,
+		Result:    "success",
+		SourceIP:  r.RemoteAddr,
+		Details:   details,
+	}
+	if err != nil {
+		entry.Result = "error"
+		if entry.Details == nil {
+			entry.Details = map[string]interface{}{}
+		}
+		entry.Details["error"] = err.Error()
+	}
+	h.audit.Log(r.Context(), entry)
+}
+
+// portMapErrorStatus maps port mapping errors to HTTP status codes
+func portMapErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, portmap.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, portmap.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, portmap.ErrExists), errors.Is(err, portmap.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, portmap.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return errorStatus(err, http.StatusBadGateway)
+}
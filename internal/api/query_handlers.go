@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
+	"github.com/KOPElan/mingyue-agent/internal/netmanager"
+	"github.com/KOPElan/mingyue-agent/internal/query"
+)
+
+// queryPath is the query endpoint. It only reads, so it takes POST during
+// maintenance mode too.
+const queryPath = "/api/v1/query"
+
+// queryTimeout bounds each resource of a query
+const queryTimeout = 10 * time.Second
+
+// QueryConfig lists the sources of the query endpoint: those of the
+// overview plus the network manager. Nil sources leave their resources
+// out.
+type QueryConfig struct {
+	OverviewConfig
+	Network *netmanager.Manager
+}
+
+// queryResource is a resource the query endpoint can return
+type queryResource struct {
+	scope string // Scope a token needs to read it
+
+	// load returns the resource. fields is its selection, nil for all of
+	// it, so loads can skip expensive parts no one asked for.
+	load func(ctx context.Context, fields []query.Field) (interface{}, error)
+}
+
+// QueryHandlers serves several resources in one request, trimmed to the
+// fields the client selects
+type QueryHandlers struct {
+	resources map[string]queryResource
+}
+
+// QueryRequest is the body of a POST query
+type QueryRequest struct {
+	Query string `json:"query"`
+}
+
+// NewQueryHandlers creates a new query handlers instance
+func NewQueryHandlers(cfg QueryConfig) *QueryHandlers {
+	h := &QueryHandlers{resources: make(map[string]queryResource)}
+
+	h.resources["status"] = queryResource{scope: auth.ScopeMonitorRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+		status := agentStatus()
+		if cfg.Maintenance != nil {
+			mode := cfg.Maintenance.Status()
+			status.Maintenance = &mode
+		}
+		return status, nil
+	}}
+	if cfg.Jobs != nil {
+		h.resources["jobs"] = queryResource{scope: auth.ScopeMonitorRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Jobs.List(), nil
+		}}
+	}
+	if cfg.Monitor != nil {
+		h.resources["stats"] = queryResource{scope: auth.ScopeMonitorRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Monitor.GetStats()
+		}}
+	}
+	if cfg.Alerts != nil {
+		h.resources["alerts"] = queryResource{scope: auth.ScopeMonitorRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Alerts.List(false), nil
+		}}
+	}
+	if cfg.Shares != nil {
+		h.resources["shares"] = queryResource{scope: auth.ScopeSharesRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Shares.ListShares(), nil
+		}}
+	}
+	if cfg.Scheduler != nil {
+		h.resources["tasks"] = queryResource{scope: auth.ScopeSchedulerRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Scheduler.ListTasks(), nil
+		}}
+	}
+	if cfg.Disks != nil {
+		h.resources["disks"] = queryResource{scope: auth.ScopeDiskRead, load: func(ctx context.Context, fields []query.Field) (interface{}, error) {
+			return loadQueryDisks(ctx, cfg.Disks, fields)
+		}}
+		h.resources["partitions"] = queryResource{scope: auth.ScopeDiskRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Disks.ListPartitions(ctx)
+		}}
+	}
+	if cfg.Network != nil {
+		h.resources["interfaces"] = queryResource{scope: auth.ScopeNetworkRead, load: func(ctx context.Context, _ []query.Field) (interface{}, error) {
+			return cfg.Network.ListInterfaces(ctx)
+		}}
+	}
+	return h
+}
+
+// loadQueryDisks lists the disks, with SMART data only if it is selected
+// since reading it runs smartctl for every disk
+func loadQueryDisks(ctx context.Context, manager *diskmanager.Manager, fields []query.Field) (interface{}, error) {
+	disks, err := manager.ListDisks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if query.Find(fields, "smart") == nil {
+		return disks, nil
+	}
+	// The listing may be cached and shared; fill in a copy
+	disks = slices.Clone(disks)
+	for i := range disks {
+		if info, err := manager.GetSMARTInfo(ctx, disks[i].Device); err == nil {
+			disks[i].SMART = info
+		}
+	}
+	return disks, nil
+}
+
+func (h *QueryHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc(queryPath, h.Query)
+}
+
+// Query godoc
+// @Summary Query several resources
+// @Description Returns the selected resources, trimmed to the selected fields, e.g. "shares{name,healthy} disks{device,smart{temperature}}". A resource without braces is returned whole. Resources load concurrently; one that fails, times out or needs a scope the token lacks is left out and its error listed under errors.
+// @Tags monitoring
+// @Accept json
+// @Produce json
+// @Param q query string false "Selection, for GET requests"
+// @Param request body QueryRequest false "Selection, for POST requests"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 405 {object} Response
+// @Router /query [get]
+// @Router /query [post]
+// @Security UserAuth
+func (h *QueryHandlers) Query(w http.ResponseWriter, r *http.Request) {
+	var input string
+	switch r.Method {
+	case http.MethodGet:
+		input = r.URL.Query().Get("q")
+	case http.MethodPost:
+		var req QueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid request body",
+			})
+			return
+		}
+		input = req.Query
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	fields, err := query.Parse(input)
+	if err != nil {
+		var syntaxErr *query.SyntaxError
+		details := map[string]interface{}{}
+		if errors.As(err, &syntaxErr) {
+			details["offset"] = syntaxErr.Offset
+		}
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    "invalid_query",
+			Details: details,
+		})
+		return
+	}
+	for _, field := range fields {
+		if _, ok := h.resources[field.Name]; !ok {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   fmt.Sprintf("unknown resource %q", field.Name),
+				Code:    "invalid_query",
+				Details: map[string]interface{}{"resources": h.resourceNames()},
+			})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(cacheContext(r), queryTimeout)
+	defer cancel()
+
+	type result struct {
+		name  string
+		value interface{}
+		err   error
+	}
+	data := make(map[string]interface{}, len(fields)+1)
+	errs := make(map[string]string)
+
+	// Buffered so resources finishing after the timeout do not block
+	results := make(chan result, len(fields))
+	pending := make(map[string]bool, len(fields))
+	token := requestToken(r)
+	for _, field := range fields {
+		resource := h.resources[field.Name]
+		// Sessions and tokens created without scopes have full access
+		if token != nil && len(token.Scopes) > 0 && !auth.Grants(token.Scopes, resource.scope) {
+			errs[field.Name] = "token lacks the required scope " + resource.scope
+			continue
+		}
+		pending[field.Name] = true
+		go func() {
+			value, err := resource.load(ctx, field.Fields)
+			if err == nil {
+				value, err = query.Select(value, field.Fields)
+			}
+			results <- result{name: field.Name, value: value, err: err}
+		}()
+	}
+
+	for len(pending) > 0 {
+		select {
+		case res := <-results:
+			delete(pending, res.name)
+			if res.err != nil {
+				errs[res.name] = res.err.Error()
+				continue
+			}
+			data[res.name] = res.value
+		case <-ctx.Done():
+			for name := range pending {
+				errs[name] = ctx.Err().Error()
+			}
+			pending = nil
+		}
+	}
+	if len(errs) > 0 {
+		data["errors"] = errs
+	}
+
+	setCacheHeaders(w, ctx)
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: data})
+}
+
+func (h *QueryHandlers) resourceNames() []string {
+	names := make([]string, 0, len(h.resources))
+	for name := range h.resources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
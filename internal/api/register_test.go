@@ -25,10 +25,37 @@ func TestAuthHandlersRegister(t *testing.T) {
 
 	assertMuxPatterns(t, mux, []string{
 		"/api/v1/auth/tokens/create",
+		"/api/v1/auth/tokens/bulk",
 		"/api/v1/auth/tokens",
 		"/api/v1/auth/tokens/revoke",
+		"/api/v1/auth/sessions",
 		"/api/v1/auth/sessions/create",
+		"/api/v1/auth/sessions/refresh",
 		"/api/v1/auth/sessions/revoke",
+		"/api/v1/auth/sessions/revoke-others",
+		"/api/v1/auth/bans",
+		"/api/v1/auth/bans/add",
+		"/api/v1/auth/bans/remove",
+	})
+}
+
+func TestAdvisorHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &AdvisorHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/security/advisor",
+	})
+}
+
+func TestAuditHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &AuditHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/audit/query",
 	})
 }
 
@@ -54,6 +81,11 @@ func TestIndexerHandlersRegister(t *testing.T) {
 	assertMuxPatterns(t, mux, []string{
 		"/api/v1/indexer/scan",
 		"/api/v1/indexer/search",
+		"/api/v1/indexer/duplicates",
+		"/api/v1/indexer/dedupe",
+		"/api/v1/indexer/enrich",
+		"/api/v1/indexer/tags",
+		"/api/v1/indexer/changes",
 		"/api/v1/thumbnail/generate",
 		"/api/v1/thumbnail/cleanup",
 	})
@@ -68,9 +100,13 @@ func TestNetDiskHandlersRegister(t *testing.T) {
 		"/api/v1/netdisk/shares",
 		"/api/v1/netdisk/shares/add",
 		"/api/v1/netdisk/shares/remove",
+		"/api/v1/netdisk/shares/remove/confirm",
+		"/api/v1/netdisk/shares/restore",
+		"/api/v1/netdisk/shares/import",
 		"/api/v1/netdisk/mount",
 		"/api/v1/netdisk/unmount",
 		"/api/v1/netdisk/status",
+		"/api/v1/netdisk/probe",
 	})
 }
 
@@ -85,6 +121,8 @@ func TestNetManagerHandlersRegister(t *testing.T) {
 		"/api/v1/network/config",
 		"/api/v1/network/rollback",
 		"/api/v1/network/history",
+		"/api/v1/network/history/diff",
+		"/api/v1/network/history/export",
 		"/api/v1/network/enable",
 		"/api/v1/network/disable",
 		"/api/v1/network/ports",
@@ -104,7 +142,11 @@ func TestSchedulerHandlersRegister(t *testing.T) {
 		"/api/v1/scheduler/tasks/update",
 		"/api/v1/scheduler/tasks/delete",
 		"/api/v1/scheduler/tasks/execute",
+		"/api/v1/scheduler/tasks/hook",
+		"/api/v1/hooks/",
 		"/api/v1/scheduler/history",
+		"/api/v1/scheduler/sync",
+		"/api/v1/scheduler/sync/run",
 	})
 }
 
@@ -119,8 +161,241 @@ func TestShareHandlersRegister(t *testing.T) {
 		"/api/v1/shares/add",
 		"/api/v1/shares/update",
 		"/api/v1/shares/remove",
+		"/api/v1/shares/remove/confirm",
+		"/api/v1/shares/restore",
 		"/api/v1/shares/enable",
 		"/api/v1/shares/disable",
 		"/api/v1/shares/rollback",
+		"/api/v1/shares/import",
+		"/api/v1/shares/stats",
+		"/api/v1/shares/unused",
+		"/api/v1/shares/dlna",
+		"/api/v1/shares/dlna/set",
+	})
+}
+
+func TestPortMapHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &PortMapHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/network/portmap",
+		"/api/v1/network/portmap/add",
+		"/api/v1/network/portmap/remove",
+		"/api/v1/network/portmap/refresh",
+	})
+}
+
+func TestTelemetryHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	NewTelemetryHandlers().Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/monitor/endpoints",
+		"/api/v1/monitor/traces/slow",
+	})
+}
+
+func TestWANHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &WANHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/network/wan",
+		"/api/v1/network/wan/history",
+		"/api/v1/network/wan/probe",
+		"/api/v1/network/wan/speedtest",
+	})
+}
+
+func TestRsyncHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &RsyncHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/rsync/modules",
+		"/api/v1/rsync/modules/add",
+		"/api/v1/rsync/modules/update",
+		"/api/v1/rsync/modules/remove",
+		"/api/v1/rsync/users",
+		"/api/v1/rsync/users/set",
+		"/api/v1/rsync/users/remove",
+		"/api/v1/rsync/status",
+		"/api/v1/rsync/start",
+		"/api/v1/rsync/stop",
+	})
+}
+
+func TestWebhookHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &WebhookHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/webhooks",
+		"/api/v1/webhooks/add",
+		"/api/v1/webhooks/remove",
+		"/api/v1/webhooks/test",
+	})
+}
+
+func TestRuleHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &RuleHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/rules",
+		"/api/v1/rules/get",
+		"/api/v1/rules/add",
+		"/api/v1/rules/update",
+		"/api/v1/rules/delete",
+	})
+}
+
+func TestConfigHistoryHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &ConfigHistoryHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/config/history",
+		"/api/v1/config/history/diff",
+		"/api/v1/config/history/revert",
+	})
+}
+
+func TestBundleHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &BundleHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/config/bundle",
+		"/api/v1/config/bundle/diff",
+		"/api/v1/config/bundle/apply",
+	})
+}
+
+func TestEventHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &EventHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/events/sse",
+	})
+}
+
+func TestClusterHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &ClusterHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/cluster/agents",
+		"/api/v1/cluster/agents/refresh",
+		"/api/v1/cluster/proxy/",
+	})
+}
+
+func TestPluginHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &PluginHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/plugins",
+		"/api/v1/plugins/",
+	})
+}
+
+func TestJobHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &JobHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/jobs",
+		"/api/v1/jobs/status",
+	})
+}
+
+func TestMaintenanceHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &MaintenanceHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/maintenance",
+	})
+}
+
+func TestCrashHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &CrashHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/crashes",
+		"/api/v1/crashes/get",
+		"/api/v1/crashes/delete",
+	})
+}
+
+func TestAlertHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &AlertHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/alerts",
+		"/api/v1/alerts/ack",
+		"/api/v1/alerts/silence",
+	})
+}
+
+func TestReportHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &ReportHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/reports",
+		"/api/v1/reports/generate",
+	})
+}
+
+func TestOverviewHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &OverviewHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/overview",
+	})
+}
+
+func TestWOPIHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &WOPIHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/api/v1/files/wopi/token",
+		"/wopi/files/",
+	})
+}
+
+func TestWebDAVHandlersRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	handler := &WebDAVHandlers{}
+	handler.Register(mux)
+
+	assertMuxPatterns(t, mux, []string{
+		"/webdav/",
 	})
 }
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/reports"
+)
+
+// ReportHandlers provides HTTP handlers for generated reports
+type ReportHandlers struct {
+	generator *reports.Generator
+	audit     *audit.Logger
+	jobs      *jobs.Manager
+}
+
+// NewReportHandlers creates a new report handlers instance
+func NewReportHandlers(generator *reports.Generator, auditLogger *audit.Logger) *ReportHandlers {
+	return &ReportHandlers{
+		generator: generator,
+		audit:     auditLogger,
+	}
+}
+
+// SetJobs enables asynchronous report generation
+func (h *ReportHandlers) SetJobs(manager *jobs.Manager) {
+	h.jobs = manager
+}
+
+func (h *ReportHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/reports", h.ListReports)
+	mux.HandleFunc("/api/v1/reports/generate", h.GenerateReport)
+}
+
+// ListReports godoc
+// @Summary List reports
+// @Description Lists stored reports, newest first; the files API serves their HTML and JSON files
+// @Tags reports
+// @Produce json
+// @Param limit query int false "Page size"
+// @Param page_token query string false "Token of the page to return"
+// @Success 200 {object} Response{data=[]reports.Info}
+// @Router /reports [get]
+func (h *ReportHandlers) ListReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	infos, err := h.generator.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "failed to list reports: " + err.Error(),
+		})
+		return
+	}
+	writePage(w, infos, page)
+}
+
+// GenerateReportRequest generates a report covering the last PeriodHours
+// hours, 24 by default
+type GenerateReportRequest struct {
+	PeriodHours float64 `json:"period_hours"`
+	Async       bool    `json:"async"`
+}
+
+// GenerateReport godoc
+// @Summary Generate a report
+// @Description Generates a report now instead of waiting for a scheduled report task
+// @Tags reports
+// @Accept json
+// @Produce json
+// @Param request body GenerateReportRequest false "Period covered"
+// @Success 200 {object} Response{data=reports.Info}
+// @Success 202 {object} Response{data=jobs.Job}
+// @Failure 400 {object} Response
+// @Router /reports/generate [post]
+func (h *ReportHandlers) GenerateReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req GenerateReportRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid request body: " + err.Error(),
+			})
+			return
+		}
+	}
+	if req.PeriodHours < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "period_hours must not be negative",
+		})
+		return
+	}
+	if req.PeriodHours == 0 {
+		req.PeriodHours = 24
+	}
+	period := time.Duration(req.PeriodHours * float64(time.Hour))
+
+	if req.Async && h.jobs != nil {
+		user, sourceIP, impersonator := getUser(r), r.RemoteAddr, audit.Impersonator(r.Context())
+		job := h.jobs.Submit("report.generate", h.generator.Dir(), func(ctx context.Context) error {
+			ctx = audit.WithImpersonator(ctx, impersonator)
+			info, err := h.generator.Generate(ctx, period)
+			h.logGenerate(ctx, user, sourceIP, info, err)
+			return err
+		})
+		writeJSON(w, http.StatusAccepted, Response{
+			Success: true,
+			Data:    job,
+		})
+		return
+	}
+
+	info, err := h.generator.Generate(r.Context(), period)
+	h.logGenerate(r.Context(), getUser(r), r.RemoteAddr, info, err)
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
+			Success: false,
+			Error:   "failed to generate report: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    info,
+	})
+}
+
+func (h *ReportHandlers) logGenerate(ctx context.Context, user, sourceIP string, info *reports.Info, err error) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    "report.generate",
+		Resource:  h.generator.Dir(),
+		Result:    "success",
+		SourceIP:  sourceIP,
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Details = map[string]interface{}{"error": err.Error()}
+	} else {
+		entry.Resource = info.HTMLPath
+		entry.Details = map[string]interface{}{"id": info.ID, "summary": info.Summary}
+	}
+	h.audit.Log(ctx, entry)
+}
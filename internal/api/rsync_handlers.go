@@ -0,0 +1,422 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/rsyncd"
+)
+
+// RsyncHandlers provides HTTP handlers for rsync daemon management
+type RsyncHandlers struct {
+	manager *rsyncd.Manager
+	audit   *audit.Logger
+}
+
+// NewRsyncHandlers creates a new rsync handlers instance
+func NewRsyncHandlers(manager *rsyncd.Manager, auditLogger *audit.Logger) *RsyncHandlers {
+	return &RsyncHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+func (h *RsyncHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/rsync/modules", h.ListModules)
+	mux.HandleFunc("/api/v1/rsync/modules/add", h.AddModule)
+	mux.HandleFunc("/api/v1/rsync/modules/update", h.UpdateModule)
+	mux.HandleFunc("/api/v1/rsync/modules/remove", h.RemoveModule)
+	mux.HandleFunc("/api/v1/rsync/users", h.ListUsers)
+	mux.HandleFunc("/api/v1/rsync/users/set", h.SetUser)
+	mux.HandleFunc("/api/v1/rsync/users/remove", h.RemoveUser)
+	mux.HandleFunc("/api/v1/rsync/status", h.Status)
+	mux.HandleFunc("/api/v1/rsync/start", h.Start)
+	mux.HandleFunc("/api/v1/rsync/stop", h.Stop)
+}
+
+// ListModules godoc
+// @Summary List rsync modules
+// @Tags rsync
+// @Produce json
+// @Param limit query int false "Page size"
+// @Param page_token query string false "Token of the page to return"
+// @Success 200 {object} Response{data=[]rsyncd.Module}
+// @Router /rsync/modules [get]
+func (h *RsyncHandlers) ListModules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+	writePage(w, h.manager.ListModules(), page)
+}
+
+// AddModule godoc
+// @Summary Add an rsync module
+// @Description Exports a directory as an rsync daemon module
+// @Tags rsync
+// @Accept json
+// @Produce json
+// @Param request body rsyncd.Module true "Module"
+// @Success 201 {object} Response{data=rsyncd.Module}
+// @Failure 400 {object} Response
+// @Failure 409 {object} Response
+// @Router /rsync/modules/add [post]
+func (h *RsyncHandlers) AddModule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var module rsyncd.Module
+	if err := json.NewDecoder(r.Body).Decode(&module); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	err := h.manager.AddModule(r.Context(), &module)
+	h.logRsync(r, "rsync.module.add", module.Name, err, map[string]interface{}{
+		"path":      module.Path,
+		"read_only": module.ReadOnly,
+	})
+	if err != nil {
+		writeJSON(w, rsyncErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to add module: " + err.Error(),
+		})
+		return
+	}
+
+	created, _ := h.manager.GetModule(module.Name)
+	writeJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Data:    created,
+	})
+}
+
+// UpdateModule godoc
+// @Summary Update an rsync module
+// @Description Replaces the settings of a module; its name can't change
+// @Tags rsync
+// @Accept json
+// @Produce json
+// @Param name query string true "Module name"
+// @Param request body rsyncd.Module true "Module"
+// @Success 200 {object} Response{data=rsyncd.Module}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /rsync/modules/update [put]
+func (h *RsyncHandlers) UpdateModule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "name is required",
+		})
+		return
+	}
+
+	var updates rsyncd.Module
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	module, err := h.manager.UpdateModule(r.Context(), name, &updates)
+	h.logRsync(r, "rsync.module.update", name, err, map[string]interface{}{
+		"path":      updates.Path,
+		"read_only": updates.ReadOnly,
+	})
+	if err != nil {
+		writeJSON(w, rsyncErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to update module: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    module,
+	})
+}
+
+// RemoveModule godoc
+// @Summary Remove an rsync module
+// @Tags rsync
+// @Produce json
+// @Param name query string true "Module name"
+// @Success 200 {object} Response
+// @Failure 404 {object} Response
+// @Router /rsync/modules/remove [delete]
+func (h *RsyncHandlers) RemoveModule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "name is required",
+		})
+		return
+	}
+
+	err := h.manager.RemoveModule(r.Context(), name)
+	h.logRsync(r, "rsync.module.remove", name, err, nil)
+	if err != nil {
+		writeJSON(w, rsyncErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to remove module: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+// ListUsers godoc
+// @Summary List rsync users
+// @Description Lists the names of users in the rsync secrets file
+// @Tags rsync
+// @Produce json
+// @Success 200 {object} Response{data=[]string}
+// @Router /rsync/users [get]
+func (h *RsyncHandlers) ListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.ListUsers(),
+	})
+}
+
+// SetRsyncUserRequest creates an rsync user or changes its password
+type SetRsyncUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// SetUser godoc
+// @Summary Create an rsync user or change its password
+// @Tags rsync
+// @Accept json
+// @Produce json
+// @Param request body SetRsyncUserRequest true "User"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Router /rsync/users/set [post]
+func (h *RsyncHandlers) SetUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req SetRsyncUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	err := h.manager.SetUser(req.Name, req.Password)
+	h.logRsync(r, "rsync.user.set", req.Name, err, nil)
+	if err != nil {
+		writeJSON(w, rsyncErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to set user: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+// RemoveUser godoc
+// @Summary Remove an rsync user
+// @Description Removes a user no module allows any more
+// @Tags rsync
+// @Produce json
+// @Param name query string true "User name"
+// @Success 200 {object} Response
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Router /rsync/users/remove [delete]
+func (h *RsyncHandlers) RemoveUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "name is required",
+		})
+		return
+	}
+
+	err := h.manager.RemoveUser(name)
+	h.logRsync(r, "rsync.user.remove", name, err, nil)
+	if err != nil {
+		writeJSON(w, rsyncErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to remove user: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+// Status godoc
+// @Summary Get rsync daemon status
+// @Tags rsync
+// @Produce json
+// @Success 200 {object} Response{data=rsyncd.Status}
+// @Router /rsync/status [get]
+func (h *RsyncHandlers) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.Status(r.Context()),
+	})
+}
+
+// Start godoc
+// @Summary Start the rsync daemon
+// @Tags rsync
+// @Produce json
+// @Success 200 {object} Response{data=rsyncd.Status}
+// @Failure 500 {object} Response
+// @Router /rsync/start [post]
+func (h *RsyncHandlers) Start(w http.ResponseWriter, r *http.Request) {
+	h.control(w, r, "rsync.start", h.manager.Start)
+}
+
+// Stop godoc
+// @Summary Stop the rsync daemon
+// @Tags rsync
+// @Produce json
+// @Success 200 {object} Response{data=rsyncd.Status}
+// @Failure 500 {object} Response
+// @Router /rsync/stop [post]
+func (h *RsyncHandlers) Stop(w http.ResponseWriter, r *http.Request) {
+	h.control(w, r, "rsync.stop", h.manager.Stop)
+}
+
+func (h *RsyncHandlers) control(w http.ResponseWriter, r *http.Request, action string, run func(ctx context.Context) error) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	err := run(r.Context())
+	h.logRsync(r, action, "rsync", err, nil)
+	if err != nil {
+		writeJSON(w, rsyncErrorStatus(err), Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.Status(r.Context()),
+	})
+}
+
+func (h *RsyncHandlers) logRsync(r *http.Request, action, resource string, err error, details map[string]interface{}) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      getUser(r),
+		Action:    action,
+		Resource:  resource,
+		Result:    "success",
+		SourceIP:  r.RemoteAddr,
+		Details:   details,
+	}
+	if err != nil {
+		entry.Result = "error"
+		if entry.Details == nil {
+			entry.Details = map[string]interface{}{}
+		}
+		entry.Details["error"] = err.Error()
+	}
+	h.audit.Log(r.Context(), entry)
+}
+
+// rsyncErrorStatus maps rsync errors to HTTP status codes
+func rsyncErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, rsyncd.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, rsyncd.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, rsyncd.ErrExists), errors.Is(err, rsyncd.ErrInUse):
+		return http.StatusConflict
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/rules"
+)
+
+// RuleHandlers provides HTTP handlers for file-event automation rules
+type RuleHandlers struct {
+	manager *rules.Manager
+	audit   *audit.Logger
+}
+
+// NewRuleHandlers creates a new rule handlers instance
+func NewRuleHandlers(manager *rules.Manager, auditLogger *audit.Logger) *RuleHandlers {
+	return &RuleHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+// Register registers rule routes
+func (h *RuleHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/rules", h.ListRules)
+	mux.HandleFunc("/api/v1/rules/get", h.GetRule)
+	mux.HandleFunc("/api/v1/rules/add", h.AddRule)
+	mux.HandleFunc("/api/v1/rules/update", h.UpdateRule)
+	mux.HandleFunc("/api/v1/rules/delete", h.DeleteRule)
+}
+
+// ListRules godoc
+// @Summary List automation rules
+// @Description Returns all file-event automation rules
+// @Tags rules
+// @Produce json
+// @Success 200 {object} Response{data=[]rules.Rule}
+// @Router /rules [get]
+func (h *RuleHandlers) ListRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	writePage(w, h.manager.ListRules(), page)
+}
+
+// GetRule godoc
+// @Summary Get an automation rule
+// @Description Returns a rule with its trigger counts
+// @Tags rules
+// @Produce json
+// @Param id query string true "Rule ID"
+// @Success 200 {object} Response{data=rules.Rule}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /rules/get [get]
+func (h *RuleHandlers) GetRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "rule ID required"})
+		return
+	}
+
+	rule, err := h.manager.GetRule(id)
+	if err != nil {
+		writeJSON(w, ruleErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: rule})
+}
+
+// AddRule godoc
+// @Summary Add an automation rule
+// @Description Creates a rule running scheduler task handlers when matching files change
+// @Tags rules
+// @Accept json
+// @Produce json
+// @Param body body rules.Rule true "Rule"
+// @Success 200 {object} Response{data=rules.Rule}
+// @Failure 400 {object} Response
+// @Failure 500 {object} Response
+// @Router /rules/add [post]
+// @Security UserAuth
+func (h *RuleHandlers) AddRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var rule rules.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	created, err := h.manager.AddRule(&rule)
+	if err != nil {
+		writeJSON(w, ruleErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	h.logAudit(r, "rule.add", created)
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: created})
+}
+
+// UpdateRule godoc
+// @Summary Update an automation rule
+// @Description Replaces the definition of a rule, keeping its trigger counts
+// @Tags rules
+// @Accept json
+// @Produce json
+// @Param body body rules.Rule true "Rule"
+// @Success 200 {object} Response{data=rules.Rule}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Failure 500 {object} Response
+// @Router /rules/update [put]
+// @Security UserAuth
+func (h *RuleHandlers) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var rule rules.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	updated, err := h.manager.UpdateRule(&rule)
+	if err != nil {
+		writeJSON(w, ruleErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	h.logAudit(r, "rule.update", updated)
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: updated})
+}
+
+// DeleteRule godoc
+// @Summary Delete an automation rule
+// @Tags rules
+// @Produce json
+// @Param id query string true "Rule ID"
+// @Success 200 {object} Response
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /rules/delete [delete]
+// @Security UserAuth
+func (h *RuleHandlers) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "rule ID required"})
+		return
+	}
+
+	if err := h.manager.RemoveRule(id); err != nil {
+		writeJSON(w, ruleErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	h.logAudit(r, "rule.delete", &rules.Rule{ID: id})
+	writeJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *RuleHandlers) logAudit(r *http.Request, action string, rule *rules.Rule) {
+	if h.audit == nil {
+		return
+	}
+
+	entry := &audit.Entry{
+		User:     getUser(r),
+		Action:   action,
+		Resource: rule.ID,
+		Result:   "success",
+		SourceIP: r.RemoteAddr,
+	}
+	if rule.Name != "" {
+		entry.Details = map[string]interface{}{"name": rule.Name, "path": rule.Path, "pattern": rule.Pattern}
+	}
+	h.audit.Log(r.Context(), entry)
+}
+
+// ruleErrorStatus maps rule errors to HTTP status codes
+func ruleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, rules.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, rules.ErrInvalidRule):
+		return http.StatusBadRequest
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
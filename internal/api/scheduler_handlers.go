@@ -2,18 +2,44 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/auth"
 	"github.com/KOPElan/mingyue-agent/internal/scheduler"
 )
 
+// hooksPath takes inbound webhooks as /api/v1/hooks/<token>. The token in
+// the path authenticates the request, so callers need no credentials.
+const hooksPath = "/api/v1/hooks/"
+
+// maxHookBody limits the body of an inbound webhook
+const maxHookBody = 64 << 10
+
 type SchedulerHandlers struct {
 	scheduler *scheduler.Scheduler
+	syncer    *scheduler.Syncer
+	auth      *auth.AuthManager
 	audit     *audit.Logger
 }
 
+// TaskHook is a newly created hook token and the path that triggers it
+type TaskHook struct {
+	TaskID string `json:"task_id"`
+	Token  string `json:"token"`
+	Path   string `json:"path"`
+}
+
+// HookRequest is the optional body of an inbound webhook
+type HookRequest struct {
+	Params map[string]interface{} `json:"params"`
+}
+
 func NewSchedulerHandlers(sched *scheduler.Scheduler, auditLogger *audit.Logger) *SchedulerHandlers {
 	return &SchedulerHandlers{
 		scheduler: sched,
@@ -21,14 +47,82 @@ func NewSchedulerHandlers(sched *scheduler.Scheduler, auditLogger *audit.Logger)
 	}
 }
 
+// SetSyncer enables the portal sync endpoints
+func (h *SchedulerHandlers) SetSyncer(syncer *scheduler.Syncer) {
+	h.syncer = syncer
+}
+
+// SetAuth counts unknown hook tokens towards the automatic ban threshold
+// of the auth manager, like other failed authentications
+func (h *SchedulerHandlers) SetAuth(authMgr *auth.AuthManager) {
+	h.auth = authMgr
+}
+
 func (h *SchedulerHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/scheduler/tasks", h.ListTasks)
 	mux.HandleFunc("/api/v1/scheduler/tasks/get", h.GetTask)
+	mux.HandleFunc("/api/v1/scheduler/tasks/preview", h.PreviewTask)
 	mux.HandleFunc("/api/v1/scheduler/tasks/add", h.AddTask)
 	mux.HandleFunc("/api/v1/scheduler/tasks/update", h.UpdateTask)
 	mux.HandleFunc("/api/v1/scheduler/tasks/delete", h.DeleteTask)
 	mux.HandleFunc("/api/v1/scheduler/tasks/execute", h.ExecuteTask)
+	mux.HandleFunc("/api/v1/scheduler/tasks/hook", h.TaskHook)
+	mux.HandleFunc(hooksPath, h.TriggerHook)
 	mux.HandleFunc("/api/v1/scheduler/history", h.GetExecutionHistory)
+	mux.HandleFunc("/api/v1/scheduler/sync", h.GetSyncStatus)
+	mux.HandleFunc("/api/v1/scheduler/sync/run", h.RunSync)
+}
+
+// portalOwned responds with 409 and returns true when taskID is managed by
+// the portal sync, whose next run would undo local changes
+func (h *SchedulerHandlers) portalOwned(w http.ResponseWriter, taskID string) bool {
+	task, err := h.scheduler.GetTask(taskID)
+	if err != nil || task.Source != scheduler.SourcePortal {
+		return false
+	}
+
+	writeJSON(w, http.StatusConflict, Response{Success: false, Error: "task is managed by the portal"})
+	return true
+}
+
+// taskFields are the settings of a task compared by check
+var taskFields = []string{"name", "type", "schedule", "params", "enabled", "hook_params", "blackouts", "ignore_global_blackouts"}
+
+// Previewed runs per request
+const (
+	defaultPreviewRuns = 5
+	maxPreviewRuns     = 50
+)
+
+// TaskPreview lists the next scheduled runs of a task
+type TaskPreview struct {
+	TaskID string      `json:"task_id"`
+	Runs   []time.Time `json:"runs"`
+}
+
+// checkAddTask reports whether adding task would change anything. Adding a
+// task whose id exists with the same settings changes nothing, and adding
+// one whose id exists with other settings fails like the add would.
+func (h *SchedulerHandlers) checkAddTask(w http.ResponseWriter, task *scheduler.Task) {
+	if task.ID == "" {
+		writeCheck(w, CheckResult{Changed: true})
+		return
+	}
+
+	existing, err := h.scheduler.GetTask(task.ID)
+	if err != nil {
+		writeCheck(w, CheckResult{Changed: true})
+		return
+	}
+	if fields := diffFields(existing, task, taskFields...); len(fields) > 0 {
+		writeJSON(w, http.StatusConflict, Response{
+			Success: false,
+			Error:   "task already exists: " + task.ID,
+			Details: map[string]interface{}{"fields": fields},
+		})
+		return
+	}
+	writeCheck(w, CheckResult{})
 }
 
 // ListTasks godoc
@@ -44,8 +138,13 @@ func (h *SchedulerHandlers) ListTasks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
 	tasks := h.scheduler.ListTasks()
-	writeJSON(w, http.StatusOK, Response{Success: true, Data: tasks})
+	writePage(w, tasks, page)
 }
 
 // GetTask godoc
@@ -79,6 +178,51 @@ func (h *SchedulerHandlers) GetTask(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, Response{Success: true, Data: task})
 }
 
+// PreviewTask godoc
+// @Summary Preview the next runs of a task
+// @Description Returns when a task will be started next, moved out of blackout windows
+// @Tags scheduler
+// @Produce json
+// @Param id query string true "Task ID"
+// @Param count query int false "Number of runs (default 5, at most 50)"
+// @Success 200 {object} Response{data=TaskPreview}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /scheduler/tasks/preview [get]
+func (h *SchedulerHandlers) PreviewTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	taskID := r.URL.Query().Get("id")
+	if taskID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "task ID required"})
+		return
+	}
+
+	count := defaultPreviewRuns
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPreviewRuns {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "count must be between 1 and 50"})
+			return
+		}
+		count = n
+	}
+
+	task, err := h.scheduler.GetTask(taskID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: TaskPreview{
+		TaskID: taskID,
+		Runs:   h.scheduler.PreviewRuns(task, count),
+	}})
+}
+
 // AddTask godoc
 // @Summary Add a new task
 // @Description Creates a new scheduled task
@@ -102,9 +246,20 @@ func (h *SchedulerHandlers) AddTask(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
 		return
 	}
+	task.Source = scheduler.SourceLocal
+
+	if err := scheduler.ValidateBlackouts(task.Blackouts); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
 
-	if err := h.scheduler.AddTask(&task); err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	if isCheck(r) {
+		h.checkAddTask(w, &task)
+		return
+	}
+
+	if err := h.scheduler.AddTask(r.Context(), &task); err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -131,6 +286,7 @@ func (h *SchedulerHandlers) AddTask(w http.ResponseWriter, r *http.Request) {
 // @Param body body scheduler.Task true "Task configuration"
 // @Success 200 {object} Response{data=scheduler.Task}
 // @Failure 400 {object} Response
+// @Failure 409 {object} Response
 // @Failure 500 {object} Response
 // @Router /scheduler/tasks/update [put]
 // @Security UserAuth
@@ -146,8 +302,39 @@ func (h *SchedulerHandlers) UpdateTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.scheduler.UpdateTask(&task); err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	if h.portalOwned(w, task.ID) {
+		return
+	}
+	task.Source = scheduler.SourceLocal
+
+	if err := scheduler.ValidateBlackouts(task.Blackouts); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if isCheck(r) {
+		existing, err := h.scheduler.GetTask(task.ID)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+			return
+		}
+		if task.Version != 0 && task.Version != existing.Version {
+			writeTaskConflict(w, h.scheduler, task.ID, scheduler.ErrTaskConflict)
+			return
+		}
+		writeCheck(w, CheckResult{Fields: diffFields(existing, &task, taskFields...)})
+		return
+	}
+
+	if err := h.scheduler.UpdateTask(r.Context(), &task); err != nil {
+		switch {
+		case errors.Is(err, scheduler.ErrTaskNotFound):
+			writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+		case errors.Is(err, scheduler.ErrTaskConflict):
+			writeTaskConflict(w, h.scheduler, task.ID, err)
+		default:
+			writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		}
 		return
 	}
 
@@ -172,6 +359,7 @@ func (h *SchedulerHandlers) UpdateTask(w http.ResponseWriter, r *http.Request) {
 // @Param id query string true "Task ID"
 // @Success 200 {object} Response
 // @Failure 400 {object} Response
+// @Failure 409 {object} Response
 // @Failure 500 {object} Response
 // @Router /scheduler/tasks/delete [delete]
 // @Security UserAuth
@@ -187,8 +375,18 @@ func (h *SchedulerHandlers) DeleteTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.scheduler.DeleteTask(taskID); err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+	if h.portalOwned(w, taskID) {
+		return
+	}
+
+	if isCheck(r) {
+		_, err := h.scheduler.GetTask(taskID)
+		writeCheck(w, CheckResult{Changed: err == nil})
+		return
+	}
+
+	if err := h.scheduler.DeleteTask(r.Context(), taskID); err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -230,7 +428,7 @@ func (h *SchedulerHandlers) ExecuteTask(w http.ResponseWriter, r *http.Request)
 
 	execution, err := h.scheduler.ExecuteTask(r.Context(), taskID)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
@@ -247,6 +445,137 @@ func (h *SchedulerHandlers) ExecuteTask(w http.ResponseWriter, r *http.Request)
 	writeJSON(w, http.StatusOK, Response{Success: true, Data: execution})
 }
 
+// TaskHook godoc
+// @Summary Create or revoke a task hook
+// @Description POST gives the task a new hook token, replacing any earlier one; the token is only shown in this response. DELETE revokes it.
+// @Tags scheduler
+// @Produce json
+// @Param id query string true "Task ID"
+// @Success 200 {object} Response{data=TaskHook}
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Router /scheduler/tasks/hook [post]
+// @Router /scheduler/tasks/hook [delete]
+// @Security UserAuth
+func (h *SchedulerHandlers) TaskHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	taskID := r.URL.Query().Get("id")
+	if taskID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "task ID required"})
+		return
+	}
+	if _, err := h.scheduler.GetTask(taskID); err != nil {
+		writeJSON(w, http.StatusNotFound, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	action := "create_task_hook"
+	var data interface{}
+	var err error
+	if r.Method == http.MethodPost {
+		var token string
+		if token, err = h.scheduler.CreateHook(r.Context(), taskID); err == nil {
+			data = TaskHook{TaskID: taskID, Token: token, Path: hooksPath + token}
+		}
+	} else {
+		action = "delete_task_hook"
+		err = h.scheduler.DeleteHook(r.Context(), taskID)
+	}
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			User:     getUser(r),
+			Action:   action,
+			Resource: taskID,
+			Result:   "success",
+			SourceIP: r.RemoteAddr,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: data})
+}
+
+// TriggerHook godoc
+// @Summary Trigger a task through its hook
+// @Description Starts the task whose hook token is in the path and returns at once. The optional body sets params the task lists in hook_params. No other credentials are needed; unknown tokens count as failed authentications.
+// @Tags scheduler
+// @Accept json
+// @Produce json
+// @Param token path string true "Hook token"
+// @Param request body HookRequest false "Params to override"
+// @Success 202 {object} Response
+// @Failure 400 {object} Response
+// @Failure 404 {object} Response
+// @Failure 409 {object} Response
+// @Router /hooks/{token} [post]
+func (h *SchedulerHandlers) TriggerHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req HookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookBody)).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, hooksPath)
+	taskID, err := h.scheduler.TriggerHook(r.Context(), token, req.Params)
+	if errors.Is(err, scheduler.ErrHookNotFound) && h.auth != nil {
+		h.auth.RecordAuthFailure(clientIP(r))
+	}
+
+	if h.audit != nil {
+		// The token is a credential, so it is left out
+		entry := &audit.Entry{
+			User:     "hook",
+			Action:   "trigger_task",
+			Resource: taskID,
+			Result:   "success",
+			SourceIP: r.RemoteAddr,
+		}
+		if err != nil {
+			entry.Result = "failed"
+			entry.Details = map[string]interface{}{"error": err.Error()}
+		}
+		h.audit.Log(r.Context(), entry)
+	}
+
+	if err != nil {
+		writeJSON(w, hookErrorStatus(err), Response{Success: false, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, Response{Success: true, Data: map[string]string{"task_id": taskID}})
+}
+
+// writeTaskConflict responds to an update of a task that changed since
+// the client read it, with the current task to merge into and retry
+func writeTaskConflict(w http.ResponseWriter, s *scheduler.Scheduler, taskID string, err error) {
+	current, _ := s.GetTask(taskID)
+	writeJSON(w, http.StatusConflict, Response{Success: false, Error: err.Error(), Code: "version_conflict", Details: current})
+}
+
+func hookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, scheduler.ErrHookNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, scheduler.ErrHookParam):
+		return http.StatusBadRequest
+	case errors.Is(err, scheduler.ErrTaskDisabled), errors.Is(err, scheduler.ErrTaskRunning):
+		return http.StatusConflict
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
+
 // GetExecutionHistory godoc
 // @Summary Get task execution history
 // @Description Returns execution history for a task
@@ -275,11 +604,78 @@ func (h *SchedulerHandlers) GetExecutionHistory(w http.ResponseWriter, r *http.R
 		limit = 10
 	}
 
-	history, err := h.scheduler.GetExecutionHistory(taskID, limit)
+	history, err := h.scheduler.GetExecutionHistory(r.Context(), taskID, limit)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, Response{Success: false, Error: err.Error()})
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{Success: false, Error: err.Error()})
 		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{Success: true, Data: history})
 }
+
+// GetSyncStatus godoc
+// @Summary Get portal sync status
+// @Description Returns the state of task definition sync with the portal
+// @Tags scheduler
+// @Produce json
+// @Success 200 {object} Response{data=scheduler.SyncStatus}
+// @Failure 503 {object} Response
+// @Router /scheduler/sync [get]
+func (h *SchedulerHandlers) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	if h.syncer == nil {
+		writeJSON(w, http.StatusServiceUnavailable, Response{Success: false, Error: "portal sync is not configured"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: h.syncer.Status()})
+}
+
+// RunSync godoc
+// @Summary Sync tasks with the portal now
+// @Description Pulls task definitions from the portal and pushes pending execution results
+// @Tags scheduler
+// @Produce json
+// @Success 200 {object} Response{data=scheduler.SyncResult}
+// @Failure 502 {object} Response
+// @Failure 503 {object} Response
+// @Router /scheduler/sync/run [post]
+// @Security UserAuth
+func (h *SchedulerHandlers) RunSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	if h.syncer == nil {
+		writeJSON(w, http.StatusServiceUnavailable, Response{Success: false, Error: "portal sync is not configured"})
+		return
+	}
+
+	result, err := h.syncer.Sync(r.Context())
+
+	if h.audit != nil {
+		status := "success"
+		if err != nil {
+			status = "failed"
+		}
+		h.audit.Log(r.Context(), &audit.Entry{
+			User:     getUser(r),
+			Action:   "sync_tasks",
+			Resource: "scheduler",
+			Result:   status,
+			SourceIP: r.RemoteAddr,
+		})
+	}
+
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, Response{Success: false, Data: result, Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: result})
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+)
+
+// routeScope names the scopes needed to read from and change the routes
+// under prefix
+type routeScope struct {
+	prefix string
+	read   string
+	write  string
+}
+
+// routeScopes maps every API route to its scopes; the longest prefix wins
+var routeScopes = []routeScope{
+	{"/api/v1/files/", auth.ScopeFilesRead, auth.ScopeFilesWrite},
+	{webdavPath, auth.ScopeFilesRead, auth.ScopeFilesWrite},
+	{checksumJobPath, auth.ScopeFilesRead, auth.ScopeFilesRead}, // Only reads the file
+	{"/api/v1/files/transfer-limits", auth.ScopeFilesRead, auth.ScopeSystemAdmin},
+	{"/api/v1/indexer/", auth.ScopeFilesRead, auth.ScopeFilesWrite},
+	{"/api/v1/thumbnail/", auth.ScopeFilesRead, auth.ScopeFilesWrite},
+	{"/api/v1/disk/", auth.ScopeDiskRead, auth.ScopeDiskAdmin},
+	{"/api/v1/network/", auth.ScopeNetworkRead, auth.ScopeNetworkAdmin},
+	{"/api/v1/shares", auth.ScopeSharesRead, auth.ScopeSharesAdmin},
+	{"/api/v1/rsync/", auth.ScopeSharesRead, auth.ScopeSharesAdmin},
+	{"/api/v1/netdisk/", auth.ScopeNetdiskRead, auth.ScopeNetdiskAdmin},
+	{"/api/v1/scheduler/", auth.ScopeSchedulerRead, auth.ScopeSchedulerAdmin},
+	{hooksPath, "", ""}, // Authenticated by the hook token
+	{"/api/v1/rules", auth.ScopeSchedulerRead, auth.ScopeSchedulerAdmin},
+	{"/api/v1/monitor/", auth.ScopeMonitorRead, auth.ScopeMonitorRead},
+	{"/api/v1/status", auth.ScopeMonitorRead, auth.ScopeMonitorRead},
+	{"/api/v1/overview", auth.ScopeMonitorRead, auth.ScopeMonitorRead},
+	{queryPath, "", ""}, // Checked for each resource queried
+	{"/api/v1/capabilities", auth.ScopeMonitorRead, auth.ScopeMonitorRead},
+	{"/api/v1/events/", auth.ScopeMonitorRead, auth.ScopeMonitorRead},
+	{"/api/v1/jobs", auth.ScopeMonitorRead, auth.ScopeMonitorRead},
+	{"/api/v1/alerts", auth.ScopeMonitorRead, auth.ScopeMonitorWrite},
+	{"/api/v1/reports", auth.ScopeMonitorRead, auth.ScopeMonitorWrite},
+	{"/api/v1/audit/", auth.ScopeAuditRead, auth.ScopeAuditRead},
+	{"/api/v1/auth/", auth.ScopeAuthAdmin, auth.ScopeAuthAdmin},
+	{"/api/v1/webhooks", auth.ScopeWebhooksRead, auth.ScopeWebhooksAdmin},
+	{"/api/v1/plugins", auth.ScopePluginsRead, auth.ScopePluginsAdmin},
+	{"/api/v1/cluster/", auth.ScopeClusterRead, auth.ScopeClusterAdmin},
+	{maintenancePath, auth.ScopeSystemRead, auth.ScopeSystemAdmin},
+	{"/api/v1/config/", auth.ScopeSystemRead, auth.ScopeSystemAdmin},
+	{"/api/v1/crashes", auth.ScopeSystemRead, auth.ScopeSystemAdmin},
+	{"/api/v1/register", auth.ScopeSystemAdmin, auth.ScopeSystemAdmin},
+	{"/api/v1/security/", auth.ScopeSystemRead, auth.ScopeSystemRead},
+}
+
+// requiredScope returns the scope a token needs for r. Paths outside the
+// API and WebDAV, like /healthz, need none; API paths missing from
+// routeScopes are reserved for tokens with the "*" scope.
+func requiredScope(r *http.Request) string {
+	if !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, webdavPath) {
+		return ""
+	}
+
+	var match *routeScope
+	for i := range routeScopes {
+		route := &routeScopes[i]
+		if strings.HasPrefix(r.URL.Path, route.prefix) && (match == nil || len(route.prefix) > len(match.prefix)) {
+			match = route
+		}
+	}
+	if match == nil {
+		return auth.ScopeAll
+	}
+
+	if readMethod(r.Method) {
+		return match.read
+	}
+	return match.write
+}
+
+// readMethod reports whether requests with method only read, which
+// includes listing WebDAV folders with PROPFIND
+func readMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
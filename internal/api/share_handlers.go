@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
@@ -29,9 +32,16 @@ func (h *ShareHandlers) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v1/shares/add", h.AddShare)
 	mux.HandleFunc("/api/v1/shares/update", h.UpdateShare)
 	mux.HandleFunc("/api/v1/shares/remove", h.RemoveShare)
+	mux.HandleFunc("/api/v1/shares/remove/confirm", h.ConfirmRemoveShare)
+	mux.HandleFunc("/api/v1/shares/restore", h.RestoreShare)
 	mux.HandleFunc("/api/v1/shares/enable", h.EnableShare)
 	mux.HandleFunc("/api/v1/shares/disable", h.DisableShare)
 	mux.HandleFunc("/api/v1/shares/rollback", h.RollbackConfig)
+	mux.HandleFunc("/api/v1/shares/import", h.ImportShares)
+	mux.HandleFunc("/api/v1/shares/stats", h.GetShareStats)
+	mux.HandleFunc("/api/v1/shares/unused", h.ListUnusedShares)
+	mux.HandleFunc("/api/v1/shares/dlna", h.GetDLNAStatus)
+	mux.HandleFunc("/api/v1/shares/dlna/set", h.SetDLNA)
 }
 
 // ListShares handles GET /api/v1/shares
@@ -44,6 +54,11 @@ func (h *ShareHandlers) ListShares(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
 	shares := h.manager.ListShares()
 
 	if h.audit != nil {
@@ -59,10 +74,7 @@ func (h *ShareHandlers) ListShares(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	writeJSON(w, http.StatusOK, Response{
-		Success: true,
-		Data:    shares,
-	})
+	writePage(w, shares, page)
 }
 
 // GetShare handles GET /api/v1/shares/{id}
@@ -118,7 +130,25 @@ func (h *ShareHandlers) AddShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.AddShare(&share); err != nil {
+	if isCheck(r) {
+		h.checkAddShare(w, &share)
+		return
+	}
+
+	if isDryRun(r) {
+		plan, err := h.manager.PlanAddShare(&share)
+		if err != nil {
+			writeJSON(w, errorStatus(err, http.StatusBadRequest), Response{
+				Success: false,
+				Error:   "invalid share: " + err.Error(),
+			})
+			return
+		}
+		writePlan(w, plan)
+		return
+	}
+
+	if err := h.manager.AddShare(r.Context(), &share); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -134,7 +164,7 @@ func (h *ShareHandlers) AddShare(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to add share: " + err.Error(),
 		})
@@ -192,7 +222,25 @@ func (h *ShareHandlers) UpdateShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.UpdateShare(id, &updates); err != nil {
+	if isCheck(r) {
+		h.checkUpdateShare(w, id, &updates)
+		return
+	}
+
+	if isDryRun(r) {
+		plan, err := h.manager.PlanUpdateShare(id, &updates)
+		if err != nil {
+			writeJSON(w, errorStatus(err, http.StatusBadRequest), Response{
+				Success: false,
+				Error:   "invalid share update: " + err.Error(),
+			})
+			return
+		}
+		writePlan(w, plan)
+		return
+	}
+
+	if err := h.manager.UpdateShare(r.Context(), id, &updates); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -206,7 +254,7 @@ func (h *ShareHandlers) UpdateShare(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to update share: " + err.Error(),
 		})
@@ -249,7 +297,15 @@ func (h *ShareHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.RemoveShare(id); err != nil {
+	if isCheck(r) {
+		// Removing a share that is gone or pending deletion changes nothing
+		share, err := h.manager.GetShare(id)
+		writeCheck(w, CheckResult{Changed: err == nil && share.DeleteAt == nil})
+		return
+	}
+
+	share, err := h.manager.RemoveShare(r.Context(), id)
+	if err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -263,7 +319,7 @@ func (h *ShareHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to remove share: " + err.Error(),
 		})
@@ -278,12 +334,79 @@ func (h *ShareHandlers) RemoveShare(w http.ResponseWriter, r *http.Request) {
 			Resource:  id,
 			Result:    "success",
 			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"delete_at": share.DeleteAt,
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusAccepted, Response{
+		Success: true,
+		Data:    share,
+	})
+}
+
+// ConfirmRemoveShare handles POST /api/v1/shares/remove/confirm
+func (h *ShareHandlers) ConfirmRemoveShare(w http.ResponseWriter, r *http.Request) {
+	h.pendingDelete(w, r, "share.remove_confirm", "share removed", h.manager.ConfirmRemoveShare)
+}
+
+// RestoreShare handles POST /api/v1/shares/restore
+func (h *ShareHandlers) RestoreShare(w http.ResponseWriter, r *http.Request) {
+	h.pendingDelete(w, r, "share.restore", "share restored", h.manager.RestoreShare)
+}
+
+// pendingDelete confirms or cancels the deletion of a share
+func (h *ShareHandlers) pendingDelete(w http.ResponseWriter, r *http.Request, action, message string, fn func(ctx context.Context, id string) error) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "share id is required",
+		})
+		return
+	}
+
+	err := fn(r.Context(), id)
+	if h.audit != nil {
+		entry := &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    action,
+			Resource:  id,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+		}
+		if err != nil {
+			entry.Result = "error"
+			entry.Details = map[string]interface{}{"error": err.Error()}
+		}
+		h.audit.Log(r.Context(), entry)
+	}
+
+	if err != nil {
+		status := errorStatus(err, http.StatusInternalServerError)
+		if errors.Is(err, sharemanager.ErrNotPendingDelete) {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, Response{
+			Success: false,
+			Error:   err.Error(),
 		})
+		return
 	}
 
 	writeJSON(w, http.StatusOK, Response{
 		Success: true,
-		Data:    map[string]interface{}{"message": "share removed"},
+		Data:    map[string]interface{}{"message": message},
 	})
 }
 
@@ -306,7 +429,12 @@ func (h *ShareHandlers) EnableShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.EnableShare(id); err != nil {
+	if isCheck(r) {
+		h.checkShareEnabled(w, id, true)
+		return
+	}
+
+	if err := h.manager.EnableShare(r.Context(), id); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -320,7 +448,7 @@ func (h *ShareHandlers) EnableShare(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to enable share: " + err.Error(),
 		})
@@ -363,7 +491,12 @@ func (h *ShareHandlers) DisableShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.manager.DisableShare(id); err != nil {
+	if isCheck(r) {
+		h.checkShareEnabled(w, id, false)
+		return
+	}
+
+	if err := h.manager.DisableShare(r.Context(), id); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -377,7 +510,7 @@ func (h *ShareHandlers) DisableShare(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to disable share: " + err.Error(),
 		})
@@ -401,6 +534,61 @@ func (h *ShareHandlers) DisableShare(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ImportShares handles POST /api/v1/shares/import
+func (h *ShareHandlers) ImportShares(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	report, err := h.manager.ImportShares(r.Context())
+	if err != nil {
+		if h.audit != nil {
+			h.audit.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      getUser(r),
+				Action:    "share.import",
+				Result:    "error",
+				SourceIP:  r.RemoteAddr,
+				Details: map[string]interface{}{
+					"error": err.Error(),
+				},
+			})
+		}
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
+			Success: false,
+			Error:   "failed to import shares: " + err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		ids := make([]string, 0, len(report.Imported))
+		for _, share := range report.Imported {
+			ids = append(ids, share.ID)
+		}
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "share.import",
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"share_ids": ids,
+				"skipped":   len(report.Skipped),
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+	})
+}
+
 // RollbackConfig handles POST /api/v1/shares/rollback
 func (h *ShareHandlers) RollbackConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -424,7 +612,7 @@ func (h *ShareHandlers) RollbackConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	timestamp := time.Unix(req.Timestamp, 0)
-	if err := h.manager.RollbackConfig(timestamp); err != nil {
+	if err := h.manager.RollbackConfig(r.Context(), timestamp); err != nil {
 		if h.audit != nil {
 			h.audit.Log(r.Context(), &audit.Entry{
 				Timestamp: time.Now(),
@@ -438,7 +626,7 @@ func (h *ShareHandlers) RollbackConfig(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		writeJSON(w, http.StatusInternalServerError, Response{
+		writeJSON(w, errorStatus(err, http.StatusInternalServerError), Response{
 			Success: false,
 			Error:   "failed to rollback config: " + err.Error(),
 		})
@@ -463,3 +651,259 @@ func (h *ShareHandlers) RollbackConfig(w http.ResponseWriter, r *http.Request) {
 		Data:    map[string]interface{}{"message": "config rolled back"},
 	})
 }
+
+// GetShareStats handles GET /api/v1/shares/stats
+func (h *ShareHandlers) GetShareStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	hours := 24 * 7
+	if hoursStr := r.URL.Query().Get("hours"); hoursStr != "" {
+		parsed, err := strconv.Atoi(hoursStr)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid hours",
+			})
+			return
+		}
+		hours = parsed
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusOK, Response{
+			Success: true,
+			Data:    h.manager.ListShareStats(since),
+		})
+		return
+	}
+
+	stats, err := h.manager.GetShareStats(id, since)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    stats,
+	})
+}
+
+// ListUnusedShares handles GET /api/v1/shares/unused
+func (h *ShareHandlers) ListUnusedShares(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	days := 30
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		parsed, err := strconv.Atoi(daysStr)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid days",
+			})
+			return
+		}
+		days = parsed
+	}
+
+	writePage(w, h.manager.ListUnusedShares(time.Duration(days)*24*time.Hour), page)
+}
+
+// DLNARequest publishes a share to the media server
+type DLNARequest struct {
+	ID      string `json:"id"`
+	Enabled bool   `json:"enabled"`
+	Media   string `json:"media"`
+}
+
+// GetDLNAStatus handles GET /api/v1/shares/dlna
+func (h *ShareHandlers) GetDLNAStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.DLNAStatus(r.Context()),
+	})
+}
+
+// SetDLNA handles POST /api/v1/shares/dlna/set
+func (h *ShareHandlers) SetDLNA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req DLNARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.ID == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "share id is required",
+		})
+		return
+	}
+
+	if err := h.manager.SetDLNA(r.Context(), req.ID, req.Enabled, req.Media); err != nil {
+		if h.audit != nil {
+			h.audit.Log(r.Context(), &audit.Entry{
+				Timestamp: time.Now(),
+				User:      getUser(r),
+				Action:    "share.dlna",
+				Resource:  req.ID,
+				Result:    "error",
+				SourceIP:  r.RemoteAddr,
+				Details: map[string]interface{}{
+					"error":   err.Error(),
+					"enabled": req.Enabled,
+				},
+			})
+		}
+		writeJSON(w, dlnaErrorStatus(err), Response{
+			Success: false,
+			Error:   "failed to update dlna: " + err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "share.dlna",
+			Resource:  req.ID,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"enabled": req.Enabled,
+				"media":   req.Media,
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.DLNAStatus(r.Context()),
+	})
+}
+
+// shareUpdateFields are the settings of a share that UpdateShare changes
+var shareUpdateFields = []string{"name", "path", "description", "users", "groups", "access_mode", "options"}
+
+// checkAddShare reports whether adding share would change anything. A share
+// is always added unless its id is given and a share with that id and the
+// same settings exists.
+func (h *ShareHandlers) checkAddShare(w http.ResponseWriter, share *sharemanager.Share) {
+	plan, err := h.manager.PlanAddShare(share)
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusBadRequest), Response{
+			Success: false,
+			Error:   "invalid share: " + err.Error(),
+		})
+		return
+	}
+
+	if share.ID != "" {
+		if existing, err := h.manager.GetShare(share.ID); err == nil {
+			fields := diffFields(existing, share, append([]string{"type", "dlna", "dlna_media"}, shareUpdateFields...)...)
+			if !existing.Enabled || existing.DeleteAt != nil {
+				fields = append(fields, "enabled")
+			}
+			if len(fields) == 0 {
+				plan = nil
+			}
+			writeCheck(w, CheckResult{Fields: fields, Plan: plan})
+			return
+		}
+	}
+	writeCheck(w, CheckResult{Changed: true, Plan: plan})
+}
+
+// checkUpdateShare reports which of the settings set in updates differ from
+// those of the share
+func (h *ShareHandlers) checkUpdateShare(w http.ResponseWriter, id string, updates *sharemanager.Share) {
+	existing, err := h.manager.GetShare(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "share not found: " + err.Error(),
+		})
+		return
+	}
+
+	fields := diffFields(existing, updates, setFields(updates, shareUpdateFields...)...)
+	if len(fields) == 0 {
+		writeCheck(w, CheckResult{})
+		return
+	}
+
+	plan, err := h.manager.PlanUpdateShare(id, updates)
+	if err != nil {
+		writeJSON(w, errorStatus(err, http.StatusBadRequest), Response{
+			Success: false,
+			Error:   "invalid share update: " + err.Error(),
+		})
+		return
+	}
+	writeCheck(w, CheckResult{Fields: fields, Plan: plan})
+}
+
+// checkShareEnabled reports whether enabling or disabling a share would
+// change it
+func (h *ShareHandlers) checkShareEnabled(w http.ResponseWriter, id string, enabled bool) {
+	share, err := h.manager.GetShare(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   "share not found: " + err.Error(),
+		})
+		return
+	}
+	writeCheck(w, CheckResult{Changed: share.Enabled != enabled})
+}
+
+func dlnaErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, sharemanager.ErrInvalidDLNA):
+		return http.StatusBadRequest
+	case errors.Is(err, sharemanager.ErrDLNANotConfigured):
+		return http.StatusConflict
+	}
+	return errorStatus(err, http.StatusInternalServerError)
+}
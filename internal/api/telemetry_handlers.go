@@ -0,0 +1,174 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
+)
+
+// Instrument counts every request in the per-endpoint metrics and, with
+// tracing enabled, traces it as a server span that continues the caller's
+// traceparent. Requests are grouped by the mux pattern they match, so
+// unknown paths all count as telemetry.OtherPath. Event streams stay open
+// for as long as the client listens, so they are left out.
+func Instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = telemetry.OtherPath
+		}
+		ctx := telemetry.Extract(r.Context(), r.Header.Get("Traceparent"))
+		ctx, span := telemetry.StartKind(ctx, r.Method+" "+route, telemetry.KindServer)
+		if span != nil {
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("http.route", route)
+			path := r.URL.Path
+			if route == hooksPath {
+				// Hook tokens are credentials
+				path = hooksPath + "{token}"
+			}
+			span.SetAttribute("url.path", path)
+			w.Header().Set("X-Trace-ID", span.TraceID())
+			r = r.WithContext(ctx)
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		telemetry.RecordRequest(r.Method, route, sw.status, time.Since(start))
+		if span != nil {
+			span.SetAttribute("http.response.status_code", sw.status)
+			span.SetAttribute("user", getUser(r))
+			if sw.status >= 500 {
+				span.SetError(statusError(sw.status))
+			}
+			span.End()
+		}
+	})
+}
+
+// statusError marks spans of failed requests
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+// statusWriter remembers the response status
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(data)
+}
+
+// Flush passes flushes on for streamed responses
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// TelemetryHandlers provides HTTP handlers for request metrics and slow
+// request traces
+type TelemetryHandlers struct{}
+
+// NewTelemetryHandlers creates a new telemetry handlers instance
+func NewTelemetryHandlers() *TelemetryHandlers {
+	return &TelemetryHandlers{}
+}
+
+func (h *TelemetryHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/monitor/endpoints", h.Endpoints)
+	mux.HandleFunc("/api/v1/monitor/traces/slow", h.SlowTraces)
+}
+
+// Endpoints godoc
+// @Summary Get per-endpoint request metrics
+// @Description Returns request counts, errors and latency of every endpoint since the agent started, slowest first
+// @Tags monitor
+// @Produce json
+// @Param limit query int false "Page size"
+// @Param page_token query string false "Token of the page to return"
+// @Success 200 {object} Response{data=[]telemetry.EndpointStats}
+// @Router /monitor/endpoints [get]
+func (h *TelemetryHandlers) Endpoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+	writePage(w, telemetry.Endpoints(), page)
+}
+
+// SlowTraces godoc
+// @Summary Get slow request traces
+// @Description Returns the slowest recent requests broken down into the spans of their phases and commands; requires tracing to be enabled
+// @Tags monitor
+// @Produce json
+// @Param trace_id query string false "Return only this trace"
+// @Success 200 {object} Response{data=[]telemetry.Trace}
+// @Failure 404 {object} Response
+// @Router /monitor/traces/slow [get]
+func (h *TelemetryHandlers) SlowTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	if traceID := r.URL.Query().Get("trace_id"); traceID != "" {
+		trace, found := telemetry.SlowTrace(traceID)
+		if !found {
+			writeJSON(w, http.StatusNotFound, Response{
+				Success: false,
+				Error:   "trace not found",
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{
+			Success: true,
+			Data:    trace,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    telemetry.SlowTraces(),
+	})
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/throttle"
+)
+
+// Directions of file transfers
+const (
+	directionDownload = "download"
+	directionUpload   = "upload"
+)
+
+// RateLimits caps downloads and uploads in KiB/s; 0 is unlimited
+type RateLimits struct {
+	DownloadKBps int `json:"download_kbps"`
+	UploadKBps   int `json:"upload_kbps"`
+}
+
+func (l RateLimits) kbps(direction string) int {
+	if direction == directionUpload {
+		return l.UploadKBps
+	}
+	return l.DownloadKBps
+}
+
+// TransferLimits caps the rates of file downloads and uploads. A transfer
+// goes no faster than the lowest of the limits that apply to it.
+type TransferLimits struct {
+	Client   RateLimits `json:"client"`   // Per API token, or per source IP for other requests
+	Transfer RateLimits `json:"transfer"` // Per download or upload
+	Global   RateLimits `json:"global"`   // All transfers together
+}
+
+func (l TransferLimits) validate() error {
+	for _, limits := range []RateLimits{l.Client, l.Transfer, l.Global} {
+		if limits.DownloadKBps < 0 || limits.UploadKBps < 0 {
+			return fmt.Errorf("limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// transferLimiter hands out the buckets limiting each transfer, and keeps
+// the buckets of running transfers so changed limits apply to them
+type transferLimiter struct {
+	clients *throttle.Limiter
+
+	mu      sync.Mutex
+	limits  TransferLimits
+	global  map[string]*throttle.Bucket          // By direction
+	running map[*throttle.Bucket]runningTransfer // Per-transfer buckets
+}
+
+// runningTransfer is what a per-transfer bucket was created for
+type runningTransfer struct {
+	direction string
+	requested int // rate_kbps of the request, 0 if none
+}
+
+func newTransferLimiter() *transferLimiter {
+	return &transferLimiter{
+		clients: throttle.NewLimiter(),
+		global: map[string]*throttle.Bucket{
+			directionDownload: throttle.NewBucket(0),
+			directionUpload:   throttle.NewBucket(0),
+		},
+		running: make(map[*throttle.Bucket]runningTransfer),
+	}
+}
+
+// SetTransferLimits caps download and upload rates. Client limits apply
+// per API token, or per source IP for other requests, and a token's own
+// rate limit takes the place of the client limit.
+func (api *FileAPI) SetTransferLimits(limits TransferLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	api.transfers.set(limits)
+	return nil
+}
+
+func (t *transferLimiter) get() TransferLimits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limits
+}
+
+// set changes the limits. Global and per-transfer limits apply to running
+// transfers at once; client limits to the transfers clients start next.
+func (t *transferLimiter) set(limits TransferLimits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits = limits
+	for direction, bucket := range t.global {
+		bucket.SetRate(int64(limits.Global.kbps(direction)) * 1024)
+	}
+	for bucket, transfer := range t.running {
+		bucket.SetRate(int64(lowest(limits.Transfer.kbps(transfer.direction), transfer.requested)) * 1024)
+	}
+}
+
+// buckets returns the buckets limiting a transfer of r in direction, and
+// a function to call once it is done. The rate_kbps query parameter lowers
+// the limit of the transfer. Transfers with a token share a client bucket
+// per token and use the token's own limit when it has one; others share
+// one per source IP. Requests over the Unix socket are not limited.
+func (t *transferLimiter) buckets(r *http.Request, direction string) ([]*throttle.Bucket, func()) {
+	key := ""
+	tokenKBps := 0
+	if token := requestToken(r); token != nil {
+		key = "token:" + token.ID
+		tokenKBps = token.RateLimitKBps
+	} else if ip := clientIP(r); ip != "" {
+		key = "ip:" + ip
+	} else {
+		return nil, func() {}
+	}
+	requested, _ := strconv.Atoi(r.URL.Query().Get("rate_kbps"))
+	requested = max(requested, 0)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clientKBps := t.limits.Client.kbps(direction)
+	if tokenKBps > 0 {
+		clientKBps = tokenKBps
+	}
+	buckets := []*throttle.Bucket{
+		t.global[direction],
+		t.clients.Bucket(direction+"/"+key, int64(clientKBps)*1024),
+	}
+
+	// Transfers get a bucket of their own even while unlimited, so a limit
+	// set while they run applies to them
+	bucket := throttle.NewBucket(int64(lowest(t.limits.Transfer.kbps(direction), requested)) * 1024)
+	t.running[bucket] = runningTransfer{direction: direction, requested: requested}
+	return append(buckets, bucket), func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.running, bucket)
+	}
+}
+
+// lowest returns the lowest of the limits that are set, or 0 if none is
+func lowest(limits ...int) int {
+	result := 0
+	for _, limit := range limits {
+		if limit > 0 && (result == 0 || limit < result) {
+			result = limit
+		}
+	}
+	return result
+}
+
+// handleTransferLimits shows the transfer rate limits, and changes them
+// until the agent restarts
+func (api *FileAPI) handleTransferLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: api.transfers.get()})
+	case http.MethodPut:
+		var limits TransferLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "invalid request body"})
+			return
+		}
+		if err := api.SetTransferLimits(limits); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+			return
+		}
+		if api.audit != nil {
+			api.audit.Log(r.Context(), &audit.Entry{
+				User:     getUser(r),
+				Action:   "set_transfer_limits",
+				Resource: "files",
+				Result:   "success",
+				SourceIP: r.RemoteAddr,
+				Details:  map[string]interface{}{"limits": limits},
+			})
+		}
+		writeJSON(w, http.StatusOK, Response{Success: true, Data: limits})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+	}
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/wanprobe"
+)
+
+// WANHandlers provides HTTP handlers for internet quality monitoring
+type WANHandlers struct {
+	manager *wanprobe.Manager
+	audit   *audit.Logger
+	jobs    *jobs.Manager
+}
+
+// NewWANHandlers creates a new WAN quality handlers instance
+func NewWANHandlers(manager *wanprobe.Manager, auditLogger *audit.Logger) *WANHandlers {
+	return &WANHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+// SetJobs enables asynchronous speedtests
+func (h *WANHandlers) SetJobs(manager *jobs.Manager) {
+	h.jobs = manager
+}
+
+func (h *WANHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/network/wan", h.Status)
+	mux.HandleFunc("/api/v1/network/wan/history", h.History)
+	mux.HandleFunc("/api/v1/network/wan/probe", h.Probe)
+	mux.HandleFunc("/api/v1/network/wan/speedtest", h.Speedtest)
+}
+
+// Status godoc
+// @Summary Get internet quality
+// @Description Returns the latest probe of each target and the latest speedtest
+// @Tags network
+// @Produce json
+// @Success 200 {object} Response{data=wanprobe.Status}
+// @Router /network/wan [get]
+func (h *WANHandlers) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.Status(),
+	})
+}
+
+// History godoc
+// @Summary Get internet quality history
+// @Tags network
+// @Produce json
+// @Param target query string false "Only probes of this target; speedtests are omitted"
+// @Param hours query int false "Hours of history (default 24)"
+// @Success 200 {object} Response{data=wanprobe.History}
+// @Failure 400 {object} Response
+// @Router /network/wan/history [get]
+func (h *WANHandlers) History(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	hours := 24
+	if value := r.URL.Query().Get("hours"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "hours must be a positive integer",
+			})
+			return
+		}
+		hours = parsed
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.History(r.URL.Query().Get("target"), since),
+	})
+}
+
+// Probe godoc
+// @Summary Probe internet quality now
+// @Description Probes all targets without waiting for the next interval
+// @Tags network
+// @Produce json
+// @Success 200 {object} Response{data=[]wanprobe.Result}
+// @Router /network/wan/probe [post]
+func (h *WANHandlers) Probe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    h.manager.Probe(r.Context()),
+	})
+}
+
+// SpeedtestRequest is the request body for running a speedtest
+type SpeedtestRequest struct {
+	Async bool `json:"async"`
+}
+
+// Speedtest godoc
+// @Summary Run a speedtest
+// @Description Downloads the configured speedtest file and records the throughput
+// @Tags network
+// @Accept json
+// @Produce json
+// @Param request body SpeedtestRequest false "Options"
+// @Success 200 {object} Response{data=wanprobe.SpeedResult}
+// @Success 202 {object} Response{data=jobs.Job}
+// @Failure 409 {object} Response
+// @Failure 502 {object} Response
+// @Failure 503 {object} Response
+// @Router /network/wan/speedtest [post]
+func (h *WANHandlers) Speedtest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var req SpeedtestRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid request body: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	if req.Async && h.jobs != nil {
+		user, sourceIP, impersonator := getUser(r), r.RemoteAddr, audit.Impersonator(r.Context())
+		job := h.jobs.Submit("wan.speedtest", "download", func(ctx context.Context) error {
+			ctx = audit.WithImpersonator(ctx, impersonator)
+			result, err := h.manager.Speedtest(ctx)
+			h.logSpeedtest(ctx, user, sourceIP, result, err)
+			return err
+		})
+		writeJSON(w, http.StatusAccepted, Response{
+			Success: true,
+			Data:    job,
+		})
+		return
+	}
+
+	result, err := h.manager.Speedtest(r.Context())
+	h.logSpeedtest(r.Context(), getUser(r), r.RemoteAddr, result, err)
+	if err != nil {
+		writeJSON(w, speedtestErrorStatus(err), Response{
+			Success: false,
+			Error:   "speedtest failed: " + err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    result,
+	})
+}
+
+func (h *WANHandlers) logSpeedtest(ctx context.Context, user, sourceIP string, result *wanprobe.SpeedResult, err error) {
+	if h.audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    "wan.speedtest",
+		Resource:  "download",
+		Result:    "success",
+		SourceIP:  sourceIP,
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Details = map[string]interface{}{"error": err.Error()}
+	} else {
+		entry.Details = map[string]interface{}{"download_mbps": result.DownloadMbps}
+	}
+	h.audit.Log(ctx, entry)
+}
+
+// speedtestErrorStatus maps speedtest errors to HTTP status codes
+func speedtestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, wanprobe.ErrNoSpeedtest):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, wanprobe.ErrBusy):
+		return http.StatusConflict
+	}
+	return errorStatus(err, http.StatusBadGateway)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"golang.org/x/net/webdav"
+)
+
+// webdavPath serves the allowed directories over WebDAV, so they can be
+// mounted as a network drive in Finder, Explorer and file managers
+const webdavPath = "/webdav/"
+
+// webdavChallenge asks WebDAV clients for credentials. They send an API
+// token or session ID as the password of basic authentication; the user
+// name is ignored.
+const webdavChallenge = `Basic realm="mingyue-agent", charset="UTF-8"`
+
+// WebDAVHandlers serve the file manager over WebDAV
+type WebDAVHandlers struct {
+	manager       *filemanager.Manager
+	locks         webdav.LockSystem
+	maxUploadSize int64
+}
+
+func NewWebDAVHandlers(manager *filemanager.Manager, maxUploadSize int64) *WebDAVHandlers {
+	return &WebDAVHandlers{
+		manager:       manager,
+		locks:         webdav.NewMemLS(),
+		maxUploadSize: maxUploadSize,
+	}
+}
+
+func (h *WebDAVHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc(webdavPath, h.handleWebDAV)
+}
+
+// handleWebDAV serves the WebDAV protocol. WebDAV locks are kept apart from
+// file locks, since clients take them for every file they save.
+func (h *WebDAVHandlers) handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	// Clients only send credentials when challenged, and requests without
+	// them would be served anonymously
+	if r.Header.Get("Authorization") == "" && r.Header.Get("X-API-Key") == "" {
+		w.Header().Set("WWW-Authenticate", webdavChallenge)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(webdavPath, "/"),
+		FileSystem: h.manager.WebDAV(getUser(r), h.maxUploadSize),
+		LockSystem: h.locks,
+	}
+	handler.ServeHTTP(w, r)
+}
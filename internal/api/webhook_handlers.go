@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/webhook"
+)
+
+// WebhookHandlers provides HTTP handlers for audit event webhooks
+type WebhookHandlers struct {
+	manager *webhook.Manager
+	audit   *audit.Logger
+}
+
+// NewWebhookHandlers creates a new webhook handlers instance
+func NewWebhookHandlers(manager *webhook.Manager, auditLogger *audit.Logger) *WebhookHandlers {
+	return &WebhookHandlers{
+		manager: manager,
+		audit:   auditLogger,
+	}
+}
+
+func (h *WebhookHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/webhooks", h.ListWebhooks)
+	mux.HandleFunc("/api/v1/webhooks/add", h.AddWebhook)
+	mux.HandleFunc("/api/v1/webhooks/remove", h.RemoveWebhook)
+	mux.HandleFunc("/api/v1/webhooks/test", h.TestWebhook)
+}
+
+// ListWebhooks handles GET /api/v1/webhooks
+func (h *WebhookHandlers) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	page, ok := readPage(w, r)
+	if !ok {
+		return
+	}
+
+	writePage(w, h.manager.ListSubscriptions(), page)
+}
+
+// AddWebhook handles POST /api/v1/webhooks/add
+func (h *WebhookHandlers) AddWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	var sub webhook.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	created, err := h.manager.AddSubscription(&sub)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "failed to add webhook: " + err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "webhook.add",
+			Resource:  created.URL,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+			Details: map[string]interface{}{
+				"id":       created.ID,
+				"action":   created.Action,
+				"resource": created.Resource,
+				"result":   created.Result,
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    created,
+	})
+}
+
+// RemoveWebhook handles DELETE /api/v1/webhooks/remove
+func (h *WebhookHandlers) RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "id is required",
+		})
+		return
+	}
+
+	if err := h.manager.RemoveSubscription(id); err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if h.audit != nil {
+		h.audit.Log(r.Context(), &audit.Entry{
+			Timestamp: time.Now(),
+			User:      getUser(r),
+			Action:    "webhook.remove",
+			Resource:  id,
+			Result:    "success",
+			SourceIP:  r.RemoteAddr,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]interface{}{"message": "webhook removed"},
+	})
+}
+
+// TestWebhook handles POST /api/v1/webhooks/test
+func (h *WebhookHandlers) TestWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "id is required",
+		})
+		return
+	}
+
+	if err := h.manager.Test(id, getUser(r)); err != nil {
+		writeJSON(w, http.StatusNotFound, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]interface{}{"message": "test event queued"},
+	})
+}
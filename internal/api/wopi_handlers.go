@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+)
+
+// wopiPath serves the WOPI host endpoints CheckFileInfo at
+// /wopi/files/<id> and GetFile and PutFile at /wopi/files/<id>/contents.
+// Office suites can't send agent credentials, so requests are
+// authenticated by the access_token parameter issued for the file.
+const wopiPath = "/wopi/files/"
+
+// WOPIHandlers let Collabora Online and ONLYOFFICE edit files on the agent
+type WOPIHandlers struct {
+	manager       *filemanager.Manager
+	auth          *auth.AuthManager
+	maxUploadSize int64
+}
+
+// WOPITokenRequest asks for an access token to open path in an office suite
+type WOPITokenRequest struct {
+	Path       string `json:"path"`
+	ReadOnly   bool   `json:"read_only"`
+	TTLSeconds int    `json:"ttl_seconds"` // 0 for the default of 10 hours
+}
+
+// WOPITokenResponse is an access token and the WOPISrc URL to hand to the
+// office suite along with it
+type WOPITokenResponse struct {
+	*filemanager.WOPIAccess
+	WOPISrc string `json:"wopi_src"`
+}
+
+func NewWOPIHandlers(manager *filemanager.Manager, maxUploadSize int64) *WOPIHandlers {
+	return &WOPIHandlers{manager: manager, maxUploadSize: maxUploadSize}
+}
+
+// SetAuth counts invalid access tokens towards the automatic ban threshold
+// of the auth manager, like other failed authentications
+func (h *WOPIHandlers) SetAuth(authMgr *auth.AuthManager) {
+	h.auth = authMgr
+}
+
+func (h *WOPIHandlers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/files/wopi/token", h.handleToken)
+	mux.HandleFunc(wopiPath, h.handleWOPI)
+}
+
+func (h *WOPIHandlers) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Success: false, Error: "method not allowed"})
+		return
+	}
+
+	var req WOPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Success: false, Error: "path required"})
+		return
+	}
+
+	access, err := h.manager.WOPIToken(r.Context(), req.Path, req.ReadOnly, time.Duration(req.TTLSeconds)*time.Second, getUser(r))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, fs.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	writeJSON(w, http.StatusOK, Response{Success: true, Data: WOPITokenResponse{
+		WOPIAccess: access,
+		WOPISrc:    scheme + "://" + r.Host + wopiPath + access.FileID,
+	}})
+}
+
+// handleWOPI serves the WOPI protocol, which has its own status codes and
+// headers rather than the API's JSON envelope
+func (h *WOPIHandlers) handleWOPI(w http.ResponseWriter, r *http.Request) {
+	fileID, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, wopiPath), "/")
+	contents := rest == "contents"
+	if fileID == "" || rest != "" && !contents {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.URL.Query().Get("access_token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	grant, err := h.manager.WOPIAuthorize(fileID, token)
+	if err != nil {
+		if h.auth != nil {
+			h.auth.RecordAuthFailure(clientIP(r))
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	override := r.Header.Get("X-WOPI-Override")
+	switch {
+	case !contents && r.Method == http.MethodGet:
+		h.checkFileInfo(w, grant)
+	case contents && r.Method == http.MethodGet:
+		h.getFile(w, r, grant)
+	case contents && r.Method == http.MethodPost && (override == "" || override == "PUT"):
+		h.putFile(w, r, grant)
+	case !contents && r.Method == http.MethodPost:
+		h.lockOperation(w, r, grant, override)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *WOPIHandlers) checkFileInfo(w http.ResponseWriter, grant *filemanager.WOPIGrant) {
+	info, err := h.manager.WOPICheckFileInfo(grant)
+	if err != nil {
+		writeWOPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (h *WOPIHandlers) getFile(w http.ResponseWriter, r *http.Request, grant *filemanager.WOPIGrant) {
+	handle, err := h.manager.OpenDownload(grant.Path)
+	if err != nil {
+		writeWOPIError(w, err)
+		return
+	}
+	defer handle.Close()
+	info := handle.Info()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-WOPI-ItemVersion", filemanager.WOPIVersion(info.ModTime, info.Size))
+	w.WriteHeader(http.StatusOK)
+	if _, err := h.manager.Download(r.Context(), w, filemanager.DownloadOptions{Path: grant.Path}, grant.User); err != nil {
+		// Drop the connection, so the client sees the file is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (h *WOPIHandlers) putFile(w http.ResponseWriter, r *http.Request, grant *filemanager.WOPIGrant) {
+	version, err := h.manager.WOPIPut(r.Context(), grant, r.Body, r.Header.Get("X-WOPI-Lock"), h.maxUploadSize)
+	if err != nil {
+		writeWOPIError(w, err)
+		return
+	}
+	w.Header().Set("X-WOPI-ItemVersion", version)
+	w.WriteHeader(http.StatusOK)
+}
+
+// lockOperation serves the operations WOPI posts to the file URL, named by
+// the X-WOPI-Override header. Creating, renaming and deleting files is not
+// supported.
+func (h *WOPIHandlers) lockOperation(w http.ResponseWriter, r *http.Request, grant *filemanager.WOPIGrant, override string) {
+	lock := r.Header.Get("X-WOPI-Lock")
+	var err error
+	switch override {
+	case "LOCK":
+		err = h.manager.WOPILock(r.Context(), grant, lock, r.Header.Get("X-WOPI-OldLock"))
+	case "REFRESH_LOCK":
+		err = h.manager.WOPIRefreshLock(grant, lock)
+	case "UNLOCK":
+		err = h.manager.WOPIUnlock(r.Context(), grant, lock)
+	case "GET_LOCK":
+		w.Header().Set("X-WOPI-Lock", h.manager.WOPIGetLock(grant))
+	default:
+		http.Error(w, "unsupported operation", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeWOPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeWOPIError writes the WOPI response for err. Lock conflicts carry the
+// current lock, which WOPI clients expect even when it is empty.
+func writeWOPIError(w http.ResponseWriter, err error) {
+	var lockErr *filemanager.WOPILockError
+	var policyErr *filemanager.PolicyError
+	switch {
+	case errors.As(err, &lockErr):
+		w.Header().Set("X-WOPI-Lock", lockErr.Lock)
+		w.Header().Set("X-WOPI-LockFailureReason", lockErr.Reason)
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &policyErr):
+		http.Error(w, policyErr.Message, policyErrorStatus(policyErr))
+	case errors.Is(err, filemanager.ErrWOPIReadOnly):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, filemanager.ErrWOPILock):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, filemanager.ErrIsDirectory):
+		http.Error(w, "file not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	}
+}
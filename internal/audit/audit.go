@@ -1,21 +1,39 @@
 package audit
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+)
+
+// Remote pushes send entries in batches, at least every pushInterval
+const (
+	pushBatchSize = 100
+	pushInterval  = 2 * time.Second
+	pushTimeout   = 10 * time.Second
 )
 
 type Logger struct {
 	mu       sync.Mutex
 	file     *os.File
+	path     string
 	enabled  bool
 	pushURL  string
 	pushChan chan *Entry
+	pushDone chan struct{} // Closed when the push worker has sent what was logged
+	hooks    []func(*Entry)
 }
 
 type Entry struct {
@@ -26,12 +44,28 @@ type Entry struct {
 	Result    string                 `json:"result"`
 	SourceIP  string                 `json:"source_ip"`
 	Details   map[string]interface{} `json:"details,omitempty"`
+
+	// Impersonator is the administrator who acted as User, if any
+	Impersonator string `json:"impersonator,omitempty"`
+}
+
+type impersonatorKey struct{}
+
+// WithImpersonator returns a context under which every logged entry records
+// user as the administrator acting on behalf of the entry's user
+func WithImpersonator(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, impersonatorKey{}, user)
+}
+
+// Impersonator returns the impersonating administrator stored in ctx, or ""
+func Impersonator(ctx context.Context) string {
+	user, _ := ctx.Value(impersonatorKey{}).(string)
+	return user
 }
 
 func New(logPath string, remotePush bool, remoteURL string, enabled bool) (*Logger, error) {
 	l := &Logger{
 		enabled: enabled,
-		pushURL: remoteURL,
 	}
 
 	if !enabled {
@@ -52,10 +86,13 @@ func New(logPath string, remotePush bool, remoteURL string, enabled bool) (*Logg
 			return nil, fmt.Errorf("open log file: %w", err)
 		}
 		l.file = f
+		l.path = logPath
 	}
 
 	if remotePush && remoteURL != "" {
-		go l.pushWorker()
+		l.pushURL = remoteURL
+		l.pushDone = make(chan struct{})
+		go l.pushWorker(httpclient.New(pushTimeout))
 	}
 
 	return l, nil
@@ -69,6 +106,9 @@ func (l *Logger) Log(ctx context.Context, entry *Entry) error {
 	if entry.Timestamp.IsZero() {
 		entry.Timestamp = time.Now()
 	}
+	if entry.Impersonator == "" {
+		entry.Impersonator = Impersonator(ctx)
+	}
 
 	data, err := json.Marshal(entry)
 	if err != nil {
@@ -91,23 +131,183 @@ func (l *Logger) Log(ctx context.Context, entry *Entry) error {
 		}
 	}
 
+	for _, hook := range l.hooks {
+		hook(entry)
+	}
+
 	return nil
 }
 
-func (l *Logger) pushWorker() {
-	for entry := range l.pushChan {
-		_ = entry
+// AddHook registers fn to be called with every logged entry. Hooks run
+// synchronously while the log is locked and must hand work off instead of
+// blocking or logging themselves.
+func (l *Logger) AddHook(fn func(*Entry)) {
+	if l == nil {
+		return
 	}
-}
 
-func (l *Logger) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	l.hooks = append(l.hooks, fn)
+}
+
+// QueryFilter selects audit entries. Empty fields match everything; Action
+// and Resource ending in "*" match by prefix.
+type QueryFilter struct {
+	User         string
+	Impersonator string
+	Action       string
+	Resource     string
+	Result       string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+}
+
+// Query scans the audit log file and returns matching entries, newest first
+func (l *Logger) Query(filter QueryFilter) ([]*Entry, error) {
+	if l == nil || !l.enabled || l.path == "" {
+		return []*Entry{}, nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	var matches []*Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !filter.Matches(&entry) {
+			continue
+		}
+		matches = append(matches, &entry)
+		if len(matches) > limit {
+			matches = matches[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read audit log: %w", err)
+	}
+
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches, nil
+}
+
+// Matches reports whether entry satisfies the filter, ignoring Limit
+func (f *QueryFilter) Matches(entry *Entry) bool {
+	if f.User != "" && entry.User != f.User {
+		return false
+	}
+	if f.Impersonator != "" && entry.Impersonator != f.Impersonator {
+		return false
+	}
+	if f.Result != "" && entry.Result != f.Result {
+		return false
+	}
+	if !matchPattern(f.Action, entry.Action) || !matchPattern(f.Resource, entry.Resource) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && entry.Timestamp.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == value
+}
+
+// pushWorker posts logged entries to the remote URL as JSON arrays of up to
+// pushBatchSize entries. Entries of batches the remote rejects are dropped;
+// the log file still has them.
+func (l *Logger) pushWorker(client *http.Client) {
+	defer close(l.pushDone)
+
+	ticker := time.NewTicker(pushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Entry, 0, pushBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := l.push(client, batch); err != nil {
+			log.Printf("warning: push %d audit entries: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case entry, ok := <-l.pushChan:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) == pushBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (l *Logger) push(client *http.Client, entries []*Entry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(l.pushURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("remote returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
 	if l.pushChan != nil {
 		close(l.pushChan)
 	}
+	l.mu.Unlock()
 
+	// Entries logged before closing are still pushed
+	if l.pushDone != nil {
+		<-l.pushDone
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if l.file != nil {
 		return l.file.Close()
 	}
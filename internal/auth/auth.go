@@ -1,16 +1,20 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/subtle"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -26,38 +30,51 @@ type Token struct {
 	ExpiresAt time.Time `json:"expires_at"`
 	CreatedAt time.Time `json:"created_at"`
 	LastUsed  time.Time `json:"last_used"`
-}
-
-// Session represents a user session
-type Session struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Token     string    `json:"token,omitempty"`
-	ExpiresAt time.Time `json:"expires_at"`
-	CreatedAt time.Time `json:"created_at"`
-	IP        string    `json:"ip"`
-	UserAgent string    `json:"user_agent"`
+	// RateLimitKBps caps file transfers made with the token; 0 uses the
+	// agent's default
+	RateLimitKBps int `json:"rate_limit_kbps,omitempty"`
 }
 
 // AuthManager handles authentication and authorization
 type AuthManager struct {
 	db       *sql.DB
+	cipher   *credcrypt.Cipher // Encrypts secret columns; nil stores them as they are
 	mu       sync.RWMutex
 	tokens   map[string]*Token
 	sessions map[string]*Session
+
+	banMu         sync.Mutex
+	bans          map[string]*Ban
+	failures      map[string]*failureRecord
+	maxFailures   int
+	failureWindow time.Duration
+	banDuration   time.Duration
+
+	sessionExpiry time.Duration
+	refreshExpiry time.Duration
+	requireAuth   bool
 }
 
 // Config holds auth configuration
 type Config struct {
 	DBPath        string
 	TokenExpiry   time.Duration
-	SessionExpiry time.Duration
+	SessionExpiry time.Duration // Sessions expire after this long without use
 	RequireAuth   bool
 	AllowedIPs    []string
 	EnableMTLS    bool
 	MTLSCertPath  string
 	MTLSKeyPath   string
 	MTLSCAPath    string
+	MaxFailures   int           // Failed attempts from one IP before it is banned
+	FailureWindow time.Duration // Window in which failed attempts are counted
+	BanDuration   time.Duration // How long automatic bans last
+	CacheSizeKB   int           // SQLite page cache size; 0 uses the SQLite default
+	RefreshExpiry time.Duration // Lifetime of session refresh tokens
+	// DBKeyFile holds the key that encrypts token hashes and session
+	// details in the database. Optional; existing rows are encrypted when
+	// it is first set.
+	DBKeyFile string
 }
 
 // New creates a new AuthManager
@@ -72,15 +89,62 @@ func New(config Config) (*AuthManager, error) {
 		return nil, fmt.Errorf("create database directory %s: %w\n\nPlease ensure the directory exists and has correct permissions:\n  sudo mkdir -p %s\n  sudo chown -R $(whoami):$(whoami) %s", dbDir, err, dbDir, dbDir)
 	}
 
-	db, err := sql.Open("sqlite3", config.DBPath)
+	var cipher *credcrypt.Cipher
+	var params []string
+	if config.DBKeyFile != "" {
+		var err error
+		if cipher, err = loadDBKey(config.DBKeyFile); err != nil {
+			return nil, err
+		}
+		// Overwrite deleted rows instead of leaving them in free pages
+		params = append(params, "_secure_delete=on")
+	}
+	if config.CacheSizeKB > 0 {
+		params = append(params, fmt.Sprintf("_cache_size=-%d", config.CacheSizeKB))
+	}
+	dsn := config.DBPath
+	if len(params) > 0 {
+		dsn += "?" + strings.Join(params, "&")
+	}
+
+	if err := statefile.PrepareDB(config.DBPath); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
+	if config.MaxFailures == 0 {
+		config.MaxFailures = 5
+	}
+	if config.FailureWindow == 0 {
+		config.FailureWindow = 10 * time.Minute
+	}
+	if config.BanDuration == 0 {
+		config.BanDuration = 30 * time.Minute
+	}
+	if config.SessionExpiry == 0 {
+		config.SessionExpiry = 24 * time.Hour
+	}
+	if config.RefreshExpiry == 0 {
+		config.RefreshExpiry = 30 * 24 * time.Hour
+	}
+
 	am := &AuthManager{
-		db:       db,
-		tokens:   make(map[string]*Token),
-		sessions: make(map[string]*Session),
+		db:            db,
+		cipher:        cipher,
+		tokens:        make(map[string]*Token),
+		sessions:      make(map[string]*Session),
+		bans:          make(map[string]*Ban),
+		failures:      make(map[string]*failureRecord),
+		maxFailures:   config.MaxFailures,
+		failureWindow: config.FailureWindow,
+		banDuration:   config.BanDuration,
+		sessionExpiry: config.SessionExpiry,
+		refreshExpiry: config.RefreshExpiry,
+		requireAuth:   config.RequireAuth,
 	}
 
 	if err := am.initDB(); err != nil {
@@ -88,15 +152,30 @@ func New(config Config) (*AuthManager, error) {
 		return nil, fmt.Errorf("initialize database: %w", err)
 	}
 
+	if err := am.initBans(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("load bans: %w", err)
+	}
+
 	// Load tokens
 	if err := am.loadTokens(); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("load tokens: %w", err)
 	}
 
+	if err := am.sealStoredRows(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("encrypt auth database: %w", err)
+	}
+
 	return am, nil
 }
 
+// RequireAuth reports whether requests must carry credentials
+func (am *AuthManager) RequireAuth() bool {
+	return am.requireAuth
+}
+
 func (am *AuthManager) initDB() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS api_tokens (
@@ -125,8 +204,13 @@ func (am *AuthManager) initDB() error {
 	CREATE INDEX IF NOT EXISTS idx_user_id ON api_tokens(user_id);
 	`
 
-	_, err := am.db.Exec(schema)
-	return err
+	if _, err := am.db.Exec(schema); err != nil {
+		return err
+	}
+	if err := am.ensureColumn("api_tokens", "rate_limit_kbps", "INTEGER DEFAULT 0"); err != nil {
+		return fmt.Errorf("migrate api_tokens: %w", err)
+	}
+	return am.initSessions()
 }
 
 func (am *AuthManager) loadTokens() error {
@@ -134,7 +218,7 @@ func (am *AuthManager) loadTokens() error {
 	defer am.mu.Unlock()
 
 	rows, err := am.db.Query(`
-		SELECT id, user_id, token_hash, name, scopes, expires_at, created_at, last_used
+		SELECT id, user_id, token_hash, name, scopes, expires_at, created_at, last_used, rate_limit_kbps
 		FROM api_tokens
 	`)
 	if err != nil {
@@ -148,19 +232,19 @@ func (am *AuthManager) loadTokens() error {
 		var expiresAt, createdAt, lastUsed int64
 
 		err := rows.Scan(&token.ID, &token.UserID, &token.Hash, &token.Name,
-			&scopesStr, &expiresAt, &createdAt, &lastUsed)
+			&scopesStr, &expiresAt, &createdAt, &lastUsed, &token.RateLimitKBps)
 		if err != nil {
 			continue
 		}
+		if token.Hash, err = am.open(token.Hash); err != nil {
+			return err
+		}
 
 		token.ExpiresAt = time.Unix(expiresAt, 0)
 		token.CreatedAt = time.Unix(createdAt, 0)
 		token.LastUsed = time.Unix(lastUsed, 0)
 
-		// Parse scopes (simplified)
-		if scopesStr != "" {
-			token.Scopes = []string{scopesStr}
-		}
+		token.Scopes = decodeScopes(scopesStr)
 
 		am.tokens[token.Hash] = &token
 	}
@@ -169,52 +253,101 @@ func (am *AuthManager) loadTokens() error {
 }
 
 // CreateToken creates a new API token
-func (am *AuthManager) CreateToken(userID, name string, scopes []string, expiresAt time.Time) (*Token, error) {
-	am.mu.Lock()
-	defer am.mu.Unlock()
+func (am *AuthManager) CreateToken(ctx context.Context, userID, name string, scopes []string, expiresAt time.Time) (*Token, error) {
+	tokens, err := am.CreateTokens(ctx, []TokenSpec{{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return tokens[0], nil
+}
+
+// TokenSpec describes one token of a bulk request
+type TokenSpec struct {
+	UserID        string
+	Name          string
+	Scopes        []string
+	ExpiresAt     time.Time
+	RateLimitKBps int
+}
 
-	// Generate token
-	tokenBytes := make([]byte, 32)
-	if _, err := rand.Read(tokenBytes); err != nil {
-		return nil, fmt.Errorf("generate token: %w", err)
+// CreateTokens creates several tokens at once, for example service accounts
+// for a fleet of machines. Either all tokens are created or none are.
+func (am *AuthManager) CreateTokens(ctx context.Context, specs []TokenSpec) ([]*Token, error) {
+	// Hashing is slow, so do it before taking the lock
+	tokens := make([]*Token, 0, len(specs))
+	for _, spec := range specs {
+		token, err := newToken(spec)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
 	}
 
-	tokenStr := base64.URLEncoding.EncodeToString(tokenBytes)
+	am.mu.Lock()
+	defer am.mu.Unlock()
 
-	// Hash token
-	hash, err := bcrypt.GenerateFromPassword([]byte(tokenStr), bcrypt.DefaultCost)
+	tx, err := am.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("hash token: %w", err)
+		return nil, fmt.Errorf("begin transaction: %w", err)
 	}
-
-	token := &Token{
-		ID:        generateID(),
-		UserID:    userID,
-		Token:     tokenStr, // Only shown on creation
-		Hash:      string(hash),
-		Name:      name,
-		Scopes:    scopes,
-		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
-		LastUsed:  time.Now(),
+	for _, token := range tokens {
+		if err := am.insertToken(ctx, tx, token); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("insert token %s: %w", token.Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit tokens: %w", err)
 	}
 
-	scopesStr := ""
-	if len(scopes) > 0 {
-		scopesStr = scopes[0]
+	for _, token := range tokens {
+		am.tokens[token.Hash] = token
 	}
+	return tokens, nil
+}
 
-	_, err = am.db.Exec(`
-		INSERT INTO api_tokens (id, user_id, token_hash, name, scopes, expires_at, created_at, last_used)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, token.ID, token.UserID, token.Hash, token.Name, scopesStr,
-		token.ExpiresAt.Unix(), token.CreatedAt.Unix(), token.LastUsed.Unix())
+// newToken generates a token secret and its hash
+func newToken(spec TokenSpec) (*Token, error) {
+	tokenStr, hash, err := newSecret()
 	if err != nil {
 		return nil, err
 	}
 
-	am.tokens[token.Hash] = token
-	return token, nil
+	return &Token{
+		ID:            generateID(),
+		UserID:        spec.UserID,
+		Token:         tokenStr, // Only shown on creation
+		Hash:          hash,
+		Name:          spec.Name,
+		Scopes:        spec.Scopes,
+		ExpiresAt:     spec.ExpiresAt,
+		CreatedAt:     time.Now(),
+		LastUsed:      time.Now(),
+		RateLimitKBps: spec.RateLimitKBps,
+	}, nil
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (am *AuthManager) insertToken(ctx context.Context, db execer, token *Token) error {
+	hash, err := am.seal(token.Hash)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO api_tokens (id, user_id, token_hash, name, scopes, expires_at, created_at, last_used, rate_limit_kbps)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, token.ID, token.UserID, hash, token.Name, encodeScopes(token.Scopes),
+		token.ExpiresAt.Unix(), token.CreatedAt.Unix(), token.LastUsed.Unix(), token.RateLimitKBps)
+	return err
 }
 
 // ValidateToken validates an API token
@@ -256,11 +389,11 @@ func (am *AuthManager) updateTokenLastUsed(tokenID string) {
 }
 
 // RevokeToken revokes an API token
-func (am *AuthManager) RevokeToken(tokenID string) error {
+func (am *AuthManager) RevokeToken(ctx context.Context, tokenID string) error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	_, err := am.db.Exec("DELETE FROM api_tokens WHERE id = ?", tokenID)
+	_, err := am.db.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = ?", tokenID)
 	if err != nil {
 		return err
 	}
@@ -276,115 +409,6 @@ func (am *AuthManager) RevokeToken(tokenID string) error {
 	return nil
 }
 
-// CreateSession creates a new user session
-func (am *AuthManager) CreateSession(userID, ip, userAgent string, expiresAt time.Time) (*Session, error) {
-	am.mu.Lock()
-	defer am.mu.Unlock()
-
-	// Generate session token
-	tokenBytes := make([]byte, 32)
-	if _, err := rand.Read(tokenBytes); err != nil {
-		return nil, fmt.Errorf("generate token: %w", err)
-	}
-
-	tokenStr := base64.URLEncoding.EncodeToString(tokenBytes)
-
-	// Hash token
-	hash, err := bcrypt.GenerateFromPassword([]byte(tokenStr), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, fmt.Errorf("hash token: %w", err)
-	}
-
-	session := &Session{
-		ID:        generateID(),
-		UserID:    userID,
-		Token:     tokenStr,
-		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
-		IP:        ip,
-		UserAgent: userAgent,
-	}
-
-	_, err = am.db.Exec(`
-		INSERT INTO sessions (id, user_id, token_hash, expires_at, created_at, ip, user_agent)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, session.ID, session.UserID, string(hash), session.ExpiresAt.Unix(),
-		session.CreatedAt.Unix(), session.IP, session.UserAgent)
-	if err != nil {
-		return nil, err
-	}
-
-	am.sessions[string(hash)] = session
-	return session, nil
-}
-
-// ValidateSession validates a session token
-func (am *AuthManager) ValidateSession(tokenStr string) (*Session, error) {
-	am.mu.RLock()
-	defer am.mu.RUnlock()
-
-	for hash, session := range am.sessions {
-		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(tokenStr)); err == nil {
-			if time.Now().After(session.ExpiresAt) {
-				return nil, fmt.Errorf("session expired")
-			}
-			return session, nil
-		}
-	}
-
-	// Try to load from database
-	rows, err := am.db.Query("SELECT id, user_id, token_hash, expires_at, created_at, ip, user_agent FROM sessions")
-	if err != nil {
-		return nil, fmt.Errorf("invalid session")
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var session Session
-		var tokenHash string
-		var expiresAt, createdAt int64
-
-		err := rows.Scan(&session.ID, &session.UserID, &tokenHash, &expiresAt, &createdAt, &session.IP, &session.UserAgent)
-		if err != nil {
-			continue
-		}
-
-		if err := bcrypt.CompareHashAndPassword([]byte(tokenHash), []byte(tokenStr)); err == nil {
-			session.ExpiresAt = time.Unix(expiresAt, 0)
-			session.CreatedAt = time.Unix(createdAt, 0)
-
-			if time.Now().After(session.ExpiresAt) {
-				return nil, fmt.Errorf("session expired")
-			}
-
-			return &session, nil
-		}
-	}
-
-	return nil, fmt.Errorf("invalid session")
-}
-
-// RevokeSession revokes a session
-func (am *AuthManager) RevokeSession(sessionID string) error {
-	am.mu.Lock()
-	defer am.mu.Unlock()
-
-	_, err := am.db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
-	if err != nil {
-		return err
-	}
-
-	// Remove from cache
-	for hash, session := range am.sessions {
-		if session.ID == sessionID {
-			delete(am.sessions, hash)
-			break
-		}
-	}
-
-	return nil
-}
-
 // ListTokens lists all API tokens for a user
 func (am *AuthManager) ListTokens(userID string) ([]*Token, error) {
 	am.mu.RLock()
@@ -396,6 +420,9 @@ func (am *AuthManager) ListTokens(userID string) ([]*Token, error) {
 			tokens = append(tokens, token)
 		}
 	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
 
 	return tokens, nil
 }
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCreateTokens(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "auth.db")
+	am, err := New(Config{DBPath: dbPath})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	tokens, err := am.CreateTokens(context.Background(), []TokenSpec{
+		{UserID: "svc-monitoring", Name: "nas-01", Scopes: []string{"monitoring-readonly"}, ExpiresAt: expiresAt},
+		{UserID: "svc-backup", Name: "nas-01", Scopes: []string{"backup-agent"}, ExpiresAt: expiresAt},
+	})
+	if err != nil {
+		t.Fatalf("CreateTokens: %v", err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(tokens))
+	}
+
+	for _, token := range tokens {
+		validated, err := am.ValidateToken(token.Token)
+		if err != nil {
+			t.Fatalf("ValidateToken(%s): %v", token.Name, err)
+		}
+		if validated.UserID != token.UserID {
+			t.Errorf("expected user %s, got %s", token.UserID, validated.UserID)
+		}
+	}
+
+	// Tokens survive a restart
+	am.Close()
+	am, err = New(Config{DBPath: dbPath})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer am.Close()
+	listed, err := am.ListTokens("svc-backup")
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("expected 1 token for svc-backup after reopening, got %v (%v)", listed, err)
+	}
+}
+
+func TestRefreshSessionRotates(t *testing.T) {
+	am, err := New(Config{DBPath: filepath.Join(t.TempDir(), "auth.db")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer am.Close()
+	ctx := context.Background()
+
+	session, err := am.CreateSession(ctx, "alice", "192.168.1.20", "laptop")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if session.Token == "" || session.RefreshToken == "" {
+		t.Fatal("expected a session token and a refresh token")
+	}
+
+	refreshed, err := am.RefreshSession(ctx, session.RefreshToken, "192.168.1.20", "laptop")
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	if refreshed.ID != session.ID {
+		t.Errorf("expected the session to keep its ID, got %s and %s", session.ID, refreshed.ID)
+	}
+	if _, err := am.ValidateSession(ctx, session.Token); err == nil {
+		t.Error("expected the old session token to stop working")
+	}
+	if _, err := am.ValidateSession(ctx, refreshed.Token); err != nil {
+		t.Errorf("ValidateSession with the new token: %v", err)
+	}
+
+	// Replaying the rotated refresh token revokes the session
+	if _, err := am.RefreshSession(ctx, session.RefreshToken, "203.0.113.7", "curl"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if _, err := am.ValidateSession(ctx, refreshed.Token); err == nil {
+		t.Error("expected the session to be revoked after refresh token reuse")
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	am, err := New(Config{DBPath: filepath.Join(t.TempDir(), "auth.db")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer am.Close()
+	ctx := context.Background()
+
+	current, err := am.CreateSession(ctx, "alice", "192.168.1.20", "laptop")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	for _, device := range []string{"phone", "tablet"} {
+		if _, err := am.CreateSession(ctx, "alice", "192.168.1.21", device); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+	}
+	if _, err := am.CreateSession(ctx, "bob", "192.168.1.22", "desktop"); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	revoked, err := am.RevokeOtherSessions(ctx, "alice", current.ID)
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions: %v", err)
+	}
+	if revoked != 2 {
+		t.Errorf("expected 2 revoked sessions, got %d", revoked)
+	}
+	if sessions := am.ListSessions("alice"); len(sessions) != 1 || sessions[0].ID != current.ID {
+		t.Errorf("expected only the current session to remain, got %v", sessions)
+	}
+	if sessions := am.ListSessions("bob"); len(sessions) != 1 {
+		t.Errorf("expected bob's session to remain, got %v", sessions)
+	}
+}
+
+func TestEncryptedDB(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "auth.db")
+	keyFile := filepath.Join(dir, "auth.key")
+	os.WriteFile(keyFile, []byte("k6Lq0zJ3Tq9f4m1Vb8YwXn2Rc5Hs7Pd0Ue3Ga6Ki9Oo=\n"), 0600)
+	ctx := context.Background()
+
+	// Rows stored before encryption was enabled are encrypted on open
+	am, err := New(Config{DBPath: dbPath})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	before, err := am.CreateToken(ctx, "alice", "laptop", nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	am.Close()
+
+	am, err = New(Config{DBPath: dbPath, DBKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("New with key: %v", err)
+	}
+	after, err := am.CreateToken(ctx, "bob", "phone", nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	session, err := am.CreateSession(ctx, "alice", "192.0.2.7", "Firefox")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	refreshed, err := am.RefreshSession(ctx, session.RefreshToken, "192.0.2.8", "Firefox")
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	am.Close()
+
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("read database: %v", err)
+	}
+	for _, plaintext := range []string{"$2a$", "192.0.2.", "Firefox"} {
+		if bytes.Contains(data, []byte(plaintext)) {
+			t.Errorf("expected %q to be encrypted at rest", plaintext)
+		}
+	}
+
+	am, err = New(Config{DBPath: dbPath, DBKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("reopen with key: %v", err)
+	}
+	for _, token := range []*Token{before, after} {
+		if _, err := am.ValidateToken(token.Token); err != nil {
+			t.Errorf("ValidateToken(%s): %v", token.Name, err)
+		}
+	}
+	if found, err := am.ValidateSession(ctx, refreshed.Token); err != nil || found.IP != "192.0.2.8" {
+		t.Errorf("expected the refreshed session from 192.0.2.8, got %+v (%v)", found, err)
+	}
+	am.Close()
+
+	if _, err := New(Config{DBPath: dbPath}); !errors.Is(err, ErrDBEncrypted) {
+		t.Errorf("expected ErrDBEncrypted without the key, got %v", err)
+	}
+	otherKey := filepath.Join(dir, "other.key")
+	os.WriteFile(otherKey, []byte("Zt1Ym4Wq7Xr0Vs3Ua6Tb9Sc2Rd5Qe8Pf1Og4Nh7Mi0L="), 0600)
+	if _, err := New(Config{DBPath: dbPath, DBKeyFile: otherKey}); err == nil {
+		t.Error("expected a different key to be rejected")
+	}
+	if runtime.GOOS != "windows" {
+		os.Chmod(keyFile, 0644)
+		if _, err := New(Config{DBPath: dbPath, DBKeyFile: keyFile}); err == nil {
+			t.Error("expected a key file readable by others to be rejected")
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Ban represents a source IP blocked from the API
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Failures  int       `json:"failures"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"` // Zero for permanent bans
+}
+
+// Expired reports whether a temporary ban has run out
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && now.After(b.ExpiresAt)
+}
+
+// maxFailureRecords bounds the source IPs whose failed attempts are
+// tracked, so a scan from many addresses cannot grow the table without end
+const maxFailureRecords = 4096
+
+type failureRecord struct {
+	count int
+	first time.Time
+}
+
+func (am *AuthManager) initBans() error {
+	schema := `
+	CREATE TABLE IF NOT EXISTS ip_bans (
+		ip TEXT PRIMARY KEY,
+		reason TEXT,
+		failures INTEGER,
+		created_by TEXT,
+		created_at INTEGER,
+		expires_at INTEGER
+	);
+	`
+	if _, err := am.db.Exec(schema); err != nil {
+		return err
+	}
+
+	rows, err := am.db.Query("SELECT ip, reason, failures, created_by, created_at, expires_at FROM ip_bans")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var ban Ban
+		var createdAt, expiresAt int64
+		if err := rows.Scan(&ban.IP, &ban.Reason, &ban.Failures, &ban.CreatedBy, &createdAt, &expiresAt); err != nil {
+			continue
+		}
+
+		ban.CreatedAt = time.Unix(createdAt, 0)
+		if expiresAt > 0 {
+			ban.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		if ban.Expired(now) {
+			continue
+		}
+
+		am.bans[ban.IP] = &ban
+	}
+
+	return rows.Err()
+}
+
+// RecordAuthFailure counts a failed authentication attempt from ip and bans
+// the address once the configured threshold is reached within the failure
+// window. It returns the ban when one was created.
+func (am *AuthManager) RecordAuthFailure(ip string) (*Ban, error) {
+	if ip == "" || am.maxFailures <= 0 {
+		return nil, nil
+	}
+
+	am.banMu.Lock()
+	defer am.banMu.Unlock()
+
+	now := time.Now()
+	record, exists := am.failures[ip]
+	if !exists || now.Sub(record.first) > am.failureWindow {
+		if !exists && len(am.failures) >= maxFailureRecords {
+			am.pruneFailures(now)
+		}
+		record = &failureRecord{first: now}
+		am.failures[ip] = record
+	}
+	record.count++
+
+	if record.count < am.maxFailures {
+		return nil, nil
+	}
+
+	delete(am.failures, ip)
+	ban := &Ban{
+		IP:        ip,
+		Reason:    fmt.Sprintf("%d failed authentication attempts within %s", record.count, am.failureWindow),
+		Failures:  record.count,
+		CreatedBy: "system",
+		CreatedAt: now,
+		ExpiresAt: now.Add(am.banDuration),
+	}
+	if err := am.saveBan(ban); err != nil {
+		return nil, err
+	}
+
+	return ban, nil
+}
+
+// pruneFailures drops records whose window has passed and, if the table is
+// still full, the oldest one. Callers must hold banMu.
+func (am *AuthManager) pruneFailures(now time.Time) {
+	var oldest string
+	for ip, record := range am.failures {
+		if now.Sub(record.first) > am.failureWindow {
+			delete(am.failures, ip)
+			continue
+		}
+		if oldest == "" || record.first.Before(am.failures[oldest].first) {
+			oldest = ip
+		}
+	}
+	if len(am.failures) >= maxFailureRecords {
+		delete(am.failures, oldest)
+	}
+}
+
+// RecordAuthSuccess clears failed attempts recorded for ip
+func (am *AuthManager) RecordAuthSuccess(ip string) {
+	am.banMu.Lock()
+	defer am.banMu.Unlock()
+
+	delete(am.failures, ip)
+}
+
+// IsBanned returns the active ban for ip, if any
+func (am *AuthManager) IsBanned(ip string) (*Ban, bool) {
+	am.banMu.Lock()
+	defer am.banMu.Unlock()
+
+	ban, exists := am.bans[ip]
+	if !exists {
+		return nil, false
+	}
+
+	if ban.Expired(time.Now()) {
+		delete(am.bans, ip)
+		am.db.Exec("DELETE FROM ip_bans WHERE ip = ?", ip)
+		return nil, false
+	}
+
+	return ban, true
+}
+
+// BanIP bans ip manually. A zero duration creates a permanent ban.
+func (am *AuthManager) BanIP(ip, reason, createdBy string, duration time.Duration) (*Ban, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	am.banMu.Lock()
+	defer am.banMu.Unlock()
+
+	now := time.Now()
+	ban := &Ban{
+		IP:        ip,
+		Reason:    reason,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+	}
+	if duration > 0 {
+		ban.ExpiresAt = now.Add(duration)
+	}
+
+	if err := am.saveBan(ban); err != nil {
+		return nil, err
+	}
+
+	return ban, nil
+}
+
+// UnbanIP lifts the ban on ip
+func (am *AuthManager) UnbanIP(ip string) error {
+	am.banMu.Lock()
+	defer am.banMu.Unlock()
+
+	if _, exists := am.bans[ip]; !exists {
+		return fmt.Errorf("ip %s is not banned", ip)
+	}
+
+	if _, err := am.db.Exec("DELETE FROM ip_bans WHERE ip = ?", ip); err != nil {
+		return fmt.Errorf("delete ban: %w", err)
+	}
+
+	delete(am.bans, ip)
+	delete(am.failures, ip)
+	return nil
+}
+
+// ListBans returns all active bans, newest first
+func (am *AuthManager) ListBans() []*Ban {
+	am.banMu.Lock()
+	defer am.banMu.Unlock()
+
+	now := time.Now()
+	bans := []*Ban{}
+	for ip, ban := range am.bans {
+		if ban.Expired(now) {
+			delete(am.bans, ip)
+			am.db.Exec("DELETE FROM ip_bans WHERE ip = ?", ip)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].CreatedAt.After(bans[j].CreatedAt)
+	})
+
+	return bans
+}
+
+// saveBan persists ban; callers must hold banMu
+func (am *AuthManager) saveBan(ban *Ban) error {
+	var expiresAt int64
+	if !ban.ExpiresAt.IsZero() {
+		expiresAt = ban.ExpiresAt.Unix()
+	}
+
+	_, err := am.db.Exec(`
+		INSERT OR REPLACE INTO ip_bans (ip, reason, failures, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ban.IP, ban.Reason, ban.Failures, ban.CreatedBy, ban.CreatedAt.Unix(), expiresAt)
+	if err != nil {
+		return fmt.Errorf("save ban: %w", err)
+	}
+
+	am.bans[ban.IP] = ban
+	return nil
+}
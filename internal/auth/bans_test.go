@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthFailureBan(t *testing.T) {
+	am, err := New(Config{
+		DBPath:        filepath.Join(t.TempDir(), "auth.db"),
+		MaxFailures:   3,
+		FailureWindow: time.Hour,
+		BanDuration:   100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer am.Close()
+
+	for i := 0; i < 2; i++ {
+		if ban, err := am.RecordAuthFailure("192.0.2.1"); ban != nil || err != nil {
+			t.Fatalf("failure %d: expected no ban, got %+v, %v", i+1, ban, err)
+		}
+	}
+	// A success clears the count
+	am.RecordAuthSuccess("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		am.RecordAuthFailure("192.0.2.1")
+	}
+	if _, banned := am.IsBanned("192.0.2.1"); banned {
+		t.Fatal("banned below the threshold")
+	}
+
+	ban, err := am.RecordAuthFailure("192.0.2.1")
+	if err != nil || ban == nil || ban.Failures != 3 {
+		t.Fatalf("expected a ban after 3 failures, got %+v, %v", ban, err)
+	}
+	if _, banned := am.IsBanned("192.0.2.1"); !banned {
+		t.Fatal("expected the address to be banned")
+	}
+	if _, banned := am.IsBanned("192.0.2.2"); banned {
+		t.Fatal("expected other addresses not to be banned")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, banned := am.IsBanned("192.0.2.1"); banned {
+		t.Fatal("expected the ban to expire")
+	}
+	if bans := am.ListBans(); len(bans) != 0 {
+		t.Fatalf("expected no bans after expiry, got %v", bans)
+	}
+}
+
+func TestAuthFailureWindow(t *testing.T) {
+	am, err := New(Config{
+		DBPath:        filepath.Join(t.TempDir(), "auth.db"),
+		MaxFailures:   2,
+		FailureWindow: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer am.Close()
+
+	am.RecordAuthFailure("192.0.2.1")
+	time.Sleep(100 * time.Millisecond)
+	if ban, _ := am.RecordAuthFailure("192.0.2.1"); ban != nil {
+		t.Fatal("expected failures outside the window not to add up")
+	}
+}
+
+func TestAuthFailureRecordsBounded(t *testing.T) {
+	am, err := New(Config{DBPath: filepath.Join(t.TempDir(), "auth.db"), MaxFailures: 2})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer am.Close()
+
+	for i := 0; i < maxFailureRecords+100; i++ {
+		am.RecordAuthFailure(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+	}
+	if len(am.failures) > maxFailureRecords {
+		t.Fatalf("expected at most %d tracked addresses, got %d", maxFailureRecords, len(am.failures))
+	}
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
+)
+
+// encryptedPrefix marks column values sealed with the database key. Values
+// without it were written before encryption was enabled.
+const encryptedPrefix = "enc:"
+
+// minKeyFileSize is the shortest key file accepted, as generated by
+// "openssl rand -base64 32"
+const minKeyFileSize = 32
+
+// ErrDBEncrypted is returned when the database holds encrypted values but
+// no key file is configured
+var ErrDBEncrypted = errors.New("auth database is encrypted; configure its key file")
+
+// loadDBKey derives the cipher for the secret columns from the contents of
+// a key file, which must not be accessible to other users
+func loadDBKey(path string) (*credcrypt.Cipher, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("read database key: %w", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("database key %s is accessible to other users (mode %04o); run chmod 600 on it", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read database key: %w", err)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) < minKeyFileSize {
+		return nil, fmt.Errorf("database key %s is shorter than %d bytes", path, minKeyFileSize)
+	}
+
+	sum := sha256.Sum256(data)
+	return credcrypt.New(string(sum[:]))
+}
+
+// seal encrypts a column value when the database is encrypted
+func (am *AuthManager) seal(value string) (string, error) {
+	if am.cipher == nil || value == "" {
+		return value, nil
+	}
+	sealed, err := am.cipher.Encrypt(value)
+	if err != nil {
+		return "", fmt.Errorf("encrypt: %w", err)
+	}
+	return encryptedPrefix + sealed, nil
+}
+
+// open decrypts a column value. Unencrypted values are returned as they
+// are, so that a database can be switched to encryption.
+func (am *AuthManager) open(value string) (string, error) {
+	sealed, encrypted := strings.CutPrefix(value, encryptedPrefix)
+	if !encrypted {
+		return value, nil
+	}
+	if am.cipher == nil {
+		return "", ErrDBEncrypted
+	}
+	plaintext, err := am.cipher.Decrypt(sealed)
+	if err != nil {
+		return "", fmt.Errorf("decrypt auth database, is the key file the one it was encrypted with? %w", err)
+	}
+	return plaintext, nil
+}
+
+// sealStoredRows encrypts the tokens and sessions stored before encryption
+// was enabled, then rewrites the database file so that no plaintext copies
+// are left in free pages. Tokens and sessions must be loaded.
+func (am *AuthManager) sealStoredRows() error {
+	if am.cipher == nil {
+		return nil
+	}
+
+	tokenIDs, err := am.unsealedIDs("api_tokens")
+	if err != nil {
+		return err
+	}
+	sessionIDs, err := am.unsealedIDs("sessions")
+	if err != nil {
+		return err
+	}
+	if len(tokenIDs) == 0 && len(sessionIDs) == 0 {
+		return nil
+	}
+
+	tokensByID := make(map[string]*Token, len(am.tokens))
+	for _, token := range am.tokens {
+		tokensByID[token.ID] = token
+	}
+
+	ctx := context.Background()
+	tx, err := am.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+
+	for _, id := range tokenIDs {
+		token, ok := tokensByID[id]
+		if !ok {
+			continue
+		}
+		hash, err := am.seal(token.Hash)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE api_tokens SET token_hash = ? WHERE id = ?", hash, id); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("encrypt token %s: %w", id, err)
+		}
+	}
+
+	for _, id := range sessionIDs {
+		session, ok := am.sessions[id]
+		if !ok {
+			continue
+		}
+		values, err := am.sealSession(session)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE sessions SET token_hash = ?, refresh_hash = ?, prev_refresh_hash = ?, ip = ?, user_agent = ?
+			WHERE id = ?
+		`, append(values, id)...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("encrypt session %s: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit encrypted rows: %w", err)
+	}
+
+	if _, err := am.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	return nil
+}
+
+// unsealedIDs returns the rows of table whose token hash is not encrypted
+func (am *AuthManager) unsealedIDs(table string) ([]string, error) {
+	rows, err := am.db.Query(fmt.Sprintf("SELECT id FROM %s WHERE token_hash NOT LIKE '%s%%'", table, encryptedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// sealSession returns the token hash, refresh hash, previous refresh hash,
+// IP and user agent of a session as they are stored
+func (am *AuthManager) sealSession(session *Session) ([]interface{}, error) {
+	values := make([]interface{}, 0, 5)
+	for _, value := range []string{session.hash, session.refreshHash, session.prevRefreshHash, session.IP, session.UserAgent} {
+		sealed, err := am.seal(value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, sealed)
+	}
+	return values, nil
+}
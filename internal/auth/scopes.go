@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Scopes have the form area:level. A higher level implies the lower ones,
+// so disk:admin also grants disk:read. "*" grants everything, and either
+// part may be "*", as in files:* or *:read.
+const (
+	LevelRead        = "read"
+	LevelWrite       = "write"
+	LevelAdmin       = "admin"
+	LevelImpersonate = "impersonate"
+)
+
+// levelRank orders the levels. Levels ranked 0 are outside the order and
+// only granted by name or wildcard.
+var levelRank = map[string]int{
+	LevelRead:        1,
+	LevelWrite:       2,
+	LevelAdmin:       3,
+	LevelImpersonate: 0,
+}
+
+// Scope areas
+var Areas = []string{
+	"files",     // Files, uploads, indexing and thumbnails
+	"disk",      // Disks, partitions, mounts and SMART
+	"network",   // Interfaces, IP configuration and ports
+	"shares",    // Samba and NFS shares
+	"netdisk",   // Remote CIFS and NFS mounts
+	"scheduler", // Scheduled tasks
+	"monitor",   // Status, statistics, events, jobs, alerts and reports
+	"audit",     // The audit log
+	"auth",      // Tokens, sessions and bans
+	"webhooks",  // Webhook subscriptions
+	"plugins",   // Plugins
+	"cluster",   // Peer agents and proxying
+	"system",    // Maintenance mode, registration and the security advisor
+}
+
+// Canonical scopes
+const (
+	ScopeAll            = "*"
+	ScopeFilesRead      = "files:read"
+	ScopeFilesWrite     = "files:write"
+	ScopeDiskRead       = "disk:read"
+	ScopeDiskAdmin      = "disk:admin"
+	ScopeNetworkRead    = "network:read"
+	ScopeNetworkAdmin   = "network:admin"
+	ScopeSharesRead     = "shares:read"
+	ScopeSharesAdmin    = "shares:admin"
+	ScopeNetdiskRead    = "netdisk:read"
+	ScopeNetdiskAdmin   = "netdisk:admin"
+	ScopeSchedulerRead  = "scheduler:read"
+	ScopeSchedulerAdmin = "scheduler:admin"
+	ScopeMonitorRead    = "monitor:read"
+	ScopeMonitorWrite   = "monitor:write" // Handle alerts and generate reports
+	ScopeAuditRead      = "audit:read"
+	ScopeAuthAdmin      = "auth:admin"
+	ScopeImpersonate    = "auth:impersonate" // Act as another user
+	ScopeWebhooksRead   = "webhooks:read"
+	ScopeWebhooksAdmin  = "webhooks:admin"
+	ScopePluginsRead    = "plugins:read"
+	ScopePluginsAdmin   = "plugins:admin"
+	ScopeClusterRead    = "cluster:read"
+	ScopeClusterAdmin   = "cluster:admin"
+	ScopeSystemRead     = "system:read"
+	ScopeSystemAdmin    = "system:admin"
+)
+
+// ValidateScopes checks that every scope is well formed and names a known
+// area and level
+func ValidateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope == ScopeAll {
+			continue
+		}
+		area, level, ok := strings.Cut(scope, ":")
+		if !ok {
+			return fmt.Errorf("invalid scope %q: expected area:level", scope)
+		}
+		if area != "*" && !knownArea(area) {
+			return fmt.Errorf("invalid scope %q: unknown area %q", scope, area)
+		}
+		if _, known := levelRank[level]; level != "*" && !known {
+			return fmt.Errorf("invalid scope %q: unknown level %q", scope, level)
+		}
+	}
+	return nil
+}
+
+// Grants reports whether the granted scopes cover required
+func Grants(granted []string, required string) bool {
+	if required == "" {
+		return true
+	}
+	reqArea, reqLevel, _ := strings.Cut(required, ":")
+	for _, scope := range granted {
+		if scope == ScopeAll {
+			return true
+		}
+		area, level, ok := strings.Cut(scope, ":")
+		if !ok || (area != "*" && area != reqArea) {
+			continue
+		}
+		if level == "*" || level == reqLevel || levelRank[level] >= levelRank[reqLevel] && levelRank[reqLevel] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func knownArea(area string) bool {
+	for _, known := range Areas {
+		if area == known {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeScopes stores scopes as a JSON array
+func encodeScopes(scopes []string) string {
+	if len(scopes) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(scopes)
+	return string(data)
+}
+
+// decodeScopes reads a stored scope list. Tokens created by older versions
+// hold a single plain scope.
+func decodeScopes(stored string) []string {
+	if stored == "" {
+		return nil
+	}
+	var scopes []string
+	if strings.HasPrefix(stored, "[") && json.Unmarshal([]byte(stored), &scopes) == nil {
+		return scopes
+	}
+	return []string{stored}
+}
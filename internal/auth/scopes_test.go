@@ -0,0 +1,56 @@
+package auth
+
+import "testing"
+
+func TestGrants(t *testing.T) {
+	tests := []struct {
+		granted  []string
+		required string
+		want     bool
+	}{
+		{[]string{"files:read"}, "files:read", true},
+		{[]string{"files:read"}, "files:write", false},
+		{[]string{"files:write"}, "files:read", true},
+		{[]string{"disk:admin"}, "disk:read", true},
+		{[]string{"disk:admin"}, "network:read", false},
+		{[]string{"files:*"}, "files:write", true},
+		{[]string{"*:read"}, "network:read", true},
+		{[]string{"*:read"}, "network:admin", false},
+		{[]string{"*"}, "auth:admin", true},
+		{[]string{"*:admin"}, "*", false},
+		{[]string{"monitor:read", "shares:admin"}, "shares:admin", true},
+		{[]string{"files:read"}, "", true},
+		{[]string{"auth:admin"}, "auth:impersonate", false},
+		{[]string{"auth:impersonate"}, "auth:impersonate", true},
+		{[]string{"auth:*"}, "auth:impersonate", true},
+	}
+	for _, tt := range tests {
+		if got := Grants(tt.granted, tt.required); got != tt.want {
+			t.Errorf("Grants(%v, %q) = %v, want %v", tt.granted, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	if err := ValidateScopes([]string{"*", "files:read", "disk:admin", "*:read", "network:*"}); err != nil {
+		t.Fatalf("expected valid scopes, got %v", err)
+	}
+	for _, scope := range []string{"files", "printer:read", "files:delete", "monitoring-readonly"} {
+		if err := ValidateScopes([]string{scope}); err == nil {
+			t.Errorf("expected %q to be rejected", scope)
+		}
+	}
+}
+
+func TestDecodeScopes(t *testing.T) {
+	scopes := decodeScopes(encodeScopes([]string{"files:read", "disk:admin"}))
+	if len(scopes) != 2 || scopes[0] != "files:read" || scopes[1] != "disk:admin" {
+		t.Fatalf("expected both scopes to survive a round trip, got %v", scopes)
+	}
+	if legacy := decodeScopes("files:read"); len(legacy) != 1 || legacy[0] != "files:read" {
+		t.Fatalf("expected a plain stored scope to decode as one scope, got %v", legacy)
+	}
+	if decodeScopes("") != nil {
+		t.Fatal("expected no scopes for an empty column")
+	}
+}
@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown or expired refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was already
+	// rotated is presented again. The session is revoked, since the token
+	// has probably leaked.
+	ErrRefreshTokenReused = errors.New("refresh token reused; session revoked")
+)
+
+// sessionTouchInterval limits how often sliding expiry writes to the database
+const sessionTouchInterval = time.Minute
+
+// Session represents a user session. Each use pushes ExpiresAt out by the
+// session expiry; once it lapses, the refresh token gets a new session token
+// until RefreshExpiresAt.
+type Session struct {
+	ID               string    `json:"id"`
+	UserID           string    `json:"user_id"`
+	Token            string    `json:"token,omitempty"`         // Only shown on creation and refresh
+	RefreshToken     string    `json:"refresh_token,omitempty"` // Only shown on creation and refresh
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastUsed         time.Time `json:"last_used"`
+	IP               string    `json:"ip"`
+	UserAgent        string    `json:"user_agent"`
+
+	hash            string
+	refreshHash     string
+	prevRefreshHash string // The refresh token rotated out last, to detect reuse
+}
+
+func (am *AuthManager) initSessions() error {
+	for column, definition := range map[string]string{
+		"refresh_hash":       "TEXT DEFAULT ''",
+		"prev_refresh_hash":  "TEXT DEFAULT ''",
+		"refresh_expires_at": "INTEGER DEFAULT 0",
+		"last_used":          "INTEGER DEFAULT 0",
+	} {
+		if err := am.ensureColumn("sessions", column, definition); err != nil {
+			return fmt.Errorf("migrate sessions: %w", err)
+		}
+	}
+
+	now := time.Now().Unix()
+	if _, err := am.db.Exec("DELETE FROM sessions WHERE expires_at < ? AND refresh_expires_at < ?", now, now); err != nil {
+		return fmt.Errorf("prune sessions: %w", err)
+	}
+
+	rows, err := am.db.Query(`
+		SELECT id, user_id, token_hash, refresh_hash, prev_refresh_hash,
+			expires_at, refresh_expires_at, created_at, last_used, ip, user_agent
+		FROM sessions
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session Session
+		var expiresAt, refreshExpiresAt, createdAt, lastUsed int64
+		err := rows.Scan(&session.ID, &session.UserID, &session.hash, &session.refreshHash,
+			&session.prevRefreshHash, &expiresAt, &refreshExpiresAt, &createdAt, &lastUsed,
+			&session.IP, &session.UserAgent)
+		if err != nil {
+			continue
+		}
+		for _, field := range []*string{&session.hash, &session.refreshHash, &session.prevRefreshHash, &session.IP, &session.UserAgent} {
+			if *field, err = am.open(*field); err != nil {
+				return err
+			}
+		}
+
+		session.ExpiresAt = time.Unix(expiresAt, 0)
+		session.RefreshExpiresAt = time.Unix(refreshExpiresAt, 0)
+		session.CreatedAt = time.Unix(createdAt, 0)
+		session.LastUsed = time.Unix(lastUsed, 0)
+		am.sessions[session.ID] = &session
+	}
+
+	return rows.Err()
+}
+
+// ensureColumn adds a column to databases created before it existed
+func (am *AuthManager) ensureColumn(table, column, definition string) error {
+	rows, err := am.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = am.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// newSecret generates a random token and its bcrypt hash
+func newSecret() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("generate token: %w", err)
+	}
+	token := base64.URLEncoding.EncodeToString(secret)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", fmt.Errorf("hash token: %w", err)
+	}
+	return token, string(hash), nil
+}
+
+// CreateSession creates a new user session with a refresh token
+func (am *AuthManager) CreateSession(ctx context.Context, userID, ip, userAgent string) (*Session, error) {
+	token, hash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:               generateID(),
+		UserID:           userID,
+		ExpiresAt:        now.Add(am.sessionExpiry),
+		RefreshExpiresAt: now.Add(am.refreshExpiry),
+		CreatedAt:        now,
+		LastUsed:         now,
+		IP:               ip,
+		UserAgent:        userAgent,
+		hash:             hash,
+		refreshHash:      refreshHash,
+	}
+
+	stored, err := am.sealSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	_, err = am.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, expires_at, refresh_expires_at, created_at, last_used,
+			token_hash, refresh_hash, prev_refresh_hash, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, append([]interface{}{session.ID, session.UserID, session.ExpiresAt.Unix(), session.RefreshExpiresAt.Unix(),
+		session.CreatedAt.Unix(), session.LastUsed.Unix()}, stored...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	am.sessions[session.ID] = session
+	am.pruneSessions(ctx, now)
+
+	shown := *session
+	shown.Token = token
+	shown.RefreshToken = refreshToken
+	return &shown, nil
+}
+
+// ValidateSession validates a session token and slides its expiry forward
+func (am *AuthManager) ValidateSession(ctx context.Context, tokenStr string) (*Session, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	for _, session := range am.sessions {
+		if err := bcrypt.CompareHashAndPassword([]byte(session.hash), []byte(tokenStr)); err == nil {
+			now := time.Now()
+			if now.After(session.ExpiresAt) {
+				return nil, fmt.Errorf("session expired")
+			}
+
+			if now.Sub(session.LastUsed) >= sessionTouchInterval {
+				go am.touchSession(session.ID)
+			}
+
+			found := *session
+			return &found, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid session")
+}
+
+// touchSession records use of a session and extends its expiry
+func (am *AuthManager) touchSession(sessionID string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	session, ok := am.sessions[sessionID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	session.LastUsed = now
+	session.ExpiresAt = now.Add(am.sessionExpiry)
+
+	am.db.Exec("UPDATE sessions SET last_used = ?, expires_at = ? WHERE id = ?",
+		session.LastUsed.Unix(), session.ExpiresAt.Unix(), session.ID)
+}
+
+// RefreshSession trades a refresh token for a new session token and a new
+// refresh token. The old refresh token stops working; presenting it again
+// revokes the session.
+func (am *AuthManager) RefreshSession(ctx context.Context, refreshToken, ip, userAgent string) (*Session, error) {
+	token, hash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	newRefreshToken, newRefreshHash, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	now := time.Now()
+	for _, session := range am.sessions {
+		if session.prevRefreshHash != "" &&
+			bcrypt.CompareHashAndPassword([]byte(session.prevRefreshHash), []byte(refreshToken)) == nil {
+			if err := am.deleteSessions(ctx, []string{session.ID}); err != nil {
+				return nil, err
+			}
+			return nil, ErrRefreshTokenReused
+		}
+		if bcrypt.CompareHashAndPassword([]byte(session.refreshHash), []byte(refreshToken)) != nil {
+			continue
+		}
+		if now.After(session.RefreshExpiresAt) {
+			return nil, ErrInvalidRefreshToken
+		}
+
+		refreshed := *session
+		refreshed.prevRefreshHash = session.refreshHash
+		refreshed.hash = hash
+		refreshed.refreshHash = newRefreshHash
+		refreshed.ExpiresAt = now.Add(am.sessionExpiry)
+		refreshed.RefreshExpiresAt = now.Add(am.refreshExpiry)
+		refreshed.LastUsed = now
+		refreshed.IP = ip
+		refreshed.UserAgent = userAgent
+
+		stored, err := am.sealSession(&refreshed)
+		if err != nil {
+			return nil, err
+		}
+		_, err = am.db.ExecContext(ctx, `
+			UPDATE sessions SET expires_at = ?, refresh_expires_at = ?, last_used = ?,
+				token_hash = ?, refresh_hash = ?, prev_refresh_hash = ?, ip = ?, user_agent = ?
+			WHERE id = ?
+		`, append(append([]interface{}{refreshed.ExpiresAt.Unix(), refreshed.RefreshExpiresAt.Unix(),
+			refreshed.LastUsed.Unix()}, stored...), refreshed.ID)...)
+		if err != nil {
+			return nil, fmt.Errorf("update session: %w", err)
+		}
+		*session = refreshed
+
+		shown := refreshed
+		shown.Token = token
+		shown.RefreshToken = newRefreshToken
+		return &shown, nil
+	}
+
+	return nil, ErrInvalidRefreshToken
+}
+
+// ListSessions lists the sessions of a user, most recently used first
+func (am *AuthManager) ListSessions(userID string) []*Session {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	sessions := []*Session{}
+	for _, session := range am.sessions {
+		if session.UserID == userID {
+			listed := *session
+			sessions = append(sessions, &listed)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+	return sessions
+}
+
+// RevokeSession revokes a session
+func (am *AuthManager) RevokeSession(ctx context.Context, sessionID string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	return am.deleteSessions(ctx, []string{sessionID})
+}
+
+// RevokeOtherSessions revokes every session of a user except keepID, for
+// signing out other devices. It returns the number of revoked sessions.
+func (am *AuthManager) RevokeOtherSessions(ctx context.Context, userID, keepID string) (int, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var ids []string
+	for id, session := range am.sessions {
+		if session.UserID == userID && id != keepID {
+			ids = append(ids, id)
+		}
+	}
+	if err := am.deleteSessions(ctx, ids); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// pruneSessions drops sessions whose refresh token has expired as well
+func (am *AuthManager) pruneSessions(ctx context.Context, now time.Time) {
+	var ids []string
+	for id, session := range am.sessions {
+		if now.After(session.ExpiresAt) && now.After(session.RefreshExpiresAt) {
+			ids = append(ids, id)
+		}
+	}
+	am.deleteSessions(ctx, ids)
+}
+
+// deleteSessions removes sessions from the database and the cache. The
+// caller holds am.mu.
+func (am *AuthManager) deleteSessions(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if _, err := am.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id); err != nil {
+			return err
+		}
+		delete(am.sessions, id)
+	}
+	return nil
+}
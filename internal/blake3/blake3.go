@@ -0,0 +1,250 @@
+// Package blake3 implements the BLAKE3 hash function in its default hashing
+// mode, with 32-byte output, following the BLAKE3 reference implementation.
+// Keyed hashing, key derivation and extendable output are not supported.
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	// Size is the size of a BLAKE3 checksum in bytes
+	Size = 32
+	// BlockSize is the block size of BLAKE3 in bytes
+	BlockSize = 64
+
+	chunkLen = 1024
+
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var msgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(state *[16]uint32, a, b, c, d int, mx, my uint32) {
+	state[a] += state[b] + mx
+	state[d] = bits.RotateLeft32(state[d]^state[a], -16)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -12)
+	state[a] += state[b] + my
+	state[d] = bits.RotateLeft32(state[d]^state[a], -8)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -7)
+}
+
+func round(state *[16]uint32, m *[16]uint32) {
+	// Columns
+	g(state, 0, 4, 8, 12, m[0], m[1])
+	g(state, 1, 5, 9, 13, m[2], m[3])
+	g(state, 2, 6, 10, 14, m[4], m[5])
+	g(state, 3, 7, 11, 15, m[6], m[7])
+	// Diagonals
+	g(state, 0, 5, 10, 15, m[8], m[9])
+	g(state, 1, 6, 11, 12, m[10], m[11])
+	g(state, 2, 7, 8, 13, m[12], m[13])
+	g(state, 3, 4, 9, 14, m[14], m[15])
+}
+
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	state := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for i := 0; i < 7; i++ {
+		round(&state, &m)
+		var permuted [16]uint32
+		for j, k := range msgPermutation {
+			permuted[j] = m[k]
+		}
+		m = permuted
+	}
+	for i := 0; i < 8; i++ {
+		state[i] ^= state[i+8]
+		state[i+8] ^= cv[i]
+	}
+	return state
+}
+
+func first8(words [16]uint32) [8]uint32 {
+	var cv [8]uint32
+	copy(cv[:], words[:8])
+	return cv
+}
+
+func blockWords(block *[BlockSize]byte) [16]uint32 {
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return words
+}
+
+// output is a node that has not been compressed yet, so it can become
+// either a chaining value or the root
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	return first8(compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags))
+}
+
+func (o *output) rootBytes() [Size]byte {
+	words := compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var out [Size]byte
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(out[4*i:], words[i])
+	}
+	return out
+}
+
+func parentOutput(left, right [8]uint32) output {
+	o := output{cv: iv, blockLen: BlockSize, flags: flagParent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+type chunkState struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [BlockSize]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{cv: iv, counter: counter}
+}
+
+func (c *chunkState) len() int {
+	return BlockSize*c.blocksCompressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(input []byte) {
+	for len(input) > 0 {
+		// A full block is only compressed once more input arrives, as the
+		// last block of the chunk needs the end flag
+		if c.blockLen == BlockSize {
+			words := blockWords(&c.block)
+			c.cv = first8(compress(&c.cv, &words, c.counter, BlockSize, c.startFlag()))
+			c.blocksCompressed++
+			c.block = [BlockSize]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], input)
+		c.blockLen += n
+		input = input[n:]
+	}
+}
+
+func (c *chunkState) output() output {
+	return output{
+		cv:       c.cv,
+		block:    blockWords(&c.block),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+// Hasher computes a BLAKE3 checksum. It implements hash.Hash.
+type Hasher struct {
+	chunk   chunkState
+	cvStack [][8]uint32
+}
+
+var _ hash.Hash = (*Hasher)(nil)
+
+// New returns a new BLAKE3 hasher
+func New() *Hasher {
+	return &Hasher{chunk: newChunkState(0)}
+}
+
+// Sum256 returns the BLAKE3 checksum of data
+func Sum256(data []byte) [Size]byte {
+	h := New()
+	h.Write(data)
+	return h.root()
+}
+
+// addChunkCV merges the chaining value of a completed chunk into the tree.
+// Every trailing zero bit of totalChunks completes one more subtree.
+func (h *Hasher) addChunkCV(cv [8]uint32, totalChunks uint64) {
+	for totalChunks&1 == 0 {
+		left := h.cvStack[len(h.cvStack)-1]
+		h.cvStack = h.cvStack[:len(h.cvStack)-1]
+		parent := parentOutput(left, cv)
+		cv = parent.chainingValue()
+		totalChunks >>= 1
+	}
+	h.cvStack = append(h.cvStack, cv)
+}
+
+// Write adds data to the running hash. It never returns an error.
+func (h *Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only finished once more input arrives, as the
+		// last chunk may be the root
+		if h.chunk.len() == chunkLen {
+			out := h.chunk.output()
+			totalChunks := h.chunk.counter + 1
+			h.addChunkCV(out.chainingValue(), totalChunks)
+			h.chunk = newChunkState(totalChunks)
+		}
+		take := min(chunkLen-h.chunk.len(), len(p))
+		h.chunk.update(p[:take])
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (h *Hasher) root() [Size]byte {
+	out := h.chunk.output()
+	for i := len(h.cvStack) - 1; i >= 0; i-- {
+		out = parentOutput(h.cvStack[i], out.chainingValue())
+	}
+	return out.rootBytes()
+}
+
+// Sum appends the checksum of the data written so far to b. It does not
+// change the hasher.
+func (h *Hasher) Sum(b []byte) []byte {
+	out := h.root()
+	return append(b, out[:]...)
+}
+
+// Reset discards the data written so far
+func (h *Hasher) Reset() {
+	h.chunk = newChunkState(0)
+	h.cvStack = h.cvStack[:0]
+}
+
+// Size returns the checksum size in bytes
+func (h *Hasher) Size() int { return Size }
+
+// BlockSize returns the block size in bytes
+func (h *Hasher) BlockSize() int { return BlockSize }
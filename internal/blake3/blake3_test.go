@@ -0,0 +1,63 @@
+package blake3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSum256(t *testing.T) {
+	tests := map[string]string{
+		"":    "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+		"abc": "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+	}
+	for input, expected := range tests {
+		sum := Sum256([]byte(input))
+		if got := hex.EncodeToString(sum[:]); got != expected {
+			t.Errorf("%q: expected %s, got %s", input, expected, got)
+		}
+	}
+}
+
+// TestSum256Tree checks inputs of more than one chunk against the official
+// test vectors, whose input is the byte sequence 0, 1, ..., 250, 0, 1, ...
+func TestSum256Tree(t *testing.T) {
+	tests := map[int]string{
+		1025: "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444",
+		2048: "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a",
+	}
+	for n, expected := range tests {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		sum := Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != expected {
+			t.Errorf("%d bytes: expected %s, got %s", n, expected, got)
+		}
+	}
+}
+
+func TestWriteInPieces(t *testing.T) {
+	data := make([]byte, 5*chunkLen+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	whole := Sum256(data)
+
+	h := New()
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 100)
+		h.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, whole[:]) {
+		t.Fatalf("expected %x, got %x", whole, sum)
+	}
+
+	h.Reset()
+	h.Write(data[:chunkLen])
+	if sum, single := h.Sum(nil), Sum256(data[:chunkLen]); !bytes.Equal(sum, single[:]) {
+		t.Fatalf("expected %x after reset, got %x", single, sum)
+	}
+}
@@ -0,0 +1,604 @@
+// Package bundle exports the objects managed by the agent as a declarative
+// YAML bundle and applies such bundles, creating, updating and optionally
+// deleting objects until the agent matches them.
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/netdisk"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/sharemanager"
+	"gopkg.in/yaml.v3"
+)
+
+// APIVersion identifies the bundle format
+const APIVersion = "mingyue-agent/v1"
+
+// Kinds of objects in a bundle
+const (
+	KindShare   = "share"
+	KindNetDisk = "netdisk"
+	KindTask    = "task"
+)
+
+// Actions applying a bundle takes on an object
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// ErrInvalid is returned for bundles that cannot be applied
+var ErrInvalid = errors.New("invalid bundle")
+
+// Bundle is the declared state of the objects managed by the agent. A
+// section left out leaves objects of its kind alone; an empty section
+// declares that there are none.
+type Bundle struct {
+	APIVersion string     `yaml:"apiVersion" json:"apiVersion"`
+	Shares     []*Share   `yaml:"shares,omitempty" json:"shares,omitempty"`
+	NetDisks   []*NetDisk `yaml:"netdisks,omitempty" json:"netdisks,omitempty"`
+	Tasks      []*Task    `yaml:"tasks,omitempty" json:"tasks,omitempty"`
+}
+
+// Share declares a Samba or NFS share, identified by its type and name
+type Share struct {
+	Name        string            `yaml:"name" json:"name"`
+	Type        string            `yaml:"type" json:"type"`
+	Path        string            `yaml:"path" json:"path"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Users       []string          `yaml:"users,omitempty" json:"users,omitempty"`
+	Groups      []string          `yaml:"groups,omitempty" json:"groups,omitempty"`
+	AccessMode  string            `yaml:"access_mode,omitempty" json:"access_mode,omitempty"`
+	Options     map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	Enabled     *bool             `yaml:"enabled,omitempty" json:"enabled,omitempty"` // Defaults to true
+	DLNA        bool              `yaml:"dlna,omitempty" json:"dlna,omitempty"`
+	DLNAMedia   string            `yaml:"dlna_media,omitempty" json:"dlna_media,omitempty"`
+}
+
+// NetDisk declares a network share mount, identified by its mount point.
+// Passwords are never exported; one left out keeps the current password.
+type NetDisk struct {
+	Name           string            `yaml:"name,omitempty" json:"name,omitempty"`
+	Protocol       string            `yaml:"protocol" json:"protocol"`
+	Host           string            `yaml:"host" json:"host"`
+	Path           string            `yaml:"path" json:"path"`
+	MountPoint     string            `yaml:"mount_point" json:"mount_point"`
+	Username       string            `yaml:"username,omitempty" json:"username,omitempty"`
+	Password       string            `yaml:"password,omitempty" json:"password,omitempty"`
+	Options        map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	AutoMount      bool              `yaml:"auto_mount,omitempty" json:"auto_mount,omitempty"`
+	OnDemand       bool              `yaml:"on_demand,omitempty" json:"on_demand,omitempty"`
+	IdleTimeoutSec int               `yaml:"idle_timeout_sec,omitempty" json:"idle_timeout_sec,omitempty"`
+}
+
+// Task declares a scheduled task, identified by its ID. Tasks owned by the
+// portal are neither exported nor changed.
+type Task struct {
+	ID         string                 `yaml:"id" json:"id"`
+	Name       string                 `yaml:"name" json:"name"`
+	Type       string                 `yaml:"type" json:"type"`
+	Schedule   string                 `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+	Params     map[string]interface{} `yaml:"params,omitempty" json:"params,omitempty"`
+	Enabled    *bool                  `yaml:"enabled,omitempty" json:"enabled,omitempty"` // Defaults to true
+	HookParams []string               `yaml:"hook_params,omitempty" json:"hook_params,omitempty"`
+
+	Blackouts             []scheduler.Blackout `yaml:"blackouts,omitempty" json:"blackouts,omitempty"`
+	IgnoreGlobalBlackouts bool                 `yaml:"ignore_global_blackouts,omitempty" json:"ignore_global_blackouts,omitempty"`
+}
+
+// Change is a difference between a bundle and the agent, and the outcome
+// of applying it
+type Change struct {
+	Kind   string   `json:"kind"`
+	Key    string   `json:"key"` // type/name of shares, mount point of network disks, ID of tasks
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"` // Fields an update changes
+	Error  string   `json:"error,omitempty"`
+
+	apply func(ctx context.Context) error
+}
+
+// Config names the managers whose objects are bundled; nil managers belong
+// to disabled features
+type Config struct {
+	Shares    *sharemanager.Manager
+	NetDisks  *netdisk.Manager
+	Scheduler *scheduler.Scheduler
+}
+
+// Manager exports and applies bundles
+type Manager struct {
+	shares    *sharemanager.Manager
+	netdisks  *netdisk.Manager
+	scheduler *scheduler.Scheduler
+}
+
+// New creates a bundle manager
+func New(cfg *Config) *Manager {
+	return &Manager{
+		shares:    cfg.Shares,
+		netdisks:  cfg.NetDisks,
+		scheduler: cfg.Scheduler,
+	}
+}
+
+// Parse reads a YAML or JSON bundle
+func Parse(data []byte) (*Bundle, error) {
+	var b Bundle
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if b.APIVersion != APIVersion {
+		return nil, fmt.Errorf("%w: apiVersion must be %s", ErrInvalid, APIVersion)
+	}
+	return &b, nil
+}
+
+// Marshal writes a bundle as YAML
+func (b *Bundle) Marshal() ([]byte, error) {
+	return yaml.Marshal(b)
+}
+
+// Export returns the objects of the enabled features as a bundle. Shares
+// and network disks pending deletion are left out.
+func (m *Manager) Export() *Bundle {
+	b := &Bundle{APIVersion: APIVersion}
+	if m.shares != nil {
+		b.Shares = []*Share{}
+		for _, share := range m.shares.ListShares() {
+			if share.DeleteAt == nil {
+				b.Shares = append(b.Shares, shareSpec(share))
+			}
+		}
+	}
+	if m.netdisks != nil {
+		b.NetDisks = []*NetDisk{}
+		for _, share := range m.netdisks.ListShares() {
+			if share.DeleteAt == nil {
+				b.NetDisks = append(b.NetDisks, netDiskSpec(share))
+			}
+		}
+	}
+	if m.scheduler != nil {
+		b.Tasks = []*Task{}
+		for _, task := range m.scheduler.ListTasks() {
+			if task.Source != scheduler.SourcePortal {
+				b.Tasks = append(b.Tasks, taskSpec(task))
+			}
+		}
+	}
+	return b
+}
+
+// Diff returns the changes applying b would make. With prune, objects
+// missing from the sections b has are deleted.
+func (m *Manager) Diff(b *Bundle, prune bool) ([]*Change, error) {
+	var changes []*Change
+	if b.Shares != nil {
+		if m.shares == nil {
+			return nil, fmt.Errorf("%w: shares are disabled", ErrInvalid)
+		}
+		shareChanges, err := m.diffShares(b.Shares, prune)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, shareChanges...)
+	}
+	if b.NetDisks != nil {
+		if m.netdisks == nil {
+			return nil, fmt.Errorf("%w: network disks are disabled", ErrInvalid)
+		}
+		netDiskChanges, err := m.diffNetDisks(b.NetDisks, prune)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, netDiskChanges...)
+	}
+	if b.Tasks != nil {
+		if m.scheduler == nil {
+			return nil, fmt.Errorf("%w: the scheduler is disabled", ErrInvalid)
+		}
+		taskChanges, err := m.diffTasks(b.Tasks, prune)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, taskChanges...)
+	}
+	if changes == nil {
+		changes = []*Change{}
+	}
+	return changes, nil
+}
+
+// Apply makes the changes of Diff. A failed change is recorded in its
+// Error and does not stop the others; the error returned counts them.
+// Applying the same bundle again changes nothing.
+func (m *Manager) Apply(ctx context.Context, b *Bundle, prune bool) ([]*Change, error) {
+	changes, err := m.Diff(b, prune)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := 0
+	for _, change := range changes {
+		if err := ctx.Err(); err != nil {
+			return changes, err
+		}
+		if err := change.apply(ctx); err != nil {
+			change.Error = err.Error()
+			failed++
+		}
+	}
+	if failed > 0 {
+		return changes, fmt.Errorf("%d of %d changes failed", failed, len(changes))
+	}
+	return changes, nil
+}
+
+func (m *Manager) diffShares(specs []*Share, prune bool) ([]*Change, error) {
+	existing := make(map[string]*sharemanager.Share)
+	for _, share := range m.shares.ListShares() {
+		existing[string(share.Type)+"/"+share.Name] = share
+	}
+
+	var changes []*Change
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.Name == "" || spec.Path == "" {
+			return nil, fmt.Errorf("%w: shares need a name and a path", ErrInvalid)
+		}
+		if spec.Type != string(sharemanager.ShareTypeSamba) && spec.Type != string(sharemanager.ShareTypeNFS) {
+			return nil, fmt.Errorf("%w: share %s: type must be samba or nfs", ErrInvalid, spec.Name)
+		}
+		key := spec.Type + "/" + spec.Name
+		if seen[key] {
+			return nil, fmt.Errorf("%w: share %s is declared twice", ErrInvalid, key)
+		}
+		seen[key] = true
+
+		desired := spec.share()
+		current, ok := existing[key]
+		if !ok {
+			changes = append(changes, &Change{Kind: KindShare, Key: key, Action: ActionCreate, apply: func(ctx context.Context) error {
+				// AddShare enables every share it adds
+				disabled := *desired
+				if err := m.shares.AddShare(ctx, desired); err != nil {
+					return err
+				}
+				if !disabled.Enabled {
+					return m.shares.ReplaceShare(ctx, desired.ID, &disabled)
+				}
+				return nil
+			}})
+			continue
+		}
+
+		fields := changedFields(shareSpec(current), spec)
+		if current.DeleteAt != nil {
+			fields = append(fields, "delete_at")
+		}
+		if len(fields) > 0 {
+			id := current.ID
+			changes = append(changes, &Change{Kind: KindShare, Key: key, Action: ActionUpdate, Fields: fields, apply: func(ctx context.Context) error {
+				return m.shares.ReplaceShare(ctx, id, desired)
+			}})
+		}
+	}
+
+	if prune {
+		for key, share := range existing {
+			if !seen[key] && share.DeleteAt == nil {
+				id := share.ID
+				changes = append(changes, &Change{Kind: KindShare, Key: key, Action: ActionDelete, apply: func(ctx context.Context) error {
+					_, err := m.shares.RemoveShare(ctx, id)
+					return err
+				}})
+			}
+		}
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+func (m *Manager) diffNetDisks(specs []*NetDisk, prune bool) ([]*Change, error) {
+	existing := make(map[string]*netdisk.Share)
+	for _, share := range m.netdisks.ListShares() {
+		existing[share.MountPoint] = share
+	}
+
+	var changes []*Change
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.Host == "" || spec.MountPoint == "" {
+			return nil, fmt.Errorf("%w: network disks need a host and a mount point", ErrInvalid)
+		}
+		if spec.Protocol != string(netdisk.ProtocolCIFS) && spec.Protocol != string(netdisk.ProtocolNFS) {
+			return nil, fmt.Errorf("%w: network disk %s: protocol must be cifs or nfs", ErrInvalid, spec.MountPoint)
+		}
+		key := spec.MountPoint
+		if seen[key] {
+			return nil, fmt.Errorf("%w: network disk %s is declared twice", ErrInvalid, key)
+		}
+		seen[key] = true
+
+		desired := spec.share()
+		current, ok := existing[key]
+		if !ok {
+			changes = append(changes, &Change{Kind: KindNetDisk, Key: key, Action: ActionCreate, apply: func(ctx context.Context) error {
+				return m.netdisks.AddShare(desired)
+			}})
+			continue
+		}
+
+		exported := netDiskSpec(current)
+		exported.Password = spec.Password
+		fields := changedFields(exported, spec)
+		if spec.Password != "" && !m.netdisks.PasswordMatches(current.ID, spec.Password) {
+			fields = append(fields, "password")
+		}
+		if current.DeleteAt != nil {
+			fields = append(fields, "delete_at")
+		}
+		if len(fields) > 0 {
+			id := current.ID
+			changes = append(changes, &Change{Kind: KindNetDisk, Key: key, Action: ActionUpdate, Fields: fields, apply: func(ctx context.Context) error {
+				return m.netdisks.ReplaceShare(id, desired)
+			}})
+		}
+	}
+
+	if prune {
+		for key, share := range existing {
+			if !seen[key] && share.DeleteAt == nil {
+				id := share.ID
+				changes = append(changes, &Change{Kind: KindNetDisk, Key: key, Action: ActionDelete, apply: func(ctx context.Context) error {
+					_, err := m.netdisks.RemoveShare(ctx, id)
+					return err
+				}})
+			}
+		}
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+func (m *Manager) diffTasks(specs []*Task, prune bool) ([]*Change, error) {
+	existing := make(map[string]*scheduler.Task)
+	for _, task := range m.scheduler.ListTasks() {
+		existing[task.ID] = task
+	}
+
+	var changes []*Change
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.ID == "" || spec.Type == "" {
+			return nil, fmt.Errorf("%w: tasks need an id and a type", ErrInvalid)
+		}
+		if seen[spec.ID] {
+			return nil, fmt.Errorf("%w: task %s is declared twice", ErrInvalid, spec.ID)
+		}
+		seen[spec.ID] = true
+		if _, ok := m.scheduler.Handler(spec.Type); !ok {
+			return nil, fmt.Errorf("%w: task %s: unknown type %s", ErrInvalid, spec.ID, spec.Type)
+		}
+		params, err := normalizeParams(spec.Params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: task %s: %v", ErrInvalid, spec.ID, err)
+		}
+		spec.Params = params
+		if err := scheduler.ValidateBlackouts(spec.Blackouts); err != nil {
+			return nil, fmt.Errorf("%w: task %s: %v", ErrInvalid, spec.ID, err)
+		}
+
+		current, ok := existing[spec.ID]
+		if !ok {
+			task := spec.task()
+			changes = append(changes, &Change{Kind: KindTask, Key: spec.ID, Action: ActionCreate, apply: func(ctx context.Context) error {
+				return m.scheduler.AddTask(ctx, task)
+			}})
+			continue
+		}
+		if current.Source == scheduler.SourcePortal {
+			return nil, fmt.Errorf("%w: task %s is managed by the portal", ErrInvalid, spec.ID)
+		}
+
+		if fields := changedFields(taskSpec(current), spec); len(fields) > 0 {
+			updated := *current
+			desired := spec.task()
+			updated.Name = desired.Name
+			updated.Type = desired.Type
+			updated.Schedule = desired.Schedule
+			updated.Params = desired.Params
+			updated.Enabled = desired.Enabled
+			updated.HookParams = desired.HookParams
+			updated.Blackouts = desired.Blackouts
+			updated.IgnoreGlobalBlackouts = desired.IgnoreGlobalBlackouts
+			changes = append(changes, &Change{Kind: KindTask, Key: spec.ID, Action: ActionUpdate, Fields: fields, apply: func(ctx context.Context) error {
+				return m.scheduler.UpdateTask(ctx, &updated)
+			}})
+		}
+	}
+
+	if prune {
+		for id, task := range existing {
+			if !seen[id] && task.Source != scheduler.SourcePortal {
+				changes = append(changes, &Change{Kind: KindTask, Key: id, Action: ActionDelete, apply: func(ctx context.Context) error {
+					return m.scheduler.DeleteTask(ctx, id)
+				}})
+			}
+		}
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+func shareSpec(share *sharemanager.Share) *Share {
+	enabled := share.Enabled
+	return &Share{
+		Name:        share.Name,
+		Type:        string(share.Type),
+		Path:        share.Path,
+		Description: share.Description,
+		Users:       share.Users,
+		Groups:      share.Groups,
+		AccessMode:  string(share.AccessMode),
+		Options:     share.Options,
+		Enabled:     &enabled,
+		DLNA:        share.DLNA,
+		DLNAMedia:   share.DLNAMedia,
+	}
+}
+
+func (s *Share) share() *sharemanager.Share {
+	accessMode := sharemanager.AccessMode(s.AccessMode)
+	if accessMode == "" {
+		accessMode = sharemanager.AccessModeReadWrite
+	}
+	return &sharemanager.Share{
+		Name:        s.Name,
+		Type:        sharemanager.ShareType(s.Type),
+		Path:        s.Path,
+		Description: s.Description,
+		Users:       s.Users,
+		Groups:      s.Groups,
+		AccessMode:  accessMode,
+		Options:     s.Options,
+		Enabled:     s.Enabled == nil || *s.Enabled,
+		DLNA:        s.DLNA,
+		DLNAMedia:   s.DLNAMedia,
+	}
+}
+
+func netDiskSpec(share *netdisk.Share) *NetDisk {
+	return &NetDisk{
+		Name:           share.Name,
+		Protocol:       string(share.Protocol),
+		Host:           share.Host,
+		Path:           share.Path,
+		MountPoint:     share.MountPoint,
+		Username:       share.Username,
+		Options:        share.Options,
+		AutoMount:      share.AutoMount,
+		OnDemand:       share.OnDemand,
+		IdleTimeoutSec: share.IdleTimeoutSec,
+	}
+}
+
+func (n *NetDisk) share() *netdisk.Share {
+	return &netdisk.Share{
+		Name:           n.Name,
+		Protocol:       netdisk.Protocol(n.Protocol),
+		Host:           n.Host,
+		Path:           n.Path,
+		MountPoint:     n.MountPoint,
+		Username:       n.Username,
+		Password:       n.Password,
+		Options:        n.Options,
+		AutoMount:      n.AutoMount,
+		OnDemand:       n.OnDemand,
+		IdleTimeoutSec: n.IdleTimeoutSec,
+	}
+}
+
+func taskSpec(task *scheduler.Task) *Task {
+	enabled := task.Enabled
+	params, _ := normalizeParams(task.Params)
+	return &Task{
+		ID:         task.ID,
+		Name:       task.Name,
+		Type:       task.Type,
+		Schedule:   task.Schedule,
+		Params:     params,
+		Enabled:    &enabled,
+		HookParams: task.HookParams,
+
+		Blackouts:             task.Blackouts,
+		IgnoreGlobalBlackouts: task.IgnoreGlobalBlackouts,
+	}
+}
+
+func (t *Task) task() *scheduler.Task {
+	params := t.Params
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	return &scheduler.Task{
+		ID:         t.ID,
+		Name:       t.Name,
+		Type:       t.Type,
+		Schedule:   t.Schedule,
+		Params:     params,
+		Enabled:    t.Enabled == nil || *t.Enabled,
+		HookParams: t.HookParams,
+		Source:     scheduler.SourceLocal,
+
+		Blackouts:             t.Blackouts,
+		IgnoreGlobalBlackouts: t.IgnoreGlobalBlackouts,
+	}
+}
+
+// normalizeParams gives task params the types they have once stored as
+// JSON, so params read from YAML compare equal to stored ones
+func normalizeParams(params map[string]interface{}) (map[string]interface{}, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("params: %w", err)
+	}
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, fmt.Errorf("params: %w", err)
+	}
+	return normalized, nil
+}
+
+// changedFields returns the YAML names of the fields in which the specs
+// current and desired, of the same type, differ. Empty and missing values
+// are alike, and a missing enabled means true.
+func changedFields(current, desired interface{}) []string {
+	a := reflect.ValueOf(current).Elem()
+	b := reflect.ValueOf(desired).Elem()
+
+	var fields []string
+	for i := 0; i < a.NumField(); i++ {
+		name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("yaml"), ",")
+		if !sameValue(a.Field(i), b.Field(i)) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+func sameValue(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Pointer {
+		// Only enabled is a pointer
+		return (a.IsNil() || a.Elem().Bool()) == (b.IsNil() || b.Elem().Bool())
+	}
+	if (a.Kind() == reflect.Map || a.Kind() == reflect.Slice) && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// sortChanges orders changes by action and key
+func sortChanges(changes []*Change) {
+	order := map[string]int{ActionCreate: 0, ActionUpdate: 1, ActionDelete: 2}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Action != changes[j].Action {
+			return order[changes[i].Action] < order[changes[j].Action]
+		}
+		return changes[i].Key < changes[j].Key
+	})
+}
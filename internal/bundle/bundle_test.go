@@ -0,0 +1,127 @@
+package bundle
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/KOPElan/mingyue-agent/internal/netdisk"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+)
+
+func TestApplyBundle(t *testing.T) {
+	dir := t.TempDir()
+	disks, err := netdisk.New(&netdisk.Config{
+		AllowedMountPoints: []string{"/mnt"},
+		EncryptionKey:      "test-key",
+		StateFile:          filepath.Join(dir, "netdisk.json"),
+	})
+	if err != nil {
+		t.Fatalf("netdisk.New: %v", err)
+	}
+	defer disks.Stop()
+
+	sched, err := scheduler.New(scheduler.Config{DBPath: filepath.Join(dir, "scheduler.db")})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+	sched.RegisterHandler("noop", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+	if err := sched.AddTask(context.Background(), &scheduler.Task{ID: "stale", Name: "Stale", Type: "noop", Enabled: true}); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	m := New(&Config{NetDisks: disks, Scheduler: sched})
+	b, err := Parse([]byte(`apiVersion: mingyue-agent/v1
+netdisks:
+  - name: media
+    protocol: cifs
+    host: nas.local
+    path: /media
+    mount_point: /mnt/media
+    username: alice
+    password: secret
+tasks:
+  - id: cleanup
+    name: Cleanup
+    type: noop
+    schedule: "@daily"
+    params:
+      days: 30
+      paths: [/tmp]
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	changes, err := m.Apply(context.Background(), b, true)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	actions := map[string]string{}
+	for _, change := range changes {
+		actions[change.Kind+":"+change.Key] = change.Action
+	}
+	if len(changes) != 3 || actions["netdisk:/mnt/media"] != ActionCreate ||
+		actions["task:cleanup"] != ActionCreate || actions["task:stale"] != ActionDelete {
+		t.Fatalf("unexpected changes %+v", actions)
+	}
+	if !disks.PasswordMatches(disks.ListShares()[0].ID, "secret") {
+		t.Fatal("password was not stored")
+	}
+
+	// Applying again changes nothing, with or without the password
+	changes, err = m.Diff(b, true)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes, got %+v, %v", changes, err)
+	}
+	exported := m.Export()
+	if len(exported.NetDisks) != 1 || exported.NetDisks[0].Password != "" || len(exported.Tasks) != 1 {
+		t.Fatalf("unexpected export %+v", exported)
+	}
+	data, err := exported.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	reparsed, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse export: %v", err)
+	}
+	if changes, err := m.Diff(reparsed, true); err != nil || len(changes) != 0 {
+		t.Fatalf("expected exported bundle to match, got %+v, %v", changes, err)
+	}
+
+	// Changed fields are updated in place
+	b.NetDisks[0].Username = "bob"
+	b.NetDisks[0].Password = "other"
+	disabled := false
+	b.Tasks[0].Enabled = &disabled
+	changes, err = m.Apply(context.Background(), b, false)
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("expected 2 updates, got %+v, %v", changes, err)
+	}
+	if fields := changes[0].Fields; len(fields) != 2 || fields[0] != "username" || fields[1] != "password" {
+		t.Fatalf("unexpected netdisk fields %v", fields)
+	}
+	task, err := sched.GetTask("cleanup")
+	if err != nil || task.Enabled {
+		t.Fatalf("expected disabled task, got %+v, %v", task, err)
+	}
+}
+
+func TestParseBundle(t *testing.T) {
+	if _, err := Parse([]byte("apiVersion: v0\n")); err == nil {
+		t.Fatal("expected unknown apiVersion to fail")
+	}
+	if _, err := Parse([]byte("apiVersion: mingyue-agent/v1\nfirewall: []\n")); err == nil {
+		t.Fatal("expected unknown section to fail")
+	}
+
+	m := New(&Config{})
+	b, _ := Parse([]byte("apiVersion: mingyue-agent/v1\nshares: []\n"))
+	if _, err := m.Diff(b, false); err == nil {
+		t.Fatal("expected shares to need the share manager")
+	}
+}
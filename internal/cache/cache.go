@@ -0,0 +1,173 @@
+// Package cache keeps the results of expensive reads, like listings that
+// run lsblk or smartctl, for a short time so dashboards polling the API do
+// not run the same commands over and over. Managers invalidate entries when
+// they change what was read, such as after a mount.
+//
+// Requests learn how fresh their data is through the context: the API
+// wraps it with WithFreshness and turns the result into Cache-Control
+// headers, and WithRefresh makes a request skip cached values.
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache holds values of type V by key for a fixed time. Concurrent misses of
+// the same key share one load. Cached values are shared between callers and
+// must not be modified. A nil Cache or one with a TTL of 0 caches nothing.
+type Cache[V any] struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*entry[V]
+}
+
+type entry[V any] struct {
+	ready   chan struct{} // Closed once the load finished
+	value   V
+	err     error
+	fetched time.Time
+}
+
+// New creates a cache keeping values for ttl
+func New[V any](ttl time.Duration) *Cache[V] {
+	return &Cache[V]{
+		ttl:     ttl,
+		entries: make(map[string]*entry[V]),
+	}
+}
+
+// Get returns the value of key, calling load if there is no fresh one.
+// Errors are not cached.
+func (c *Cache[V]) Get(ctx context.Context, key string, load func(ctx context.Context) (V, error)) (V, error) {
+	if c == nil || c.ttl <= 0 {
+		value, err := load(ctx)
+		if err == nil {
+			note(ctx, time.Now(), 0)
+		}
+		return value, err
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && !refresh(ctx) {
+		select {
+		case <-e.ready:
+			if e.err == nil && time.Since(e.fetched) < c.ttl {
+				c.mu.Unlock()
+				note(ctx, e.fetched, c.ttl)
+				return e.value, nil
+			}
+		default:
+			// Another request is loading it; wait for its result
+			c.mu.Unlock()
+			select {
+			case <-e.ready:
+			case <-ctx.Done():
+				var zero V
+				return zero, ctx.Err()
+			}
+			if e.err == nil {
+				note(ctx, e.fetched, c.ttl)
+			}
+			return e.value, e.err
+		}
+	}
+	e := &entry[V]{ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.value, e.err = load(ctx)
+	e.fetched = time.Now()
+	close(e.ready)
+
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		return e.value, e.err
+	}
+	note(ctx, e.fetched, c.ttl)
+	return e.value, nil
+}
+
+// Invalidate drops the given keys, or every key if none are given. Loads
+// in progress finish for their callers but are not kept.
+func (c *Cache[V]) Invalidate(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(keys) == 0 {
+		c.entries = make(map[string]*entry[V])
+		return
+	}
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+type freshnessKey struct{}
+
+type refreshKey struct{}
+
+// freshness tracks the oldest cached value a request used
+type freshness struct {
+	mu      sync.Mutex
+	used    bool
+	age     time.Duration
+	expires time.Time
+}
+
+// WithFreshness returns a context that records how fresh the cached values
+// read with it are
+func WithFreshness(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshnessKey{}, &freshness{})
+}
+
+// Freshness returns the age of the oldest value read with ctx and how much
+// longer all of them stay fresh. ok is false if ctx read no values.
+func Freshness(ctx context.Context) (age, maxAge time.Duration, ok bool) {
+	f, _ := ctx.Value(freshnessKey{}).(*freshness)
+	if f == nil {
+		return 0, 0, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.used {
+		return 0, 0, false
+	}
+	return f.age, max(0, time.Until(f.expires)), true
+}
+
+// WithRefresh returns a context whose reads skip cached values. Fresh
+// results are still stored for other requests.
+func WithRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refreshKey{}, true)
+}
+
+func refresh(ctx context.Context) bool {
+	skip, _ := ctx.Value(refreshKey{}).(bool)
+	return skip
+}
+
+func note(ctx context.Context, fetched time.Time, ttl time.Duration) {
+	f, _ := ctx.Value(freshnessKey{}).(*freshness)
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	age := time.Since(fetched)
+	expires := fetched.Add(ttl)
+	if !f.used || age > f.age {
+		f.age = age
+	}
+	if !f.used || expires.Before(f.expires) {
+		f.expires = expires
+	}
+	f.used = true
+}
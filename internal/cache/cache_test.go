@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetCachesUntilInvalidated(t *testing.T) {
+	c := New[int](time.Minute)
+	var loads atomic.Int32
+	load := func(context.Context) (int, error) {
+		return int(loads.Add(1)), nil
+	}
+
+	ctx := WithFreshness(context.Background())
+	for i := 0; i < 3; i++ {
+		if v, err := c.Get(ctx, "disks", load); err != nil || v != 1 {
+			t.Fatalf("expected the first load to be reused, got %d (%v)", v, err)
+		}
+	}
+	if _, maxAge, ok := Freshness(ctx); !ok || maxAge <= 58*time.Second {
+		t.Fatalf("expected the value to stay fresh for about a minute, got %v", maxAge)
+	}
+
+	if v, _ := c.Get(WithRefresh(context.Background()), "disks", load); v != 2 {
+		t.Fatalf("expected a refresh to load again, got %d", v)
+	}
+	if v, _ := c.Get(context.Background(), "disks", load); v != 2 {
+		t.Fatalf("expected the refreshed value to be kept, got %d", v)
+	}
+
+	c.Invalidate("disks")
+	if v, _ := c.Get(context.Background(), "disks", load); v != 3 {
+		t.Fatalf("expected a load after invalidation, got %d", v)
+	}
+}
+
+func TestGetSharesConcurrentLoads(t *testing.T) {
+	c := New[string](time.Minute)
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func(context.Context) (string, error) {
+		loads.Add(1)
+		<-release
+		return "sda", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get(context.Background(), "smart", load); err != nil || v != "sda" {
+				t.Errorf("unexpected result %q (%v)", v, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("expected one shared load, got %d", n)
+	}
+}
+
+func TestErrorsAndDisabledCacheAreNotKept(t *testing.T) {
+	c := New[int](time.Minute)
+	fail := errors.New("lsblk failed")
+	if _, err := c.Get(context.Background(), "disks", func(context.Context) (int, error) { return 0, fail }); !errors.Is(err, fail) {
+		t.Fatalf("expected the load error, got %v", err)
+	}
+	if v, _ := c.Get(context.Background(), "disks", func(context.Context) (int, error) { return 7, nil }); v != 7 {
+		t.Fatalf("expected the error not to be cached, got %d", v)
+	}
+
+	var disabled *Cache[int]
+	ctx := WithFreshness(context.Background())
+	for i := 1; i <= 2; i++ {
+		if v, _ := disabled.Get(ctx, "disks", func(context.Context) (int, error) { return i, nil }); v != i {
+			t.Fatalf("expected a nil cache to always load, got %d", v)
+		}
+	}
+	if _, maxAge, ok := Freshness(ctx); !ok || maxAge != 0 {
+		t.Fatalf("expected uncached reads to be stale at once, got %v %v", maxAge, ok)
+	}
+}
@@ -0,0 +1,293 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayHeader is set on proxied requests to the agent ID of the gateway.
+// Agents refuse to proxy requests that already carry it to prevent loops.
+const GatewayHeader = "X-Mingyue-Gateway"
+
+// ProxyPrefix is the path under which a gateway proxies sibling agent APIs:
+// /api/v1/cluster/proxy/<agent id>/api/v1/...
+const ProxyPrefix = "/api/v1/cluster/proxy/"
+
+// Peer represents a sibling agent known to the gateway
+type Peer struct {
+	ID       string    `json:"id"`
+	Hostname string    `json:"hostname,omitempty"`
+	URL      string    `json:"url"`
+	Source   string    `json:"source"` // mdns or static
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// Manager discovers sibling agents and proxies API calls to them
+type Manager struct {
+	agentID      string
+	announce     Announcement
+	advertise    bool
+	gateway      bool
+	interval     time.Duration
+	staleAfter   time.Duration
+	peerToken    string
+	peers        map[string]*Peer
+	mu           sync.RWMutex
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	refreshMu    sync.Mutex
+	browseWindow time.Duration
+}
+
+// Config represents cluster configuration
+type Config struct {
+	AgentID           string
+	Hostname          string
+	Port              int
+	TLS               bool
+	Advertise         bool              // Answer mDNS queries for this agent
+	Gateway           bool              // Discover siblings and proxy to them
+	StaticPeers       map[string]string // Agent ID to base URL, for networks without multicast
+	DiscoveryInterval time.Duration
+	PeerToken         string // Sent as X-API-Key to peers instead of the caller's credentials
+}
+
+// New creates a cluster manager. Call Start to advertise and discover.
+func New(cfg *Config) (*Manager, error) {
+	if cfg.AgentID == "" {
+		return nil, fmt.Errorf("agent ID is required")
+	}
+
+	interval := cfg.DiscoveryInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	scheme := "http"
+	if cfg.TLS {
+		scheme = "https"
+	}
+
+	m := &Manager{
+		agentID: cfg.AgentID,
+		announce: Announcement{
+			AgentID:  cfg.AgentID,
+			Hostname: cfg.Hostname,
+			Port:     cfg.Port,
+			Scheme:   scheme,
+		},
+		advertise:    cfg.Advertise,
+		gateway:      cfg.Gateway,
+		interval:     interval,
+		staleAfter:   3 * interval,
+		peerToken:    cfg.PeerToken,
+		peers:        make(map[string]*Peer),
+		browseWindow: 3 * time.Second,
+	}
+
+	for id, rawURL := range cfg.StaticPeers {
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid URL for peer %s: %s", id, rawURL)
+		}
+		m.peers[id] = &Peer{
+			ID:     id,
+			URL:    strings.TrimSuffix(rawURL, "/"),
+			Source: "static",
+			Online: true,
+		}
+	}
+
+	return m, nil
+}
+
+// Start begins advertising and, on gateways, periodic discovery
+func (m *Manager) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	if m.advertise {
+		responder, err := NewResponder(m.announce)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("start mDNS responder: %w", err)
+		}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			responder.Serve(ctx)
+		}()
+	}
+
+	if m.gateway {
+		m.wg.Add(1)
+		go m.discoveryLoop(ctx)
+	}
+
+	return nil
+}
+
+// Stop stops advertising and discovery
+func (m *Manager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// IsGateway reports whether this agent proxies to siblings
+func (m *Manager) IsGateway() bool {
+	return m.gateway
+}
+
+// ListPeers returns known sibling agents sorted by ID
+func (m *Manager) ListPeers() []*Peer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, peer := range m.peers {
+		copied := *peer
+		peers = append(peers, &copied)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+
+	return peers
+}
+
+// GetPeer returns a sibling agent by ID
+func (m *Manager) GetPeer(id string) (*Peer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	peer, exists := m.peers[id]
+	if !exists {
+		return nil, fmt.Errorf("agent %s not found", id)
+	}
+
+	copied := *peer
+	return &copied, nil
+}
+
+// Refresh browses for siblings now and returns the updated peer list.
+// Peers not seen for three discovery intervals are marked offline.
+func (m *Manager) Refresh(ctx context.Context) ([]*Peer, error) {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+
+	found, err := Browse(ctx, m.browseWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	for _, peer := range found {
+		if peer.ID == m.agentID {
+			continue
+		}
+		if existing, exists := m.peers[peer.ID]; exists && existing.Source == "static" {
+			existing.LastSeen = now
+			continue
+		}
+		peer.Online = true
+		peer.LastSeen = now
+		m.peers[peer.ID] = peer
+	}
+	for _, peer := range m.peers {
+		if peer.Source == "mdns" && now.Sub(peer.LastSeen) > m.staleAfter {
+			peer.Online = false
+		}
+	}
+	m.mu.Unlock()
+
+	return m.ListPeers(), nil
+}
+
+func (m *Manager) discoveryLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.Refresh(ctx); err != nil {
+			log.Printf("cluster discovery: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeProxy forwards /api/v1/cluster/proxy/<agent id>/<path> to <path> on
+// the sibling agent. It returns an error status when the peer is unknown or
+// the request has already passed through a gateway.
+func (m *Manager) ServeProxy(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Header.Get(GatewayHeader) != "" {
+		return http.StatusLoopDetected, fmt.Errorf("request was already proxied by %s", r.Header.Get(GatewayHeader))
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, ProxyPrefix)
+	id, path, _ := strings.Cut(rest, "/")
+	if id == "" || !strings.HasPrefix("/"+path, "/api/") {
+		return http.StatusBadRequest, fmt.Errorf("expected %s<agent id>/api/...", ProxyPrefix)
+	}
+
+	peer, err := m.GetPeer(id)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if !peer.Online {
+		return http.StatusBadGateway, fmt.Errorf("agent %s is offline", id)
+	}
+
+	target, err := url.Parse(peer.URL)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("invalid URL for agent %s: %w", id, err)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.URL.Path = "/" + path
+			pr.Out.URL.RawPath = ""
+			pr.SetXForwarded()
+			pr.Out.Header.Set(GatewayHeader, m.agentID)
+			if m.peerToken != "" {
+				pr.Out.Header.Del("Authorization")
+				pr.Out.Header.Set("X-API-Key", m.peerToken)
+			}
+		},
+		FlushInterval: -1, // Stream SSE and large downloads
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("cluster proxy to %s: %v", id, err)
+			body, _ := json.Marshal(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("agent %s unreachable", id),
+			})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write(body)
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+	return http.StatusOK, nil
+}
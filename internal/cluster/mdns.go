@@ -0,0 +1,307 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ServiceName is the DNS-SD service type agents advertise
+const ServiceName = "_mingyue-agent._tcp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Announcement is what an agent publishes over mDNS
+type Announcement struct {
+	AgentID  string
+	Hostname string
+	Port     int
+	Scheme   string
+}
+
+// instanceName returns the DNS-SD instance name for agentID, replacing
+// characters that are not allowed in a single DNS label
+func instanceName(agentID string) string {
+	label := strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' {
+			return '-'
+		}
+		return r
+	}, agentID)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label + "." + ServiceName
+}
+
+// Responder answers mDNS queries for the agent service on the local network
+type Responder struct {
+	conn     *net.UDPConn
+	announce Announcement
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+}
+
+// NewResponder joins the mDNS multicast group. Call Serve to answer queries.
+func NewResponder(announce Announcement) (*Responder, error) {
+	service, err := dnsmessage.NewName(ServiceName)
+	if err != nil {
+		return nil, fmt.Errorf("build service name: %w", err)
+	}
+	instance, err := dnsmessage.NewName(instanceName(announce.AgentID))
+	if err != nil {
+		return nil, fmt.Errorf("build instance name: %w", err)
+	}
+	host, err := dnsmessage.NewName(strings.SplitN(announce.Hostname, ".", 2)[0] + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("build host name: %w", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("join mDNS group: %w", err)
+	}
+
+	return &Responder{
+		conn:     conn,
+		announce: announce,
+		service:  service,
+		instance: instance,
+		host:     host,
+	}, nil
+}
+
+// Serve answers queries until ctx is cancelled
+func (r *Responder) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		r.conn.Close()
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("mdns responder: %v", err)
+			}
+			return
+		}
+
+		reply, ok := r.answer(buf[:n])
+		if !ok {
+			continue
+		}
+
+		// One-shot queriers send from an ephemeral port and expect a unicast
+		// reply; regular mDNS queriers listen on the group
+		dst := mdnsGroup
+		if src.Port != mdnsGroup.Port {
+			dst = src
+		}
+		r.conn.WriteToUDP(reply, dst)
+	}
+}
+
+// answer builds a response when query asks for the service or this instance
+func (r *Responder) answer(query []byte) ([]byte, bool) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil, false
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+
+	matched := false
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		if name == strings.ToLower(r.service.String()) || name == strings.ToLower(r.instance.String()) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil, false
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+	builder.EnableCompression()
+	if err := builder.StartAnswers(); err != nil {
+		return nil, false
+	}
+
+	ttl := uint32(120)
+	builder.PTRResource(dnsmessage.ResourceHeader{Name: r.service, Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.PTRResource{PTR: r.instance})
+
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, false
+	}
+	builder.SRVResource(dnsmessage.ResourceHeader{Name: r.instance, Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.SRVResource{Port: uint16(r.announce.Port), Target: r.host})
+	builder.TXTResource(dnsmessage.ResourceHeader{Name: r.instance, Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.TXTResource{TXT: []string{
+			"id=" + r.announce.AgentID,
+			"hostname=" + r.announce.Hostname,
+			"scheme=" + r.announce.Scheme,
+		}})
+	for _, ip := range localIPv4Addrs() {
+		var a [4]byte
+		copy(a[:], ip)
+		builder.AResource(dnsmessage.ResourceHeader{Name: r.host, Class: dnsmessage.ClassINET, TTL: ttl},
+			dnsmessage.AResource{A: a})
+	}
+
+	reply, err := builder.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
+
+// Browse sends a one-shot mDNS query for the agent service and collects the
+// peers that answer before timeout
+func Browse(ctx context.Context, timeout time.Duration) ([]*Peer, error) {
+	service, err := dnsmessage.NewName(ServiceName)
+	if err != nil {
+		return nil, fmt.Errorf("build service name: %w", err)
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("build query: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("open query socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("send query: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	peers := make(map[string]*Peer)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if peer := parseAnnouncement(buf[:n], src.IP); peer != nil {
+			peers[peer.ID] = peer
+		}
+	}
+
+	result := make([]*Peer, 0, len(peers))
+	for _, peer := range peers {
+		result = append(result, peer)
+	}
+	return result, nil
+}
+
+// parseAnnouncement extracts a peer from a response. The address is taken
+// from the packet source, which is reachable from this host by definition.
+func parseAnnouncement(msg []byte, src net.IP) *Peer {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil || !header.Response {
+		return nil
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil
+	}
+
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return nil
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return nil
+	}
+	additionals, err := parser.AllAdditionals()
+	if err != nil {
+		return nil
+	}
+
+	var port uint16
+	txt := make(map[string]string)
+	for _, rr := range append(answers, additionals...) {
+		if !strings.HasSuffix(strings.ToLower(rr.Header.Name.String()), ServiceName) {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.SRVResource:
+			port = body.Port
+		case *dnsmessage.TXTResource:
+			for _, entry := range body.TXT {
+				if key, value, ok := strings.Cut(entry, "="); ok {
+					txt[key] = value
+				}
+			}
+		}
+	}
+
+	if port == 0 || txt["id"] == "" {
+		return nil
+	}
+
+	scheme := txt["scheme"]
+	if scheme != "https" {
+		scheme = "http"
+	}
+
+	return &Peer{
+		ID:       txt["id"],
+		Hostname: txt["hostname"],
+		URL:      fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(src.String(), fmt.Sprint(port))),
+		Source:   "mdns",
+	}
+}
+
+func localIPv4Addrs() []net.IP {
+	var addrs []net.IP
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				if ip4 := ipNet.IP.To4(); ip4 != nil {
+					addrs = append(addrs, ip4)
+				}
+			}
+		}
+	}
+
+	return addrs
+}
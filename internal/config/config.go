@@ -2,19 +2,52 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultEncryptionKey is the placeholder netdisk credential key shipped in
+// the default configuration; deployments are expected to replace it
+const DefaultEncryptionKey = "change-this-to-a-secure-key-32b"
+
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	API      APIConfig      `yaml:"api"`
-	Audit    AuditConfig    `yaml:"audit"`
-	Security SecurityConfig `yaml:"security"`
-	NetDisk  NetDiskConfig  `yaml:"netdisk"`
-	Network  NetworkConfig  `yaml:"network"`
-	ShareMgr ShareMgrConfig `yaml:"sharemgr"`
+	Server    ServerConfig    `yaml:"server"`
+	API       APIConfig       `yaml:"api"`
+	Audit     AuditConfig     `yaml:"audit"`
+	Outbound  OutboundConfig  `yaml:"outbound"`
+	History   HistoryConfig   `yaml:"config_history"`
+	Security  SecurityConfig  `yaml:"security"`
+	Quota     QuotaConfig     `yaml:"quota"`
+	Scan      ScanConfig      `yaml:"scan"`
+	Versions  VersionsConfig  `yaml:"versions"`
+	NetDisk   NetDiskConfig   `yaml:"netdisk"`
+	Network   NetworkConfig   `yaml:"network"`
+	ShareMgr  ShareMgrConfig  `yaml:"sharemgr"`
+	Rsync     RsyncConfig     `yaml:"rsync"`
+	MQTT      MQTTConfig      `yaml:"mqtt"`
+	FTP       FTPConfig       `yaml:"ftp"`
+	SFTP      SFTPConfig      `yaml:"sftp"`
+	PortMap   PortMapConfig   `yaml:"portmap"`
+	WAN       WANConfig       `yaml:"wan"`
+	Telemetry TelemetryConfig `yaml:"telemetry"`
+	Crash     CrashConfig     `yaml:"crash"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Cluster   ClusterConfig   `yaml:"cluster"`
+	Plugins   PluginsConfig   `yaml:"plugins"`
+	Alerts    AlertsConfig    `yaml:"alerts"`
+	Reports   ReportsConfig   `yaml:"reports"`
+	Features  FeaturesConfig  `yaml:"features"`
+	Indexer   IndexerConfig   `yaml:"indexer"`
+	Ignore    IgnoreConfig    `yaml:"ignore"`
+	Resources ResourcesConfig `yaml:"resources"`
+	Cache     CacheConfig     `yaml:"cache"`
+	Disk      DiskConfig      `yaml:"disk"`
 }
 
 type ServerConfig struct {
@@ -22,6 +55,48 @@ type ServerConfig struct {
 	HTTPPort   int    `yaml:"http_port"`
 	GRPCPort   int    `yaml:"grpc_port"`
 	UDSPath    string `yaml:"uds_path"`
+	// UDSGroup may use the Unix socket, and its members are served without
+	// credentials like root and the agent's user; empty for none
+	UDSGroup string `yaml:"uds_group"`
+
+	// Listeners replace listen_addr and http_port for the HTTP API, to
+	// listen on several addresses, like 0.0.0.0:8080 and [::]:8080
+	Listeners []ListenerConfig `yaml:"listeners"`
+}
+
+// ListenerConfig is an address the HTTP API listens on
+type ListenerConfig struct {
+	Addr      string `yaml:"addr"`      // host:port; an IPv6 host goes in brackets
+	Interface string `yaml:"interface"` // Only accept connections arriving on this interface (Linux)
+	TLSCert   string `yaml:"tls_cert"`  // Defaults to api.tls_cert
+	TLSKey    string `yaml:"tls_key"`   // Defaults to api.tls_key
+	NoTLS     bool   `yaml:"no_tls"`    // Plain HTTP even if api.tls_cert is set
+}
+
+// TLS reports whether the listener serves HTTPS
+func (l ListenerConfig) TLS() bool {
+	return l.TLSCert != "" && l.TLSKey != ""
+}
+
+// HTTPListeners returns the listeners of the HTTP API with their TLS
+// files resolved: server.listeners if set, else listen_addr and http_port
+func (c *Config) HTTPListeners() []ListenerConfig {
+	listeners := c.Server.Listeners
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{Addr: net.JoinHostPort(c.Server.ListenAddr, strconv.Itoa(c.Server.HTTPPort))}}
+	}
+
+	resolved := make([]ListenerConfig, 0, len(listeners))
+	for _, l := range listeners {
+		switch {
+		case l.NoTLS:
+			l.TLSCert, l.TLSKey = "", ""
+		case l.TLSCert == "" && l.TLSKey == "":
+			l.TLSCert, l.TLSKey = c.API.TLSCert, c.API.TLSKey
+		}
+		resolved = append(resolved, l)
+	}
+	return resolved
 }
 
 type APIConfig struct {
@@ -33,19 +108,108 @@ type APIConfig struct {
 }
 
 type AuditConfig struct {
-	Enabled    bool   `yaml:"enabled"`
-	LogPath    string `yaml:"log_path"`
-	RemotePush bool   `yaml:"remote_push"`
-	RemoteURL  string `yaml:"remote_url"`
+	Enabled     bool   `yaml:"enabled"`
+	LogPath     string `yaml:"log_path"`
+	RemotePush  bool   `yaml:"remote_push"`
+	RemoteURL   string `yaml:"remote_url"`
+	WebhookFile string `yaml:"webhook_file"`
+}
+
+// OutboundConfig tunes the HTTP client shared by audit pushes, webhooks,
+// portal sync, crash reports and other outbound requests. Without Proxy,
+// proxies are taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+type OutboundConfig struct {
+	Proxy   string `yaml:"proxy"`    // http, https or socks5 URL
+	NoProxy string `yaml:"no_proxy"` // Hosts reached directly, like NO_PROXY
+
+	// Offline keeps the agent from connecting outside the local network,
+	// for deployments that must not talk to the internet. LAN services
+	// keep working; WAN monitoring is off.
+	Offline bool `yaml:"offline"`
+
+	MaxIdleConns           int                 `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost    int                 `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeoutSec     int                 `yaml:"idle_conn_timeout_sec"`
+	KeepAliveSec           int                 `yaml:"keepalive_sec"`
+	DialTimeoutSec         int                 `yaml:"dial_timeout_sec"`
+	TLSHandshakeTimeoutSec int                 `yaml:"tls_handshake_timeout_sec"`
+	CAFile                 string              `yaml:"ca_file"` // Certificates trusted besides the system's
+	Pins                   map[string][]string `yaml:"pins"`    // Host name to base64 SHA-256 digests of pinned public keys
+}
+
+// HistoryConfig configures the git repository recording every
+// configuration file the agent writes, like smb.conf and /etc/exports
+type HistoryConfig struct {
+	Dir string `yaml:"dir"` // Needs git; changes are not recorded if empty
 }
 
 type SecurityConfig struct {
-	EnableMTLS      bool     `yaml:"enable_mtls"`
-	TokenAuth       bool     `yaml:"token_auth"`
-	AllowedPaths    []string `yaml:"allowed_paths"`
-	MaxUploadSize   int64    `yaml:"max_upload_size"`
-	RateLimitPerMin int      `yaml:"rate_limit_per_min"`
-	RequireConfirm  bool     `yaml:"require_confirm"`
+	EnableMTLS        bool     `yaml:"enable_mtls"`
+	TokenAuth         bool     `yaml:"token_auth"`
+	AllowedPaths      []string `yaml:"allowed_paths"`
+	FollowSymlinks    bool     `yaml:"follow_escaping_symlinks"` // Let symlinks lead out of allowed_paths
+	MaxUploadSize     int64    `yaml:"max_upload_size"`
+	RateLimitPerMin   int      `yaml:"rate_limit_per_min"`
+	RequireConfirm    bool     `yaml:"require_confirm"`
+	UploadPolicyFile  string   `yaml:"upload_policy_file"`
+	UploadSessionDir  string   `yaml:"upload_session_dir"` // State of chunked uploads
+	UploadSessionTTL  int      `yaml:"upload_session_ttl_hours"`
+	TrashDir          string   `yaml:"trash_dir"` // Metadata of deleted files; empty deletes permanently
+	TrashRetention    int      `yaml:"trash_retention_days"`
+	MaintenanceFile   string   `yaml:"maintenance_file"`
+	AuthDB            string   `yaml:"auth_db"`
+	AuthDBKeyFile     string   `yaml:"auth_db_key_file"` // Encrypts token hashes and session details in auth_db
+	BanMaxFailures    int      `yaml:"ban_max_failures"`
+	BanWindowMin      int      `yaml:"ban_window_min"`
+	BanDurationMin    int      `yaml:"ban_duration_min"`
+	SessionExpiryMin  int      `yaml:"session_expiry_min"` // Idle time before a session expires
+	RefreshExpiryDays int      `yaml:"refresh_expiry_days"`
+	DownloadRateKBps  int      `yaml:"download_rate_kbps"` // Per token or source IP, 0 for unlimited
+	UploadRateKBps    int      `yaml:"upload_rate_kbps"`
+	TransferDownKBps  int      `yaml:"transfer_download_rate_kbps"` // Per download
+	TransferUpKBps    int      `yaml:"transfer_upload_rate_kbps"`
+	GlobalDownKBps    int      `yaml:"global_download_rate_kbps"` // All downloads together
+	GlobalUpKBps      int      `yaml:"global_upload_rate_kbps"`
+}
+
+// QuotaConfig limits the space users and directories may take through
+// uploads and copies of the file API. Quotas are off when none are listed.
+type QuotaConfig struct {
+	StateFile  string       `yaml:"state_file"`  // Files charged to each user
+	GraceHours int          `yaml:"grace_hours"` // How long soft limits may be exceeded
+	RescanSec  int          `yaml:"rescan_sec"`  // How long measured usage is reused
+	Users      []QuotaLimit `yaml:"users"`
+	Dirs       []QuotaLimit `yaml:"dirs"`
+}
+
+// QuotaLimit is the quota of a user or a directory in bytes; 0 is no limit
+type QuotaLimit struct {
+	Name       string `yaml:"name"` // User name, or directory path
+	Soft       int64  `yaml:"soft"`
+	Hard       int64  `yaml:"hard"`
+	GraceHours int    `yaml:"grace_hours"` // 0 uses quota.grace_hours
+}
+
+// ScanConfig configures malware scanning of uploads with ClamAV. Uploads
+// found infected are moved to the quarantine directory and rejected.
+type ScanConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	ClamdSocket   string `yaml:"clamd_socket"` // Unix socket path, or host:port of clamd
+	QuarantineDir string `yaml:"quarantine_dir"`
+	TimeoutSec    int    `yaml:"timeout_sec"`
+	MaxFileSizeMB int    `yaml:"max_file_size_mb"` // Larger uploads aren't scanned; keep within clamd's StreamMaxLength
+}
+
+// VersionsConfig keeps previous versions of files that uploads and edits
+// overwrite, in a .versions directory at the top of each listed directory
+type VersionsConfig struct {
+	Dirs []VersionDir `yaml:"dirs"`
+}
+
+// VersionDir keeps the last Keep versions of the files below Path
+type VersionDir struct {
+	Path string `yaml:"path"`
+	Keep int    `yaml:"keep"`
 }
 
 type NetDiskConfig struct {
@@ -53,19 +217,340 @@ type NetDiskConfig struct {
 	AllowedMountPoints []string `yaml:"allowed_mount_points"`
 	EncryptionKey      string   `yaml:"encryption_key"`
 	StateFile          string   `yaml:"state_file"`
+	MonitorIntervalSec int      `yaml:"monitor_interval_sec"`
+	MountTimeoutSec    int      `yaml:"mount_timeout_sec"`
+	CheckTimeoutSec    int      `yaml:"check_timeout_sec"`
+	DeleteGraceHours   int      `yaml:"delete_grace_hours"`
+	Namespace          bool     `yaml:"namespace"`        // Mount shares in a private mount namespace
+	NamespaceDir       string   `yaml:"namespace_dir"`    // Links to shares mounted in the namespace
+	IdleTimeoutMin     int      `yaml:"idle_timeout_min"` // Unmount on-demand shares unused this long
 }
 
 type NetworkConfig struct {
-	ManagementInterface string `yaml:"management_interface"`
-	HistoryFile         string `yaml:"history_file"`
+	ManagementInterface  string `yaml:"management_interface"`
+	WANInterface         string `yaml:"wan_interface"`
+	HistoryDB            string `yaml:"history_db"`
+	HistoryFile          string `yaml:"history_file"`           // Imported into history_db once
+	HistoryMaxEntries    int    `yaml:"history_max_entries"`    // 0 keeps all
+	HistoryRetentionDays int    `yaml:"history_retention_days"` // 0 keeps all
 }
 
 type ShareMgrConfig struct {
-	AllowedPaths []string `yaml:"allowed_paths"`
-	SambaConfig  string   `yaml:"samba_config"`
-	NFSConfig    string   `yaml:"nfs_config"`
-	BackupDir    string   `yaml:"backup_dir"`
-	StateFile    string   `yaml:"state_file"`
+	AllowedPaths       []string `yaml:"allowed_paths"`
+	SambaConfig        string   `yaml:"samba_config"`
+	NFSConfig          string   `yaml:"nfs_config"`
+	StateFile          string   `yaml:"state_file"`
+	TemplateDir        string   `yaml:"template_dir"`
+	SambaAudit         bool     `yaml:"samba_audit"`
+	SambaAuditLog      string   `yaml:"samba_audit_log"`
+	SambaAuditFacility string   `yaml:"samba_audit_facility"`
+	StatsFile          string   `yaml:"stats_file"`
+	StatsRetentionDays int      `yaml:"stats_retention_days"`
+	CheckTimeoutSec    int      `yaml:"check_timeout_sec"`
+	DeleteGraceHours   int      `yaml:"delete_grace_hours"`
+	DLNAConfig         string   `yaml:"dlna_config"` // minidlna.conf owned by the agent; DLNA is off if empty
+	DLNAFriendlyName   string   `yaml:"dlna_friendly_name"`
+	DLNAPort           int      `yaml:"dlna_port"`
+	DLNADBDir          string   `yaml:"dlna_db_dir"`
+	DLNAService        string   `yaml:"dlna_service"`
+}
+
+// RsyncConfig configures rsync daemon module management. Module paths are
+// limited to sharemgr.allowed_paths.
+type RsyncConfig struct {
+	ConfigFile  string `yaml:"config_file"`
+	SecretsFile string `yaml:"secrets_file"`
+	StateFile   string `yaml:"state_file"`
+	ServiceName string `yaml:"service_name"` // systemd unit of the daemon
+}
+
+type MQTTConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	Broker           string   `yaml:"broker"`
+	ClientID         string   `yaml:"client_id"`
+	Username         string   `yaml:"username"`
+	Password         string   `yaml:"password"`
+	AgentID          string   `yaml:"agent_id"`
+	TopicPrefix      string   `yaml:"topic_prefix"`
+	Retain           bool     `yaml:"retain"`
+	EventTypes       []string `yaml:"event_types"`
+	StatsIntervalSec int      `yaml:"stats_interval_sec"`
+	SMARTIntervalSec int      `yaml:"smart_interval_sec"`
+}
+
+// FTPConfig configures the FTP drop server for devices that only speak FTP
+type FTPConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	ListenAddr    string `yaml:"listen_addr"`
+	Port          int    `yaml:"port"`
+	DropDir       string `yaml:"drop_dir"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	PassivePorts  string `yaml:"passive_ports"` // Range like "50000-50100"; any free port if empty
+	PublicHost    string `yaml:"public_host"`   // IPv4 address announced for passive mode
+	TLSCert       string `yaml:"tls_cert"`      // Defaults to api.tls_cert
+	TLSKey        string `yaml:"tls_key"`       // Defaults to api.tls_key
+	RequireTLS    bool   `yaml:"require_tls"`
+	MaxUploadSize int64  `yaml:"max_upload_size"` // 0 uses security.max_upload_size
+}
+
+// PassiveRange parses PassivePorts; 0, 0 means any free port
+func (f FTPConfig) PassiveRange() (low, high int, err error) {
+	if f.PassivePorts == "" {
+		return 0, 0, nil
+	}
+	if _, err := fmt.Sscanf(f.PassivePorts, "%d-%d", &low, &high); err != nil {
+		return 0, 0, fmt.Errorf("invalid ftp.passive_ports %q", f.PassivePorts)
+	}
+	if low < 1024 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid ftp.passive_ports %q", f.PassivePorts)
+	}
+	return low, high, nil
+}
+
+// SFTPConfig configures the SFTP server for the allowed paths
+type SFTPConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	ListenAddr    string `yaml:"listen_addr"`
+	Port          int    `yaml:"port"`
+	HostKey       string `yaml:"host_key"`        // Generated if missing
+	MaxUploadSize int64  `yaml:"max_upload_size"` // 0 uses security.max_upload_size
+}
+
+// PortMapConfig configures port mappings on the home router. Mappings are
+// only requested through the API.
+type PortMapConfig struct {
+	Method    string `yaml:"method"`  // auto, upnp or natpmp
+	Gateway   string `yaml:"gateway"` // NAT-PMP gateway; the default route if empty
+	LeaseSec  int    `yaml:"lease_sec"`
+	StateFile string `yaml:"state_file"`
+}
+
+// WANConfig configures internet quality monitoring. Thresholds of 0 are
+// disabled.
+type WANConfig struct {
+	Targets         []string `yaml:"targets"` // Hosts to ping, or host:port to time TCP connects
+	IntervalSec     int      `yaml:"interval_sec"`
+	Samples         int      `yaml:"samples"`
+	TimeoutMs       int      `yaml:"timeout_ms"`
+	LatencyMs       float64  `yaml:"latency_ms"`
+	JitterMs        float64  `yaml:"jitter_ms"`
+	LossPercent     float64  `yaml:"loss_percent"`
+	SpeedtestURL    string   `yaml:"speedtest_url"` // Speedtests are disabled if empty
+	SpeedtestMaxMB  int      `yaml:"speedtest_max_mb"`
+	MinDownloadMbps float64  `yaml:"min_download_mbps"`
+	HistoryFile     string   `yaml:"history_file"`
+	RetentionDays   int      `yaml:"retention_days"`
+}
+
+// TelemetryConfig configures request tracing. Per-endpoint request metrics
+// are always collected.
+type TelemetryConfig struct {
+	Tracing       bool              `yaml:"tracing"`
+	OTLPEndpoint  string            `yaml:"otlp_endpoint"` // OTLP/HTTP collector; traces are only kept locally if empty
+	OTLPHeaders   map[string]string `yaml:"otlp_headers"`
+	ServiceName   string            `yaml:"service_name"`
+	SampleRatio   float64           `yaml:"sample_ratio"` // Share of traces exported
+	SlowRequestMs int               `yaml:"slow_request_ms"`
+	SlowKeep      int               `yaml:"slow_keep"`
+}
+
+// CrashConfig configures crash reports
+type CrashConfig struct {
+	Dir          string `yaml:"dir"`
+	SubmitURL    string `yaml:"submit_url"` // Reports are only kept locally if empty
+	SubmitToken  string `yaml:"submit_token"`
+	LogTailLines int    `yaml:"log_tail_lines"`
+	Keep         int    `yaml:"keep"`
+}
+
+type SchedulerConfig struct {
+	DBPath          string `yaml:"db_path"`
+	PortalURL       string `yaml:"portal_url"`
+	PortalToken     string `yaml:"portal_token"`
+	AgentID         string `yaml:"agent_id"`
+	SyncIntervalSec int    `yaml:"sync_interval_sec"`
+	SyncStateFile   string `yaml:"sync_state_file"`
+	RulesFile       string `yaml:"rules_file"` // File-event automation rules
+	// Windows in which no task is started on schedule
+	Blackouts []BlackoutWindow `yaml:"blackouts"`
+	// Runs without a heartbeat for this long are reported as stalled, and
+	// canceled if cancel_stalled is set; 0 disables stall detection
+	StallTimeoutSec int  `yaml:"stall_timeout_sec"`
+	CancelStalled   bool `yaml:"cancel_stalled"`
+}
+
+// BlackoutWindow is a daily HH:MM-HH:MM window, optionally limited to some
+// weekdays
+type BlackoutWindow struct {
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+	Days  []string `yaml:"days"`
+}
+
+type ClusterConfig struct {
+	AgentID              string            `yaml:"agent_id"`
+	Advertise            bool              `yaml:"advertise"`
+	Gateway              bool              `yaml:"gateway"`
+	StaticPeers          map[string]string `yaml:"static_peers"`
+	DiscoveryIntervalSec int               `yaml:"discovery_interval_sec"`
+	PeerToken            string            `yaml:"peer_token"`
+}
+
+type PluginsConfig struct {
+	SocketDir string         `yaml:"socket_dir"`
+	Entries   []PluginConfig `yaml:"entries"`
+}
+
+type PluginConfig struct {
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	Env     []string `yaml:"env"`
+	Enabled bool     `yaml:"enabled"`
+}
+
+// AlertsConfig configures the alert center. Disk space and SMART health are
+// sampled at the MQTT stats and SMART intervals.
+type AlertsConfig struct {
+	StateFile      string  `yaml:"state_file"`
+	LowDiskPercent float64 `yaml:"low_disk_percent"` // Root filesystem usage that raises an alert
+	RetentionDays  int     `yaml:"retention_days"`   // How long resolved alerts are listed
+}
+
+// ReportsConfig configures generated reports. Reports are produced by
+// scheduler tasks of type "report" or on request.
+type ReportsConfig struct {
+	Dir  string `yaml:"dir"`  // Browsable through the files API
+	Keep int    `yaml:"keep"` // Number of reports kept
+}
+
+// FeaturesConfig enables or disables subsystems. Routes of disabled
+// subsystems are not registered and their managers are not started.
+type FeaturesConfig struct {
+	Monitor   bool `yaml:"monitor"`
+	Files     bool `yaml:"files"`
+	Disks     bool `yaml:"disks"`
+	NetDisk   bool `yaml:"netdisk"`
+	Network   bool `yaml:"network"`
+	ShareMgr  bool `yaml:"sharemgr"`
+	Rsync     bool `yaml:"rsync"`
+	PortMap   bool `yaml:"portmap"`
+	WAN       bool `yaml:"wan"`
+	Indexer   bool `yaml:"indexer"`
+	Scheduler bool `yaml:"scheduler"`
+	Advisor   bool `yaml:"advisor"`
+	Events    bool `yaml:"events"`
+	Webhooks  bool `yaml:"webhooks"`
+	Alerts    bool `yaml:"alerts"`
+	Reports   bool `yaml:"reports"`
+	Query     bool `yaml:"query"`
+	Rules     bool `yaml:"rules"`
+	WebDAV    bool `yaml:"webdav"` // Serves the allowed paths at /webdav/; needs files
+}
+
+// Map returns the subsystem switches keyed by their config names
+func (f FeaturesConfig) Map() map[string]bool {
+	return map[string]bool{
+		"monitor":   f.Monitor,
+		"files":     f.Files,
+		"disks":     f.Disks,
+		"netdisk":   f.NetDisk,
+		"network":   f.Network,
+		"sharemgr":  f.ShareMgr,
+		"rsync":     f.Rsync,
+		"portmap":   f.PortMap,
+		"wan":       f.WAN,
+		"indexer":   f.Indexer,
+		"scheduler": f.Scheduler,
+		"advisor":   f.Advisor,
+		"events":    f.Events,
+		"webhooks":  f.Webhooks,
+		"alerts":    f.Alerts,
+		"reports":   f.Reports,
+		"query":     f.Query,
+		"rules":     f.Rules,
+		"webdav":    f.WebDAV,
+	}
+}
+
+type IndexerConfig struct {
+	DBPath       string       `yaml:"db_path"`
+	ThumbnailDir string       `yaml:"thumbnail_dir"`
+	HashFiles    bool         `yaml:"hash_files"`
+	Enrich       EnrichConfig `yaml:"enrich"`
+}
+
+// IgnoreConfig lists glob patterns of files and directories the indexer,
+// the file watcher and usage reports leave out, on top of the
+// .mingyueignore files in directories. Patterns without a slash match
+// names at any depth; others match absolute paths.
+type IgnoreConfig struct {
+	Patterns []string `yaml:"patterns"`
+}
+
+// EnrichConfig sends indexed images to an external machine learning
+// service, which returns tags and faces to store in the index
+type EnrichConfig struct {
+	URL        string `yaml:"url"` // Enrichment is disabled if empty
+	Token      string `yaml:"token"`
+	TimeoutSec int    `yaml:"timeout_sec"`
+	MaxSizeMB  int    `yaml:"max_size_mb"` // Larger images are not sent
+}
+
+// Resource profiles
+const (
+	ProfileStandard  = "standard"
+	ProfileLowMemory = "low_memory"
+)
+
+// ResourcesConfig bounds memory and CPU use. The profile sets defaults for
+// these and for other resource-related settings; values set explicitly in
+// the config file take precedence over the profile.
+type ResourcesConfig struct {
+	Profile       string `yaml:"profile"`
+	SQLiteCacheKB int    `yaml:"sqlite_cache_kb"` // 0 uses the SQLite default
+	MaxWorkers    int    `yaml:"max_workers"`     // 0 uses each subsystem's default
+}
+
+// CacheConfig sets how long expensive reads are reused; 0 disables caching
+type CacheConfig struct {
+	DiskTTLSec    int `yaml:"disk_ttl_sec"` // Disk and partition listings
+	SMARTTTLSec   int `yaml:"smart_ttl_sec"`
+	NetworkTTLSec int `yaml:"network_ttl_sec"` // Interface listings
+	UsageTTLSec   int `yaml:"usage_ttl_sec"`   // Directory usage reports
+}
+
+// DiskConfig configures disk management. Remembered LUKS passphrases are
+// encrypted with netdisk.encryption_key, like network share passwords.
+type DiskConfig struct {
+	KeyfileDir   string `yaml:"keyfile_dir"`    // LUKS key files are only read from here
+	LUKSKeysFile string `yaml:"luks_keys_file"` // Remembered LUKS keys
+}
+
+// applyProfile sets the defaults of a resource profile
+func (c *Config) applyProfile(profile string) error {
+	switch profile {
+	case "":
+		// Keep the default profile
+		return nil
+	case ProfileStandard:
+	case ProfileLowMemory:
+		// Raspberry Pi class devices: avoid reading every file during
+		// scans, keep SQLite caches small and poll less often
+		c.Indexer.HashFiles = false
+		c.Resources.SQLiteCacheKB = 512
+		c.Resources.MaxWorkers = 1
+		c.NetDisk.MonitorIntervalSec = 300
+		c.MQTT.StatsIntervalSec = 300
+		c.MQTT.SMARTIntervalSec = 6 * 3600
+		c.Cluster.DiscoveryIntervalSec = 300
+		c.WAN.IntervalSec = 900
+	default:
+		return fmt.Errorf("unknown resources.profile: %s", profile)
+	}
+	c.Resources.Profile = profile
+	return nil
 }
 
 func Load(path string) (*Config, error) {
@@ -83,6 +568,19 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("read config file: %w", err)
 	}
 
+	// Apply the profile's defaults first so explicit settings override them
+	var profile struct {
+		Resources struct {
+			Profile string `yaml:"profile"`
+		} `yaml:"resources"`
+	}
+	if err := yaml.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("parse config file: %w", err)
+	}
+	if err := cfg.applyProfile(profile.Resources.Profile); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parse config file: %w", err)
 	}
@@ -95,6 +593,8 @@ func Load(path string) (*Config, error) {
 }
 
 func defaultConfig() *Config {
+	linux := runtime.GOOS == "linux"
+
 	return &Config{
 		Server: ServerConfig{
 			ListenAddr: "0.0.0.0",
@@ -108,36 +608,260 @@ func defaultConfig() *Config {
 			EnableUDS:  true,
 		},
 		Audit: AuditConfig{
-			Enabled:    true,
-			LogPath:    "/var/log/mingyue-agent/audit.log",
-			RemotePush: false,
+			Enabled:     true,
+			LogPath:     "/var/log/mingyue-agent/audit.log",
+			RemotePush:  false,
+			WebhookFile: "/var/lib/mingyue-agent/webhooks.json",
+		},
+		Outbound: OutboundConfig{
+			MaxIdleConns:           100,
+			MaxIdleConnsPerHost:    10,
+			IdleConnTimeoutSec:     90,
+			KeepAliveSec:           30,
+			DialTimeoutSec:         10,
+			TLSHandshakeTimeoutSec: 10,
+		},
+		History: HistoryConfig{
+			Dir: "/var/lib/mingyue-agent/config-history",
 		},
 		Security: SecurityConfig{
-			EnableMTLS:      false,
-			TokenAuth:       true,
-			AllowedPaths:    []string{"/home", "/data"},
-			MaxUploadSize:   10 * 1024 * 1024 * 1024,
-			RateLimitPerMin: 1000,
-			RequireConfirm:  true,
+			EnableMTLS:        false,
+			TokenAuth:         true,
+			AllowedPaths:      []string{"/home", "/data"},
+			MaxUploadSize:     10 * 1024 * 1024 * 1024,
+			RateLimitPerMin:   1000,
+			RequireConfirm:    true,
+			UploadPolicyFile:  "/var/lib/mingyue-agent/upload-policies.json",
+			UploadSessionDir:  "/var/lib/mingyue-agent/upload-sessions",
+			UploadSessionTTL:  24,
+			TrashDir:          "/var/lib/mingyue-agent/trash",
+			TrashRetention:    30,
+			MaintenanceFile:   "/var/lib/mingyue-agent/maintenance.json",
+			AuthDB:            "/var/lib/mingyue-agent/auth.db",
+			BanMaxFailures:    5,
+			BanWindowMin:      10,
+			BanDurationMin:    30,
+			SessionExpiryMin:  1440,
+			RefreshExpiryDays: 30,
+		},
+		Quota: QuotaConfig{
+			StateFile:  "/var/lib/mingyue-agent/quota.json",
+			GraceHours: 168,
+			RescanSec:  300,
+		},
+		Scan: ScanConfig{
+			ClamdSocket:   "/run/clamav/clamd.ctl",
+			QuarantineDir: "/var/lib/mingyue-agent/quarantine",
+			TimeoutSec:    60,
+			MaxFileSizeMB: 25,
 		},
 		NetDisk: NetDiskConfig{
 			AllowedHosts:       []string{"*"},
 			AllowedMountPoints: []string{"/mnt", "/media"},
-			EncryptionKey:      "change-this-to-a-secure-key-32b",
+			EncryptionKey:      DefaultEncryptionKey,
 			StateFile:          "/var/lib/mingyue-agent/netdisk-state.json",
+			MonitorIntervalSec: 60,
+			MountTimeoutSec:    30,
+			CheckTimeoutSec:    10,
+			DeleteGraceHours:   24,
+			NamespaceDir:       "/run/mingyue-agent/netdisk",
+			IdleTimeoutMin:     10,
 		},
 		Network: NetworkConfig{
 			ManagementInterface: "",
+			HistoryDB:           "/var/lib/mingyue-agent/network-history.db",
 			HistoryFile:         "/var/lib/mingyue-agent/network-history.json",
+			HistoryMaxEntries:   1000,
 		},
 		ShareMgr: ShareMgrConfig{
-			AllowedPaths: []string{"/home", "/data", "/mnt", "/media"},
-			SambaConfig:  "/etc/samba/smb.conf",
-			NFSConfig:    "/etc/exports",
-			BackupDir:    "/var/lib/mingyue-agent/share-backups",
-			StateFile:    "/var/lib/mingyue-agent/share-state.json",
+			AllowedPaths:       []string{"/home", "/data", "/mnt", "/media"},
+			SambaConfig:        "/etc/samba/smb.conf",
+			NFSConfig:          "/etc/exports",
+			StateFile:          "/var/lib/mingyue-agent/share-state.json",
+			TemplateDir:        "/etc/mingyue-agent/share-templates",
+			SambaAudit:         false,
+			SambaAuditLog:      "/var/log/samba/audit.log",
+			SambaAuditFacility: "local5",
+			StatsFile:          "/var/lib/mingyue-agent/share-stats.json",
+			StatsRetentionDays: 90,
+			CheckTimeoutSec:    10,
+			DeleteGraceHours:   24,
+			DLNAPort:           8200,
+			DLNADBDir:          "/var/cache/minidlna",
+			DLNAService:        "minidlna",
+		},
+		Rsync: RsyncConfig{
+			ConfigFile:  "/etc/rsyncd.conf",
+			SecretsFile: "/etc/rsyncd.secrets",
+			StateFile:   "/var/lib/mingyue-agent/rsync-state.json",
+			ServiceName: "rsync",
+		},
+		MQTT: MQTTConfig{
+			Enabled:          false,
+			Broker:           "tcp://localhost:1883",
+			Retain:           true,
+			EventTypes:       []string{"system.*", "disk.*", "share.*", "netdisk.*"},
+			StatsIntervalSec: 60,
+			SMARTIntervalSec: 1800,
+		},
+		FTP: FTPConfig{
+			Enabled:      false,
+			ListenAddr:   "0.0.0.0",
+			Port:         2121,
+			DropDir:      "/data/ftp-drop",
+			Username:     "scanner",
+			PassivePorts: "50000-50100",
+		},
+		SFTP: SFTPConfig{
+			Enabled:    false,
+			ListenAddr: "0.0.0.0",
+			Port:       2022,
+			HostKey:    "/var/lib/mingyue-agent/ssh_host_ed25519_key",
+		},
+		PortMap: PortMapConfig{
+			Method:    "auto",
+			LeaseSec:  3600,
+			StateFile: "/var/lib/mingyue-agent/portmap-state.json",
+		},
+		WAN: WANConfig{
+			Targets:        []string{"1.1.1.1", "8.8.8.8"},
+			IntervalSec:    300,
+			Samples:        10,
+			TimeoutMs:      1000,
+			LatencyMs:      100,
+			JitterMs:       30,
+			LossPercent:    5,
+			SpeedtestMaxMB: 25,
+			HistoryFile:    "/var/lib/mingyue-agent/wan-history.json",
+			RetentionDays:  7,
+		},
+		Telemetry: TelemetryConfig{
+			Tracing:       false,
+			ServiceName:   "mingyue-agent",
+			SampleRatio:   1,
+			SlowRequestMs: 1000,
+			SlowKeep:      50,
+		},
+		Crash: CrashConfig{
+			Dir:          "/var/lib/mingyue-agent/crashes",
+			LogTailLines: 200,
+			Keep:         20,
+		},
+		Scheduler: SchedulerConfig{
+			DBPath:          "/var/lib/mingyue-agent/scheduler.db",
+			SyncIntervalSec: 300,
+			SyncStateFile:   "/var/lib/mingyue-agent/scheduler-sync.json",
+			RulesFile:       "/var/lib/mingyue-agent/rules.json",
+			StallTimeoutSec: 1800,
+		},
+		Cluster: ClusterConfig{
+			Advertise:            false,
+			Gateway:              false,
+			DiscoveryIntervalSec: 60,
+		},
+		Plugins: PluginsConfig{
+			SocketDir: "/run/mingyue-agent/plugins",
 		},
+		Alerts: AlertsConfig{
+			StateFile:      "/var/lib/mingyue-agent/alerts.json",
+			LowDiskPercent: 90,
+			RetentionDays:  7,
+		},
+		Reports: ReportsConfig{
+			Dir:  "/var/lib/mingyue-agent/reports",
+			Keep: 30,
+		},
+		// Disk, mount, network and share management drive Linux tools, so
+		// other systems default to file management and monitoring
+		Features: FeaturesConfig{
+			Monitor:   true,
+			Files:     true,
+			Disks:     linux,
+			NetDisk:   linux,
+			Network:   linux,
+			ShareMgr:  linux,
+			Rsync:     false, // Takes over rsyncd.conf, so it is opt-in
+			PortMap:   false, // Opens ports on the router, so it is opt-in
+			WAN:       false, // Sends traffic to outside hosts, so it is opt-in
+			Indexer:   false,
+			Scheduler: true,
+			Advisor:   true,
+			Events:    true,
+			Webhooks:  true,
+			Alerts:    true,
+			Reports:   true,
+			Query:     true,
+			Rules:     true,
+			WebDAV:    false, // Another way for tokens into the files, so it is opt-in
+		},
+		Indexer: IndexerConfig{
+			DBPath:       "/var/lib/mingyue-agent/indexer.db",
+			ThumbnailDir: "/var/cache/mingyue-agent/thumbnails",
+			HashFiles:    true,
+			Enrich: EnrichConfig{
+				TimeoutSec: 30,
+				MaxSizeMB:  25,
+			},
+		},
+		Ignore: IgnoreConfig{
+			Patterns: []string{"node_modules", ".git", "@eaDir", "#recycle"},
+		},
+		Resources: ResourcesConfig{
+			Profile: ProfileStandard,
+		},
+		Cache: CacheConfig{
+			DiskTTLSec:    15,
+			SMARTTTLSec:   300,
+			NetworkTTLSec: 5,
+			UsageTTLSec:   300,
+		},
+		Disk: DiskConfig{
+			KeyfileDir:   "/etc/mingyue-agent/keys",
+			LUKSKeysFile: "/var/lib/mingyue-agent/luks-keys.json",
+		},
+	}
+}
+
+// validateListeners checks server.listeners
+func (c *Config) validateListeners() error {
+	seen := make(map[string]bool)
+	for i, l := range c.Server.Listeners {
+		host, port, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid server.listeners[%d].addr %q: %w", i, l.Addr, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid server.listeners[%d].addr %q: bad port", i, l.Addr)
+		}
+		if host != "" && net.ParseIP(host) == nil && host != "localhost" {
+			return fmt.Errorf("invalid server.listeners[%d].addr %q: host must be an IP address", i, l.Addr)
+		}
+		if l.Interface != "" && runtime.GOOS != "linux" {
+			return fmt.Errorf("server.listeners[%d].interface is only supported on Linux", i)
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			return fmt.Errorf("server.listeners[%d]: tls_cert and tls_key must both be set or both be empty", i)
+		}
+		key := l.Interface + "/" + l.Addr
+		if seen[key] {
+			return fmt.Errorf("server.listeners[%d]: %s is listed twice", i, l.Addr)
+		}
+		seen[key] = true
 	}
+	if !c.API.EnableHTTP {
+		return nil
+	}
+	for _, l := range c.Server.Listeners {
+		for _, file := range []string{l.TLSCert, l.TLSKey} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Addr, err)
+			}
+		}
+	}
+	return nil
 }
 
 func (c *Config) Validate() error {
@@ -150,6 +874,9 @@ func (c *Config) Validate() error {
 	if (c.API.TLSCert == "") != (c.API.TLSKey == "") {
 		return fmt.Errorf("tls_cert and tls_key must both be set or both be empty")
 	}
+	if err := c.validateListeners(); err != nil {
+		return err
+	}
 	if c.API.EnableHTTP && c.API.TLSCert != "" {
 		if _, err := os.Stat(c.API.TLSCert); err != nil {
 			return fmt.Errorf("tls_cert not found: %w", err)
@@ -160,6 +887,136 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("tls_key not found: %w", err)
 		}
 	}
+	if c.MQTT.Enabled && c.MQTT.Broker == "" {
+		return fmt.Errorf("mqtt.broker is required when mqtt is enabled")
+	}
+	if c.ShareMgr.DLNAConfig != "" {
+		if c.ShareMgr.DLNAPort < 1 || c.ShareMgr.DLNAPort > 65535 {
+			return fmt.Errorf("invalid sharemgr.dlna_port: %d", c.ShareMgr.DLNAPort)
+		}
+		if strings.ContainsAny(c.ShareMgr.DLNAFriendlyName, "\r\n") {
+			return fmt.Errorf("sharemgr.dlna_friendly_name must be a single line")
+		}
+	}
+	switch c.PortMap.Method {
+	case "auto", "upnp", "natpmp":
+	default:
+		return fmt.Errorf("invalid portmap.method %q: expected auto, upnp or natpmp", c.PortMap.Method)
+	}
+	if c.PortMap.LeaseSec < 60 {
+		return fmt.Errorf("portmap.lease_sec must be at least 60")
+	}
+	if c.Telemetry.SampleRatio < 0 || c.Telemetry.SampleRatio > 1 {
+		return fmt.Errorf("telemetry.sample_ratio must be between 0 and 1")
+	}
+	if c.Telemetry.Tracing && c.Telemetry.OTLPEndpoint != "" && !strings.HasPrefix(c.Telemetry.OTLPEndpoint, "http://") && !strings.HasPrefix(c.Telemetry.OTLPEndpoint, "https://") {
+		return fmt.Errorf("telemetry.otlp_endpoint must be an http or https url")
+	}
+	if c.Indexer.Enrich.URL != "" && !strings.HasPrefix(c.Indexer.Enrich.URL, "http://") && !strings.HasPrefix(c.Indexer.Enrich.URL, "https://") {
+		return fmt.Errorf("indexer.enrich.url must be an http or https url")
+	}
+	if c.Indexer.Enrich.TimeoutSec < 1 || c.Indexer.Enrich.MaxSizeMB < 0 {
+		return fmt.Errorf("indexer.enrich.timeout_sec must be at least 1 and indexer.enrich.max_size_mb must not be negative")
+	}
+	if c.Outbound.MaxIdleConns < 1 || c.Outbound.MaxIdleConnsPerHost < 1 {
+		return fmt.Errorf("outbound.max_idle_conns and outbound.max_idle_conns_per_host must be at least 1")
+	}
+	if c.Outbound.IdleConnTimeoutSec < 1 || c.Outbound.KeepAliveSec < 1 || c.Outbound.DialTimeoutSec < 1 || c.Outbound.TLSHandshakeTimeoutSec < 1 {
+		return fmt.Errorf("outbound timeouts must be at least 1 second")
+	}
+	if c.Outbound.Proxy != "" && !strings.HasPrefix(c.Outbound.Proxy, "http://") && !strings.HasPrefix(c.Outbound.Proxy, "https://") && !strings.HasPrefix(c.Outbound.Proxy, "socks5://") {
+		return fmt.Errorf("outbound.proxy must be an http, https or socks5 url")
+	}
+	if c.Outbound.CAFile != "" && !filepath.IsAbs(c.Outbound.CAFile) {
+		return fmt.Errorf("outbound.ca_file must be an absolute path")
+	}
+	if c.Crash.SubmitURL != "" && !strings.HasPrefix(c.Crash.SubmitURL, "http://") && !strings.HasPrefix(c.Crash.SubmitURL, "https://") {
+		return fmt.Errorf("crash.submit_url must be an http or https url")
+	}
+	if c.Crash.LogTailLines < 0 || c.Crash.Keep < 1 {
+		return fmt.Errorf("crash.log_tail_lines must not be negative and crash.keep must be at least 1")
+	}
+	if c.Cache.DiskTTLSec < 0 || c.Cache.SMARTTTLSec < 0 || c.Cache.NetworkTTLSec < 0 || c.Cache.UsageTTLSec < 0 {
+		return fmt.Errorf("cache ttls must not be negative")
+	}
+	if c.Scheduler.StallTimeoutSec < 0 {
+		return fmt.Errorf("scheduler.stall_timeout_sec must not be negative")
+	}
+	if c.Security.UploadSessionTTL < 1 {
+		return fmt.Errorf("security.upload_session_ttl_hours must be at least 1")
+	}
+	if c.Security.TrashRetention < 0 {
+		return fmt.Errorf("security.trash_retention_days must not be negative")
+	}
+	if c.Quota.GraceHours < 0 || c.Quota.RescanSec < 0 {
+		return fmt.Errorf("quota.grace_hours and quota.rescan_sec must not be negative")
+	}
+	for _, limit := range append(append([]QuotaLimit{}, c.Quota.Users...), c.Quota.Dirs...) {
+		if limit.Name == "" {
+			return fmt.Errorf("quota limits need a name")
+		}
+		if limit.Soft < 0 || limit.Hard < 0 || limit.GraceHours < 0 {
+			return fmt.Errorf("quota of %s must not be negative", limit.Name)
+		}
+		if limit.Soft > 0 && limit.Hard > 0 && limit.Soft > limit.Hard {
+			return fmt.Errorf("soft quota of %s exceeds its hard quota", limit.Name)
+		}
+	}
+	if c.Scan.Enabled {
+		if c.Scan.ClamdSocket == "" || c.Scan.QuarantineDir == "" {
+			return fmt.Errorf("scan.clamd_socket and scan.quarantine_dir are required when scan is enabled")
+		}
+		if c.Scan.TimeoutSec < 1 || c.Scan.MaxFileSizeMB < 0 {
+			return fmt.Errorf("scan.timeout_sec must be at least 1 and scan.max_file_size_mb must not be negative")
+		}
+	}
+	for _, dir := range c.Versions.Dirs {
+		if dir.Path == "" || !filepath.IsAbs(dir.Path) {
+			return fmt.Errorf("versions.dirs need an absolute path")
+		}
+		if dir.Keep < 1 {
+			return fmt.Errorf("versions of %s: keep must be at least 1", dir.Path)
+		}
+	}
+	if c.WAN.IntervalSec < 60 {
+		return fmt.Errorf("wan.interval_sec must be at least 60")
+	}
+	if c.WAN.Samples < 1 || c.WAN.Samples > 100 {
+		return fmt.Errorf("wan.samples must be 1-100")
+	}
+	if c.WAN.SpeedtestURL != "" && !strings.HasPrefix(c.WAN.SpeedtestURL, "http://") && !strings.HasPrefix(c.WAN.SpeedtestURL, "https://") {
+		return fmt.Errorf("wan.speedtest_url must be an http or https url")
+	}
+	if c.FTP.Enabled {
+		if c.FTP.Port < 1 || c.FTP.Port > 65535 {
+			return fmt.Errorf("invalid ftp.port: %d", c.FTP.Port)
+		}
+		if c.FTP.DropDir == "" || c.FTP.Username == "" || c.FTP.Password == "" {
+			return fmt.Errorf("ftp.drop_dir, ftp.username and ftp.password are required when ftp is enabled")
+		}
+		if _, _, err := c.FTP.PassiveRange(); err != nil {
+			return err
+		}
+	}
+	if c.SFTP.Enabled {
+		if c.SFTP.Port < 1 || c.SFTP.Port > 65535 {
+			return fmt.Errorf("invalid sftp.port: %d", c.SFTP.Port)
+		}
+		if c.SFTP.HostKey == "" {
+			return fmt.Errorf("sftp.host_key is required when sftp is enabled")
+		}
+		if !c.Features.Files {
+			return fmt.Errorf("sftp requires features.files")
+		}
+	}
+	if c.Security.DownloadRateKBps < 0 || c.Security.UploadRateKBps < 0 ||
+		c.Security.TransferDownKBps < 0 || c.Security.TransferUpKBps < 0 ||
+		c.Security.GlobalDownKBps < 0 || c.Security.GlobalUpKBps < 0 {
+		return fmt.Errorf("download and upload rate limits must not be negative")
+	}
+	if c.Alerts.LowDiskPercent <= 0 || c.Alerts.LowDiskPercent > 100 {
+		return fmt.Errorf("invalid alerts.low_disk_percent: %g", c.Alerts.LowDiskPercent)
+	}
 	return nil
 }
 
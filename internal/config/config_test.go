@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestDefaultFeaturesFollowOS(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	linux := runtime.GOOS == "linux"
+	features := cfg.Features
+	if !features.Monitor || !features.Files || !features.Scheduler {
+		t.Fatalf("expected portable features on by default on %s: %+v", runtime.GOOS, features)
+	}
+	if features.Disks != linux || features.NetDisk != linux || features.Network != linux || features.ShareMgr != linux {
+		t.Fatalf("expected Linux-only features to be %v on %s: %+v", linux, runtime.GOOS, features)
+	}
+
+	// Explicit settings still win
+	cfg, err = Load(writeConfig(t, "features:\n  disks: true\n  files: false\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !cfg.Features.Disks || cfg.Features.Files {
+		t.Fatalf("expected the file to override the defaults: %+v", cfg.Features)
+	}
+}
+
+func TestLowMemoryProfile(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "resources:\n  profile: low_memory\nwan:\n  interval_sec: 60\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if cfg.Resources.Profile != ProfileLowMemory || cfg.Resources.SQLiteCacheKB != 512 || cfg.Resources.MaxWorkers != 1 {
+		t.Fatalf("expected the low-memory resource limits, got %+v", cfg.Resources)
+	}
+	if cfg.Indexer.HashFiles || cfg.NetDisk.MonitorIntervalSec != 300 || cfg.MQTT.SMARTIntervalSec != 6*3600 {
+		t.Fatalf("expected the low-memory defaults, got hash_files=%v netdisk=%d smart=%d",
+			cfg.Indexer.HashFiles, cfg.NetDisk.MonitorIntervalSec, cfg.MQTT.SMARTIntervalSec)
+	}
+	// Settings in the file override the profile
+	if cfg.WAN.IntervalSec != 60 {
+		t.Fatalf("expected wan.interval_sec from the file, got %d", cfg.WAN.IntervalSec)
+	}
+
+	cfg, err = Load(writeConfig(t, "server:\n  http_port: 8080\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Resources.Profile != ProfileStandard || cfg.Resources.SQLiteCacheKB != 0 || !cfg.Indexer.HashFiles {
+		t.Fatalf("expected the standard profile by default, got %+v hash_files=%v", cfg.Resources, cfg.Indexer.HashFiles)
+	}
+
+	if _, err := Load(writeConfig(t, "resources:\n  profile: tiny\n")); err == nil {
+		t.Fatal("expected an unknown profile to be rejected")
+	}
+}
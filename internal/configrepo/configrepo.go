@@ -0,0 +1,457 @@
+// Package configrepo keeps the configuration files the agent writes, like
+// the Samba configuration, /etc/exports and resolv.conf, in a local git
+// repository. Every applied change becomes a commit recording who made it,
+// why and through which API request, so changes can be listed, compared and
+// reverted.
+package configrepo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+var (
+	// ErrNotFound is returned for unknown commits and for files a commit
+	// does not contain
+	ErrNotFound = errors.New("not found")
+	// ErrDisabled is returned when no repository is configured
+	ErrDisabled = errors.New("configuration history is disabled")
+)
+
+// validCommit matches abbreviated and full commit IDs, so IDs from clients
+// can't be mistaken for git options or revision expressions
+var validCommit = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// Change describes who changed the configuration and why
+type Change struct {
+	User      string `json:"user"`
+	Reason    string `json:"reason,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type changeKey struct{}
+
+// WithChange returns a context whose recorded commits are attributed to c
+func WithChange(ctx context.Context, c Change) context.Context {
+	return context.WithValue(ctx, changeKey{}, c)
+}
+
+// ChangeFrom returns the change carried by ctx. Changes not made through
+// the API are attributed to "system".
+func ChangeFrom(ctx context.Context) Change {
+	c, _ := ctx.Value(changeKey{}).(Change)
+	if c.User == "" {
+		c.User = "system"
+	}
+	return c
+}
+
+// Commit is a recorded configuration change
+type Commit struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Summary   string    `json:"summary"` // What the agent changed
+	User      string    `json:"user"`
+	Reason    string    `json:"reason,omitempty"` // Why, as given by the client
+	RequestID string    `json:"request_id,omitempty"`
+	Files     []string  `json:"files"`
+}
+
+// ReloadFunc makes the service reading a file pick up a reverted version.
+// It runs while the repository is locked, so it must not wait for locks held
+// around Record.
+type ReloadFunc func(ctx context.Context) error
+
+// Config configures the repository
+type Config struct {
+	Dir string
+}
+
+// Repo records configuration files in a git repository. Files are stored
+// under their absolute path, so /etc/exports is kept as etc/exports. A nil
+// Repo records nothing, so subsystems can use it unconditionally.
+type Repo struct {
+	dir     string
+	mu      sync.Mutex
+	reloads map[string]ReloadFunc
+}
+
+// New opens the repository in cfg.Dir, creating it if needed
+func New(cfg *Config) (*Repo, error) {
+	if cfg.Dir == "" {
+		return nil, ErrDisabled
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git is required for configuration history: %w", err)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("create configuration history directory: %w", err)
+	}
+
+	r := &Repo{
+		dir:     cfg.Dir,
+		reloads: make(map[string]ReloadFunc),
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Dir, ".git")); os.IsNotExist(err) {
+		if _, err := r.git(context.Background(), "init", "-q"); err != nil {
+			return nil, fmt.Errorf("create configuration history: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// Track records the current content of path as a baseline and registers
+// reload to run when the file is reverted. reload may be nil for files read
+// on every use.
+func (r *Repo) Track(ctx context.Context, path string, reload ReloadFunc) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	r.reloads[filepath.Clean(path)] = reload
+	r.mu.Unlock()
+
+	return r.Record(ctx, "baseline of "+path, path)
+}
+
+// Record commits the current content of paths, attributed to the change
+// carried by ctx. Missing files are recorded as deleted. Nothing is
+// committed if no file changed since the last commit.
+func (r *Repo) Record(ctx context.Context, summary string, paths ...string) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.record(ctx, summary, paths)
+}
+
+func (r *Repo) record(ctx context.Context, summary string, paths []string) error {
+	for _, path := range paths {
+		stored := filepath.Join(r.dir, repoPath(path))
+
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			if err := os.Remove(stored); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("record %s: %w", path, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("record %s: %w", path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(stored), 0700); err != nil {
+			return fmt.Errorf("record %s: %w", path, err)
+		}
+		if err := os.WriteFile(stored, data, 0600); err != nil {
+			return fmt.Errorf("record %s: %w", path, err)
+		}
+	}
+
+	// Only record changes the work tree, so everything in it is staged
+	if _, err := r.git(ctx, "add", "-A"); err != nil {
+		return err
+	}
+	// Exit status 1 means there are staged changes
+	if _, err := r.git(ctx, "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+
+	change := ChangeFrom(ctx)
+	message := summary + "\n"
+	if change.Reason != "" {
+		message += "\nReason: " + singleLine(change.Reason)
+	}
+	if change.RequestID != "" {
+		message += "\nRequest-ID: " + singleLine(change.RequestID)
+	}
+	user := strings.NewReplacer("<", "", ">", "").Replace(singleLine(change.User))
+	_, err := r.git(ctx, "commit", "-q", "--no-verify", "--author="+user+" <"+user+"@mingyue-agent>", "-m", message)
+	return err
+}
+
+// Log returns the most recent commits first, limited to those touching path
+// if it is set. A limit of 0 returns all commits.
+func (r *Repo) Log(ctx context.Context, path string, limit int) ([]Commit, error) {
+	if r == nil {
+		return nil, ErrDisabled
+	}
+
+	args := []string{"log", "--name-only", "--format=%x1e%H%x1f%at%x1f%an%x1f%B%x1f"}
+	if limit > 0 {
+		args = append(args, "-n", strconv.Itoa(limit))
+	}
+	if path != "" {
+		args = append(args, "--", repoPath(path))
+	}
+
+	output, err := r.git(ctx, args...)
+	if err != nil {
+		// A repository without commits has no HEAD yet
+		if !r.hasCommits(ctx) {
+			return []Commit{}, nil
+		}
+		return nil, err
+	}
+	return parseLog(string(output)), nil
+}
+
+// Get returns the commit called id
+func (r *Repo) Get(ctx context.Context, id string) (*Commit, error) {
+	if r == nil {
+		return nil, ErrDisabled
+	}
+	full, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := r.git(ctx, "show", "--name-only", "--format=%x1e%H%x1f%at%x1f%an%x1f%B%x1f", full)
+	if err != nil {
+		return nil, err
+	}
+	commits := parseLog(string(output))
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("commit %s: %w", id, ErrNotFound)
+	}
+	return &commits[0], nil
+}
+
+// Diff returns the changes of commit id as a unified diff
+func (r *Repo) Diff(ctx context.Context, id string) (string, error) {
+	if r == nil {
+		return "", ErrDisabled
+	}
+	full, err := r.resolve(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := r.git(ctx, "show", "--format=", "--no-color", "--src-prefix=a/", "--dst-prefix=b/", full)
+	if err != nil {
+		return "", err
+	}
+	return livePaths(string(output)), nil
+}
+
+// Revert puts paths back to their content as of commit id and reloads the
+// services reading them. Without paths, every file the commit touched is
+// reverted. The revert is recorded as a new commit; the reverted files are
+// returned.
+func (r *Repo) Revert(ctx context.Context, id string, paths ...string) ([]string, error) {
+	if r == nil {
+		return nil, ErrDisabled
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	full, err := r.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		commit, err := r.Get(ctx, full)
+		if err != nil {
+			return nil, err
+		}
+		paths = commit.Files
+	}
+
+	// Read every version before writing any, so a bad path changes nothing
+	contents := make([][]byte, len(paths))
+	for i, path := range paths {
+		output, err := r.git(ctx, "show", full+":"+repoPath(path))
+		if err == nil {
+			contents[i] = output
+			continue
+		}
+		// Files recorded before but missing at the commit are deleted
+		history, _ := r.git(ctx, "log", "-n", "1", "--format=%H", full, "--", repoPath(path))
+		if len(bytes.TrimSpace(history)) == 0 {
+			return nil, fmt.Errorf("%s at %s: %w", path, id, ErrNotFound)
+		}
+	}
+
+	for i, path := range paths {
+		if contents[i] == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("revert %s: %w", path, err)
+			}
+			continue
+		}
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if err := writeFile(path, contents[i], mode); err != nil {
+			return nil, fmt.Errorf("revert %s: %w", path, err)
+		}
+	}
+
+	if err := r.record(ctx, "revert to "+shortID(full), paths); err != nil {
+		return nil, err
+	}
+
+	var reloadErrs []error
+	reloaded := make(map[string]bool)
+	for _, path := range paths {
+		reload := r.reloads[filepath.Clean(path)]
+		if reload == nil || reloaded[path] {
+			continue
+		}
+		reloaded[path] = true
+		if err := reload(ctx); err != nil {
+			reloadErrs = append(reloadErrs, fmt.Errorf("reload after reverting %s: %w", path, err))
+		}
+	}
+	return paths, errors.Join(reloadErrs...)
+}
+
+// Before returns the ID of the last commit touching path at or before t
+func (r *Repo) Before(ctx context.Context, path string, t time.Time) (string, error) {
+	if r == nil {
+		return "", ErrDisabled
+	}
+
+	output, err := r.git(ctx, "log", "-n", "1", "--format=%H", "--until="+t.Format(time.RFC3339), "--", repoPath(path))
+	if err != nil && r.hasCommits(ctx) {
+		return "", err
+	}
+	id := strings.TrimSpace(string(output))
+	if id == "" {
+		return "", fmt.Errorf("no version of %s at %s: %w", path, t.Format(time.RFC3339), ErrNotFound)
+	}
+	return id, nil
+}
+
+// resolve returns the full ID of commit id
+func (r *Repo) resolve(ctx context.Context, id string) (string, error) {
+	if !validCommit.MatchString(id) {
+		return "", fmt.Errorf("commit %s: %w", id, ErrNotFound)
+	}
+	output, err := r.git(ctx, "rev-parse", "--quiet", "--verify", id+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("commit %s: %w", id, ErrNotFound)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (r *Repo) hasCommits(ctx context.Context) bool {
+	_, err := r.git(ctx, "rev-parse", "--quiet", "--verify", "HEAD")
+	return err == nil
+}
+
+// git runs a git command in the repository. The agent commits as itself;
+// the user making a change is recorded as the author.
+func (r *Repo) git(ctx context.Context, args ...string) ([]byte, error) {
+	output, err := sysexec.Output(ctx, "git", append([]string{
+		"-C", r.dir,
+		"-c", "user.name=mingyue-agent",
+		"-c", "user.email=agent@mingyue-agent",
+	}, args...)...)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return output, nil
+}
+
+// parseLog parses records written with the format used by Log
+func parseLog(output string) []Commit {
+	commits := []Commit{}
+	for _, record := range strings.Split(output, "\x1e") {
+		fields := strings.Split(record, "\x1f")
+		if len(fields) < 5 {
+			continue
+		}
+
+		commit := Commit{
+			ID:   fields[0],
+			User: fields[2],
+		}
+		if sec, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			commit.Time = time.Unix(sec, 0)
+		}
+
+		lines := strings.Split(strings.TrimSpace(fields[3]), "\n")
+		commit.Summary = lines[0]
+		for _, line := range lines[1:] {
+			if reason, ok := strings.CutPrefix(line, "Reason: "); ok {
+				commit.Reason = reason
+			} else if requestID, ok := strings.CutPrefix(line, "Request-ID: "); ok {
+				commit.RequestID = requestID
+			}
+		}
+
+		for _, file := range strings.Split(fields[4], "\n") {
+			if file = strings.TrimSpace(file); file != "" {
+				commit.Files = append(commit.Files, "/"+file)
+			}
+		}
+		commits = append(commits, commit)
+	}
+	return commits
+}
+
+// livePaths rewrites the file headers of a diff from repository paths to
+// the paths of the live files
+func livePaths(diff string) string {
+	var b bytes.Buffer
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "--- a/"), strings.HasPrefix(line, "+++ b/"):
+			line = line[:4] + "/" + line[6:]
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// repoPath returns where path is kept in the repository
+func repoPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	return strings.TrimPrefix(filepath.ToSlash(abs), "/")
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// writeFile replaces path through a temporary file so services never read
+// a partial configuration
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,126 @@
+package configrepo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestRepo(t *testing.T) (*Repo, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	r, err := New(&Config{Dir: filepath.Join(dir, "history")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r, dir
+}
+
+func TestRecordLogDiffRevert(t *testing.T) {
+	r, dir := newTestRepo(t)
+	conf := filepath.Join(dir, "smb.conf")
+	if err := os.WriteFile(conf, []byte("[global]\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	reloads := 0
+	if err := r.Track(context.Background(), conf, func(context.Context) error {
+		reloads++
+		return nil
+	}); err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+
+	if err := os.WriteFile(conf, []byte("[global]\n[photos]\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ctx := WithChange(context.Background(), Change{User: "alice", Reason: "add photos", RequestID: "req-1"})
+	if err := r.Record(ctx, "update shares", conf); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	// Unchanged files are not committed again
+	if err := r.Record(ctx, "update shares", conf); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	commits, err := r.Log(context.Background(), conf, 0)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits, got %+v", commits)
+	}
+	latest := commits[0]
+	if latest.User != "alice" || latest.Reason != "add photos" || latest.RequestID != "req-1" || latest.Summary != "update shares" {
+		t.Fatalf("unexpected commit metadata: %+v", latest)
+	}
+	if len(latest.Files) != 1 || latest.Files[0] != conf {
+		t.Fatalf("expected files [%s], got %v", conf, latest.Files)
+	}
+	if commits[1].User != "system" {
+		t.Fatalf("expected the baseline to be attributed to system, got %q", commits[1].User)
+	}
+
+	diff, err := r.Diff(context.Background(), latest.ID)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !strings.Contains(diff, "+++ "+conf+"\n") || !strings.Contains(diff, "+[photos]\n") {
+		t.Fatalf("unexpected diff:\n%s", diff)
+	}
+
+	reverted, err := r.Revert(context.Background(), commits[1].ID)
+	if err != nil {
+		t.Fatalf("Revert: %v", err)
+	}
+	if len(reverted) != 1 || reverted[0] != conf {
+		t.Fatalf("expected %s to be reverted, got %v", conf, reverted)
+	}
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data) != "[global]\n" {
+		t.Fatalf("expected the baseline content, got %q", data)
+	}
+	if reloads != 1 {
+		t.Fatalf("expected 1 reload, got %d", reloads)
+	}
+
+	commits, err = r.Log(context.Background(), "", 1)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if len(commits) != 1 || !strings.HasPrefix(commits[0].Summary, "revert to ") {
+		t.Fatalf("expected the revert to be recorded, got %+v", commits)
+	}
+}
+
+func TestUnknownCommits(t *testing.T) {
+	r, _ := newTestRepo(t)
+
+	commits, err := r.Log(context.Background(), "", 0)
+	if err != nil || len(commits) != 0 {
+		t.Fatalf("expected an empty log, got %v, %v", commits, err)
+	}
+	for _, id := range []string{"deadbeef", "--all", "HEAD~1"} {
+		if _, err := r.Diff(context.Background(), id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Diff(%q): expected ErrNotFound, got %v", id, err)
+		}
+	}
+
+	var disabled *Repo
+	if err := disabled.Record(context.Background(), "update", "/etc/exports"); err != nil {
+		t.Fatalf("nil Repo Record: %v", err)
+	}
+	if _, err := disabled.Log(context.Background(), "", 0); !errors.Is(err, ErrDisabled) {
+		t.Fatalf("expected ErrDisabled, got %v", err)
+	}
+}
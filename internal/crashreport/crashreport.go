@@ -0,0 +1,440 @@
+// Package crashreport keeps reports of agent crashes so intermittent
+// crashes on user machines can be diagnosed. The Go runtime writes the
+// output of fatal panics and errors, with the stacks of all goroutines, to a
+// file in the crash directory; on the next start that output is turned into
+// a report with the version of the crashed run and the tail of its log, and
+// optionally submitted to a configured endpoint.
+package crashreport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// ErrNotFound is returned for unknown reports
+var ErrNotFound = errors.New("crash report not found")
+
+const (
+	crashOutputFile = "crash.out"
+	runFile         = "run.json"
+	maxOutputBytes  = 1 << 20
+)
+
+// Report describes one crash
+type Report struct {
+	ID          string     `json:"id"`
+	Time        time.Time  `json:"time"` // When the crash output was written
+	Version     string     `json:"version"`
+	GoVersion   string     `json:"go_version"`
+	OS          string     `json:"os"`
+	Arch        string     `json:"arch"`
+	PID         int        `json:"pid"`
+	StartedAt   time.Time  `json:"started_at"`
+	Panic       string     `json:"panic"`  // First line, like "panic: runtime error: ..."
+	Output      string     `json:"output"` // Full runtime output with goroutine stacks
+	Truncated   bool       `json:"truncated,omitempty"`
+	LogTail     []string   `json:"log_tail"`
+	Submitted   bool       `json:"submitted"`
+	SubmittedAt *time.Time `json:"submitted_at,omitempty"`
+	SubmitError string     `json:"submit_error,omitempty"`
+}
+
+// Summary is a report without its output and log, for listings
+type Summary struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Version   string    `json:"version"`
+	Panic     string    `json:"panic"`
+	Submitted bool      `json:"submitted"`
+}
+
+// run records the running agent so a crash can be attributed to it
+type run struct {
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Config configures crash reports
+type Config struct {
+	Dir          string
+	Version      string
+	LogFile      string // Agent log whose tail goes into reports
+	LogTailLines int
+	SubmitURL    string // Reports are only kept locally if empty
+	SubmitToken  string
+	Keep         int // Number of reports kept
+}
+
+// Manager collects, stores and submits crash reports
+type Manager struct {
+	dir          string
+	version      string
+	logFile      string
+	logTailLines int
+	submitURL    string
+	submitToken  string
+	keep         int
+	client       *http.Client
+	output       *os.File
+}
+
+// New creates a crash report manager
+func New(cfg *Config) *Manager {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "/var/lib/mingyue-agent/crashes"
+	}
+
+	version := cfg.Version
+	if version == "" {
+		version = "dev"
+	}
+
+	logTailLines := cfg.LogTailLines
+	if logTailLines == 0 {
+		logTailLines = 200
+	}
+
+	keep := cfg.Keep
+	if keep == 0 {
+		keep = 20
+	}
+
+	return &Manager{
+		dir:          dir,
+		version:      version,
+		logFile:      cfg.LogFile,
+		logTailLines: logTailLines,
+		submitURL:    cfg.SubmitURL,
+		submitToken:  cfg.SubmitToken,
+		keep:         keep,
+		client:       httpclient.New(30 * time.Second),
+	}
+}
+
+// Install turns the output of a previous crash into a report and then has
+// the runtime write the output of the next fatal panic or error to the crash
+// directory, in addition to standard error. Call it early during startup,
+// before the log receives output of this run.
+func (m *Manager) Install() (*Report, error) {
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return nil, fmt.Errorf("create crash directory: %w", err)
+	}
+
+	report, err := m.collect()
+	if err != nil {
+		// Keep going; losing an old crash must not stop the agent
+		log.Printf("warning: collect crash report: %v", err)
+	}
+
+	data, err := json.Marshal(run{
+		Version:   m.version,
+		GoVersion: runtime.Version(),
+		PID:       os.Getpid(),
+		StartedAt: time.Now(),
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := statefile.Write(filepath.Join(m.dir, runFile), data, statefile.PrivateMode); err != nil {
+		return report, fmt.Errorf("write run file: %w", err)
+	}
+
+	output, err := os.OpenFile(filepath.Join(m.dir, crashOutputFile), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, statefile.PrivateMode)
+	if err != nil {
+		return report, fmt.Errorf("open crash output: %w", err)
+	}
+	if err := debug.SetCrashOutput(output, debug.CrashOptions{}); err != nil {
+		output.Close()
+		return report, fmt.Errorf("set crash output: %w", err)
+	}
+	// The runtime keeps its own descriptor; ours stays open until Close
+	m.output = output
+	return report, nil
+}
+
+// Close stops writing crash output to the crash directory
+func (m *Manager) Close() {
+	if m.output == nil {
+		return
+	}
+	debug.SetCrashOutput(nil, debug.CrashOptions{})
+	m.output.Close()
+	m.output = nil
+}
+
+// collect makes a report of crash output left by the previous run
+func (m *Manager) collect() (*Report, error) {
+	path := filepath.Join(m.dir, crashOutputFile)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	output, err := io.ReadAll(io.LimitReader(f, maxOutputBytes+1))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		ID:      "crash-" + info.ModTime().UTC().Format("20060102-150405"),
+		Time:    info.ModTime(),
+		Version: "unknown",
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		LogTail: []string{},
+	}
+	if len(output) > maxOutputBytes {
+		output = output[:maxOutputBytes]
+		report.Truncated = true
+	}
+	report.Output = string(output)
+	report.Panic = firstLine(report.Output)
+
+	var previous run
+	if err := statefile.Read(filepath.Join(m.dir, runFile), &previous); err == nil {
+		report.Version = previous.Version
+		report.GoVersion = previous.GoVersion
+		report.PID = previous.PID
+		report.StartedAt = previous.StartedAt
+	}
+	if m.logFile != "" {
+		if tail, err := tailLines(m.logFile, m.logTailLines); err == nil {
+			report.LogTail = tail
+		}
+	}
+
+	if err := m.save(report); err != nil {
+		return nil, err
+	}
+	// Only clear the output once the report is safe
+	if err := os.Truncate(path, 0); err != nil {
+		return report, err
+	}
+	m.prune()
+	return report, nil
+}
+
+// firstLine returns the first line that explains the crash
+func firstLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "panic:") || strings.HasPrefix(line, "fatal error:") {
+			return line
+		}
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	return line
+}
+
+// tailLines returns the last n lines of the file at path
+func tailLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Lines are short, so the end of the file holds enough of them
+	const window = 256 << 10
+	if info, err := f.Stat(); err == nil && info.Size() > window {
+		if _, err := f.Seek(-window, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// List returns summaries of the kept reports, newest first
+func (m *Manager) List() ([]*Summary, error) {
+	paths, err := filepath.Glob(filepath.Join(m.dir, "crash-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []*Summary{}
+	for _, path := range paths {
+		var report Report
+		if err := statefile.Read(path, &report); err != nil {
+			continue
+		}
+		summaries = append(summaries, &Summary{
+			ID:        report.ID,
+			Time:      report.Time,
+			Version:   report.Version,
+			Panic:     report.Panic,
+			Submitted: report.Submitted,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Time.After(summaries[j].Time)
+	})
+	return summaries, nil
+}
+
+// Get returns a report by ID
+func (m *Manager) Get(id string) (*Report, error) {
+	path, err := m.path(id)
+	if err != nil {
+		return nil, err
+	}
+	var report Report
+	if err := statefile.Read(path, &report); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return nil, fmt.Errorf("read crash report: %w", err)
+	}
+	return &report, nil
+}
+
+// Delete removes a report
+func (m *Manager) Delete(id string) error {
+	path, err := m.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return fmt.Errorf("delete crash report: %w", err)
+	}
+	// Get would otherwise restore the report from its backup
+	os.Remove(path + statefile.BackupSuffix)
+	return nil
+}
+
+// path returns the file of the report with id, refusing IDs that could
+// leave the crash directory
+func (m *Manager) path(id string) (string, error) {
+	if !strings.HasPrefix(id, "crash-") || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return filepath.Join(m.dir, id+".json"), nil
+}
+
+func (m *Manager) save(report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal crash report: %w", err)
+	}
+	path := filepath.Join(m.dir, report.ID+".json")
+	if err := statefile.Write(path, data, statefile.PrivateMode); err != nil {
+		return fmt.Errorf("write crash report: %w", err)
+	}
+	return nil
+}
+
+// prune removes the oldest reports beyond the configured number
+func (m *Manager) prune() {
+	summaries, err := m.List()
+	if err != nil || len(summaries) <= m.keep {
+		return
+	}
+	for _, summary := range summaries[m.keep:] {
+		if err := m.Delete(summary.ID); err != nil {
+			log.Printf("warning: prune crash report %s: %v", summary.ID, err)
+		}
+	}
+}
+
+// SubmitPending submits the reports that have not been submitted yet. It
+// does nothing without a submit URL; failed submissions are retried on the
+// next call.
+func (m *Manager) SubmitPending(ctx context.Context) {
+	if m.submitURL == "" {
+		return
+	}
+	summaries, err := m.List()
+	if err != nil {
+		log.Printf("warning: list crash reports: %v", err)
+		return
+	}
+	for _, summary := range summaries {
+		if summary.Submitted || ctx.Err() != nil {
+			continue
+		}
+		report, err := m.Get(summary.ID)
+		if err != nil {
+			continue
+		}
+
+		err = m.submit(ctx, report)
+		if err != nil {
+			log.Printf("warning: submit crash report %s: %v", report.ID, err)
+			report.SubmitError = err.Error()
+		} else {
+			now := time.Now()
+			report.Submitted = true
+			report.SubmittedAt = &now
+			report.SubmitError = ""
+		}
+		if err := m.save(report); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+}
+
+func (m *Manager) submit(ctx context.Context, report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.submitURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.submitToken != "" {
+		req.Header.Set("Authorization", "Bearer "+m.submitToken)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
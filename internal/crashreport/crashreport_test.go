@@ -0,0 +1,114 @@
+package crashreport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const goroutineDump = `panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4a2b3c]
+
+goroutine 42 [running]:
+github.com/KOPElan/mingyue-agent/internal/netdisk.(*Manager).probe(...)
+	/src/internal/netdisk/netdisk.go:310
+`
+
+func TestInstallCollectsPreviousCrash(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "agent.log")
+	var logLines []string
+	for i := 0; i < 300; i++ {
+		logLines = append(logLines, "line "+strings.Repeat("x", i%7))
+	}
+	logLines[299] = "last line before the crash"
+	os.WriteFile(logFile, []byte(strings.Join(logLines, "\n")+"\n"), 0600)
+
+	// What the previous run left behind
+	previous := New(&Config{Dir: dir, Version: "1.4.0"})
+	if _, err := previous.Install(); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	previous.Close()
+	os.WriteFile(filepath.Join(dir, crashOutputFile), []byte(goroutineDump), 0600)
+
+	var submitted Report
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&submitted)
+	}))
+	defer endpoint.Close()
+
+	m := New(&Config{
+		Dir:          dir,
+		Version:      "1.5.0",
+		LogFile:      logFile,
+		LogTailLines: 50,
+		SubmitURL:    endpoint.URL,
+		SubmitToken:  "secret",
+	})
+	report, err := m.Install()
+	if err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	defer m.Close()
+
+	if report == nil {
+		t.Fatal("expected the previous crash to be collected")
+	}
+	if report.Version != "1.4.0" || !strings.HasPrefix(report.Panic, "panic: runtime error") {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.LogTail) != 50 || report.LogTail[49] != "last line before the crash" {
+		t.Fatalf("unexpected log tail of %d lines", len(report.LogTail))
+	}
+	if info, err := os.Stat(filepath.Join(dir, crashOutputFile)); err != nil || info.Size() != 0 {
+		t.Fatalf("expected empty crash output for this run, got %v", err)
+	}
+
+	m.SubmitPending(context.Background())
+	if submitted.ID != report.ID || !strings.Contains(submitted.Output, "goroutine 42") {
+		t.Fatalf("unexpected submission %+v", submitted)
+	}
+	summaries, err := m.List()
+	if err != nil || len(summaries) != 1 || !summaries[0].Submitted {
+		t.Fatalf("expected one submitted report, got %+v (%v)", summaries, err)
+	}
+
+	if err := m.Delete(report.ID); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := m.Get(report.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestInstallWithoutCrash(t *testing.T) {
+	m := New(&Config{Dir: t.TempDir()})
+	report, err := m.Install()
+	if err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	defer m.Close()
+	if report != nil {
+		t.Fatalf("expected no report, got %+v", report)
+	}
+}
+
+func TestReportIDsStayInDirectory(t *testing.T) {
+	m := New(&Config{Dir: t.TempDir()})
+	for _, id := range []string{"../run", "crash-../../etc/passwd", "crash-a/b", "run"} {
+		if _, err := m.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected %q to be rejected, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package credcrypt encrypts credentials the agent stores, like network
+// share passwords and LUKS passphrases, with AES-256-GCM under the key
+// configured as netdisk.encryption_key.
+package credcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Cipher encrypts and decrypts stored credentials
+type Cipher struct {
+	key []byte
+}
+
+// New creates a cipher from a configured key, which is zero-padded or cut
+// to 32 bytes
+func New(key string) (*Cipher, error) {
+	if key == "" {
+		return nil, fmt.Errorf("encryption key is required")
+	}
+	padded := make([]byte, 32)
+	copy(padded, key)
+	return &Cipher{key: padded}, nil
+}
+
+// Encrypt returns plaintext sealed with a random nonce, base64-encoded
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	gcm, err := c.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt opens a credential sealed by Encrypt
+func (c *Cipher) Decrypt(ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := c.gcm()
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertextBytes := data[:nonceSize], data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func (c *Cipher) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,25 @@
+package credcrypt
+
+import "testing"
+
+func TestRoundTrip(t *testing.T) {
+	c, err := New("change-this-to-a-secure-key-32b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := c.Decrypt(sealed); err != nil || plaintext != "secret" {
+		t.Fatalf("expected secret, got %q, %v", plaintext, err)
+	}
+
+	other, _ := New("another-key")
+	if _, err := other.Decrypt(sealed); err == nil {
+		t.Fatal("decrypted with a different key")
+	}
+	if _, err := New(""); err == nil {
+		t.Fatal("empty key accepted")
+	}
+}
@@ -11,91 +11,22 @@ import (
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
 	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/crashreport"
+	"github.com/KOPElan/mingyue-agent/internal/preflight"
 	"github.com/KOPElan/mingyue-agent/internal/server"
+	"github.com/KOPElan/mingyue-agent/internal/smbaudit"
 )
 
-type Daemon struct {
-	config *config.Config
-	audit  *audit.Logger
-	server *server.Server
-	logDir string
-}
-
-// verifyDirectories checks if all required directories exist and have correct permissions
-func verifyDirectories(cfg *config.Config) error {
-	type dirCheck struct {
-		path        string
-		description string
-	}
-
-	logDir := agentLogDir(cfg)
-	requiredDirs := []dirCheck{
-		{filepath.Dir(cfg.NetDisk.StateFile), "network disk state"},
-		{filepath.Dir(cfg.Network.HistoryFile), "network history"},
-		{cfg.ShareMgr.BackupDir, "share backups"},
-		{filepath.Dir(cfg.ShareMgr.StateFile), "share state"},
-		{filepath.Dir(cfg.Server.UDSPath), "unix socket"},
-		{logDir, "agent log"},
-	}
-
-	if cfg.Audit.Enabled && cfg.Audit.LogPath != "" {
-		requiredDirs = append(requiredDirs, dirCheck{
-			path:        filepath.Dir(cfg.Audit.LogPath),
-			description: "audit log",
-		})
-	}
-
-	var errors []string
-	for _, dir := range requiredDirs {
-		if err := ensureWritableDir(dir.path); err != nil {
-			errors = append(errors, fmt.Sprintf("  - %s: %v", dir.description, err))
-		}
-	}
-
-	if cfg.Audit.Enabled && cfg.Audit.LogPath != "" {
-		if err := ensureWritableFile(cfg.Audit.LogPath); err != nil {
-			errors = append(errors, fmt.Sprintf("  - audit log file: %v", err))
-		}
-	}
-
-	if len(errors) > 0 {
-		return fmt.Errorf("Required directories are not accessible:\n%s\n\nFix by running:\n  sudo mingyue-agent fix-permissions --config /etc/mingyue-agent/config.yaml", strings.Join(errors, "\n"))
-	}
-
-	return nil
-}
-
-func ensureWritableDir(path string) error {
-	info, err := os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("directory does not exist: %s", path)
-		}
-		return fmt.Errorf("cannot access directory: %s (%v)", path, err)
-	}
-
-	if !info.IsDir() {
-		return fmt.Errorf("path exists but is not a directory: %s", path)
-	}
+// Version is the agent version recorded in crash reports; set by main
+var Version = "dev"
 
-	testFile := filepath.Join(path, ".mingyue-agent-write-test")
-	if err := os.WriteFile(testFile, []byte("test"), 0644); err != nil {
-		return fmt.Errorf("directory is not writable: %s (%v)", path, err)
-	}
-
-	if err := os.Remove(testFile); err != nil {
-		return fmt.Errorf("remove write test file: %s (%v)", path, err)
-	}
-
-	return nil
-}
-
-func ensureWritableFile(path string) error {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return fmt.Errorf("cannot open log file: %s (%v)", path, err)
-	}
-	return file.Close()
+type Daemon struct {
+	config   *config.Config
+	audit    *audit.Logger
+	server   *server.Server
+	smbAudit *smbaudit.Ingester
+	crashes  *crashreport.Manager
+	logDir   string
 }
 
 func agentLogDir(cfg *config.Config) string {
@@ -106,9 +37,15 @@ func agentLogDir(cfg *config.Config) string {
 }
 
 func New(cfg *config.Config) (*Daemon, error) {
-	// Verify all required directories before proceeding
-	if err := verifyDirectories(cfg); err != nil {
-		return nil, err
+	// Self-test before touching anything; only fatal issues stop startup
+	report := preflight.Run(cfg)
+	report.Print(os.Stdout)
+	if report.HasFatal() {
+		var problems []string
+		for _, check := range report.FatalChecks() {
+			problems = append(problems, fmt.Sprintf("  - %s %s: %s", check.Category, check.Name, check.Message))
+		}
+		return nil, fmt.Errorf("preflight checks failed:\n%s\n\nFix directory permissions by running:\n  sudo mingyue-agent fix-permissions --config /etc/mingyue-agent/config.yaml", strings.Join(problems, "\n"))
 	}
 
 	logDir := agentLogDir(cfg)
@@ -131,16 +68,42 @@ func New(cfg *config.Config) (*Daemon, error) {
 		return nil, fmt.Errorf("create server: %w", err)
 	}
 
-	return &Daemon{
+	d := &Daemon{
 		config: cfg,
 		audit:  auditLogger,
 		server: srv,
 		logDir: logDir,
-	}, nil
+	}
+
+	if cfg.ShareMgr.SambaAudit {
+		ingester, err := smbaudit.New(&smbaudit.Config{
+			LogPath:   cfg.ShareMgr.SambaAuditLog,
+			StateFile: filepath.Join(filepath.Dir(cfg.ShareMgr.StateFile), "smb-audit-offset.json"),
+		}, auditLogger)
+		if err != nil {
+			return nil, fmt.Errorf("create samba audit ingester: %w", err)
+		}
+		d.smbAudit = ingester
+	}
+
+	return d, nil
 }
 
 func (d *Daemon) Start(ctx context.Context) error {
 	logFile := filepath.Join(d.logDir, "agent.log")
+
+	// Collect a crash of the previous run before this run appends to its log
+	d.crashes = crashreport.New(&crashreport.Config{
+		Dir:          d.config.Crash.Dir,
+		Version:      Version,
+		LogFile:      logFile,
+		LogTailLines: d.config.Crash.LogTailLines,
+		SubmitURL:    d.config.Crash.SubmitURL,
+		SubmitToken:  d.config.Crash.SubmitToken,
+		Keep:         d.config.Crash.Keep,
+	})
+	crash, crashErr := d.crashes.Install()
+
 	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		log.Printf("Warning: failed to open log file: %v", err)
@@ -165,13 +128,27 @@ func (d *Daemon) Start(ctx context.Context) error {
 	}
 
 	log.Printf("Mingyue Agent starting (PID: %d)", os.Getpid())
-	log.Printf("HTTP server on %s:%d", d.config.Server.ListenAddr, d.config.Server.HTTPPort)
+	for _, l := range d.config.HTTPListeners() {
+		log.Printf("HTTP server on %s", l.Addr)
+	}
 	log.Printf("gRPC server on %s:%d", d.config.Server.ListenAddr, d.config.Server.GRPCPort)
+	if crashErr != nil {
+		log.Printf("Warning: crash reporting unavailable: %v", crashErr)
+	}
+	if crash != nil {
+		log.Printf("Previous run crashed: %s (report %s)", crash.Panic, crash.ID)
+	}
+	go d.crashes.SubmitPending(ctx)
 
 	if err := d.server.Start(ctx); err != nil {
 		return fmt.Errorf("start server: %w", err)
 	}
 
+	if d.smbAudit != nil {
+		d.smbAudit.Start(ctx)
+		log.Printf("Samba audit ingestion from %s", d.config.ShareMgr.SambaAuditLog)
+	}
+
 	return nil
 }
 
@@ -190,6 +167,14 @@ func (d *Daemon) Shutdown(ctx context.Context) error {
 		log.Printf("Warning: failed to log audit entry: %v", err)
 	}
 
+	if d.smbAudit != nil {
+		d.smbAudit.Stop()
+	}
+
+	if d.crashes != nil {
+		d.crashes.Close()
+	}
+
 	if err := d.server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("shutdown server: %w", err)
 	}
@@ -1,75 +1,27 @@
-//go:build !windows
-// +build !windows
+//go:build linux
 
 package diskmanager
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
-)
-
-// Partition represents a disk partition
-type Partition struct {
-	Name       string  `json:"name"`
-	Device     string  `json:"device"`
-	MountPoint string  `json:"mount_point"`
-	FileSystem string  `json:"filesystem"`
-	Size       uint64  `json:"size"`
-	Used       uint64  `json:"used"`
-	Available  uint64  `json:"available"`
-	UsedPct    float64 `json:"used_percent"`
-	UUID       string  `json:"uuid"`
-	Label      string  `json:"label"`
-	ReadOnly   bool    `json:"read_only"`
-}
-
-// DiskInfo represents physical disk information
-type DiskInfo struct {
-	Device     string      `json:"device"`
-	Model      string      `json:"model"`
-	Size       uint64      `json:"size"`
-	Partitions []Partition `json:"partitions"`
-	SMART      *SMARTInfo  `json:"smart,omitempty"`
-}
-
-// SMARTInfo represents SMART health information
-type SMARTInfo struct {
-	Healthy      bool   `json:"healthy"`
-	Temperature  int    `json:"temperature"`
-	PowerOnHours int    `json:"power_on_hours"`
-	RawData      string `json:"raw_data,omitempty"`
-}
 
-// MountOptions represents mount operation options
-type MountOptions struct {
-	Device     string   `json:"device"`
-	MountPoint string   `json:"mount_point"`
-	FileSystem string   `json:"filesystem"`
-	Options    []string `json:"options"`
-	ReadOnly   bool     `json:"read_only"`
-}
-
-// Manager handles disk management operations
-type Manager struct {
-	allowedMountPoints []string
-}
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
 
-// New creates a new disk manager
-func New(allowedMountPoints []string) *Manager {
-	return &Manager{
-		allowedMountPoints: allowedMountPoints,
-	}
+// ListPartitions lists all available partitions
+func (m *Manager) ListPartitions(ctx context.Context) ([]Partition, error) {
+	return m.partitions.Get(ctx, "", m.listPartitions)
 }
 
-// ListPartitions lists all available partitions
-func (m *Manager) ListPartitions() ([]Partition, error) {
+func (m *Manager) listPartitions(ctx context.Context) ([]Partition, error) {
 	var partitions []Partition
 
 	// Read /proc/mounts for mounted filesystems
@@ -81,6 +33,10 @@ func (m *Manager) ListPartitions() ([]Partition, error) {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		fields := strings.Fields(scanner.Text())
 		if len(fields) < 6 {
 			continue
@@ -112,7 +68,7 @@ func (m *Manager) ListPartitions() ([]Partition, error) {
 			}
 
 			// Get UUID and label using blkid
-			if uuid, label := m.getDeviceInfo(device); uuid != "" || label != "" {
+			if uuid, label := m.getDeviceInfo(ctx, device); uuid != "" || label != "" {
 				partition.UUID = uuid
 				partition.Label = label
 			}
@@ -130,9 +86,8 @@ func (m *Manager) ListPartitions() ([]Partition, error) {
 }
 
 // getDeviceInfo gets UUID and label for a device using blkid
-func (m *Manager) getDeviceInfo(device string) (uuid, label string) {
-	cmd := exec.Command("blkid", "-o", "export", device)
-	output, err := cmd.Output()
+func (m *Manager) getDeviceInfo(ctx context.Context, device string) (uuid, label string) {
+	output, err := sysexec.Output(ctx, "blkid", "-o", "export", device)
 	if err != nil {
 		return "", ""
 	}
@@ -151,26 +106,32 @@ func (m *Manager) getDeviceInfo(device string) (uuid, label string) {
 }
 
 // ListDisks lists all physical disks
-func (m *Manager) ListDisks() ([]DiskInfo, error) {
+func (m *Manager) ListDisks(ctx context.Context) ([]DiskInfo, error) {
+	return m.disks.Get(ctx, "", m.listDisks)
+}
+
+// lsblkDevice is a block device in the output of lsblk -J
+type lsblkDevice struct {
+	Name       string        `json:"name"`
+	Size       uint64        `json:"size,string"`
+	Model      string        `json:"model"`
+	Type       string        `json:"type"`
+	FSType     string        `json:"fstype"`
+	UUID       string        `json:"uuid"`
+	Label      string        `json:"label"`
+	MountPoint string        `json:"mountpoint"`
+	Children   []lsblkDevice `json:"children"`
+}
+
+func (m *Manager) listDisks(ctx context.Context) ([]DiskInfo, error) {
 	// Use lsblk to get disk information
-	cmd := exec.Command("lsblk", "-J", "-b", "-o", "NAME,SIZE,MODEL,TYPE")
-	output, err := cmd.Output()
+	output, err := sysexec.Output(ctx, "lsblk", "-J", "-b", "-o", "NAME,SIZE,MODEL,TYPE,FSTYPE,UUID,LABEL,MOUNTPOINT")
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute lsblk: %w", err)
 	}
 
 	var result struct {
-		BlockDevices []struct {
-			Name     string `json:"name"`
-			Size     uint64 `json:"size,string"`
-			Model    string `json:"model"`
-			Type     string `json:"type"`
-			Children []struct {
-				Name string `json:"name"`
-				Size uint64 `json:"size,string"`
-				Type string `json:"type"`
-			} `json:"children"`
-		} `json:"blockdevices"`
+		BlockDevices []lsblkDevice `json:"blockdevices"`
 	}
 
 	if err := json.Unmarshal(output, &result); err != nil {
@@ -178,14 +139,16 @@ func (m *Manager) ListDisks() ([]DiskInfo, error) {
 	}
 
 	var disks []DiskInfo
-	partitions, _ := m.ListPartitions()
+	// Read partitions afresh so they are as current as the disks
+	partitions, _ := m.listPartitions(ctx)
 
 	for _, dev := range result.BlockDevices {
 		if dev.Type == "disk" {
 			disk := DiskInfo{
-				Device: "/dev/" + dev.Name,
-				Model:  dev.Model,
-				Size:   dev.Size,
+				Device:    "/dev/" + dev.Name,
+				Model:     dev.Model,
+				Size:      dev.Size,
+				Encrypted: m.luksVolumes(dev),
 			}
 
 			// Match partitions to this disk
@@ -202,13 +165,49 @@ func (m *Manager) ListDisks() ([]DiskInfo, error) {
 	return disks, nil
 }
 
+// luksVolumes returns the LUKS volumes on a disk, either the whole disk or
+// its partitions
+func (m *Manager) luksVolumes(disk lsblkDevice) []LUKSVolume {
+	var volumes []LUKSVolume
+	for _, dev := range append([]lsblkDevice{disk}, disk.Children...) {
+		if dev.FSType != "crypto_LUKS" {
+			continue
+		}
+		volume := LUKSVolume{
+			Device:     "/dev/" + dev.Name,
+			UUID:       dev.UUID,
+			Label:      dev.Label,
+			Remembered: m.hasLUKSKey(dev.UUID),
+		}
+		for _, child := range dev.Children {
+			if child.Type == "crypt" {
+				volume.Open = true
+				volume.Name = child.Name
+				volume.Mapper = "/dev/mapper/" + child.Name
+				volume.MountPoint = child.MountPoint
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes
+}
+
 // Mount mounts a device to a mount point
-func (m *Manager) Mount(opts MountOptions) error {
+func (m *Manager) Mount(ctx context.Context, opts MountOptions) error {
 	// Validate mount point
 	if !m.isAllowedMountPoint(opts.MountPoint) {
 		return fmt.Errorf("mount point %s is not in allowed list", opts.MountPoint)
 	}
 
+	requested := opts.Options
+	if opts.ReadOnly {
+		requested = append([]string{"ro"}, requested...)
+	}
+	options, err := BuildMountOptions(opts.FileSystem, opts.Preset, isRemovable(opts.Device), requested)
+	if err != nil {
+		return err
+	}
+
 	// Create mount point if it doesn't exist
 	if err := os.MkdirAll(opts.MountPoint, 0755); err != nil {
 		return fmt.Errorf("failed to create mount point: %w", err)
@@ -219,32 +218,52 @@ func (m *Manager) Mount(opts MountOptions) error {
 	if opts.FileSystem != "" {
 		args = append(args, "-t", opts.FileSystem)
 	}
-	if len(opts.Options) > 0 {
-		args = append(args, "-o", strings.Join(opts.Options, ","))
-	}
-	if opts.ReadOnly {
-		args = append(args, "-r")
-	}
+	args = append(args, "-o", strings.Join(options, ","))
 	args = append(args, opts.Device, opts.MountPoint)
 
-	cmd := exec.Command("mount", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	output, err := sysexec.CombinedOutput(ctx, "mount", args...)
+	m.InvalidateCache()
+	if err != nil {
 		return fmt.Errorf("mount failed: %s: %w", string(output), err)
 	}
 
 	return nil
 }
 
+// isRemovable reports whether device sits on removable media or a USB bus,
+// according to sysfs. Partitions are checked through their parent disk.
+func isRemovable(device string) bool {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		resolved = device
+	}
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(resolved)))
+	if err != nil {
+		return false
+	}
+	if strings.Contains(sysPath, "/usb") {
+		return true
+	}
+
+	for _, dir := range []string{sysPath, filepath.Dir(sysPath)} {
+		if data, err := os.ReadFile(filepath.Join(dir, "removable")); err == nil {
+			return strings.TrimSpace(string(data)) == "1"
+		}
+	}
+	return false
+}
+
 // Unmount unmounts a device or mount point
-func (m *Manager) Unmount(target string, force bool) error {
+func (m *Manager) Unmount(ctx context.Context, target string, force bool) error {
 	args := []string{}
 	if force {
 		args = append(args, "-f")
 	}
 	args = append(args, target)
 
-	cmd := exec.Command("umount", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	output, err := sysexec.CombinedOutput(ctx, "umount", args...)
+	m.InvalidateCache()
+	if err != nil {
 		return fmt.Errorf("unmount failed: %s: %w", string(output), err)
 	}
 
@@ -252,13 +271,18 @@ func (m *Manager) Unmount(target string, force bool) error {
 }
 
 // GetSMARTInfo retrieves SMART information for a device
-func (m *Manager) GetSMARTInfo(device string) (*SMARTInfo, error) {
+func (m *Manager) GetSMARTInfo(ctx context.Context, device string) (*SMARTInfo, error) {
+	return m.smart.Get(ctx, device, func(ctx context.Context) (*SMARTInfo, error) {
+		return m.getSMARTInfo(ctx, device)
+	})
+}
+
+func (m *Manager) getSMARTInfo(ctx context.Context, device string) (*SMARTInfo, error) {
 	// Try using smartctl
-	cmd := exec.Command("smartctl", "-H", "-A", device)
-	output, err := cmd.CombinedOutput()
+	output, err := sysexec.CombinedOutput(ctx, "smartctl", "-H", "-A", device)
 	if err != nil {
 		// smartctl returns non-zero even on success sometimes
-		if len(output) == 0 {
+		if sysexec.IsTimeout(err) || len(output) == 0 {
 			return nil, fmt.Errorf("smartctl failed: %w", err)
 		}
 	}
@@ -0,0 +1,69 @@
+//go:build !linux
+
+package diskmanager
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// Disk management relies on /proc, /sys, lsblk and smartctl, so other
+// systems get a manager whose operations report that they are unsupported
+
+func errUnsupported() error {
+	return fmt.Errorf("disk operations are not supported on %s", runtime.GOOS)
+}
+
+// ListPartitions lists all available partitions.
+func (m *Manager) ListPartitions(ctx context.Context) ([]Partition, error) {
+	return nil, errUnsupported()
+}
+
+// ListDisks lists all physical disks.
+func (m *Manager) ListDisks(ctx context.Context) ([]DiskInfo, error) {
+	return nil, errUnsupported()
+}
+
+// Mount mounts a device to a mount point.
+func (m *Manager) Mount(ctx context.Context, opts MountOptions) error {
+	return errUnsupported()
+}
+
+// Unmount unmounts a device or mount point.
+func (m *Manager) Unmount(ctx context.Context, target string, force bool) error {
+	return errUnsupported()
+}
+
+// GetSMARTInfo retrieves SMART information for a device.
+func (m *Manager) GetSMARTInfo(ctx context.Context, device string) (*SMARTInfo, error) {
+	return nil, errUnsupported()
+}
+
+func (m *Manager) readTable(ctx context.Context, device string) (*PartitionTable, string, error) {
+	return nil, "", errUnsupported()
+}
+
+func checkNotBusy(device string) error {
+	return errUnsupported()
+}
+
+func runPartitionCommand(ctx context.Context, command []string) error {
+	return errUnsupported()
+}
+
+func checkBlockDevice(device string) error {
+	return errUnsupported()
+}
+
+func checkNotSystem(device string) error {
+	return errUnsupported()
+}
+
+func filesystemType(ctx context.Context, device string) string {
+	return ""
+}
+
+func (m *Manager) getDeviceInfo(ctx context.Context, device string) (uuid, label string) {
+	return "", ""
+}
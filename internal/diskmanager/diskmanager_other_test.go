@@ -0,0 +1,27 @@
+//go:build !linux
+
+package diskmanager
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestUnsupportedOperations(t *testing.T) {
+	m := New([]string{"/mnt"})
+	ctx := context.Background()
+
+	errs := map[string]error{}
+	_, errs["ListPartitions"] = m.ListPartitions(ctx)
+	_, errs["ListDisks"] = m.ListDisks(ctx)
+	errs["Mount"] = m.Mount(ctx, MountOptions{Device: "/dev/disk2s1", MountPoint: "/mnt/usb"})
+	errs["Unmount"] = m.Unmount(ctx, "/mnt/usb", false)
+	_, errs["GetSMARTInfo"] = m.GetSMARTInfo(ctx, "/dev/disk2")
+
+	for name, err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("%s: expected an unsupported error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package diskmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+)
+
+// Errors of formatting
+var (
+	ErrInvalidFormat = errors.New("invalid format request")
+	// ErrConfirmPhrase is returned when the request does not carry the
+	// phrase of FormatConfirmPhrase
+	ErrConfirmPhrase = errors.New("confirmation phrase does not match")
+	// ErrSystemDevice is returned for devices on the disks of the running
+	// system, which are never formatted
+	ErrSystemDevice = errors.New("device belongs to the running system")
+)
+
+// formatTimeout bounds mkfs, which takes longer than other commands on
+// large disks
+const formatTimeout = 10 * time.Minute
+
+// formatLabelLimits are the longest labels each filesystem takes, in
+// characters
+var formatLabelLimits = map[string]int{
+	"ext4":  16,
+	"xfs":   12,
+	"btrfs": 255,
+	"exfat": 15,
+	"ntfs":  128,
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// FormatOptions asks to create a filesystem on a disk or partition
+type FormatOptions struct {
+	Device     string `json:"device"`
+	FileSystem string `json:"filesystem"` // ext4, xfs, btrfs, exfat or ntfs
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`    // ext4, xfs and btrfs; random if empty
+	Confirm    string `json:"confirm,omitempty"` // Must be FormatConfirmPhrase(Device)
+}
+
+// FormatResult describes a formatted device
+type FormatResult struct {
+	Device     string `json:"device"`
+	FileSystem string `json:"filesystem"`
+	Label      string `json:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	Previous   string `json:"previous_filesystem,omitempty"` // What was on the device before
+}
+
+// FormatConfirmPhrase is the phrase a format request for device must
+// carry, so a device is never formatted by a mixed-up or replayed request
+func FormatConfirmPhrase(device string) string {
+	return "FORMAT " + device
+}
+
+// PlanFormat validates a format request and returns the command it would
+// run. The confirmation phrase is not needed.
+func (m *Manager) PlanFormat(ctx context.Context, opts *FormatOptions) (*dryrun.Plan, error) {
+	command, err := m.prepareFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+	return planOf([][]string{command}), nil
+}
+
+// Format creates a filesystem on a device, destroying what is on it.
+// Devices that are mounted, used as swap, held by LVM, RAID or dm-crypt,
+// or on the disks of the running system are refused.
+func (m *Manager) Format(ctx context.Context, opts *FormatOptions) (*FormatResult, error) {
+	if opts.Confirm != FormatConfirmPhrase(opts.Device) {
+		return nil, fmt.Errorf("%w: send %q as confirm", ErrConfirmPhrase, FormatConfirmPhrase(opts.Device))
+	}
+	command, err := m.prepareFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FormatResult{
+		Device:     opts.Device,
+		FileSystem: opts.FileSystem,
+		Previous:   filesystemType(ctx, opts.Device),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, formatTimeout)
+	defer cancel()
+	defer m.InvalidateCache()
+	if err := runPartitionCommand(ctx, command); err != nil {
+		return result, err
+	}
+	result.UUID, result.Label = m.getDeviceInfo(ctx, opts.Device)
+	return result, nil
+}
+
+// prepareFormat validates a format request and returns its mkfs command
+func (m *Manager) prepareFormat(opts *FormatOptions) ([]string, error) {
+	invalid := func(format string, args ...interface{}) ([]string, error) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidFormat, fmt.Sprintf(format, args...))
+	}
+
+	if !diskDevicePattern.MatchString(opts.Device) {
+		return invalid("device must be a path below /dev")
+	}
+	limit, ok := formatLabelLimits[opts.FileSystem]
+	if !ok {
+		return invalid("unsupported filesystem %q: expected ext4, xfs, btrfs, exfat or ntfs", opts.FileSystem)
+	}
+	if utf8.RuneCountInString(opts.Label) > limit {
+		return invalid("%s labels take at most %d characters", opts.FileSystem, limit)
+	}
+	for _, r := range opts.Label {
+		if r < 0x20 || r == 0x7f || r == '/' {
+			return invalid("label must not contain control characters or '/'")
+		}
+	}
+	if opts.UUID != "" {
+		if opts.FileSystem == "exfat" || opts.FileSystem == "ntfs" {
+			return invalid("%s has no UUID to set", opts.FileSystem)
+		}
+		if !uuidPattern.MatchString(opts.UUID) {
+			return invalid("uuid must look like 123e4567-e89b-12d3-a456-426614174000")
+		}
+	}
+
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return nil, err
+	}
+	if err := checkNotSystem(opts.Device); err != nil {
+		return nil, err
+	}
+	if err := checkNotBusy(opts.Device); err != nil {
+		return nil, err
+	}
+	return formatCommand(opts), nil
+}
+
+// formatCommand returns the mkfs command line of a validated request.
+// Options force formatting over existing filesystems, which the request
+// confirmed.
+func formatCommand(opts *FormatOptions) []string {
+	var command []string
+	switch opts.FileSystem {
+	case "ext4":
+		command = []string{"mkfs.ext4", "-F"}
+		if opts.UUID != "" {
+			command = append(command, "-U", opts.UUID)
+		}
+	case "xfs":
+		command = []string{"mkfs.xfs", "-f"}
+		if opts.UUID != "" {
+			command = append(command, "-m", "uuid="+opts.UUID)
+		}
+	case "btrfs":
+		command = []string{"mkfs.btrfs", "-f"}
+		if opts.UUID != "" {
+			command = append(command, "-U", opts.UUID)
+		}
+	case "exfat":
+		command = []string{"mkfs.exfat"}
+	case "ntfs":
+		// Quick format; a full one zeroes the device first
+		command = []string{"mkfs.ntfs", "-Q", "-F"}
+	}
+	if opts.Label != "" {
+		command = append(command, "-L", opts.Label)
+	}
+	return append(command, opts.Device)
+}
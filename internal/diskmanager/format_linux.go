@@ -0,0 +1,76 @@
+//go:build linux
+
+package diskmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// systemMounts are the mount points whose disks hold the running system
+var systemMounts = map[string]bool{
+	"/": true, "/boot": true, "/boot/efi": true, "/usr": true, "/var": true,
+}
+
+// checkBlockDevice fails unless device is a disk or partition
+func checkBlockDevice(device string) error {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidFormat, device, err)
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/block", filepath.Base(resolved))); err != nil {
+		return fmt.Errorf("%w: %s is not a block device", ErrInvalidFormat, device)
+	}
+	return nil
+}
+
+// checkNotSystem fails if device is on a disk holding a system mount, even
+// an unmounted partition of it
+func checkNotSystem(device string) error {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil
+	}
+	disk := parentDisk(filepath.Base(resolved))
+
+	for dev, mountPoint := range mountedDevices() {
+		if !systemMounts[mountPoint] {
+			continue
+		}
+		link, err := os.Readlink(filepath.Join("/sys/dev/block", dev))
+		if err != nil {
+			continue
+		}
+		if parentDisk(filepath.Base(link)) == disk {
+			return fmt.Errorf("%w: %s is on the disk of %s", ErrSystemDevice, device, mountPoint)
+		}
+	}
+	return nil
+}
+
+// parentDisk returns the disk a block device belongs to, or name itself
+// for disks
+func parentDisk(name string) string {
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		return name
+	}
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+		return filepath.Base(filepath.Dir(sysPath))
+	}
+	return name
+}
+
+// filesystemType returns the filesystem blkid finds on device, or ""
+func filesystemType(ctx context.Context, device string) string {
+	output, err := sysexec.Output(ctx, "blkid", "-o", "value", "-s", "TYPE", device)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,415 @@
+package diskmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// Errors of LUKS volumes
+var (
+	ErrInvalidLUKS = errors.New("invalid LUKS request")
+	// ErrNoLUKSKey is returned when opening a volume without a passphrase
+	// or key file and none is remembered for it
+	ErrNoLUKSKey = errors.New("no key for the LUKS volume")
+	// ErrWrongLUKSKey is returned when a volume refuses the key
+	ErrWrongLUKSKey = errors.New("wrong passphrase or key file")
+)
+
+// luksLabelMax is the longest LUKS2 label
+const luksLabelMax = 47
+
+var mapperNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// LUKSFormatOptions asks to create a LUKS2 volume on a device
+type LUKSFormatOptions struct {
+	Device     string `json:"device"`
+	Label      string `json:"label,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Keyfile    string `json:"keyfile,omitempty"` // Below the key file directory; instead of Passphrase
+	Remember   bool   `json:"remember,omitempty"`
+	Confirm    string `json:"confirm,omitempty"` // Must be FormatConfirmPhrase(Device)
+}
+
+// LUKSOpenOptions asks to unlock a LUKS volume. Without a passphrase or key
+// file, the remembered key of the volume is used.
+type LUKSOpenOptions struct {
+	Device     string `json:"device"`
+	Name       string `json:"name,omitempty"` // Device mapper name; luks-<uuid> if empty
+	Passphrase string `json:"passphrase,omitempty"`
+	Keyfile    string `json:"keyfile,omitempty"`
+	Remember   bool   `json:"remember,omitempty"`
+}
+
+// LUKSVolume describes a LUKS volume and whether it is unlocked
+type LUKSVolume struct {
+	Device     string `json:"device"`
+	UUID       string `json:"uuid"`
+	Label      string `json:"label,omitempty"`
+	Open       bool   `json:"open"`
+	Name       string `json:"name,omitempty"`   // Device mapper name while open
+	Mapper     string `json:"mapper,omitempty"` // Unlocked device while open
+	MountPoint string `json:"mount_point,omitempty"`
+	Remembered bool   `json:"key_remembered"`
+}
+
+// storedLUKSKey is a remembered key of a volume: an encrypted passphrase
+// or a key file path
+type storedLUKSKey struct {
+	Passphrase string `json:"passphrase,omitempty"`
+	Keyfile    string `json:"keyfile,omitempty"`
+}
+
+// luksKey is the key of a cryptsetup command, passed as --key-file
+type luksKey struct {
+	file   string // "-" for input
+	input  []byte
+	source string // passphrase, keyfile or stored
+	stored storedLUKSKey
+}
+
+// SetLUKSKeys enables key files below keyfileDir and remembering keys in
+// stateFile, with passphrases encrypted by credentials. Without it, LUKS
+// volumes take passphrases only and keys are not remembered.
+func (m *Manager) SetLUKSKeys(credentials *credcrypt.Cipher, keyfileDir, stateFile string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentials = credentials
+	m.keyfileDir = keyfileDir
+	m.luksStateFile = stateFile
+}
+
+// PlanLUKSFormat validates a LUKS format request and returns the command
+// it would run. The confirmation phrase is not needed.
+func (m *Manager) PlanLUKSFormat(ctx context.Context, opts *LUKSFormatOptions) (*dryrun.Plan, error) {
+	command, _, err := m.prepareLUKSFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+	return planOf([][]string{command}), nil
+}
+
+// FormatLUKS creates a LUKS2 volume on a device, destroying what is on it.
+// The checks of Format apply.
+func (m *Manager) FormatLUKS(ctx context.Context, opts *LUKSFormatOptions) (*LUKSVolume, error) {
+	if opts.Confirm != FormatConfirmPhrase(opts.Device) {
+		return nil, fmt.Errorf("%w: send %q as confirm", ErrConfirmPhrase, FormatConfirmPhrase(opts.Device))
+	}
+	command, key, err := m.prepareLUKSFormat(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Key derivation is benchmarked first, which takes a few seconds
+	formatCtx, cancel := context.WithTimeout(ctx, formatTimeout)
+	defer cancel()
+	defer m.InvalidateCache()
+	if err := runCryptsetup(formatCtx, key, command); err != nil {
+		return nil, err
+	}
+
+	uuid, err := luksUUID(ctx, opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	volume := &LUKSVolume{Device: opts.Device, UUID: uuid, Label: opts.Label}
+	if opts.Remember {
+		if err := m.rememberLUKSKey(uuid, key); err != nil {
+			return volume, err
+		}
+		volume.Remembered = true
+	}
+	return volume, nil
+}
+
+func (m *Manager) prepareLUKSFormat(opts *LUKSFormatOptions) ([]string, *luksKey, error) {
+	if !diskDevicePattern.MatchString(opts.Device) {
+		return nil, nil, fmt.Errorf("%w: device must be a path below /dev", ErrInvalidLUKS)
+	}
+	if len(opts.Label) > luksLabelMax || strings.ContainsFunc(opts.Label, isControl) {
+		return nil, nil, fmt.Errorf("%w: label must be at most %d printable characters", ErrInvalidLUKS, luksLabelMax)
+	}
+	key, err := m.luksKey(opts.Passphrase, opts.Keyfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("%w: passphrase or keyfile is required", ErrInvalidLUKS)
+	}
+	if opts.Remember && m.credentials == nil {
+		return nil, nil, fmt.Errorf("%w: keys can't be remembered without an encryption key", ErrInvalidLUKS)
+	}
+
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNotSystem(opts.Device); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNotBusy(opts.Device); err != nil {
+		return nil, nil, err
+	}
+
+	command := []string{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode"}
+	if opts.Label != "" {
+		command = append(command, "--label", opts.Label)
+	}
+	command = append(command, "--key-file", key.file, opts.Device)
+	return command, key, nil
+}
+
+// OpenLUKS unlocks a LUKS volume as /dev/mapper/<name>
+func (m *Manager) OpenLUKS(ctx context.Context, opts *LUKSOpenOptions) (*LUKSVolume, error) {
+	if !diskDevicePattern.MatchString(opts.Device) {
+		return nil, fmt.Errorf("%w: device must be a path below /dev", ErrInvalidLUKS)
+	}
+	uuid, err := luksUUID(ctx, opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	name := opts.Name
+	if name == "" {
+		name = "luks-" + uuid
+	}
+	if !mapperNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: name may hold letters, digits, '.', '_' and '-'", ErrInvalidLUKS)
+	}
+
+	key, err := m.luksKey(opts.Passphrase, opts.Keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		if key, err = m.storedLUKSKey(uuid); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Remember && m.credentials == nil {
+		return nil, fmt.Errorf("%w: keys can't be remembered without an encryption key", ErrInvalidLUKS)
+	}
+
+	defer m.InvalidateCache()
+	command := []string{"cryptsetup", "open", "--type", "luks", "--key-file", key.file, opts.Device, name}
+	if err := runCryptsetup(ctx, key, command); err != nil {
+		return nil, err
+	}
+
+	volume := &LUKSVolume{Device: opts.Device, UUID: uuid, Open: true, Name: name, Mapper: "/dev/mapper/" + name}
+	if opts.Remember && key.source != "stored" {
+		if err := m.rememberLUKSKey(uuid, key); err != nil {
+			return volume, err
+		}
+	}
+	volume.Remembered = m.hasLUKSKey(uuid)
+	return volume, nil
+}
+
+// CloseLUKS locks the LUKS volume open as /dev/mapper/<name>. It must not
+// be mounted.
+func (m *Manager) CloseLUKS(ctx context.Context, name string) error {
+	if !mapperNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidLUKS, name)
+	}
+	mapper := "/dev/mapper/" + name
+	if _, err := os.Stat(mapper); err != nil {
+		return fmt.Errorf("%w: %s is not open", ErrInvalidLUKS, name)
+	}
+	if err := checkNotBusy(mapper); err != nil {
+		return err
+	}
+
+	defer m.InvalidateCache()
+	return runCryptsetup(ctx, nil, []string{"cryptsetup", "close", name})
+}
+
+// ForgetLUKSKey drops the remembered key of a LUKS volume
+func (m *Manager) ForgetLUKSKey(ctx context.Context, device string) error {
+	if !diskDevicePattern.MatchString(device) {
+		return fmt.Errorf("%w: device must be a path below /dev", ErrInvalidLUKS)
+	}
+	uuid, err := luksUUID(ctx, device)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.loadLUKSKeys()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[uuid]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoLUKSKey, device)
+	}
+	delete(keys, uuid)
+	return m.saveLUKSKeys(keys)
+}
+
+// luksKey returns the key given in a request, or nil if there is none
+func (m *Manager) luksKey(passphrase, keyfile string) (*luksKey, error) {
+	switch {
+	case passphrase != "" && keyfile != "":
+		return nil, fmt.Errorf("%w: passphrase and keyfile are exclusive", ErrInvalidLUKS)
+	case passphrase != "":
+		return &luksKey{file: "-", input: []byte(passphrase), source: "passphrase"}, nil
+	case keyfile != "":
+		path, err := m.keyfilePath(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		return &luksKey{file: path, source: "keyfile", stored: storedLUKSKey{Keyfile: path}}, nil
+	}
+	return nil, nil
+}
+
+// keyfilePath resolves a key file, which must be a regular file in the key
+// file directory
+func (m *Manager) keyfilePath(keyfile string) (string, error) {
+	m.mu.Lock()
+	dir := m.keyfileDir
+	m.mu.Unlock()
+	if dir == "" {
+		return "", fmt.Errorf("%w: key files are not enabled", ErrInvalidLUKS)
+	}
+
+	path := keyfile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%w: key files must be in %s", ErrInvalidLUKS, dir)
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: key file %s not found", ErrInvalidLUKS, path)
+	}
+	return path, nil
+}
+
+func (m *Manager) rememberLUKSKey(uuid string, key *luksKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.credentials == nil {
+		return fmt.Errorf("%w: keys can't be remembered without an encryption key", ErrInvalidLUKS)
+	}
+
+	stored := key.stored
+	if key.source == "passphrase" {
+		encrypted, err := m.credentials.Encrypt(string(key.input))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt passphrase: %w", err)
+		}
+		stored = storedLUKSKey{Passphrase: encrypted}
+	}
+
+	keys, err := m.loadLUKSKeys()
+	if err != nil {
+		return err
+	}
+	keys[uuid] = stored
+	return m.saveLUKSKeys(keys)
+}
+
+func (m *Manager) storedLUKSKey(uuid string) (*luksKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.loadLUKSKeys()
+	if err != nil {
+		return nil, err
+	}
+	stored, ok := keys[uuid]
+	if !ok {
+		return nil, fmt.Errorf("%w: send a passphrase or keyfile", ErrNoLUKSKey)
+	}
+	if stored.Keyfile != "" {
+		return &luksKey{file: stored.Keyfile, source: "stored", stored: stored}, nil
+	}
+	passphrase, err := m.credentials.Decrypt(stored.Passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt remembered passphrase: %w", err)
+	}
+	return &luksKey{file: "-", input: []byte(passphrase), source: "stored", stored: stored}, nil
+}
+
+func (m *Manager) hasLUKSKey(uuid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, _ := m.loadLUKSKeys()
+	_, ok := keys[uuid]
+	return ok
+}
+
+// loadLUKSKeys reads the remembered keys by volume UUID. Called with mu
+// held.
+func (m *Manager) loadLUKSKeys() (map[string]storedLUKSKey, error) {
+	keys := make(map[string]storedLUKSKey)
+	if m.luksStateFile == "" || m.credentials == nil {
+		return keys, nil
+	}
+	if err := statefile.Read(m.luksStateFile, &keys); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read LUKS keys: %w", err)
+	}
+	return keys, nil
+}
+
+// saveLUKSKeys writes the remembered keys. Called with mu held.
+func (m *Manager) saveLUKSKeys(keys map[string]storedLUKSKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.luksStateFile), 0700); err != nil {
+		return fmt.Errorf("failed to save LUKS keys: %w", err)
+	}
+	if err := statefile.Write(m.luksStateFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to save LUKS keys: %w", err)
+	}
+	return nil
+}
+
+// luksUUID returns the UUID of a LUKS volume, failing if device isn't one
+func luksUUID(ctx context.Context, device string) (string, error) {
+	output, err := sysexec.CombinedOutput(ctx, "cryptsetup", "luksUUID", device)
+	if err != nil {
+		if sysexec.IsTimeout(err) {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %s is not a LUKS volume", ErrInvalidLUKS, device)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// runCryptsetup runs a cryptsetup command, passing an input key on
+// standard input so it never shows in the process list
+func runCryptsetup(ctx context.Context, key *luksKey, command []string) error {
+	var input []byte
+	if key != nil {
+		input = key.input
+	}
+	output, err := sysexec.CombinedOutputInput(ctx, input, command[0], command[1:]...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 && command[1] == "open" {
+		// cryptsetup exits with 2 when no key slot takes the key
+		return ErrWrongLUKSKey
+	}
+	if err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %s: %w", command[1], strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -0,0 +1,78 @@
+package diskmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
+)
+
+func TestLUKSKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyfileDir := filepath.Join(dir, "keys")
+	if err := os.MkdirAll(keyfileDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keyfileDir, "backup.key"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := credcrypt.New("test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(dir, "luks-keys.json")
+
+	m := New(nil)
+	m.SetLUKSKeys(credentials, keyfileDir, stateFile)
+
+	if _, err := m.luksKey("pass", "backup.key"); !errors.Is(err, ErrInvalidLUKS) {
+		t.Fatalf("expected passphrase and keyfile to be exclusive, got %v", err)
+	}
+	for _, keyfile := range []string{"../luks-keys.json", "/etc/passwd", "missing.key"} {
+		if _, err := m.luksKey("", keyfile); !errors.Is(err, ErrInvalidLUKS) {
+			t.Fatalf("expected %s to be refused, got %v", keyfile, err)
+		}
+	}
+
+	if _, err := m.storedLUKSKey("uuid-1"); !errors.Is(err, ErrNoLUKSKey) {
+		t.Fatalf("expected ErrNoLUKSKey, got %v", err)
+	}
+
+	passphrase, _ := m.luksKey("correct horse", "")
+	if err := m.rememberLUKSKey("uuid-1", passphrase); err != nil {
+		t.Fatal(err)
+	}
+	keyfile, err := m.luksKey("", "backup.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.rememberLUKSKey("uuid-2", keyfile); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "correct horse") {
+		t.Fatal("passphrase stored in plain text")
+	}
+
+	stored, err := m.storedLUKSKey("uuid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.file != "-" || string(stored.input) != "correct horse" {
+		t.Fatalf("unexpected stored passphrase %+v", stored)
+	}
+	stored, err = m.storedLUKSKey("uuid-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.file != filepath.Join(keyfileDir, "backup.key") || stored.input != nil {
+		t.Fatalf("unexpected stored key file %+v", stored)
+	}
+}
@@ -0,0 +1,229 @@
+package diskmanager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidOption is returned for mount options outside the allowed sets
+var ErrInvalidOption = errors.New("invalid mount option")
+
+// Mount option presets
+const (
+	PresetData      = "data"      // Internal disks
+	PresetRemovable = "removable" // USB sticks, SD cards and other removable media
+)
+
+// presets are always applied; requested options cannot remove them
+var presets = map[string][]string{
+	PresetData:      {"nosuid", "nodev"},
+	PresetRemovable: {"nosuid", "nodev", "noexec"},
+}
+
+// optionSpec describes an allowed option. Kind is "" for a flag, "uint",
+// "octal", "name" for a plain identifier, or a "|"-separated list of values.
+type optionSpec struct {
+	name string
+	kind string
+}
+
+func (s optionSpec) String() string {
+	switch s.kind {
+	case "":
+		return s.name
+	case "uint", "octal", "name":
+		return fmt.Sprintf("%s=<%s>", s.name, s.kind)
+	default:
+		return fmt.Sprintf("%s=%s", s.name, s.kind)
+	}
+}
+
+// commonOptions are allowed for every filesystem. suid, dev and exec are
+// deliberately missing so presets cannot be undone.
+var commonOptions = []optionSpec{
+	{"ro", ""}, {"rw", ""},
+	{"noatime", ""}, {"relatime", ""}, {"nodiratime", ""},
+	{"nosuid", ""}, {"nodev", ""}, {"noexec", ""},
+	{"sync", ""}, {"async", ""}, {"nofail", ""},
+}
+
+var ownerOptions = []optionSpec{
+	{"uid", "uint"}, {"gid", "uint"},
+	{"umask", "octal"}, {"fmask", "octal"}, {"dmask", "octal"},
+}
+
+var filesystemOptions = map[string][]optionSpec{
+	"ext4": {
+		{"discard", ""}, {"nodiscard", ""}, {"acl", ""}, {"noacl", ""}, {"user_xattr", ""},
+		{"commit", "uint"}, {"errors", "remount-ro|continue"}, {"data", "ordered|writeback|journal"},
+	},
+	"xfs": {
+		{"discard", ""}, {"nodiscard", ""}, {"inode64", ""}, {"noquota", ""}, {"logbufs", "uint"},
+	},
+	"btrfs": {
+		{"discard", "sync|async"}, {"nodiscard", ""}, {"ssd", ""}, {"autodefrag", ""},
+		{"compress", "zstd|lzo|zlib|no"}, {"compress-force", "zstd|lzo|zlib"},
+		{"subvol", "name"}, {"subvolid", "uint"}, {"space_cache", "v2"},
+	},
+	"vfat":  append([]optionSpec{{"utf8", ""}, {"shortname", "lower|win95|winnt|mixed"}, {"iocharset", "name"}}, ownerOptions...),
+	"exfat": append([]optionSpec{{"iocharset", "name"}}, ownerOptions...),
+	"ntfs3": append([]optionSpec{{"windows_names", ""}, {"prealloc", ""}}, ownerOptions...),
+	"ntfs":  ownerOptions,
+}
+
+// conflicts lists options that cannot be combined
+var conflicts = [][2]string{
+	{"ro", "rw"},
+	{"sync", "async"},
+	{"noatime", "relatime"},
+	{"discard", "nodiscard"},
+	{"acl", "noacl"},
+}
+
+// BuildMountOptions validates requested options for a filesystem and merges
+// them with the preset. An empty preset selects PresetRemovable for
+// removable devices and PresetData otherwise.
+func BuildMountOptions(fileSystem, preset string, removable bool, requested []string) ([]string, error) {
+	if preset == "" {
+		preset = PresetData
+		if removable {
+			preset = PresetRemovable
+		}
+	}
+	base, ok := presets[preset]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown preset %q", ErrInvalidOption, preset)
+	}
+	if removable && preset != PresetRemovable {
+		return nil, fmt.Errorf("%w: removable media must use the %s preset", ErrInvalidOption, PresetRemovable)
+	}
+
+	specs := allowedOptions(fileSystem)
+	options := append([]string{}, base...)
+	seen := make(map[string]bool)
+	for _, option := range base {
+		seen[option] = true
+	}
+
+	for _, option := range requested {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(option, "=")
+		spec, ok := specs[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not allowed for %s", ErrInvalidOption, name, describeFS(fileSystem))
+		}
+		if err := checkValue(spec, value, hasValue); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidOption, option, err)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		options = append(options, option)
+	}
+
+	for _, pair := range conflicts {
+		if seen[pair[0]] && seen[pair[1]] {
+			return nil, fmt.Errorf("%w: %s and %s cannot be combined", ErrInvalidOption, pair[0], pair[1])
+		}
+	}
+
+	return options, nil
+}
+
+// MountOptionSets describes the presets and allowed options per filesystem
+type MountOptionSets struct {
+	Presets     map[string][]string `json:"presets"`
+	Common      []string            `json:"common"`
+	Filesystems map[string][]string `json:"filesystems"`
+}
+
+// AllowedMountOptions returns the presets and allowed options
+func AllowedMountOptions() *MountOptionSets {
+	sets := &MountOptionSets{
+		Presets:     presets,
+		Common:      describe(commonOptions),
+		Filesystems: make(map[string][]string),
+	}
+	for fs, specs := range filesystemOptions {
+		sets.Filesystems[fs] = describe(specs)
+	}
+	return sets
+}
+
+func allowedOptions(fileSystem string) map[string]optionSpec {
+	specs := make(map[string]optionSpec)
+	for _, spec := range commonOptions {
+		specs[spec.name] = spec
+	}
+	for _, spec := range filesystemOptions[fileSystem] {
+		specs[spec.name] = spec
+	}
+	return specs
+}
+
+func checkValue(spec optionSpec, value string, hasValue bool) error {
+	if spec.kind == "" {
+		if hasValue {
+			return errors.New("takes no value")
+		}
+		return nil
+	}
+	// btrfs discard may be used as a flag as well
+	if !hasValue && spec.name == "discard" {
+		return nil
+	}
+	if value == "" {
+		return fmt.Errorf("expected %s", spec)
+	}
+
+	switch spec.kind {
+	case "uint":
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return fmt.Errorf("expected an unsigned integer")
+		}
+	case "octal":
+		if _, err := strconv.ParseUint(value, 8, 32); err != nil || len(value) > 4 {
+			return fmt.Errorf("expected an octal mask")
+		}
+	case "name":
+		for _, r := range value {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_@./", r)) {
+				return fmt.Errorf("invalid character %q", r)
+			}
+		}
+		if strings.Contains(value, "..") {
+			return fmt.Errorf("must not contain ..")
+		}
+	default:
+		for _, allowed := range strings.Split(spec.kind, "|") {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", spec.kind)
+	}
+	return nil
+}
+
+func describe(specs []optionSpec) []string {
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func describeFS(fileSystem string) string {
+	if fileSystem == "" {
+		return "an unspecified filesystem"
+	}
+	return fileSystem
+}
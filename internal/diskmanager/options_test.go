@@ -0,0 +1,74 @@
+package diskmanager
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBuildMountOptionsPresets(t *testing.T) {
+	options, err := BuildMountOptions("vfat", "", true, []string{"uid=1000", "umask=022", "nosuid"})
+	if err != nil {
+		t.Fatalf("BuildMountOptions: %v", err)
+	}
+	expected := []string{"nosuid", "nodev", "noexec", "uid=1000", "umask=022"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("expected %v, got %v", expected, options)
+	}
+
+	options, err = BuildMountOptions("ext4", "", false, []string{"noatime"})
+	if err != nil {
+		t.Fatalf("BuildMountOptions: %v", err)
+	}
+	expected = []string{"nosuid", "nodev", "noatime"}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("expected %v, got %v", expected, options)
+	}
+}
+
+func TestBuildMountOptionsRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		fileSystem string
+		preset     string
+		removable  bool
+		options    []string
+	}{
+		{"suid", "ext4", "", false, []string{"suid"}},
+		{"exec on removable", "vfat", "", true, []string{"exec"}},
+		{"data preset on removable", "vfat", PresetData, true, nil},
+		{"unknown preset", "ext4", "fast", false, nil},
+		{"option of another filesystem", "xfs", "", false, []string{"uid=0"}},
+		{"bad enum", "ext4", "", false, []string{"errors=panic"}},
+		{"bad number", "vfat", "", false, []string{"uid=root"}},
+		{"bad mask", "vfat", "", false, []string{"umask=999"}},
+		{"value on flag", "ext4", "", false, []string{"noatime=1"}},
+		{"path escape", "btrfs", "", false, []string{"subvol=../root"}},
+		{"conflict", "ext4", "", false, []string{"ro", "rw"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildMountOptions(tt.fileSystem, tt.preset, tt.removable, tt.options)
+			if !errors.Is(err, ErrInvalidOption) {
+				t.Fatalf("expected ErrInvalidOption, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAllowedMountOptions(t *testing.T) {
+	sets := AllowedMountOptions()
+	if !reflect.DeepEqual(sets.Presets[PresetRemovable], []string{"nosuid", "nodev", "noexec"}) {
+		t.Fatalf("unexpected removable preset: %v", sets.Presets[PresetRemovable])
+	}
+	found := false
+	for _, option := range sets.Filesystems["ext4"] {
+		if option == "errors=remount-ro|continue" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("ext4 options missing errors=: %v", sets.Filesystems["ext4"])
+	}
+}
@@ -0,0 +1,385 @@
+package diskmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+)
+
+// Errors of partition changes
+var (
+	ErrInvalidPartition = errors.New("invalid partition change")
+	ErrPartitionBusy    = errors.New("partition is in use")
+	// ErrConfirmation is returned for confirmation tokens that are unknown,
+	// expired, issued for another change, or whose disk changed since
+	ErrConfirmation = errors.New("invalid or expired confirmation token")
+)
+
+// Partition change actions
+const (
+	PartitionCreate = "create"
+	PartitionDelete = "delete"
+	PartitionResize = "resize"
+)
+
+// confirmTTL is how long a confirmation token can be used
+const confirmTTL = 5 * time.Minute
+
+// partitionAlign is the alignment of new partitions and partition ends, in
+// bytes
+const partitionAlign = 1 << 20
+
+// partitionFSTypes are the filesystem types parted may tag partitions with
+var partitionFSTypes = map[string]bool{
+	"": true, "ext4": true, "xfs": true, "btrfs": true, "linux-swap": true, "fat32": true, "ntfs": true,
+}
+
+var (
+	diskDevicePattern    = regexp.MustCompile(`^/dev/[A-Za-z0-9_/-]+$`)
+	partitionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,36}$`)
+)
+
+// PartitionTable is the partition table of a disk. Label is "" for disks
+// without one.
+type PartitionTable struct {
+	Device     string           `json:"device"`
+	Label      string           `json:"label"` // gpt or dos
+	ID         string           `json:"id,omitempty"`
+	SectorSize uint64           `json:"sector_size"`
+	Sectors    uint64           `json:"sectors"`   // Of the whole disk
+	FirstLBA   uint64           `json:"first_lba"` // First and last sector partitions may use
+	LastLBA    uint64           `json:"last_lba"`
+	Partitions []PartitionEntry `json:"partitions"`
+}
+
+// PartitionEntry is a partition of a partition table. Start and Sectors
+// count sectors.
+type PartitionEntry struct {
+	Number  int    `json:"number"`
+	Node    string `json:"node"`
+	Start   uint64 `json:"start"`
+	Sectors uint64 `json:"sectors"`
+	Size    uint64 `json:"size"` // Bytes
+	Type    string `json:"type"`
+	UUID    string `json:"uuid,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+// end returns the last sector of the partition
+func (p PartitionEntry) end() uint64 {
+	return p.Start + p.Sectors - 1
+}
+
+// PartitionRequest asks to create, delete or resize a partition. Sizes
+// and offsets are in bytes.
+type PartitionRequest struct {
+	Action string `json:"-"`
+	Device string `json:"device"` // Whole disk, like /dev/sdb
+
+	// Create: Start 0 takes the first free space large enough, Size 0 all
+	// of it. Table creates a partition table (gpt or msdos) on a disk
+	// without one. Name is the GPT partition name; FSType tags the
+	// partition for a filesystem, which is not created.
+	Start  uint64 `json:"start,omitempty"`
+	Size   uint64 `json:"size,omitempty"` // Resize: the new size
+	Table  string `json:"table,omitempty"`
+	Name   string `json:"name,omitempty"`
+	FSType string `json:"fs_type,omitempty"`
+
+	Number       int    `json:"number,omitempty"` // Delete and resize
+	ConfirmToken string `json:"confirm_token,omitempty"`
+}
+
+// PartitionChange is a planned change waiting to be confirmed by sending
+// the request again with ConfirmToken
+type PartitionChange struct {
+	Table        *PartitionTable `json:"table"` // As the change was planned on
+	Plan         *dryrun.Plan    `json:"plan"`
+	ConfirmToken string          `json:"confirm_token"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+}
+
+// pendingChange is what a confirmation token was issued for
+type pendingChange struct {
+	request   string
+	digest    string // Of the partition table the change was planned on
+	expiresAt time.Time
+}
+
+// GetPartitionTable reads the partition table of a disk
+func (m *Manager) GetPartitionTable(ctx context.Context, device string) (*PartitionTable, error) {
+	table, _, err := m.readTable(ctx, device)
+	return table, err
+}
+
+// PlanPartitionChange returns the commands a change would run, without
+// running them
+func (m *Manager) PlanPartitionChange(ctx context.Context, req *PartitionRequest) (*dryrun.Plan, error) {
+	_, _, commands, err := m.preparePartitionChange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return planOf(commands), nil
+}
+
+// RequestPartitionChange validates and plans a change, and issues the
+// token that confirms it. Nothing is changed until the token is used.
+func (m *Manager) RequestPartitionChange(ctx context.Context, req *PartitionRequest) (*PartitionChange, error) {
+	table, digest, commands, err := m.preparePartitionChange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("generate confirmation token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(confirmTTL)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for t, pending := range m.pending {
+		if time.Now().After(pending.expiresAt) {
+			delete(m.pending, t)
+		}
+	}
+	m.pending[token] = &pendingChange{request: requestKey(req), digest: digest, expiresAt: expiresAt}
+
+	return &PartitionChange{Table: table, Plan: planOf(commands), ConfirmToken: token, ExpiresAt: expiresAt}, nil
+}
+
+// ApplyPartitionChange runs a change confirmed with the token issued for
+// it. Tokens are used up, and refused if the request differs from the
+// one they were issued for or the partition table changed since. The new
+// partition table is returned.
+func (m *Manager) ApplyPartitionChange(ctx context.Context, req *PartitionRequest) (*PartitionTable, error) {
+	m.mu.Lock()
+	pending, ok := m.pending[req.ConfirmToken]
+	delete(m.pending, req.ConfirmToken)
+	m.mu.Unlock()
+	if !ok || time.Now().After(pending.expiresAt) || pending.request != requestKey(req) {
+		return nil, ErrConfirmation
+	}
+
+	// One change at a time, so a second token planned on the same table
+	// finds it changed
+	m.partitionMu.Lock()
+	defer m.partitionMu.Unlock()
+
+	_, digest, commands, err := m.preparePartitionChange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if digest != pending.digest {
+		return nil, fmt.Errorf("%w: the partition table changed", ErrConfirmation)
+	}
+
+	defer m.InvalidateCache()
+	for _, command := range commands {
+		if err := runPartitionCommand(ctx, command); err != nil {
+			return nil, err
+		}
+	}
+	return m.GetPartitionTable(ctx, req.Device)
+}
+
+// preparePartitionChange validates a change against the current partition
+// table and returns the table, its digest and the commands of the change
+func (m *Manager) preparePartitionChange(ctx context.Context, req *PartitionRequest) (*PartitionTable, string, [][]string, error) {
+	if !diskDevicePattern.MatchString(req.Device) {
+		return nil, "", nil, fmt.Errorf("%w: device must be a path below /dev", ErrInvalidPartition)
+	}
+	table, digest, err := m.readTable(ctx, req.Device)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	commands, busy, err := planPartitionChange(table, req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	for _, device := range busy {
+		if err := checkNotBusy(device); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	return table, digest, commands, nil
+}
+
+// planPartitionChange validates req against table and returns the parted
+// commands of the change, and the devices that must not be in use
+func planPartitionChange(table *PartitionTable, req *PartitionRequest) ([][]string, []string, error) {
+	invalid := func(format string, args ...interface{}) ([][]string, []string, error) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidPartition, fmt.Sprintf(format, args...))
+	}
+
+	switch req.Action {
+	case PartitionCreate:
+		var commands [][]string
+		var busy []string
+		label := table.Label
+		switch {
+		case req.Table == "":
+		case req.Table != "gpt" && req.Table != "msdos":
+			return invalid("table must be gpt or msdos")
+		case label != "":
+			return invalid("%s already has a %s partition table", table.Device, label)
+		default:
+			// A new table replaces whatever is on the disk
+			commands = append(commands, []string{"parted", "-s", table.Device, "mklabel", req.Table})
+			busy = append(busy, table.Device)
+			label = req.Table
+			if label == "msdos" {
+				label = "dos"
+			}
+		}
+		if label == "" {
+			return invalid("%s has no partition table; set table to create one", table.Device)
+		}
+		if !partitionFSTypes[req.FSType] {
+			return invalid("unsupported fs_type %q", req.FSType)
+		}
+		name := "primary"
+		if req.Name != "" {
+			if label != "gpt" {
+				return invalid("partition names need a gpt partition table")
+			}
+			if !partitionNamePattern.MatchString(req.Name) {
+				return invalid("name must be 1 to 36 letters, digits, '_', '.' or '-'")
+			}
+			name = req.Name
+		}
+		if label == "dos" && len(table.Partitions) >= 4 {
+			return invalid("a dos partition table holds at most 4 primary partitions")
+		}
+		start, end, err := findSpace(table, req.Start, req.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		mkpart := []string{"parted", "-s", "-a", "optimal", table.Device, "unit", "s", "mkpart", name}
+		if req.FSType != "" {
+			mkpart = append(mkpart, req.FSType)
+		}
+		mkpart = append(mkpart, sectorArg(start), sectorArg(end))
+		return append(commands, mkpart), busy, nil
+
+	case PartitionDelete, PartitionResize:
+		index := -1
+		for i, p := range table.Partitions {
+			if p.Number == req.Number {
+				index = i
+			}
+		}
+		if index < 0 {
+			return invalid("%s has no partition %d", table.Device, req.Number)
+		}
+		partition := table.Partitions[index]
+		number := strconv.Itoa(partition.Number)
+		if req.Action == PartitionDelete {
+			return [][]string{{"parted", "-s", table.Device, "rm", number}}, []string{partition.Node}, nil
+		}
+
+		sectors := roundUp(req.Size, table.SectorSize) / table.SectorSize
+		if sectors <= partition.Sectors {
+			// Shrinking would cut off the filesystem on it
+			return invalid("partitions can only grow; %s has %d bytes", partition.Node, partition.Size)
+		}
+		end := partition.Start + sectors - 1
+		limit := table.LastLBA
+		for _, p := range table.Partitions {
+			if p.Start > partition.Start && p.Start-1 < limit {
+				limit = p.Start - 1
+			}
+		}
+		if end > limit {
+			return invalid("%s can grow to at most %d bytes", partition.Node, (limit-partition.Start+1)*table.SectorSize)
+		}
+		return [][]string{{"parted", "-s", table.Device, "unit", "s", "resizepart", number, sectorArg(end)}}, []string{partition.Node}, nil
+	}
+	return invalid("unknown action %q", req.Action)
+}
+
+// findSpace returns the first and last sector of a new partition of size
+// bytes at start, or in the first free space that fits it. Partitions
+// start at 1 MiB boundaries and take at least 1 MiB.
+func findSpace(table *PartitionTable, start, size uint64) (uint64, uint64, error) {
+	align := partitionAlign / table.SectorSize
+	if start%partitionAlign != 0 {
+		return 0, 0, fmt.Errorf("%w: start must be a multiple of 1 MiB", ErrInvalidPartition)
+	}
+	if size != 0 && size < partitionAlign {
+		return 0, 0, fmt.Errorf("%w: partitions take at least 1 MiB", ErrInvalidPartition)
+	}
+	sectors := roundUp(size, table.SectorSize) / table.SectorSize
+
+	used := append([]PartitionEntry(nil), table.Partitions...)
+	sort.Slice(used, func(i, j int) bool { return used[i].Start < used[j].Start })
+	from := table.FirstLBA
+	for i := 0; i <= len(used); i++ {
+		to := table.LastLBA
+		if i < len(used) {
+			to = used[i].Start - 1
+		}
+		first := roundUp(from, align)
+		if start != 0 {
+			first = start / table.SectorSize
+		}
+		if first >= from && first <= to {
+			last := to
+			if sectors != 0 {
+				last = first + sectors - 1
+			}
+			if last <= to && last-first+1 >= align {
+				return first, last, nil
+			}
+		}
+		if i < len(used) {
+			from = used[i].end() + 1
+		}
+	}
+	if start != 0 {
+		return 0, 0, fmt.Errorf("%w: no free space of that size at %d", ErrInvalidPartition, start)
+	}
+	return 0, 0, fmt.Errorf("%w: no free space of that size on %s", ErrInvalidPartition, table.Device)
+}
+
+func roundUp(n, multiple uint64) uint64 {
+	return (n + multiple - 1) / multiple * multiple
+}
+
+func sectorArg(sector uint64) string {
+	return strconv.FormatUint(sector, 10) + "s"
+}
+
+func planOf(commands [][]string) *dryrun.Plan {
+	plan := dryrun.New()
+	for _, command := range commands {
+		plan.AddCommand(command[0], command[1:]...)
+	}
+	return plan
+}
+
+// requestKey identifies a change for its confirmation token
+func requestKey(req *PartitionRequest) string {
+	key := *req
+	key.ConfirmToken = ""
+	data, _ := json.Marshal(key)
+	return req.Action + " " + string(data)
+}
+
+// tableDigest identifies the state of a partition table, as reported by
+// sfdisk
+func tableDigest(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
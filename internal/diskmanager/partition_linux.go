@@ -0,0 +1,220 @@
+//go:build linux
+
+package diskmanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// readTable reads the partition table of a whole disk with sfdisk, and
+// returns it with its digest
+func (m *Manager) readTable(ctx context.Context, device string) (*PartitionTable, string, error) {
+	name, err := diskName(device)
+	if err != nil {
+		return nil, "", err
+	}
+	sectorSize := readSysUint(filepath.Join("/sys/class/block", name, "queue", "logical_block_size"))
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	// sysfs counts 512-byte sectors whatever the disk's sector size
+	sectors := readSysUint(filepath.Join("/sys/class/block", name, "size")) * 512 / sectorSize
+
+	table := &PartitionTable{
+		Device:     device,
+		SectorSize: sectorSize,
+		Sectors:    sectors,
+		Partitions: []PartitionEntry{},
+	}
+	output, err := sysexec.Output(ctx, "sfdisk", "--json", device)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && bytes.Contains(exitErr.Stderr, []byte("does not contain a recognized partition table")) {
+			// Room for a GPT, whose backup sits in the last 33 sectors
+			table.FirstLBA = partitionAlign / sectorSize
+			if sectors > 34 {
+				table.LastLBA = sectors - 34
+			}
+			return table, tableDigest(nil), nil
+		}
+		return nil, "", fmt.Errorf("sfdisk failed: %w", err)
+	}
+
+	var result struct {
+		PartitionTable struct {
+			Label      string `json:"label"`
+			ID         string `json:"id"`
+			FirstLBA   uint64 `json:"firstlba"`
+			LastLBA    uint64 `json:"lastlba"`
+			SectorSize uint64 `json:"sectorsize"`
+			Partitions []struct {
+				Node  string `json:"node"`
+				Start uint64 `json:"start"`
+				Size  uint64 `json:"size"`
+				Type  string `json:"type"`
+				UUID  string `json:"uuid"`
+				Name  string `json:"name"`
+			} `json:"partitions"`
+		} `json:"partitiontable"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, "", fmt.Errorf("failed to parse sfdisk output: %w", err)
+	}
+
+	pt := result.PartitionTable
+	table.Label, table.ID = pt.Label, pt.ID
+	if pt.SectorSize != 0 {
+		table.SectorSize = pt.SectorSize
+	}
+	table.FirstLBA, table.LastLBA = pt.FirstLBA, pt.LastLBA
+	// dos tables don't report their usable range
+	if table.FirstLBA == 0 {
+		table.FirstLBA = partitionAlign / table.SectorSize
+	}
+	if table.LastLBA == 0 && sectors > 0 {
+		table.LastLBA = sectors - 1
+	}
+	for _, p := range pt.Partitions {
+		table.Partitions = append(table.Partitions, PartitionEntry{
+			Number:  partitionNumber(p.Node),
+			Node:    p.Node,
+			Start:   p.Start,
+			Sectors: p.Size,
+			Size:    p.Size * table.SectorSize,
+			Type:    p.Type,
+			UUID:    p.UUID,
+			Name:    p.Name,
+		})
+	}
+	return table, tableDigest(output), nil
+}
+
+// diskName returns the kernel name of device, which must be a whole disk
+func diskName(device string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrInvalidPartition, device, err)
+	}
+	name := filepath.Base(resolved)
+	if _, err := os.Stat(filepath.Join("/sys/class/block", name)); err != nil {
+		return "", fmt.Errorf("%w: %s is not a block device", ErrInvalidPartition, device)
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/block", name, "partition")); err == nil {
+		return "", fmt.Errorf("%w: %s is a partition, not a disk", ErrInvalidPartition, device)
+	}
+	return name, nil
+}
+
+// partitionNumber returns the number at the end of a partition node, like
+// 2 for /dev/sda2 or /dev/nvme0n1p2
+func partitionNumber(node string) int {
+	i := len(node)
+	for i > 0 && node[i-1] >= '0' && node[i-1] <= '9' {
+		i--
+	}
+	n, _ := strconv.Atoi(node[i:])
+	return n
+}
+
+func readSysUint(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
+
+// checkNotBusy fails if device, or a partition of it, is mounted, used as
+// swap, or held by LVM, RAID or dm-crypt
+func checkNotBusy(device string) error {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil
+	}
+	name := filepath.Base(resolved)
+	names := []string{name}
+	if entries, err := os.ReadDir(filepath.Join("/sys/class/block", name)); err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), name) {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	mounted := mountedDevices()
+	for _, name := range names {
+		if holders, _ := os.ReadDir(filepath.Join("/sys/class/block", name, "holders")); len(holders) > 0 {
+			return fmt.Errorf("%w: /dev/%s is held by %s", ErrPartitionBusy, name, holders[0].Name())
+		}
+		dev := readSysString(filepath.Join("/sys/class/block", name, "dev"))
+		if where, ok := mounted[dev]; ok && dev != "" {
+			return fmt.Errorf("%w: /dev/%s is mounted at %s", ErrPartitionBusy, name, where)
+		}
+		if isSwap("/dev/" + name) {
+			return fmt.Errorf("%w: /dev/%s is used as swap", ErrPartitionBusy, name)
+		}
+	}
+	return nil
+}
+
+// mountedDevices maps the major:minor numbers of mounted devices to a
+// mount point
+func mountedDevices() map[string]string {
+	mounted := make(map[string]string)
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return mounted
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 {
+			mounted[fields[2]] = fields[4]
+		}
+	}
+	return mounted
+}
+
+func isSwap(device string) bool {
+	data, err := os.ReadFile("/proc/swaps")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == device {
+			return true
+		}
+	}
+	return false
+}
+
+func readSysString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// runPartitionCommand runs a parted command of a change
+func runPartitionCommand(ctx context.Context, command []string) error {
+	output, err := sysexec.CombinedOutput(ctx, command[0], command[1:]...)
+	if err != nil {
+		return fmt.Errorf("%s failed: %s: %w", command[0], strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package diskmanager
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testTable is a 1 GiB GPT disk with 100 MiB and 200 MiB partitions,
+// leaving a 100 MiB gap between them
+func testTable() *PartitionTable {
+	return &PartitionTable{
+		Device:     "/dev/sdb",
+		Label:      "gpt",
+		SectorSize: 512,
+		Sectors:    2097152,
+		FirstLBA:   2048,
+		LastLBA:    2097118,
+		Partitions: []PartitionEntry{
+			{Number: 1, Node: "/dev/sdb1", Start: 2048, Sectors: 204800},
+			{Number: 2, Node: "/dev/sdb2", Start: 411648, Sectors: 409600},
+		},
+	}
+}
+
+func TestPlanPartitionChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      PartitionRequest
+		expected [][]string
+		busy     []string
+	}{
+		{
+			"create in the first gap that fits",
+			PartitionRequest{Action: PartitionCreate, Size: 50 << 20, Name: "backup"},
+			[][]string{{"parted", "-s", "-a", "optimal", "/dev/sdb", "unit", "s", "mkpart", "backup", "206848s", "309247s"}},
+			nil,
+		},
+		{
+			"create with the rest of the disk",
+			PartitionRequest{Action: PartitionCreate, Size: 200 << 20, FSType: "ext4"},
+			[][]string{{"parted", "-s", "-a", "optimal", "/dev/sdb", "unit", "s", "mkpart", "primary", "ext4", "821248s", "1230847s"}},
+			nil,
+		},
+		{
+			"delete",
+			PartitionRequest{Action: PartitionDelete, Number: 2},
+			[][]string{{"parted", "-s", "/dev/sdb", "rm", "2"}},
+			[]string{"/dev/sdb2"},
+		},
+		{
+			"grow into the gap",
+			PartitionRequest{Action: PartitionResize, Number: 1, Size: 150 << 20},
+			[][]string{{"parted", "-s", "/dev/sdb", "unit", "s", "resizepart", "1", "309247s"}},
+			[]string{"/dev/sdb1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, busy, err := planPartitionChange(testTable(), &tt.req)
+			if err != nil {
+				t.Fatalf("planPartitionChange: %v", err)
+			}
+			if !reflect.DeepEqual(commands, tt.expected) || !reflect.DeepEqual(busy, tt.busy) {
+				t.Fatalf("expected %v busy %v, got %v busy %v", tt.expected, tt.busy, commands, busy)
+			}
+		})
+	}
+
+	blank := &PartitionTable{Device: "/dev/sdc", SectorSize: 512, Sectors: 2097152, FirstLBA: 2048, LastLBA: 2097118, Partitions: []PartitionEntry{}}
+	commands, busy, err := planPartitionChange(blank, &PartitionRequest{Action: PartitionCreate, Table: "gpt"})
+	if err != nil {
+		t.Fatalf("planPartitionChange: %v", err)
+	}
+	expected := [][]string{
+		{"parted", "-s", "/dev/sdc", "mklabel", "gpt"},
+		{"parted", "-s", "-a", "optimal", "/dev/sdc", "unit", "s", "mkpart", "primary", "2048s", "2097118s"},
+	}
+	if !reflect.DeepEqual(commands, expected) || !reflect.DeepEqual(busy, []string{"/dev/sdc"}) {
+		t.Fatalf("expected %v, got %v busy %v", expected, commands, busy)
+	}
+}
+
+func TestPlanPartitionChangeRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		req  PartitionRequest
+	}{
+		{"no table", PartitionRequest{Action: PartitionCreate}},
+		{"replace table", PartitionRequest{Action: PartitionCreate, Table: "msdos"}},
+		{"too large", PartitionRequest{Action: PartitionCreate, Size: 1 << 30}},
+		{"too small", PartitionRequest{Action: PartitionCreate, Size: 4096}},
+		{"unaligned start", PartitionRequest{Action: PartitionCreate, Start: 512 << 10}},
+		{"start inside a partition", PartitionRequest{Action: PartitionCreate, Start: 10 << 20}},
+		{"unknown fs type", PartitionRequest{Action: PartitionCreate, FSType: "zfs"}},
+		{"bad name", PartitionRequest{Action: PartitionCreate, Name: "a;b"}},
+		{"unknown partition", PartitionRequest{Action: PartitionDelete, Number: 3}},
+		{"shrink", PartitionRequest{Action: PartitionResize, Number: 2, Size: 100 << 20}},
+		{"grow over the next partition", PartitionRequest{Action: PartitionResize, Number: 1, Size: 300 << 20}},
+		{"unknown action", PartitionRequest{Action: "format"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := testTable()
+			if tt.name == "no table" {
+				table.Label, table.Partitions = "", nil
+			}
+			if _, _, err := planPartitionChange(table, &tt.req); !errors.Is(err, ErrInvalidPartition) {
+				t.Fatalf("expected ErrInvalidPartition, got %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyPartitionChangeNeedsToken(t *testing.T) {
+	m := New(nil)
+	req := &PartitionRequest{Action: PartitionDelete, Device: "/dev/sdb", Number: 1, ConfirmToken: "unknown"}
+	if _, err := m.ApplyPartitionChange(t.Context(), req); !errors.Is(err, ErrConfirmation) {
+		t.Fatalf("expected ErrConfirmation, got %v", err)
+	}
+}
+
+func TestFormatCommand(t *testing.T) {
+	tests := []struct {
+		opts     FormatOptions
+		expected []string
+	}{
+		{FormatOptions{Device: "/dev/sdb1", FileSystem: "ext4", Label: "backup", UUID: "3f1c2a9e-3b7d-41c8-a6e2-f1d04b9c7e35"},
+			[]string{"mkfs.ext4", "-F", "-U", "3f1c2a9e-3b7d-41c8-a6e2-f1d04b9c7e35", "-L", "backup", "/dev/sdb1"}},
+		{FormatOptions{Device: "/dev/sdb1", FileSystem: "xfs", UUID: "3f1c2a9e-3b7d-41c8-a6e2-f1d04b9c7e35"},
+			[]string{"mkfs.xfs", "-f", "-m", "uuid=3f1c2a9e-3b7d-41c8-a6e2-f1d04b9c7e35", "/dev/sdb1"}},
+		{FormatOptions{Device: "/dev/sdc", FileSystem: "ntfs", Label: "Media"},
+			[]string{"mkfs.ntfs", "-Q", "-F", "-L", "Media", "/dev/sdc"}},
+	}
+	for _, tt := range tests {
+		if command := formatCommand(&tt.opts); !reflect.DeepEqual(command, tt.expected) {
+			t.Errorf("expected %v, got %v", tt.expected, command)
+		}
+	}
+}
+
+func TestFormatRejects(t *testing.T) {
+	m := New(nil)
+	tests := []struct {
+		name     string
+		opts     FormatOptions
+		expected error
+	}{
+		{"no confirmation", FormatOptions{Device: "/dev/sdb1", FileSystem: "ext4"}, ErrConfirmPhrase},
+		{"other device confirmed", FormatOptions{Device: "/dev/sdb1", FileSystem: "ext4", Confirm: "FORMAT /dev/sdb2"}, ErrConfirmPhrase},
+		{"unknown filesystem", FormatOptions{Device: "/dev/sdb1", FileSystem: "zfs", Confirm: "FORMAT /dev/sdb1"}, ErrInvalidFormat},
+		{"long label", FormatOptions{Device: "/dev/sdb1", FileSystem: "xfs", Label: "a-very-long-label", Confirm: "FORMAT /dev/sdb1"}, ErrInvalidFormat},
+		{"uuid on exfat", FormatOptions{Device: "/dev/sdb1", FileSystem: "exfat", UUID: "3f1c2a9e-3b7d-41c8-a6e2-f1d04b9c7e35", Confirm: "FORMAT /dev/sdb1"}, ErrInvalidFormat},
+		{"bad uuid", FormatOptions{Device: "/dev/sdb1", FileSystem: "ext4", UUID: "1234", Confirm: "FORMAT /dev/sdb1"}, ErrInvalidFormat},
+		{"not a device", FormatOptions{Device: "/etc/passwd", FileSystem: "ext4", Confirm: "FORMAT /etc/passwd"}, ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.Format(t.Context(), &tt.opts); !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package diskmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/cache"
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
+)
+
+// Partition represents a disk partition
+type Partition struct {
+	Name       string  `json:"name"`
+	Device     string  `json:"device"`
+	MountPoint string  `json:"mount_point"`
+	FileSystem string  `json:"filesystem"`
+	Size       uint64  `json:"size"`
+	Used       uint64  `json:"used"`
+	Available  uint64  `json:"available"`
+	UsedPct    float64 `json:"used_percent"`
+	UUID       string  `json:"uuid"`
+	Label      string  `json:"label"`
+	ReadOnly   bool    `json:"read_only"`
+}
+
+// DiskInfo represents physical disk information
+type DiskInfo struct {
+	Device     string       `json:"device"`
+	Model      string       `json:"model"`
+	Size       uint64       `json:"size"`
+	Partitions []Partition  `json:"partitions"`
+	Encrypted  []LUKSVolume `json:"encrypted,omitempty"` // LUKS volumes on the disk or its partitions
+	SMART      *SMARTInfo   `json:"smart,omitempty"`
+}
+
+// SMARTInfo represents SMART health information
+type SMARTInfo struct {
+	Healthy      bool   `json:"healthy"`
+	Temperature  int    `json:"temperature"`
+	PowerOnHours int    `json:"power_on_hours"`
+	RawData      string `json:"raw_data,omitempty"`
+}
+
+// MountOptions represents mount operation options
+type MountOptions struct {
+	Device     string   `json:"device"`
+	MountPoint string   `json:"mount_point"`
+	FileSystem string   `json:"filesystem"`
+	Options    []string `json:"options"`
+	Preset     string   `json:"preset,omitempty"` // PresetData or PresetRemovable; chosen from the device when empty
+	ReadOnly   bool     `json:"read_only"`
+}
+
+// Manager handles disk management operations
+type Manager struct {
+	allowedMountPoints []string
+	partitions         *cache.Cache[[]Partition]
+	disks              *cache.Cache[[]DiskInfo]
+	smart              *cache.Cache[*SMARTInfo]
+
+	mu          sync.Mutex
+	pending     map[string]*pendingChange // Partition changes by confirmation token
+	partitionMu sync.Mutex                // Serializes partition changes
+
+	credentials   *credcrypt.Cipher // Encrypts remembered LUKS passphrases
+	keyfileDir    string
+	luksStateFile string
+}
+
+// New creates a new disk manager
+func New(allowedMountPoints []string) *Manager {
+	return &Manager{
+		allowedMountPoints: allowedMountPoints,
+		pending:            make(map[string]*pendingChange),
+	}
+}
+
+// SetCacheTTL keeps disk and partition listings for listTTL and SMART data
+// for smartTTL, so polling does not rerun lsblk, blkid and smartctl. Mounts
+// and unmounts drop the listings. A TTL of 0 disables caching.
+func (m *Manager) SetCacheTTL(listTTL, smartTTL time.Duration) {
+	m.partitions = cache.New[[]Partition](listTTL)
+	m.disks = cache.New[[]DiskInfo](listTTL)
+	m.smart = cache.New[*SMARTInfo](smartTTL)
+}
+
+// InvalidateCache drops cached listings, for changes made outside the
+// manager such as mounts of network disks or formatting
+func (m *Manager) InvalidateCache() {
+	m.partitions.Invalidate()
+	m.disks.Invalidate()
+}
@@ -0,0 +1,49 @@
+// Package dryrun describes what a configuration change would do without
+// doing it, so clients can show the rendered files and commands for
+// confirmation before applying the change.
+package dryrun
+
+import "strings"
+
+// File is a configuration file that would be written
+type File struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// Plan lists the files and commands of a change in the order they apply
+type Plan struct {
+	Files    []File   `json:"files,omitempty"`
+	Commands []string `json:"commands"`
+}
+
+// New creates an empty plan
+func New() *Plan {
+	return &Plan{Commands: []string{}}
+}
+
+// AddFile records a file that would be written
+func (p *Plan) AddFile(path, content string) {
+	p.Files = append(p.Files, File{Path: path, Content: content})
+}
+
+// AddCommand records a command line, quoted for a POSIX shell
+func (p *Plan) AddCommand(name string, args ...string) {
+	words := make([]string, 0, len(args)+1)
+	for _, word := range append([]string{name}, args...) {
+		words = append(words, quote(word))
+	}
+	p.Commands = append(p.Commands, strings.Join(words, " "))
+}
+
+func quote(word string) string {
+	if word == "" {
+		return "''"
+	}
+	for _, r := range word {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,@%+", r)) {
+			return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+		}
+	}
+	return word
+}
@@ -0,0 +1,21 @@
+package dryrun
+
+import "testing"
+
+func TestAddCommandQuotes(t *testing.T) {
+	plan := New()
+	plan.AddCommand("ip", "addr", "add", "192.168.1.10/24", "dev", "eth0")
+	plan.AddCommand("mount", "-t", "cifs", "//nas/My Files", "")
+	plan.AddCommand("echo", "it's")
+
+	expected := []string{
+		"ip addr add 192.168.1.10/24 dev eth0",
+		"mount -t cifs '//nas/My Files' ''",
+		`echo 'it'\''s'`,
+	}
+	for i, command := range expected {
+		if plan.Commands[i] != command {
+			t.Errorf("command %d: expected %q, got %q", i, command, plan.Commands[i])
+		}
+	}
+}
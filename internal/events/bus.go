@@ -0,0 +1,200 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+// Event is a single message published on the bus
+type Event struct {
+	ID        uint64      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Filter selects events by type. Types ending in "*" match by prefix; an
+// empty filter matches every event.
+type Filter struct {
+	Types []string
+}
+
+// Matches reports whether event passes the filter
+func (f *Filter) Matches(event *Event) bool {
+	if f == nil || len(f.Types) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.Types {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(event.Type, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilter builds a filter from a comma-separated list of type patterns
+func ParseFilter(types string) *Filter {
+	filter := &Filter{}
+	for _, pattern := range strings.Split(types, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			filter.Types = append(filter.Types, pattern)
+		}
+	}
+	return filter
+}
+
+// Subscription receives events matching its filter
+type Subscription struct {
+	C      <-chan *Event
+	ch     chan *Event
+	filter *Filter
+	bus    *Bus
+}
+
+// Close unsubscribes and closes the event channel
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// Bus fans out events to subscribers and keeps a bounded history so
+// reconnecting clients can resume from the last event they saw
+type Bus struct {
+	mu          sync.RWMutex
+	firstID     uint64
+	nextID      uint64
+	history     []*Event
+	historySize int
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBus creates an event bus retaining the last historySize events
+func NewBus(historySize int) *Bus {
+	if historySize <= 0 {
+		historySize = 1000
+	}
+
+	// IDs start at the current time in microseconds, so they keep growing
+	// across restarts and IDs from an earlier run are told apart. They stay
+	// below 2^53 for JavaScript clients.
+	firstID := uint64(time.Now().UnixMicro())
+	return &Bus{
+		firstID:     firstID,
+		nextID:      firstID,
+		historySize: historySize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the next ID to an event and delivers it to subscribers.
+// Subscribers that cannot keep up miss events rather than blocking the bus.
+// Publishing on a nil bus is a no-op so managers work without one.
+func (b *Bus) Publish(eventType string, data interface{}) *Event {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := &Event{
+		ID:        b.nextID,
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+	b.nextID++
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter.Matches(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a subscriber for events matching filter
+func (b *Bus) Subscribe(filter *Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = 64
+	}
+
+	ch := make(chan *Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, filter: filter, bus: b}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub
+}
+
+// SubscribeFrom registers a subscriber and returns the retained events after
+// lastID that match filter. complete is false when events after lastID have
+// already been dropped from history, or lastID was never published by this
+// bus, as after a restart; all retained events are returned then.
+func (b *Bus) SubscribeFrom(lastID uint64, filter *Filter, buffer int) (sub *Subscription, missed []*Event, complete bool) {
+	sub = b.Subscribe(filter, buffer)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// Zero asks for every retained event
+	stale := lastID != 0 && (lastID < b.firstID-1 || lastID >= b.nextID)
+	if lastID < b.firstID || stale {
+		lastID = b.firstID - 1
+	}
+	// Events published before the subscription was registered are in history,
+	// later ones arrive on the channel; the caller skips duplicates by ID
+	complete = !stale && (len(b.history) == 0 || b.history[0].ID <= lastID+1)
+	for _, event := range b.history {
+		if event.ID > lastID && filter.Matches(event) {
+			missed = append(missed, event)
+		}
+	}
+
+	return sub, missed, complete
+}
+
+// LastID returns the ID of the most recently published event
+func (b *Bus) LastID() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.nextID - 1
+}
+
+// AttachAudit publishes every audit entry as an "audit.<action>" event
+func (b *Bus) AttachAudit(auditLogger *audit.Logger) {
+	auditLogger.AddHook(func(entry *audit.Entry) {
+		b.Publish("audit."+entry.Action, entry)
+	})
+}
+
+func (b *Bus) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.subscribers[sub]; exists {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
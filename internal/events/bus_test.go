@@ -0,0 +1,51 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeFrom(t *testing.T) {
+	earlier := NewBus(10)
+	previous := earlier.Publish("share.created", nil)
+
+	// A restarted agent
+	time.Sleep(time.Millisecond)
+	bus := NewBus(3)
+	first := bus.Publish("share.created", nil)
+	second := bus.Publish("share.deleted", nil)
+	if first.ID <= previous.ID {
+		t.Fatalf("expected IDs to grow across restarts, got %d after %d", first.ID, previous.ID)
+	}
+
+	tests := []struct {
+		name     string
+		lastID   uint64
+		missed   int
+		complete bool
+	}{
+		{"resume", first.ID, 1, true},
+		{"up to date", second.ID, 0, true},
+		{"from the start", 0, 2, true},
+		{"ID of an earlier run", previous.ID, 2, false},
+		{"ID not published yet", second.ID + 100, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, missed, complete := bus.SubscribeFrom(tt.lastID, nil, 0)
+			defer sub.Close()
+			if len(missed) != tt.missed || complete != tt.complete {
+				t.Fatalf("expected %d missed events and complete=%v, got %d and %v", tt.missed, tt.complete, len(missed), complete)
+			}
+		})
+	}
+
+	// History only keeps the last 3 events, so the first one is gone
+	bus.Publish("share.created", nil)
+	bus.Publish("share.created", nil)
+	sub, missed, complete := bus.SubscribeFrom(0, nil, 0)
+	defer sub.Close()
+	if complete || len(missed) != 3 {
+		t.Fatalf("expected a gap after history was trimmed, got %d missed events and complete=%v", len(missed), complete)
+	}
+}
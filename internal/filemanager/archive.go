@@ -0,0 +1,224 @@
+package filemanager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Archive formats
+const (
+	ArchiveTar = "tar"
+	ArchiveZip = "zip"
+)
+
+// ErrUnknownArchiveFormat is returned for archive formats other than tar and zip
+var ErrUnknownArchiveFormat = errors.New("unknown archive format")
+
+// ArchiveSummary is what an archive download contained
+type ArchiveSummary struct {
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+	Skipped int   `json:"skipped,omitempty"` // Devices, sockets and pipes, which are not archived
+}
+
+// ArchiveContentType returns the MIME type of format
+func ArchiveContentType(format string) string {
+	if format == ArchiveZip {
+		return "application/zip"
+	}
+	return "application/x-tar"
+}
+
+// ValidateArchiveFormat returns ErrUnknownArchiveFormat unless format is
+// tar or zip
+func ValidateArchiveFormat(format string) error {
+	if format != ArchiveTar && format != ArchiveZip {
+		return fmt.Errorf("%w: %s", ErrUnknownArchiveFormat, format)
+	}
+	return nil
+}
+
+// archiveWriter adds entries to a tar or zip stream
+type archiveWriter interface {
+	add(name string, info os.FileInfo, link string, content io.Reader) error
+	Close() error
+}
+
+// Archive streams path, a file or a directory with everything below it, to
+// w as a tar or zip archive, without writing it to disk first. Entries are
+// named relative to the parent of path, so unpacking recreates its
+// directory. Symbolic links are stored as links, never followed, and
+// reserved directories such as the trash are left out. The archive is
+// incomplete if an error is returned after writing has started.
+func (m *Manager) Archive(ctx context.Context, w io.Writer, path, format, user string) (ArchiveSummary, error) {
+	var summary ArchiveSummary
+	fail := func(err error) (ArchiveSummary, error) {
+		m.logAudit(ctx, user, "download_archive", path, "failed", map[string]interface{}{"error": err.Error(), "format": format})
+		return summary, err
+	}
+
+	if err := ValidateArchiveFormat(format); err != nil {
+		return fail(err)
+	}
+	if err := m.validator.ValidatePath(path); err != nil {
+		return fail(fmt.Errorf("invalid path: %w", err))
+	}
+	path = filepath.Clean(path)
+	if _, err := os.Lstat(path); err != nil {
+		return fail(err)
+	}
+
+	var aw archiveWriter
+	if format == ArchiveZip {
+		aw = &zipArchive{w: zip.NewWriter(w)}
+	} else {
+		aw = &tarArchive{w: tar.NewWriter(w)}
+	}
+
+	parent := filepath.Dir(path)
+	err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if m.validator.hidden(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(parent, file)
+		name := filepath.ToSlash(rel)
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			return aw.add(name+"/", info, "", nil)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return fmt.Errorf("read link: %w", err)
+			}
+			summary.Files++
+			return aw.add(name, info, link, nil)
+		case mode.IsRegular():
+			f, err := os.Open(file)
+			if err != nil {
+				return fmt.Errorf("open file: %w", err)
+			}
+			defer f.Close()
+			counted := &countingReader{r: f, ctx: ctx}
+			if err := aw.add(name, info, "", counted); err != nil {
+				return err
+			}
+			summary.Files++
+			summary.Bytes += counted.n
+			return nil
+		default:
+			summary.Skipped++
+			return nil
+		}
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if err := aw.Close(); err != nil {
+		return fail(err)
+	}
+
+	m.logAudit(ctx, user, "download_archive", path, "success", map[string]interface{}{
+		"format": format,
+		"files":  summary.Files,
+		"bytes":  summary.Bytes,
+	})
+	return summary, nil
+}
+
+// countingReader counts what is read and stops once ctx is canceled
+type countingReader struct {
+	r   io.Reader
+	ctx context.Context
+	n   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type tarArchive struct {
+	w *tar.Writer
+}
+
+func (a *tarArchive) add(name string, info os.FileInfo, link string, content io.Reader) error {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := a.w.WriteHeader(header); err != nil {
+		return err
+	}
+	if content == nil {
+		return nil
+	}
+	// A file that grew since it was listed is cut to its header size, and
+	// one that shrank fails, as the header can't be changed any more
+	_, err = io.CopyN(a.w, content, header.Size)
+	if err == io.EOF {
+		return fmt.Errorf("%s changed while archiving", name)
+	}
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	return a.w.Close()
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a *zipArchive) add(name string, info os.FileInfo, link string, content io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if content != nil {
+		header.Method = zip.Deflate
+	}
+	out, err := a.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if link != "" {
+		_, err = io.WriteString(out, link)
+		return err
+	}
+	if content != nil {
+		_, err = io.Copy(out, content)
+	}
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.w.Close()
+}
@@ -0,0 +1,211 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// MaxBatchOps is the most operations one batch may hold
+const MaxBatchOps = 1000
+
+// Batch operation types
+const (
+	BatchDelete = "delete"
+	BatchCopy   = "copy"
+	BatchMove   = "move"
+	BatchRename = "rename"
+)
+
+// ErrInvalidBatch is returned for batches that are rejected before any of
+// their operations runs
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// BatchOp is one operation of a batch. Path is the file deleted, or the
+// source of a copy, move or rename to DstPath.
+type BatchOp struct {
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	DstPath   string `json:"dst_path,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"` // Replace an existing destination
+	Permanent bool   `json:"permanent,omitempty"` // Delete without the trash
+}
+
+// BatchResult is the outcome of one operation of a batch
+type BatchResult struct {
+	Index      int    `json:"index"`
+	Op         string `json:"op"`
+	Path       string `json:"path"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`     // Not run, as an earlier operation of a transaction failed
+	RolledBack bool   `json:"rolled_back,omitempty"` // Run, then undone as the transaction failed
+}
+
+// BatchReport is the outcome of a batch
+type BatchReport struct {
+	Transactional bool          `json:"transactional"`
+	Succeeded     int           `json:"succeeded"`
+	Failed        int           `json:"failed"`
+	RolledBack    bool          `json:"rolled_back,omitempty"`
+	Results       []BatchResult `json:"results"`
+}
+
+// Batch runs ops in order and reports the outcome of each. Without
+// transactional, every operation runs whether or not the ones before it
+// failed. With transactional, the first failure stops the batch and the
+// operations that ran are undone in reverse order, so either all of them
+// take effect or none do. Transactions cannot overwrite destinations or
+// delete permanently, as neither can be undone, and deletes in them need
+// the trash.
+func (m *Manager) Batch(ctx context.Context, ops []BatchOp, transactional bool, user string) (*BatchReport, error) {
+	if err := m.checkBatch(ops, transactional); err != nil {
+		return nil, err
+	}
+
+	report := &BatchReport{Transactional: transactional, Results: make([]BatchResult, len(ops))}
+	var undos []func(context.Context) error
+	failed := -1
+	for i, op := range ops {
+		result := &report.Results[i]
+		*result = BatchResult{Index: i, Op: op.Op, Path: op.Path}
+		if failed >= 0 {
+			result.Skipped = true
+			continue
+		}
+
+		undo, err := m.runBatchOp(ctx, op, user)
+		if err != nil {
+			result.Error = err.Error()
+			report.Failed++
+			if transactional {
+				failed = i
+			}
+			continue
+		}
+		result.Success = true
+		report.Succeeded++
+		undos = append(undos, undo)
+	}
+
+	if failed >= 0 {
+		// The request may be gone, but what ran must still be undone
+		undoCtx := context.WithoutCancel(ctx)
+		report.RolledBack = true
+		for i := len(undos) - 1; i >= 0; i-- {
+			result := &report.Results[i]
+			if err := undos[i](undoCtx); err != nil {
+				result.Error = "rollback failed: " + err.Error()
+				report.RolledBack = false
+				continue
+			}
+			result.Success = false
+			result.RolledBack = true
+		}
+		report.Succeeded = 0
+	}
+
+	details := map[string]interface{}{
+		"operations":    len(ops),
+		"succeeded":     report.Succeeded,
+		"failed":        report.Failed,
+		"transactional": transactional,
+	}
+	result := "success"
+	if report.Failed > 0 {
+		result = "failed"
+		if transactional {
+			details["rolled_back"] = report.RolledBack
+		}
+	}
+	m.logAudit(ctx, user, "batch", fmt.Sprintf("%d operations", len(ops)), result, details)
+	return report, nil
+}
+
+// checkBatch rejects batches that cannot run as a whole
+func (m *Manager) checkBatch(ops []BatchOp, transactional bool) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("%w: no operations", ErrInvalidBatch)
+	}
+	if len(ops) > MaxBatchOps {
+		return fmt.Errorf("%w: more than %d operations", ErrInvalidBatch, MaxBatchOps)
+	}
+
+	for i, op := range ops {
+		switch op.Op {
+		case BatchDelete:
+			if transactional && (op.Permanent || m.trash == nil) {
+				return fmt.Errorf("%w: operation %d: transactions can only delete to the trash", ErrInvalidBatch, i)
+			}
+		case BatchCopy, BatchMove, BatchRename:
+			if op.DstPath == "" {
+				return fmt.Errorf("%w: operation %d: dst_path is required", ErrInvalidBatch, i)
+			}
+			if transactional && op.Overwrite {
+				return fmt.Errorf("%w: operation %d: transactions cannot overwrite", ErrInvalidBatch, i)
+			}
+		default:
+			return fmt.Errorf("%w: operation %d: unknown op %q", ErrInvalidBatch, i, op.Op)
+		}
+		if op.Path == "" {
+			return fmt.Errorf("%w: operation %d: path is required", ErrInvalidBatch, i)
+		}
+	}
+	return nil
+}
+
+// runBatchOp runs op and returns how to undo it
+func (m *Manager) runBatchOp(ctx context.Context, op BatchOp, user string) (func(context.Context) error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case BatchDelete:
+		if op.Permanent || m.trash == nil {
+			return nil, m.DeletePermanently(ctx, op.Path, user)
+		}
+		if err := m.validator.ValidatePath(op.Path); err != nil {
+			m.logAudit(ctx, user, "delete", op.Path, "failed", map[string]interface{}{"error": err.Error()})
+			return nil, fmt.Errorf("invalid path: %w", err)
+		}
+		id, err := m.moveToTrash(ctx, op.Path, user)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			_, err := m.RestoreTrash(ctx, id, "", user)
+			return err
+		}, nil
+
+	case BatchCopy:
+		if err := m.CopyTree(ctx, op.Path, op.DstPath, TreeOptions{Overwrite: op.Overwrite}, user, nil); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			return m.remove(ctx, op.DstPath, user)
+		}, nil
+
+	case BatchMove:
+		if err := m.MoveTree(ctx, op.Path, op.DstPath, TreeOptions{Overwrite: op.Overwrite}, user, nil); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			return m.MoveTree(ctx, op.DstPath, op.Path, TreeOptions{}, user, nil)
+		}, nil
+
+	default: // BatchRename
+		if !op.Overwrite {
+			if _, err := os.Lstat(op.DstPath); err == nil {
+				return nil, fmt.Errorf("%w: %s", ErrDestinationExists, op.DstPath)
+			}
+		}
+		if err := m.Rename(ctx, op.Path, op.DstPath, user); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			return m.Rename(ctx, op.DstPath, op.Path, user)
+		}, nil
+	}
+}
@@ -0,0 +1,106 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/KOPElan/mingyue-agent/internal/blake3"
+)
+
+// Checksum algorithms accepted by GetChecksum
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+	ChecksumBLAKE3 = "blake3"
+)
+
+// ErrUnknownAlgorithm is returned by GetChecksum for an algorithm it does
+// not support
+var ErrUnknownAlgorithm = errors.New("unknown checksum algorithm")
+
+// ChecksumProgress reports how far hashing a file has come. Checksum is set
+// once it is done.
+type ChecksumProgress struct {
+	Algorithm  string `json:"algorithm"`
+	BytesDone  int64  `json:"bytes_done"`
+	BytesTotal int64  `json:"bytes_total"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA1:
+		return sha1.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algorithm)
+}
+
+// GetChecksum returns the hex checksum of a file with algorithm, md5 if
+// empty. progress, if not nil, is called as the file is read and once more
+// with the checksum. Hashing stops when ctx is canceled.
+func (m *Manager) GetChecksum(ctx context.Context, path, algorithm, user string, progress func(ChecksumProgress)) (string, error) {
+	if algorithm == "" {
+		algorithm = ChecksumMD5
+	}
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if err := m.validator.ValidatePath(path); err != nil {
+		return "", fmt.Errorf("invalid path: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	p := ChecksumProgress{Algorithm: algorithm}
+	if info, err := f.Stat(); err == nil {
+		p.BytesTotal = info.Size()
+	}
+
+	buf := make([]byte, treeCopyBuffer)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		p.BytesDone += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("compute hash: %w", err)
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	m.logAudit(ctx, user, "checksum", path, "success", map[string]interface{}{"algorithm": algorithm, "checksum": checksum})
+
+	if progress != nil {
+		p.Checksum = checksum
+		progress(p)
+	}
+	return checksum, nil
+}
@@ -0,0 +1,204 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Reasons a duplicate is not replaced by a hard link
+const (
+	DedupeAlreadyLinked  = "already_linked"
+	DedupeOtherFS        = "other_filesystem"
+	DedupeContentDiffers = "content_differs"
+	DedupeMetaDiffers    = "metadata_differs"
+	DedupeInvalid        = "invalid"
+	DedupeFailed         = "failed"
+)
+
+// DedupeResult is what Dedupe did, or would do in a dry run
+type DedupeResult struct {
+	DryRun     bool         `json:"dry_run"`
+	Linked     []DedupeLink `json:"linked"`
+	Skipped    []DedupeSkip `json:"skipped,omitempty"`
+	SavedBytes int64        `json:"saved_bytes"` // Space freed; files with other hard links free none
+}
+
+// DedupeLink is a duplicate replaced by a hard link to the kept copy
+type DedupeLink struct {
+	Path string `json:"path"`
+	Kept string `json:"kept"`
+	Size int64  `json:"size"`
+}
+
+// DedupeSkip is a path left as it is
+type DedupeSkip struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidatePath returns an error unless path is absolute, within the
+// allowed paths and not reserved
+func (m *Manager) ValidatePath(path string) error {
+	return m.validator.ValidatePath(path)
+}
+
+// Dedupe replaces the files of each set but the first with hard links to
+// the first. Sets come from the index, which may be stale, so a file is
+// only linked once its content is compared byte for byte with the kept
+// copy; files on another filesystem, or with other permissions or owners,
+// are skipped. Replacing is atomic: the link is made under a temporary
+// name and renamed over the duplicate. With dryRun nothing is changed.
+func (m *Manager) Dedupe(ctx context.Context, sets [][]string, dryRun bool, user string) (*DedupeResult, error) {
+	result := &DedupeResult{DryRun: dryRun, Linked: []DedupeLink{}}
+	for _, set := range sets {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		m.dedupeSet(ctx, set, result)
+	}
+
+	if !dryRun {
+		m.logAudit(ctx, user, "dedupe", fmt.Sprintf("%d sets", len(sets)), "success", map[string]interface{}{
+			"linked":      len(result.Linked),
+			"skipped":     len(result.Skipped),
+			"saved_bytes": result.SavedBytes,
+		})
+	}
+	return result, nil
+}
+
+func (m *Manager) dedupeSet(ctx context.Context, set []string, result *DedupeResult) {
+	skip := func(path, reason string, err error) {
+		s := DedupeSkip{Path: path, Reason: reason}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		result.Skipped = append(result.Skipped, s)
+	}
+
+	var kept string
+	var keptInfo os.FileInfo
+	for _, path := range set {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := m.validator.ValidatePath(path); err != nil {
+			skip(path, DedupeInvalid, err)
+			continue
+		}
+		path = filepath.Clean(path)
+		info, err := os.Lstat(path)
+		if err != nil {
+			skip(path, DedupeInvalid, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			skip(path, DedupeInvalid, fmt.Errorf("not a regular file"))
+			continue
+		}
+		if keptInfo == nil {
+			kept, keptInfo = path, info
+			continue
+		}
+
+		if reason, err := dedupeCheck(kept, keptInfo, path, info); reason != "" {
+			skip(path, reason, err)
+			continue
+		}
+		if !result.DryRun {
+			if err := replaceWithLink(kept, path, info); err != nil {
+				skip(path, DedupeFailed, err)
+				continue
+			}
+		}
+
+		result.Linked = append(result.Linked, DedupeLink{Path: path, Kept: kept, Size: info.Size()})
+		if _, _, shared := diskUsage(info); !shared {
+			result.SavedBytes += info.Size()
+		}
+	}
+}
+
+// dedupeCheck returns why path can't be linked to kept, or "" if it can
+func dedupeCheck(kept string, keptInfo os.FileInfo, path string, info os.FileInfo) (string, error) {
+	if os.SameFile(keptInfo, info) {
+		return DedupeAlreadyLinked, nil
+	}
+	keptDev, ok := deviceID(keptInfo)
+	if dev, _ := deviceID(info); !ok || dev != keptDev {
+		return DedupeOtherFS, nil
+	}
+	if info.Size() != keptInfo.Size() {
+		return DedupeContentDiffers, nil
+	}
+	keptOwner, keptGroup, _ := getOwnerAndGroup(keptInfo)
+	owner, group, _ := getOwnerAndGroup(info)
+	if info.Mode() != keptInfo.Mode() || owner != keptOwner || group != keptGroup {
+		return DedupeMetaDiffers, nil
+	}
+	same, err := sameContent(kept, path)
+	if err != nil {
+		return DedupeFailed, err
+	}
+	if !same {
+		return DedupeContentDiffers, nil
+	}
+	return "", nil
+}
+
+// replaceWithLink replaces path with a hard link to kept, unless path
+// changed since it was compared
+func replaceWithLink(kept, path string, compared os.FileInfo) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".dedupe-"+newUploadID()[:8])
+	if err := os.Link(kept, tmp); err != nil {
+		return fmt.Errorf("create hardlink: %w", err)
+	}
+	current, err := os.Lstat(path)
+	if err != nil || !os.SameFile(current, compared) || !current.ModTime().Equal(compared.ModTime()) || current.Size() != compared.Size() {
+		os.Remove(tmp)
+		return fmt.Errorf("file changed while deduplicating")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replace file: %w", err)
+	}
+	return nil
+}
+
+// sameContent compares two files byte for byte
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		switch {
+		case errA != nil && !endA:
+			return false, errA
+		case errB != nil && !endB:
+			return false, errB
+		case endA || endB:
+			return endA == endB, nil
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package filemanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxEXIFScan is how far into a JPEG file the EXIF segment is looked for
+const maxEXIFScan = 256 << 10
+
+// exifTags are the EXIF tags reported by previews, by IFD and tag number
+var exifTags = map[string]map[uint16]string{
+	"ifd0": {
+		0x010F: "make",
+		0x0110: "model",
+		0x0112: "orientation",
+		0x0131: "software",
+		0x0132: "date_time",
+	},
+	"exif": {
+		0x829A: "exposure_time",
+		0x829D: "f_number",
+		0x8827: "iso",
+		0x9003: "date_time_original",
+		0x920A: "focal_length",
+		0xA434: "lens_model",
+	},
+}
+
+// EXIF pointers to sub-IFDs
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+)
+
+// readEXIF returns the main EXIF tags of a JPEG file, or nil if it has none
+func readEXIF(r io.Reader) map[string]string {
+	head, _ := io.ReadAll(io.LimitReader(r, maxEXIFScan))
+	tiff := jpegEXIF(head)
+	if tiff == nil {
+		return nil
+	}
+	tags, err := parseTIFF(tiff)
+	if err != nil || len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// jpegEXIF returns the TIFF data of the EXIF APP1 segment of a JPEG file
+func jpegEXIF(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		marker := data[pos+1]
+		// Start of scan: image data follows, no more metadata
+		if marker == 0xDA {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// tiffReader reads IFD entries of TIFF data in its byte order
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func parseTIFF(data []byte) (map[string]string, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("short TIFF header")
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid TIFF byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, fmt.Errorf("invalid TIFF header")
+	}
+
+	tags := map[string]string{}
+	pointers := t.readIFD(t.order.Uint32(data[4:]), exifTags["ifd0"], tags)
+	if offset, ok := pointers[exifIFDPointer]; ok {
+		t.readIFD(offset, exifTags["exif"], tags)
+	}
+	if offset, ok := pointers[gpsIFDPointer]; ok {
+		t.readGPS(offset, tags)
+	}
+	return tags, nil
+}
+
+// tiffEntry is a 12-byte IFD entry
+type tiffEntry struct {
+	tag, kind uint16
+	count     uint32
+	value     []byte // The value bytes, wherever they are stored
+}
+
+// entries returns the entries of the IFD at offset
+func (t *tiffReader) entries(offset uint32) []tiffEntry {
+	if int(offset)+2 > len(t.data) {
+		return nil
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	var entries []tiffEntry
+	for i := 0; i < n; i++ {
+		pos := int(offset) + 2 + 12*i
+		if pos+12 > len(t.data) {
+			break
+		}
+		e := tiffEntry{
+			tag:   t.order.Uint16(t.data[pos:]),
+			kind:  t.order.Uint16(t.data[pos+2:]),
+			count: t.order.Uint32(t.data[pos+4:]),
+		}
+		size := tiffTypeSize(e.kind) * int(e.count)
+		if size <= 0 || size > len(t.data) {
+			continue
+		}
+		if size <= 4 {
+			e.value = t.data[pos+8 : pos+8+size]
+		} else {
+			at := int(t.order.Uint32(t.data[pos+8:]))
+			if at+size > len(t.data) {
+				continue
+			}
+			e.value = t.data[at : at+size]
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// readIFD adds the named tags of the IFD at offset to tags and returns the
+// sub-IFD pointers it holds
+func (t *tiffReader) readIFD(offset uint32, names map[uint16]string, tags map[string]string) map[uint16]uint32 {
+	pointers := map[uint16]uint32{}
+	for _, e := range t.entries(offset) {
+		if e.tag == exifIFDPointer || e.tag == gpsIFDPointer {
+			pointers[e.tag] = t.order.Uint32(e.value)
+			continue
+		}
+		if name, ok := names[e.tag]; ok {
+			if value := t.format(e); value != "" {
+				tags[name] = value
+			}
+		}
+	}
+	return pointers
+}
+
+// readGPS adds the position of the GPS IFD at offset as decimal degrees
+func (t *tiffReader) readGPS(offset uint32, tags map[string]string) {
+	var latRef, lonRef string
+	var lat, lon []float64
+	for _, e := range t.entries(offset) {
+		switch e.tag {
+		case 1:
+			latRef = t.format(e)
+		case 2:
+			lat = t.rationals(e)
+		case 3:
+			lonRef = t.format(e)
+		case 4:
+			lon = t.rationals(e)
+		}
+	}
+	if len(lat) == 3 && len(lon) == 3 {
+		tags["gps_latitude"] = formatDegrees(lat, latRef == "S")
+		tags["gps_longitude"] = formatDegrees(lon, lonRef == "W")
+	}
+}
+
+func formatDegrees(dms []float64, negative bool) string {
+	degrees := dms[0] + dms[1]/60 + dms[2]/3600
+	if negative {
+		degrees = -degrees
+	}
+	return strconv.FormatFloat(degrees, 'f', 6, 64)
+}
+
+// TIFF field types
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+func tiffTypeSize(kind uint16) int {
+	switch kind {
+	case tiffByte, tiffASCII, tiffUndefined:
+		return 1
+	case tiffShort:
+		return 2
+	case tiffLong, tiffSLong:
+		return 4
+	case tiffRational, tiffSRational:
+		return 8
+	}
+	return 0
+}
+
+// format returns the first value of an entry as text
+func (t *tiffReader) format(e tiffEntry) string {
+	switch e.kind {
+	case tiffASCII:
+		return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+	case tiffShort:
+		return strconv.Itoa(int(t.order.Uint16(e.value)))
+	case tiffLong:
+		return strconv.FormatUint(uint64(t.order.Uint32(e.value)), 10)
+	case tiffSLong:
+		return strconv.Itoa(int(int32(t.order.Uint32(e.value))))
+	case tiffRational, tiffSRational:
+		num, den := t.order.Uint32(e.value), t.order.Uint32(e.value[4:])
+		if e.kind == tiffSRational {
+			return formatRational(float64(int32(num)), float64(int32(den)))
+		}
+		return formatRational(float64(num), float64(den))
+	}
+	return ""
+}
+
+// formatRational keeps exposure times such as 1/250 as fractions
+func formatRational(num, den float64) string {
+	if den == 0 {
+		return ""
+	}
+	if num == 1 && den > 1 {
+		return "1/" + strconv.FormatFloat(den, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(num/den, 'f', -1, 64)
+}
+
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	if e.kind != tiffRational {
+		return nil
+	}
+	var values []float64
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := t.order.Uint32(e.value[i:]), t.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
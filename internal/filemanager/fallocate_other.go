@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filemanager
+
+import (
+	"os"
+)
+
+// preallocate is a no-op where the agent has no fallocate; the file is
+// allocated as it is written
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
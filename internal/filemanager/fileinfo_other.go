@@ -0,0 +1,22 @@
+//go:build !unix
+
+package filemanager
+
+import (
+	"os"
+)
+
+func getOwnerAndGroup(info os.FileInfo) (owner uint32, group uint32, ok bool) {
+	// Windows and other non-Unix systems have no Unix-style UID/GID
+	return 0, 0, false
+}
+
+func deviceID(info os.FileInfo) (uint64, bool) {
+	// Without device IDs the trash lives at the top of each allowed path
+	return 0, false
+}
+
+func diskUsage(info os.FileInfo) (int64, [2]uint64, bool) {
+	// Without block counts the apparent size has to do
+	return info.Size(), [2]uint64{}, false
+}
@@ -1,4 +1,4 @@
-//go:build linux || darwin
+//go:build unix
 
 package filemanager
 
@@ -13,3 +13,21 @@ func getOwnerAndGroup(info os.FileInfo) (owner uint32, group uint32, ok bool) {
 	}
 	return 0, 0, false
 }
+
+// deviceID returns the device a file is on, to tell whether a rename stays
+// on one filesystem
+func deviceID(info os.FileInfo) (uint64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), true
+	}
+	return 0, false
+}
+
+// diskUsage returns the space a file takes on disk and, for files with
+// more than one hard link, an identity so each is counted once
+func diskUsage(info os.FileInfo) (int64, [2]uint64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512, [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}, stat.Nlink > 1 && !info.IsDir()
+	}
+	return info.Size(), [2]uint64{}, false
+}
@@ -0,0 +1,301 @@
+package filemanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultGrepMaxFileSize is the largest file searched by default
+	DefaultGrepMaxFileSize = 10 << 20
+	// DefaultGrepMaxMatches is the number of matches returned by default
+	DefaultGrepMaxMatches = 1000
+	// MaxGrepMatches is the most matches a search may return
+	MaxGrepMatches = 10000
+	// MaxGrepContext is the most context lines around a match
+	MaxGrepContext = 10
+
+	// grepMaxLine is the longest line scanned; files with longer lines
+	// are skipped
+	grepMaxLine = 1 << 20
+	// grepLineLimit is where line text is cut in results
+	grepLineLimit = 1000
+	// grepSniffSize is how much of a file is checked for binary content
+	grepSniffSize = 8 << 10
+)
+
+// GrepOptions selects the files to search and what to look for
+type GrepOptions struct {
+	Path        string   // File or directory searched recursively
+	Pattern     string   // RE2 regular expression
+	IgnoreCase  bool     // Match without regard to case
+	Extensions  []string // Only files with these extensions, like ".txt"
+	MaxFileSize int64    // Skip larger files; 0 uses DefaultGrepMaxFileSize
+	Context     int      // Lines of context before and after each match
+	MaxMatches  int      // Stop after this many matches; 0 uses DefaultGrepMaxMatches
+}
+
+// GrepMatch is a line matching a content search
+type GrepMatch struct {
+	Path   string   `json:"path"`
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// GrepSummary describes a finished content search
+type GrepSummary struct {
+	FilesSearched int  `json:"files_searched"`
+	FilesSkipped  int  `json:"files_skipped"` // Binary, too large or unreadable files
+	Matches       int  `json:"matches"`
+	Truncated     bool `json:"truncated"` // The search stopped at MaxMatches
+}
+
+// errGrepLimit stops a search that reached its match limit
+var errGrepLimit = errors.New("match limit reached")
+
+// grepper keeps the state shared by one content search
+type grepper struct {
+	ctx     context.Context
+	opts    GrepOptions
+	re      *regexp.Regexp
+	exts    map[string]bool
+	hidden  func(string) bool
+	emit    func(*GrepMatch) error
+	summary GrepSummary
+}
+
+// Grep searches the text files below opts.Path for lines matching
+// opts.Pattern and passes every match to emit as it is found. Symbolic
+// links are not followed, and hidden directories like the trash, binary
+// files and files above the size limit are skipped. An error returned by
+// emit stops the search.
+func (m *Manager) Grep(ctx context.Context, opts GrepOptions, user string, emit func(*GrepMatch) error) (*GrepSummary, error) {
+	if err := m.validator.ValidatePath(opts.Path); err != nil {
+		m.logAudit(ctx, user, "grep", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	if opts.Pattern == "" {
+		return nil, fmt.Errorf("pattern is required")
+	}
+	if opts.Context < 0 || opts.Context > MaxGrepContext {
+		return nil, fmt.Errorf("context must be between 0 and %d", MaxGrepContext)
+	}
+	if opts.MaxMatches < 0 || opts.MaxMatches > MaxGrepMatches {
+		return nil, fmt.Errorf("max matches must be between 0 and %d", MaxGrepMatches)
+	}
+	if opts.MaxFileSize < 0 {
+		return nil, fmt.Errorf("max file size must not be negative")
+	}
+	if opts.MaxMatches == 0 {
+		opts.MaxMatches = DefaultGrepMaxMatches
+	}
+	if opts.MaxFileSize == 0 {
+		opts.MaxFileSize = DefaultGrepMaxFileSize
+	}
+
+	pattern := opts.Pattern
+	if opts.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	g := &grepper{ctx: ctx, opts: opts, re: re, hidden: m.validator.hidden, emit: emit}
+	if len(opts.Extensions) > 0 {
+		g.exts = make(map[string]bool, len(opts.Extensions))
+		for _, ext := range opts.Extensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext != "" && !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			g.exts[ext] = true
+		}
+	}
+
+	path := filepath.Clean(opts.Path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		m.logAudit(ctx, user, "grep", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("stat path: %w", err)
+	}
+	if info.IsDir() {
+		err = g.walk(path)
+	} else {
+		err = g.file(path, info)
+	}
+	if errors.Is(err, errGrepLimit) {
+		g.summary.Truncated = true
+		err = nil
+	}
+	if err != nil {
+		m.logAudit(ctx, user, "grep", path, "failed", map[string]interface{}{"pattern": opts.Pattern, "error": err.Error()})
+		return &g.summary, err
+	}
+
+	m.logAudit(ctx, user, "grep", path, "success", map[string]interface{}{"pattern": opts.Pattern, "matches": g.summary.Matches})
+	return &g.summary, nil
+}
+
+// walk searches the files below dir
+func (g *grepper) walk(dir string) error {
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		g.summary.FilesSkipped++
+		return nil
+	}
+	for _, entry := range entries {
+		if g.hidden(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := g.walk(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			g.summary.FilesSkipped++
+			continue
+		}
+		if err := g.file(path, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file searches one file, skipping it when filtered out, too large or
+// binary
+func (g *grepper) file(path string, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	if g.exts != nil && !g.exts[strings.ToLower(filepath.Ext(path))] {
+		return nil
+	}
+	if info.Size() > g.opts.MaxFileSize {
+		g.summary.FilesSkipped++
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		g.summary.FilesSkipped++
+		return nil
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, grepSniffSize)
+	head, err := reader.Peek(grepSniffSize)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		g.summary.FilesSkipped++
+		return nil
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		g.summary.FilesSkipped++
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64<<10), grepMaxLine)
+
+	var before []string
+	var pending []*GrepMatch
+	lineNo := 0
+	for scanner.Scan() {
+		if lineNo%1000 == 0 {
+			if err := g.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		lineNo++
+		line := scanner.Text()
+
+		// Matches are sent once their trailing context is complete
+		for len(pending) > 0 && len(pending[0].After) >= g.opts.Context {
+			if err := g.send(pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+		for _, match := range pending {
+			match.After = append(match.After, grepLine(line))
+		}
+
+		if g.re.MatchString(line) {
+			match := &GrepMatch{Path: path, Line: lineNo, Text: grepLine(line)}
+			if len(before) > 0 {
+				match.Before = append([]string(nil), before...)
+			}
+			if g.opts.Context == 0 {
+				if err := g.send(match); err != nil {
+					return err
+				}
+			} else {
+				pending = append(pending, match)
+			}
+		}
+
+		if g.opts.Context > 0 {
+			before = append(before, grepLine(line))
+			if len(before) > g.opts.Context {
+				before = before[1:]
+			}
+		}
+	}
+	for _, match := range pending {
+		if err := g.send(match); err != nil {
+			return err
+		}
+	}
+
+	if scanner.Err() != nil {
+		// Lines too long to scan mean the file is not meant to be read
+		// as text
+		g.summary.FilesSkipped++
+		return nil
+	}
+	g.summary.FilesSearched++
+	return nil
+}
+
+// send passes a match on, stopping the search once the limit is reached
+func (g *grepper) send(match *GrepMatch) error {
+	if g.summary.Matches >= g.opts.MaxMatches {
+		return errGrepLimit
+	}
+	g.summary.Matches++
+	if err := g.emit(match); err != nil {
+		return err
+	}
+	return nil
+}
+
+// grepLine cuts overly long lines for results
+func grepLine(line string) string {
+	if len(line) <= grepLineLimit {
+		return line
+	}
+	return strings.ToValidUTF8(line[:grepLineLimit], "")
+}
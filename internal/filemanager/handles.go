@@ -0,0 +1,140 @@
+package filemanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrIsDirectory is returned when downloading a directory
+var ErrIsDirectory = errors.New("path is a directory")
+
+// handleIdleTimeout is how long a file no download is reading stays open
+const handleIdleTimeout = 30 * time.Second
+
+// DownloadHandle is an open file shared by concurrent downloads of the same
+// path. Download managers fetch one file over several connections, each
+// asking for a range; sharing the handle saves re-validating the path and
+// re-opening the file for every range.
+type DownloadHandle struct {
+	path     string
+	file     *os.File
+	info     os.FileInfo
+	fileInfo FileInfo
+	refs     int
+	lastUsed time.Time
+	cache    *handleCache
+}
+
+// Info describes the file as it was when the handle was opened
+func (h *DownloadHandle) Info() *FileInfo {
+	info := h.fileInfo
+	return &info
+}
+
+// Close releases the handle. The file stays open for a while for other
+// requests of the same path.
+func (h *DownloadHandle) Close() {
+	h.cache.release(h)
+}
+
+type handleCache struct {
+	mu      sync.Mutex
+	handles map[string]*DownloadHandle
+}
+
+func newHandleCache() *handleCache {
+	return &handleCache{handles: make(map[string]*DownloadHandle)}
+}
+
+// OpenDownload opens path for downloading, or shares a handle other
+// downloads of it already hold. A cached handle is reused only while the
+// path still refers to the same, unmodified file; otherwise the path is
+// validated and opened again.
+func (m *Manager) OpenDownload(path string) (*DownloadHandle, error) {
+	c := m.handles
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	if h, ok := c.handles[path]; ok {
+		if current, err := os.Stat(path); err == nil && os.SameFile(current, h.info) &&
+			current.ModTime().Equal(h.info.ModTime()) && current.Size() == h.info.Size() {
+			h.refs++
+			h.lastUsed = now
+			return h, nil
+		}
+		c.drop(h)
+	}
+
+	if err := m.validator.ValidatePath(path); err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrIsDirectory
+	}
+
+	h := &DownloadHandle{
+		path:     path,
+		file:     file,
+		info:     info,
+		fileInfo: m.buildFileInfo(path, info),
+		refs:     1,
+		lastUsed: now,
+		cache:    c,
+	}
+	c.handles[path] = h
+	return h, nil
+}
+
+func (c *handleCache) release(h *DownloadHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h.refs--
+	h.lastUsed = time.Now()
+	if h.refs > 0 {
+		return
+	}
+	if c.handles[h.path] != h {
+		// Replaced by a newer version of the file while in use
+		h.file.Close()
+		return
+	}
+	time.AfterFunc(handleIdleTimeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.expire(time.Now())
+	})
+}
+
+// drop removes h from the cache, closing it unless downloads still read it
+func (c *handleCache) drop(h *DownloadHandle) {
+	delete(c.handles, h.path)
+	if h.refs == 0 {
+		h.file.Close()
+	}
+}
+
+// expire closes handles that no download used for handleIdleTimeout
+func (c *handleCache) expire(now time.Time) {
+	for _, h := range c.handles {
+		if h.refs == 0 && now.Sub(h.lastUsed) >= handleIdleTimeout {
+			c.drop(h)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lock lifetimes
+const (
+	DefaultLockTTL = 5 * time.Minute
+	MaxLockTTL     = time.Hour
+)
+
+// Errors of file locks
+var (
+	ErrLocked         = errors.New("file is locked")
+	ErrLockNotFound   = errors.New("lock not found")
+	ErrInvalidLockTTL = errors.New("invalid lock ttl")
+)
+
+// FileLock is a lock on a path, held by one editing session of a user
+// until released or until it expires. Listings show the locks on files,
+// and text saves and uploads to a locked path fail unless they carry the
+// lock's ID; other file operations ignore locks.
+type FileLock struct {
+	ID         string    `json:"id,omitempty"` // Secret of the holder, left out of listings
+	Path       string    `json:"path"`
+	Owner      string    `json:"owner"`
+	Session    string    `json:"session,omitempty"` // Editor session of the owner, such as a browser tab
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// LockedError is returned when locking or writing a path another session
+// holds the lock on
+type LockedError struct {
+	Holder FileLock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s until %s", e.Holder.Path, e.Holder.Owner, e.Holder.ExpiresAt.Format(time.RFC3339))
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// lockTable holds the locks by path. Expired locks are dropped whenever
+// the table is used.
+type lockTable struct {
+	mu     sync.Mutex
+	byPath map[string]*FileLock
+	byID   map[string]*FileLock
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		byPath: make(map[string]*FileLock),
+		byID:   make(map[string]*FileLock),
+	}
+}
+
+func (t *lockTable) expire(now time.Time) {
+	for path, lock := range t.byPath {
+		if !now.Before(lock.ExpiresAt) {
+			delete(t.byPath, path)
+			delete(t.byID, lock.ID)
+		}
+	}
+}
+
+func (t *lockTable) put(lock *FileLock) {
+	if old, ok := t.byPath[lock.Path]; ok {
+		delete(t.byID, old.ID)
+	}
+	t.byPath[lock.Path] = lock
+	t.byID[lock.ID] = lock
+}
+
+// lockTTL returns the lifetime for ttl, DefaultLockTTL if 0
+func lockTTL(ttl time.Duration) (time.Duration, error) {
+	if ttl == 0 {
+		return DefaultLockTTL, nil
+	}
+	if ttl < time.Second || ttl > MaxLockTTL {
+		return 0, fmt.Errorf("%w: must be between 1s and %s", ErrInvalidLockTTL, MaxLockTTL)
+	}
+	return ttl, nil
+}
+
+// AcquireLock locks path for session of user for ttl, DefaultLockTTL if 0.
+// The path need not exist yet. Acquiring a path the same session already
+// holds extends its lock; one held by anyone else fails with a
+// *LockedError naming the holder.
+func (m *Manager) AcquireLock(ctx context.Context, path, session string, ttl time.Duration, user string) (*FileLock, error) {
+	lock, err := m.acquireLock(path, session, ttl, user, false)
+	if err != nil {
+		m.logAudit(ctx, user, "acquire_lock", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+	m.logAudit(ctx, user, "acquire_lock", lock.Path, "success", map[string]interface{}{"session": session, "expires_at": lock.ExpiresAt})
+	return lock, nil
+}
+
+// StealLock locks path for session of user like AcquireLock, but takes
+// the lock over from any other holder, whose lock ID stops working
+func (m *Manager) StealLock(ctx context.Context, path, session string, ttl time.Duration, user string) (*FileLock, error) {
+	m.locks.mu.Lock()
+	previous := m.locks.byPath[filepath.Clean(path)]
+	var from FileLock
+	if previous != nil && time.Now().Before(previous.ExpiresAt) {
+		from = *previous
+	}
+	m.locks.mu.Unlock()
+
+	lock, err := m.acquireLock(path, session, ttl, user, true)
+	if err != nil {
+		m.logAudit(ctx, user, "steal_lock", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+	m.logAudit(ctx, user, "steal_lock", lock.Path, "success", map[string]interface{}{
+		"session":          session,
+		"previous_owner":   from.Owner,
+		"previous_session": from.Session,
+	})
+	return lock, nil
+}
+
+func (m *Manager) acquireLock(path, session string, ttl time.Duration, user string, steal bool) (*FileLock, error) {
+	if err := m.validator.ValidatePath(path); err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	ttl, err := lockTTL(ttl)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+	if held, ok := t.byPath[path]; ok && !steal {
+		if held.Owner != user || held.Session != session {
+			holder := *held
+			holder.ID = ""
+			return nil, &LockedError{Holder: holder}
+		}
+		held.ExpiresAt = now.Add(ttl)
+		lock := *held
+		return &lock, nil
+	}
+
+	lock := &FileLock{
+		ID:         newUploadID(),
+		Path:       path,
+		Owner:      user,
+		Session:    session,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	t.put(lock)
+	result := *lock
+	return &result, nil
+}
+
+// RefreshLock extends the lock with id to expire ttl from now,
+// DefaultLockTTL if 0. Editors refresh their locks while the file is open.
+func (m *Manager) RefreshLock(id string, ttl time.Duration) (*FileLock, error) {
+	ttl, err := lockTTL(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.expire(now)
+	lock, ok := t.byID[id]
+	if !ok {
+		return nil, ErrLockNotFound
+	}
+	lock.ExpiresAt = now.Add(ttl)
+	result := *lock
+	return &result, nil
+}
+
+// ReleaseLock releases the lock with id. A lock that expired or was
+// stolen is not found.
+func (m *Manager) ReleaseLock(ctx context.Context, id, user string) error {
+	t := m.locks
+	t.mu.Lock()
+	t.expire(time.Now())
+	lock, ok := t.byID[id]
+	if ok {
+		delete(t.byID, id)
+		delete(t.byPath, lock.Path)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return ErrLockNotFound
+	}
+	m.logAudit(ctx, user, "release_lock", lock.Path, "success", map[string]interface{}{"owner": lock.Owner, "session": lock.Session})
+	return nil
+}
+
+// ListLocks returns the locks on prefix and the paths below it, or all
+// locks if prefix is empty, sorted by path and without their IDs
+func (m *Manager) ListLocks(prefix string) []FileLock {
+	if prefix != "" {
+		prefix = filepath.Clean(prefix)
+	}
+
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(time.Now())
+	locks := []FileLock{}
+	for path, lock := range t.byPath {
+		if prefix != "" && path != prefix && !strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			continue
+		}
+		listed := *lock
+		listed.ID = ""
+		locks = append(locks, listed)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Path < locks[j].Path })
+	return locks
+}
+
+// checkLock returns a *LockedError if path is locked and lockID is not the
+// ID of its lock
+func (m *Manager) checkLock(path, lockID string) error {
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lock, ok := t.byPath[filepath.Clean(path)]
+	if !ok || !time.Now().Before(lock.ExpiresAt) || lock.ID == lockID {
+		return nil
+	}
+	holder := *lock
+	holder.ID = ""
+	return &LockedError{Holder: holder}
+}
+
+// attachLocks sets the locks on files, without their IDs
+func (m *Manager) attachLocks(files []FileInfo) {
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.byPath) == 0 {
+		return
+	}
+	now := time.Now()
+	for i := range files {
+		if lock, ok := t.byPath[filepath.Clean(files[i].Path)]; ok && now.Before(lock.ExpiresAt) {
+			holder := *lock
+			holder.ID = ""
+			files[i].Lock = &holder
+		}
+	}
+}
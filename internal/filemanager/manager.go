@@ -2,18 +2,36 @@ package filemanager
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/cache"
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
 )
 
 type Manager struct {
 	validator *PathValidator
 	audit     *audit.Logger
+	policies  *PolicyStore
+	handles   *handleCache
+	locks     *lockTable
+	wopi      *wopiTokens
+	uploads   *uploadSessions
+	trash     *trash
+	usage     *cache.Cache[*DirUsage]
+	ignore    *ignore.Matcher
+	quotas    *quotas
+	watcher   *watcher.Watcher
+	scan      *uploadScan
+	versions  *versioning
 }
 
 type FileInfo struct {
@@ -28,29 +46,95 @@ type FileInfo struct {
 	Group       uint32      `json:"group,omitempty"`
 	Permissions string      `json:"permissions"`
 	MimeType    string      `json:"mime_type,omitempty"`
+	Lock        *FileLock   `json:"lock,omitempty"` // Set by List and GetInfo while the file is locked
 }
 
+// Sort keys and orders for ListOptions
+const (
+	SortByName  = "name"
+	SortBySize  = "size"
+	SortByMTime = "mtime"
+
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// ErrInvalidListOptions is returned by List for an unknown sort key or
+// order, a negative offset or limit, or a malformed pattern
+var ErrInvalidListOptions = errors.New("invalid list options")
+
 type ListOptions struct {
 	Path      string
 	Recursive bool
 	Offset    int
-	Limit     int
-	SortBy    string
-	SortOrder string
+	Limit     int    // 0 for no limit
+	SortBy    string // name (default), size or mtime
+	SortOrder string // asc (default) or desc
+	Pattern   string // Glob matched against entry names, as in filepath.Match
+	NoHidden  bool   // Leave out dotfiles
+}
+
+func (o *ListOptions) validate() error {
+	switch o.SortBy {
+	case "", SortByName, SortBySize, SortByMTime:
+	default:
+		return fmt.Errorf("%w: unknown sort key %q", ErrInvalidListOptions, o.SortBy)
+	}
+	switch o.SortOrder {
+	case "", SortAsc, SortDesc:
+	default:
+		return fmt.Errorf("%w: unknown sort order %q", ErrInvalidListOptions, o.SortOrder)
+	}
+	if o.Offset < 0 || o.Limit < 0 {
+		return fmt.Errorf("%w: offset and limit must not be negative", ErrInvalidListOptions)
+	}
+	if _, err := filepath.Match(o.Pattern, ""); err != nil {
+		return fmt.Errorf("%w: bad pattern %q", ErrInvalidListOptions, o.Pattern)
+	}
+	return nil
 }
 
 func New(allowedPaths []string, auditLogger *audit.Logger) *Manager {
 	return &Manager{
 		validator: NewPathValidator(allowedPaths),
 		audit:     auditLogger,
+		handles:   newHandleCache(),
+		locks:     newLockTable(),
+		wopi:      newWOPITokens(),
 	}
 }
 
+// SetFollowEscapingSymlinks lets paths lead out of the allowed directories
+// through symlinks, for hosts that link shares to disks mounted elsewhere.
+// Otherwise paths are resolved and must stay within them.
+func (m *Manager) SetFollowEscapingSymlinks(follow bool) {
+	m.validator.followEscape = follow
+}
+
+// SetOnDemandMount calls mount with every path before it is used, so
+// network shares can be mounted when they are first accessed. Errors of
+// mount fail the operation.
+func (m *Manager) SetOnDemandMount(mount func(path string) error) {
+	m.validator.mount = mount
+}
+
+// SetPolicyStore enables per-directory upload policies
+func (m *Manager) SetPolicyStore(store *PolicyStore) {
+	m.policies = store
+}
+
+// List returns the entries of a directory that match opts, sorted and cut
+// to the requested window. Entries are filtered by name before they are
+// stat'ed, and when sorting by name only the entries in the window are, so
+// pages of large directories stay cheap.
 func (m *Manager) List(ctx context.Context, opts ListOptions, user string) ([]FileInfo, error) {
 	if err := m.validator.ValidatePath(opts.Path); err != nil {
 		m.logAudit(ctx, user, "list", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
 		return nil, fmt.Errorf("invalid path: %w", err)
 	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 
 	entries, err := os.ReadDir(opts.Path)
 	if err != nil {
@@ -58,23 +142,79 @@ func (m *Manager) List(ctx context.Context, opts ListOptions, user string) ([]Fi
 		return nil, fmt.Errorf("read directory: %w", err)
 	}
 
-	var files []FileInfo
+	matched := entries[:0]
 	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
+		name := entry.Name()
+		if m.validator.hidden(name) || opts.NoHidden && strings.HasPrefix(name, ".") {
 			continue
 		}
+		if opts.Pattern != "" {
+			if ok, _ := filepath.Match(opts.Pattern, name); !ok {
+				continue
+			}
+		}
+		matched = append(matched, entry)
+	}
 
-		fileInfo := m.buildFileInfo(filepath.Join(opts.Path, entry.Name()), info)
-		files = append(files, fileInfo)
+	desc := opts.SortOrder == SortDesc
+	files := []FileInfo{}
+	if opts.SortBy == "" || opts.SortBy == SortByName {
+		// ReadDir already sorts by name
+		if desc {
+			slices.Reverse(matched)
+		}
+		for _, entry := range window(matched, opts.Offset, opts.Limit) {
+			if info, err := entry.Info(); err == nil {
+				files = append(files, m.buildFileInfo(filepath.Join(opts.Path, entry.Name()), info))
+			}
+		}
+	} else {
+		for _, entry := range matched {
+			if info, err := entry.Info(); err == nil {
+				files = append(files, m.buildFileInfo(filepath.Join(opts.Path, entry.Name()), info))
+			}
+		}
+		sortFiles(files, opts.SortBy, desc)
+		files = window(files, opts.Offset, opts.Limit)
 	}
 
+	m.attachLocks(files)
 	m.logAudit(ctx, user, "list", opts.Path, "success", map[string]interface{}{"count": len(files)})
 	return files, nil
 }
 
+// sortFiles sorts files by size or modification time, breaking ties by name
+func sortFiles(files []FileInfo, by string, desc bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if desc {
+			a, b = b, a
+		}
+		switch {
+		case by == SortBySize && a.Size != b.Size:
+			return a.Size < b.Size
+		case by == SortByMTime && !a.ModTime.Equal(b.ModTime):
+			return a.ModTime.Before(b.ModTime)
+		}
+		return a.Name < b.Name
+	})
+}
+
+// window returns limit items from offset, or all of them from offset when
+// limit is 0
+func window[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return items[:0]
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
 func (m *Manager) GetInfo(ctx context.Context, path string, user string) (*FileInfo, error) {
-	if err := m.validator.ValidatePath(path); err != nil {
+	if err := m.validator.validateEntry(path); err != nil {
 		m.logAudit(ctx, user, "get_info", path, "failed", map[string]interface{}{"error": err.Error()})
 		return nil, fmt.Errorf("invalid path: %w", err)
 	}
@@ -85,9 +225,10 @@ func (m *Manager) GetInfo(ctx context.Context, path string, user string) (*FileI
 		return nil, fmt.Errorf("stat file: %w", err)
 	}
 
-	fileInfo := m.buildFileInfo(path, info)
+	files := []FileInfo{m.buildFileInfo(path, info)}
+	m.attachLocks(files)
 	m.logAudit(ctx, user, "get_info", path, "success", nil)
-	return &fileInfo, nil
+	return &files[0], nil
 }
 
 func (m *Manager) CreateDir(ctx context.Context, path string, user string) error {
@@ -106,22 +247,39 @@ func (m *Manager) CreateDir(ctx context.Context, path string, user string) error
 }
 
 func (m *Manager) Delete(ctx context.Context, path string, user string) error {
-	if err := m.validator.ValidatePath(path); err != nil {
+	if err := m.validator.validateEntry(path); err != nil {
 		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
 		return fmt.Errorf("invalid path: %w", err)
 	}
 
+	if m.trash != nil {
+		_, err := m.moveToTrash(ctx, path, user)
+		return err
+	}
+	return m.remove(ctx, path, user)
+}
+
+// DeletePermanently removes path without moving it to the trash
+func (m *Manager) DeletePermanently(ctx context.Context, path string, user string) error {
+	if err := m.validator.validateEntry(path); err != nil {
+		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
+		return fmt.Errorf("invalid path: %w", err)
+	}
+	return m.remove(ctx, path, user)
+}
+
+func (m *Manager) remove(ctx context.Context, path string, user string) error {
 	if err := os.RemoveAll(path); err != nil {
 		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
 		return fmt.Errorf("delete: %w", err)
 	}
 
-	m.logAudit(ctx, user, "delete", path, "success", nil)
+	m.logAudit(ctx, user, "delete", path, "success", map[string]interface{}{"permanent": true})
 	return nil
 }
 
 func (m *Manager) Rename(ctx context.Context, oldPath, newPath string, user string) error {
-	if err := m.validator.ValidatePath(oldPath); err != nil {
+	if err := m.validator.validateEntry(oldPath); err != nil {
 		m.logAudit(ctx, user, "rename", oldPath, "failed", map[string]interface{}{"error": err.Error()})
 		return fmt.Errorf("invalid old path: %w", err)
 	}
@@ -135,52 +293,87 @@ func (m *Manager) Rename(ctx context.Context, oldPath, newPath string, user stri
 		m.logAudit(ctx, user, "rename", oldPath, "failed", map[string]interface{}{"error": err.Error(), "new_path": newPath})
 		return fmt.Errorf("rename: %w", err)
 	}
+	m.moveQuota(oldPath, newPath)
 
 	m.logAudit(ctx, user, "rename", oldPath, "success", map[string]interface{}{"new_path": newPath})
 	return nil
 }
 
-func (m *Manager) Copy(ctx context.Context, srcPath, dstPath string, user string) error {
+// CopyResult describes a finished copy
+type CopyResult struct {
+	Bytes int64 `json:"bytes"`
+	// Reflink is set when the data was cloned instead of copied, sharing
+	// blocks with the source until either is changed. For directories,
+	// every file was cloned.
+	Reflink bool `json:"reflink"`
+}
+
+// Copy copies srcPath to dstPath. On filesystems that support reflinks,
+// like btrfs and XFS, files are cloned instead, which is instant and takes
+// no space; elsewhere their data is copied.
+func (m *Manager) Copy(ctx context.Context, srcPath, dstPath string, user string) (*CopyResult, error) {
 	if err := m.validator.ValidatePath(srcPath); err != nil {
 		m.logAudit(ctx, user, "copy", srcPath, "failed", map[string]interface{}{"error": err.Error()})
-		return fmt.Errorf("invalid source path: %w", err)
+		return nil, fmt.Errorf("invalid source path: %w", err)
 	}
 
 	if err := m.validator.ValidatePath(dstPath); err != nil {
 		m.logAudit(ctx, user, "copy", srcPath, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
-		return fmt.Errorf("invalid destination path: %w", err)
+		return nil, fmt.Errorf("invalid destination path: %w", err)
+	}
+
+	if info, err := os.Stat(srcPath); err == nil {
+		if info.IsDir() {
+			var p TransferProgress
+			if err := m.CopyTree(ctx, srcPath, dstPath, TreeOptions{}, user, func(progress TransferProgress) { p = progress }); err != nil {
+				return nil, err
+			}
+			return &CopyResult{Bytes: p.BytesDone, Reflink: p.Reflinked > 0 && p.Reflinked == p.FilesDone}, nil
+		}
+		if err := m.checkQuota(ctx, dstPath, user, info.Size()); err != nil {
+			m.logAudit(ctx, user, "copy", srcPath, "rejected", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
+			return nil, err
+		}
 	}
 
 	src, err := os.Open(srcPath)
 	if err != nil {
 		m.logAudit(ctx, user, "copy", srcPath, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
-		return fmt.Errorf("open source: %w", err)
+		return nil, fmt.Errorf("open source: %w", err)
 	}
 	defer src.Close()
 
 	dst, err := os.Create(dstPath)
 	if err != nil {
 		m.logAudit(ctx, user, "copy", srcPath, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
-		return fmt.Errorf("create destination: %w", err)
+		return nil, fmt.Errorf("create destination: %w", err)
 	}
 	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
-		m.logAudit(ctx, user, "copy", srcPath, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
-		return fmt.Errorf("copy data: %w", err)
+	result := &CopyResult{}
+	srcInfo, statErr := src.Stat()
+	if statErr == nil && reflink(dst, src) == nil {
+		result.Bytes, result.Reflink = srcInfo.Size(), true
+	} else {
+		written, err := copyData(dst, src)
+		if err != nil {
+			m.logAudit(ctx, user, "copy", srcPath, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
+			return nil, fmt.Errorf("copy data: %w", err)
+		}
+		result.Bytes = written
 	}
+	m.chargeQuota(dstPath, user, result.Bytes)
 
-	srcInfo, err := src.Stat()
-	if err == nil {
+	if statErr == nil {
 		os.Chmod(dstPath, srcInfo.Mode())
 	}
 
-	m.logAudit(ctx, user, "copy", srcPath, "success", map[string]interface{}{"dst_path": dstPath})
-	return nil
+	m.logAudit(ctx, user, "copy", srcPath, "success", map[string]interface{}{"dst_path": dstPath, "reflink": result.Reflink})
+	return result, nil
 }
 
 func (m *Manager) Move(ctx context.Context, srcPath, dstPath string, user string) error {
-	if err := m.validator.ValidatePath(srcPath); err != nil {
+	if err := m.validator.validateEntry(srcPath); err != nil {
 		m.logAudit(ctx, user, "move", srcPath, "failed", map[string]interface{}{"error": err.Error()})
 		return fmt.Errorf("invalid source path: %w", err)
 	}
@@ -194,6 +387,7 @@ func (m *Manager) Move(ctx context.Context, srcPath, dstPath string, user string
 		m.logAudit(ctx, user, "move", srcPath, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dstPath})
 		return fmt.Errorf("move: %w", err)
 	}
+	m.moveQuota(srcPath, dstPath)
 
 	m.logAudit(ctx, user, "move", srcPath, "success", map[string]interface{}{"dst_path": dstPath})
 	return nil
@@ -205,6 +399,15 @@ func (m *Manager) CreateSymlink(ctx context.Context, target, linkPath string, us
 		return fmt.Errorf("invalid link path: %w", err)
 	}
 
+	resolved := target
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(linkPath), resolved)
+	}
+	if err := m.validator.checkSymlinks(filepath.Clean(resolved)); err != nil {
+		m.logAudit(ctx, user, "create_symlink", linkPath, "failed", map[string]interface{}{"error": err.Error(), "target": target})
+		return fmt.Errorf("invalid target: %w", err)
+	}
+
 	if err := os.Symlink(target, linkPath); err != nil {
 		m.logAudit(ctx, user, "create_symlink", linkPath, "failed", map[string]interface{}{"error": err.Error(), "target": target})
 		return fmt.Errorf("create symlink: %w", err)
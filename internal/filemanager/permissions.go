@@ -0,0 +1,357 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// ErrInvalidPermissions is returned for permission changes that are
+// malformed or cannot apply to the file
+var ErrInvalidPermissions = errors.New("invalid permission change")
+
+// Permissions is who may access a file and how
+type Permissions struct {
+	Path      string            `json:"path"`
+	Mode      string            `json:"mode"` // Octal, with setuid, setgid and sticky bits
+	Owner     uint32            `json:"owner"`
+	OwnerName string            `json:"owner_name,omitempty"`
+	Group     uint32            `json:"group"`
+	GroupName string            `json:"group_name,omitempty"`
+	Xattrs    map[string]string `json:"xattrs,omitempty"` // Extended attributes the agent may read
+	ACL       []string          `json:"acl,omitempty"`    // Extended POSIX ACL entries, as getfacl prints them
+}
+
+// PermissionChange is a change of permissions. Fields left empty are not
+// changed.
+type PermissionChange struct {
+	Mode         string            `json:"mode,omitempty"`          // Octal, e.g. "0750"
+	Owner        string            `json:"owner,omitempty"`         // User name or UID
+	Group        string            `json:"group,omitempty"`         // Group name or GID
+	SetXattrs    map[string]string `json:"set_xattrs,omitempty"`    // Only in the user namespace
+	RemoveXattrs []string          `json:"remove_xattrs,omitempty"` // Only in the user namespace
+	SetACL       []string          `json:"set_acl,omitempty"`       // Entries added or changed, e.g. "user:alice:rwx"
+	RemoveACL    []string          `json:"remove_acl,omitempty"`    // Entries removed, e.g. "user:alice"
+	Recursive    bool              `json:"recursive,omitempty"`     // Apply mode, owner, group and ACL below directories too
+}
+
+// aclEntry matches an ACL entry with permissions, as setfacl -m takes it
+var aclEntry = regexp.MustCompile(`^(d:|default:)?(u|user|g|group|m|mask|o|other):[A-Za-z0-9._@$-]*:[rwxX-]{1,3}$`)
+
+// aclName matches an ACL entry without permissions, as setfacl -x takes it
+var aclName = regexp.MustCompile(`^(d:|default:)?(u|user|g|group|m|mask|o|other):[A-Za-z0-9._@$-]*$`)
+
+// xattrNamespace is the only namespace whose attributes may be changed;
+// the others hold security labels, capabilities and ACLs
+const xattrNamespace = "user."
+
+// GetPermissions returns the mode, ownership, extended attributes and ACL
+// of path
+func (m *Manager) GetPermissions(ctx context.Context, path string, user string) (*Permissions, error) {
+	if err := m.validator.ValidatePath(path); err != nil {
+		m.logAudit(ctx, user, "get_permissions", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+
+	perms, err := readPermissions(ctx, filepath.Clean(path))
+	if err != nil {
+		m.logAudit(ctx, user, "get_permissions", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+	m.logAudit(ctx, user, "get_permissions", path, "success", nil)
+	return perms, nil
+}
+
+// SetPermissions applies change to path and returns the permissions it
+// ends up with. The audit entry holds the permissions before and after.
+// Symbolic links are never followed: their ownership can be changed, but
+// they have no mode, attributes or ACL of their own.
+func (m *Manager) SetPermissions(ctx context.Context, path string, change PermissionChange, user string) (*Permissions, error) {
+	fail := func(err error) (*Permissions, error) {
+		m.logAudit(ctx, user, "set_permissions", path, "failed", map[string]interface{}{"error": err.Error(), "change": change})
+		return nil, err
+	}
+
+	if err := m.validator.ValidatePath(path); err != nil {
+		return fail(fmt.Errorf("invalid path: %w", err))
+	}
+	path = filepath.Clean(path)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fail(fmt.Errorf("stat file: %w", err))
+	}
+	mode, uid, gid, err := checkPermissionChange(change, info)
+	if err != nil {
+		return fail(err)
+	}
+
+	before, err := readPermissions(ctx, path)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := applyOwnership(path, mode, uid, gid, change.Recursive); err != nil {
+		return fail(err)
+	}
+	for name, value := range change.SetXattrs {
+		if err := setXattr(path, name, value); err != nil {
+			return fail(fmt.Errorf("set attribute %s: %w", name, err))
+		}
+	}
+	for _, name := range change.RemoveXattrs {
+		if err := removeXattr(path, name); err != nil {
+			return fail(fmt.Errorf("remove attribute %s: %w", name, err))
+		}
+	}
+	if err := applyACL(ctx, path, "-m", change.SetACL, change.Recursive); err != nil {
+		return fail(err)
+	}
+	if err := applyACL(ctx, path, "-x", change.RemoveACL, change.Recursive); err != nil {
+		return fail(err)
+	}
+
+	after, err := readPermissions(ctx, path)
+	if err != nil {
+		return fail(err)
+	}
+	m.logAudit(ctx, user, "set_permissions", path, "success", map[string]interface{}{
+		"before":    before,
+		"after":     after,
+		"recursive": change.Recursive,
+	})
+	return after, nil
+}
+
+// checkPermissionChange validates change for a file with info and returns
+// the mode to set, or nil, and the owner and group, or -1 to keep them
+func checkPermissionChange(change PermissionChange, info os.FileInfo) (*os.FileMode, int, int, error) {
+	invalid := func(format string, args ...interface{}) (*os.FileMode, int, int, error) {
+		return nil, -1, -1, fmt.Errorf("%w: %s", ErrInvalidPermissions, fmt.Sprintf(format, args...))
+	}
+
+	isLink := info.Mode()&os.ModeSymlink != 0
+	if isLink && (change.Mode != "" || len(change.SetXattrs) > 0 || len(change.RemoveXattrs) > 0 ||
+		len(change.SetACL) > 0 || len(change.RemoveACL) > 0) {
+		return invalid("symbolic links only have an owner and group of their own")
+	}
+
+	var mode *os.FileMode
+	if change.Mode != "" {
+		bits, err := strconv.ParseUint(change.Mode, 8, 32)
+		if err != nil || bits > 07777 {
+			return invalid("mode %q is not an octal mode", change.Mode)
+		}
+		m := fileModeFromBits(uint32(bits))
+		mode = &m
+	}
+
+	uid, gid := -1, -1
+	if change.Owner != "" {
+		id, err := lookupID(change.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return invalid("unknown owner %q", change.Owner)
+		}
+		uid = id
+	}
+	if change.Group != "" {
+		id, err := lookupID(change.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return invalid("unknown group %q", change.Group)
+		}
+		gid = id
+	}
+
+	for name := range change.SetXattrs {
+		if !strings.HasPrefix(name, xattrNamespace) || len(name) == len(xattrNamespace) {
+			return invalid("attribute %q is not in the %s namespace", name, strings.TrimSuffix(xattrNamespace, "."))
+		}
+	}
+	for _, name := range change.RemoveXattrs {
+		if !strings.HasPrefix(name, xattrNamespace) || len(name) == len(xattrNamespace) {
+			return invalid("attribute %q is not in the %s namespace", name, strings.TrimSuffix(xattrNamespace, "."))
+		}
+	}
+	for _, entry := range change.SetACL {
+		if !aclEntry.MatchString(entry) {
+			return invalid("ACL entry %q is malformed", entry)
+		}
+	}
+	for _, entry := range change.RemoveACL {
+		if !aclName.MatchString(entry) {
+			return invalid("ACL entry %q is malformed", entry)
+		}
+	}
+	return mode, uid, gid, nil
+}
+
+// lookupID resolves a numeric ID or a name
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// applyOwnership sets the mode and ownership of path, and of everything
+// below it if recursive. Links below are not followed.
+func applyOwnership(path string, mode *os.FileMode, uid, gid int, recursive bool) error {
+	if mode == nil && uid < 0 && gid < 0 {
+		return nil
+	}
+	apply := func(path string, isLink bool) error {
+		// Before chmod, since chown clears setuid and setgid bits
+		if uid >= 0 || gid >= 0 {
+			if err := os.Lchown(path, uid, gid); err != nil {
+				return fmt.Errorf("chown: %w", err)
+			}
+		}
+		if mode != nil && !isLink {
+			if err := os.Chmod(path, *mode); err != nil {
+				return fmt.Errorf("chmod: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if !recursive {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return fmt.Errorf("stat file: %w", err)
+		}
+		return apply(path, info.Mode()&os.ModeSymlink != 0)
+	}
+	return filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return apply(path, entry.Type()&fs.ModeSymlink != 0)
+	})
+}
+
+// applyACL runs setfacl with action, -m or -x, for entries
+func applyACL(ctx context.Context, path, action string, entries []string, recursive bool) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	args := []string{action, strings.Join(entries, ",")}
+	if recursive {
+		// -P keeps the walk from following links
+		args = append([]string{"-R", "-P"}, args...)
+	}
+	args = append(args, "--", path)
+	if output, err := sysexec.CombinedOutput(ctx, "setfacl", args...); err != nil {
+		return fmt.Errorf("setfacl: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// readPermissions reads the permissions of path. Attributes and ACLs the
+// system does not support are left out.
+func readPermissions(ctx context.Context, path string) (*Permissions, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+
+	perms := &Permissions{
+		Path: path,
+		Mode: fmt.Sprintf("%04o", fileModeBits(info.Mode())),
+	}
+	if owner, group, ok := getOwnerAndGroup(info); ok {
+		perms.Owner, perms.Group = owner, group
+		if u, err := user.LookupId(strconv.FormatUint(uint64(owner), 10)); err == nil {
+			perms.OwnerName = u.Username
+		}
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(group), 10)); err == nil {
+			perms.GroupName = g.Name
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return perms, nil
+	}
+
+	if perms.Xattrs, err = listXattrs(path); err != nil {
+		return nil, fmt.Errorf("list attributes: %w", err)
+	}
+	perms.ACL = readACL(ctx, path)
+	return perms, nil
+}
+
+// readACL returns the extended ACL entries of path, or nil if it has none
+// or getfacl is not available
+func readACL(ctx context.Context, path string) []string {
+	output, err := sysexec.Output(ctx, "getfacl", "--omit-header", "--absolute-names", "--", path)
+	if err != nil {
+		return nil
+	}
+	var entries []string
+	for _, line := range strings.Split(string(output), "\n") {
+		// Drop comments, like the effective rights after a mask
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		// The mode already shows the base entries
+		if line == "" || strings.HasPrefix(line, "user::") || strings.HasPrefix(line, "group::") || strings.HasPrefix(line, "other::") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries
+}
+
+// fileModeBits returns the octal permission bits of mode
+func fileModeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// fileModeFromBits is the reverse of fileModeBits
+func fileModeFromBits(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
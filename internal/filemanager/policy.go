@@ -0,0 +1,261 @@
+package filemanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// Policy violation codes returned in PolicyError.Code
+const (
+	PolicyChecksumMismatch    = "checksum_mismatch"
+	PolicyExtensionNotAllowed = "extension_not_allowed"
+	PolicyFileTooLarge        = "file_too_large"
+	PolicyInsufficientSpace   = "insufficient_space"
+	PolicyMalwareDetected     = "malware_detected"
+	PolicyQuotaExceeded       = "quota_exceeded"
+)
+
+// PolicyError describes an upload rejected by checksum verification or a directory policy
+type PolicyError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// UploadPolicy restricts uploads into a directory and its subdirectories
+type UploadPolicy struct {
+	Path              string    `json:"path"`
+	AllowedExtensions []string  `json:"allowed_extensions,omitempty"`
+	MaxSize           int64     `json:"max_size,omitempty"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// PolicyStore keeps per-directory upload policies persisted as JSON
+type PolicyStore struct {
+	mu        sync.RWMutex
+	policies  map[string]*UploadPolicy
+	stateFile string
+}
+
+// NewPolicyStore creates a policy store backed by stateFile
+func NewPolicyStore(stateFile string) (*PolicyStore, error) {
+	s := &PolicyStore{
+		policies:  make(map[string]*UploadPolicy),
+		stateFile: stateFile,
+	}
+
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load upload policies: %w", err)
+	}
+
+	return s, nil
+}
+
+// Set adds or replaces the policy for policy.Path
+func (s *PolicyStore) Set(policy *UploadPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policy.Path = filepath.Clean(policy.Path)
+	policy.AllowedExtensions = normalizeExtensions(policy.AllowedExtensions)
+	policy.UpdatedAt = time.Now()
+
+	s.policies[policy.Path] = policy
+	return s.save()
+}
+
+// Remove deletes the policy for path
+func (s *PolicyStore) Remove(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, exists := s.policies[path]; !exists {
+		return fmt.Errorf("no upload policy for %s", path)
+	}
+
+	delete(s.policies, path)
+	return s.save()
+}
+
+// List returns all policies sorted by path
+func (s *PolicyStore) List() []*UploadPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	policies := make([]*UploadPolicy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policyCopy := *policy
+		policies = append(policies, &policyCopy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Path < policies[j].Path
+	})
+	return policies
+}
+
+// Match returns the most specific policy covering path, or nil
+func (s *PolicyStore) Match(path string) *UploadPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best *UploadPolicy
+	dir := filepath.Dir(filepath.Clean(path))
+	for policyPath, policy := range s.policies {
+		rel, err := filepath.Rel(policyPath, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if best == nil || len(policyPath) > len(best.Path) {
+			best = policy
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	policyCopy := *best
+	return &policyCopy
+}
+
+// Check validates the file extension against the policy
+func (p *UploadPolicy) Check(path string) error {
+	if len(p.AllowedExtensions) == 0 {
+		return nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, allowed := range p.AllowedExtensions {
+		if ext == allowed {
+			return nil
+		}
+	}
+
+	return &PolicyError{
+		Code:    PolicyExtensionNotAllowed,
+		Message: fmt.Sprintf("extension %q is not allowed in %s", ext, p.Path),
+		Details: map[string]interface{}{
+			"extension":          ext,
+			"allowed_extensions": p.AllowedExtensions,
+			"policy_path":        p.Path,
+		},
+	}
+}
+
+func normalizeExtensions(exts []string) []string {
+	normalized := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+func (s *PolicyStore) save() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	dir := filepath.Dir(s.stateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(s.policies, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal policies: %w", err)
+	}
+
+	if err := statefile.Write(s.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("write policy file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PolicyStore) load() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	var policies map[string]*UploadPolicy
+	if err := statefile.Read(s.stateFile, &policies); err != nil {
+		return err
+	}
+
+	s.policies = policies
+	if s.policies == nil {
+		s.policies = make(map[string]*UploadPolicy)
+	}
+	return nil
+}
+
+// SetUploadPolicy validates and stores an upload policy for a directory
+func (m *Manager) SetUploadPolicy(ctx context.Context, policy *UploadPolicy, user string) error {
+	if m.policies == nil {
+		return fmt.Errorf("upload policies are not enabled")
+	}
+
+	if err := m.validator.ValidatePath(policy.Path); err != nil {
+		m.logAudit(ctx, user, "set_upload_policy", policy.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return fmt.Errorf("invalid path: %w", err)
+	}
+
+	if policy.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative")
+	}
+
+	if err := m.policies.Set(policy); err != nil {
+		m.logAudit(ctx, user, "set_upload_policy", policy.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+
+	m.logAudit(ctx, user, "set_upload_policy", policy.Path, "success", map[string]interface{}{
+		"allowed_extensions": policy.AllowedExtensions,
+		"max_size":           policy.MaxSize,
+	})
+	return nil
+}
+
+// RemoveUploadPolicy deletes the upload policy for a directory
+func (m *Manager) RemoveUploadPolicy(ctx context.Context, path string, user string) error {
+	if m.policies == nil {
+		return fmt.Errorf("upload policies are not enabled")
+	}
+
+	if err := m.policies.Remove(path); err != nil {
+		m.logAudit(ctx, user, "remove_upload_policy", path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+
+	m.logAudit(ctx, user, "remove_upload_policy", path, "success", nil)
+	return nil
+}
+
+// ListUploadPolicies returns all configured upload policies
+func (m *Manager) ListUploadPolicies() []*UploadPolicy {
+	if m.policies == nil {
+		return []*UploadPolicy{}
+	}
+	return m.policies.List()
+}
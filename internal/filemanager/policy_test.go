@@ -0,0 +1,70 @@
+package filemanager
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyStoreMatch(t *testing.T) {
+	store, err := NewPolicyStore(filepath.Join(t.TempDir(), "policies.json"))
+	if err != nil {
+		t.Fatalf("NewPolicyStore: %v", err)
+	}
+	store.Set(&UploadPolicy{Path: "/srv/share", MaxSize: 100})
+	store.Set(&UploadPolicy{Path: "/srv/share/photos/", AllowedExtensions: []string{"JPG", ".png"}})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/srv/share/a.txt", "/srv/share"},
+		{"/srv/share/docs/a.txt", "/srv/share"},
+		{"/srv/share/..hidden/a.txt", "/srv/share"},
+		{"/srv/share/photos/a.jpg", "/srv/share/photos"},
+		{"/srv/share/photos/2024/a.jpg", "/srv/share/photos"},
+		{"/srv/shared/a.txt", ""},
+		{"/srv/a.txt", ""},
+		{"/srv/share", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			policy := store.Match(tt.path)
+			got := ""
+			if policy != nil {
+				got = policy.Path
+			}
+			if got != tt.want {
+				t.Fatalf("Match(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	reloaded, err := NewPolicyStore(store.stateFile)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if policies := reloaded.List(); len(policies) != 2 || policies[1].AllowedExtensions[0] != ".jpg" {
+		t.Fatalf("unexpected reloaded policies %+v", policies)
+	}
+}
+
+func TestUploadPolicyCheck(t *testing.T) {
+	policy := &UploadPolicy{Path: "/srv/photos", AllowedExtensions: normalizeExtensions([]string{"jpg", " .PNG "})}
+
+	if err := policy.Check("/srv/photos/a.JPG"); err != nil {
+		t.Fatalf("expected .JPG to be allowed, got %v", err)
+	}
+	if err := policy.Check("/srv/photos/b.png"); err != nil {
+		t.Fatalf("expected .png to be allowed, got %v", err)
+	}
+
+	var policyErr *PolicyError
+	if err := policy.Check("/srv/photos/c.exe"); !errors.As(err, &policyErr) || policyErr.Code != PolicyExtensionNotAllowed {
+		t.Fatalf("expected extension_not_allowed, got %v", err)
+	}
+	if err := (&UploadPolicy{Path: "/srv"}).Check("/srv/c.exe"); err != nil {
+		t.Fatalf("expected a policy without extensions to allow everything, got %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// Preview kinds
+const (
+	PreviewText   = "text"
+	PreviewImage  = "image"
+	PreviewVideo  = "video"
+	PreviewAudio  = "audio"
+	PreviewBinary = "binary"
+)
+
+// Text preview sizes
+const (
+	DefaultPreviewBytes = 64 << 10
+	MaxPreviewBytes     = 1 << 20
+)
+
+// Preview describes a file well enough to render it without downloading
+// it. Only the part matching Kind is set.
+type Preview struct {
+	Path     string        `json:"path"`
+	Name     string        `json:"name"`
+	Size     int64         `json:"size"`
+	Kind     string        `json:"kind"`
+	MimeType string        `json:"mime_type"`
+	Text     *TextPreview  `json:"text,omitempty"`
+	Image    *ImagePreview `json:"image,omitempty"`
+	Media    *MediaPreview `json:"media,omitempty"`
+	Warning  string        `json:"warning,omitempty"` // Why details are missing, such as ffprobe not being installed
+}
+
+// TextPreview is the start of a text file, converted to UTF-8
+type TextPreview struct {
+	Encoding  string `json:"encoding"` // utf-8, utf-16le, utf-16be or iso-8859-1
+	Content   string `json:"content"`
+	Truncated bool   `json:"truncated"`
+}
+
+// ImagePreview holds the dimensions and EXIF tags of an image
+type ImagePreview struct {
+	Format string            `json:"format,omitempty"`
+	Width  int               `json:"width,omitempty"`
+	Height int               `json:"height,omitempty"`
+	EXIF   map[string]string `json:"exif,omitempty"`
+}
+
+// MediaPreview holds what ffprobe reports about a video or audio file
+type MediaPreview struct {
+	Format   string        `json:"format"`
+	Duration float64       `json:"duration"` // Seconds
+	BitRate  int64         `json:"bit_rate,omitempty"`
+	Streams  []MediaStream `json:"streams"`
+}
+
+// MediaStream is a video, audio or subtitle stream of a media file
+type MediaStream struct {
+	Type     string  `json:"type"`
+	Codec    string  `json:"codec"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	Channels int     `json:"channels,omitempty"`
+	Language string  `json:"language,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// previewTypes maps extensions that content sniffing can't tell apart to
+// their MIME types
+var previewTypes = map[string]string{
+	".mp4": "video/mp4", ".m4v": "video/mp4", ".mkv": "video/x-matroska", ".webm": "video/webm",
+	".mov": "video/quicktime", ".avi": "video/x-msvideo", ".wmv": "video/x-ms-wmv", ".ts": "video/mp2t",
+	".mp3": "audio/mpeg", ".flac": "audio/flac", ".wav": "audio/wav", ".m4a": "audio/mp4",
+	".aac": "audio/aac", ".ogg": "audio/ogg", ".opus": "audio/opus",
+}
+
+// Preview returns a preview of the file at path. Text files are read up to
+// maxBytes, DefaultPreviewBytes if 0; images are decoded only as far as
+// their header; video and audio are described by ffprobe, if installed.
+func (m *Manager) Preview(ctx context.Context, path string, maxBytes int, user string) (*Preview, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultPreviewBytes
+	}
+	if maxBytes > MaxPreviewBytes {
+		maxBytes = MaxPreviewBytes
+	}
+	if err := m.validator.ValidatePath(path); err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+	if info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+
+	// One byte more than shown tells whether the text is truncated
+	head := make([]byte, maxBytes+1)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	head = head[:n]
+
+	p := &Preview{
+		Path:     path,
+		Name:     info.Name(),
+		Size:     info.Size(),
+		MimeType: previewMimeType(path, head),
+	}
+	switch {
+	case strings.HasPrefix(p.MimeType, "image/"):
+		p.Kind = PreviewImage
+		p.Image = previewImage(f)
+	case strings.HasPrefix(p.MimeType, "video/"), strings.HasPrefix(p.MimeType, "audio/"):
+		p.Kind = PreviewVideo
+		if strings.HasPrefix(p.MimeType, "audio/") {
+			p.Kind = PreviewAudio
+		}
+		p.Media, err = probeMedia(ctx, path)
+		if err != nil {
+			p.Warning = err.Error()
+		}
+	case isTextType(p.MimeType):
+		p.Kind = PreviewBinary
+		if text := decodeText(head, maxBytes); text != nil {
+			p.Kind = PreviewText
+			p.Text = text
+		}
+	default:
+		p.Kind = PreviewBinary
+	}
+
+	m.logAudit(ctx, user, "preview", path, "success", map[string]interface{}{"kind": p.Kind})
+	return p, nil
+}
+
+func previewMimeType(path string, head []byte) string {
+	if mimeType, ok := previewTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		return mimeType
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return mimeType
+}
+
+// isTextType reports whether files of mimeType are worth showing as text
+func isTextType(mimeType string) bool {
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript", "text/xml":
+		return true
+	}
+	return strings.HasPrefix(mimeType, "text/")
+}
+
+func previewImage(f *os.File) *ImagePreview {
+	preview := &ImagePreview{}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return preview
+	}
+	if config, format, err := image.DecodeConfig(f); err == nil {
+		preview.Format = format
+		preview.Width = config.Width
+		preview.Height = config.Height
+	}
+	if _, err := f.Seek(0, io.SeekStart); err == nil {
+		preview.EXIF = readEXIF(f)
+	}
+	return preview
+}
+
+// decodeText returns the first maxBytes of head as UTF-8 text, or nil if
+// head looks binary. UTF-16 is recognized by its byte order mark; other
+// text that is not valid UTF-8 is taken as ISO-8859-1.
+func decodeText(head []byte, maxBytes int) *TextPreview {
+	truncated := len(head) > maxBytes
+	if truncated {
+		head = head[:maxBytes]
+	}
+	text := &TextPreview{Truncated: truncated}
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		text.Encoding = "utf-16le"
+		text.Content = decodeUTF16(head[2:], false)
+		return text
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		text.Encoding = "utf-16be"
+		text.Content = decodeUTF16(head[2:], true)
+		return text
+	}
+
+	head = bytes.TrimPrefix(head, []byte{0xEF, 0xBB, 0xBF})
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+	// A multi-byte character may be cut off at the end
+	valid := head
+	if truncated {
+		for i := 0; i < utf8.UTFMax-1 && len(valid) > 0 && !utf8.Valid(valid); i++ {
+			valid = valid[:len(valid)-1]
+		}
+	}
+	if utf8.Valid(valid) {
+		text.Encoding = "utf-8"
+		text.Content = string(valid)
+		return text
+	}
+
+	// Control characters other than whitespace mean binary data
+	for _, b := range head {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' {
+			return nil
+		}
+	}
+	runes := make([]rune, len(head))
+	for i, b := range head {
+		runes[i] = rune(b)
+	}
+	text.Encoding = "iso-8859-1"
+	text.Content = string(runes)
+	return text
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// ffprobeOutput is the part of "ffprobe -print_format json" output used
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string            `json:"codec_type"`
+		CodecName string            `json:"codec_name"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Channels  int               `json:"channels"`
+		Duration  string            `json:"duration"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"streams"`
+}
+
+func probeMedia(ctx context.Context, path string) (*MediaPreview, error) {
+	output, err := sysexec.Output(ctx, "ffprobe", "-v", "quiet", "-print_format", "json",
+		"-show_format", "-show_streams", path)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("parse ffprobe output: %w", err)
+	}
+
+	media := &MediaPreview{Format: probe.Format.FormatName, Streams: []MediaStream{}}
+	media.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	media.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	for _, s := range probe.Streams {
+		stream := MediaStream{
+			Type:     s.CodecType,
+			Codec:    s.CodecName,
+			Width:    s.Width,
+			Height:   s.Height,
+			Channels: s.Channels,
+			Language: s.Tags["language"],
+		}
+		stream.Duration, _ = strconv.ParseFloat(s.Duration, 64)
+		media.Streams = append(media.Streams, stream)
+	}
+	return media, nil
+}
@@ -0,0 +1,463 @@
+package filemanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// Kinds of quotas
+const (
+	QuotaKindUser = "user"
+	QuotaKindDir  = "dir"
+)
+
+// Quota states reported in QuotaStatus.State
+const (
+	QuotaOK           = "ok"
+	QuotaSoftExceeded = "soft_exceeded" // Above the soft limit, within the grace period
+	QuotaGraceExpired = "grace_expired" // Above the soft limit after the grace period
+	QuotaHardExceeded = "hard_exceeded" // At or above the hard limit
+)
+
+const (
+	// DefaultQuotaGrace is how long a soft limit may be exceeded by default
+	DefaultQuotaGrace = 7 * 24 * time.Hour
+	// DefaultQuotaRescan is how long measured usage is reused by default
+	DefaultQuotaRescan = 5 * time.Minute
+)
+
+// ErrQuotasDisabled is returned when no quotas are configured
+var ErrQuotasDisabled = errors.New("quotas are not enabled")
+
+// QuotaLimit limits the space of a user or a directory. Writes may go past
+// the soft limit for the grace period, after which the soft limit is
+// enforced like the hard limit until usage drops below it again.
+type QuotaLimit struct {
+	Subject string        // User name, or directory path
+	Soft    int64         // Bytes, 0 for none
+	Hard    int64         // Bytes, 0 for none
+	Grace   time.Duration // 0 uses QuotaConfig.Grace
+}
+
+// QuotaConfig configures the quotas enforced on uploads and copies
+type QuotaConfig struct {
+	StateFile string        // Files charged to each user
+	Grace     time.Duration // Grace period of limits without their own; 0 uses DefaultQuotaGrace
+	Rescan    time.Duration // How long measured usage is reused; 0 uses DefaultQuotaRescan
+	Users     []QuotaLimit
+	Dirs      []QuotaLimit
+}
+
+// QuotaStatus is the usage of a quota against its limits
+type QuotaStatus struct {
+	Kind      string     `json:"kind"`
+	Subject   string     `json:"subject"`
+	Used      int64      `json:"used"`
+	Soft      int64      `json:"soft,omitempty"`
+	Hard      int64      `json:"hard,omitempty"`
+	GraceSec  int64      `json:"grace_sec"`
+	GraceEnds *time.Time `json:"grace_ends,omitempty"` // Set while above the soft limit
+	State     string     `json:"state"`
+}
+
+// quotaFile is a file written by a user through the agent
+type quotaFile struct {
+	User string `json:"user"`
+	Size int64  `json:"size"`
+}
+
+// quotaState is what is persisted across restarts
+type quotaState struct {
+	Files    map[string]quotaFile `json:"files"`
+	OverSoft map[string]time.Time `json:"over_soft"` // Since when quotas are above their soft limit, by key
+}
+
+// quotaUsage is measured usage and when it was measured
+type quotaUsage struct {
+	used int64
+	at   time.Time
+}
+
+// quota is one configured quota
+type quota struct {
+	kind  string
+	limit QuotaLimit
+}
+
+func (q quota) key() string {
+	return q.kind + ":" + q.limit.Subject
+}
+
+// quotas tracks usage against the configured quotas. Users are charged for
+// the files they upload and copy; directories are measured by walking them
+// and charged for writes in between.
+type quotas struct {
+	mu        sync.Mutex
+	stateFile string
+	rescan    time.Duration
+	users     map[string]QuotaLimit
+	dirs      map[string]QuotaLimit
+	state     quotaState
+	usage     map[string]*quotaUsage // By quota key
+	hidden    func(string) bool
+}
+
+// SetQuotas enables per-user and per-directory quotas on uploads and
+// copies
+func (m *Manager) SetQuotas(cfg *QuotaConfig) error {
+	grace := cfg.Grace
+	if grace <= 0 {
+		grace = DefaultQuotaGrace
+	}
+	rescan := cfg.Rescan
+	if rescan <= 0 {
+		rescan = DefaultQuotaRescan
+	}
+
+	q := &quotas{
+		stateFile: cfg.StateFile,
+		rescan:    rescan,
+		users:     make(map[string]QuotaLimit),
+		dirs:      make(map[string]QuotaLimit),
+		state:     quotaState{Files: make(map[string]quotaFile), OverSoft: make(map[string]time.Time)},
+		usage:     make(map[string]*quotaUsage),
+		hidden:    m.validator.hidden,
+	}
+	for kind, limits := range map[string][]QuotaLimit{QuotaKindUser: cfg.Users, QuotaKindDir: cfg.Dirs} {
+		for _, limit := range limits {
+			if limit.Subject == "" {
+				return fmt.Errorf("%s quota without a subject", kind)
+			}
+			if limit.Soft < 0 || limit.Hard < 0 || (limit.Soft > 0 && limit.Hard > 0 && limit.Soft > limit.Hard) {
+				return fmt.Errorf("%s quota of %s: limits must not be negative and soft must not exceed hard", kind, limit.Subject)
+			}
+			if limit.Grace <= 0 {
+				limit.Grace = grace
+			}
+			if kind == QuotaKindUser {
+				q.users[limit.Subject] = limit
+				continue
+			}
+			if err := m.validator.ValidatePath(limit.Subject); err != nil {
+				return fmt.Errorf("dir quota of %s: %w", limit.Subject, err)
+			}
+			limit.Subject = filepath.Clean(limit.Subject)
+			q.dirs[limit.Subject] = limit
+		}
+	}
+
+	if q.stateFile != "" {
+		if err := statefile.Read(q.stateFile, &q.state); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("load quota state: %w", err)
+		}
+		if q.state.Files == nil {
+			q.state.Files = make(map[string]quotaFile)
+		}
+		if q.state.OverSoft == nil {
+			q.state.OverSoft = make(map[string]time.Time)
+		}
+	}
+
+	m.quotas = q
+	return nil
+}
+
+// Quotas returns the usage of every configured quota, users first
+func (m *Manager) Quotas(ctx context.Context) ([]*QuotaStatus, error) {
+	q := m.quotas
+	if q == nil {
+		return nil, ErrQuotasDisabled
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var all []quota
+	for _, limit := range q.users {
+		all = append(all, quota{kind: QuotaKindUser, limit: limit})
+	}
+	for _, limit := range q.dirs {
+		all = append(all, quota{kind: QuotaKindDir, limit: limit})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].kind != all[j].kind {
+			return all[i].kind == QuotaKindUser
+		}
+		return all[i].limit.Subject < all[j].limit.Subject
+	})
+
+	now := time.Now()
+	statuses := make([]*QuotaStatus, 0, len(all))
+	for _, quota := range all {
+		used, err := q.used(ctx, quota, now)
+		if err != nil {
+			return nil, err
+		}
+
+		status := &QuotaStatus{
+			Kind:     quota.kind,
+			Subject:  quota.limit.Subject,
+			Used:     used,
+			Soft:     quota.limit.Soft,
+			Hard:     quota.limit.Hard,
+			GraceSec: int64(quota.limit.Grace / time.Second),
+			State:    QuotaOK,
+		}
+		if since, over := q.state.OverSoft[quota.key()]; over {
+			ends := since.Add(quota.limit.Grace)
+			status.GraceEnds = &ends
+			status.State = QuotaSoftExceeded
+			if now.After(ends) {
+				status.State = QuotaGraceExpired
+			}
+		}
+		if quota.limit.Hard > 0 && used >= quota.limit.Hard {
+			status.State = QuotaHardExceeded
+		}
+		statuses = append(statuses, status)
+	}
+	q.save()
+	return statuses, nil
+}
+
+// quotaRoom returns how many more bytes user may write to path and the
+// quota that limits it most, or -1 if no quota limits it
+func (m *Manager) quotaRoom(ctx context.Context, path, user string) (int64, *quota, error) {
+	q := m.quotas
+	if q == nil {
+		return -1, nil, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	room := int64(-1)
+	var tightest *quota
+	for _, quota := range q.covering(path, user) {
+		used, err := q.used(ctx, quota, now)
+		if err != nil {
+			return 0, nil, fmt.Errorf("measure quota usage: %w", err)
+		}
+
+		limit := int64(-1)
+		if quota.limit.Hard > 0 {
+			limit = quota.limit.Hard
+		}
+		if since, over := q.state.OverSoft[quota.key()]; over && quota.limit.Soft > 0 && now.After(since.Add(quota.limit.Grace)) {
+			if limit < 0 || quota.limit.Soft < limit {
+				limit = quota.limit.Soft
+			}
+		}
+		if limit < 0 {
+			continue
+		}
+		left := max(limit-used, 0)
+		if room < 0 || left < room {
+			room = left
+			tightest = &quota
+		}
+	}
+	return room, tightest, nil
+}
+
+// checkQuota returns a PolicyError if writing size bytes to path would
+// take user or a directory over quota
+func (m *Manager) checkQuota(ctx context.Context, path, user string, size int64) error {
+	room, quota, err := m.quotaRoom(ctx, path, user)
+	if err != nil {
+		return err
+	}
+	if room >= 0 && size > room {
+		return quotaError(quota, size, room)
+	}
+	return nil
+}
+
+func quotaError(quota *quota, size, room int64) *PolicyError {
+	return &PolicyError{
+		Code:    PolicyQuotaExceeded,
+		Message: fmt.Sprintf("%s quota of %s exceeded: %d bytes left", quota.kind, quota.limit.Subject, room),
+		Details: map[string]interface{}{
+			"kind":      quota.kind,
+			"subject":   quota.limit.Subject,
+			"requested": size,
+			"available": room,
+		},
+	}
+}
+
+// chargeQuota records that user wrote size bytes to path, a file or a
+// directory tree. A path written before is charged to its new writer.
+func (m *Manager) chargeQuota(path, user string, size int64) {
+	q := m.quotas
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if previous, ok := q.state.Files[path]; ok {
+		if usage := q.usage[QuotaKindUser+":"+previous.User]; usage != nil {
+			usage.used -= previous.Size
+		}
+	}
+	q.state.Files[path] = quotaFile{User: user, Size: size}
+
+	now := time.Now()
+	for _, quota := range q.covering(path, user) {
+		if usage := q.usage[quota.key()]; usage != nil {
+			usage.used += size
+			q.markSoft(quota, usage.used, now)
+		}
+	}
+	q.save()
+}
+
+// moveQuota keeps the files below oldPath charged to their users once they
+// are moved to newPath
+func (m *Manager) moveQuota(oldPath, newPath string) {
+	q := m.quotas
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	moved := false
+	for path, file := range q.state.Files {
+		if rel, ok := pathBelow(oldPath, path); ok {
+			delete(q.state.Files, path)
+			q.state.Files[filepath.Join(newPath, rel)] = file
+			moved = true
+		}
+	}
+	if moved {
+		q.save()
+	}
+}
+
+// covering returns the quotas that apply to user writing path
+func (q *quotas) covering(path, user string) []quota {
+	var covering []quota
+	if limit, ok := q.users[user]; ok {
+		covering = append(covering, quota{kind: QuotaKindUser, limit: limit})
+	}
+	for dir, limit := range q.dirs {
+		if _, ok := pathBelow(dir, path); ok {
+			covering = append(covering, quota{kind: QuotaKindDir, limit: limit})
+		}
+	}
+	return covering
+}
+
+// used returns the usage of a quota, measuring it again once the last
+// measurement is older than the rescan interval. Users use the files
+// charged to them that still exist; files deleted or changed since are
+// dropped or charged at their new size.
+func (q *quotas) used(ctx context.Context, quota quota, now time.Time) (int64, error) {
+	key := quota.key()
+	if usage := q.usage[key]; usage != nil && now.Sub(usage.at) < q.rescan {
+		return usage.used, nil
+	}
+
+	var used int64
+	if quota.kind == QuotaKindDir {
+		size, err := q.measure(ctx, quota.limit.Subject)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		used = size
+	} else {
+		for path, file := range q.state.Files {
+			if file.User != quota.limit.Subject {
+				continue
+			}
+			size, err := q.measure(ctx, path)
+			if os.IsNotExist(err) {
+				delete(q.state.Files, path)
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			file.Size = size
+			q.state.Files[path] = file
+			used += size
+		}
+	}
+
+	q.usage[key] = &quotaUsage{used: used, at: now}
+	q.markSoft(quota, used, now)
+	return used, nil
+}
+
+// measure returns the apparent size of a file or a directory tree
+func (q *quotas) measure(ctx context.Context, path string) (int64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	counter := &usageCounter{ctx: ctx, hidden: q.hidden, linked: make(map[[2]uint64]bool)}
+	usage, err := counter.walk(path, info, 0)
+	if err != nil {
+		return 0, err
+	}
+	return usage.Size, nil
+}
+
+// markSoft starts the grace period of a quota that went above its soft
+// limit and ends it once usage is back below
+func (q *quotas) markSoft(quota quota, used int64, now time.Time) {
+	key := quota.key()
+	_, over := q.state.OverSoft[key]
+	switch {
+	case quota.limit.Soft > 0 && used > quota.limit.Soft:
+		if !over {
+			q.state.OverSoft[key] = now
+		}
+	case over:
+		delete(q.state.OverSoft, key)
+	}
+}
+
+func (q *quotas) save() {
+	if q.stateFile == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(q.stateFile), 0755); err != nil {
+		log.Printf("warning: create quota state directory: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(q.state, "", "  ")
+	if err == nil {
+		err = statefile.Write(q.stateFile, data, 0600)
+	}
+	if err != nil {
+		log.Printf("warning: save quota state: %v", err)
+	}
+}
+
+// pathBelow reports whether path is dir or below it, and returns path
+// relative to dir
+func pathBelow(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
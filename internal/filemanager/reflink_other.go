@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filemanager
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is unsupported where the agent has no FICLONE; data is copied
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
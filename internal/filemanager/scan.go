@@ -0,0 +1,146 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Verdicts of ScanResult.Verdict
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanSkipped  = "skipped" // Larger than the scanner takes; the upload is let through
+)
+
+// ScanResult is what a scanner found in an upload
+type ScanResult struct {
+	Engine     string    `json:"engine"`
+	Verdict    string    `json:"verdict"`
+	Signature  string    `json:"signature,omitempty"`  // Name of the malware found
+	Quarantine string    `json:"quarantine,omitempty"` // Where an infected upload was moved
+	ScannedAt  time.Time `json:"scanned_at"`
+}
+
+// Scanner checks uploads for malware before they replace their
+// destination. Errors mean the upload couldn't be scanned, which rejects
+// it.
+type Scanner interface {
+	// Name identifies the scanner in scan results
+	Name() string
+	Scan(ctx context.Context, path string) (*ScanResult, error)
+}
+
+// ScanRecorder is told the scan result of each upload that was stored,
+// such as to keep it with the file's index entry
+type ScanRecorder func(ctx context.Context, path string, result *ScanResult)
+
+// uploadScan scans uploads and moves infected ones to quarantine
+type uploadScan struct {
+	scanner    Scanner
+	quarantine string
+	record     ScanRecorder
+}
+
+// SetScanner makes uploads pass scanner before they are stored. Infected
+// uploads are moved to quarantineDir and rejected.
+func (m *Manager) SetScanner(scanner Scanner, quarantineDir string) error {
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return fmt.Errorf("create quarantine directory: %w", err)
+	}
+	m.scan = &uploadScan{scanner: scanner, quarantine: quarantineDir}
+	return nil
+}
+
+// SetScanRecorder passes the scan results of stored uploads to record
+func (m *Manager) SetScanRecorder(record ScanRecorder) {
+	if m.scan != nil {
+		m.scan.record = record
+	}
+}
+
+// scanUpload scans temp, the upload that is to replace path, and returns
+// nil if no scanner is set. Infected uploads are quarantined and rejected
+// with a policy error.
+func (m *Manager) scanUpload(ctx context.Context, temp, path, user string) (*ScanResult, error) {
+	if m.scan == nil {
+		return nil, nil
+	}
+	result, err := m.scan.scanner.Scan(ctx, temp)
+	if err != nil {
+		return nil, fmt.Errorf("scan upload: %w", err)
+	}
+	if result.Verdict != ScanInfected {
+		return result, nil
+	}
+
+	details := map[string]interface{}{"engine": result.Engine, "signature": result.Signature}
+	dst := filepath.Join(m.scan.quarantine, fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405.000000000Z"), filepath.Base(path)))
+	if err := quarantineFile(temp, dst); err != nil {
+		os.Remove(temp)
+		details["error"] = err.Error()
+		m.logAudit(ctx, user, "upload.quarantine", path, "failed", details)
+	} else {
+		result.Quarantine = dst
+		details["quarantine"] = dst
+		m.logAudit(ctx, user, "upload.quarantine", path, "success", details)
+	}
+
+	return result, &PolicyError{
+		Code:    PolicyMalwareDetected,
+		Message: fmt.Sprintf("upload contains malware: %s", result.Signature),
+		Details: map[string]interface{}{"scan": result},
+	}
+}
+
+// recordScan passes the scan result of an upload stored at path on
+func (m *Manager) recordScan(ctx context.Context, path string, result *ScanResult) {
+	if result != nil && m.scan.record != nil {
+		m.scan.record(context.WithoutCancel(ctx), path, result)
+	}
+}
+
+// quarantineFile moves an infected upload to dst, copying it if the
+// quarantine directory is on another filesystem. Quarantined files are
+// only readable by the agent.
+func quarantineFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return os.Chmod(dst, 0400)
+	} else if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("quarantine: %w", err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("quarantine: %w", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return fmt.Errorf("quarantine: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("quarantine: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("quarantine: %w", err)
+	}
+	return os.Remove(src)
+}
+
+// scanFailure is the audit result of an upload that didn't pass its scan
+func scanFailure(err error) string {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return "rejected"
+	}
+	return "failed"
+}
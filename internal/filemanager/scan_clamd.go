@@ -0,0 +1,117 @@
+package filemanager
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks a file is streamed to clamd in
+const clamdChunkSize = 64 * 1024
+
+// ClamdScanner scans files with a ClamAV daemon. Files are streamed over
+// the connection, so clamd needs no access to the allowed directories.
+type ClamdScanner struct {
+	addr    string // Unix socket path, or host:port for TCP
+	timeout time.Duration
+	maxSize int64
+}
+
+// NewClamdScanner returns a scanner using the clamd at addr, a unix socket
+// path or a host:port. Files larger than maxSize, which should not exceed
+// clamd's StreamMaxLength, are skipped; 0 scans every file.
+func NewClamdScanner(addr string, timeout time.Duration, maxSize int64) *ClamdScanner {
+	return &ClamdScanner{addr: addr, timeout: timeout, maxSize: maxSize}
+}
+
+func (s *ClamdScanner) Name() string {
+	return "clamd"
+}
+
+// Scan streams path to clamd with the INSTREAM command
+func (s *ClamdScanner) Scan(ctx context.Context, path string) (*ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s.maxSize > 0 && info.Size() > s.maxSize {
+		return &ScanResult{Engine: s.Name(), Verdict: ScanSkipped, ScannedAt: time.Now()}, nil
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(s.addr, "/") {
+		network = "unix"
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("send to clamd: %w", err)
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return nil, fmt.Errorf("send to clamd: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A zero-length chunk ends the stream
+	if _, err := conn.Write(make([]byte, 4)); err != nil {
+		return nil, fmt.Errorf("send to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return nil, fmt.Errorf("read clamd reply: %w", err)
+	}
+	return s.parseReply(strings.TrimRight(reply, "\x00"))
+}
+
+// parseReply reads the verdict from a reply like "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func (s *ClamdScanner) parseReply(reply string) (*ScanResult, error) {
+	result := &ScanResult{Engine: s.Name(), ScannedAt: time.Now()}
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		result.Verdict = ScanClean
+	case strings.HasSuffix(verdict, " FOUND"):
+		result.Verdict = ScanInfected
+		result.Signature = strings.TrimSuffix(verdict, " FOUND")
+	default:
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package filemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ErrSparsePreallocated is returned for an upload asking to be both sparse
+// and preallocated, since preallocating fills the holes sparseness keeps
+var ErrSparsePreallocated = errors.New("an upload can't be both sparse and preallocated")
+
+// sparseBlock is the size of the runs of zeros written as holes, the
+// block size of common filesystems
+const sparseBlock = 4096
+
+var zeroBlock [sparseBlock]byte
+
+// sparseWriter writes to f from off on, seeking over blocks of zeros
+// instead of writing them, so they become holes. VM images are mostly
+// zeros and take a fraction of their size on disk this way. It must only
+// write over a part of f that is empty, such as the end of a new file.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		// Blocks are aligned to the file, so a hole never splits a block
+		end := n + sparseBlock - int(w.off%sparseBlock)
+		if end > len(p) {
+			end = len(p)
+		}
+		block := p[n:end]
+		if !bytes.Equal(block, zeroBlock[:len(block)]) {
+			if _, err := w.f.WriteAt(block, w.off); err != nil {
+				return n, err
+			}
+		}
+		w.off += int64(len(block))
+		n = end
+	}
+	return n, nil
+}
+
+// finish sets the size of the file to where writing stopped, which keeps
+// trailing zeros as a hole
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.off)
+}
+
+// isSparse reports whether the file of info takes less disk than its size,
+// so copies of it should keep its holes
+func isSparse(info os.FileInfo) bool {
+	allocated, _, _ := diskUsage(info)
+	return info.Mode().IsRegular() && allocated < info.Size()
+}
+
+// preallocateUpload reserves the disk for an upload of size bytes to f, so
+// one that can't fit is rejected before it is sent rather than partway
+func preallocateUpload(f *os.File, size int64) error {
+	err := preallocate(f, size)
+	if errors.Is(err, syscall.ENOSPC) {
+		return &PolicyError{
+			Code:    PolicyInsufficientSpace,
+			Message: fmt.Sprintf("not enough free space for %d bytes", size),
+			Details: map[string]interface{}{"size": size},
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("preallocate: %w", err)
+	}
+	return nil
+}
+
+// copyData copies src to the new file dst, keeping the holes of a sparse
+// src so copies of VM images don't grow to their full size
+func copyData(dst, src *os.File) (int64, error) {
+	info, err := src.Stat()
+	if err != nil || !isSparse(info) {
+		return io.Copy(dst, src)
+	}
+	sparse := &sparseWriter{f: dst}
+	written, err := io.Copy(sparse, src)
+	if err != nil {
+		return written, err
+	}
+	return written, sparse.finish()
+}
@@ -0,0 +1,42 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+)
+
+// Scheduler task types that copy and move files. Both take src_path and
+// dst_path parameters and an optional overwrite flag.
+const (
+	CopyTaskType = "file.copy"
+	MoveTaskType = "file.move"
+)
+
+// CopyTaskHandler copies files for scheduler tasks of type CopyTaskType
+func (m *Manager) CopyTaskHandler() scheduler.TaskHandler {
+	return m.treeTaskHandler(m.CopyTree)
+}
+
+// MoveTaskHandler moves files for scheduler tasks of type MoveTaskType
+func (m *Manager) MoveTaskHandler() scheduler.TaskHandler {
+	return m.treeTaskHandler(m.MoveTree)
+}
+
+func (m *Manager) treeTaskHandler(transfer func(context.Context, string, string, TreeOptions, string, func(TransferProgress)) error) scheduler.TaskHandler {
+	return func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		src, _ := params["src_path"].(string)
+		dst, _ := params["dst_path"].(string)
+		if src == "" || dst == "" {
+			return nil, fmt.Errorf("src_path and dst_path are required")
+		}
+		overwrite, _ := params["overwrite"].(bool)
+
+		heartbeat := func(TransferProgress) { scheduler.Heartbeat(ctx) }
+		if err := transfer(ctx, src, dst, TreeOptions{Overwrite: overwrite}, "scheduler", heartbeat); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"dst_path": dst}, nil
+	}
+}
@@ -0,0 +1,262 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxTextFileSize is the largest file ReadText and WriteText accept
+const MaxTextFileSize = 1 << 20
+
+var (
+	// ErrNotText is returned for files that are not UTF-8 text, and for
+	// symbolic links, which an atomic write would replace
+	ErrNotText = errors.New("not an editable text file")
+	// ErrTextChanged is returned by WriteText when the file no longer has
+	// the expected checksum
+	ErrTextChanged = errors.New("file changed since it was read")
+)
+
+// TextFile is the content of a text file, with the checksum to send back
+// when saving it
+type TextFile struct {
+	Path    string    `json:"path"`
+	Content string    `json:"content"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// TextEdit describes a saved edit, as recorded in the audit log
+type TextEdit struct {
+	Path         string `json:"path"`
+	Created      bool   `json:"created,omitempty"`
+	SizeBefore   int64  `json:"size_before"`
+	SizeAfter    int64  `json:"size_after"`
+	LinesAdded   int    `json:"lines_added"`
+	LinesRemoved int    `json:"lines_removed"`
+	FirstChange  int    `json:"first_changed_line,omitempty"` // 1-based, 0 if nothing changed
+	SHA256       string `json:"sha256"`
+}
+
+// ReadText returns a UTF-8 text file of up to MaxTextFileSize bytes
+func (m *Manager) ReadText(ctx context.Context, path, user string) (*TextFile, error) {
+	if err := m.validator.ValidatePath(path); err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	data, info, err := readTextFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logAudit(ctx, user, "read_text", path, "success", map[string]interface{}{"size": info.Size()})
+	return &TextFile{
+		Path:    path,
+		Content: string(data),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  textChecksum(data),
+	}, nil
+}
+
+// WriteText replaces the content of a text file atomically, so readers
+// see either the old or the new content. If expectedSHA256 is set, the
+// file must still have that checksum, or ErrTextChanged is returned; pass
+// the checksum of ReadText so edits of others are not overwritten. A locked
+// file can only be written with the ID of its lock. A file that does not
+// exist is only created if create is set. Permissions and ownership of an
+// existing file are kept.
+func (m *Manager) WriteText(ctx context.Context, path, content, expectedSHA256, lockID string, create bool, user string) (*TextEdit, error) {
+	fail := func(err error) (*TextEdit, error) {
+		m.logAudit(ctx, user, "write_text", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+
+	if err := m.validator.ValidatePath(path); err != nil {
+		return fail(fmt.Errorf("invalid path: %w", err))
+	}
+	if len(content) > MaxTextFileSize {
+		return fail(&PolicyError{
+			Code:    PolicyFileTooLarge,
+			Message: fmt.Sprintf("text exceeds maximum size of %d bytes", MaxTextFileSize),
+			Details: map[string]interface{}{"max_size": MaxTextFileSize},
+		})
+	}
+	if !utf8.ValidString(content) {
+		return fail(fmt.Errorf("%w: content is not valid UTF-8", ErrNotText))
+	}
+	if err := m.checkLock(path, lockID); err != nil {
+		return fail(err)
+	}
+
+	old, info, err := readTextFile(path)
+	exists := err == nil
+	switch {
+	case errors.Is(err, os.ErrNotExist) && create:
+	case err != nil:
+		return fail(err)
+	}
+
+	current := ""
+	if exists {
+		current = textChecksum(old)
+	}
+	if expectedSHA256 != "" && !strings.EqualFold(expectedSHA256, current) {
+		m.logAudit(ctx, user, "write_text", path, "rejected", map[string]interface{}{"error": ErrTextChanged.Error()})
+		return nil, fmt.Errorf("%w: its sha256 is now %q", ErrTextChanged, current)
+	}
+
+	if !exists && m.policies != nil {
+		if policy := m.policies.Match(path); policy != nil {
+			if err := policy.Check(path); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if growth := int64(len(content)) - int64(len(old)); growth > 0 {
+		room, quota, err := m.quotaRoom(ctx, path, user)
+		if err != nil {
+			return fail(err)
+		}
+		if room >= 0 && growth > room {
+			return fail(quotaError(quota, growth, room))
+		}
+	}
+
+	if err := m.keepVersion(path); err != nil {
+		return fail(err)
+	}
+	if err := writeFileAtomic(path, []byte(content), info); err != nil {
+		return fail(err)
+	}
+	m.chargeQuota(path, user, int64(len(content)))
+
+	edit := diffSummary(string(old), content)
+	edit.Path = path
+	edit.Created = !exists
+	edit.SizeBefore = int64(len(old))
+	edit.SizeAfter = int64(len(content))
+	edit.SHA256 = textChecksum([]byte(content))
+	m.logAudit(ctx, user, "write_text", path, "success", map[string]interface{}{
+		"created":       edit.Created,
+		"size_before":   edit.SizeBefore,
+		"size_after":    edit.SizeAfter,
+		"lines_added":   edit.LinesAdded,
+		"lines_removed": edit.LinesRemoved,
+		"sha256":        edit.SHA256,
+	})
+	return edit, nil
+}
+
+// readTextFile reads a regular UTF-8 file of up to MaxTextFileSize bytes
+func readTextFile(path string) ([]byte, os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, ErrIsDirectory
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%w: not a regular file", ErrNotText)
+	}
+	if info.Size() > MaxTextFileSize {
+		return nil, nil, &PolicyError{
+			Code:    PolicyFileTooLarge,
+			Message: fmt.Sprintf("file exceeds maximum text size of %d bytes", MaxTextFileSize),
+			Details: map[string]interface{}{"max_size": MaxTextFileSize, "size": info.Size()},
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read file: %w", err)
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return nil, nil, fmt.Errorf("%w: content is not UTF-8 text", ErrNotText)
+	}
+	return data, info, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, giving it the permissions and ownership of previous if set
+func writeFileAtomic(path string, data []byte, previous os.FileInfo) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
+	}
+
+	mode := os.FileMode(0644)
+	if previous != nil {
+		if owner, group, ok := getOwnerAndGroup(previous); ok {
+			os.Lchown(tmp.Name(), int(owner), int(group))
+		}
+		mode = previous.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("set permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace file: %w", err)
+	}
+	return nil
+}
+
+// diffSummary counts the lines that differ between before and after once
+// their common leading and trailing lines are set aside, which is exact
+// for a single changed region and an upper bound otherwise
+func diffSummary(before, after string) *TextEdit {
+	a, b := splitLines(before), splitLines(after)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edit := &TextEdit{
+		LinesRemoved: len(a) - prefix - suffix,
+		LinesAdded:   len(b) - prefix - suffix,
+	}
+	if edit.LinesRemoved > 0 || edit.LinesAdded > 0 {
+		edit.FirstChange = prefix + 1
+	}
+	return edit
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.SplitAfter(s, "\n")
+}
+
+func textChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -2,33 +2,76 @@ package filemanager
 
 import (
 	"context"
-	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type UploadOptions struct {
-	Path          string
-	TempDir       string
-	MaxSize       int64
-	ChunkSize     int64
-	ResumeSupport bool
+	Path           string
+	TempDir        string
+	MaxSize        int64
+	Size           int64 // Total size of a chunked upload, or the expected size of one to preallocate
+	ChunkSize      int64
+	ResumeSupport  bool
+	ExpectedSHA256 string
+	LockID         string // ID of the lock on Path, if it is locked
+	Preallocate    bool   // Reserve Size bytes of disk before writing
+	Sparse         bool   // Write runs of zeros as holes
+}
+
+// validate rejects option combinations that contradict each other
+func (o *UploadOptions) validate() error {
+	if o.Sparse && o.Preallocate {
+		return ErrSparsePreallocated
+	}
+	return nil
 }
 
 type DownloadOptions struct {
 	Path       string
+	Partial    bool // Only send RangeStart to RangeEnd, inclusive
 	RangeStart int64
 	RangeEnd   int64
 }
 
+// ErrRangeNotSatisfiable is returned for a range outside the file
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
 func (m *Manager) Upload(ctx context.Context, reader io.Reader, opts UploadOptions, user string) error {
 	if err := m.validator.ValidatePath(opts.Path); err != nil {
 		m.logAudit(ctx, user, "upload", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
 		return fmt.Errorf("invalid path: %w", err)
 	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if err := m.checkLock(opts.Path, opts.LockID); err != nil {
+		m.logAudit(ctx, user, "upload", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+
+	maxSize, err := m.uploadLimit(ctx, opts, user)
+	if err != nil {
+		return err
+	}
+	// The size is not known up front, so the upload stops where it would
+	// go over quota
+	room, quota, err := m.quotaRoom(ctx, opts.Path, user)
+	if err != nil {
+		m.logAudit(ctx, user, "upload", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	limit := maxSize
+	if room >= 0 && (limit <= 0 || room < limit) {
+		limit = room
+	}
 
 	dir := filepath.Dir(opts.Path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -44,12 +87,33 @@ func (m *Manager) Upload(ctx context.Context, reader io.Reader, opts UploadOptio
 	}
 	defer f.Close()
 
+	if opts.Preallocate {
+		if err := preallocateUpload(f, opts.Size); err != nil {
+			f.Close()
+			os.Remove(tempFile)
+			m.logAudit(ctx, user, "upload", opts.Path, "rejected", map[string]interface{}{"error": err.Error()})
+			return err
+		}
+	}
+
+	hash := sha256.New()
+	var sparse *sparseWriter
+	dst := io.MultiWriter(f, hash)
+	if opts.Sparse {
+		sparse = &sparseWriter{f: f}
+		dst = io.MultiWriter(sparse, hash)
+	}
+
 	var written int64
-	if opts.MaxSize > 0 {
-		limited := io.LimitReader(reader, opts.MaxSize)
-		written, err = io.Copy(f, limited)
+	if maxSize > 0 || room >= 0 {
+		// Read one byte past the limit so oversized uploads are rejected instead of truncated
+		limited := io.LimitReader(reader, limit+1)
+		written, err = io.Copy(dst, limited)
 	} else {
-		written, err = io.Copy(f, reader)
+		written, err = io.Copy(dst, reader)
+	}
+	if err == nil && sparse != nil {
+		err = sparse.finish()
 	}
 
 	if err != nil {
@@ -64,41 +128,98 @@ func (m *Manager) Upload(ctx context.Context, reader io.Reader, opts UploadOptio
 		return fmt.Errorf("close file: %w", err)
 	}
 
+	if maxSize > 0 && written > maxSize {
+		os.Remove(tempFile)
+		policyErr := &PolicyError{
+			Code:    PolicyFileTooLarge,
+			Message: fmt.Sprintf("upload exceeds maximum size of %d bytes", maxSize),
+			Details: map[string]interface{}{"max_size": maxSize},
+		}
+		m.logAudit(ctx, user, "upload", opts.Path, "rejected", map[string]interface{}{"error": policyErr.Error()})
+		return policyErr
+	}
+	if room >= 0 && written > room {
+		os.Remove(tempFile)
+		policyErr := quotaError(quota, written, room)
+		m.logAudit(ctx, user, "upload", opts.Path, "rejected", map[string]interface{}{"error": policyErr.Error()})
+		return policyErr
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if opts.ExpectedSHA256 != "" && !strings.EqualFold(opts.ExpectedSHA256, actual) {
+		os.Remove(tempFile)
+		policyErr := &PolicyError{
+			Code:    PolicyChecksumMismatch,
+			Message: "uploaded content does not match expected SHA-256",
+			Details: map[string]interface{}{
+				"expected": strings.ToLower(opts.ExpectedSHA256),
+				"actual":   actual,
+			},
+		}
+		m.logAudit(ctx, user, "upload", opts.Path, "rejected", map[string]interface{}{"error": policyErr.Error(), "actual_sha256": actual})
+		return policyErr
+	}
+
+	scan, err := m.scanUpload(ctx, tempFile, opts.Path, user)
+	if err != nil {
+		os.Remove(tempFile)
+		m.logAudit(ctx, user, "upload", opts.Path, scanFailure(err), map[string]interface{}{"error": err.Error(), "sha256": actual})
+		return err
+	}
+
+	if err := m.keepVersion(opts.Path); err != nil {
+		os.Remove(tempFile)
+		m.logAudit(ctx, user, "upload", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
 	if err := os.Rename(tempFile, opts.Path); err != nil {
 		os.Remove(tempFile)
 		m.logAudit(ctx, user, "upload", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
 		return fmt.Errorf("rename file: %w", err)
 	}
+	m.chargeQuota(opts.Path, user, written)
+	m.recordScan(ctx, opts.Path, scan)
 
-	m.logAudit(ctx, user, "upload", opts.Path, "success", map[string]interface{}{"size": written})
+	details := map[string]interface{}{"size": written, "sha256": actual}
+	if scan != nil {
+		details["scan"] = scan
+	}
+	m.logAudit(ctx, user, "upload", opts.Path, "success", details)
 	return nil
 }
 
-func (m *Manager) Download(ctx context.Context, writer io.Writer, opts DownloadOptions, user string) (int64, error) {
-	if err := m.validator.ValidatePath(opts.Path); err != nil {
-		m.logAudit(ctx, user, "download", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
-		return 0, fmt.Errorf("invalid path: %w", err)
+// uploadLimit checks an upload against the policy of its directory and
+// returns the size it may have, 0 for unlimited
+func (m *Manager) uploadLimit(ctx context.Context, opts UploadOptions, user string) (int64, error) {
+	maxSize := opts.MaxSize
+	if m.policies != nil {
+		if policy := m.policies.Match(opts.Path); policy != nil {
+			if err := policy.Check(opts.Path); err != nil {
+				m.logAudit(ctx, user, "upload", opts.Path, "rejected", map[string]interface{}{"error": err.Error()})
+				return 0, err
+			}
+			if policy.MaxSize > 0 && (maxSize <= 0 || policy.MaxSize < maxSize) {
+				maxSize = policy.MaxSize
+			}
+		}
 	}
+	return maxSize, nil
+}
 
-	f, err := os.Open(opts.Path)
+func (m *Manager) Download(ctx context.Context, writer io.Writer, opts DownloadOptions, user string) (int64, error) {
+	h, err := m.OpenDownload(opts.Path)
 	if err != nil {
 		m.logAudit(ctx, user, "download", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
-		return 0, fmt.Errorf("open file: %w", err)
-	}
-	defer f.Close()
-
-	var reader io.Reader = f
-
-	if opts.RangeStart > 0 {
-		if _, err := f.Seek(opts.RangeStart, 0); err != nil {
-			m.logAudit(ctx, user, "download", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
-			return 0, fmt.Errorf("seek file: %w", err)
-		}
+		return 0, err
 	}
+	defer h.Close()
 
-	if opts.RangeEnd > 0 {
-		reader = io.LimitReader(f, opts.RangeEnd-opts.RangeStart+1)
+	// Reading at offsets lets concurrent ranges share the file
+	length := h.info.Size() - opts.RangeStart
+	if opts.Partial {
+		length = opts.RangeEnd - opts.RangeStart + 1
 	}
+	reader := io.NewSectionReader(h.file, opts.RangeStart, length)
 
 	written, err := io.Copy(writer, reader)
 	if err != nil {
@@ -115,57 +236,91 @@ func (m *Manager) Download(ctx context.Context, writer io.Writer, opts DownloadO
 	return written, nil
 }
 
-func (m *Manager) GetChecksum(ctx context.Context, path string, user string) (string, error) {
-	if err := m.validator.ValidatePath(path); err != nil {
-		return "", fmt.Errorf("invalid path: %w", err)
-	}
-
-	f, err := os.Open(path)
-	if err != nil {
-		return "", fmt.Errorf("open file: %w", err)
-	}
-	defer f.Close()
-
-	hash := md5.New()
-	if _, err := io.Copy(hash, f); err != nil {
-		return "", fmt.Errorf("compute hash: %w", err)
-	}
-
-	checksum := fmt.Sprintf("%x", hash.Sum(nil))
-	m.logAudit(ctx, user, "checksum", path, "success", map[string]interface{}{"checksum": checksum})
-
-	return checksum, nil
-}
-
+// ParseRangeHeader parses a single byte range such as "bytes=100-",
+// "bytes=100-199" or the suffix form "bytes=-500" against a file of
+// fileSize bytes. An end past the file is clamped to its last byte. It
+// returns ErrRangeNotSatisfiable if the range starts past the file; other
+// errors mean the header is malformed or asks for several ranges, and
+// callers should serve the whole file.
 func ParseRangeHeader(rangeHeader string, fileSize int64) (start, end int64, err error) {
-	if rangeHeader == "" {
-		return 0, 0, nil
+	spec, ok := strings.CutPrefix(strings.TrimSpace(rangeHeader), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("invalid range header")
 	}
-
-	var rangeStart, rangeEnd string
-	if _, err := fmt.Sscanf(rangeHeader, "bytes=%s-%s", &rangeStart, &rangeEnd); err != nil {
+	rangeStart, rangeEnd, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
 		return 0, 0, fmt.Errorf("invalid range header")
 	}
 
-	start = 0
-	if rangeStart != "" {
-		start, err = strconv.ParseInt(rangeStart, 10, 64)
-		if err != nil {
-			return 0, 0, fmt.Errorf("invalid range start")
+	if rangeStart == "" {
+		suffix, err := strconv.ParseInt(rangeEnd, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, fmt.Errorf("invalid range suffix")
+		}
+		if suffix == 0 || fileSize == 0 {
+			return 0, 0, ErrRangeNotSatisfiable
 		}
+		return max(fileSize-suffix, 0), fileSize - 1, nil
 	}
 
+	start, err = strconv.ParseInt(rangeStart, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range start")
+	}
 	end = fileSize - 1
 	if rangeEnd != "" {
 		end, err = strconv.ParseInt(rangeEnd, 10, 64)
-		if err != nil {
+		if err != nil || end < start {
 			return 0, 0, fmt.Errorf("invalid range end")
 		}
+		end = min(end, fileSize-1)
 	}
-
-	if start > end || start < 0 || end >= fileSize {
-		return 0, 0, fmt.Errorf("invalid range")
+	if start >= fileSize {
+		return 0, 0, ErrRangeNotSatisfiable
 	}
 
 	return start, end, nil
 }
+
+// Segment is an inclusive byte range of a file
+type Segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+const (
+	// MaxSegments bounds how many connections a client is told to open
+	MaxSegments = 16
+	// minSegmentSize keeps small files from being split into tiny requests
+	minSegmentSize = 4 << 20
+	// segmentAlign aligns boundaries to whole MiB for sequential disk reads
+	segmentAlign = 1 << 20
+)
+
+// Segments splits a file of size bytes into at most connections ranges of
+// similar size for a parallel download. Boundaries are aligned to 1 MiB
+// and segments are at least 4 MiB, so small files get fewer segments.
+func Segments(size int64, connections int) []Segment {
+	if size <= 0 {
+		return []Segment{}
+	}
+	connections = max(1, min(connections, MaxSegments))
+	count := min(int64(connections), max(1, size/minSegmentSize))
+
+	segmentSize := (size + count - 1) / count
+	segmentSize = (segmentSize + segmentAlign - 1) / segmentAlign * segmentAlign
+
+	segments := make([]Segment, 0, count)
+	for start := int64(0); start < size; start += segmentSize {
+		segments = append(segments, Segment{Start: start, End: min(start+segmentSize, size) - 1})
+	}
+	return segments
+}
+
+// ETag returns a strong entity tag for the contents of a file, derived
+// from its size and modification time in nanoseconds. Rewriting a file
+// changes its modification time, so a resumed download never mixes two
+// versions of it.
+func ETag(info *FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size, info.ModTime.UnixNano())
+}
@@ -0,0 +1,351 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// TrashDirName is the hidden directory deleted files are moved to. File
+// APIs cannot reach into it; the trash APIs manage its contents.
+const TrashDirName = ".trash"
+
+// Errors of the trash
+var (
+	ErrTrashNotFound = errors.New("trash item not found")
+	ErrTrashConflict = errors.New("restore target already exists")
+	ErrTrashDisabled = errors.New("trash is not enabled")
+)
+
+// TrashItem is a deleted file or directory that can still be restored
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`       // Where it was deleted from
+	TrashPath string    `json:"trash_path"` // Where it is kept until purged
+	Size      int64     `json:"size"`       // Total size, including directory contents
+	IsDir     bool      `json:"is_dir"`
+	DeletedBy string    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"` // Zero if kept until purged
+}
+
+// trash keeps the metadata of trash items, one JSON file each. The items
+// themselves stay in a .trash area on their own filesystem, so deleting
+// and restoring are renames however large they are.
+type trash struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+}
+
+// SetTrash makes Delete move files to the trash instead of removing them,
+// with their metadata kept in dir. Items are purged after retention, or
+// kept until purged if it is 0.
+func (m *Manager) SetTrash(dir string, retention time.Duration) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create trash directory: %w", err)
+	}
+	m.trash = &trash{dir: dir, retention: retention}
+	m.validator.hide(TrashDirName)
+	m.trash.prune()
+	return nil
+}
+
+// moveToTrash moves path to the trash area of its filesystem and returns
+// the ID of its trash item
+func (m *Manager) moveToTrash(ctx context.Context, path, user string) (string, error) {
+	path = filepath.Clean(path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
+		return "", fmt.Errorf("delete: %w", err)
+	}
+
+	area, err := m.trashArea(path)
+	if err != nil {
+		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
+		return "", err
+	}
+	if err := os.MkdirAll(area, 0700); err != nil {
+		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
+		return "", fmt.Errorf("create trash area: %w", err)
+	}
+
+	size := info.Size()
+	if info.IsDir() {
+		size = treeSize(path)
+	}
+	now := time.Now()
+	item := &TrashItem{
+		ID:        newTrashID(),
+		Path:      path,
+		Size:      size,
+		IsDir:     info.IsDir(),
+		DeletedBy: user,
+		DeletedAt: now,
+	}
+	item.TrashPath = filepath.Join(area, item.ID)
+	if m.trash.retention > 0 {
+		item.ExpiresAt = now.Add(m.trash.retention)
+	}
+
+	m.trash.mu.Lock()
+	defer m.trash.mu.Unlock()
+	// Save first so a crash between the steps never loses track of data
+	if err := m.trash.save(item); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, item.TrashPath); err != nil {
+		m.trash.removeState(item.ID)
+		m.logAudit(ctx, user, "delete", path, "failed", map[string]interface{}{"error": err.Error()})
+		return "", fmt.Errorf("move to trash: %w", err)
+	}
+
+	m.logAudit(ctx, user, "delete", path, "success", map[string]interface{}{"trash_id": item.ID, "size": item.Size})
+	return item.ID, nil
+}
+
+// trashArea returns the trash directory for path: the .trash directory of
+// the highest directory inside its allowed path that is on the same
+// filesystem, so moving it there never copies data
+func (m *Manager) trashArea(path string) (string, error) {
+	root := m.validator.root(path)
+	if root == "" || root == path {
+		return "", fmt.Errorf("cannot move an allowed directory to the trash")
+	}
+
+	area := filepath.Dir(path)
+	dir, err := os.Stat(area)
+	if err != nil {
+		return "", fmt.Errorf("stat directory: %w", err)
+	}
+	device, ok := deviceID(dir)
+	for ok && area != root {
+		parent, err := os.Stat(filepath.Dir(area))
+		if err != nil {
+			break
+		}
+		if parentDevice, ok := deviceID(parent); !ok || parentDevice != device {
+			break
+		}
+		area = filepath.Dir(area)
+	}
+	if !ok {
+		area = root
+	}
+	return filepath.Join(area, TrashDirName), nil
+}
+
+// ListTrash returns the trash items, most recently deleted first
+func (m *Manager) ListTrash() ([]*TrashItem, error) {
+	if m.trash == nil {
+		return nil, ErrTrashDisabled
+	}
+	m.trash.prune()
+	return m.trash.list()
+}
+
+// RestoreTrash moves a trash item back to target, or to where it was
+// deleted from if target is empty. It never replaces an existing file.
+func (m *Manager) RestoreTrash(ctx context.Context, id, target, user string) (*TrashItem, error) {
+	if m.trash == nil {
+		return nil, ErrTrashDisabled
+	}
+
+	m.trash.mu.Lock()
+	defer m.trash.mu.Unlock()
+
+	item, err := m.trash.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if target == "" {
+		target = item.Path
+	}
+	if err := m.validator.ValidatePath(target); err != nil {
+		m.logAudit(ctx, user, "trash.restore", target, "failed", map[string]interface{}{"error": err.Error(), "trash_id": id})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	target = filepath.Clean(target)
+	if _, err := os.Lstat(target); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTrashConflict, target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		m.logAudit(ctx, user, "trash.restore", target, "failed", map[string]interface{}{"error": err.Error(), "trash_id": id})
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+	if err := os.Rename(item.TrashPath, target); err != nil {
+		m.logAudit(ctx, user, "trash.restore", target, "failed", map[string]interface{}{"error": err.Error(), "trash_id": id})
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+	m.trash.removeState(id)
+
+	m.logAudit(ctx, user, "trash.restore", target, "success", map[string]interface{}{"trash_id": id, "deleted_from": item.Path})
+	item.Path = target
+	return item, nil
+}
+
+// PurgeTrash removes a trash item for good
+func (m *Manager) PurgeTrash(ctx context.Context, id, user string) error {
+	if m.trash == nil {
+		return ErrTrashDisabled
+	}
+
+	m.trash.mu.Lock()
+	item, err := m.trash.load(id)
+	if err == nil {
+		m.trash.removeState(id)
+	}
+	m.trash.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(item.TrashPath); err != nil {
+		m.logAudit(ctx, user, "trash.purge", item.Path, "failed", map[string]interface{}{"error": err.Error(), "trash_id": id})
+		return fmt.Errorf("purge: %w", err)
+	}
+	m.logAudit(ctx, user, "trash.purge", item.Path, "success", map[string]interface{}{"trash_id": id, "size": item.Size})
+	return nil
+}
+
+// EmptyTrash purges every trash item and returns how many were purged and
+// the bytes they freed
+func (m *Manager) EmptyTrash(ctx context.Context, user string) (int, int64, error) {
+	items, err := m.ListTrash()
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int
+	var freed int64
+	for _, item := range items {
+		if err := m.PurgeTrash(ctx, item.ID, user); err != nil {
+			if errors.Is(err, ErrTrashNotFound) {
+				continue
+			}
+			return count, freed, err
+		}
+		count++
+		freed += item.Size
+	}
+	return count, freed, nil
+}
+
+func (t *trash) path(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", fmt.Errorf("%w: %s", ErrTrashNotFound, id)
+	}
+	return filepath.Join(t.dir, id+".json"), nil
+}
+
+func (t *trash) load(id string) (*TrashItem, error) {
+	path, err := t.path(id)
+	if err != nil {
+		return nil, err
+	}
+	var item TrashItem
+	if err := statefile.Read(path, &item); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrTrashNotFound, id)
+		}
+		return nil, fmt.Errorf("read trash item: %w", err)
+	}
+	return &item, nil
+}
+
+func (t *trash) save(item *TrashItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("marshal trash item: %w", err)
+	}
+	if err := statefile.Write(filepath.Join(t.dir, item.ID+".json"), data, statefile.PrivateMode); err != nil {
+		return fmt.Errorf("save trash item: %w", err)
+	}
+	return nil
+}
+
+func (t *trash) removeState(id string) {
+	path := filepath.Join(t.dir, id+".json")
+	os.Remove(path)
+	os.Remove(path + statefile.BackupSuffix)
+}
+
+func (t *trash) list() ([]*TrashItem, error) {
+	paths, err := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	items := []*TrashItem{}
+	for _, path := range paths {
+		item, err := t.load(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// prune purges expired items and forgets items whose data is gone
+func (t *trash) prune() {
+	items, err := t.list()
+	if err != nil {
+		log.Printf("warning: list trash: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, item := range items {
+		expired := !item.ExpiresAt.IsZero() && now.After(item.ExpiresAt)
+		if _, err := os.Lstat(item.TrashPath); !expired && !os.IsNotExist(err) {
+			continue
+		}
+		t.mu.Lock()
+		t.removeState(item.ID)
+		t.mu.Unlock()
+		if expired {
+			if err := os.RemoveAll(item.TrashPath); err != nil {
+				log.Printf("warning: purge expired trash item %s: %v", item.Path, err)
+			}
+		}
+	}
+}
+
+// treeSize returns the total size of the files below dir
+func treeSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func newTrashID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,343 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrDestinationExists is returned when a copy or move would replace
+// something without being asked to
+var ErrDestinationExists = errors.New("destination already exists")
+
+// TreeOptions controls recursive copies and moves
+type TreeOptions struct {
+	// Overwrite merges into an existing destination directory and replaces
+	// files that exist in both
+	Overwrite bool
+}
+
+// TransferProgress is how far a recursive copy or move has come
+type TransferProgress struct {
+	BytesDone      int64  `json:"bytes_done"`
+	BytesTotal     int64  `json:"bytes_total"`
+	FilesDone      int    `json:"files_done"`
+	FilesTotal     int    `json:"files_total"`
+	FilesRemaining int    `json:"files_remaining"`
+	Skipped        int    `json:"skipped,omitempty"`   // Devices, sockets and pipes, which are not copied
+	Reflinked      int    `json:"reflinked,omitempty"` // Files cloned sharing their blocks with the source
+	Current        string `json:"current,omitempty"`   // File being copied
+}
+
+// treeCopyBuffer is how much is copied between cancellation checks and
+// progress reports
+const treeCopyBuffer = 1 << 20
+
+// CopyTree copies src, a file or a directory with everything below it, to
+// dst. Permissions, ownership where the agent may set it, and modification
+// times are preserved, and symbolic links are copied as links. progress,
+// if not nil, is called as files are copied. If the copy fails or ctx is
+// canceled, a destination it created is removed again. Copies that would
+// take user or the destination over quota are rejected before they start.
+func (m *Manager) CopyTree(ctx context.Context, src, dst string, opts TreeOptions, user string, progress func(TransferProgress)) error {
+	src, dst, dstExists, err := m.checkTree(ctx, "copy", src, dst, opts, user)
+	if err != nil {
+		return err
+	}
+
+	admit := func(size int64) error {
+		return m.checkQuota(ctx, dst, user, size)
+	}
+	p, err := m.copyTree(ctx, src, dst, dstExists, admit, progress)
+	if err != nil {
+		m.logAudit(ctx, user, "copy", src, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dst, "recursive": true})
+		return err
+	}
+	m.chargeQuota(dst, user, p.BytesDone)
+	m.logAudit(ctx, user, "copy", src, "success", map[string]interface{}{"dst_path": dst, "recursive": true, "files": p.FilesDone, "bytes": p.BytesDone})
+	return nil
+}
+
+// MoveTree moves src to dst. Within a filesystem it is a rename; across
+// filesystems src is copied like CopyTree and removed once the copy is
+// complete, so a failed or canceled move leaves src as it was.
+func (m *Manager) MoveTree(ctx context.Context, src, dst string, opts TreeOptions, user string, progress func(TransferProgress)) error {
+	src, dst, dstExists, err := m.checkTree(ctx, "move", src, dst, opts, user)
+	if err != nil {
+		return err
+	}
+
+	if !dstExists {
+		err := os.Rename(src, dst)
+		if err == nil {
+			m.moveQuota(src, dst)
+			m.logAudit(ctx, user, "move", src, "success", map[string]interface{}{"dst_path": dst, "recursive": true})
+			return nil
+		}
+		if !errors.Is(err, syscall.EXDEV) {
+			m.logAudit(ctx, user, "move", src, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dst})
+			return fmt.Errorf("move: %w", err)
+		}
+	}
+
+	p, err := m.copyTree(ctx, src, dst, dstExists, nil, progress)
+	if err == nil {
+		if err = os.RemoveAll(src); err != nil {
+			err = fmt.Errorf("remove source: %w", err)
+		}
+	}
+	if err != nil {
+		m.logAudit(ctx, user, "move", src, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dst, "recursive": true})
+		return err
+	}
+	m.moveQuota(src, dst)
+	m.logAudit(ctx, user, "move", src, "success", map[string]interface{}{"dst_path": dst, "recursive": true, "files": p.FilesDone, "bytes": p.BytesDone})
+	return nil
+}
+
+// checkTree validates the paths of a copy or move and reports whether the
+// destination exists
+func (m *Manager) checkTree(ctx context.Context, action, src, dst string, opts TreeOptions, user string) (string, string, bool, error) {
+	fail := func(err error) (string, string, bool, error) {
+		m.logAudit(ctx, user, action, src, "failed", map[string]interface{}{"error": err.Error(), "dst_path": dst})
+		return "", "", false, err
+	}
+
+	if err := m.validator.ValidatePath(src); err != nil {
+		return fail(fmt.Errorf("invalid source path: %w", err))
+	}
+	if err := m.validator.ValidatePath(dst); err != nil {
+		return fail(fmt.Errorf("invalid destination path: %w", err))
+	}
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+
+	if _, err := os.Lstat(src); err != nil {
+		return fail(fmt.Errorf("stat source: %w", err))
+	}
+	if rel, err := filepath.Rel(src, dst); err == nil && !strings.HasPrefix(rel, "..") {
+		return fail(fmt.Errorf("destination is inside the source"))
+	}
+
+	dstExists := false
+	if _, err := os.Lstat(dst); err == nil {
+		if !opts.Overwrite {
+			return fail(fmt.Errorf("%w: %s", ErrDestinationExists, dst))
+		}
+		dstExists = true
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fail(fmt.Errorf("create directory: %w", err))
+	}
+	return src, dst, dstExists, nil
+}
+
+// treeEntry is a file or directory found below the source
+type treeEntry struct {
+	rel  string
+	info os.FileInfo
+}
+
+// copyTree copies src to dst and removes what it created if it fails.
+// admit, if not nil, may refuse the copy once its size is known.
+func (m *Manager) copyTree(ctx context.Context, src, dst string, dstExists bool, admit func(int64) error, progress func(TransferProgress)) (TransferProgress, error) {
+	var p TransferProgress
+	report := func() {
+		if progress != nil {
+			p.FilesRemaining = p.FilesTotal - p.FilesDone
+			progress(p)
+		}
+	}
+
+	// Count first so progress can be given as a share of the total
+	var entries []treeEntry
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		entries = append(entries, treeEntry{rel: rel, info: info})
+		if info.Mode().IsRegular() {
+			p.BytesTotal += info.Size()
+		}
+		if !info.IsDir() {
+			p.FilesTotal++
+		}
+		return nil
+	})
+	if err != nil {
+		return p, fmt.Errorf("scan source: %w", err)
+	}
+	if admit != nil {
+		if err := admit(p.BytesTotal); err != nil {
+			return p, err
+		}
+	}
+	report()
+
+	var dirs []treeEntry
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return p, m.undoTree(dst, dstExists, err)
+		}
+		from, to := filepath.Join(src, entry.rel), filepath.Join(dst, entry.rel)
+		mode := entry.info.Mode()
+
+		switch {
+		case mode.IsDir():
+			// Written to first, so permissions and times are set at the end
+			if err := os.MkdirAll(to, 0700); err != nil {
+				return p, m.undoTree(dst, dstExists, fmt.Errorf("create directory: %w", err))
+			}
+			dirs = append(dirs, entry)
+			continue
+		case mode.IsRegular():
+			p.Current = from
+			var cloned bool
+			cloned, err = copyTreeFile(ctx, from, to, entry.info, func(n int64) {
+				p.BytesDone += n
+				report()
+			})
+			if cloned {
+				p.Reflinked++
+			}
+		case mode&os.ModeSymlink != 0:
+			err = copyTreeLink(from, to, entry.info)
+		default:
+			p.Skipped++
+		}
+		if err != nil {
+			return p, m.undoTree(dst, dstExists, err)
+		}
+		p.FilesDone++
+		report()
+	}
+
+	// Deepest first, so setting a time is not undone by work below it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		applyMetadata(filepath.Join(dst, dirs[i].rel), dirs[i].info)
+	}
+	p.Current = ""
+	report()
+	return p, nil
+}
+
+// undoTree removes a destination the copy created and returns err
+func (m *Manager) undoTree(dst string, dstExists bool, err error) error {
+	if !dstExists {
+		os.RemoveAll(dst)
+	}
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("copy canceled: %w", err)
+	}
+	return err
+}
+
+// copyTreeFile copies the file from to to and reports whether it was
+// cloned with a reflink instead of copying its data
+func copyTreeFile(ctx context.Context, from, to string, info os.FileInfo, copied func(int64)) (bool, error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return false, fmt.Errorf("open source: %w", err)
+	}
+	defer in.Close()
+
+	// A link or other non-file in the way is replaced, not written through
+	if existing, err := os.Lstat(to); err == nil && !existing.Mode().IsRegular() {
+		if err := os.RemoveAll(to); err != nil {
+			return false, fmt.Errorf("replace destination: %w", err)
+		}
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, fmt.Errorf("create destination: %w", err)
+	}
+	defer out.Close()
+
+	if reflink(out, in) == nil {
+		copied(info.Size())
+		if err := out.Close(); err != nil {
+			return false, fmt.Errorf("close destination: %w", err)
+		}
+		applyMetadata(to, info)
+		return true, nil
+	}
+
+	var dst io.Writer = out
+	var sparse *sparseWriter
+	if isSparse(info) {
+		sparse = &sparseWriter{f: out}
+		dst = sparse
+	}
+	buf := make([]byte, treeCopyBuffer)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		n, readErr := in.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return false, fmt.Errorf("copy data: %w", err)
+			}
+			copied(int64(n))
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return false, fmt.Errorf("copy data: %w", readErr)
+		}
+	}
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			return false, fmt.Errorf("copy data: %w", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return false, fmt.Errorf("close destination: %w", err)
+	}
+	applyMetadata(to, info)
+	return false, nil
+}
+
+func copyTreeLink(from, to string, info os.FileInfo) error {
+	target, err := os.Readlink(from)
+	if err != nil {
+		return fmt.Errorf("read link: %w", err)
+	}
+	if _, err := os.Lstat(to); err == nil {
+		if err := os.RemoveAll(to); err != nil {
+			return fmt.Errorf("replace destination: %w", err)
+		}
+	}
+	if err := os.Symlink(target, to); err != nil {
+		return fmt.Errorf("create symlink: %w", err)
+	}
+	if owner, group, ok := getOwnerAndGroup(info); ok {
+		os.Lchown(to, int(owner), int(group))
+	}
+	return nil
+}
+
+// applyMetadata gives path the ownership, permissions and modification time
+// of info. Ownership is best effort, as only root may give files away.
+func applyMetadata(path string, info os.FileInfo) {
+	if owner, group, ok := getOwnerAndGroup(info); ok {
+		os.Lchown(path, int(owner), int(group))
+	}
+	// After chown, which clears setuid and setgid bits
+	os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,481 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// Errors of chunked uploads
+var (
+	ErrUploadNotFound       = errors.New("upload session not found")
+	ErrUploadBusy           = errors.New("upload session is busy with another request")
+	ErrUploadOffsetMismatch = errors.New("chunk offset does not match the bytes received")
+	ErrUploadIncomplete     = errors.New("upload is incomplete")
+	ErrUploadsDisabled      = errors.New("chunked uploads are not enabled")
+)
+
+// UploadSession is a chunked upload that survives dropped connections and
+// agent restarts. Chunks are appended to a hidden file next to the target,
+// so finishing the upload is a rename on the same filesystem.
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Received  int64     `json:"received"` // Offset of the next chunk
+	SHA256    string    `json:"sha256,omitempty"`
+	Sparse    bool      `json:"sparse,omitempty"` // Chunks write runs of zeros as holes
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// dataPath returns the file the chunks of the session are written to
+func (s *UploadSession) dataPath() string {
+	return filepath.Join(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".upload-"+s.ID)
+}
+
+// uploadSessions keeps the state of chunked uploads, one JSON file each
+type uploadSessions struct {
+	dir  string
+	ttl  time.Duration
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// SetUploadSessions enables chunked uploads with their state kept in dir.
+// Sessions that receive nothing for ttl are discarded with their data.
+func (m *Manager) SetUploadSessions(dir string, ttl time.Duration) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create upload session directory: %w", err)
+	}
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	m.uploads = &uploadSessions{
+		dir:  dir,
+		ttl:  ttl,
+		busy: make(map[string]bool),
+	}
+	m.uploads.prune()
+	return nil
+}
+
+// StartUpload starts a chunked upload of opts.Size bytes to opts.Path.
+// Directory policies and the maximum size are checked up front so a large
+// upload is not rejected after it has been sent.
+func (m *Manager) StartUpload(ctx context.Context, opts UploadOptions, user string) (*UploadSession, error) {
+	if m.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+	if err := m.validator.ValidatePath(opts.Path); err != nil {
+		m.logAudit(ctx, user, "upload.start", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	if opts.Size < 0 {
+		return nil, fmt.Errorf("size must not be negative")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	maxSize, err := m.uploadLimit(ctx, opts, user)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && opts.Size > maxSize {
+		policyErr := &PolicyError{
+			Code:    PolicyFileTooLarge,
+			Message: fmt.Sprintf("upload exceeds maximum size of %d bytes", maxSize),
+			Details: map[string]interface{}{"max_size": maxSize},
+		}
+		m.logAudit(ctx, user, "upload.start", opts.Path, "rejected", map[string]interface{}{"error": policyErr.Error()})
+		return nil, policyErr
+	}
+	if err := m.checkQuota(ctx, opts.Path, user, opts.Size); err != nil {
+		m.logAudit(ctx, user, "upload.start", opts.Path, "rejected", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+		m.logAudit(ctx, user, "upload.start", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+
+	m.uploads.prune()
+
+	now := time.Now()
+	session := &UploadSession{
+		ID:        newUploadID(),
+		Path:      opts.Path,
+		Size:      opts.Size,
+		SHA256:    strings.ToLower(opts.ExpectedSHA256),
+		Sparse:    opts.Sparse,
+		User:      user,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(m.uploads.ttl),
+	}
+	f, err := os.OpenFile(session.dataPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		m.logAudit(ctx, user, "upload.start", opts.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("create upload file: %w", err)
+	}
+	if opts.Preallocate {
+		if err := preallocateUpload(f, opts.Size); err != nil {
+			f.Close()
+			os.Remove(session.dataPath())
+			m.logAudit(ctx, user, "upload.start", opts.Path, "rejected", map[string]interface{}{"error": err.Error()})
+			return nil, err
+		}
+	}
+	f.Close()
+
+	if err := m.uploads.save(session); err != nil {
+		os.Remove(session.dataPath())
+		return nil, err
+	}
+
+	m.logAudit(ctx, user, "upload.start", opts.Path, "success", map[string]interface{}{"id": session.ID, "size": session.Size})
+	return session, nil
+}
+
+// UploadChunk writes a chunk at offset, which must be the number of bytes
+// received so far. A chunk cut off by a dropped connection is kept as far
+// as it arrived; the client asks for the session to learn where to resume.
+func (m *Manager) UploadChunk(ctx context.Context, id string, offset int64, reader io.Reader, user string) (*UploadSession, error) {
+	session, release, err := m.acquireUpload(id, user)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if offset != session.Received {
+		return session, fmt.Errorf("%w: expected offset %d", ErrUploadOffsetMismatch, session.Received)
+	}
+
+	f, err := os.OpenFile(session.dataPath(), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open upload file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek upload file: %w", err)
+	}
+
+	var dst io.Writer = f
+	var sparse *sparseWriter
+	if session.Sparse {
+		sparse = &sparseWriter{f: f, off: offset}
+		dst = sparse
+	}
+	written, copyErr := io.Copy(dst, io.LimitReader(reader, session.Size-offset))
+	if sparse != nil {
+		// Also after a dropped connection, so the file ends where the
+		// chunk did
+		if err := sparse.finish(); err != nil && copyErr == nil {
+			copyErr = err
+		}
+	}
+	if copyErr == nil {
+		// Anything left would run past the announced size
+		var extra [1]byte
+		if n, _ := io.ReadFull(reader, extra[:]); n > 0 {
+			copyErr = &PolicyError{
+				Code:    PolicyFileTooLarge,
+				Message: fmt.Sprintf("chunk runs past the upload size of %d bytes", session.Size),
+				Details: map[string]interface{}{"max_size": session.Size},
+			}
+		}
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = fmt.Errorf("close upload file: %w", err)
+	}
+
+	session.Received = offset + written
+	session.UpdatedAt = time.Now()
+	session.ExpiresAt = session.UpdatedAt.Add(m.uploads.ttl)
+	if err := m.uploads.save(session); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		var policyErr *PolicyError
+		if errors.As(copyErr, &policyErr) {
+			return session, copyErr
+		}
+		return session, fmt.Errorf("write chunk: %w", copyErr)
+	}
+	return session, nil
+}
+
+// FinalizeUpload verifies a complete upload against expectedSHA256, or the
+// checksum given when it started, and moves it to its path. An upload that
+// fails verification is discarded.
+func (m *Manager) FinalizeUpload(ctx context.Context, id, expectedSHA256, user string) (*UploadSession, error) {
+	session, release, err := m.acquireUpload(id, user)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if session.Received != session.Size {
+		return session, fmt.Errorf("%w: received %d of %d bytes", ErrUploadIncomplete, session.Received, session.Size)
+	}
+
+	actual, err := fileSHA256(session.dataPath())
+	if err != nil {
+		return nil, fmt.Errorf("compute hash: %w", err)
+	}
+	expected := strings.ToLower(expectedSHA256)
+	if expected == "" {
+		expected = session.SHA256
+	}
+	if expected != "" && expected != actual {
+		m.uploads.remove(session)
+		policyErr := &PolicyError{
+			Code:    PolicyChecksumMismatch,
+			Message: "uploaded content does not match expected SHA-256",
+			Details: map[string]interface{}{
+				"expected": expected,
+				"actual":   actual,
+			},
+		}
+		m.logAudit(ctx, user, "upload", session.Path, "rejected", map[string]interface{}{"error": policyErr.Error(), "actual_sha256": actual, "id": session.ID})
+		return nil, policyErr
+	}
+
+	// Other writes may have used up the quota since the upload started; the
+	// session is kept so it can be finalized once space is freed
+	if err := m.checkQuota(ctx, session.Path, user, session.Size); err != nil {
+		m.logAudit(ctx, user, "upload", session.Path, "rejected", map[string]interface{}{"error": err.Error(), "id": session.ID})
+		return session, err
+	}
+	// Uploads that couldn't be scanned are kept to be finalized again once
+	// the scanner is back; infected ones are already quarantined
+	scan, err := m.scanUpload(ctx, session.dataPath(), session.Path, user)
+	if err != nil {
+		m.logAudit(ctx, user, "upload", session.Path, scanFailure(err), map[string]interface{}{"error": err.Error(), "sha256": actual, "id": session.ID})
+		if scan != nil {
+			m.uploads.remove(session)
+			return nil, err
+		}
+		return session, err
+	}
+	if err := m.keepVersion(session.Path); err != nil {
+		m.logAudit(ctx, user, "upload", session.Path, "failed", map[string]interface{}{"error": err.Error(), "id": session.ID})
+		return session, err
+	}
+	if err := os.Rename(session.dataPath(), session.Path); err != nil {
+		m.logAudit(ctx, user, "upload", session.Path, "failed", map[string]interface{}{"error": err.Error(), "id": session.ID})
+		return nil, fmt.Errorf("rename file: %w", err)
+	}
+	m.uploads.remove(session)
+	m.chargeQuota(session.Path, user, session.Size)
+	m.recordScan(ctx, session.Path, scan)
+
+	session.SHA256 = actual
+	details := map[string]interface{}{"size": session.Size, "sha256": actual, "id": session.ID}
+	if scan != nil {
+		details["scan"] = scan
+	}
+	m.logAudit(ctx, user, "upload", session.Path, "success", details)
+	return session, nil
+}
+
+// AbortUpload discards an upload and what it received
+func (m *Manager) AbortUpload(ctx context.Context, id, user string) error {
+	session, release, err := m.acquireUpload(id, user)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	m.uploads.remove(session)
+	m.logAudit(ctx, user, "upload.abort", session.Path, "success", map[string]interface{}{"id": session.ID, "received": session.Received})
+	return nil
+}
+
+// GetUpload returns an upload session of user
+func (m *Manager) GetUpload(id, user string) (*UploadSession, error) {
+	if m.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+	session, err := m.uploads.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.User != user {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+	}
+	return session, nil
+}
+
+// ListUploads returns the unfinished uploads of user, newest first
+func (m *Manager) ListUploads(user string) ([]*UploadSession, error) {
+	if m.uploads == nil {
+		return nil, ErrUploadsDisabled
+	}
+	all, err := m.uploads.list()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*UploadSession{}
+	for _, session := range all {
+		if session.User == user {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// acquireUpload loads a session of user and keeps other requests from
+// changing it until release is called
+func (m *Manager) acquireUpload(id, user string) (*UploadSession, func(), error) {
+	session, err := m.GetUpload(id, user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := m.uploads
+	s.mu.Lock()
+	if s.busy[id] {
+		s.mu.Unlock()
+		return nil, nil, ErrUploadBusy
+	}
+	s.busy[id] = true
+	s.mu.Unlock()
+
+	release := func() {
+		s.mu.Lock()
+		delete(s.busy, id)
+		s.mu.Unlock()
+	}
+
+	// Reload now that no one else writes it, and trust the data file over
+	// the state if the agent stopped between writing and saving
+	session, err = s.load(id)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if info, err := os.Stat(session.dataPath()); err != nil {
+		release()
+		s.remove(session)
+		return nil, nil, fmt.Errorf("%w: %s has lost its data", ErrUploadNotFound, id)
+	} else if info.Size() < session.Received {
+		session.Received = info.Size()
+	}
+	return session, release, nil
+}
+
+func (s *uploadSessions) path(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *uploadSessions) load(id string) (*UploadSession, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	var session UploadSession
+	if err := statefile.Read(path, &session); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+		}
+		return nil, fmt.Errorf("read upload session: %w", err)
+	}
+	return &session, nil
+}
+
+func (s *uploadSessions) save(session *UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("marshal upload session: %w", err)
+	}
+	if err := statefile.Write(filepath.Join(s.dir, session.ID+".json"), data, statefile.PrivateMode); err != nil {
+		return fmt.Errorf("save upload session: %w", err)
+	}
+	return nil
+}
+
+// remove deletes a session with its data
+func (s *uploadSessions) remove(session *UploadSession) {
+	os.Remove(session.dataPath())
+	path := filepath.Join(s.dir, session.ID+".json")
+	os.Remove(path)
+	os.Remove(path + statefile.BackupSuffix)
+}
+
+func (s *uploadSessions) list() ([]*UploadSession, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*UploadSession{}
+	for _, path := range paths {
+		session, err := s.load(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// prune discards expired sessions that no request is using
+func (s *uploadSessions) prune() {
+	sessions, err := s.list()
+	if err != nil {
+		log.Printf("warning: list upload sessions: %v", err)
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range sessions {
+		if now.After(session.ExpiresAt) && !s.busy[session.ID] {
+			s.remove(session)
+		}
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newUploadID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
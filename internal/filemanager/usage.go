@@ -0,0 +1,154 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/cache"
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+)
+
+// MaxUsageDepth is the deepest level of subdirectories a usage report
+// breaks down; everything below is still counted in the totals
+const MaxUsageDepth = 10
+
+// DirUsage is the space a directory and everything below it takes
+type DirUsage struct {
+	Path     string      `json:"path"`
+	Name     string      `json:"name"`
+	Size     int64       `json:"size"`      // Apparent size of the files
+	DiskSize int64       `json:"disk_size"` // Space allocated on disk, counting hard links once
+	Files    int         `json:"files"`
+	Dirs     int         `json:"dirs"`              // Subdirectories at any depth
+	Errors   int         `json:"errors,omitempty"`  // Entries that could not be read
+	Ignored  int         `json:"ignored,omitempty"` // Entries left out by ignore rules, at any depth
+	Children []*DirUsage `json:"children,omitempty"`
+}
+
+// usageCounter keeps the state shared by one usage walk
+type usageCounter struct {
+	ctx    context.Context
+	hidden func(string) bool
+	ignore *ignore.Matcher
+	linked map[[2]uint64]bool
+}
+
+// SetIgnore leaves the files and directories m ignores out of usage
+// reports
+func (m *Manager) SetIgnore(matcher *ignore.Matcher) {
+	m.ignore = matcher
+}
+
+// SetUsageCache keeps usage reports for ttl, since walking a large tree
+// takes long. A TTL of 0 disables caching.
+func (m *Manager) SetUsageCache(ttl time.Duration) {
+	m.usage = cache.New[*DirUsage](ttl)
+}
+
+// Usage adds up the space taken below path, du style, and breaks it down
+// into subdirectories down to depth levels. Symbolic links are not
+// followed, and hidden directories like the trash are left out, as are the
+// files and directories ignored by SetIgnore. The result
+// may be cached and shared, so it must not be modified.
+func (m *Manager) Usage(ctx context.Context, path string, depth int, user string) (*DirUsage, error) {
+	if err := m.validator.ValidatePath(path); err != nil {
+		m.logAudit(ctx, user, "usage", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	if depth < 0 || depth > MaxUsageDepth {
+		return nil, fmt.Errorf("depth must be between 0 and %d", MaxUsageDepth)
+	}
+	path = filepath.Clean(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		m.logAudit(ctx, user, "usage", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("stat directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", path)
+	}
+
+	usage, err := m.usage.Get(ctx, path+"\x00"+strconv.Itoa(depth), func(ctx context.Context) (*DirUsage, error) {
+		counter := &usageCounter{ctx: ctx, hidden: m.validator.hidden, ignore: m.ignore, linked: make(map[[2]uint64]bool)}
+		return counter.walk(path, info, depth)
+	})
+	if err != nil {
+		m.logAudit(ctx, user, "usage", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("compute usage: %w", err)
+	}
+
+	m.logAudit(ctx, user, "usage", path, "success", map[string]interface{}{"depth": depth, "size": usage.Size})
+	return usage, nil
+}
+
+// walk adds up dir, keeping the usage of its subdirectories while depth
+// is above 0
+func (c *usageCounter) walk(dir string, info os.FileInfo, depth int) (*DirUsage, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	usage := &DirUsage{Path: dir, Name: info.Name()}
+	usage.DiskSize, _, _ = diskUsage(info)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		usage.Errors++
+		return usage, nil
+	}
+	for _, entry := range entries {
+		if c.hidden(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if c.ignore.Ignored(path, entry.IsDir()) {
+			usage.Ignored++
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			usage.Errors++
+			continue
+		}
+
+		if info.IsDir() {
+			child, err := c.walk(path, info, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			usage.Size += child.Size
+			usage.DiskSize += child.DiskSize
+			usage.Files += child.Files
+			usage.Dirs += child.Dirs + 1
+			usage.Errors += child.Errors
+			usage.Ignored += child.Ignored
+			if depth > 0 {
+				usage.Children = append(usage.Children, child)
+			}
+			continue
+		}
+
+		usage.Files++
+		disk, id, linked := diskUsage(info)
+		if linked {
+			if c.linked[id] {
+				continue
+			}
+			c.linked[id] = true
+		}
+		usage.Size += info.Size()
+		usage.DiskSize += disk
+	}
+
+	// Largest first, as a treemap lays them out
+	sort.Slice(usage.Children, func(i, j int) bool {
+		return usage.Children[i].DiskSize > usage.Children[j].DiskSize
+	})
+	return usage, nil
+}
@@ -1,13 +1,28 @@
 package filemanager
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
+// ErrSymlinkEscape is returned for paths that lead out of the allowed
+// directories through a symlink
+var ErrSymlinkEscape = errors.New("path leaves allowed directories through a symlink")
+
+// maxSymlinks bounds the symlinks followed resolving a path, as the kernel
+// does, so loops end
+const maxSymlinks = 40
+
 type PathValidator struct {
 	allowedPaths []string
+	hiddenNames  []string // Directories no path may go through, like the trash
+	followEscape bool     // Let symlinks lead out of the allowed directories
+	// mount is called with each valid path before its symlinks are
+	// checked, so shares mounted on demand are there to resolve
+	mount func(path string) error
 }
 
 func NewPathValidator(allowedPaths []string) *PathValidator {
@@ -39,23 +54,118 @@ func (v *PathValidator) ValidatePath(path string) error {
 		return fmt.Errorf("null byte in path")
 	}
 
-	allowed := false
+	if v.root(cleanPath) == "" {
+		return fmt.Errorf("path not in allowed directories")
+	}
+
+	for _, name := range strings.Split(cleanPath, string(filepath.Separator)) {
+		if v.hidden(name) {
+			return fmt.Errorf("path is reserved")
+		}
+	}
+
+	if v.mount != nil {
+		if err := v.mount(cleanPath); err != nil {
+			return err
+		}
+	}
+
+	return v.checkSymlinks(cleanPath)
+}
+
+// validateEntry is ValidatePath for operations on a directory entry itself
+// rather than what it points to, like deleting or renaming a symlink, so
+// symlinks leading out of the allowed directories can still be removed
+func (v *PathValidator) validateEntry(path string) error {
+	err := v.ValidatePath(path)
+	if errors.Is(err, ErrSymlinkEscape) {
+		return v.checkSymlinks(filepath.Dir(filepath.Clean(path)))
+	}
+	return err
+}
+
+// checkSymlinks refuses path if it resolves to a place outside the allowed
+// directories. Allowed directories that are symlinks themselves are
+// resolved too. Parts of path that don't exist yet are taken as they are,
+// except dangling symlinks, which writes would create the target of.
+func (v *PathValidator) checkSymlinks(path string) error {
+	if v.followEscape {
+		return nil
+	}
+	resolved, ok := resolvePath(path, 0)
+	if !ok {
+		return fmt.Errorf("%w: too many levels of symlinks", ErrSymlinkEscape)
+	}
+	for _, allowedPath := range v.allowedPaths {
+		root, _ := resolvePath(allowedPath, 0)
+		if rel, err := filepath.Rel(root, resolved); err == nil && !strings.HasPrefix(rel, "..") {
+			return nil
+		}
+	}
+	return ErrSymlinkEscape
+}
+
+// resolvePath returns path with its symlinks resolved, or false after
+// maxSymlinks of them
+func resolvePath(path string, depth int) (string, bool) {
+	if depth > maxSymlinks {
+		return "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved, true
+	}
+
+	dir, name := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if dir == path || name == "" {
+		return path, true
+	}
+	parent, ok := resolvePath(dir, depth)
+	if !ok {
+		return "", false
+	}
+	full := filepath.Join(parent, name)
+	target, err := os.Readlink(full)
+	if err != nil {
+		// Doesn't exist yet
+		return full, true
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(parent, target)
+	}
+	return resolvePath(filepath.Clean(target), depth+1)
+}
+
+// root returns the allowed directory containing path, the innermost one
+// if they are nested, or "" if none does
+func (v *PathValidator) root(path string) string {
+	root := ""
 	for _, allowedPath := range v.allowedPaths {
-		rel, err := filepath.Rel(allowedPath, cleanPath)
-		if err != nil {
+		rel, err := filepath.Rel(allowedPath, filepath.Clean(path))
+		if err != nil || strings.HasPrefix(rel, "..") {
 			continue
 		}
-		if !strings.HasPrefix(rel, "..") {
-			allowed = true
-			break
+		if len(allowedPath) > len(root) {
+			root = allowedPath
 		}
 	}
+	return root
+}
 
-	if !allowed {
-		return fmt.Errorf("path not in allowed directories")
+// hide keeps paths from going through directories named name
+func (v *PathValidator) hide(name string) {
+	if !v.hidden(name) {
+		v.hiddenNames = append(v.hiddenNames, name)
 	}
+}
 
-	return nil
+func (v *PathValidator) hidden(name string) bool {
+	for _, hidden := range v.hiddenNames {
+		if name == hidden {
+			return true
+		}
+	}
+	return false
 }
 
 func (v *PathValidator) ValidateName(name string) error {
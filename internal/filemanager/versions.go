@@ -0,0 +1,220 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VersionsDirName is the hidden directory previous versions of files are
+// kept in, at the top of each versioned directory. File APIs cannot reach
+// into it; the version APIs manage its contents.
+const VersionsDirName = ".versions"
+
+// versionIDFormat names versions by when they were replaced, so names
+// sort oldest first
+const versionIDFormat = "20060102T150405.000000000Z"
+
+// Errors of file versioning
+var (
+	ErrVersionNotFound    = errors.New("version not found")
+	ErrVersioningDisabled = errors.New("versioning is not enabled for this path")
+)
+
+// VersionDir keeps the last Keep versions of files below Path when uploads
+// and edits overwrite them
+type VersionDir struct {
+	Path string
+	Keep int
+}
+
+// FileVersion is a previous content of a file
+type FileVersion struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`    // When the content was written
+	ReplacedAt time.Time `json:"replaced_at"` // When it was overwritten
+}
+
+// versioning holds the versioned directories, innermost first
+type versioning struct {
+	dirs []VersionDir
+	mu   sync.Mutex
+}
+
+// SetVersioning keeps previous versions of the files in dirs when uploads
+// and edits overwrite them. Nested directories use their own setting.
+func (m *Manager) SetVersioning(dirs []VersionDir) {
+	v := &versioning{}
+	for _, dir := range dirs {
+		if dir.Keep > 0 {
+			v.dirs = append(v.dirs, VersionDir{Path: filepath.Clean(dir.Path), Keep: dir.Keep})
+		}
+	}
+	sort.Slice(v.dirs, func(i, j int) bool { return len(v.dirs[i].Path) > len(v.dirs[j].Path) })
+	m.versions = v
+	m.validator.hide(VersionsDirName)
+}
+
+// versionStore returns the directory versions of path are kept in and how
+// many, or "" if path is not versioned
+func (m *Manager) versionStore(path string) (string, int) {
+	if m.versions == nil {
+		return "", 0
+	}
+	path = filepath.Clean(path)
+	for _, dir := range m.versions.dirs {
+		rel, err := filepath.Rel(dir.Path, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		return filepath.Join(dir.Path, VersionsDirName, rel), dir.Keep
+	}
+	return "", 0
+}
+
+// keepVersion keeps the content of path as a version before it is
+// overwritten, dropping the oldest versions past the limit. Paths that
+// aren't versioned or don't hold a file yet are left alone.
+func (m *Manager) keepVersion(path string) error {
+	store, keep := m.versionStore(path)
+	if store == "" {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	m.versions.mu.Lock()
+	defer m.versions.mu.Unlock()
+
+	if err := os.MkdirAll(store, 0700); err != nil {
+		return fmt.Errorf("create version store: %w", err)
+	}
+	version := filepath.Join(store, time.Now().UTC().Format(versionIDFormat))
+	// The overwrite renames a new file into place, so a link keeps the old
+	// content without copying it
+	if err := os.Link(path, version); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("keep version: %w", err)
+		}
+		if _, err := copyTreeFile(context.Background(), path, version, info, func(int64) {}); err != nil {
+			os.Remove(version)
+			return fmt.Errorf("keep version: %w", err)
+		}
+	}
+
+	entries, err := os.ReadDir(store)
+	if err != nil {
+		return nil
+	}
+	for len(entries) > keep {
+		os.Remove(filepath.Join(store, entries[0].Name()))
+		entries = entries[1:]
+	}
+	return nil
+}
+
+// ListVersions returns the kept versions of path, newest first
+func (m *Manager) ListVersions(ctx context.Context, path, user string) ([]FileVersion, error) {
+	if err := m.validator.ValidatePath(path); err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	path = filepath.Clean(path)
+	store, _ := m.versionStore(path)
+	if store == "" {
+		return nil, ErrVersioningDisabled
+	}
+
+	entries, err := os.ReadDir(store)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read version store: %w", err)
+	}
+	versions := make([]FileVersion, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		if version, err := m.version(store, path, entries[i].Name()); err == nil {
+			versions = append(versions, *version)
+		}
+	}
+	return versions, nil
+}
+
+// version returns version id of path from its store
+func (m *Manager) version(store, path, id string) (*FileVersion, error) {
+	replaced, err := time.Parse(versionIDFormat, id)
+	if err != nil {
+		return nil, ErrVersionNotFound
+	}
+	info, err := os.Lstat(filepath.Join(store, id))
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, ErrVersionNotFound
+	}
+	return &FileVersion{
+		ID:         id,
+		Path:       path,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		ReplacedAt: replaced,
+	}, nil
+}
+
+// RestoreVersion makes version id the content of path again. The content
+// it replaces is kept as a version in turn, so a restore can be undone.
+func (m *Manager) RestoreVersion(ctx context.Context, path, id, user string) (*FileVersion, error) {
+	fail := func(err error) (*FileVersion, error) {
+		m.logAudit(ctx, user, "version.restore", path, "failed", map[string]interface{}{"error": err.Error(), "id": id})
+		return nil, err
+	}
+
+	if err := m.validator.ValidatePath(path); err != nil {
+		return fail(fmt.Errorf("invalid path: %w", err))
+	}
+	path = filepath.Clean(path)
+	store, _ := m.versionStore(path)
+	if store == "" {
+		return fail(ErrVersioningDisabled)
+	}
+	version, err := m.version(store, path, id)
+	if err != nil {
+		return fail(err)
+	}
+	if err := m.checkLock(path, ""); err != nil {
+		return fail(err)
+	}
+
+	src := filepath.Join(store, id)
+	info, err := os.Stat(src)
+	if err != nil {
+		return fail(ErrVersionNotFound)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fail(fmt.Errorf("create temp file: %w", err))
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := copyTreeFile(ctx, src, tmp.Name(), info, func(int64) {}); err != nil {
+		return fail(err)
+	}
+	// Restored content is new to sync clients comparing times
+	now := time.Now()
+	os.Chtimes(tmp.Name(), now, now)
+
+	if err := m.keepVersion(path); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fail(fmt.Errorf("replace file: %w", err))
+	}
+
+	m.logAudit(ctx, user, "version.restore", path, "success", map[string]interface{}{"id": id, "size": version.Size})
+	return version, nil
+}
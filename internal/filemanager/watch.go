@@ -0,0 +1,48 @@
+package filemanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
+)
+
+// SetWatcher lets clients watch directories for changes with w. Changes
+// are published on w's event bus.
+func (m *Manager) SetWatcher(w *watcher.Watcher) {
+	m.watcher = w
+}
+
+// Watch watches dir and everything below it until release is called.
+// Changes are published on the watcher's event bus as file events. It
+// returns watcher.ErrUnsupported when no watcher is set.
+func (m *Manager) Watch(ctx context.Context, dir, user string) (release func(), err error) {
+	if m.watcher == nil {
+		return nil, watcher.ErrUnsupported
+	}
+	if err := m.validator.ValidatePath(dir); err != nil {
+		m.logAudit(ctx, user, "watch", dir, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	dir = filepath.Clean(dir)
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		m.logAudit(ctx, user, "watch", dir, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("stat directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	release, err = m.watcher.Watch(dir)
+	if err != nil {
+		m.logAudit(ctx, user, "watch", dir, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+
+	m.logAudit(ctx, user, "watch", dir, "success", nil)
+	return release, nil
+}
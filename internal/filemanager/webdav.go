@@ -0,0 +1,416 @@
+package filemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV returns the allowed directories as the file system of a WebDAV
+// server acting for user. Each allowed directory is a folder at the root,
+// named after its last element. Writes get the checks of the file API:
+// uploads replace files only once complete and are held to locks, upload
+// policies, quotas and maxUploadSize (0 for unlimited), and deletes go to
+// the trash when it is enabled. Reads are not audited, as clients stat
+// every file of the folders they show.
+func (m *Manager) WebDAV(user string, maxUploadSize int64) webdav.FileSystem {
+	return &davFS{m: m, user: user, protocol: "webdav", maxSize: maxUploadSize, roots: m.davRoots()}
+}
+
+// SFTP returns the file system of WebDAV for the SFTP server, with its
+// changes audited as made over SFTP
+func (m *Manager) SFTP(user string, maxUploadSize int64) webdav.FileSystem {
+	return &davFS{m: m, user: user, protocol: "sftp", maxSize: maxUploadSize, roots: m.davRoots()}
+}
+
+type davFS struct {
+	m        *Manager
+	user     string
+	protocol string // Recorded in audit entries
+	maxSize  int64
+	roots    map[string]string // Allowed directories by folder name
+}
+
+// davRoots names the allowed directories, numbering those whose last
+// elements are the same
+func (m *Manager) davRoots() map[string]string {
+	roots := make(map[string]string)
+	for _, dir := range m.validator.allowedPaths {
+		base := filepath.Base(dir)
+		if base == string(filepath.Separator) {
+			base = "root"
+		}
+		name := base
+		for i := 2; roots[name] != ""; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		roots[name] = dir
+	}
+	return roots
+}
+
+// resolve maps a WebDAV name to a path. The root, which lists the allowed
+// directories, has no path; top-level folders return the name they are
+// listed under.
+func (fs *davFS) resolve(name string) (path, folder string, err error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "", "", nil
+	}
+	folder, rest, _ := strings.Cut(name, "/")
+	dir, ok := fs.roots[folder]
+	if !ok {
+		return "", "", os.ErrNotExist
+	}
+	if rest != "" {
+		folder = ""
+	}
+	return filepath.Join(dir, filepath.FromSlash(rest)), folder, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	path, folder, err := fs.resolve(name)
+	switch {
+	case err != nil:
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	case path == "" || folder != "":
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := fs.m.validator.ValidatePath(path); err != nil {
+		fs.m.logAudit(ctx, fs.user, "create_dir", path, "failed", map[string]interface{}{"error": err.Error(), "protocol": fs.protocol})
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+	}
+
+	// Parents are not created, so clients see 409 Conflict as WebDAV expects
+	if err := os.Mkdir(path, 0755); err != nil {
+		fs.m.logAudit(ctx, fs.user, "create_dir", path, "failed", map[string]interface{}{"error": err.Error(), "protocol": fs.protocol})
+		return err
+	}
+	fs.m.logAudit(ctx, fs.user, "create_dir", path, "success", map[string]interface{}{"protocol": fs.protocol})
+	return nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	path, folder, err := fs.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+	if path == "" {
+		if write {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return &davRoot{fs: fs}, nil
+	}
+	if err := fs.m.validator.ValidatePath(path); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+
+	if !write {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{File: f, fs: fs, path: path, folder: folder}, nil
+	}
+	// The WebDAV server only opens files for writing to replace them
+	if flag&os.O_TRUNC == 0 || folder != "" {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	upload, err := fs.m.openDAVUpload(ctx, path, fs.user, fs.protocol, fs.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	path, folder, err := fs.resolve(name)
+	switch {
+	case err != nil:
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	case path == "" || folder != "":
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return fs.m.Delete(ctx, path, fs.user)
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, oldFolder, err := fs.resolve(oldName)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+	newPath, newFolder, err := fs.resolve(newName)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: newName, Err: err}
+	}
+	if oldPath == "" || newPath == "" || oldFolder != "" || newFolder != "" {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrPermission}
+	}
+	return fs.m.Rename(ctx, oldPath, newPath, fs.user)
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	path, folder, err := fs.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if path == "" {
+		return davRootInfo{}, nil
+	}
+	if err := fs.m.validator.ValidatePath(path); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrPermission}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if folder != "" {
+		return davInfo{FileInfo: info, name: folder}, nil
+	}
+	return info, nil
+}
+
+// davFile is a file or directory opened for reading. Directory listings
+// leave out reserved directories and symlinks leading out of the allowed
+// directories, and show other symlinks as what they point to.
+type davFile struct {
+	*os.File
+	fs     *davFS
+	path   string
+	folder string // Name of a top-level folder
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if f.fs.m.validator.hidden(info.Name()) {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			path := filepath.Join(f.path, info.Name())
+			if f.fs.m.validator.checkSymlinks(path) != nil {
+				continue
+			}
+			target, statErr := os.Stat(path)
+			if statErr != nil {
+				continue
+			}
+			info = davInfo{FileInfo: target, name: info.Name()}
+		}
+		visible = append(visible, info)
+	}
+	return visible, err
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil || f.folder == "" {
+		return info, err
+	}
+	return davInfo{FileInfo: info, name: f.folder}, nil
+}
+
+// davUpload receives the content of a file in a temporary file next to it,
+// which replaces the file when closed after a complete upload. The file
+// isn't embedded, so copies can't bypass Write through its ReadFrom.
+type davUpload struct {
+	file     *os.File
+	m        *Manager
+	ctx      context.Context
+	path     string
+	user     string
+	protocol string
+	maxSize  int64
+	room     int64 // Left in the quota, -1 for unlimited
+	quota    *quota
+	written  int64
+	err      error
+}
+
+// openDAVUpload starts replacing path, after checking its lock and upload
+// policy
+func (m *Manager) openDAVUpload(ctx context.Context, path, user, protocol string, maxSize int64) (*davUpload, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: ErrIsDirectory}
+	}
+	if err := m.checkLock(path, ""); err != nil {
+		m.logAudit(ctx, user, "upload", path, "failed", map[string]interface{}{"error": err.Error(), "protocol": protocol})
+		return nil, err
+	}
+	maxSize, err := m.uploadLimit(ctx, UploadOptions{Path: path, MaxSize: maxSize}, user)
+	if err != nil {
+		return nil, err
+	}
+	room, quota, err := m.quotaRoom(ctx, path, user)
+	if err != nil {
+		m.logAudit(ctx, user, "upload", path, "failed", map[string]interface{}{"error": err.Error(), "protocol": protocol})
+		return nil, err
+	}
+
+	// Fails like the final file would if the directory is missing. Each
+	// upload gets its own temp file so concurrent PUTs don't share one.
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &davUpload{file: f, m: m, ctx: ctx, path: path, user: user, protocol: protocol, maxSize: maxSize, room: room, quota: quota}, nil
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	size := u.written + int64(len(p))
+	if u.maxSize > 0 && size > u.maxSize {
+		u.err = &PolicyError{
+			Code:    PolicyFileTooLarge,
+			Message: fmt.Sprintf("upload exceeds maximum size of %d bytes", u.maxSize),
+			Details: map[string]interface{}{"max_size": u.maxSize},
+		}
+		return 0, u.err
+	}
+	if u.room >= 0 && size > u.room {
+		u.err = quotaError(u.quota, size, u.room)
+		return 0, u.err
+	}
+
+	n, err := u.file.Write(p)
+	u.written += int64(n)
+	if err != nil {
+		u.err = err
+	}
+	return n, err
+}
+
+// Close replaces the file with the upload. The server closes uploads even
+// when the request body couldn't be read, but then the request context
+// has been canceled, so the file is kept.
+func (u *davUpload) Close() error {
+	temp := u.file.Name()
+	err := u.file.Close()
+	if u.err != nil {
+		err = u.err
+	} else if ctxErr := u.ctx.Err(); ctxErr != nil {
+		err = fmt.Errorf("upload interrupted: %w", ctxErr)
+	}
+	var scan *ScanResult
+	if err == nil {
+		scan, err = u.m.scanUpload(context.WithoutCancel(u.ctx), temp, u.path, u.user)
+	}
+	if err == nil {
+		err = u.m.keepVersion(u.path)
+	}
+	if err == nil {
+		err = os.Rename(temp, u.path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		result := "failed"
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			result = "rejected"
+		}
+		u.m.logAudit(context.WithoutCancel(u.ctx), u.user, "upload", u.path, result, map[string]interface{}{"error": err.Error(), "protocol": u.protocol})
+		return err
+	}
+	u.m.chargeQuota(u.path, u.user, u.written)
+	u.m.recordScan(u.ctx, u.path, scan)
+
+	details := map[string]interface{}{"size": u.written, "protocol": u.protocol}
+	if scan != nil {
+		details["scan"] = scan
+	}
+	u.m.logAudit(u.ctx, u.user, "upload", u.path, "success", details)
+	return nil
+}
+
+func (u *davUpload) Read(p []byte) (int, error) {
+	return u.file.Read(p)
+}
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return u.file.Seek(offset, whence)
+}
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	return u.file.Stat()
+}
+
+func (u *davUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: u.path, Err: os.ErrInvalid}
+}
+
+// davRoot is the root folder, listing the allowed directories
+type davRoot struct {
+	fs   *davFS
+	done bool
+}
+
+func (r *davRoot) Readdir(count int) ([]os.FileInfo, error) {
+	if r.done && count > 0 {
+		return nil, io.EOF
+	}
+	r.done = true
+
+	names := make([]string, 0, len(r.fs.roots))
+	for name := range r.fs.roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var infos []os.FileInfo
+	for _, name := range names {
+		// Allowed directories that don't exist yet are left out
+		if info, err := os.Stat(r.fs.roots[name]); err == nil && info.IsDir() {
+			infos = append(infos, davInfo{FileInfo: info, name: name})
+		}
+	}
+	return infos, nil
+}
+
+func (r *davRoot) Stat() (os.FileInfo, error) { return davRootInfo{}, nil }
+func (r *davRoot) Close() error               { return nil }
+
+func (r *davRoot) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: "/", Err: ErrIsDirectory}
+}
+
+func (r *davRoot) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (r *davRoot) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "/", Err: os.ErrPermission}
+}
+
+// davInfo is a FileInfo under another name
+type davInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i davInfo) Name() string { return i.name }
+
+// davRootInfo describes the root folder
+type davRootInfo struct{}
+
+func (davRootInfo) Name() string       { return "/" }
+func (davRootInfo) Size() int64        { return 0 }
+func (davRootInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (davRootInfo) ModTime() time.Time { return time.Time{} }
+func (davRootInfo) IsDir() bool        { return true }
+func (davRootInfo) Sys() interface{}   { return nil }
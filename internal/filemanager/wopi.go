@@ -0,0 +1,391 @@
+package filemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WOPI lets office suites on the LAN, such as Collabora Online and
+// ONLYOFFICE, open and save files on the agent. A user of the API is
+// issued an access token for one file; the suite then reads, locks and
+// writes that file with the token alone.
+const (
+	WOPISession         = "wopi" // Session of the file locks WOPI clients hold
+	WOPILockTTL         = 30 * time.Minute
+	DefaultWOPITokenTTL = 10 * time.Hour
+	MaxWOPILockLength   = 1024
+)
+
+// Errors of WOPI requests
+var (
+	ErrWOPIToken    = errors.New("invalid or expired wopi access token")
+	ErrWOPIReadOnly = errors.New("wopi access token is read-only")
+	ErrWOPILock     = errors.New("invalid wopi lock")
+)
+
+// WOPIAccess is an access token for editing a file through WOPI, to be
+// passed to the office suite with the file's ID
+type WOPIAccess struct {
+	FileID         string `json:"file_id"`
+	Path           string `json:"path"`
+	AccessToken    string `json:"access_token"`
+	AccessTokenTTL int64  `json:"access_token_ttl"` // Expiry in milliseconds since the epoch, as WOPI clients expect
+	ReadOnly       bool   `json:"read_only"`
+}
+
+// WOPIGrant is what an access token allows: access to one file for the
+// user it was issued to
+type WOPIGrant struct {
+	FileID   string
+	Path     string
+	User     string
+	ReadOnly bool
+	expires  time.Time
+}
+
+// WOPIFileInfo is the response to CheckFileInfo, named as WOPI has it
+type WOPIFileInfo struct {
+	BaseFileName               string `json:"BaseFileName"`
+	OwnerID                    string `json:"OwnerId"`
+	Size                       int64  `json:"Size"`
+	UserID                     string `json:"UserId"`
+	UserFriendlyName           string `json:"UserFriendlyName"`
+	Version                    string `json:"Version"`
+	LastModifiedTime           string `json:"LastModifiedTime"`
+	ReadOnly                   bool   `json:"ReadOnly"`
+	UserCanWrite               bool   `json:"UserCanWrite"`
+	UserCanNotWriteRelative    bool   `json:"UserCanNotWriteRelative"`
+	SupportsLocks              bool   `json:"SupportsLocks"`
+	SupportsGetLock            bool   `json:"SupportsGetLock"`
+	SupportsExtendedLockLength bool   `json:"SupportsExtendedLockLength"`
+	SupportsUpdate             bool   `json:"SupportsUpdate"`
+}
+
+// WOPILockError is returned when a WOPI lock request or save does not
+// match the lock on the file. Lock is the current WOPI lock, empty if the
+// file is unlocked or locked through the file API.
+type WOPILockError struct {
+	Lock   string
+	Reason string
+}
+
+func (e *WOPILockError) Error() string {
+	return "lock mismatch: " + e.Reason
+}
+
+func (e *WOPILockError) Unwrap() error {
+	return ErrLocked
+}
+
+// wopiTokens holds the issued access tokens by their SHA-256, so a memory
+// dump does not reveal them. Tokens do not survive a restart; editors
+// then ask the user to reopen the file.
+type wopiTokens struct {
+	mu     sync.Mutex
+	grants map[string]*WOPIGrant
+}
+
+func newWOPITokens() *wopiTokens {
+	return &wopiTokens{grants: make(map[string]*WOPIGrant)}
+}
+
+func hashWOPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// WOPIFileID returns the WOPI file ID of path. IDs are stable, so every
+// user editing a file joins the same editing session, and do not reveal
+// the path.
+func WOPIFileID(path string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(path)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// WOPIVersion returns the version WOPI clients are told a file has, which
+// changes whenever it is written
+func WOPIVersion(modTime time.Time, size int64) string {
+	return strconv.FormatInt(modTime.UnixNano(), 36) + "-" + strconv.FormatInt(size, 36)
+}
+
+// WOPIToken issues user an access token for the file at path, valid for
+// ttl, DefaultWOPITokenTTL if 0. Read-only tokens can't lock or save.
+func (m *Manager) WOPIToken(ctx context.Context, path string, readOnly bool, ttl time.Duration, user string) (*WOPIAccess, error) {
+	if err := m.validator.ValidatePath(path); err != nil {
+		m.logAudit(ctx, user, "wopi_token", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		m.logAudit(ctx, user, "wopi_token", path, "failed", map[string]interface{}{"error": err.Error()})
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+	if ttl <= 0 {
+		ttl = DefaultWOPITokenTTL
+	}
+
+	token := newUploadID() + newUploadID()
+	grant := &WOPIGrant{
+		FileID:   WOPIFileID(path),
+		Path:     path,
+		User:     user,
+		ReadOnly: readOnly,
+		expires:  time.Now().Add(ttl),
+	}
+
+	t := m.wopi
+	t.mu.Lock()
+	now := time.Now()
+	for hash, g := range t.grants {
+		if !now.Before(g.expires) {
+			delete(t.grants, hash)
+		}
+	}
+	t.grants[hashWOPIToken(token)] = grant
+	t.mu.Unlock()
+
+	m.logAudit(ctx, user, "wopi_token", path, "success", map[string]interface{}{"read_only": readOnly, "expires_at": grant.expires})
+	return &WOPIAccess{
+		FileID:         grant.FileID,
+		Path:           path,
+		AccessToken:    token,
+		AccessTokenTTL: grant.expires.UnixMilli(),
+		ReadOnly:       readOnly,
+	}, nil
+}
+
+// WOPIAuthorize returns the grant of token if it is valid for the file
+// with fileID
+func (m *Manager) WOPIAuthorize(fileID, token string) (*WOPIGrant, error) {
+	t := m.wopi
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	grant, ok := t.grants[hashWOPIToken(token)]
+	if !ok || grant.FileID != fileID || !time.Now().Before(grant.expires) {
+		return nil, ErrWOPIToken
+	}
+	return grant, nil
+}
+
+// WOPICheckFileInfo describes the file of grant to the WOPI client
+func (m *Manager) WOPICheckFileInfo(grant *WOPIGrant) (*WOPIFileInfo, error) {
+	info, err := os.Stat(grant.Path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+
+	owner := ""
+	if uid, _, ok := getOwnerAndGroup(info); ok {
+		owner = strconv.FormatUint(uint64(uid), 10)
+	}
+	return &WOPIFileInfo{
+		BaseFileName:               filepath.Base(grant.Path),
+		OwnerID:                    owner,
+		Size:                       info.Size(),
+		UserID:                     grant.User,
+		UserFriendlyName:           grant.User,
+		Version:                    WOPIVersion(info.ModTime(), info.Size()),
+		LastModifiedTime:           info.ModTime().UTC().Format(time.RFC3339Nano),
+		ReadOnly:                   grant.ReadOnly,
+		UserCanWrite:               !grant.ReadOnly,
+		UserCanNotWriteRelative:    true,
+		SupportsLocks:              true,
+		SupportsGetLock:            true,
+		SupportsExtendedLockLength: true,
+		SupportsUpdate:             true,
+	}, nil
+}
+
+// WOPILock locks the file of grant with lock for WOPILockTTL, or extends
+// the lock if it already has it. With oldLock set, the file must have
+// that lock, which is replaced by lock.
+func (m *Manager) WOPILock(ctx context.Context, grant *WOPIGrant, lock, oldLock string) error {
+	if grant.ReadOnly {
+		return ErrWOPIReadOnly
+	}
+	if lock == "" || len(lock) > MaxWOPILockLength {
+		return ErrWOPILock
+	}
+
+	t := m.locks
+	t.mu.Lock()
+	now := time.Now()
+	t.expire(now)
+	held := t.byPath[grant.Path]
+	var err error
+	switch {
+	case oldLock != "":
+		if !isWOPILock(held, oldLock) {
+			err = wopiLockError(held)
+			break
+		}
+		if other, ok := t.byID[lock]; ok && other != held {
+			err = wopiLockError(held)
+			break
+		}
+		delete(t.byID, held.ID)
+		held.ID = lock
+		held.ExpiresAt = now.Add(WOPILockTTL)
+		t.byID[lock] = held
+	case held == nil:
+		if _, ok := t.byID[lock]; ok {
+			// Lock IDs must be unique across files
+			err = &WOPILockError{Reason: "lock is in use on another file"}
+			break
+		}
+		t.put(&FileLock{
+			ID:         lock,
+			Path:       grant.Path,
+			Owner:      grant.User,
+			Session:    WOPISession,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(WOPILockTTL),
+		})
+	case isWOPILock(held, lock):
+		held.ExpiresAt = now.Add(WOPILockTTL)
+	default:
+		err = wopiLockError(held)
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		m.logAudit(ctx, grant.User, "wopi_lock", grant.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	m.logAudit(ctx, grant.User, "wopi_lock", grant.Path, "success", nil)
+	return nil
+}
+
+// WOPIRefreshLock extends lock on the file of grant for WOPILockTTL
+func (m *Manager) WOPIRefreshLock(grant *WOPIGrant, lock string) error {
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(time.Now())
+	held := t.byPath[grant.Path]
+	if !isWOPILock(held, lock) {
+		return wopiLockError(held)
+	}
+	held.ExpiresAt = time.Now().Add(WOPILockTTL)
+	return nil
+}
+
+// WOPIUnlock releases lock on the file of grant
+func (m *Manager) WOPIUnlock(ctx context.Context, grant *WOPIGrant, lock string) error {
+	t := m.locks
+	t.mu.Lock()
+	t.expire(time.Now())
+	held := t.byPath[grant.Path]
+	var err error
+	if isWOPILock(held, lock) {
+		delete(t.byID, held.ID)
+		delete(t.byPath, held.Path)
+	} else {
+		err = wopiLockError(held)
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		m.logAudit(ctx, grant.User, "wopi_unlock", grant.Path, "failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	m.logAudit(ctx, grant.User, "wopi_unlock", grant.Path, "success", nil)
+	return nil
+}
+
+// WOPIGetLock returns the WOPI lock on the file of grant, empty if it has
+// none
+func (m *Manager) WOPIGetLock(grant *WOPIGrant) string {
+	t := m.locks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(time.Now())
+	if held := t.byPath[grant.Path]; held != nil && held.Session == WOPISession {
+		return held.ID
+	}
+	return ""
+}
+
+// WOPIPut replaces the file of grant with the content of reader, limited
+// to maxSize bytes if not 0, and returns its new version. A locked file
+// can only be written with its lock; an unlocked one only while empty, so
+// a client that lost its lock can't overwrite changes saved meanwhile.
+func (m *Manager) WOPIPut(ctx context.Context, grant *WOPIGrant, reader io.Reader, lock string, maxSize int64) (string, error) {
+	if grant.ReadOnly {
+		return "", ErrWOPIReadOnly
+	}
+
+	t := m.locks
+	t.mu.Lock()
+	t.expire(time.Now())
+	held := t.byPath[grant.Path]
+	var lockErr error
+	if held != nil && !isWOPILock(held, lock) {
+		lockErr = wopiLockError(held)
+	}
+	t.mu.Unlock()
+	if lockErr != nil {
+		return "", lockErr
+	}
+	if held == nil {
+		info, err := os.Stat(grant.Path)
+		if err != nil {
+			return "", err
+		}
+		if info.Size() > 0 {
+			return "", &WOPILockError{Reason: "file is not locked"}
+		}
+	}
+
+	// Upload checks the lock again as it writes
+	err := m.Upload(ctx, reader, UploadOptions{Path: grant.Path, MaxSize: maxSize, LockID: lock}, grant.User)
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return "", &WOPILockError{Reason: "file was locked meanwhile"}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(grant.Path)
+	if err != nil {
+		return "", err
+	}
+	return WOPIVersion(info.ModTime(), info.Size()), nil
+}
+
+// isWOPILock reports whether held is the WOPI lock with id lock
+func isWOPILock(held *FileLock, lock string) bool {
+	return held != nil && held.Session == WOPISession && lock != "" && held.ID == lock
+}
+
+// wopiLockError describes the lock held on a file to a WOPI client, which
+// is only told the ID of locks other WOPI clients hold
+func wopiLockError(held *FileLock) error {
+	switch {
+	case held == nil:
+		return &WOPILockError{Reason: "file is not locked"}
+	case held.Session == WOPISession:
+		return &WOPILockError{Lock: held.ID, Reason: "file is locked by another editing session"}
+	}
+	return &WOPILockError{Reason: fmt.Sprintf("file is locked by %s", held.Owner)}
+}
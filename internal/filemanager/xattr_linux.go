@@ -0,0 +1,57 @@
+//go:build linux
+
+package filemanager
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns the extended attributes of path that the agent may
+// read. Filesystems without them yield none.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		value, err := getXattr(path, name)
+		if err != nil {
+			// Namespaces like trusted are only readable by root
+			continue
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+func getXattr(path, name string) (string, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, name, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+func setXattr(path, name, value string) error {
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
+
+func removeXattr(path, name string) error {
+	return unix.Lremovexattr(path, name)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package filemanager
+
+import (
+	"errors"
+)
+
+// errXattrUnsupported is returned when changing extended attributes where
+// the agent does not implement them
+var errXattrUnsupported = errors.New("extended attributes are not supported on this system")
+
+func listXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setXattr(path, name, value string) error {
+	return errXattrUnsupported
+}
+
+func removeXattr(path, name string) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,188 @@
+// Package ftpd is a small FTP server for devices that can only deliver
+// files over FTP, like network cameras and scanners. It accepts uploads into
+// a single drop directory for one set of credentials. Downloads, deletes and
+// renames are not supported, so a leaked device password can't be used to
+// read or destroy what was dropped. Explicit FTPS (AUTH TLS) is offered when
+// a certificate is configured.
+package ftpd
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+const (
+	// maxSessions bounds concurrent control connections
+	maxSessions = 16
+	// idleTimeout closes control connections without commands
+	idleTimeout = 5 * time.Minute
+	// dataTimeout bounds waiting for a data connection and stalled transfers
+	dataTimeout = 30 * time.Second
+	// maxLoginFailures closes a connection after repeated wrong passwords
+	maxLoginFailures = 3
+)
+
+// Config configures the FTP server
+type Config struct {
+	Addr        string // host:port to listen on
+	Root        string // Drop directory; created if missing
+	Username    string
+	Password    string
+	PassiveMin  int    // Passive data ports; any free port if 0
+	PassiveMax  int    //
+	PublicHost  string // IPv4 address announced for passive mode, if behind NAT
+	TLS         *tls.Config
+	RequireTLS  bool  // Refuse logins before AUTH TLS
+	MaxFileSize int64 // 0 for unlimited
+	Audit       *audit.Logger
+}
+
+// Server accepts FTP connections
+type Server struct {
+	cfg      Config
+	root     string
+	listener net.Listener
+	sessions map[*session]struct{}
+	closed   bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// New creates a server for cfg, creating the drop directory
+func New(cfg Config) (*Server, error) {
+	if cfg.Username == "" || cfg.Password == "" {
+		return nil, errors.New("username and password are required")
+	}
+	if cfg.RequireTLS && cfg.TLS == nil {
+		return nil, errors.New("TLS is required but no certificate is configured")
+	}
+	if cfg.PassiveMin > cfg.PassiveMax || cfg.PassiveMin < 0 {
+		return nil, fmt.Errorf("invalid passive port range %d-%d", cfg.PassiveMin, cfg.PassiveMax)
+	}
+	if err := os.MkdirAll(cfg.Root, 0755); err != nil {
+		return nil, fmt.Errorf("create drop directory: %w", err)
+	}
+	// Resolve the root once so symlink checks compare real paths
+	root, err := filepath.EvalSymlinks(cfg.Root)
+	if err != nil {
+		return nil, fmt.Errorf("resolve drop directory: %w", err)
+	}
+
+	return &Server{
+		cfg:      cfg,
+		root:     root,
+		sessions: make(map[*session]struct{}),
+	}, nil
+}
+
+// Listen binds the control port. It is separate from Serve so startup
+// errors can be reported synchronously.
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", s.cfg.Addr, err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	return nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until Close is called
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		sess := newSession(s, conn)
+		s.mu.Lock()
+		if len(s.sessions) >= maxSessions {
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "421 Too many connections\r\n")
+			conn.Close()
+			continue
+		}
+		s.sessions[sess] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			sess.serve()
+			s.mu.Lock()
+			delete(s.sessions, sess)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and ends open sessions
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for sess := range s.sessions {
+		sess.close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// checkLogin compares credentials in constant time
+func (s *Server) checkLogin(username, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.cfg.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password)) == 1
+	return userOK && passOK
+}
+
+func (s *Server) logAudit(user, action, resource, result, sourceIP string, details map[string]interface{}) {
+	if s.cfg.Audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    action,
+		Resource:  resource,
+		Result:    result,
+		SourceIP:  sourceIP,
+		Details:   details,
+	}
+	if err := s.cfg.Audit.Log(context.Background(), entry); err != nil {
+		log.Printf("warning: audit ftp %s: %v", action, err)
+	}
+}
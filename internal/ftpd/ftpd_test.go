@@ -0,0 +1,143 @@
+package ftpd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func startServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.Addr = "127.0.0.1:0"
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+type client struct {
+	t    *testing.T
+	conn *textproto.Conn
+}
+
+func dial(t *testing.T, server *Server) *client {
+	t.Helper()
+	conn, err := textproto.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &client{t: t, conn: conn}
+	c.expect(220)
+	return c
+}
+
+func (c *client) cmd(expected int, format string, args ...interface{}) string {
+	c.t.Helper()
+	if _, err := c.conn.Cmd(format, args...); err != nil {
+		c.t.Fatalf("send %s: %v", format, err)
+	}
+	return c.expect(expected)
+}
+
+func (c *client) expect(expected int) string {
+	c.t.Helper()
+	code, message, err := c.conn.ReadResponse(0)
+	if code != expected {
+		c.t.Fatalf("expected %d, got %d %s (%v)", expected, code, message, err)
+	}
+	return message
+}
+
+// store uploads data to name in passive mode
+func (c *client) store(name, data string) int {
+	c.t.Helper()
+	message := c.cmd(229, "EPSV")
+	var port int
+	if _, err := fmt.Sscanf(message[strings.Index(message, "|||"):], "|||%d|)", &port); err != nil {
+		c.t.Fatalf("parse EPSV reply %q: %v", message, err)
+	}
+	dataConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		c.t.Fatalf("dial data connection: %v", err)
+	}
+	c.cmd(150, "STOR %s", name)
+	io.WriteString(dataConn, data)
+	dataConn.Close()
+	code, _, _ := c.conn.ReadResponse(0)
+	return code
+}
+
+func TestUploadIntoDropDirectory(t *testing.T) {
+	root := t.TempDir()
+	server := startServer(t, Config{Root: root, Username: "scanner", Password: "secret", MaxFileSize: 16})
+
+	c := dial(t, server)
+	c.cmd(530, "STOR early.pdf")
+	c.cmd(331, "USER scanner")
+	c.cmd(230, "PASS secret")
+	c.cmd(257, "MKD scans")
+	c.cmd(250, "CWD scans")
+
+	if code := c.store("page1.pdf", "scanned page"); code != 226 {
+		t.Fatalf("expected the upload to complete, got %d", code)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "scans", "page1.pdf")); err != nil || string(data) != "scanned page" {
+		t.Fatalf("expected the upload in the drop directory, got %q (%v)", data, err)
+	}
+
+	// Paths are confined to the drop directory
+	if code := c.store("../../escape.txt", "x"); code != 226 {
+		t.Fatalf("expected the upload to complete, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatalf("expected ../.. to stop at the drop directory: %v", err)
+	}
+
+	if code := c.store("big.bin", strings.Repeat("x", 32)); code != 552 {
+		t.Fatalf("expected an oversized upload to be refused, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "scans", "big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected the oversized upload to be removed: %v", err)
+	}
+
+	c.cmd(550, "RETR page1.pdf")
+	c.cmd(550, "DELE page1.pdf")
+	c.cmd(213, "SIZE page1.pdf")
+	c.cmd(221, "QUIT")
+}
+
+func TestLoginFailures(t *testing.T) {
+	server := startServer(t, Config{Root: t.TempDir(), Username: "camera", Password: "secret"})
+
+	c := dial(t, server)
+	c.cmd(331, "USER camera")
+	c.cmd(530, "PASS wrong")
+	c.cmd(530, "CWD /")
+
+	if _, err := New(Config{Root: t.TempDir(), Username: "camera", Password: "secret", RequireTLS: true}); err == nil {
+		t.Fatalf("expected RequireTLS without a certificate to be rejected")
+	}
+}
+
+func TestRejectsForeignActiveAddress(t *testing.T) {
+	server := startServer(t, Config{Root: t.TempDir(), Username: "camera", Password: "secret"})
+
+	c := dial(t, server)
+	c.cmd(331, "USER camera")
+	c.cmd(230, "PASS secret")
+	c.cmd(501, "PORT 10,0,0,9,200,10")
+	c.cmd(501, "EPRT |1|10.0.0.9|51210|")
+	c.cmd(200, "EPRT |1|127.0.0.1|51210|")
+}
@@ -0,0 +1,641 @@
+package ftpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// session is one control connection
+type session struct {
+	server   *Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	remoteIP net.IP
+	sourceIP string
+
+	user     string // Name given with USER
+	loggedIn bool
+	failures int
+	tls      bool // Control connection is encrypted
+	protect  bool // PROT P: data connections are encrypted
+	cwd      string
+
+	passive net.Listener
+	active  string // Address from PORT or EPRT
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	sess := &session{
+		server:   server,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		sourceIP: conn.RemoteAddr().String(),
+		cwd:      "/",
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		sess.remoteIP = addr.IP
+		sess.sourceIP = addr.IP.String()
+	}
+	return sess
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.conn.Close()
+	s.closePassive()
+}
+
+func (s *session) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+func (s *session) reply(code int, message string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, message)
+}
+
+func (s *session) serve() {
+	defer s.close()
+	s.reply(220, "mingyue-agent FTP ready")
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if len(line) > 4096 {
+			s.reply(500, "Line too long")
+			return
+		}
+
+		command, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if quit := s.handle(strings.ToUpper(command), arg); quit {
+			return
+		}
+	}
+}
+
+// handle runs one command and reports whether the session should end
+func (s *session) handle(command, arg string) bool {
+	switch command {
+	case "QUIT":
+		s.reply(221, "Bye")
+		return true
+	case "NOOP":
+		s.reply(200, "OK")
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+	case "FEAT":
+		features := []string{"UTF8", "PASV", "EPSV", "SIZE", "MDTM"}
+		if s.server.cfg.TLS != nil {
+			features = append(features, "AUTH TLS", "PBSZ", "PROT")
+		}
+		fmt.Fprintf(s.conn, "211-Features:\r\n")
+		for _, feature := range features {
+			fmt.Fprintf(s.conn, " %s\r\n", feature)
+		}
+		s.reply(211, "End")
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			s.reply(200, "UTF8 enabled")
+		} else {
+			s.reply(501, "Option not supported")
+		}
+	case "AUTH":
+		return s.handleAuth(arg)
+	case "PBSZ":
+		if !s.tls {
+			s.reply(503, "Use AUTH TLS first")
+		} else {
+			s.reply(200, "PBSZ=0")
+		}
+	case "PROT":
+		s.handleProt(arg)
+	case "USER":
+		s.handleUser(arg)
+	case "PASS":
+		return s.handlePass(arg)
+	default:
+		if !s.loggedIn {
+			s.reply(530, "Not logged in")
+			return false
+		}
+		s.handleAuthenticated(command, arg)
+	}
+	return false
+}
+
+func (s *session) handleAuthenticated(command, arg string) {
+	switch command {
+	case "PWD", "XPWD":
+		s.reply(257, strconv.Quote(s.cwd)+" is the current directory")
+	case "CWD", "XCWD":
+		s.handleCwd(arg)
+	case "CDUP", "XCUP":
+		s.handleCwd("..")
+	case "TYPE":
+		// Transfers are always binary; ASCII mode is accepted for
+		// clients that insist on it
+		s.reply(200, "Type set")
+	case "MODE":
+		s.replyIf(strings.EqualFold(arg, "S"), 200, "Mode set", 504, "Only stream mode is supported")
+	case "STRU":
+		s.replyIf(strings.EqualFold(arg, "F"), 200, "Structure set", 504, "Only file structure is supported")
+	case "PASV":
+		s.handlePasv(false)
+	case "EPSV":
+		s.handlePasv(true)
+	case "PORT":
+		s.handlePort(arg, false)
+	case "EPRT":
+		s.handlePort(arg, true)
+	case "LIST", "NLST":
+		s.handleList(arg, command == "NLST")
+	case "STOR":
+		s.handleStore(arg, false)
+	case "APPE":
+		s.handleStore(arg, true)
+	case "MKD", "XMKD":
+		s.handleMkdir(arg)
+	case "SIZE", "MDTM":
+		s.handleStat(command, arg)
+	case "RETR", "DELE", "RMD", "XRMD", "RNFR", "RNTO", "SITE":
+		s.reply(550, "Not allowed on a drop directory")
+	default:
+		s.reply(502, "Command not implemented")
+	}
+}
+
+func (s *session) replyIf(ok bool, okCode int, okMessage string, failCode int, failMessage string) {
+	if ok {
+		s.reply(okCode, okMessage)
+	} else {
+		s.reply(failCode, failMessage)
+	}
+}
+
+func (s *session) handleAuth(arg string) bool {
+	if s.server.cfg.TLS == nil {
+		s.reply(502, "TLS is not configured")
+		return false
+	}
+	if s.tls {
+		s.reply(503, "Already using TLS")
+		return false
+	}
+	if !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "SSL") {
+		s.reply(504, "Unsupported security mechanism")
+		return false
+	}
+
+	s.reply(234, "Starting TLS")
+	conn := tls.Server(s.conn, s.server.cfg.TLS)
+	conn.SetDeadline(time.Now().Add(dataTimeout))
+	if err := conn.Handshake(); err != nil {
+		return true
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.reader = bufio.NewReader(conn)
+	s.tls = true
+	// A new login is required over the encrypted connection
+	s.user = ""
+	s.loggedIn = false
+	return false
+}
+
+func (s *session) handleProt(arg string) {
+	switch {
+	case !s.tls:
+		s.reply(503, "Use AUTH TLS first")
+	case strings.EqualFold(arg, "P"):
+		s.protect = true
+		s.reply(200, "Data connections are protected")
+	case strings.EqualFold(arg, "C"):
+		if s.server.cfg.RequireTLS {
+			s.reply(534, "Data connections must be protected")
+			return
+		}
+		s.protect = false
+		s.reply(200, "Data connections are clear")
+	default:
+		s.reply(504, "Unsupported protection level")
+	}
+}
+
+func (s *session) handleUser(arg string) {
+	if s.server.cfg.RequireTLS && !s.tls {
+		s.reply(530, "Use AUTH TLS first")
+		return
+	}
+	s.user = arg
+	s.loggedIn = false
+	s.reply(331, "Password required")
+}
+
+func (s *session) handlePass(arg string) bool {
+	if s.user == "" {
+		s.reply(503, "Send USER first")
+		return false
+	}
+	if s.server.checkLogin(s.user, arg) {
+		s.loggedIn = true
+		s.server.logAudit(s.user, "ftp.login", s.server.cfg.Root, "success", s.sourceIP, map[string]interface{}{"tls": s.tls})
+		s.reply(230, "Logged in")
+		return false
+	}
+
+	s.failures++
+	s.server.logAudit(s.user, "ftp.login", s.server.cfg.Root, "failed", s.sourceIP, map[string]interface{}{"tls": s.tls})
+	// Slow down guessing
+	time.Sleep(time.Second)
+	s.reply(530, "Login incorrect")
+	return s.failures >= maxLoginFailures
+}
+
+func (s *session) handleCwd(arg string) {
+	virtual := s.virtualPath(arg)
+	local, err := s.resolve(virtual)
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	if info, err := os.Stat(local); err != nil || !info.IsDir() {
+		s.reply(550, "No such directory")
+		return
+	}
+	s.cwd = virtual
+	s.reply(250, "Directory changed to "+virtual)
+}
+
+func (s *session) handleMkdir(arg string) {
+	virtual := s.virtualPath(arg)
+	local, err := s.resolve(virtual)
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	if err := os.Mkdir(local, 0755); err != nil {
+		s.server.logAudit(s.user, "ftp.mkdir", local, "failed", s.sourceIP, map[string]interface{}{"error": err.Error()})
+		s.reply(550, "Cannot create directory")
+		return
+	}
+	s.server.logAudit(s.user, "ftp.mkdir", local, "success", s.sourceIP, nil)
+	s.reply(257, strconv.Quote(virtual)+" created")
+}
+
+func (s *session) handleStat(command, arg string) {
+	local, err := s.resolve(s.virtualPath(arg))
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	info, err := os.Stat(local)
+	if err != nil || info.IsDir() {
+		s.reply(550, "No such file")
+		return
+	}
+	if command == "SIZE" {
+		s.reply(213, strconv.FormatInt(info.Size(), 10))
+	} else {
+		s.reply(213, info.ModTime().UTC().Format("20060102150405"))
+	}
+}
+
+// virtualPath resolves arg against the current directory. Virtual paths
+// are rooted at the drop directory and can't climb out of it.
+func (s *session) virtualPath(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join(s.cwd, arg)
+	}
+	return path.Clean("/" + arg)
+}
+
+// resolve maps a virtual path to a local one, refusing paths whose
+// existing parent directories lead out of the drop directory through
+// symlinks
+func (s *session) resolve(virtual string) (string, error) {
+	local := filepath.Join(s.server.root, filepath.FromSlash(virtual))
+
+	// Check the deepest existing ancestor; the rest is created below it
+	existing := local
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", errors.New("Permission denied")
+	}
+	if resolved != s.server.root && !strings.HasPrefix(resolved, s.server.root+string(filepath.Separator)) {
+		return "", errors.New("Permission denied")
+	}
+	return local, nil
+}
+
+func (s *session) handlePasv(extended bool) {
+	s.closePassive()
+	s.active = ""
+
+	local := s.conn.LocalAddr().(*net.TCPAddr)
+	listener, err := s.listenPassive(local.IP)
+	if err != nil {
+		s.reply(425, "Cannot open data connection")
+		return
+	}
+	s.passive = listener
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if extended {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+
+	ip := local.IP.To4()
+	if public := net.ParseIP(s.server.cfg.PublicHost); public != nil && public.To4() != nil {
+		ip = public.To4()
+	}
+	if ip == nil {
+		s.closePassive()
+		s.reply(425, "Use EPSV on IPv6")
+		return
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+func (s *session) listenPassive(ip net.IP) (net.Listener, error) {
+	cfg := s.server.cfg
+	if cfg.PassiveMin == 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+	for port := cfg.PassiveMin; port <= cfg.PassiveMax; port++ {
+		if listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port}); err == nil {
+			return listener, nil
+		}
+	}
+	return nil, errors.New("no free passive port")
+}
+
+// handlePort accepts an active mode address. Only the client's own
+// address is allowed, so the server can't be used to reach other hosts.
+func (s *session) handlePort(arg string, extended bool) {
+	s.closePassive()
+	s.active = ""
+
+	var host, port string
+	if extended {
+		// EPRT |1|192.168.1.5|6446|, with the first character as delimiter
+		if arg == "" {
+			s.reply(501, "Invalid EPRT argument")
+			return
+		}
+		parts := strings.Split(arg, arg[:1])
+		if len(parts) != 5 {
+			s.reply(501, "Invalid EPRT argument")
+			return
+		}
+		host, port = parts[2], parts[3]
+	} else {
+		parts := strings.Split(arg, ",")
+		if len(parts) != 6 {
+			s.reply(501, "Invalid PORT argument")
+			return
+		}
+		high, err1 := strconv.Atoi(parts[4])
+		low, err2 := strconv.Atoi(parts[5])
+		if err1 != nil || err2 != nil || high < 0 || high > 255 || low < 0 || low > 255 {
+			s.reply(501, "Invalid PORT argument")
+			return
+		}
+		host = strings.Join(parts[:4], ".")
+		port = strconv.Itoa(high<<8 | low)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.Equal(s.remoteIP) {
+		s.reply(501, "Data connections must go to the client address")
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1024 || n > 65535 {
+		s.reply(501, "Invalid port")
+		return
+	}
+	s.active = net.JoinHostPort(host, port)
+	s.reply(200, "PORT command successful")
+}
+
+// openData opens the data connection set up by PASV, EPSV, PORT or EPRT
+func (s *session) openData() (net.Conn, error) {
+	var conn net.Conn
+	switch {
+	case s.passive != nil:
+		listener := s.passive.(*net.TCPListener)
+		listener.SetDeadline(time.Now().Add(dataTimeout))
+		c, err := listener.Accept()
+		s.closePassive()
+		if err != nil {
+			return nil, err
+		}
+		// Refuse data connections from anyone but the client
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !addr.IP.Equal(s.remoteIP) {
+			c.Close()
+			return nil, errors.New("data connection from another address")
+		}
+		conn = c
+	case s.active != "":
+		c, err := net.DialTimeout("tcp", s.active, dataTimeout)
+		s.active = ""
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	default:
+		return nil, errors.New("use PASV or PORT first")
+	}
+
+	if s.server.cfg.RequireTLS && !s.protect {
+		conn.Close()
+		return nil, errors.New("use PROT P first")
+	}
+	if s.protect {
+		tlsConn := tls.Server(conn, s.server.cfg.TLS)
+		tlsConn.SetDeadline(time.Now().Add(dataTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (s *session) handleList(arg string, namesOnly bool) {
+	// Ignore ls-style flags like -la that many clients send
+	if strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	local, err := s.resolve(s.virtualPath(arg))
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+
+	var infos []os.FileInfo
+	info, err := os.Stat(local)
+	if err != nil {
+		s.reply(550, "No such file or directory")
+		return
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			s.reply(550, "Cannot read directory")
+			return
+		}
+		for _, entry := range entries {
+			if entryInfo, err := entry.Info(); err == nil {
+				infos = append(infos, entryInfo)
+			}
+		}
+	} else {
+		infos = []os.FileInfo{info}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	s.reply(150, "Opening data connection")
+	conn, err := s.openData()
+	if err != nil {
+		s.reply(425, "Cannot open data connection: "+err.Error())
+		return
+	}
+	w := bufio.NewWriter(conn)
+	now := time.Now()
+	for _, info := range infos {
+		if namesOnly {
+			fmt.Fprintf(w, "%s\r\n", info.Name())
+		} else {
+			fmt.Fprintf(w, "%s 1 ftp ftp %12d %s %s\r\n", info.Mode().String(), info.Size(), listTime(info.ModTime(), now), info.Name())
+		}
+	}
+	err = w.Flush()
+	conn.Close()
+	if err != nil {
+		s.reply(426, "Transfer aborted")
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+// listTime formats a modification time like ls -l does
+func listTime(t, now time.Time) string {
+	if now.Sub(t) < 180*24*time.Hour && t.Before(now.Add(time.Hour)) {
+		return t.Format("Jan _2 15:04")
+	}
+	return t.Format("Jan _2  2006")
+}
+
+func (s *session) handleStore(arg string, appendData bool) {
+	if arg == "" {
+		s.reply(501, "File name required")
+		return
+	}
+	virtual := s.virtualPath(arg)
+	local, err := s.resolve(virtual)
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	if info, err := os.Lstat(local); err == nil && !info.Mode().IsRegular() {
+		s.reply(550, "Not a regular file")
+		return
+	}
+
+	s.reply(150, "Ok to send data")
+	conn, err := s.openData()
+	if err != nil {
+		s.reply(425, "Cannot open data connection: "+err.Error())
+		return
+	}
+
+	// Open the file only once data arrives, so a failed connection
+	// doesn't truncate an earlier upload
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendData {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(local, flags, 0644)
+	if err != nil {
+		conn.Close()
+		s.reply(550, "Cannot create file")
+		return
+	}
+
+	var reader io.Reader = &deadlineReader{conn: conn}
+	limit := s.server.cfg.MaxFileSize
+	if limit > 0 {
+		reader = io.LimitReader(reader, limit+1)
+	}
+	written, err := io.Copy(f, reader)
+	conn.Close()
+	closeErr := f.Close()
+
+	action := "ftp.upload"
+	details := map[string]interface{}{"size": written, "append": appendData, "tls": s.protect}
+	switch {
+	case limit > 0 && written > limit:
+		os.Remove(local)
+		details["error"] = "file too large"
+		s.server.logAudit(s.user, action, local, "failed", s.sourceIP, details)
+		s.reply(552, "File exceeds the size limit")
+	case err != nil || closeErr != nil:
+		details["error"] = errors.Join(err, closeErr).Error()
+		s.server.logAudit(s.user, action, local, "failed", s.sourceIP, details)
+		s.reply(426, "Transfer aborted")
+	default:
+		s.server.logAudit(s.user, action, local, "success", s.sourceIP, details)
+		s.reply(226, "Transfer complete")
+	}
+}
+
+// deadlineReader fails reads that stall for longer than dataTimeout
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(dataTimeout))
+	return r.conn.Read(p)
+}
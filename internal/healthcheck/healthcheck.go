@@ -0,0 +1,55 @@
+// Package healthcheck runs path health checks for the share and network
+// disk monitors without letting one hung filesystem stall the others.
+package healthcheck
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultWorkers is how many checks run at once when no limit is set
+const DefaultWorkers = 4
+
+// Stat stats path and gives up after timeout. A stat on a dead network
+// mount may never return, so it runs in its own goroutine that is abandoned
+// on timeout.
+func Stat(path string, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		result <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("stat %s: no response within %s", path, timeout)
+	}
+}
+
+// ForEach calls check for 0..n-1 with at most workers calls running at
+// once, and returns when all have finished
+func ForEach(n, workers int, check func(i int)) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			check(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,39 @@
+package healthcheck
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachLimitsConcurrency(t *testing.T) {
+	var running, peak, calls int32
+	ForEach(10, 3, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&calls, 1)
+	})
+
+	if calls != 10 {
+		t.Fatalf("expected 10 checks, got %d", calls)
+	}
+	if peak > 3 {
+		t.Fatalf("expected at most 3 concurrent checks, got %d", peak)
+	}
+}
+
+func TestStat(t *testing.T) {
+	if err := Stat(t.TempDir(), time.Second); err != nil {
+		t.Fatalf("stat temp dir: %v", err)
+	}
+	if err := Stat("/nonexistent/mingyue-agent", time.Second); err == nil {
+		t.Fatal("expected error for missing path")
+	}
+}
@@ -0,0 +1,265 @@
+// Package httpclient provides the HTTP clients the agent makes outbound
+// requests with, such as audit pushes, webhooks, portal sync and crash
+// reports. Clients share one pool of connections kept alive between
+// requests, go through the configured proxy or the one of HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY, and can pin the keys of the servers they talk
+// to. In offline mode they, and other outbound connections made with
+// Dialer, only reach the local network.
+package httpclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Options tunes the shared connection pool. Zero values use the defaults
+// of DefaultOptions.
+type Options struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	KeepAlive           time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	CAFile              string // PEM certificates trusted besides the system's
+
+	// Proxy is the URL of the proxy for HTTP and HTTPS requests, except to
+	// the hosts of NoProxy, a list like NO_PROXY. The environment is used
+	// if empty.
+	Proxy   string
+	NoProxy string
+
+	// Offline refuses connections to addresses outside the local network:
+	// loopback, private and link-local addresses. Proxies aren't used.
+	Offline bool
+
+	// Pins maps host names to the base64 SHA-256 digests of public keys
+	// (SPKI), one of which the certificate chain of the host must contain.
+	// Servers reached by IP address can't be pinned.
+	Pins map[string][]string
+}
+
+// DefaultOptions are used until Configure is called
+var DefaultOptions = Options{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	KeepAlive:           30 * time.Second,
+	DialTimeout:         10 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// ErrOffline is returned for connections offline mode refuses
+var ErrOffline = errors.New("outbound connections outside the local network are disabled in offline mode")
+
+var (
+	mu        sync.RWMutex
+	transport = mustTransport(DefaultOptions)
+	offline   bool
+)
+
+// Configure replaces the shared transport. Clients returned by New before
+// use the new one from their next request on.
+func Configure(opts Options) error {
+	t, err := newTransport(opts)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	old := transport
+	transport, offline = t, opts.Offline
+	mu.Unlock()
+	old.CloseIdleConnections()
+	return nil
+}
+
+// New returns a client using the shared transport, whose requests fail
+// after timeout; 0 means no limit
+func New(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: sharedTransport{}}
+}
+
+// Dialer returns a dialer for outbound connections other than HTTP, which
+// follows offline mode
+func Dialer(timeout time.Duration) *net.Dialer {
+	mu.RLock()
+	defer mu.RUnlock()
+	dialer := &net.Dialer{Timeout: timeout}
+	if offline {
+		dialer.Control = localOnly
+	}
+	return dialer
+}
+
+// Offline reports whether offline mode is on
+func Offline() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return offline
+}
+
+// sharedTransport hands requests to the transport configured last
+type sharedTransport struct{}
+
+func (sharedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	mu.RLock()
+	t := transport
+	mu.RUnlock()
+	return t.RoundTrip(req)
+}
+
+func mustTransport(opts Options) *http.Transport {
+	t, err := newTransport(opts)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func newTransport(opts Options) (*http.Transport, error) {
+	opts = withDefaults(opts)
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca file %s holds no certificates", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(opts.Pins) > 0 {
+		pins, err := parsePins(opts.Pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = pins.verify
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		if _, err := url.Parse(opts.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		proxyFunc := (&httpproxy.Config{HTTPProxy: opts.Proxy, HTTPSProxy: opts.Proxy, NoProxy: opts.NoProxy}).ProxyFunc()
+		proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: opts.KeepAlive}
+	if opts.Offline {
+		dialer.Control = localOnly
+		proxy = nil
+	}
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
+
+func withDefaults(opts Options) Options {
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = DefaultOptions.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost <= 0 {
+		opts.MaxIdleConnsPerHost = DefaultOptions.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout <= 0 {
+		opts.IdleConnTimeout = DefaultOptions.IdleConnTimeout
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = DefaultOptions.KeepAlive
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultOptions.DialTimeout
+	}
+	if opts.TLSHandshakeTimeout <= 0 {
+		opts.TLSHandshakeTimeout = DefaultOptions.TLSHandshakeTimeout
+	}
+	return opts
+}
+
+// localOnly refuses connections to addresses outside the local network.
+// It runs for every address a host name resolves to, so names can't lead
+// out.
+func localOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+		return fmt.Errorf("connect to %s: %w", host, ErrOffline)
+	}
+	return nil
+}
+
+// pinSet holds the SPKI digests pinned per host
+type pinSet map[string]map[[sha256.Size]byte]bool
+
+func parsePins(hosts map[string][]string) (pinSet, error) {
+	pins := make(pinSet)
+	for host, digests := range hosts {
+		host = strings.ToLower(host)
+		if pins[host] == nil {
+			pins[host] = make(map[[sha256.Size]byte]bool)
+		}
+		for _, digest := range digests {
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(digest, "sha256/"))
+			if err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q for %s: expected a base64 sha256 digest", digest, host)
+			}
+			pins[host][[sha256.Size]byte(raw)] = true
+		}
+	}
+	return pins, nil
+}
+
+// verify fails connections to pinned hosts whose certificate chain holds
+// none of their pinned keys. It runs after the chain is verified.
+func (p pinSet) verify(cs tls.ConnectionState) error {
+	pinned, ok := p[strings.ToLower(cs.ServerName)]
+	if !ok {
+		return nil
+	}
+	for _, cert := range cs.PeerCertificates {
+		if pinned[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate of %s does not match its pinned keys", cs.ServerName)
+}
+
+// Pin returns the pin of cert, as used in Options.Pins
+func Pin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
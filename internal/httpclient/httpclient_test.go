@@ -0,0 +1,125 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	defer Configure(Options{})
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := srv.Certificate()
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test certificate is issued to example.com, which is dialed at
+	// the test server
+	configure := func(opts Options) error {
+		if err := Configure(opts); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, srv.Listener.Addr().String())
+		}
+		return nil
+	}
+	client := New(5 * time.Second)
+	get := func() error {
+		resp, err := client.Get("https://example.com/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := configure(Options{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Fatalf("trusted server: %v", err)
+	}
+
+	if err := configure(Options{CAFile: caFile, Pins: map[string][]string{"example.com": {Pin(cert)}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Fatalf("matching pin: %v", err)
+	}
+
+	other := "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	if err := configure(Options{CAFile: caFile, Pins: map[string][]string{"Example.com": {other}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err == nil {
+		t.Fatal("mismatching pin: request succeeded")
+	}
+
+	if err := Configure(Options{Pins: map[string][]string{"example.com": {"not-a-digest"}}}); err == nil {
+		t.Fatal("invalid pin accepted")
+	}
+}
+
+func TestProxyAndOffline(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+	}))
+	defer proxy.Close()
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+	defer Configure(Options{})
+
+	client := New(5 * time.Second)
+	get := func(target string) error {
+		resp, err := client.Get(target)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := Configure(Options{Proxy: proxy.URL, NoProxy: "skip.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("http://portal.example.com/sync"); err != nil {
+		t.Fatalf("proxied request: %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != "portal.example.com" {
+		t.Fatalf("expected the request to go through the proxy, got %v", proxied)
+	}
+
+	if err := Configure(Options{Proxy: proxy.URL, Offline: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !Offline() {
+		t.Fatal("expected offline mode")
+	}
+	if err := get(local.URL); err != nil {
+		t.Fatalf("local request in offline mode: %v", err)
+	}
+	if err := get("http://1.1.1.1/"); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+	if _, err := Dialer(time.Second).Dial("tcp", "8.8.8.8:53"); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected the dialer to refuse, got %v", err)
+	}
+	if len(proxied) != 1 {
+		t.Fatalf("expected no proxy in offline mode, got %v", proxied)
+	}
+}
@@ -0,0 +1,201 @@
+// Package ignore decides which files the indexer, the file watcher and
+// usage reports leave out, from glob patterns in the configuration and
+// .mingyueignore files in the directories themselves. Ignoring a
+// directory leaves out everything below it, so junk trees like
+// node_modules or the @eaDir thumbnails of Synology never get walked.
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileName is the name of the ignore files in directories. They hold one
+// pattern per line; blank lines and lines starting with # are skipped,
+// and \# starts a pattern with #.
+const FileName = ".mingyueignore"
+
+// recheck is how long an ignore file is trusted before it is read again
+const recheck = 10 * time.Second
+
+// maxCached bounds the directories whose ignore files are remembered. The
+// cache starts over when it fills up.
+const maxCached = 100000
+
+// pattern is one glob. Patterns without a slash match entry names at any
+// depth; others match paths relative to the directory of their ignore
+// file, or absolute paths for patterns in the configuration. A trailing
+// slash only matches directories.
+type pattern struct {
+	glob    string
+	path    bool
+	dirOnly bool
+}
+
+// parse reads a pattern. Lines of ignore files starting with # are
+// comments; patterns of the configuration can't be, so names like the
+// #recycle bin of Samba need no escaping there.
+func parse(line string, file bool) (pattern, bool) {
+	line = strings.TrimSpace(line)
+	if file {
+		if strings.HasPrefix(line, "#") {
+			return pattern{}, false
+		}
+		line = strings.TrimPrefix(line, `\`)
+	}
+
+	var p pattern
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+	p.path = strings.Contains(line, "/")
+	p.glob = filepath.Clean(line)
+	if _, err := filepath.Match(p.glob, ""); err != nil {
+		return pattern{}, false
+	}
+	return p, true
+}
+
+// match reports whether the entry at rel, a path relative to the
+// directory of the pattern, matches
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.path {
+		ok, _ := filepath.Match(p.glob, filepath.Base(rel))
+		return ok
+	}
+	ok, _ := filepath.Match(p.glob, rel)
+	return ok
+}
+
+// rules are the patterns of an ignore file
+type rules struct {
+	patterns []pattern
+	modTime  time.Time
+	checked  time.Time
+}
+
+// Matcher reports whether paths are ignored. A nil Matcher ignores
+// nothing.
+type Matcher struct {
+	global []pattern
+
+	mu    sync.Mutex
+	files map[string]*rules // By directory
+}
+
+// New creates a Matcher for the patterns of the configuration, on top of
+// which the ignore files of directories apply
+func New(patterns []string) *Matcher {
+	m := &Matcher{files: make(map[string]*rules)}
+	for _, line := range patterns {
+		if p, ok := parse(line, false); ok {
+			m.global = append(m.global, p)
+		}
+	}
+	return m
+}
+
+// Ignored reports whether the entry at path is left out. Only the entry
+// itself is checked, not the directories above it, as callers skip
+// ignored directories without looking into them.
+func (m *Matcher) Ignored(path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	if filepath.Base(path) == FileName {
+		return false
+	}
+	for _, p := range m.global {
+		if p.match(path, isDir) {
+			return true
+		}
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil {
+			for _, p := range m.load(dir) {
+				if p.match(rel, isDir) {
+					return true
+				}
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// Excluded reports whether path or a directory above it is ignored, for
+// paths that were not reached by walking, like those stored in the index
+func (m *Matcher) Excluded(path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if m.Ignored(dir, true) {
+			return true
+		}
+	}
+	return m.Ignored(path, isDir)
+}
+
+// load returns the patterns of the ignore file in dir, reading it again
+// once it may have changed
+func (m *Matcher) load(dir string) []pattern {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	cached := m.files[dir]
+	if cached != nil && now.Sub(cached.checked) < recheck {
+		return cached.patterns
+	}
+
+	info, err := os.Stat(filepath.Join(dir, FileName))
+	if err != nil {
+		cached = &rules{checked: now}
+	} else if cached == nil || !info.ModTime().Equal(cached.modTime) {
+		cached = &rules{modTime: info.ModTime(), checked: now, patterns: readFile(filepath.Join(dir, FileName))}
+	} else {
+		cached.checked = now
+	}
+
+	if len(m.files) >= maxCached {
+		m.files = make(map[string]*rules)
+	}
+	m.files[dir] = cached
+	return cached.patterns
+}
+
+func readFile(path string) []pattern {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var patterns []pattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p, ok := parse(scanner.Text(), true); ok {
+			// A leading slash anchors nothing more than any other slash
+			p.glob = strings.TrimPrefix(p.glob, "/")
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,50 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "photos", "raw"), 0755)
+	os.WriteFile(filepath.Join(root, "photos", FileName), []byte("# Editor leftovers\n*.tmp\nraw/\ncache/*.db\n\\#notes\n"), 0644)
+
+	m := New([]string{"node_modules", "@eaDir", "#recycle", filepath.Join(root, "scratch")})
+	for _, tt := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"node_modules", true, true},
+		{"src/node_modules", true, true},
+		{"photos/@eaDir", true, true},
+		{"#recycle", true, true},
+		{"scratch", true, true},
+		{"other/scratch", true, false},
+		{"photos/a.tmp", false, true},
+		{"photos/deep/a.tmp", false, true},
+		{"a.tmp", false, false},
+		{"photos/raw", true, true},
+		{"photos/raw", false, false},
+		{"photos/cache/thumbs.db", false, true},
+		{"photos/x/cache/thumbs.db", false, false},
+		{"photos/#notes", false, true},
+		{"photos/" + FileName, false, false},
+		{"photos/a.jpg", false, false},
+	} {
+		if got := m.Ignored(filepath.Join(root, tt.path), tt.isDir); got != tt.ignored {
+			t.Errorf("Ignored(%s, %v) = %v, want %v", tt.path, tt.isDir, got, tt.ignored)
+		}
+	}
+
+	if !m.Excluded(filepath.Join(root, "src", "node_modules", "left-pad", "index.js"), false) || m.Excluded(filepath.Join(root, "src", "index.js"), false) {
+		t.Error("expected paths below ignored directories to be excluded")
+	}
+
+	var none *Matcher
+	if none.Ignored(filepath.Join(root, "node_modules"), true) {
+		t.Error("expected a nil Matcher to ignore nothing")
+	}
+}
@@ -0,0 +1,263 @@
+package indexer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Every change to the index gets the next sequence number, which clients
+// keeping their own copy of the index, like the portal's search cache, use
+// as a cursor to fetch only what changed since their last sync.
+
+// TombstoneRetention is how long removed files are remembered. Clients
+// whose cursor is older must fetch the whole index again.
+const TombstoneRetention = 30 * 24 * time.Hour
+
+// Bounds of the changes returned at once
+const (
+	DefaultChangesLimit = 1000
+	MaxChangesLimit     = 10000
+)
+
+// ErrInvalidCursor is returned for cursors the index never handed out
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ChangeSet is what changed in the index after a cursor
+type ChangeSet struct {
+	Cursor  int64           `json:"cursor"`  // Pass to the next call
+	More    bool            `json:"more"`    // More changes follow the cursor
+	Reset   bool            `json:"reset"`   // Added holds every file; drop everything else first
+	Added   []*FileMetadata `json:"added"`   // Files new since the cursor
+	Changed []*FileMetadata `json:"changed"` // Files changed since the cursor
+	Removed []string        `json:"removed"` // Paths of files removed since the cursor
+}
+
+// migrateSeq adds the sequence numbers to databases created before them
+// and loads the last one handed out. The caller holds i.mu.
+func (i *Indexer) migrateSeq() error {
+	for _, column := range []string{"seq", "added_seq"} {
+		if err := i.ensureColumn("file_metadata", column, "INTEGER"); err != nil {
+			return err
+		}
+	}
+	if _, err := i.db.Exec(`
+		UPDATE file_metadata SET seq = id, added_seq = id WHERE seq IS NULL;
+		CREATE INDEX IF NOT EXISTS idx_seq ON file_metadata(seq);
+	`); err != nil {
+		return err
+	}
+
+	return i.db.QueryRow(`
+		SELECT MAX(
+			COALESCE((SELECT MAX(seq) FROM file_metadata), 0),
+			COALESCE((SELECT MAX(seq) FROM file_removed), 0),
+			COALESCE((SELECT value FROM index_state WHERE key = 'horizon'), 0))
+	`).Scan(&i.seq)
+}
+
+// ensureColumn adds a column to databases created before it existed
+func (i *Indexer) ensureColumn(table, column, definition string) error {
+	rows, err := i.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = i.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// nextSeq hands out the next sequence number. The caller holds i.mu.
+func (i *Indexer) nextSeq() int64 {
+	i.seq++
+	return i.seq
+}
+
+// touch marks the entry of path as changed. The caller holds i.mu.
+func (i *Indexer) touch(ctx context.Context, tx *sql.Tx, path string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE file_metadata SET seq = ? WHERE path = ?", i.nextSeq(), path)
+	return err
+}
+
+// recordRemovals remembers that the entries of paths were removed. The
+// caller holds i.mu.
+func (i *Indexer) recordRemovals(ctx context.Context, tx *sql.Tx, paths []string) error {
+	now := time.Now().Unix()
+	for _, path := range paths {
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO file_removed (path, seq, removed_at) VALUES (?, ?, ?)",
+			path, i.nextSeq(), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneTombstones forgets removals older than TombstoneRetention, moving
+// the horizon that older cursors must resync from
+func pruneTombstones(ctx context.Context, tx *sql.Tx) error {
+	cutoff := time.Now().Add(-TombstoneRetention).Unix()
+	var horizon sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT MAX(seq) FROM file_removed WHERE removed_at < ?", cutoff).Scan(&horizon); err != nil {
+		return err
+	}
+	if !horizon.Valid {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO index_state (key, value) VALUES ('horizon', ?)
+		ON CONFLICT(key) DO UPDATE SET value = MAX(value, excluded.value)
+	`, horizon.Int64); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM file_removed WHERE seq <= ?", horizon.Int64)
+	return err
+}
+
+// Changes returns up to limit changes to the index after cursor, oldest
+// first. Cursor 0, and cursors from before the removals still remembered,
+// yield the whole index with Reset set, over as many calls as it takes.
+func (i *Indexer) Changes(ctx context.Context, cursor int64, limit int) (*ChangeSet, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if cursor < 0 || cursor > i.seq {
+		return nil, ErrInvalidCursor
+	}
+	if limit <= 0 {
+		limit = DefaultChangesLimit
+	}
+	limit = min(limit, MaxChangesLimit)
+
+	var horizon int64
+	if err := i.db.QueryRowContext(ctx, "SELECT COALESCE((SELECT value FROM index_state WHERE key = 'horizon'), 0)").Scan(&horizon); err != nil {
+		return nil, err
+	}
+	changes := &ChangeSet{Cursor: cursor, Added: []*FileMetadata{}, Changed: []*FileMetadata{}, Removed: []string{}}
+	if cursor == 0 || cursor < horizon {
+		// Files removed before the horizon are gone without a trace, so
+		// the client starts over
+		changes.Reset = true
+		cursor = 0
+	}
+
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT id, path, name, size, mod_time, is_dir, mime_type, md5_hash, thumbnail_url, indexed_at, seq, added_seq
+		FROM file_metadata
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT ?
+	`, cursor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		file  *FileMetadata
+		added bool
+	}
+	files := map[int64]entry{}
+	var seqs []int64
+	for rows.Next() {
+		var m FileMetadata
+		var modTime, indexedAt, seq, addedSeq int64
+		var isDir int
+		var md5Hash, thumbnailURL sql.NullString
+		if err := rows.Scan(&m.ID, &m.Path, &m.Name, &m.Size, &modTime, &isDir,
+			&m.MimeType, &md5Hash, &thumbnailURL, &indexedAt, &seq, &addedSeq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.MD5Hash = md5Hash.String
+		m.ThumbnailURL = thumbnailURL.String
+		m.ModTime = time.Unix(modTime, 0)
+		m.IndexedAt = time.Unix(indexedAt, 0)
+		m.IsDir = isDir != 0
+		files[seq] = entry{file: &m, added: changes.Reset || addedSeq > cursor}
+		seqs = append(seqs, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	removed := map[int64]string{}
+	if !changes.Reset {
+		// Files added again since they were removed show up as changed
+		rows, err := i.db.QueryContext(ctx, `
+			SELECT path, seq FROM file_removed
+			WHERE seq > ? AND path NOT IN (SELECT path FROM file_metadata)
+			ORDER BY seq
+			LIMIT ?
+		`, cursor, limit+1)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var path string
+			var seq int64
+			if err := rows.Scan(&path, &seq); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			removed[seq] = path
+			seqs = append(seqs, seq)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.Sort(seqs)
+	if len(seqs) > limit {
+		seqs = seqs[:limit]
+		changes.More = true
+	}
+	var added []*FileMetadata
+	for _, seq := range seqs {
+		if e, ok := files[seq]; ok {
+			if e.added {
+				added = append(added, e.file)
+			} else {
+				changes.Changed = append(changes.Changed, e.file)
+			}
+		} else {
+			changes.Removed = append(changes.Removed, removed[seq])
+		}
+		changes.Cursor = seq
+	}
+	if len(added) > 0 {
+		changes.Added = added
+	}
+	if !changes.More && changes.Cursor < i.seq {
+		// Skip the numbers of changes that left nothing behind, like
+		// rows updated again since
+		changes.Cursor = i.seq
+	}
+
+	if err := i.attachTags(ctx, changes.Added); err != nil {
+		return nil, err
+	}
+	if err := i.attachTags(ctx, changes.Changed); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
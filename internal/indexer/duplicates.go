@@ -0,0 +1,107 @@
+package indexer
+
+import (
+	"cmp"
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DuplicateOptions selects the duplicates reported by Duplicates
+type DuplicateOptions struct {
+	Path    string            // Only files below this directory; all if empty
+	MinSize int64             // Leave out files smaller than this
+	Limit   int               // Sets to return, largest waste first; 0 for all
+	Allow   func(string) bool // Leave out paths it rejects, such as ones outside the allowed paths
+}
+
+// DuplicateSet is a group of indexed files with the same size and MD5 hash
+type DuplicateSet struct {
+	MD5Hash     string   `json:"md5_hash"`
+	Size        int64    `json:"size"`
+	Paths       []string `json:"paths"`
+	WastedBytes int64    `json:"wasted_bytes"` // Size of all copies but one
+}
+
+// DuplicateReport lists the duplicate files in the index
+type DuplicateReport struct {
+	Sets        []DuplicateSet `json:"sets"`
+	Files       int            `json:"files"`        // Files in the sets returned
+	WastedBytes int64          `json:"wasted_bytes"` // Space all copies but one take in the sets returned
+}
+
+// Duplicates reports the indexed files that have the same size and MD5
+// hash as another, largest waste first. It goes by the index alone, so
+// files changed since their last scan may be reported wrongly, and copies
+// that are already hard links to each other are counted as wasted. Files
+// are only hashed by scans with hashing enabled.
+func (i *Indexer) Duplicates(ctx context.Context, opts DuplicateOptions) (*DuplicateReport, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	prefix := ""
+	if opts.Path != "" {
+		prefix = strings.TrimSuffix(filepath.Clean(opts.Path), "/") + "/"
+	}
+
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT f.md5_hash, f.size, f.path
+		FROM file_metadata f
+		JOIN (
+			SELECT md5_hash, size
+			FROM file_metadata
+			WHERE is_dir = 0 AND md5_hash != '' AND size >= ? AND (? = '' OR substr(path, 1, length(?)) = ?)
+			GROUP BY md5_hash, size
+			HAVING COUNT(*) > 1
+		) d ON f.md5_hash = d.md5_hash AND f.size = d.size
+		WHERE f.is_dir = 0 AND (? = '' OR substr(f.path, 1, length(?)) = ?)
+		ORDER BY f.size DESC, f.md5_hash, f.path
+	`, opts.MinSize, prefix, prefix, prefix, prefix, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sets []DuplicateSet
+	for rows.Next() {
+		var hash, path string
+		var size int64
+		if err := rows.Scan(&hash, &size, &path); err != nil {
+			return nil, err
+		}
+		if opts.Allow != nil && !opts.Allow(path) {
+			continue
+		}
+		if n := len(sets); n > 0 && sets[n-1].MD5Hash == hash && sets[n-1].Size == size {
+			sets[n-1].Paths = append(sets[n-1].Paths, path)
+			continue
+		}
+		sets = append(sets, DuplicateSet{MD5Hash: hash, Size: size, Paths: []string{path}})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sets are in order of file size; paths left out may have left a
+	// single file
+	report := &DuplicateReport{Sets: []DuplicateSet{}}
+	for _, set := range sets {
+		if len(set.Paths) < 2 {
+			continue
+		}
+		set.WastedBytes = set.Size * int64(len(set.Paths)-1)
+		report.Sets = append(report.Sets, set)
+	}
+	slices.SortStableFunc(report.Sets, func(a, b DuplicateSet) int {
+		return cmp.Compare(b.WastedBytes, a.WastedBytes)
+	})
+	if opts.Limit > 0 && len(report.Sets) > opts.Limit {
+		report.Sets = report.Sets[:opts.Limit]
+	}
+	for _, set := range report.Sets {
+		report.Files += len(set.Paths)
+		report.WastedBytes += set.WastedBytes
+	}
+	return report, nil
+}
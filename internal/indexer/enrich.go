@@ -0,0 +1,418 @@
+package indexer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+)
+
+// EnrichTaskType is the scheduler task type that enriches indexed files
+// not enriched since they last changed. The path and limit parameters
+// select the files, as in EnrichOptions.
+const EnrichTaskType = "indexer.enrich"
+
+// Kinds of tags
+const (
+	TagLabel = "label" // An object or scene, such as "cat" or "beach"
+	TagFace  = "face"  // A face, named if the person was recognized
+	TagScan  = "scan"  // The malware scan verdict of an upload, such as "clean"
+)
+
+// Errors of enrichment
+var (
+	ErrNoEnrichers = errors.New("no enrichers are configured")
+	// ErrEnricherUnavailable ends an enrichment pass, since the files left
+	// would fail the same way
+	ErrEnricherUnavailable = errors.New("enricher unavailable")
+)
+
+// Tag describes the content of a file, as found by an enricher
+type Tag struct {
+	Name       string  `json:"name"`
+	Kind       string  `json:"kind"`
+	Confidence float64 `json:"confidence,omitempty"`
+	Box        []int   `json:"box,omitempty"` // x, y, width and height of a face in pixels
+	Source     string  `json:"source,omitempty"`
+}
+
+// TagCount is a tag and how many indexed files have it
+type TagCount struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Files int    `json:"files"`
+}
+
+// Enricher derives tags from the content of indexed files, typically by
+// asking an external service, so the agent itself runs no models
+type Enricher interface {
+	// Name identifies the tags of the enricher, which replace its earlier
+	// tags of a file
+	Name() string
+	// Accepts reports whether the enricher handles file
+	Accepts(file *FileMetadata) bool
+	// Enrich returns the tags of file, whose content is read from content.
+	// Errors wrapping ErrEnricherUnavailable are retried on the next pass;
+	// others are recorded, and the file is retried once it changes.
+	Enrich(ctx context.Context, file *FileMetadata, content io.Reader) ([]Tag, error)
+}
+
+// EnrichOptions selects the files an enrichment pass handles
+type EnrichOptions struct {
+	Path  string `json:"path"`  // Only files below this directory; all if empty
+	Limit int    `json:"limit"` // Files to enrich in this pass; 0 for all
+	Force bool   `json:"force"` // Enrich files again even if unchanged, such as after the service was upgraded
+}
+
+// EnrichResult is what an enrichment pass did
+type EnrichResult struct {
+	Files  int `json:"files"`  // Files sent to enrichers
+	Tagged int `json:"tagged"` // Files that got at least one tag
+	Tags   int `json:"tags"`
+	Errors int `json:"errors"`
+}
+
+// AddEnricher adds e to the enrichment pipeline
+func (i *Indexer) AddEnricher(e Enricher) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.enrichers = append(i.enrichers, e)
+}
+
+// Enrich runs the indexed files not enriched since they last changed
+// through the enrichers, storing the tags they return. The database is
+// not locked while enrichers run, so scans and searches go on.
+func (i *Indexer) Enrich(ctx context.Context, opts EnrichOptions) (*EnrichResult, error) {
+	i.mu.RLock()
+	enrichers := append([]Enricher(nil), i.enrichers...)
+	i.mu.RUnlock()
+	if len(enrichers) == 0 {
+		return nil, ErrNoEnrichers
+	}
+
+	result := &EnrichResult{}
+	for _, e := range enrichers {
+		files, err := i.enrichCandidates(ctx, e.Name(), opts)
+		if err != nil {
+			return result, err
+		}
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			scheduler.Heartbeat(ctx)
+			if !e.Accepts(file) {
+				continue
+			}
+			if opts.Limit > 0 && result.Files >= opts.Limit {
+				return result, nil
+			}
+
+			result.Files++
+			tags, err := enrichFile(ctx, e, file)
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			if errors.Is(err, ErrEnricherUnavailable) {
+				result.Errors++
+				return result, err
+			}
+			if err != nil {
+				result.Errors++
+			}
+			if err := i.saveTags(ctx, e.Name(), file, tags, err); err != nil {
+				return result, err
+			}
+			if len(tags) > 0 {
+				result.Tagged++
+				result.Tags += len(tags)
+			}
+		}
+	}
+	return result, nil
+}
+
+// enrichCandidates returns the files e has not enriched since they last
+// changed, or all of them with opts.Force
+func (i *Indexer) enrichCandidates(ctx context.Context, source string, opts EnrichOptions) ([]*FileMetadata, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	prefix := ""
+	if opts.Path != "" {
+		prefix = strings.TrimSuffix(filepath.Clean(opts.Path), "/") + "/"
+	}
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT f.path, f.name, f.size, f.mod_time, f.mime_type, f.md5_hash
+		FROM file_metadata f
+		LEFT JOIN file_enrichment e ON e.path = f.path AND e.source = ?
+		WHERE f.is_dir = 0 AND (? OR e.path IS NULL OR e.mod_time != f.mod_time)
+			AND (? = '' OR substr(f.path, 1, length(?)) = ?)
+		ORDER BY f.id
+	`, source, opts.Force, prefix, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*FileMetadata
+	for rows.Next() {
+		var m FileMetadata
+		var modTime int64
+		var mimeType, hash sql.NullString
+		if err := rows.Scan(&m.Path, &m.Name, &m.Size, &modTime, &mimeType, &hash); err != nil {
+			return nil, err
+		}
+		m.ModTime = time.Unix(modTime, 0)
+		m.MimeType, m.MD5Hash = mimeType.String, hash.String
+		files = append(files, &m)
+	}
+	return files, rows.Err()
+}
+
+func enrichFile(ctx context.Context, e Enricher, file *FileMetadata) ([]Tag, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tags, err := e.Enrich(ctx, file, f)
+	if err != nil {
+		return nil, err
+	}
+	kept := tags[:0]
+	for _, tag := range tags {
+		tag.Name = strings.TrimSpace(tag.Name)
+		if tag.Kind != TagFace && (tag.Kind != TagLabel || tag.Name == "") {
+			continue
+		}
+		tag.Source = e.Name()
+		kept = append(kept, tag)
+	}
+	return kept, nil
+}
+
+// saveTags replaces the tags source gave file, recording enrichErr if the
+// enricher failed on it
+func (i *Indexer) saveTags(ctx context.Context, source string, file *FileMetadata, tags []Tag, enrichErr error) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE path = ? AND source = ?", file.Path, source); err != nil {
+		return err
+	}
+	// Tags are part of what index deltas carry
+	if err := i.touch(ctx, tx, file.Path); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		box := ""
+		if len(tag.Box) > 0 {
+			data, _ := json.Marshal(tag.Box)
+			box = string(data)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO file_tags (path, source, kind, name, confidence, box) VALUES (?, ?, ?, ?, ?, ?)",
+			file.Path, source, tag.Kind, tag.Name, tag.Confidence, box); err != nil {
+			return err
+		}
+	}
+	errText := ""
+	if enrichErr != nil {
+		errText = enrichErr.Error()
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO file_enrichment (path, source, mod_time, enriched_at, error) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(path, source) DO UPDATE SET
+			mod_time = excluded.mod_time,
+			enriched_at = excluded.enriched_at,
+			error = excluded.error
+	`, file.Path, source, file.ModTime.Unix(), time.Now().Unix(), errText); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordScan stores the verdict of a malware scan of path by engine as a
+// scan tag, replacing the engine's earlier verdict. Uploads are scanned
+// before the file is indexed, so the tag may come before its entry.
+func (i *Indexer) RecordScan(ctx context.Context, path, engine, verdict string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE path = ? AND source = ? AND kind = ?", path, engine, TagScan); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO file_tags (path, source, kind, name, confidence, box) VALUES (?, ?, ?, ?, 0, '')",
+		path, engine, TagScan, verdict); err != nil {
+		return err
+	}
+	if err := i.touch(ctx, tx, path); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchByTags returns the indexed files that have all of tags, of any
+// kind and ignoring case, and whose name or path contains query if it is
+// not empty
+func (i *Indexer) SearchByTags(ctx context.Context, query string, tags []string, limit, offset int) ([]*FileMetadata, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	args := []interface{}{}
+	placeholders := make([]string, len(tags))
+	for n, tag := range tags {
+		placeholders[n] = "?"
+		args = append(args, strings.ToLower(tag))
+	}
+	args = append(args, len(tags), query, "%"+query+"%", "%"+query+"%", limit, offset)
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT id, path, name, size, mod_time, is_dir, mime_type, md5_hash, thumbnail_url, indexed_at
+		FROM file_metadata
+		WHERE path IN (
+			SELECT path FROM file_tags
+			WHERE lower(name) IN (`+strings.Join(placeholders, ", ")+`)
+			GROUP BY path
+			HAVING COUNT(DISTINCT lower(name)) = ?
+		) AND (? = '' OR name LIKE ? OR path LIKE ?)
+		ORDER BY indexed_at DESC
+		LIMIT ? OFFSET ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	results, err := scanMetadata(rows)
+	if err != nil {
+		return nil, err
+	}
+	return results, i.attachTags(ctx, results)
+}
+
+// Tags lists the tags of the files below path, or of all files if path is
+// empty, with the number of files that have each, most common first
+func (i *Indexer) Tags(ctx context.Context, path string) ([]TagCount, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	prefix := ""
+	if path != "" {
+		prefix = strings.TrimSuffix(filepath.Clean(path), "/") + "/"
+	}
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT MIN(name), kind, COUNT(DISTINCT path) AS files
+		FROM file_tags
+		WHERE name != '' AND (? = '' OR substr(path, 1, length(?)) = ?)
+		GROUP BY lower(name), kind
+		ORDER BY files DESC, lower(name)
+	`, prefix, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []TagCount{}
+	for rows.Next() {
+		var c TagCount
+		if err := rows.Scan(&c.Name, &c.Kind, &c.Files); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// attachTags sets the tags of files. The caller holds i.mu.
+func (i *Indexer) attachTags(ctx context.Context, files []*FileMetadata) error {
+	if len(files) == 0 {
+		return nil
+	}
+	byPath := make(map[string]*FileMetadata, len(files))
+	args := make([]interface{}, 0, len(files))
+	placeholders := make([]string, 0, len(files))
+	for _, file := range files {
+		byPath[file.Path] = file
+		args = append(args, file.Path)
+		placeholders = append(placeholders, "?")
+	}
+
+	rows, err := i.db.QueryContext(ctx, `
+		SELECT path, source, kind, name, confidence, box
+		FROM file_tags
+		WHERE path IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY path, kind, confidence DESC
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, box string
+		var tag Tag
+		if err := rows.Scan(&path, &tag.Source, &tag.Kind, &tag.Name, &tag.Confidence, &box); err != nil {
+			return err
+		}
+		if box != "" {
+			json.Unmarshal([]byte(box), &tag.Box)
+		}
+		if file, ok := byPath[path]; ok {
+			file.Tags = append(file.Tags, tag)
+		}
+	}
+	return rows.Err()
+}
+
+// EnrichTaskHandler enriches files for scheduler tasks of type
+// EnrichTaskType
+func (i *Indexer) EnrichTaskHandler() scheduler.TaskHandler {
+	return func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		var opts EnrichOptions
+		opts.Path, _ = params["path"].(string)
+		if limit, ok := params["limit"].(float64); ok {
+			opts.Limit = int(limit)
+		}
+		opts.Force, _ = params["force"].(bool)
+
+		result, err := i.Enrich(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return enrichOutput(result), nil
+	}
+}
+
+func enrichOutput(result *EnrichResult) map[string]interface{} {
+	return map[string]interface{}{
+		"files":  result.Files,
+		"tagged": result.Tagged,
+		"tags":   result.Tags,
+		"errors": result.Errors,
+	}
+}
+
+// hasEnrichers reports whether any enrichers are configured
+func (i *Indexer) hasEnrichers() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.enrichers) > 0
+}
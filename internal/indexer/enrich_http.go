@@ -0,0 +1,106 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+)
+
+// maxTagsPerFile bounds what a misbehaving service can store for a file
+const maxTagsPerFile = 200
+
+// HTTPEnricher tags images with an external machine learning service,
+// such as one running object detection and face recognition on a GPU box
+// on the LAN. Each image is posted as the request body, with its type in
+// Content-Type and its path and name in the X-File-Path and X-File-Name
+// headers. The service responds with
+//
+//	{"tags": [{"name": "cat", "confidence": 0.97}],
+//	 "faces": [{"name": "alice", "confidence": 0.91, "box": [40, 32, 128, 128]}]}
+//
+// where faces of unknown people have no name.
+type HTTPEnricher struct {
+	url     string
+	token   string
+	maxSize int64
+	client  *http.Client
+}
+
+// HTTPEnricherResponse is the response of the enrichment service
+type HTTPEnricherResponse struct {
+	Tags  []Tag `json:"tags"`
+	Faces []Tag `json:"faces"`
+}
+
+// NewHTTPEnricher sends images up to maxSize bytes to url, with token as
+// a bearer token if set
+func NewHTTPEnricher(url, token string, timeout time.Duration, maxSize int64) *HTTPEnricher {
+	return &HTTPEnricher{
+		url:     url,
+		token:   token,
+		maxSize: maxSize,
+		client:  httpclient.New(timeout),
+	}
+}
+
+func (e *HTTPEnricher) Name() string {
+	return "ml"
+}
+
+func (e *HTTPEnricher) Accepts(file *FileMetadata) bool {
+	return strings.HasPrefix(file.MimeType, "image/") && file.Size > 0 && (e.maxSize <= 0 || file.Size <= e.maxSize)
+}
+
+func (e *HTTPEnricher) Enrich(ctx context.Context, file *FileMetadata, content io.Reader) ([]Tag, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEnricherUnavailable, err)
+	}
+	req.ContentLength = file.Size
+	req.Header.Set("Content-Type", file.MimeType)
+	req.Header.Set("X-File-Path", file.Path)
+	req.Header.Set("X-File-Name", file.Name)
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEnricherUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		// Not the file's fault, so it is retried on the next pass
+		return nil, fmt.Errorf("%w: service returned %s", ErrEnricherUnavailable, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("service rejected the file: %s", resp.Status)
+	}
+
+	var result HTTPEnricherResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	tags := make([]Tag, 0, len(result.Tags)+len(result.Faces))
+	for _, tag := range result.Tags {
+		tags = append(tags, Tag{Name: tag.Name, Kind: TagLabel, Confidence: tag.Confidence})
+	}
+	for _, face := range result.Faces {
+		if len(face.Box) != 0 && len(face.Box) != 4 {
+			face.Box = nil
+		}
+		tags = append(tags, Tag{Name: face.Name, Kind: TagFace, Confidence: face.Confidence, Box: face.Box})
+	}
+	if len(tags) > maxTagsPerFile {
+		tags = tags[:maxTagsPerFile]
+	}
+	return tags, nil
+}
@@ -12,9 +12,18 @@ import (
 	"sync"
 	"time"
 
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// TaskType is the scheduler task type that scans the files named by its
+// path or paths parameters into the index. The recursive and incremental
+// parameters select the scan options. Unless the enrich parameter is
+// false, the enrichers then handle the files that changed.
+const TaskType = "indexer.scan"
+
 // FileMetadata represents indexed file metadata
 type FileMetadata struct {
 	ID           int64     `json:"id"`
@@ -27,6 +36,7 @@ type FileMetadata struct {
 	MD5Hash      string    `json:"md5_hash,omitempty"`
 	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
 	IndexedAt    time.Time `json:"indexed_at"`
+	Tags         []Tag     `json:"tags,omitempty"` // Set by searches
 }
 
 // ScanOptions defines scanning behavior
@@ -43,17 +53,40 @@ type Indexer struct {
 	mu          sync.RWMutex
 	scanPaths   []string
 	lastScanRun time.Time
+	skipHashes  bool
+	ignore      *ignore.Matcher
+	enrichers   []Enricher
+	seq         int64 // Last sequence number handed out; see delta.go
+}
+
+// Config holds indexer configuration
+type Config struct {
+	DBPath      string
+	CacheSizeKB int  // SQLite page cache size; 0 uses the SQLite default
+	SkipHashes  bool // Do not compute MD5 hashes while scanning
+	Ignore      *ignore.Matcher
 }
 
 // New creates a new Indexer instance
-func New(dbPath string) (*Indexer, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+func New(cfg *Config) (*Indexer, error) {
+	dsn := cfg.DBPath
+	if cfg.CacheSizeKB > 0 {
+		dsn += fmt.Sprintf("?_cache_size=-%d", cfg.CacheSizeKB)
+	}
+
+	if err := statefile.PrepareDB(cfg.DBPath); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
 	idx := &Indexer{
-		db: db,
+		db:         db,
+		skipHashes: cfg.SkipHashes,
+		ignore:     cfg.Ignore,
 	}
 
 	if err := idx.initDB(); err != nil {
@@ -85,6 +118,40 @@ func (i *Indexer) initDB() error {
 	CREATE INDEX IF NOT EXISTS idx_mod_time ON file_metadata(mod_time);
 	CREATE INDEX IF NOT EXISTS idx_mime_type ON file_metadata(mime_type);
 
+	CREATE TABLE IF NOT EXISTS file_tags (
+		path TEXT NOT NULL,
+		source TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		confidence REAL,
+		box TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tags_path ON file_tags(path);
+	CREATE INDEX IF NOT EXISTS idx_tags_name ON file_tags(name COLLATE NOCASE);
+
+	CREATE TABLE IF NOT EXISTS file_enrichment (
+		path TEXT NOT NULL,
+		source TEXT NOT NULL,
+		mod_time INTEGER,
+		enriched_at INTEGER,
+		error TEXT,
+		PRIMARY KEY (path, source)
+	);
+
+	CREATE TABLE IF NOT EXISTS file_removed (
+		path TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		removed_at INTEGER
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_removed_seq ON file_removed(seq);
+
+	CREATE TABLE IF NOT EXISTS index_state (
+		key TEXT PRIMARY KEY,
+		value INTEGER
+	);
+
 	CREATE TABLE IF NOT EXISTS scan_history (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		scan_path TEXT NOT NULL,
@@ -97,8 +164,10 @@ func (i *Indexer) initDB() error {
 	);
 	`
 
-	_, err := i.db.Exec(schema)
-	return err
+	if _, err := i.db.Exec(schema); err != nil {
+		return err
+	}
+	return i.migrateSeq()
 }
 
 // Scan performs file scanning according to options
@@ -134,6 +203,9 @@ func (i *Indexer) Scan(ctx context.Context, opts ScanOptions) (*ScanResult, erro
 	if err != nil {
 		return nil, fmt.Errorf("record scan history: %w", err)
 	}
+	if err := pruneTombstones(ctx, tx); err != nil {
+		return nil, fmt.Errorf("prune removed files: %w", err)
+	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("commit transaction: %w", err)
@@ -152,6 +224,55 @@ type ScanResult struct {
 	Errors       int       `json:"errors"`
 }
 
+// TaskHandler scans files for scheduler tasks of type TaskType
+func (i *Indexer) TaskHandler() scheduler.TaskHandler {
+	return func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		var opts ScanOptions
+		if path, ok := params["path"].(string); ok && path != "" {
+			opts.Paths = append(opts.Paths, path)
+		}
+		if paths, ok := params["paths"].([]interface{}); ok {
+			for _, path := range paths {
+				if path, ok := path.(string); ok && path != "" {
+					opts.Paths = append(opts.Paths, path)
+				}
+			}
+		}
+		if len(opts.Paths) == 0 {
+			return nil, fmt.Errorf("path or paths is required")
+		}
+		opts.Recursive, _ = params["recursive"].(bool)
+		opts.Incremental, _ = params["incremental"].(bool)
+
+		result, err := i.Scan(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		output := map[string]interface{}{
+			"files_scanned": result.FilesScanned,
+			"files_added":   result.FilesAdded,
+			"files_updated": result.FilesUpdated,
+			"errors":        result.Errors,
+		}
+
+		// New and changed files go through the enrichers right away
+		if enrich, ok := params["enrich"].(bool); (enrich || !ok) && i.hasEnrichers() {
+			var enrichOpts EnrichOptions
+			if len(opts.Paths) == 1 {
+				enrichOpts.Path = opts.Paths[0]
+			}
+			enriched, err := i.Enrich(ctx, enrichOpts)
+			if enriched != nil {
+				output["enrich"] = enrichOutput(enriched)
+			}
+			if err != nil {
+				return output, fmt.Errorf("enrich: %w", err)
+			}
+		}
+		return output, nil
+	}
+}
+
 // Stats summarizes indexer metadata for diagnostics.
 type Stats struct {
 	TotalFiles int
@@ -188,6 +309,7 @@ func (i *Indexer) scanPath(ctx context.Context, tx *sql.Tx, path string, opts Sc
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+		scheduler.Heartbeat(ctx)
 
 		// Skip if not recursive and not in root directory
 		if !opts.Recursive && filepath.Dir(filePath) != path {
@@ -197,6 +319,17 @@ func (i *Indexer) scanPath(ctx context.Context, tx *sql.Tx, path string, opts Sc
 			return nil
 		}
 
+		// Entries indexed before they were ignored are dropped
+		if filePath != path && i.ignore.Ignored(filePath, info.IsDir()) {
+			if err := i.forget(ctx, tx, filePath); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		result.FilesScanned++
 
 		// Check if incremental and file hasn't changed
@@ -219,7 +352,7 @@ func (i *Indexer) scanPath(ctx context.Context, tx *sql.Tx, path string, opts Sc
 		}
 
 		// Calculate MD5 for regular files
-		if !info.IsDir() && info.Size() < 100*1024*1024 { // Limit to 100MB
+		if !i.skipHashes && !info.IsDir() && info.Size() < 100*1024*1024 { // Limit to 100MB
 			if hash, err := calculateMD5(filePath); err == nil {
 				metadata.MD5Hash = hash
 			}
@@ -229,10 +362,19 @@ func (i *Indexer) scanPath(ctx context.Context, tx *sql.Tx, path string, opts Sc
 		metadata.MimeType = detectMimeType(filePath)
 
 		// Insert or update
+		// Rescanning an unchanged file keeps its sequence number, so it is
+		// not in the next delta
+		seq := i.nextSeq()
 		_, err = tx.Exec(`
-			INSERT INTO file_metadata (path, name, size, mod_time, is_dir, mime_type, md5_hash, indexed_at)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			INSERT INTO file_metadata (path, name, size, mod_time, is_dir, mime_type, md5_hash, indexed_at, seq, added_seq)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 			ON CONFLICT(path) DO UPDATE SET
+				seq = CASE WHEN file_metadata.size IS NOT excluded.size
+						OR file_metadata.mod_time IS NOT excluded.mod_time
+						OR file_metadata.is_dir IS NOT excluded.is_dir
+						OR file_metadata.mime_type IS NOT excluded.mime_type
+						OR file_metadata.md5_hash IS NOT excluded.md5_hash
+					THEN excluded.seq ELSE file_metadata.seq END,
 				name = excluded.name,
 				size = excluded.size,
 				mod_time = excluded.mod_time,
@@ -240,7 +382,7 @@ func (i *Indexer) scanPath(ctx context.Context, tx *sql.Tx, path string, opts Sc
 				md5_hash = excluded.md5_hash,
 				indexed_at = excluded.indexed_at
 		`, metadata.Path, metadata.Name, metadata.Size, metadata.ModTime.Unix(),
-			metadata.IsDir, metadata.MimeType, metadata.MD5Hash, metadata.IndexedAt.Unix())
+			metadata.IsDir, metadata.MimeType, metadata.MD5Hash, metadata.IndexedAt.Unix(), seq, seq)
 
 		if err != nil {
 			result.Errors++
@@ -267,6 +409,15 @@ func (i *Indexer) Search(ctx context.Context, query string, limit, offset int) (
 	if err != nil {
 		return nil, err
 	}
+	results, err := scanMetadata(rows)
+	if err != nil {
+		return nil, err
+	}
+	return results, i.attachTags(ctx, results)
+}
+
+// scanMetadata reads the file metadata rows selects and closes them
+func scanMetadata(rows *sql.Rows) ([]*FileMetadata, error) {
 	defer rows.Close()
 
 	var results []*FileMetadata
@@ -274,13 +425,17 @@ func (i *Indexer) Search(ctx context.Context, query string, limit, offset int) (
 		var m FileMetadata
 		var modTime, indexedAt int64
 		var isDir int
+		// Files without thumbnails, and hashes when they are skipped, are NULL
+		var md5Hash, thumbnailURL sql.NullString
 
 		err := rows.Scan(&m.ID, &m.Path, &m.Name, &m.Size, &modTime, &isDir,
-			&m.MimeType, &m.MD5Hash, &m.ThumbnailURL, &indexedAt)
+			&m.MimeType, &md5Hash, &thumbnailURL, &indexedAt)
 		if err != nil {
 			continue
 		}
 
+		m.MD5Hash = md5Hash.String
+		m.ThumbnailURL = thumbnailURL.String
 		m.ModTime = time.Unix(modTime, 0)
 		m.IndexedAt = time.Unix(indexedAt, 0)
 		m.IsDir = isDir != 0
@@ -292,24 +447,27 @@ func (i *Indexer) Search(ctx context.Context, query string, limit, offset int) (
 }
 
 // GetByPath retrieves file metadata by path
-func (i *Indexer) GetByPath(path string) (*FileMetadata, error) {
+func (i *Indexer) GetByPath(ctx context.Context, path string) (*FileMetadata, error) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
 	var m FileMetadata
 	var modTime, indexedAt int64
 	var isDir int
+	var md5Hash, thumbnailURL sql.NullString
 
-	err := i.db.QueryRow(`
+	err := i.db.QueryRowContext(ctx, `
 		SELECT id, path, name, size, mod_time, is_dir, mime_type, md5_hash, thumbnail_url, indexed_at
 		FROM file_metadata
 		WHERE path = ?
 	`, path).Scan(&m.ID, &m.Path, &m.Name, &m.Size, &modTime, &isDir,
-		&m.MimeType, &m.MD5Hash, &m.ThumbnailURL, &indexedAt)
+		&m.MimeType, &md5Hash, &thumbnailURL, &indexedAt)
 	if err != nil {
 		return nil, err
 	}
 
+	m.MD5Hash = md5Hash.String
+	m.ThumbnailURL = thumbnailURL.String
 	m.ModTime = time.Unix(modTime, 0)
 	m.IndexedAt = time.Unix(indexedAt, 0)
 	m.IsDir = isDir != 0
@@ -318,20 +476,51 @@ func (i *Indexer) GetByPath(path string) (*FileMetadata, error) {
 }
 
 // UpdateThumbnailURL updates the thumbnail URL for a file
-func (i *Indexer) UpdateThumbnailURL(path, thumbnailURL string) error {
+func (i *Indexer) UpdateThumbnailURL(ctx context.Context, path, thumbnailURL string) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	_, err := i.db.Exec("UPDATE file_metadata SET thumbnail_url = ? WHERE path = ?", thumbnailURL, path)
+	_, err := i.db.ExecContext(ctx, "UPDATE file_metadata SET thumbnail_url = ?, seq = ? WHERE path = ?", thumbnailURL, i.nextSeq(), path)
 	return err
 }
 
-// CleanupOrphans removes entries for non-existent files
+// forget removes path and everything below it from the index. The caller
+// holds i.mu.
+func (i *Indexer) forget(ctx context.Context, tx *sql.Tx, path string) error {
+	below := filepath.Clean(path) + "/"
+	rows, err := tx.QueryContext(ctx, "SELECT path FROM file_metadata WHERE path = ? OR substr(path, 1, length(?)) = ?", path, below, below)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return err
+		}
+		removed = append(removed, p)
+	}
+	rows.Close()
+	if err := i.recordRemovals(ctx, tx, removed); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"file_metadata", "file_tags", "file_enrichment"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE path = ? OR substr(path, 1, length(?)) = ?", path, below, below); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupOrphans removes entries for non-existent files, and for files
+// ignored since they were indexed
 func (i *Indexer) CleanupOrphans(ctx context.Context) (int, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	rows, err := i.db.QueryContext(ctx, "SELECT path FROM file_metadata")
+	rows, err := i.db.QueryContext(ctx, "SELECT path, is_dir FROM file_metadata")
 	if err != nil {
 		return 0, err
 	}
@@ -340,11 +529,12 @@ func (i *Indexer) CleanupOrphans(ctx context.Context) (int, error) {
 	var toDelete []string
 	for rows.Next() {
 		var path string
-		if err := rows.Scan(&path); err != nil {
+		var isDir int
+		if err := rows.Scan(&path, &isDir); err != nil {
 			continue
 		}
 
-		if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(path); os.IsNotExist(err) || i.ignore.Excluded(path, isDir != 0) {
 			toDelete = append(toDelete, path)
 		}
 	}
@@ -360,11 +550,15 @@ func (i *Indexer) CleanupOrphans(ctx context.Context) (int, error) {
 	defer tx.Rollback()
 
 	for _, path := range toDelete {
-		_, err := tx.Exec("DELETE FROM file_metadata WHERE path = ?", path)
-		if err != nil {
-			return 0, err
+		for _, table := range []string{"file_metadata", "file_tags", "file_enrichment"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE path = ?", path); err != nil {
+				return 0, err
+			}
 		}
 	}
+	if err := i.recordRemovals(ctx, tx, toDelete); err != nil {
+		return 0, err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return 0, err
@@ -402,6 +596,10 @@ func detectMimeType(filePath string) string {
 		return "image/png"
 	case ".gif":
 		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".heic", ".heif":
+		return "image/heif"
 	case ".mp4":
 		return "video/mp4"
 	case ".pdf":
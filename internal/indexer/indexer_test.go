@@ -0,0 +1,57 @@
+package indexer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanHashesAndCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		config    Config
+		hash      string
+		cacheSize int
+	}{
+		{"defaults", Config{}, "5d41402abc4b2a76b9719d911017c592", -2000},
+		{"low memory", Config{CacheSizeKB: 512, SkipHashes: true}, "", -512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.config
+			cfg.DBPath = filepath.Join(t.TempDir(), "index.db")
+			idx, err := New(&cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			defer idx.Close()
+
+			var cacheSize int
+			if err := idx.db.QueryRow("PRAGMA cache_size").Scan(&cacheSize); err != nil {
+				t.Fatalf("PRAGMA cache_size: %v", err)
+			}
+			if cacheSize != tt.cacheSize {
+				t.Fatalf("expected cache_size %d, got %d", tt.cacheSize, cacheSize)
+			}
+
+			if _, err := idx.Scan(context.Background(), ScanOptions{Paths: []string{dir}, Recursive: true}); err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+			file, err := idx.GetByPath(context.Background(), path)
+			if err != nil {
+				t.Fatalf("GetByPath: %v", err)
+			}
+			if file.Size != 5 || file.MD5Hash != tt.hash {
+				t.Fatalf("expected size 5 and hash %q, got %d %q", tt.hash, file.Size, file.MD5Hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// Package jobs runs slow operations, such as network mounts, in the
+// background so API requests can return immediately and be polled.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
+)
+
+// Job states
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCanceled  = "canceled"
+)
+
+// Errors of job lookups and cancellation
+var (
+	ErrNotFound      = errors.New("job not found")
+	ErrNotCancelable = errors.New("job cannot be canceled")
+)
+
+// Job is a background operation and its outcome
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Resource   string     `json:"resource,omitempty"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Progress is the latest progress the job reported with SetProgress
+	Progress interface{} `json:"progress,omitempty"`
+	// Cancelable jobs stop when canceled with Cancel
+	Cancelable bool `json:"cancelable,omitempty"`
+}
+
+// Manager tracks recent jobs
+type Manager struct {
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc // Of running cancelable jobs
+	order   []string
+	maxJobs int
+	bus     *events.Bus
+	mu      sync.RWMutex
+}
+
+// Config represents job manager configuration
+type Config struct {
+	// MaxJobs is how many jobs are kept; the oldest finished jobs are
+	// dropped first
+	MaxJobs int
+	Bus     *events.Bus
+}
+
+// New creates a new job manager
+func New(cfg *Config) *Manager {
+	maxJobs := cfg.MaxJobs
+	if maxJobs <= 0 {
+		maxJobs = 100
+	}
+
+	return &Manager{
+		jobs:    make(map[string]*Job),
+		cancels: make(map[string]context.CancelFunc),
+		maxJobs: maxJobs,
+		bus:     cfg.Bus,
+	}
+}
+
+// Submit starts fn in the background and returns the running job. fn gets
+// a context that is not tied to the request that submitted it, so it must
+// bound its own run time.
+func (m *Manager) Submit(jobType, resource string, fn func(ctx context.Context) error) *Job {
+	return m.submit(jobType, resource, false, fn)
+}
+
+// SubmitCancelable starts fn like Submit, but Cancel cancels the context
+// fn gets. fn should return soon after and undo what it left half done.
+func (m *Manager) SubmitCancelable(jobType, resource string, fn func(ctx context.Context) error) *Job {
+	return m.submit(jobType, resource, true, fn)
+}
+
+func (m *Manager) submit(jobType, resource string, cancelable bool, fn func(ctx context.Context) error) *Job {
+	job := &Job{
+		ID:         generateID(),
+		Type:       jobType,
+		Resource:   resource,
+		State:      StateRunning,
+		CreatedAt:  time.Now(),
+		Cancelable: cancelable,
+	}
+
+	// Jobs outlive the request that submitted them, so they start traces
+	// of their own
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, jobContextKey{}, &jobRef{manager: m, id: job.ID})
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	if cancelable {
+		m.cancels[job.ID] = cancel
+	}
+	m.order = append(m.order, job.ID)
+	m.prune()
+	snapshot := *job
+	m.mu.Unlock()
+
+	go m.run(ctx, cancel, job, fn)
+
+	return &snapshot
+}
+
+// Cancel asks a running cancelable job to stop. The job ends in the
+// canceled state once its function returns.
+func (m *Manager) Cancel(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	cancel, ok := m.cancels[id]
+	if !ok {
+		if job.State != StateRunning {
+			return nil, fmt.Errorf("%w: job %s has finished", ErrNotCancelable, id)
+		}
+		return nil, fmt.Errorf("%w: %s jobs run to completion", ErrNotCancelable, job.Type)
+	}
+	cancel()
+
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+type jobContextKey struct{}
+
+type jobRef struct {
+	manager *Manager
+	id      string
+}
+
+// SetProgress records the progress of the job running with ctx, for
+// clients polling it. progress is shown as is and must not be modified
+// afterwards. Outside a job it does nothing.
+func SetProgress(ctx context.Context, progress interface{}) {
+	ref, _ := ctx.Value(jobContextKey{}).(*jobRef)
+	if ref == nil {
+		return
+	}
+	ref.manager.mu.Lock()
+	defer ref.manager.mu.Unlock()
+	if job, exists := ref.manager.jobs[ref.id]; exists && job.State == StateRunning {
+		job.Progress = progress
+	}
+}
+
+// Get returns a job by ID
+func (m *Manager) Get(id string) (*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+// List returns all kept jobs, newest first
+func (m *Manager) List() []*Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		jobCopy := *m.jobs[m.order[i]]
+		jobs = append(jobs, &jobCopy)
+	}
+	return jobs
+}
+
+func (m *Manager) run(ctx context.Context, cancel context.CancelFunc, job *Job, fn func(ctx context.Context) error) {
+	ctx, span := telemetry.Start(ctx, "job "+job.Type)
+	span.SetAttribute("job.id", job.ID)
+	span.SetAttribute("job.resource", job.Resource)
+	err := fn(ctx)
+	span.SetError(err)
+	span.End()
+	canceled := ctx.Err() != nil
+	cancel()
+
+	m.mu.Lock()
+	delete(m.cancels, job.ID)
+	now := time.Now()
+	job.FinishedAt = &now
+	switch {
+	case err != nil && canceled:
+		job.State = StateCanceled
+		job.Error = err.Error()
+	case err != nil:
+		job.State = StateFailed
+		job.Error = err.Error()
+	default:
+		job.State = StateSucceeded
+	}
+	snapshot := *job
+	m.mu.Unlock()
+
+	m.bus.Publish("job."+snapshot.State, &snapshot)
+}
+
+// prune drops the oldest finished jobs beyond maxJobs. Running jobs are
+// always kept so they can still be polled.
+func (m *Manager) prune() {
+	excess := len(m.order) - m.maxJobs
+	if excess <= 0 {
+		return
+	}
+
+	kept := m.order[:0]
+	for _, id := range m.order {
+		if excess > 0 && m.jobs[id].State != StateRunning {
+			delete(m.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitFinished(t *testing.T, m *Manager, id string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if job.State != StateRunning {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return nil
+}
+
+func TestCancelStopsJob(t *testing.T) {
+	m := New(&Config{})
+	started := make(chan struct{})
+	job := m.SubmitCancelable("file.copy", "/data/a", func(ctx context.Context) error {
+		SetProgress(ctx, map[string]int{"files_done": 3})
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	<-started
+
+	if running, _ := m.Get(job.ID); running.Progress == nil {
+		t.Fatal("expected the reported progress")
+	}
+	if _, err := m.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if finished := waitFinished(t, m, job.ID); finished.State != StateCanceled {
+		t.Fatalf("expected a canceled job, got %+v", finished)
+	}
+	if _, err := m.Cancel(job.ID); !errors.Is(err, ErrNotCancelable) {
+		t.Fatalf("expected a finished job not to be cancelable, got %v", err)
+	}
+}
+
+func TestCancelRequiresCancelableJob(t *testing.T) {
+	m := New(&Config{})
+	release := make(chan struct{})
+	job := m.Submit("netdisk.mount", "share-1", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	if _, err := m.Cancel(job.ID); !errors.Is(err, ErrNotCancelable) {
+		t.Fatalf("expected ErrNotCancelable, got %v", err)
+	}
+	close(release)
+	if finished := waitFinished(t, m, job.ID); finished.State != StateSucceeded {
+		t.Fatalf("expected the job to succeed, got %+v", finished)
+	}
+	if _, err := m.Cancel("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+// Package maintenance holds the agent-wide maintenance switch. While it is
+// on, the API rejects requests that change state, for example during
+// backups or migrations. The switch survives restarts.
+package maintenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// Status describes the maintenance switch
+type Status struct {
+	Enabled   bool      `json:"enabled"`
+	Reason    string    `json:"reason,omitempty"`
+	User      string    `json:"user,omitempty"` // Who last toggled the switch
+	ChangedAt time.Time `json:"changed_at,omitempty"`
+}
+
+// Mode is the maintenance switch
+type Mode struct {
+	stateFile string
+	status    Status
+	bus       *events.Bus
+	mu        sync.RWMutex
+}
+
+// Config represents maintenance mode configuration
+type Config struct {
+	StateFile string
+}
+
+// New creates the maintenance switch, restoring its state from StateFile
+func New(cfg *Config) (*Mode, error) {
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "/var/lib/mingyue-agent/maintenance.json"
+	}
+
+	m := &Mode{stateFile: stateFile}
+	if err := statefile.Read(stateFile, &m.status); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+	return m, nil
+}
+
+// SetEventBus publishes maintenance.enabled and maintenance.disabled events
+// to bus
+func (m *Mode) SetEventBus(bus *events.Bus) {
+	m.bus = bus
+}
+
+// Enabled reports whether maintenance mode is on
+func (m *Mode) Enabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status.Enabled
+}
+
+// Status returns the current state of the switch
+func (m *Mode) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// Set turns maintenance mode on or off and records who did it and why
+func (m *Mode) Set(enabled bool, user, reason string) (Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := Status{
+		Enabled:   enabled,
+		Reason:    reason,
+		User:      user,
+		ChangedAt: time.Now(),
+	}
+	if err := m.save(&status); err != nil {
+		return m.status, err
+	}
+	m.status = status
+
+	eventType := "maintenance.disabled"
+	if enabled {
+		eventType = "maintenance.enabled"
+	}
+	m.bus.Publish(eventType, status)
+	return status, nil
+}
+
+func (m *Mode) save(status *Status) error {
+	if err := os.MkdirAll(filepath.Dir(m.stateFile), 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := statefile.Write(m.stateFile, data, statefile.PrivateMode); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package maintenance
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStatePersists(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "maintenance.json")
+
+	mode, err := New(&Config{StateFile: stateFile})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if mode.Enabled() {
+		t.Fatalf("maintenance mode should start disabled")
+	}
+	if _, err := mode.Set(true, "admin", "migration"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	reloaded, err := New(&Config{StateFile: stateFile})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	status := reloaded.Status()
+	if !status.Enabled || status.User != "admin" || status.Reason != "migration" {
+		t.Fatalf("unexpected status after reload: %+v", status)
+	}
+}
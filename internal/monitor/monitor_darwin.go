@@ -3,22 +3,55 @@
 package monitor
 
 import (
+	"encoding/binary"
 	"fmt"
+	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func (m *Monitor) getMemoryStats() (MemoryStats, error) {
-	// For macOS, we can use syscall to get page size and vm_stat
-	// For now, return basic stats with zero values
-	// A production implementation would use sysctl or vm_stat
-	return MemoryStats{
-		Total:       0,
-		Available:   0,
-		Used:        0,
-		UsedPercent: 0,
-		SwapTotal:   0,
-		SwapUsed:    0,
-	}, nil
+	total, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return MemoryStats{}, fmt.Errorf("sysctl hw.memsize: %w", err)
+	}
+
+	pageSize, err := unix.SysctlUint32("hw.pagesize")
+	if err != nil {
+		return MemoryStats{}, fmt.Errorf("sysctl hw.pagesize: %w", err)
+	}
+
+	// Free pages plus purgeable and speculative pages the kernel can reclaim
+	// without swapping approximate what Activity Monitor shows as available
+	var availablePages uint64
+	for _, name := range []string{"vm.page_free_count", "vm.page_purgeable_count", "vm.page_speculative_count"} {
+		if count, err := unix.SysctlUint32(name); err == nil {
+			availablePages += uint64(count)
+		}
+	}
+	available := availablePages * uint64(pageSize)
+	if available > total {
+		available = total
+	}
+	used := total - available
+
+	stats := MemoryStats{
+		Total:     total,
+		Available: available,
+		Used:      used,
+	}
+	if total > 0 {
+		stats.UsedPercent = float64(used) / float64(total) * 100
+	}
+
+	// struct xsw_usage { u_int64_t xsu_total, xsu_avail, xsu_used; ... }
+	if raw, err := unix.SysctlRaw("vm.swapusage"); err == nil && len(raw) >= 24 {
+		stats.SwapTotal = binary.LittleEndian.Uint64(raw[0:8])
+		stats.SwapUsed = binary.LittleEndian.Uint64(raw[16:24])
+	}
+
+	return stats, nil
 }
 
 func (m *Monitor) getDiskStats(path string) (DiskStats, error) {
@@ -49,13 +82,32 @@ func (m *Monitor) getDiskStats(path string) (DiskStats, error) {
 }
 
 func getLoadAverage() ([3]float64, error) {
-	// macOS doesn't have Sysinfo, but we can use getloadavg syscall
-	// For now, return zeros
-	return [3]float64{0, 0, 0}, nil
+	// struct loadavg { fixpt_t ldavg[3]; long fscale; }
+	raw, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil {
+		return [3]float64{}, fmt.Errorf("sysctl vm.loadavg: %w", err)
+	}
+	if len(raw) < 24 {
+		return [3]float64{}, fmt.Errorf("unexpected vm.loadavg size %d", len(raw))
+	}
+
+	scale := float64(binary.LittleEndian.Uint64(raw[16:24]))
+	if scale == 0 {
+		return [3]float64{}, fmt.Errorf("vm.loadavg reported zero scale")
+	}
+
+	return [3]float64{
+		float64(binary.LittleEndian.Uint32(raw[0:4])) / scale,
+		float64(binary.LittleEndian.Uint32(raw[4:8])) / scale,
+		float64(binary.LittleEndian.Uint32(raw[8:12])) / scale,
+	}, nil
 }
 
 func countOpenFiles() int {
-	// macOS doesn't have /proc, would need to use lsof or other methods
-	// Return 0 for now
-	return 0
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return 0
+	}
+	// Reading the directory opens one descriptor of its own
+	return len(entries) - 1
 }
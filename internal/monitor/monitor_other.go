@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !windows
+
+package monitor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (m *Monitor) getMemoryStats() (MemoryStats, error) {
+	return MemoryStats{}, fmt.Errorf("memory statistics are not supported on %s", runtime.GOOS)
+}
+
+func (m *Monitor) getDiskStats(path string) (DiskStats, error) {
+	return DiskStats{}, fmt.Errorf("disk statistics are not supported on %s", runtime.GOOS)
+}
+
+func getLoadAverage() ([3]float64, error) {
+	return [3]float64{}, fmt.Errorf("load average is not supported on %s", runtime.GOOS)
+}
+
+func countOpenFiles() int {
+	return 0
+}
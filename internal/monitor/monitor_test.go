@@ -0,0 +1,83 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// The platform files read different sources, so these checks only assert
+// what must hold everywhere the agent runs
+
+func TestMemoryStats(t *testing.T) {
+	stats, err := New().getMemoryStats()
+	if err != nil {
+		t.Fatalf("getMemoryStats on %s: %v", runtime.GOOS, err)
+	}
+	if stats.Total == 0 || stats.Available > stats.Total || stats.Used != stats.Total-stats.Available {
+		t.Fatalf("inconsistent memory stats %+v", stats)
+	}
+	if stats.UsedPercent < 0 || stats.UsedPercent > 100 {
+		t.Fatalf("used percent out of range: %+v", stats)
+	}
+	if stats.SwapUsed > stats.SwapTotal {
+		t.Fatalf("more swap used than available: %+v", stats)
+	}
+}
+
+func TestDiskStats(t *testing.T) {
+	stats, err := New().getDiskStats(t.TempDir())
+	if err != nil {
+		t.Fatalf("getDiskStats on %s: %v", runtime.GOOS, err)
+	}
+	if stats.Total == 0 || stats.Free > stats.Total || stats.Used != stats.Total-stats.Free {
+		t.Fatalf("inconsistent disk stats %+v", stats)
+	}
+
+	// Windows reports the drive a path is on, whether it exists or not
+	if runtime.GOOS != "windows" {
+		if _, err := New().getDiskStats(filepath.Join(t.TempDir(), "missing")); err == nil {
+			t.Fatal("expected an error for a missing path")
+		}
+	}
+}
+
+func TestLoadAverage(t *testing.T) {
+	load, err := getLoadAverage()
+	if err != nil {
+		t.Fatalf("getLoadAverage on %s: %v", runtime.GOOS, err)
+	}
+	for i, value := range load {
+		if value < 0 {
+			t.Fatalf("negative load average %d: %v", i, load)
+		}
+	}
+}
+
+func TestCountOpenFiles(t *testing.T) {
+	before := countOpenFiles()
+	if before <= 0 {
+		t.Fatalf("expected open descriptors, got %d", before)
+	}
+
+	f, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	if after := countOpenFiles(); after <= before {
+		t.Fatalf("expected the count to grow past %d, got %d", before, after)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	stats, err := New().GetStats()
+	if err != nil {
+		t.Fatalf("GetStats: %v", err)
+	}
+	if stats.CPU.Cores != runtime.NumCPU() || stats.Process.PID != os.Getpid() || stats.Memory.Total == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
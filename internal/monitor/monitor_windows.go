@@ -2,28 +2,95 @@
 
 package monitor
 
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32                 = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalMemoryStatusEx = kernel32.NewProc("GlobalMemoryStatusEx")
+	procGetProcessHandleCnt  = kernel32.NewProc("GetProcessHandleCount")
+)
+
+// memoryStatusEx mirrors MEMORYSTATUSEX
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
 func (m *Monitor) getMemoryStats() (MemoryStats, error) {
-	// Windows would use GlobalMemoryStatusEx
-	// For now, return basic stats with zero values
-	return MemoryStats{
-		Total:       0,
-		Available:   0,
-		Used:        0,
-		UsedPercent: 0,
-		SwapTotal:   0,
-		SwapUsed:    0,
-	}, nil
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+
+	ret, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
+		return MemoryStats{}, fmt.Errorf("GlobalMemoryStatusEx: %w", err)
+	}
+
+	stats := MemoryStats{
+		Total:     status.TotalPhys,
+		Available: status.AvailPhys,
+		Used:      status.TotalPhys - status.AvailPhys,
+	}
+	if status.TotalPhys > 0 {
+		stats.UsedPercent = float64(stats.Used) / float64(status.TotalPhys) * 100
+	}
+
+	// The page file total includes physical memory
+	if status.TotalPageFile > status.TotalPhys {
+		stats.SwapTotal = status.TotalPageFile - status.TotalPhys
+		committed := status.TotalPageFile - status.AvailPageFile
+		if committed > stats.Used {
+			stats.SwapUsed = committed - stats.Used
+		}
+		if stats.SwapUsed > stats.SwapTotal {
+			stats.SwapUsed = stats.SwapTotal
+		}
+	}
+
+	return stats, nil
 }
 
 func (m *Monitor) getDiskStats(path string) (DiskStats, error) {
-	// Windows uses GetDiskFreeSpaceEx
-	// For a basic implementation, return zeros
-	return DiskStats{
-		Total:       0,
-		Free:        0,
-		Used:        0,
-		UsedPercent: 0,
-	}, nil
+	// "/" resolves to the root of the current drive
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return DiskStats{}, fmt.Errorf("resolve path: %w", err)
+	}
+	root := filepath.VolumeName(abs) + `\`
+
+	rootPtr, err := windows.UTF16PtrFromString(root)
+	if err != nil {
+		return DiskStats{}, fmt.Errorf("encode path: %w", err)
+	}
+
+	var freeToCaller, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(rootPtr, &freeToCaller, &total, &free); err != nil {
+		return DiskStats{}, fmt.Errorf("GetDiskFreeSpaceEx: %w", err)
+	}
+
+	used := total - free
+	stats := DiskStats{
+		Total: total,
+		Free:  free,
+		Used:  used,
+	}
+	if total > 0 {
+		stats.UsedPercent = float64(used) / float64(total) * 100
+	}
+
+	return stats, nil
 }
 
 func getLoadAverage() ([3]float64, error) {
@@ -32,6 +99,11 @@ func getLoadAverage() ([3]float64, error) {
 }
 
 func countOpenFiles() int {
-	// Windows doesn't track open files in the same way
-	return 0
+	// Handles include files, sockets, threads and other kernel objects
+	var count uint32
+	ret, _, _ := procGetProcessHandleCnt.Call(uintptr(windows.CurrentProcess()), uintptr(unsafe.Pointer(&count)))
+	if ret == 0 {
+		return 0
+	}
+	return int(count)
 }
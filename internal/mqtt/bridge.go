@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+// Bridge republishes event bus events to an MQTT broker under
+// <prefix>/<agent id>/<event type with dots as slashes>
+type Bridge struct {
+	opts   ClientOptions
+	prefix string
+	retain bool
+	bus    *events.Bus
+	filter *events.Filter
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// BridgeConfig represents MQTT bridge configuration
+type BridgeConfig struct {
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	TopicPrefix string // Defaults to "mingyue/agent/<AgentID>"
+	AgentID     string
+	Retain      bool
+	EventTypes  []string // Event type patterns to publish; empty publishes all
+}
+
+// NewBridge creates a bridge for bus. Call Start to connect.
+func NewBridge(cfg *BridgeConfig, bus *events.Bus) *Bridge {
+	prefix := strings.TrimSuffix(cfg.TopicPrefix, "/")
+	if prefix == "" {
+		prefix = "mingyue/agent/" + cfg.AgentID
+	}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "mingyue-agent-" + cfg.AgentID
+	}
+
+	return &Bridge{
+		opts: ClientOptions{
+			Broker:      cfg.Broker,
+			ClientID:    clientID,
+			Username:    cfg.Username,
+			Password:    cfg.Password,
+			WillTopic:   prefix + "/status",
+			WillPayload: []byte("offline"),
+			WillRetain:  true,
+		},
+		prefix: prefix,
+		retain: cfg.Retain,
+		bus:    bus,
+		filter: &events.Filter{Types: cfg.EventTypes},
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Start connects to the broker in the background, reconnecting with backoff
+func (b *Bridge) Start() {
+	b.wg.Add(1)
+	go b.run()
+}
+
+// Stop disconnects from the broker
+func (b *Bridge) Stop() {
+	close(b.stopCh)
+	b.wg.Wait()
+}
+
+// Topic returns the MQTT topic an event type is published on
+func (b *Bridge) Topic(eventType string) string {
+	return b.prefix + "/" + strings.ReplaceAll(eventType, ".", "/")
+}
+
+// resourceTopics are the event types published on a topic per resource,
+// so a retained message is kept for each, with the data field naming it
+var resourceTopics = map[string]string{
+	"disk.smart": "name",
+}
+
+// eventTopic returns the MQTT topic of event
+func (b *Bridge) eventTopic(event *events.Event) string {
+	topic := b.Topic(event.Type)
+	field, ok := resourceTopics[event.Type]
+	if !ok {
+		return topic
+	}
+	data, _ := event.Data.(map[string]interface{})
+	if name, _ := data[field].(string); name != "" && !strings.ContainsAny(name, "/+#") {
+		topic += "/" + name
+	}
+	return topic
+}
+
+func (b *Bridge) run() {
+	defer b.wg.Done()
+
+	sub := b.bus.Subscribe(b.filter, 256)
+	defer sub.Close()
+
+	backoff := time.Second
+	for {
+		client, err := Dial(b.opts)
+		if err != nil {
+			log.Printf("mqtt bridge: %v (retrying in %s)", err, backoff)
+			select {
+			case <-b.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		client.Publish(b.prefix+"/status", []byte("online"), true)
+		if b.forward(client, sub) {
+			client.Publish(b.prefix+"/status", []byte("offline"), true)
+			client.Close()
+			return
+		}
+		client.Close()
+	}
+}
+
+// forward publishes events until the connection drops or the bridge stops.
+// It returns true when stopped.
+func (b *Bridge) forward(client *Client, sub *events.Subscription) bool {
+	for {
+		select {
+		case <-b.stopCh:
+			return true
+		case <-client.Done():
+			log.Printf("mqtt bridge: connection lost")
+			return false
+		case event, ok := <-sub.C:
+			if !ok {
+				return true
+			}
+
+			payload, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if err := client.Publish(b.eventTopic(event), payload, b.retain); err != nil {
+				log.Printf("mqtt bridge: publish %s: %v", event.Type, err)
+				return false
+			}
+		}
+	}
+}
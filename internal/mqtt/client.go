@@ -0,0 +1,284 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	packetConnect    byte = 0x10
+	packetConnack    byte = 0x20
+	packetPublish    byte = 0x30
+	packetPingreq    byte = 0xC0
+	packetDisconnect byte = 0xE0
+)
+
+// ClientOptions configures a broker connection
+type ClientOptions struct {
+	Broker      string // tcp://host:1883, ssl://host:8883 or tls://host:8883
+	ClientID    string
+	Username    string
+	Password    string
+	KeepAlive   time.Duration
+	WillTopic   string
+	WillPayload []byte
+	WillRetain  bool
+}
+
+// Client is a minimal MQTT 3.1.1 client supporting QoS 0 publishing, which
+// is all the bridge needs
+type Client struct {
+	opts ClientOptions
+	mu   sync.Mutex
+	conn net.Conn
+	done chan struct{}
+}
+
+// Dial connects to the broker and completes the MQTT handshake
+func Dial(opts ClientOptions) (*Client, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 60 * time.Second
+	}
+
+	broker, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("parse broker URL: %w", err)
+	}
+
+	dialer := httpclient.Dialer(10 * time.Second)
+	var conn net.Conn
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", brokerAddr(broker, "1883"))
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", brokerAddr(broker, "8883"), &tls.Config{
+			ServerName: broker.Hostname(),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme: %s", broker.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to broker: %w", err)
+	}
+
+	c := &Client{
+		opts: opts,
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	go c.pingLoop()
+
+	return c, nil
+}
+
+// Publish sends payload to topic with QoS 0
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	var body bytes.Buffer
+	writeString(&body, topic)
+	body.Write(payload)
+
+	header := packetPublish
+	if retain {
+		header |= 0x01
+	}
+
+	return c.writePacket(header, body.Bytes())
+}
+
+// Done is closed when the connection is lost
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close disconnects cleanly from the broker
+func (c *Client) Close() error {
+	c.writePacket(packetDisconnect, nil)
+	return c.conn.Close()
+}
+
+func (c *Client) handshake() error {
+	var body bytes.Buffer
+	writeString(&body, "MQTT")
+	body.WriteByte(4) // protocol level 3.1.1
+
+	flags := byte(0x02) // clean session
+	if c.opts.WillTopic != "" {
+		flags |= 0x04
+		if c.opts.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if c.opts.Username != "" {
+		flags |= 0x80
+		if c.opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(c.opts.KeepAlive/time.Second))
+
+	writeString(&body, c.opts.ClientID)
+	if c.opts.WillTopic != "" {
+		writeString(&body, c.opts.WillTopic)
+		writeBytes(&body, c.opts.WillPayload)
+	}
+	if c.opts.Username != "" {
+		writeString(&body, c.opts.Username)
+		if c.opts.Password != "" {
+			writeString(&body, c.opts.Password)
+		}
+	}
+
+	if err := c.writePacket(packetConnect, body.Bytes()); err != nil {
+		return fmt.Errorf("send connect: %w", err)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return fmt.Errorf("read connack: %w", err)
+	}
+	if reply[0] != packetConnack {
+		return fmt.Errorf("unexpected packet 0x%02x waiting for connack", reply[0])
+	}
+	if reply[3] != 0 {
+		return fmt.Errorf("broker refused connection: %s", connackReason(reply[3]))
+	}
+
+	return nil
+}
+
+func (c *Client) writePacket(header byte, body []byte) error {
+	var packet bytes.Buffer
+	packet.WriteByte(header)
+	writeRemainingLength(&packet, len(body))
+	packet.Write(body)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet.Bytes())
+	return err
+}
+
+// readLoop discards incoming packets (PINGRESP) and detects disconnects
+func (c *Client) readLoop() {
+	defer close(c.done)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		if _, err := reader.ReadByte(); err != nil {
+			return
+		}
+		length, err := readRemainingLength(reader)
+		if err != nil {
+			return
+		}
+		if _, err := reader.Discard(length); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.opts.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writePacket(packetPingreq, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeBytes(buf, []byte(s))
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+func writeRemainingLength(buf *bytes.Buffer, length int) {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		buf.WriteByte(digit)
+		if length == 0 {
+			return
+		}
+	}
+}
+
+func readRemainingLength(reader *bufio.Reader) (int, error) {
+	length := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length += int(digit&0x7F) * multiplier
+		if digit&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, fmt.Errorf("malformed remaining length")
+}
+
+func brokerAddr(broker *url.URL, defaultPort string) string {
+	port := broker.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(broker.Hostname(), port)
+}
+
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("code %d", code)
+	}
+}
@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+func TestRemainingLength(t *testing.T) {
+	tests := []struct {
+		length  int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{268435455, []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		writeRemainingLength(&buf, tt.length)
+		if !bytes.Equal(buf.Bytes(), tt.encoded) {
+			t.Errorf("%d: expected % X, got % X", tt.length, tt.encoded, buf.Bytes())
+		}
+		decoded, err := readRemainingLength(bufio.NewReader(bytes.NewReader(tt.encoded)))
+		if err != nil || decoded != tt.length {
+			t.Errorf("% X: expected %d, got %d, %v", tt.encoded, tt.length, decoded, err)
+		}
+	}
+
+	if _, err := readRemainingLength(bufio.NewReader(bytes.NewReader([]byte{0x80, 0x80, 0x80, 0x80, 0x01}))); err == nil {
+		t.Error("expected a five byte length to be rejected")
+	}
+}
+
+// readPacket reads one packet as sent on the wire
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	var packet bytes.Buffer
+	packet.WriteByte(header)
+	writeRemainingLength(&packet, length)
+	packet.Write(body)
+	return packet.Bytes(), nil
+}
+
+func TestClientPackets(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lis.Close()
+
+	packets := make(chan []byte, 8)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(packets)
+		reader := bufio.NewReader(conn)
+		for accepted := false; ; accepted = true {
+			packet, err := readPacket(reader)
+			if err != nil {
+				return
+			}
+			packets <- packet
+			if !accepted {
+				conn.Write([]byte{packetConnack, 0x02, 0x00, 0x00})
+			}
+		}
+	}()
+
+	client, err := Dial(ClientOptions{
+		Broker:      "tcp://" + lis.Addr().String(),
+		ClientID:    "agent",
+		Username:    "u",
+		Password:    "p",
+		KeepAlive:   time.Minute,
+		WillTopic:   "t",
+		WillPayload: []byte("x"),
+		WillRetain:  true,
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if err := client.Publish("a/b", []byte("hi"), true); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := client.Publish("a/b", []byte("hi"), false); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	client.Close()
+
+	expected := [][]byte{
+		// CONNECT: protocol MQTT level 4; flags user name, password, will
+		// retain, will and clean session; keep alive 60
+		{0x10, 0x1D, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xE6, 0x00, 0x3C,
+			0x00, 0x05, 'a', 'g', 'e', 'n', 't',
+			0x00, 0x01, 't', 0x00, 0x01, 'x',
+			0x00, 0x01, 'u', 0x00, 0x01, 'p'},
+		{0x31, 0x07, 0x00, 0x03, 'a', '/', 'b', 'h', 'i'},
+		{0x30, 0x07, 0x00, 0x03, 'a', '/', 'b', 'h', 'i'},
+		{0xE0, 0x00},
+	}
+	for i, want := range expected {
+		select {
+		case got, ok := <-packets:
+			if !ok {
+				t.Fatalf("packet %d not received", i)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("packet %d: expected % X, got % X", i, want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d not received", i)
+		}
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readPacket(bufio.NewReader(conn))
+		conn.Write([]byte{packetConnack, 0x02, 0x00, 0x05})
+	}()
+
+	if _, err := Dial(ClientOptions{Broker: "tcp://" + lis.Addr().String(), ClientID: "agent"}); err == nil || err.Error() != "broker refused connection: not authorized" {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+}
+
+func TestBridgeTopics(t *testing.T) {
+	b := NewBridge(&BridgeConfig{AgentID: "nas"}, nil)
+	tests := []struct {
+		event    events.Event
+		expected string
+	}{
+		{events.Event{Type: "system.stats"}, "mingyue/agent/nas/system/stats"},
+		{events.Event{Type: "disk.smart", Data: map[string]interface{}{"name": "sda"}}, "mingyue/agent/nas/disk/smart/sda"},
+		{events.Event{Type: "disk.smart", Data: map[string]interface{}{"name": "nvme0n1"}}, "mingyue/agent/nas/disk/smart/nvme0n1"},
+		{events.Event{Type: "disk.smart", Data: map[string]interface{}{"name": "a/#"}}, "mingyue/agent/nas/disk/smart"},
+	}
+	for _, tt := range tests {
+		if got := b.eventTopic(&tt.event); got != tt.expected {
+			t.Errorf("expected %s, got %s", tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package netdisk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files read when importing mounts
+var (
+	fstabFile  = "/etc/fstab"
+	mountsFile = "/proc/mounts"
+)
+
+// fstabOnlyOptions are fstab options that mean nothing to mount -o
+var fstabOnlyOptions = map[string]bool{
+	"defaults": true,
+	"auto":     true,
+	"noauto":   true,
+	"nofail":   true,
+	"_netdev":  true,
+	"user":     true,
+	"users":    true,
+	"nouser":   true,
+}
+
+// ImportSkip is an fstab entry that was not imported
+type ImportSkip struct {
+	Source     string `json:"source"`
+	MountPoint string `json:"mount_point"`
+	Reason     string `json:"reason"`
+}
+
+// ImportReport lists the outcome of importing fstab
+type ImportReport struct {
+	Imported []*Share     `json:"imported"`
+	Skipped  []ImportSkip `json:"skipped"`
+}
+
+// ImportFstab adopts the CIFS and NFS mounts listed in /etc/fstab, so an
+// existing server does not need them to be recreated. Imported shares are
+// marked as such and keep the fstab options; entries marked noauto are
+// not mounted automatically. Passwords are encrypted like those of added
+// shares. The fstab entries themselves are left in place.
+func (m *Manager) ImportFstab(ctx context.Context) (*ImportReport, error) {
+	entries, err := parseFstab(fstabFile)
+	if err != nil {
+		return nil, fmt.Errorf("read fstab: %w", err)
+	}
+	mounted := mountedPoints()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := &ImportReport{Imported: []*Share{}, Skipped: []ImportSkip{}}
+	now := time.Now()
+	var added []string
+	for i, entry := range entries {
+		share := entry.share
+		if reason := m.importConflict(share); reason != "" {
+			report.Skipped = append(report.Skipped, ImportSkip{Source: entry.source, MountPoint: share.MountPoint, Reason: reason})
+			continue
+		}
+		if share.Password != "" {
+			encrypted, err := m.encrypt(share.Password)
+			if err != nil {
+				return nil, fmt.Errorf("encrypt password: %w", err)
+			}
+			share.Password = encrypted
+		}
+
+		share.ID = fmt.Sprintf("%s-%s-%d-%d", share.Protocol, share.Host, now.Unix(), i)
+		share.Imported = true
+		share.Mounted = mounted[share.MountPoint]
+		share.Healthy = share.Mounted
+		m.shares[share.ID] = share
+		added = append(added, share.ID)
+
+		shareCopy := *share
+		shareCopy.Password = ""
+		report.Imported = append(report.Imported, &shareCopy)
+	}
+	if len(added) == 0 {
+		return report, nil
+	}
+
+	if err := m.saveState(); err != nil {
+		for _, id := range added {
+			delete(m.shares, id)
+		}
+		return nil, err
+	}
+
+	m.bus.Publish("netdisk.imported", map[string]interface{}{
+		"count": len(added),
+	})
+	return report, nil
+}
+
+// importConflict returns why share cannot be imported, or "" if it can
+func (m *Manager) importConflict(share *Share) string {
+	if !m.isAllowedHost(share.Host) {
+		return "host is not in allowed list"
+	}
+	if !m.isAllowedMountPoint(share.MountPoint) {
+		return "mount point is not allowed"
+	}
+	for _, existing := range m.shares {
+		if filepath.Clean(existing.MountPoint) == filepath.Clean(share.MountPoint) {
+			return "a share with this mount point is already managed"
+		}
+	}
+	return ""
+}
+
+// fstabEntry is a network mount read from fstab
+type fstabEntry struct {
+	source string
+	share  *Share
+}
+
+// parseFstab returns the CIFS and NFS mounts in an fstab file
+func parseFstab(path string) ([]fstabEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []fstabEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		source, mountPoint := unescapeFstab(fields[0]), unescapeFstab(fields[1])
+
+		share := &Share{MountPoint: mountPoint, Name: filepath.Base(mountPoint), AutoMount: true}
+		switch fields[2] {
+		case "cifs", "smb3":
+			rest, ok := strings.CutPrefix(source, "//")
+			if !ok {
+				continue
+			}
+			host, sharePath, _ := strings.Cut(rest, "/")
+			share.Protocol = ProtocolCIFS
+			share.Host = host
+			share.Path = "/" + sharePath
+		case "nfs", "nfs4":
+			host, sharePath, ok := strings.Cut(source, ":")
+			if !ok {
+				continue
+			}
+			share.Protocol = ProtocolNFS
+			share.Host = strings.Trim(host, "[]")
+			share.Path = sharePath
+		default:
+			continue
+		}
+
+		if len(fields) > 3 {
+			for _, option := range strings.Split(fields[3], ",") {
+				key, value, _ := strings.Cut(option, "=")
+				switch {
+				case key == "noauto":
+					share.AutoMount = false
+				case share.Protocol == ProtocolCIFS && value != "" && (key == "username" || key == "user"):
+					share.Username = value
+				case fstabOnlyOptions[key] || strings.HasPrefix(key, "x-systemd.") || key == "comment":
+				case share.Protocol == ProtocolCIFS && (key == "password" || key == "pass"):
+					share.Password = value
+				default:
+					if share.Options == nil {
+						share.Options = map[string]string{}
+					}
+					share.Options[key] = value
+				}
+			}
+		}
+		entries = append(entries, fstabEntry{source: source, share: share})
+	}
+	return entries, scanner.Err()
+}
+
+// unescapeFstab decodes the octal escapes fstab uses for spaces and tabs
+func unescapeFstab(field string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\134`, `\`).Replace(field)
+}
+
+// mountedPoints returns the mount points currently in use
+func mountedPoints() map[string]bool {
+	mounted := make(map[string]bool)
+	data, err := os.ReadFile(mountsFile)
+	if err != nil {
+		return mounted
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 {
+			mounted[unescapeFstab(fields[1])] = true
+		}
+	}
+	return mounted
+}
@@ -0,0 +1,186 @@
+package netdisk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// holderStartTimeout bounds how long the holder may take to set up the
+// namespace
+const holderStartTimeout = 5 * time.Second
+
+// mountNamespace is a private mount namespace for share mounts, held open
+// by a child process. Its mounts don't show up in the host's mount table,
+// so a hung server only blocks processes that look into it, not df,
+// systemd or other services. Each mounted share is reached from the host
+// through a link in the managed directory. The holder is killed when the
+// agent exits, even if it crashes, and the kernel then detaches every
+// mount of the namespace.
+type mountNamespace struct {
+	dir  string // Managed directory with a link per mounted share
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{} // Closed when the holder exits
+}
+
+// newMountNamespace starts the holder and clears links left in dir by a
+// previous run, whose namespace is gone
+func newMountNamespace(dir string) (*mountNamespace, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("mount namespaces require Linux")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create namespace directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read namespace directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink != 0 {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	ns := &mountNamespace{dir: dir}
+	if _, err := ns.pid(); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// pid returns the process ID of the holder, starting a new one if it has
+// exited. Mounts made in the namespace of an earlier holder are gone.
+func (ns *mountNamespace) pid() (int, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.cmd != nil {
+		select {
+		case <-ns.done:
+		default:
+			return ns.cmd.Process.Pid, nil
+		}
+	}
+
+	// Private propagation keeps mounts from leaking to the host and host
+	// mount changes from reaching in
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "--", "sleep", "infinity")
+	cmd.SysProcAttr = holderProcAttr()
+	started := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		// The parent death signal follows the thread that started the
+		// holder, so the thread must live as long as the holder
+		runtime.LockOSThread()
+		if err := cmd.Start(); err != nil {
+			started <- err
+			return
+		}
+		started <- nil
+		cmd.Wait()
+		close(done)
+	}()
+	if err := <-started; err != nil {
+		return 0, fmt.Errorf("start mount namespace: %w", err)
+	}
+	if err := waitHolder(cmd.Process.Pid, done); err != nil {
+		cmd.Process.Kill()
+		<-done
+		return 0, err
+	}
+	ns.cmd, ns.done = cmd, done
+	return cmd.Process.Pid, nil
+}
+
+// waitHolder waits until the holder has set up its namespace and runs
+// sleep. Until then it is still in the host's namespace, and commands
+// entering it would mount there.
+func waitHolder(pid int, done chan struct{}) error {
+	deadline := time.Now().Add(holderStartTimeout)
+	for {
+		comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		if err == nil && strings.TrimSpace(string(comm)) == "sleep" {
+			return nil
+		}
+		select {
+		case <-done:
+			return errors.New("start mount namespace: holder exited")
+		default:
+		}
+		if time.Now().After(deadline) {
+			return errors.New("start mount namespace: holder did not start in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// command returns name and args run inside the namespace
+func (ns *mountNamespace) command(name string, args ...string) (string, []string, error) {
+	pid, err := ns.pid()
+	if err != nil {
+		return "", nil, err
+	}
+	return "nsenter", append([]string{"--target", strconv.Itoa(pid), "--mount", "--", name}, args...), nil
+}
+
+// linkPath is where a share mounted in the namespace is reached from the
+// host
+func (ns *mountNamespace) linkPath(id string) string {
+	return filepath.Join(ns.dir, id)
+}
+
+// link points the link of a share at its mount point in the namespace
+func (ns *mountNamespace) link(id, mountPoint string) error {
+	pid, err := ns.pid()
+	if err != nil {
+		return err
+	}
+	path := ns.linkPath(id)
+	os.Remove(path)
+	return os.Symlink(fmt.Sprintf("/proc/%d/root%s", pid, mountPoint), path)
+}
+
+func (ns *mountNamespace) unlink(id string) {
+	os.Remove(ns.linkPath(id))
+}
+
+// current reports whether the link of a share leads into the running
+// namespace, rather than one whose holder has exited
+func (ns *mountNamespace) current(id string) bool {
+	target, err := os.Readlink(ns.linkPath(id))
+	if err != nil {
+		return false
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.cmd == nil {
+		return false
+	}
+	select {
+	case <-ns.done:
+		return false
+	default:
+	}
+	return strings.HasPrefix(target, fmt.Sprintf("/proc/%d/root/", ns.cmd.Process.Pid))
+}
+
+// close kills the holder, detaching the mounts of the namespace
+func (ns *mountNamespace) close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.cmd == nil {
+		return
+	}
+	ns.cmd.Process.Kill()
+	<-ns.done
+	ns.cmd = nil
+}
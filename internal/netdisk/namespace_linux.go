@@ -0,0 +1,10 @@
+//go:build linux
+
+package netdisk
+
+import "syscall"
+
+// holderProcAttr kills the namespace holder when the agent exits
+func holderProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package netdisk
+
+import "syscall"
+
+// holderProcAttr is unused; mount namespaces require Linux
+func holderProcAttr() *syscall.SysProcAttr {
+	return nil
+}
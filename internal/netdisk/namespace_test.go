@@ -0,0 +1,65 @@
+package netdisk
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMountNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mount namespaces need root")
+	}
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter not installed")
+	}
+
+	ns, err := newMountNamespace(filepath.Join(t.TempDir(), "links"))
+	if err != nil {
+		t.Skipf("no mount namespace: %v", err)
+	}
+	defer ns.close()
+
+	mountPoint := t.TempDir()
+	name, args, err := ns.command("mount", "-t", "tmpfs", "tmpfs", mountPoint)
+	if err != nil {
+		t.Fatalf("command: %v", err)
+	}
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("mount: %v: %s", err, output)
+	}
+	if err := ns.link("share", mountPoint); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+
+	// Files written through the link land in the namespace's mount, which
+	// the host doesn't see
+	if err := os.WriteFile(filepath.Join(ns.linkPath("share"), "probe"), []byte("x"), 0644); err != nil {
+		t.Fatalf("write through link: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mountPoint, "probe")); !os.IsNotExist(err) {
+		t.Fatalf("expected the mount to be hidden from the host, got %v", err)
+	}
+	mounts, _ := os.ReadFile("/proc/self/mounts")
+	if strings.Contains(string(mounts), mountPoint) {
+		t.Fatalf("mount shows up in the host's mount table")
+	}
+	if !ns.current("share") {
+		t.Fatalf("expected the link to lead into the running namespace")
+	}
+
+	// The mount goes away with the holder, and a new namespace is started
+	// on demand
+	ns.close()
+	if ns.current("share") {
+		t.Fatalf("link still current after the holder exited")
+	}
+	if _, err := ns.pid(); err != nil {
+		t.Fatalf("restart holder: %v", err)
+	}
+	if ns.current("share") {
+		t.Fatalf("link into an old namespace reported as current")
+	}
+}
@@ -1,19 +1,26 @@
 package netdisk
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/healthcheck"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
 )
 
 // Protocol represents the network filesystem protocol
@@ -24,21 +31,44 @@ const (
 	ProtocolNFS  Protocol = "nfs"
 )
 
+// ErrHostUnreachable is returned when a share's host does not answer in time
+var ErrHostUnreachable = errors.New("host unreachable")
+
+// ErrBusy is returned when another mount or unmount of the share is running
+var ErrBusy = errors.New("operation in progress")
+
+// ErrNotPendingDelete is returned when confirming or restoring the deletion
+// of a share that is not scheduled for deletion
+var ErrNotPendingDelete = errors.New("share is not pending deletion")
+
 // Share represents a network share
 type Share struct {
-	ID          string            `json:"id"`
-	Name        string            `json:"name"`
-	Protocol    Protocol          `json:"protocol"`
-	Host        string            `json:"host"`
-	Path        string            `json:"path"`
-	MountPoint  string            `json:"mount_point"`
-	Username    string            `json:"username,omitempty"`
-	Password    string            `json:"-"` // Never expose in JSON
-	Options     map[string]string `json:"options"`
-	AutoMount   bool              `json:"auto_mount"`
-	Mounted     bool              `json:"mounted"`
-	LastChecked time.Time         `json:"last_checked"`
-	Healthy     bool              `json:"healthy"`
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Protocol   Protocol          `json:"protocol"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	MountPoint string            `json:"mount_point"`
+	Username   string            `json:"username,omitempty"`
+	Password   string            `json:"-"` // Never expose in JSON
+	Options    map[string]string `json:"options"`
+	AutoMount  bool              `json:"auto_mount"`
+	// OnDemand shares are mounted when their path is first used through
+	// the agent and unmounted after IdleTimeoutSec without use
+	OnDemand       bool      `json:"on_demand,omitempty"`
+	IdleTimeoutSec int       `json:"idle_timeout_sec,omitempty"` // 0 uses the manager's idle timeout
+	Mounted        bool      `json:"mounted"`
+	Imported       bool      `json:"imported,omitempty"` // Adopted from /etc/fstab
+	LastChecked    time.Time `json:"last_checked"`
+	Healthy        bool      `json:"healthy"`
+	// HealthError says why the last health check failed
+	HealthError string `json:"health_error,omitempty"`
+	// AccessPath is where the share is reached from the host while it is
+	// mounted in the mount namespace
+	AccessPath string `json:"access_path,omitempty"`
+	// DeleteAt is set while the share is pending deletion; it stays mounted
+	// until then
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
 }
 
 // Manager handles network disk operations
@@ -46,11 +76,21 @@ type Manager struct {
 	shares             map[string]*Share
 	allowedHosts       []string
 	allowedMountPoints []string
-	encryptionKey      []byte
+	credentials        *credcrypt.Cipher
 	stateFile          string
 	mu                 sync.RWMutex
 	monitorInterval    time.Duration
+	mountTimeout       time.Duration
+	checkTimeout       time.Duration
+	checkWorkers       int
+	deleteGrace        time.Duration
+	busy               map[string]bool
+	saver              *statefile.Debouncer
 	stopMonitor        chan struct{}
+	bus                *events.Bus
+	ns                 *mountNamespace // Nil to mount in the host's namespace
+	idleTimeout        time.Duration
+	onDemand           *onDemandMounts
 }
 
 // Config represents network disk manager configuration
@@ -60,22 +100,27 @@ type Config struct {
 	EncryptionKey      string
 	StateFile          string
 	MonitorInterval    time.Duration
+	// MountTimeout bounds a single mount or unmount command
+	MountTimeout time.Duration
+	// CheckTimeout bounds the health check of a single mount point
+	CheckTimeout time.Duration
+	// CheckWorkers limits how many shares are checked at once
+	CheckWorkers int
+	// DeleteGrace is how long removed shares stay until they are deleted
+	DeleteGrace time.Duration
+	// Namespace mounts shares in a private mount namespace, reached through
+	// links in NamespaceDir
+	Namespace    bool
+	NamespaceDir string
+	// IdleTimeout is how long on-demand shares stay mounted without use
+	IdleTimeout time.Duration
 }
 
 // New creates a new network disk manager
 func New(cfg *Config) (*Manager, error) {
-	if cfg.EncryptionKey == "" {
-		return nil, fmt.Errorf("encryption key is required")
-	}
-
-	key := []byte(cfg.EncryptionKey)
-	if len(key) < 32 {
-		// Pad key to 32 bytes for AES-256
-		padded := make([]byte, 32)
-		copy(padded, key)
-		key = padded
-	} else {
-		key = key[:32]
+	credentials, err := credcrypt.New(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
 	}
 
 	monitorInterval := cfg.MonitorInterval
@@ -83,6 +128,26 @@ func New(cfg *Config) (*Manager, error) {
 		monitorInterval = 1 * time.Minute
 	}
 
+	mountTimeout := cfg.MountTimeout
+	if mountTimeout == 0 {
+		mountTimeout = 30 * time.Second
+	}
+
+	checkTimeout := cfg.CheckTimeout
+	if checkTimeout == 0 {
+		checkTimeout = 10 * time.Second
+	}
+
+	deleteGrace := cfg.DeleteGrace
+	if deleteGrace == 0 {
+		deleteGrace = 24 * time.Hour
+	}
+
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 10 * time.Minute
+	}
+
 	stateFile := cfg.StateFile
 	if stateFile == "" {
 		stateFile = "/var/lib/mingyue-agent/netdisk-state.json"
@@ -92,12 +157,37 @@ func New(cfg *Config) (*Manager, error) {
 		shares:             make(map[string]*Share),
 		allowedHosts:       cfg.AllowedHosts,
 		allowedMountPoints: cfg.AllowedMountPoints,
-		encryptionKey:      key,
+		credentials:        credentials,
 		stateFile:          stateFile,
 		monitorInterval:    monitorInterval,
+		mountTimeout:       mountTimeout,
+		checkTimeout:       checkTimeout,
+		checkWorkers:       cfg.CheckWorkers,
+		deleteGrace:        deleteGrace,
+		busy:               make(map[string]bool),
 		stopMonitor:        make(chan struct{}),
+		idleTimeout:        idleTimeout,
+		onDemand:           newOnDemandMounts(),
+	}
+
+	if cfg.Namespace {
+		dir := cfg.NamespaceDir
+		if dir == "" {
+			dir = "/run/mingyue-agent/netdisk"
+		}
+		ns, err := newMountNamespace(dir)
+		if err != nil {
+			return nil, err
+		}
+		m.ns = ns
 	}
 
+	m.saver = statefile.NewDebouncer(statefile.DefaultDelay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.saveState()
+	})
+
 	// Load persisted state
 	if err := m.loadState(); err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("load state: %w", err)
@@ -119,23 +209,17 @@ func (m *Manager) AddShare(share *Share) error {
 	}
 
 	// Validate host whitelist
-	if len(m.allowedHosts) > 0 {
-		allowed := false
-		for _, host := range m.allowedHosts {
-			if host == share.Host || host == "*" {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			return fmt.Errorf("host %s is not in allowed list", share.Host)
-		}
+	if !m.isAllowedHost(share.Host) {
+		return fmt.Errorf("host %s is not in allowed list", share.Host)
 	}
 
 	// Validate mount point
 	if !m.isAllowedMountPoint(share.MountPoint) {
 		return fmt.Errorf("mount point %s is not allowed", share.MountPoint)
 	}
+	if share.IdleTimeoutSec < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
 
 	// Encrypt password if provided
 	if share.Password != "" {
@@ -150,28 +234,172 @@ func (m *Manager) AddShare(share *Share) error {
 	return m.saveState()
 }
 
-// RemoveShare removes a network share
-func (m *Manager) RemoveShare(id string) error {
+// ReplaceShare sets every setting of an existing share to those of share.
+// An empty password keeps the current one. Changes take effect the next
+// time the share is mounted, but a mounted share cannot be moved to another
+// mount point. A share pending deletion is restored.
+func (m *Manager) ReplaceShare(id string, share *Share) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	share, exists := m.shares[id]
+	existing, exists := m.shares[id]
 	if !exists {
 		return fmt.Errorf("share %s not found", id)
 	}
+	if m.busy[id] {
+		return fmt.Errorf("share %s: %w", id, ErrBusy)
+	}
+	if !m.isAllowedHost(share.Host) {
+		return fmt.Errorf("host %s is not in allowed list", share.Host)
+	}
+	if !m.isAllowedMountPoint(share.MountPoint) {
+		return fmt.Errorf("mount point %s is not allowed", share.MountPoint)
+	}
+	if share.IdleTimeoutSec < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
+	if existing.Mounted && share.MountPoint != existing.MountPoint {
+		return fmt.Errorf("share %s is mounted; unmount it before moving its mount point", id)
+	}
+
+	password := existing.Password
+	if share.Password != "" {
+		encrypted, err := m.encrypt(share.Password)
+		if err != nil {
+			return fmt.Errorf("encrypt password: %w", err)
+		}
+		password = encrypted
+	}
+
+	previous := *existing
+	existing.Name = share.Name
+	existing.Protocol = share.Protocol
+	existing.Host = share.Host
+	existing.Path = share.Path
+	existing.MountPoint = share.MountPoint
+	existing.Username = share.Username
+	existing.Password = password
+	existing.Options = share.Options
+	existing.AutoMount = share.AutoMount
+	existing.OnDemand = share.OnDemand
+	existing.IdleTimeoutSec = share.IdleTimeoutSec
+	existing.DeleteAt = nil
+
+	if err := m.saveState(); err != nil {
+		*existing = previous
+		return err
+	}
+	return nil
+}
+
+// PasswordMatches reports whether password is the stored password of a
+// share, so callers can tell whether it changed without reading it
+func (m *Manager) PasswordMatches(id, password string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	share, exists := m.shares[id]
+	if !exists || share.Password == "" {
+		return password == ""
+	}
+	stored, err := m.decrypt(share.Password)
+	return err == nil && stored == password
+}
+
+// RemoveShare schedules a network share for deletion after the grace
+// period. It stays mounted until then and can be restored with RestoreShare
+// or deleted at once with ConfirmRemoveShare.
+func (m *Manager) RemoveShare(ctx context.Context, id string) (*Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, exists := m.shares[id]
+	if !exists {
+		return nil, fmt.Errorf("share %s not found", id)
+	}
+
+	if share.DeleteAt == nil {
+		deleteAt := time.Now().Add(m.deleteGrace)
+		share.DeleteAt = &deleteAt
+		if err := m.saveState(); err != nil {
+			share.DeleteAt = nil
+			return nil, err
+		}
+		m.bus.Publish("netdisk.delete_pending", map[string]interface{}{
+			"id":        share.ID,
+			"name":      share.Name,
+			"delete_at": deleteAt,
+		})
+	}
+
+	shareCopy := *share
+	shareCopy.Password = ""
+	return &shareCopy, nil
+}
+
+// ConfirmRemoveShare unmounts and deletes a share pending deletion without
+// waiting for the grace period
+func (m *Manager) ConfirmRemoveShare(ctx context.Context, id string) error {
+	share, err := m.claim(id)
+	if err != nil {
+		return err
+	}
+	defer m.release(id)
+
+	if share.DeleteAt == nil {
+		return ErrNotPendingDelete
+	}
 
 	// Unmount if mounted
 	if share.Mounted {
-		if err := m.unmountShare(share); err != nil {
+		if err := m.unmountShare(ctx, share); err != nil {
 			return fmt.Errorf("unmount share: %w", err)
 		}
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	delete(m.shares, id)
+	m.bus.Publish("netdisk.deleted", map[string]interface{}{
+		"id":   share.ID,
+		"name": share.Name,
+	})
 	return m.saveState()
 }
 
-// ListShares returns all configured shares
+// RestoreShare cancels the pending deletion of a share
+func (m *Manager) RestoreShare(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, exists := m.shares[id]
+	if !exists {
+		return fmt.Errorf("share %s not found", id)
+	}
+	if share.DeleteAt == nil {
+		return ErrNotPendingDelete
+	}
+	// A running ConfirmRemoveShare may be unmounting it already
+	if m.busy[id] {
+		return fmt.Errorf("share %s: %w", id, ErrBusy)
+	}
+
+	deleteAt := share.DeleteAt
+	share.DeleteAt = nil
+	if err := m.saveState(); err != nil {
+		share.DeleteAt = deleteAt
+		return err
+	}
+
+	m.bus.Publish("netdisk.restored", map[string]interface{}{
+		"id":   share.ID,
+		"name": share.Name,
+	})
+	return nil
+}
+
+// ListShares returns all configured shares, ordered by ID
 func (m *Manager) ListShares() []*Share {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -183,53 +411,107 @@ func (m *Manager) ListShares() []*Share {
 		shareCopy.Password = "" // Never expose password
 		shares = append(shares, &shareCopy)
 	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ID < shares[j].ID
+	})
 	return shares
 }
 
-// Mount mounts a network share
-func (m *Manager) Mount(id string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	share, exists := m.shares[id]
-	if !exists {
-		return fmt.Errorf("share %s not found", id)
+// Mount mounts a network share. It fails with ErrHostUnreachable when the
+// host does not answer within the mount timeout.
+func (m *Manager) Mount(ctx context.Context, id string) (err error) {
+	ctx, span := telemetry.Start(ctx, "netdisk.mount")
+	span.SetAttribute("share.id", id)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	share, err := m.claim(id)
+	if err != nil {
+		return err
 	}
+	defer m.release(id)
 
 	if share.Mounted {
 		return fmt.Errorf("share %s is already mounted", id)
 	}
 
-	if err := m.mountShare(share); err != nil {
+	if err := m.mountShare(ctx, share); err != nil {
 		return err
 	}
 
-	share.Mounted = true
-	share.Healthy = true
-	share.LastChecked = time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if current, exists := m.shares[id]; exists {
+		current.Mounted = true
+		current.Healthy = true
+		current.HealthError = ""
+		current.AccessPath = share.AccessPath
+		current.LastChecked = time.Now()
+	}
+	m.onDemand.used(id)
 	return m.saveState()
 }
 
-// Unmount unmounts a network share
-func (m *Manager) Unmount(id string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// PlanMount returns the commands Mount would run, with the password
+// masked, without mounting anything
+func (m *Manager) PlanMount(id string) (*dryrun.Plan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	share, exists := m.shares[id]
 	if !exists {
-		return fmt.Errorf("share %s not found", id)
+		return nil, fmt.Errorf("share %s not found", id)
+	}
+	if share.Mounted {
+		return nil, fmt.Errorf("share %s is already mounted", id)
+	}
+
+	args, err := m.mountArgs(share, true)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "mount"
+	if m.ns != nil {
+		if name, args, err = m.ns.command(name, args...); err != nil {
+			return nil, err
+		}
 	}
 
+	plan := dryrun.New()
+	plan.AddCommand("mkdir", "-p", share.MountPoint)
+	plan.AddCommand(name, args...)
+	return plan, nil
+}
+
+// Unmount unmounts a network share
+func (m *Manager) Unmount(ctx context.Context, id string) error {
+	share, err := m.claim(id)
+	if err != nil {
+		return err
+	}
+	defer m.release(id)
+
 	if !share.Mounted {
 		return fmt.Errorf("share %s is not mounted", id)
 	}
 
-	if err := m.unmountShare(share); err != nil {
+	if err := m.unmountShare(ctx, share); err != nil {
 		return err
 	}
 
-	share.Mounted = false
-	share.Healthy = false
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if share, exists := m.shares[id]; exists {
+		share.Mounted = false
+		share.Healthy = false
+		share.HealthError = ""
+		share.AccessPath = ""
+	}
 	return m.saveState()
 }
 
@@ -249,13 +531,65 @@ func (m *Manager) GetShareStatus(id string) (*Share, error) {
 	return &shareCopy, nil
 }
 
-// Stop stops the network disk manager
+// SetEventBus publishes network disk health changes on bus
+func (m *Manager) SetEventBus(bus *events.Bus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bus = bus
+}
+
+// Stop stops the network disk manager. Shares in the mount namespace are
+// detached with it.
 func (m *Manager) Stop() {
 	close(m.stopMonitor)
+	m.saver.Flush()
+	if m.ns != nil {
+		m.ns.close()
+	}
 }
 
 // Private methods
 
+// claim marks a share busy and returns a copy of it, so that mount commands
+// run without holding m.mu and a hung host cannot block other shares
+func (m *Manager) claim(id string) (*Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, exists := m.shares[id]
+	if !exists {
+		return nil, fmt.Errorf("share %s not found", id)
+	}
+	if m.busy[id] {
+		return nil, fmt.Errorf("share %s: %w", id, ErrBusy)
+	}
+
+	m.busy[id] = true
+	shareCopy := *share
+	return &shareCopy, nil
+}
+
+func (m *Manager) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.busy, id)
+}
+
+// isAllowedHost reports whether shares may be mounted from host
+func (m *Manager) isAllowedHost(host string) bool {
+	if len(m.allowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range m.allowedHosts {
+		if allowed == host || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Manager) isAllowedMountPoint(mountPoint string) bool {
 	if len(m.allowedMountPoints) == 0 {
 		return false
@@ -284,45 +618,190 @@ func (m *Manager) isAllowedMountPoint(mountPoint string) bool {
 	return false
 }
 
-func (m *Manager) mountShare(share *Share) error {
+func (m *Manager) mountShare(ctx context.Context, share *Share) error {
 	// Create mount point if it doesn't exist
 	if err := os.MkdirAll(share.MountPoint, 0755); err != nil {
 		return fmt.Errorf("create mount point: %w", err)
 	}
 
-	var cmd *exec.Cmd
-	switch share.Protocol {
-	case ProtocolCIFS:
-		cmd = m.buildCIFSMountCommand(share)
-	case ProtocolNFS:
-		cmd = m.buildNFSMountCommand(share)
-	default:
-		return fmt.Errorf("unsupported protocol: %s", share.Protocol)
+	args, err := m.mountArgs(share, false)
+	if err != nil {
+		return err
+	}
+
+	// Fail fast instead of letting mount retry an unreachable host, and
+	// with a clearer reason than its exit code
+	if err := telemetry.Run(ctx, "netdisk.probe_host", func(ctx context.Context) error {
+		return m.preflight(ctx, share)
+	}); err != nil {
+		return err
 	}
 
-	output, err := cmd.CombinedOutput()
+	name := "mount"
+	if m.ns != nil {
+		// Set first so a timed out mount is detached in the namespace
+		share.AccessPath = m.ns.linkPath(share.ID)
+		if name, args, err = m.ns.command(name, args...); err != nil {
+			return err
+		}
+	}
+
+	mountCtx, cancel := context.WithTimeout(ctx, m.mountTimeout)
+	defer cancel()
+
+	output, err := sysexec.CombinedOutput(mountCtx, name, args...)
 	if err != nil {
+		if sysexec.IsTimeout(err) {
+			// The kernel may have half-attached the mount; detach it so the
+			// mount point does not hang later callers
+			m.lazyUnmount(share)
+			return fmt.Errorf("mount %s: %w: no response within %s: %w", share.MountPoint, ErrHostUnreachable, m.mountTimeout, err)
+		}
 		return fmt.Errorf("mount failed: %w, output: %s", err, string(output))
 	}
 
+	if m.ns != nil {
+		if err := m.ns.link(share.ID, share.MountPoint); err != nil {
+			m.lazyUnmount(share)
+			return fmt.Errorf("link mount point: %w", err)
+		}
+	}
 	return nil
 }
 
-func (m *Manager) unmountShare(share *Share) error {
-	cmd := exec.Command("umount", share.MountPoint)
-	output, err := cmd.CombinedOutput()
+func (m *Manager) unmountShare(ctx context.Context, share *Share) error {
+	if m.inNamespace(share) && !m.ns.current(share.ID) {
+		// The namespace it was mounted in is gone, and the mount with it
+		m.ns.unlink(share.ID)
+		return nil
+	}
+
+	unmountCtx, cancel := context.WithTimeout(ctx, m.mountTimeout)
+	defer cancel()
+
+	output, err := m.umount(unmountCtx, share, share.MountPoint)
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("unmount failed: %w", err)
+		}
+		if sysexec.IsTimeout(err) {
+			// umount blocks on a dead server; a lazy unmount detaches it
+			// immediately and cleans up once it is no longer busy
+			return m.lazyUnmount(share)
+		}
+
 		// Try force unmount if normal unmount fails
-		cmd = exec.Command("umount", "-f", share.MountPoint)
-		output, err = cmd.CombinedOutput()
+		output, err = m.umount(ctx, share, "-f", share.MountPoint)
 		if err != nil {
 			return fmt.Errorf("unmount failed: %w, output: %s", err, string(output))
 		}
 	}
+	if m.inNamespace(share) {
+		m.ns.unlink(share.ID)
+	}
 	return nil
 }
 
-func (m *Manager) buildCIFSMountCommand(share *Share) *exec.Cmd {
+// lazyUnmount detaches a mount point without waiting for the server
+func (m *Manager) lazyUnmount(share *Share) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := m.umount(ctx, share, "-l", share.MountPoint)
+	if err != nil {
+		return fmt.Errorf("lazy unmount failed: %w, output: %s", err, string(output))
+	}
+	if m.inNamespace(share) {
+		m.ns.unlink(share.ID)
+	}
+	return nil
+}
+
+// inNamespace reports whether share is mounted in the mount namespace.
+// Shares mounted before it was enabled, or adopted from fstab, are mounted
+// in the host's.
+func (m *Manager) inNamespace(share *Share) bool {
+	return m.ns != nil && share.AccessPath != ""
+}
+
+// umount runs umount with args where share is mounted
+func (m *Manager) umount(ctx context.Context, share *Share, args ...string) ([]byte, error) {
+	name := "umount"
+	if m.inNamespace(share) {
+		var err error
+		if name, args, err = m.ns.command(name, args...); err != nil {
+			return nil, err
+		}
+	}
+	return sysexec.CombinedOutput(ctx, name, args...)
+}
+
+// probeHost checks that the share's file service port accepts connections
+func (m *Manager) probeHost(ctx context.Context, share *Share) error {
+	port := share.Options["port"]
+	if port == "" {
+		switch share.Protocol {
+		case ProtocolCIFS:
+			port = "445"
+		case ProtocolNFS:
+			port = "2049"
+		}
+	}
+
+	timeout := 5 * time.Second
+	if m.mountTimeout < timeout {
+		timeout = m.mountTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+
+	addr := net.JoinHostPort(share.Host, port)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("probe %s: %w", addr, ctx.Err())
+		}
+		return fmt.Errorf("%w: %s: %v", ErrHostUnreachable, addr, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// softOptions makes I/O on a dead server fail with an error instead of
+// blocking forever, unless the share sets hard or soft explicitly
+func (m *Manager) softOptions(share *Share) []string {
+	if _, hard := share.Options["hard"]; hard {
+		return nil
+	}
+	if _, soft := share.Options["soft"]; soft {
+		return nil
+	}
+
+	opts := []string{"soft"}
+	if share.Protocol == ProtocolNFS {
+		if _, set := share.Options["timeo"]; !set {
+			// timeo is in tenths of a second
+			opts = append(opts, "timeo=100")
+		}
+		if _, set := share.Options["retrans"]; !set {
+			opts = append(opts, "retrans=2")
+		}
+	}
+	return opts
+}
+
+// mountArgs returns the mount command arguments for share. With redact the
+// password is masked, for showing the command to users.
+func (m *Manager) mountArgs(share *Share, redact bool) ([]string, error) {
+	switch share.Protocol {
+	case ProtocolCIFS:
+		return m.buildCIFSMountArgs(share, redact), nil
+	case ProtocolNFS:
+		return m.buildNFSMountArgs(share), nil
+	}
+	return nil, fmt.Errorf("unsupported protocol: %s", share.Protocol)
+}
+
+func (m *Manager) buildCIFSMountArgs(share *Share, redact bool) []string {
 	source := fmt.Sprintf("//%s%s", share.Host, share.Path)
 
 	opts := []string{}
@@ -330,7 +809,9 @@ func (m *Manager) buildCIFSMountCommand(share *Share) *exec.Cmd {
 		opts = append(opts, fmt.Sprintf("username=%s", share.Username))
 	}
 
-	if share.Password != "" {
+	if share.Password != "" && redact {
+		opts = append(opts, "password=********")
+	} else if share.Password != "" {
 		// Decrypt password
 		password, err := m.decrypt(share.Password)
 		if err == nil {
@@ -340,8 +821,13 @@ func (m *Manager) buildCIFSMountCommand(share *Share) *exec.Cmd {
 
 	// Add custom options
 	for key, value := range share.Options {
-		opts = append(opts, fmt.Sprintf("%s=%s", key, value))
+		if value == "" {
+			opts = append(opts, key)
+		} else {
+			opts = append(opts, fmt.Sprintf("%s=%s", key, value))
+		}
 	}
+	opts = append(opts, m.softOptions(share)...)
 
 	args := []string{"-t", "cifs"}
 	if len(opts) > 0 {
@@ -349,10 +835,10 @@ func (m *Manager) buildCIFSMountCommand(share *Share) *exec.Cmd {
 	}
 	args = append(args, source, share.MountPoint)
 
-	return exec.Command("mount", args...)
+	return args
 }
 
-func (m *Manager) buildNFSMountCommand(share *Share) *exec.Cmd {
+func (m *Manager) buildNFSMountArgs(share *Share) []string {
 	source := fmt.Sprintf("%s:%s", share.Host, share.Path)
 
 	opts := []string{}
@@ -364,6 +850,7 @@ func (m *Manager) buildNFSMountCommand(share *Share) *exec.Cmd {
 			opts = append(opts, fmt.Sprintf("%s=%s", key, value))
 		}
 	}
+	opts = append(opts, m.softOptions(share)...)
 
 	args := []string{"-t", "nfs"}
 	if len(opts) > 0 {
@@ -371,7 +858,7 @@ func (m *Manager) buildNFSMountCommand(share *Share) *exec.Cmd {
 	}
 	args = append(args, source, share.MountPoint)
 
-	return exec.Command("mount", args...)
+	return args
 }
 
 func (m *Manager) healthMonitor() {
@@ -381,94 +868,131 @@ func (m *Manager) healthMonitor() {
 	for {
 		select {
 		case <-ticker.C:
+			m.deleteExpired()
 			m.checkAllShares()
+			m.unmountIdle()
 		case <-m.stopMonitor:
 			return
 		}
 	}
 }
 
-func (m *Manager) checkAllShares() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	for _, share := range m.shares {
-		if !share.Mounted {
-			continue
+// deleteExpired deletes shares whose grace period has ended. Shares that
+// are busy are retried on the next tick.
+func (m *Manager) deleteExpired() {
+	m.mu.RLock()
+	now := time.Now()
+	var expired []string
+	for id, share := range m.shares {
+		if share.DeleteAt != nil && !share.DeleteAt.After(now) {
+			expired = append(expired, id)
 		}
+	}
+	m.mu.RUnlock()
 
-		// Check if mount point is still accessible
-		_, err := os.Stat(share.MountPoint)
-		healthy := err == nil
-
-		// Try to remount if unhealthy and auto-mount is enabled
-		if !healthy && share.AutoMount {
-			if err := m.unmountShare(share); err == nil {
-				time.Sleep(1 * time.Second)
-				if err := m.mountShare(share); err == nil {
-					healthy = true
-				}
-			}
+	for _, id := range expired {
+		if err := m.ConfirmRemoveShare(context.Background(), id); err != nil && !errors.Is(err, ErrBusy) {
+			log.Printf("warning: delete expired network share %s: %v", id, err)
 		}
+	}
+}
 
-		share.Healthy = healthy
-		share.LastChecked = time.Now()
-		if !healthy {
-			share.Mounted = false
+func (m *Manager) checkAllShares() {
+	m.mu.RLock()
+	var ids []string
+	for id, share := range m.shares {
+		if share.Mounted {
+			ids = append(ids, id)
 		}
 	}
+	m.mu.RUnlock()
 
-	m.saveState()
+	healthcheck.ForEach(len(ids), m.checkWorkers, func(i int) {
+		// Shares being mounted or unmounted by the API are skipped
+		share, err := m.claim(ids[i])
+		if err != nil {
+			return
+		}
+		if m.checkShare(share) {
+			m.saver.Trigger()
+		}
+		m.release(ids[i])
+	})
 }
 
-func (m *Manager) encrypt(plaintext string) (string, error) {
-	block, err := aes.NewCipher(m.encryptionKey)
-	if err != nil {
-		return "", err
+// checkShare updates a share's health and reports whether it changed.
+// LastChecked alone is not worth a state write.
+func (m *Manager) checkShare(share *Share) bool {
+	// Check if mount point is still accessible
+	path := share.MountPoint
+	if m.inNamespace(share) {
+		path = share.AccessPath
 	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
+	healthErr := healthcheck.Stat(path, m.checkTimeout)
+	healthy := healthErr == nil
+
+	// Try to remount if unhealthy and auto-mount is enabled
+	remounted := false
+	if !healthy && share.AutoMount {
+		if err := m.unmountShare(context.Background(), share); err == nil {
+			time.Sleep(1 * time.Second)
+			remounted = true
+			if healthErr = m.mountShare(context.Background(), share); healthErr == nil {
+				healthy = true
+			}
+		}
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+	// A failed remount already probed the server; otherwise ask it why the
+	// mount point stopped answering
+	if !healthy && !remounted {
+		if password, err := m.sharePassword(share); err == nil {
+			if err := m.probe(context.Background(), share, password).Err(); err != nil {
+				healthErr = err
+			}
+		}
+	}
+	reason := ""
+	if healthErr != nil {
+		reason = healthErr.Error()
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
-}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-func (m *Manager) decrypt(ciphertext string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
-	if err != nil {
-		return "", err
+	current, exists := m.shares[share.ID]
+	if !exists {
+		return false
 	}
-
-	block, err := aes.NewCipher(m.encryptionKey)
-	if err != nil {
-		return "", err
+	changed := healthy != current.Healthy
+	if changed {
+		m.bus.Publish("netdisk.health", map[string]interface{}{
+			"id":          current.ID,
+			"name":        current.Name,
+			"mount_point": current.MountPoint,
+			"healthy":     healthy,
+			"error":       reason,
+		})
 	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
+	current.Healthy = healthy
+	current.HealthError = reason
+	current.LastChecked = time.Now()
+	if remounted && healthy {
+		current.AccessPath = share.AccessPath
 	}
-
-	nonceSize := gcm.NonceSize()
-	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
+	if !healthy && current.Mounted {
+		current.Mounted = false
+		current.AccessPath = ""
+		changed = true
 	}
+	return changed
+}
 
-	nonce, ciphertextBytes := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
-	if err != nil {
-		return "", err
-	}
+func (m *Manager) encrypt(plaintext string) (string, error) {
+	return m.credentials.Encrypt(plaintext)
+}
 
-	return string(plaintext), nil
+func (m *Manager) decrypt(ciphertext string) (string, error) {
+	return m.credentials.Decrypt(ciphertext)
 }
 
 func (m *Manager) saveState() error {
@@ -483,7 +1007,7 @@ func (m *Manager) saveState() error {
 		return fmt.Errorf("marshal state: %w", err)
 	}
 
-	if err := os.WriteFile(m.stateFile, data, 0600); err != nil {
+	if err := statefile.Write(m.stateFile, data, 0600); err != nil {
 		return fmt.Errorf("write state file: %w", err)
 	}
 
@@ -491,14 +1015,9 @@ func (m *Manager) saveState() error {
 }
 
 func (m *Manager) loadState() error {
-	data, err := os.ReadFile(m.stateFile)
-	if err != nil {
-		return err
-	}
-
 	var shares map[string]*Share
-	if err := json.Unmarshal(data, &shares); err != nil {
-		return fmt.Errorf("unmarshal state: %w", err)
+	if err := statefile.Read(m.stateFile, &shares); err != nil {
+		return err
 	}
 
 	m.shares = shares
@@ -507,6 +1026,8 @@ func (m *Manager) loadState() error {
 	for _, share := range m.shares {
 		share.Mounted = false
 		share.Healthy = false
+		share.HealthError = ""
+		share.AccessPath = ""
 	}
 
 	return nil
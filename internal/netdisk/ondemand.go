@@ -0,0 +1,155 @@
+package netdisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// onDemandMounts tracks when on-demand shares were last used, and keeps
+// concurrent first uses of a share from mounting it twice
+type onDemandMounts struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+	mounting map[string]*sync.Mutex
+}
+
+func newOnDemandMounts() *onDemandMounts {
+	return &onDemandMounts{
+		lastUsed: make(map[string]time.Time),
+		mounting: make(map[string]*sync.Mutex),
+	}
+}
+
+// used marks share id used now
+func (d *onDemandMounts) used(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastUsed[id] = time.Now()
+}
+
+// idle reports whether share id went unused for timeout
+func (d *onDemandMounts) idle(id string, timeout time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, ok := d.lastUsed[id]
+	if !ok {
+		// Mounted before it was first used, like at startup
+		d.lastUsed[id] = time.Now()
+		return false
+	}
+	return time.Since(last) >= timeout
+}
+
+// lock serializes mounting and idle unmounting of share id
+func (d *onDemandMounts) lock(id string) (unlock func()) {
+	d.mu.Lock()
+	mu, ok := d.mounting[id]
+	if !ok {
+		mu = &sync.Mutex{}
+		d.mounting[id] = mu
+	}
+	d.mu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Access mounts the on-demand share holding path if it isn't mounted, and
+// marks it used so it stays mounted. Paths outside on-demand shares are
+// left alone. It fails like Mount when the share can't be mounted, such as
+// with ErrHostUnreachable when its host is powered off.
+func (m *Manager) Access(path string) error {
+	id, mounted := m.onDemandShare(filepath.Clean(path))
+	if id == "" {
+		return nil
+	}
+	m.onDemand.used(id)
+	if mounted {
+		return nil
+	}
+
+	// Uses that came in while another mounted the share find it mounted
+	unlock := m.onDemand.lock(id)
+	defer unlock()
+	if m.isMounted(id) {
+		return nil
+	}
+	if err := m.Mount(context.Background(), id); err != nil {
+		if m.isMounted(id) {
+			return nil
+		}
+		return fmt.Errorf("mount share %s on demand: %w", id, err)
+	}
+	return nil
+}
+
+// onDemandShare returns the on-demand share whose mount point, or link
+// when mounted in the namespace, holds path, and whether it is mounted
+func (m *Manager) onDemandShare(path string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, mounted, longest := "", false, 0
+	for _, share := range m.shares {
+		if !share.OnDemand || share.DeleteAt != nil {
+			continue
+		}
+		roots := []string{share.MountPoint}
+		if m.ns != nil {
+			roots = append(roots, m.ns.linkPath(share.ID))
+		}
+		for _, root := range roots {
+			root = filepath.Clean(root)
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") || len(root) <= longest {
+				continue
+			}
+			id, mounted, longest = share.ID, share.Mounted, len(root)
+		}
+	}
+	return id, mounted
+}
+
+func (m *Manager) isMounted(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	share, exists := m.shares[id]
+	return exists && share.Mounted
+}
+
+// unmountIdle unmounts on-demand shares that went unused for their idle
+// timeout. Shares that are busy, or still have open files, are retried
+// after another timeout.
+func (m *Manager) unmountIdle() {
+	m.mu.RLock()
+	idle := make(map[string]time.Duration)
+	for id, share := range m.shares {
+		if !share.OnDemand || !share.Mounted {
+			continue
+		}
+		timeout := m.idleTimeout
+		if share.IdleTimeoutSec > 0 {
+			timeout = time.Duration(share.IdleTimeoutSec) * time.Second
+		}
+		idle[id] = timeout
+	}
+	m.mu.RUnlock()
+
+	for id, timeout := range idle {
+		unlock := m.onDemand.lock(id)
+		if m.onDemand.idle(id, timeout) {
+			if err := m.Unmount(context.Background(), id); err != nil {
+				m.onDemand.used(id)
+				if !errors.Is(err, ErrBusy) {
+					log.Printf("warning: unmount idle network share %s: %v", id, err)
+				}
+			}
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,64 @@
+package netdisk
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessOnDemand(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	mnt := t.TempDir()
+	m, err := New(&Config{
+		AllowedMountPoints: []string{mnt},
+		EncryptionKey:      "test-key",
+		StateFile:          filepath.Join(t.TempDir(), "state.json"),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer m.Stop()
+
+	for _, share := range []*Share{
+		{ID: "pc", Protocol: ProtocolNFS, Host: "127.0.0.1", Path: "/export", MountPoint: filepath.Join(mnt, "pc"), Options: map[string]string{"port": port}, OnDemand: true},
+		{ID: "nas", Protocol: ProtocolNFS, Host: "127.0.0.1", Path: "/export", MountPoint: filepath.Join(mnt, "nas"), Options: map[string]string{"port": port}},
+	} {
+		if err := m.AddShare(share); err != nil {
+			t.Fatalf("AddShare: %v", err)
+		}
+	}
+
+	// The host is down, so the first use fails fast with the reason
+	if err := m.Access(filepath.Join(mnt, "pc", "photos")); !errors.Is(err, ErrHostUnreachable) {
+		t.Fatalf("expected host unreachable, got %v", err)
+	}
+	// Shares mounted as usual and paths next to mount points are left alone
+	for _, path := range []string{filepath.Join(mnt, "nas", "photos"), mnt, filepath.Join(mnt, "pc2")} {
+		if err := m.Access(path); err != nil {
+			t.Errorf("%s: expected no mount, got %v", path, err)
+		}
+	}
+}
+
+func TestOnDemandIdle(t *testing.T) {
+	d := newOnDemandMounts()
+	// Shares mounted before their first use start their timeout then
+	if d.idle("pc", 0) {
+		t.Fatal("expected a share not yet used to be kept")
+	}
+	if !d.idle("pc", 0) {
+		t.Fatal("expected the share to be idle after the timeout")
+	}
+	d.used("pc")
+	if d.idle("pc", time.Hour) {
+		t.Fatal("expected a used share to be kept")
+	}
+}
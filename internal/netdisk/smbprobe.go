@@ -0,0 +1,238 @@
+package netdisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// Outcomes of probing a share, in ProbeResult.Status
+const (
+	ProbeOK            = "ok"
+	ProbeUnreachable   = "unreachable"     // No connection to the file service port
+	ProbeAuthFailed    = "auth_failed"     // Wrong user name or password, or the account can't log in
+	ProbeShareNotFound = "share_not_found" // The host has no share of that name
+	ProbeAccessDenied  = "access_denied"   // The user may not open the share
+	ProbePathNotFound  = "path_not_found"  // The directory below the share doesn't exist
+	ProbeFailed        = "error"           // Anything else, like a protocol error
+)
+
+// ErrAuthFailed is returned when a host rejects the credentials of a share
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrShareNotFound is returned when a host has no share of the name, or
+// the directory below it is missing
+var ErrShareNotFound = errors.New("share not found")
+
+// ErrAccessDenied is returned when the user of a share may not open it
+var ErrAccessDenied = errors.New("access denied")
+
+// NTSTATUS codes sorted into probe outcomes
+const (
+	statusAccessDenied       = 0xC0000022
+	statusObjectNameNotFound = 0xC0000034
+	statusObjectPathNotFound = 0xC000003A
+	statusLogonFailure       = 0xC000006D
+	statusAccountRestriction = 0xC000006E
+	statusInvalidLogonHours  = 0xC000006F
+	statusPasswordExpired    = 0xC0000071
+	statusAccountDisabled    = 0xC0000072
+	statusBadNetworkName     = 0xC00000CC
+	statusPasswordMustChange = 0xC0000224
+	statusAccountLockedOut   = 0xC0000234
+)
+
+// ProbeResult tells whether a share can be reached and opened with its
+// credentials, without mounting it
+type ProbeResult struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	LatencyMs int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+
+	err error // Sentinel error of Status, for callers that fail on it
+}
+
+// Err returns nil if the share is usable, or an error wrapping
+// ErrHostUnreachable, ErrAuthFailed, ErrShareNotFound or ErrAccessDenied
+// depending on why not
+func (r *ProbeResult) Err() error {
+	if r.Status == ProbeOK {
+		return nil
+	}
+	if r.err != nil {
+		return fmt.Errorf("%w: %s", r.err, r.Message)
+	}
+	return errors.New(r.Message)
+}
+
+// Probe checks that a configured share can be reached and, for CIFS, that
+// its credentials log in and the share and directory exist. NFS shares are
+// only checked for a connection to their port.
+func (m *Manager) Probe(ctx context.Context, id string) (*ProbeResult, error) {
+	m.mu.RLock()
+	share, exists := m.shares[id]
+	var shareCopy Share
+	if exists {
+		shareCopy = *share
+	}
+	m.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("share %s not found", id)
+	}
+
+	password, err := m.sharePassword(&shareCopy)
+	if err != nil {
+		return nil, err
+	}
+	return m.probe(ctx, &shareCopy, password), nil
+}
+
+// sharePassword decrypts the stored password of share
+func (m *Manager) sharePassword(share *Share) (string, error) {
+	if share.Password == "" {
+		return "", nil
+	}
+	password, err := m.decrypt(share.Password)
+	if err != nil {
+		return "", fmt.Errorf("decrypt password: %w", err)
+	}
+	return password, nil
+}
+
+// preflight checks a share before it is mounted. CIFS shares are probed
+// over SMB2 unless they ask for SMB1, which the client doesn't speak;
+// errors it can't sort are left for mount to report.
+func (m *Manager) preflight(ctx context.Context, share *Share) error {
+	if share.Protocol != ProtocolCIFS || strings.HasPrefix(share.Options["vers"], "1") {
+		return m.probeHost(ctx, share)
+	}
+	password, err := m.sharePassword(share)
+	if err != nil {
+		return err
+	}
+	result := m.probe(ctx, share, password)
+	if result.Status == ProbeFailed {
+		return nil
+	}
+	if err := result.Err(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("probe %s: %w", share.Host, ctx.Err())
+		}
+		return err
+	}
+	return nil
+}
+
+// probe checks share within the check timeout
+func (m *Manager) probe(ctx context.Context, share *Share, password string) *ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, m.checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var result *ProbeResult
+	if share.Protocol == ProtocolCIFS {
+		result = probeSMB(ctx, share, password)
+	} else {
+		result = &ProbeResult{Status: ProbeOK}
+		if err := m.probeHost(ctx, share); err != nil {
+			result = &ProbeResult{Status: ProbeUnreachable, Message: err.Error(), err: ErrHostUnreachable}
+		}
+	}
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.CheckedAt = time.Now()
+	return result
+}
+
+// probeSMB logs in to the host of a CIFS share with SMB2 and opens the
+// share and the directory below it
+func probeSMB(ctx context.Context, share *Share, password string) *ProbeResult {
+	port := share.Options["port"]
+	if port == "" {
+		port = "445"
+	}
+	addr := net.JoinHostPort(share.Host, port)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return &ProbeResult{Status: ProbeUnreachable, Message: fmt.Sprintf("connect to %s: %v", addr, err), err: ErrHostUnreachable}
+	}
+	defer conn.Close()
+	// Reads of the SMB client don't all follow the context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The SMB client has no anonymous logins; servers map guest to them
+	user := share.Username
+	if user == "" {
+		user = "guest"
+	}
+	domain := share.Options["domain"]
+	if before, after, ok := strings.Cut(user, `\`); ok {
+		domain, user = before, after
+	}
+	smbDialer := &smb2.Dialer{Initiator: &smb2.NTLMInitiator{User: user, Password: password, Domain: domain}}
+	session, err := smbDialer.DialContext(ctx, conn)
+	if err != nil {
+		return smbProbeError("log in to "+addr, err)
+	}
+	session = session.WithContext(ctx)
+	defer session.Logoff()
+
+	name, dir, _ := strings.Cut(strings.Trim(share.Path, "/"), "/")
+	if name == "" {
+		return &ProbeResult{Status: ProbeShareNotFound, Message: "share path names no share", err: ErrShareNotFound}
+	}
+	fs, err := session.Mount(`\\` + share.Host + `\` + name)
+	if err != nil {
+		return smbProbeError("open share "+name, err)
+	}
+	fs = fs.WithContext(ctx)
+	defer fs.Umount()
+
+	if dir != "" {
+		info, err := fs.Stat(strings.ReplaceAll(dir, "/", `\`))
+		if err != nil {
+			return smbProbeError("open directory "+dir, err)
+		}
+		if !info.IsDir() {
+			return &ProbeResult{Status: ProbePathNotFound, Message: dir + " is not a directory", err: ErrShareNotFound}
+		}
+	}
+	return &ProbeResult{Status: ProbeOK}
+}
+
+// smbProbeError sorts an error of the SMB client into a probe outcome
+func smbProbeError(action string, err error) *ProbeResult {
+	message := fmt.Sprintf("%s: %v", action, err)
+
+	var respErr *smb2.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.Code {
+		case statusLogonFailure, statusAccountRestriction, statusInvalidLogonHours, statusPasswordExpired,
+			statusAccountDisabled, statusPasswordMustChange, statusAccountLockedOut:
+			return &ProbeResult{Status: ProbeAuthFailed, Message: message, err: ErrAuthFailed}
+		case statusBadNetworkName:
+			return &ProbeResult{Status: ProbeShareNotFound, Message: message, err: ErrShareNotFound}
+		case statusAccessDenied:
+			return &ProbeResult{Status: ProbeAccessDenied, Message: message, err: ErrAccessDenied}
+		case statusObjectNameNotFound, statusObjectPathNotFound:
+			return &ProbeResult{Status: ProbePathNotFound, Message: message, err: ErrShareNotFound}
+		}
+	}
+
+	var transportErr *smb2.TransportError
+	var ctxErr *smb2.ContextError
+	var netErr net.Error
+	if errors.As(err, &transportErr) || errors.As(err, &ctxErr) || errors.As(err, &netErr) && netErr.Timeout() {
+		return &ProbeResult{Status: ProbeUnreachable, Message: message, err: ErrHostUnreachable}
+	}
+	return &ProbeResult{Status: ProbeFailed, Message: message}
+}
@@ -0,0 +1,63 @@
+package netdisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+func TestSMBProbeError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status string
+		is     error
+	}{
+		{&smb2.ResponseError{Code: statusLogonFailure}, ProbeAuthFailed, ErrAuthFailed},
+		{&smb2.ResponseError{Code: statusAccountLockedOut}, ProbeAuthFailed, ErrAuthFailed},
+		{&smb2.ResponseError{Code: statusBadNetworkName}, ProbeShareNotFound, ErrShareNotFound},
+		{&smb2.ResponseError{Code: statusAccessDenied}, ProbeAccessDenied, ErrAccessDenied},
+		{&smb2.ResponseError{Code: statusObjectPathNotFound}, ProbePathNotFound, ErrShareNotFound},
+		{&smb2.TransportError{Err: errors.New("connection reset")}, ProbeUnreachable, ErrHostUnreachable},
+		{fmt.Errorf("read: %w", &net.OpError{Op: "read", Err: timeoutError{}}), ProbeUnreachable, ErrHostUnreachable},
+		{&smb2.InvalidResponseError{Message: "broken"}, ProbeFailed, nil},
+	}
+	for _, tt := range tests {
+		result := smbProbeError("log in", tt.err)
+		if result.Status != tt.status {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.status, result.Status)
+		}
+		if tt.is != nil && !errors.Is(result.Err(), tt.is) {
+			t.Errorf("%v: expected error wrapping %v, got %v", tt.err, tt.is, result.Err())
+		}
+	}
+}
+
+func TestProbeSMBUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	share := &Share{
+		Protocol: ProtocolCIFS,
+		Host:     "127.0.0.1",
+		Path:     "/data",
+		Options:  map[string]string{"port": port},
+	}
+	result := probeSMB(context.Background(), share, "")
+	if result.Status != ProbeUnreachable || !errors.Is(result.Err(), ErrHostUnreachable) {
+		t.Fatalf("expected unreachable, got %s: %v", result.Status, result.Err())
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
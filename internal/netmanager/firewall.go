@@ -0,0 +1,285 @@
+package netmanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// DefaultRouteInterface returns the interface carrying the IPv4 default route,
+// which is treated as the WAN interface when none is configured
+func (m *Manager) DefaultRouteInterface() (string, error) {
+	data, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", fmt.Errorf("read routing table: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] == "Iface" {
+			continue
+		}
+		if fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("no default route found")
+}
+
+// IsPortFiltered reports whether inbound traffic to port on iface is dropped
+// or rejected by the iptables INPUT chain or an nftables input hook. Hosts
+// usually carry only one of them, so an error is returned only when neither
+// ruleset can be read.
+func (m *Manager) IsPortFiltered(ctx context.Context, iface string, port int, protocol string) (bool, error) {
+	iptables, iptErr := sysexec.Output(ctx, "iptables", "-S", "INPUT")
+	if iptErr == nil && portFilteredByRules(string(iptables), iface, port, protocol) {
+		return true, nil
+	}
+
+	nft, nftErr := sysexec.Output(ctx, "nft", "list", "ruleset")
+	if nftErr == nil && portFilteredByNftRules(string(nft), iface, port, protocol) {
+		return true, nil
+	}
+
+	if iptErr != nil && nftErr != nil {
+		return false, fmt.Errorf("read firewall rules: iptables: %v; nft: %w", iptErr, nftErr)
+	}
+	return false, nil
+}
+
+// portFilteredByRules evaluates "iptables -S" output in order. Rules limited
+// to particular sources or connection states are ignored since they do not
+// decide reachability of new connections from arbitrary hosts.
+func portFilteredByRules(rules, iface string, port int, protocol string) bool {
+	policyDrop := false
+
+	scanner := bufio.NewScanner(strings.NewReader(rules))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		if fields[0] == "-P" {
+			policyDrop = len(fields) > 2 && fields[2] == "DROP"
+			continue
+		}
+		if fields[0] != "-A" {
+			continue
+		}
+
+		var target string
+		matches := true
+		for i := 2; i < len(fields); i++ {
+			next := ""
+			if i+1 < len(fields) {
+				next = fields[i+1]
+			}
+
+			switch fields[i] {
+			case "-i":
+				if next != iface && !(strings.HasSuffix(next, "+") && strings.HasPrefix(iface, strings.TrimSuffix(next, "+"))) {
+					matches = false
+				}
+				i++
+			case "-p":
+				if next != protocol && next != "all" {
+					matches = false
+				}
+				i++
+			case "--dport":
+				if !portInRange(next, port) {
+					matches = false
+				}
+				i++
+			case "--dports":
+				found := false
+				for _, spec := range strings.Split(next, ",") {
+					if portInRange(spec, port) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					matches = false
+				}
+				i++
+			case "-s", "--ctstate", "--state", "--src-range":
+				matches = false
+				i++
+			case "-j":
+				target = next
+				i++
+			}
+		}
+
+		if !matches {
+			continue
+		}
+
+		switch target {
+		case "ACCEPT":
+			return false
+		case "DROP", "REJECT":
+			return true
+		}
+	}
+
+	return policyDrop
+}
+
+// portFilteredByNftRules evaluates "nft list ruleset" output. Every base chain
+// hooked to input sees the packet, so the port is filtered when any of them
+// drops it, either by a matching rule or by its policy. As with iptables,
+// rules limited to sources or connection states are ignored and jumps to
+// regular chains are not followed.
+func portFilteredByNftRules(ruleset, iface string, port int, protocol string) bool {
+	inChain, inputHook, decided, filtered := false, false, false, false
+
+	scanner := bufio.NewScanner(strings.NewReader(ruleset))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(strings.NewReplacer("{", " { ", "}", " } ", ",", " ", ";", " ; ").Replace(line))
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "chain":
+			inChain, inputHook, decided = true, false, false
+			continue
+		case !inChain:
+			continue
+		case fields[0] == "}":
+			if inputHook && !decided && filtered {
+				return true
+			}
+			inChain = false
+			continue
+		case fields[0] == "type":
+			inputHook = strings.Contains(line, "hook input")
+			if i := strings.Index(line, "policy "); i >= 0 {
+				filtered = strings.HasPrefix(line[i+len("policy "):], "drop")
+			} else {
+				filtered = false
+			}
+			continue
+		}
+		if !inputHook || decided {
+			continue
+		}
+
+		verdict, matches := nftRuleVerdict(fields, iface, port, protocol)
+		if !matches {
+			continue
+		}
+		switch verdict {
+		case "accept":
+			decided, filtered = true, false
+		case "drop", "reject":
+			return true
+		}
+	}
+
+	return false
+}
+
+// nftRuleVerdict returns the verdict of a single nftables rule and whether the
+// rule matches new connections to port on iface
+func nftRuleVerdict(fields []string, iface string, port int, protocol string) (string, bool) {
+	verdict := ""
+	matches := true
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "iifname", "iif":
+			var names []string
+			names, i = nftValues(fields, i+1)
+			found := false
+			for _, name := range names {
+				name = strings.Trim(name, `"`)
+				if name == iface || (strings.HasSuffix(name, "*") && strings.HasPrefix(iface, strings.TrimSuffix(name, "*"))) {
+					found = true
+				}
+			}
+			matches = matches && found
+		case "l4proto":
+			var protos []string
+			protos, i = nftValues(fields, i+1)
+			matches = matches && containsString(protos, protocol)
+		case "tcp", "udp":
+			if i+1 < len(fields) && fields[i+1] == "dport" {
+				proto := fields[i]
+				var specs []string
+				specs, i = nftValues(fields, i+2)
+				found := false
+				for _, spec := range specs {
+					if portInRange(strings.Replace(spec, "-", ":", 1), port) {
+						found = true
+					}
+				}
+				matches = matches && proto == protocol && found
+			}
+		case "saddr", "state", "status":
+			matches = false
+		case "accept", "drop", "reject":
+			verdict = fields[i]
+		}
+	}
+	return verdict, matches
+}
+
+// nftValues reads the single value or anonymous set starting at fields[i] and
+// returns it with the index of its last token. A negated match yields no
+// values so the rule never counts as matching.
+func nftValues(fields []string, i int) ([]string, int) {
+	if i >= len(fields) {
+		return nil, i
+	}
+	if fields[i] == "!=" {
+		_, end := nftValues(fields, i+1)
+		return nil, end
+	}
+	if fields[i] != "{" {
+		return []string{fields[i]}, i
+	}
+
+	values := []string{}
+	for i++; i < len(fields) && fields[i] != "}"; i++ {
+		values = append(values, fields[i])
+	}
+	return values, i
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func portInRange(spec string, port int) bool {
+	low, high, isRange := strings.Cut(spec, ":")
+	start, err := strconv.Atoi(low)
+	if err != nil {
+		return false
+	}
+	if !isRange {
+		return start == port
+	}
+
+	end, err := strconv.Atoi(high)
+	if err != nil {
+		return false
+	}
+	return port >= start && port <= end
+}
@@ -0,0 +1,74 @@
+package netmanager
+
+import "testing"
+
+func TestPortFilteredByRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  bool
+	}{
+		{"accept policy", "-P INPUT ACCEPT\n", false},
+		{"drop policy", "-P INPUT DROP\n", true},
+		{"drop policy with accept", "-P INPUT DROP\n-A INPUT -i eth0 -p tcp -m tcp --dport 445 -j ACCEPT\n", false},
+		{"drop rule", "-P INPUT ACCEPT\n-A INPUT -i eth0 -p tcp -m tcp --dport 445 -j DROP\n", true},
+		{"reject multiport", "-P INPUT ACCEPT\n-A INPUT -p tcp -m multiport --dports 139,440:450 -j REJECT\n", true},
+		{"interface wildcard", "-P INPUT ACCEPT\n-A INPUT -i eth+ -p tcp --dport 445 -j DROP\n", true},
+		{"other interface", "-P INPUT ACCEPT\n-A INPUT -i wlan0 -p tcp --dport 445 -j DROP\n", false},
+		{"other port", "-P INPUT ACCEPT\n-A INPUT -p tcp --dport 22 -j DROP\n", false},
+		{"source limited", "-P INPUT ACCEPT\n-A INPUT -s 10.0.0.0/8 -p tcp --dport 445 -j DROP\n", false},
+		{"established first", "-P INPUT DROP\n-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := portFilteredByRules(tt.rules, "eth0", 445, "tcp"); got != tt.want {
+				t.Fatalf("portFilteredByRules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortFilteredByNftRules(t *testing.T) {
+	chain := func(policy string, rules ...string) string {
+		out := "table inet filter {\n\tset blocked {\n\t\ttype ipv4_addr\n\t\telements = { 10.0.0.1 }\n\t}\n\n\tchain input {\n" +
+			"\t\ttype filter hook input priority filter; policy " + policy + ";\n"
+		for _, rule := range rules {
+			out += "\t\t" + rule + "\n"
+		}
+		return out + "\t}\n}\n"
+	}
+
+	tests := []struct {
+		name    string
+		ruleset string
+		want    bool
+	}{
+		{"empty", "", false},
+		{"accept policy", chain("accept"), false},
+		{"drop policy", chain("drop"), true},
+		{"drop policy with accept", chain("drop", `iifname "eth0" tcp dport 445 accept`), false},
+		{"drop policy with set accept", chain("drop", "tcp dport { 22, 139, 445 } accept"), false},
+		{"drop policy with range accept", chain("drop", "tcp dport 400-500 counter packets 0 bytes 0 accept"), false},
+		{"drop rule", chain("accept", "tcp dport 445 drop"), true},
+		{"reject rule", chain("accept", `iifname "eth*" meta l4proto tcp tcp dport 445 reject with tcp reset`), true},
+		{"udp rule", chain("accept", "udp dport 445 drop"), false},
+		{"other interface", chain("accept", `iifname "wlan0" tcp dport 445 drop`), false},
+		{"negated interface", chain("accept", `iifname != "eth0" tcp dport 445 drop`), false},
+		{"source limited", chain("accept", "ip saddr @blocked tcp dport 445 drop"), false},
+		{"established only", chain("drop", "ct state established,related accept"), true},
+		{"loopback only", chain("drop", `iifname "lo" accept`), true},
+		{"jump ignored", chain("accept", "jump lan"), false},
+		{"forward chain", "table inet filter {\n\tchain forward {\n\t\ttype filter hook forward priority filter; policy drop;\n\t}\n}\n", false},
+		{"second base chain drops", chain("accept", "tcp dport 445 accept") +
+			"table ip extra {\n\tchain input {\n\t\ttype filter hook input priority 10; policy drop;\n\t}\n}\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := portFilteredByNftRules(tt.ruleset, "eth0", 445, "tcp"); got != tt.want {
+				t.Fatalf("portFilteredByNftRules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
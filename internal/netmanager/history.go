@@ -0,0 +1,351 @@
+package netmanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Export formats
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// HistoryFilter selects configuration history entries
+type HistoryFilter struct {
+	Interface string
+	Since     time.Time
+	Until     time.Time
+	Limit     int // Newest entries kept when set
+}
+
+// FieldChange is a single difference between two configurations
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// ConfigDiff compares two configuration history entries
+type ConfigDiff struct {
+	From    *ConfigHistory `json:"from"`
+	To      *ConfigHistory `json:"to"`
+	Changes []FieldChange  `json:"changes"`
+}
+
+func (m *Manager) openHistory(dbPath string, cacheSizeKB int) error {
+	dbDir := filepath.Dir(dbPath)
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return fmt.Errorf("create history directory %s: %w\n\nPlease ensure the directory exists and has correct permissions:\n  sudo mkdir -p %s\n  sudo chown -R $(whoami):$(whoami) %s", dbDir, err, dbDir, dbDir)
+	}
+
+	dsn := dbPath
+	if cacheSizeKB > 0 {
+		dsn += fmt.Sprintf("?_cache_size=-%d", cacheSizeKB)
+	}
+
+	if err := statefile.PrepareDB(dbPath); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+
+	schema := `
+	CREATE TABLE IF NOT EXISTS config_history (
+		id TEXT PRIMARY KEY,
+		timestamp INTEGER NOT NULL,
+		interface TEXT NOT NULL,
+		config TEXT NOT NULL,
+		user TEXT NOT NULL,
+		reason TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_history_timestamp ON config_history(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_history_interface ON config_history(interface, timestamp);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return fmt.Errorf("create schema: %w", err)
+	}
+
+	m.db = db
+	return nil
+}
+
+// importHistoryFile moves entries from the JSON history file used by older
+// versions into the database, then renames the file so it is imported once
+func (m *Manager) importHistoryFile(path string) error {
+	var entries []ConfigHistory
+	if err := statefile.Read(path, &entries); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin import: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i := range entries {
+		if err := insertHistory(context.Background(), tx, &entries[i], "INSERT OR IGNORE"); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit import: %w", err)
+	}
+
+	return os.Rename(path, path+".imported")
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertHistory(ctx context.Context, db execer, entry *ConfigHistory, verb string) error {
+	config, err := json.Marshal(entry.Config)
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, verb+` INTO config_history (id, timestamp, interface, config, user, reason)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		entry.ID, entry.Timestamp.UnixNano(), entry.Interface, string(config), entry.User, entry.Reason)
+	if err != nil {
+		return fmt.Errorf("insert history: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) addToHistory(ctx context.Context, iface string, config IPConfig, user, reason string) error {
+	now := time.Now()
+	entry := &ConfigHistory{
+		ID:        fmt.Sprintf("%s-%d", iface, now.UnixNano()),
+		Timestamp: now,
+		Interface: iface,
+		Config:    config,
+		User:      user,
+		Reason:    reason,
+	}
+
+	if err := insertHistory(ctx, m.db, entry, "INSERT"); err != nil {
+		return err
+	}
+	return m.pruneHistory(ctx)
+}
+
+// pruneHistory applies the retention limits
+func (m *Manager) pruneHistory(ctx context.Context) error {
+	if m.historyMaxAge > 0 {
+		cutoff := time.Now().Add(-m.historyMaxAge).UnixNano()
+		if _, err := m.db.ExecContext(ctx, `DELETE FROM config_history WHERE timestamp < ?`, cutoff); err != nil {
+			return fmt.Errorf("prune history: %w", err)
+		}
+	}
+
+	if m.historyMaxEntries > 0 {
+		_, err := m.db.ExecContext(ctx, `
+			DELETE FROM config_history WHERE id NOT IN (
+				SELECT id FROM config_history ORDER BY timestamp DESC LIMIT ?
+			)`, m.historyMaxEntries)
+		if err != nil {
+			return fmt.Errorf("prune history: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetConfigHistory returns a single history entry
+func (m *Manager) GetConfigHistory(ctx context.Context, id string) (*ConfigHistory, error) {
+	row := m.db.QueryRowContext(ctx, `
+		SELECT id, timestamp, interface, config, user, reason
+		FROM config_history WHERE id = ?`, id)
+
+	entry, err := scanHistory(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("configuration %s not found in history", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query history: %w", err)
+	}
+	return entry, nil
+}
+
+// ListConfigHistory returns configuration history, oldest first
+func (m *Manager) ListConfigHistory(ctx context.Context, filter *HistoryFilter) ([]ConfigHistory, error) {
+	query := `SELECT id, timestamp, interface, config, user, reason FROM config_history WHERE 1=1`
+	var args []interface{}
+
+	if filter != nil {
+		if filter.Interface != "" {
+			query += ` AND interface = ?`
+			args = append(args, filter.Interface)
+		}
+		if !filter.Since.IsZero() {
+			query += ` AND timestamp >= ?`
+			args = append(args, filter.Since.UnixNano())
+		}
+		if !filter.Until.IsZero() {
+			query += ` AND timestamp <= ?`
+			args = append(args, filter.Until.UnixNano())
+		}
+	}
+
+	query += ` ORDER BY timestamp DESC`
+	if filter != nil && filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []ConfigHistory{}
+	for rows.Next() {
+		entry, err := scanHistory(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan history: %w", err)
+		}
+		history = append(history, *entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query history: %w", err)
+	}
+
+	// Newest entries were selected for the limit; return them oldest first
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
+
+// DiffConfigHistory compares two history entries field by field
+func (m *Manager) DiffConfigHistory(ctx context.Context, fromID, toID string) (*ConfigDiff, error) {
+	from, err := m.GetConfigHistory(ctx, fromID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := m.GetConfigHistory(ctx, toID)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ConfigDiff{From: from, To: to, Changes: []FieldChange{}}
+	fromFields, toFields := configFields(&from.Config), configFields(&to.Config)
+	for i := range fromFields {
+		if fromFields[i][1] != toFields[i][1] {
+			diff.Changes = append(diff.Changes, FieldChange{
+				Field: fromFields[i][0],
+				From:  fromFields[i][1],
+				To:    toFields[i][1],
+			})
+		}
+	}
+	return diff, nil
+}
+
+// WriteConfigHistory writes history entries to w as JSON or CSV
+func WriteConfigHistory(w io.Writer, format string, history []ConfigHistory) error {
+	if format != ExportJSON && format != ExportCSV {
+		return fmt.Errorf("unsupported export format: %s", format)
+	}
+
+	if format == ExportJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(history)
+	}
+
+	writer := csv.NewWriter(w)
+	header := []string{"id", "timestamp", "user", "reason"}
+	for _, field := range configFields(&IPConfig{}) {
+		header = append(header, field[0])
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for i := range history {
+		record := []string{
+			history[i].ID,
+			history[i].Timestamp.UTC().Format(time.RFC3339),
+			history[i].User,
+			history[i].Reason,
+		}
+		for _, field := range configFields(&history[i].Config) {
+			record = append(record, field[1])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// configFields lists a configuration's fields as name/value pairs in a
+// fixed order, shared by diffs and CSV columns
+func configFields(config *IPConfig) [][2]string {
+	return [][2]string{
+		{"interface", config.Interface},
+		{"method", config.Method},
+		{"address", config.Address},
+		{"prefix", prefixString(config.Prefix)},
+		{"gateway", config.Gateway},
+		{"dns_servers", strings.Join(config.DNSServers, " ")},
+	}
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanHistory(row scanner) (*ConfigHistory, error) {
+	var entry ConfigHistory
+	var timestamp int64
+	var config string
+
+	if err := row.Scan(&entry.ID, &timestamp, &entry.Interface, &config, &entry.User, &entry.Reason); err != nil {
+		return nil, err
+	}
+
+	entry.Timestamp = time.Unix(0, timestamp)
+	if err := json.Unmarshal([]byte(config), &entry.Config); err != nil {
+		return nil, fmt.Errorf("unmarshal config %s: %w", entry.ID, err)
+	}
+
+	// Entries written before normalization may hold a prefix or a dotted
+	// mask in Netmask; ones that fail to parse are returned as stored
+	NormalizeIPConfig(&entry.Config)
+	return &entry, nil
+}
+
+func prefixString(prefix int) string {
+	if prefix == 0 {
+		return ""
+	}
+	return strconv.Itoa(prefix)
+}
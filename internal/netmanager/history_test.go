@@ -0,0 +1,73 @@
+package netmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigHistory(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "network-history.json")
+	if err := os.WriteFile(legacy, []byte(`[{"id":"eth0-1","timestamp":"2024-01-01T00:00:00Z","interface":"eth0","config":{"interface":"eth0","method":"dhcp"},"user":"admin","reason":"initial"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(&Config{
+		HistoryDB:         filepath.Join(dir, "history.db"),
+		HistoryFile:       legacy,
+		HistoryMaxEntries: 3,
+	})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	defer m.Close()
+
+	if _, err := os.Stat(legacy + ".imported"); err != nil {
+		t.Fatalf("expected legacy file to be renamed: %v", err)
+	}
+
+	ctx := context.Background()
+	static := IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", DNSServers: []string{"1.1.1.1"}}
+	for i := 0; i < 3; i++ {
+		if err := m.addToHistory(ctx, "eth0", static, "admin", "change"); err != nil {
+			t.Fatalf("add history: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	history, err := m.ListConfigHistory(ctx, &HistoryFilter{Interface: "eth0"})
+	if err != nil {
+		t.Fatalf("list history: %v", err)
+	}
+	if len(history) != 3 || history[0].ID == "eth0-1" {
+		t.Fatalf("expected the imported entry to be pruned, got %d entries starting with %s", len(history), history[0].ID)
+	}
+
+	if err := insertHistory(ctx, m.db, &ConfigHistory{ID: "old", Timestamp: time.Now().Add(-time.Hour), Interface: "eth0", Config: IPConfig{Interface: "eth0", Method: "dhcp"}}, "INSERT"); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := m.DiffConfigHistory(ctx, "old", history[2].ID)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if len(diff.Changes) != 3 {
+		t.Fatalf("expected method, address and dns changes, got %+v", diff.Changes)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteConfigHistory(&buf, ExportCSV, history); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("parse csv: %v", err)
+	}
+	if len(records) != 4 || records[0][0] != "id" || records[1][6] != "192.168.1.10" {
+		t.Fatalf("unexpected csv: %v", records)
+	}
+}
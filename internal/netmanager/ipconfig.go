@@ -0,0 +1,109 @@
+package netmanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// CIDR returns the address in CIDR notation, or "" when no address is set
+func (c *IPConfig) CIDR() string {
+	if c.Address == "" || c.Prefix == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", c.Address, c.Prefix)
+}
+
+// NormalizeIPConfig brings the address fields of config into canonical form.
+// The prefix may be given as CIDR notation in Address ("192.168.1.10/24"),
+// as Prefix, or as Netmask in either prefix ("24") or dotted IPv4
+// ("255.255.255.0") form; any that are set must agree. Afterwards Address
+// is a bare IP, Prefix holds the prefix length and Netmask the dotted IPv4
+// mask (empty for IPv6). Configs without an address are left unchanged.
+func NormalizeIPConfig(config *IPConfig) error {
+	if config.Address == "" {
+		return nil
+	}
+
+	var addr netip.Addr
+	bits := -1
+	if strings.Contains(config.Address, "/") {
+		prefix, err := netip.ParsePrefix(config.Address)
+		if err != nil {
+			return invalid(InvalidAddress, "address", "invalid address %q", config.Address)
+		}
+		addr, bits = prefix.Addr(), prefix.Bits()
+	} else {
+		parsed, err := netip.ParseAddr(config.Address)
+		if err != nil {
+			return invalid(InvalidAddress, "address", "invalid address %q", config.Address)
+		}
+		addr = parsed
+	}
+	addr = addr.Unmap()
+
+	for _, given := range []struct {
+		field string
+		bits  func() (int, error)
+		set   bool
+	}{
+		{"prefix", func() (int, error) { return config.Prefix, nil }, config.Prefix != 0},
+		{"netmask", func() (int, error) { return prefixLength(config.Netmask, addr.BitLen()) }, config.Netmask != ""},
+	} {
+		if !given.set {
+			continue
+		}
+		b, err := given.bits()
+		if err != nil {
+			return invalid(InvalidNetmask, given.field, "invalid %s: %v", given.field, err)
+		}
+		if bits >= 0 && b != bits {
+			return invalid(InvalidNetmask, given.field, "%s /%d does not match prefix /%d", given.field, b, bits)
+		}
+		bits = b
+	}
+
+	if bits < 0 {
+		return invalid(InvalidNetmask, "netmask", "netmask or prefix is required")
+	}
+	if bits < 1 || bits > addr.BitLen() {
+		return invalid(InvalidNetmask, "prefix", "prefix length must be between 1 and %d", addr.BitLen())
+	}
+
+	config.Address = addr.String()
+	config.Prefix = bits
+	config.Netmask = dottedMask(addr, bits)
+	return nil
+}
+
+// prefixLength accepts a prefix length ("24") or, for IPv4, a dotted mask
+// ("255.255.255.0")
+func prefixLength(netmask string, maxBits int) (int, error) {
+	if bits, err := strconv.Atoi(strings.TrimPrefix(netmask, "/")); err == nil {
+		if bits < 1 || bits > maxBits {
+			return 0, fmt.Errorf("prefix length must be between 1 and %d", maxBits)
+		}
+		return bits, nil
+	}
+
+	mask, err := netip.ParseAddr(netmask)
+	if err != nil || !mask.Is4() || maxBits != 32 {
+		return 0, errors.New("expected a prefix length or dotted IPv4 mask")
+	}
+	ones, bits := net.IPMask(mask.AsSlice()).Size()
+	if bits == 0 || ones == 0 {
+		return 0, errors.New("mask bits are not contiguous")
+	}
+	return ones, nil
+}
+
+// dottedMask formats an IPv4 prefix length as a dotted mask
+func dottedMask(addr netip.Addr, bits int) string {
+	if !addr.Is4() {
+		return ""
+	}
+	return net.IP(net.CIDRMask(bits, 32)).String()
+}
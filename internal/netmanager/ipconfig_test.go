@@ -0,0 +1,134 @@
+package netmanager
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeIPConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  IPConfig
+		address string
+		prefix  int
+		netmask string
+		wantErr bool
+	}{
+		{"prefix netmask", IPConfig{Address: "192.168.1.10", Netmask: "24"}, "192.168.1.10", 24, "255.255.255.0", false},
+		{"dotted netmask", IPConfig{Address: "192.168.1.10", Netmask: "255.255.255.0"}, "192.168.1.10", 24, "255.255.255.0", false},
+		{"prefix field", IPConfig{Address: "10.0.0.1", Prefix: 8}, "10.0.0.1", 8, "255.0.0.0", false},
+		{"cidr address", IPConfig{Address: "172.16.5.4/20"}, "172.16.5.4", 20, "255.255.240.0", false},
+		{"cidr with matching netmask", IPConfig{Address: "172.16.5.4/20", Netmask: "255.255.240.0"}, "172.16.5.4", 20, "255.255.240.0", false},
+		{"ipv6", IPConfig{Address: "2001:db8::10/64"}, "2001:db8::10", 64, "", false},
+		{"ipv4-mapped", IPConfig{Address: "::ffff:192.168.1.10", Netmask: "24"}, "192.168.1.10", 24, "255.255.255.0", false},
+		{"conflicting prefix", IPConfig{Address: "192.168.1.10/24", Prefix: 16}, "", 0, "", true},
+		{"conflicting netmask", IPConfig{Address: "192.168.1.10", Prefix: 24, Netmask: "255.255.0.0"}, "", 0, "", true},
+		{"dotted mask for ipv6", IPConfig{Address: "2001:db8::10", Netmask: "255.255.255.0"}, "", 0, "", true},
+		{"missing prefix", IPConfig{Address: "192.168.1.10"}, "", 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			err := NormalizeIPConfig(&config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+			if config.Address != tt.address || config.Prefix != tt.prefix || config.Netmask != tt.netmask {
+				t.Fatalf("got %s /%d %q, want %s /%d %q", config.Address, config.Prefix, config.Netmask, tt.address, tt.prefix, tt.netmask)
+			}
+
+			// Normalized configs are stable
+			again := config
+			if err := NormalizeIPConfig(&again); err != nil || !reflect.DeepEqual(again, config) {
+				t.Fatalf("second normalize changed %+v to %+v (%v)", config, again, err)
+			}
+		})
+	}
+}
+
+func TestIPConfigRoundTripThroughHistory(t *testing.T) {
+	m, err := New(&Config{HistoryDB: filepath.Join(t.TempDir(), "history.db")})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+
+	// An entry stored before normalization, with the prefix in Netmask
+	legacy := &ConfigHistory{ID: "eth0-legacy", Interface: "eth0", Config: IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "24", Gateway: "192.168.1.1"}}
+	if err := insertHistory(ctx, m.db, legacy, "INSERT"); err != nil {
+		t.Fatal(err)
+	}
+
+	input := IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "255.255.255.0", Gateway: "192.168.1.1"}
+	if err := ValidateIPConfig(&input); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.addToHistory(ctx, "eth0", input, "admin", "change"); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := m.ListConfigHistory(ctx, nil)
+	if err != nil || len(history) != 2 {
+		t.Fatalf("list history: %v (%d entries)", err, len(history))
+	}
+	for _, entry := range history {
+		if entry.Config.CIDR() != "192.168.1.10/24" || entry.Config.Netmask != "255.255.255.0" {
+			t.Fatalf("entry %s not normalized: %+v", entry.ID, entry.Config)
+		}
+
+		target, err := m.rollbackTarget(ctx, entry.ID)
+		if err != nil {
+			t.Fatalf("rollback target %s: %v", entry.ID, err)
+		}
+		if !reflect.DeepEqual(target.Config, entry.Config) {
+			t.Fatalf("rollback changed config %+v to %+v", entry.Config, target.Config)
+		}
+	}
+
+	diff, err := m.DiffConfigHistory(ctx, history[0].ID, history[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changes) != 0 {
+		t.Fatalf("expected equivalent configs to have no diff, got %+v", diff.Changes)
+	}
+}
+
+func TestIPConfigCommands(t *testing.T) {
+	config := &IPConfig{
+		Interface: "eth0",
+		Method:    "static",
+		Address:   "192.168.1.10",
+		Prefix:    24,
+		Gateway:   "192.168.1.1",
+	}
+
+	var commands [][]string
+	for _, command := range ipConfigCommands(config) {
+		commands = append(commands, command.args)
+	}
+	expected := [][]string{
+		{"ip", "addr", "flush", "dev", "eth0"},
+		{"ip", "addr", "add", "192.168.1.10/24", "dev", "eth0"},
+		{"ip", "route", "add", "default", "via", "192.168.1.1", "dev", "eth0"},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected %v, got %v", expected, commands)
+	}
+
+	dhcp := ipConfigCommands(&IPConfig{Interface: "eth0", Method: "dhcp"})
+	if len(dhcp) != 1 || dhcp[0].args[0] != "dhclient" {
+		t.Fatalf("unexpected dhcp commands: %+v", dhcp)
+	}
+}
@@ -3,15 +3,22 @@ package netmanager
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
+	"database/sql"
 	"fmt"
+	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/cache"
+	"github.com/KOPElan/mingyue-agent/internal/configrepo"
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
 )
 
 // Interface represents a network interface
@@ -37,7 +44,8 @@ type IPConfig struct {
 	Interface  string   `json:"interface"`
 	Method     string   `json:"method"` // "static" or "dhcp"
 	Address    string   `json:"address,omitempty"`
-	Netmask    string   `json:"netmask,omitempty"`
+	Prefix     int      `json:"prefix,omitempty"`  // Prefix length; canonical form of the netmask
+	Netmask    string   `json:"netmask,omitempty"` // Dotted IPv4 mask derived from Prefix
 	Gateway    string   `json:"gateway,omitempty"`
 	DNSServers []string `json:"dns_servers,omitempty"`
 }
@@ -64,40 +72,69 @@ type PortInfo struct {
 // Manager handles network management operations
 type Manager struct {
 	managementInterface string
-	historyFile         string
-	history             []ConfigHistory
+	db                  *sql.DB
+	historyMaxEntries   int
+	historyMaxAge       time.Duration
+	interfaces          *cache.Cache[[]Interface]
+	history             *configrepo.Repo
 	mu                  sync.RWMutex
 }
 
 // Config represents network manager configuration
 type Config struct {
 	ManagementInterface string
-	HistoryFile         string
+	HistoryDB           string
+	HistoryFile         string        // JSON history from older versions, imported once
+	HistoryMaxEntries   int           // Entries kept; 0 keeps all
+	HistoryMaxAge       time.Duration // Entries older than this are removed; 0 keeps all
+	CacheSizeKB         int
+	CacheTTL            time.Duration // How long interface listings are kept; 0 disables caching
 }
 
 // New creates a new network manager
 func New(cfg *Config) (*Manager, error) {
-	historyFile := cfg.HistoryFile
-	if historyFile == "" {
-		historyFile = "/var/lib/mingyue-agent/network-history.json"
+	historyDB := cfg.HistoryDB
+	if historyDB == "" {
+		historyDB = "/var/lib/mingyue-agent/network-history.db"
 	}
 
 	m := &Manager{
 		managementInterface: cfg.ManagementInterface,
-		historyFile:         historyFile,
-		history:             []ConfigHistory{},
+		historyMaxEntries:   cfg.HistoryMaxEntries,
+		historyMaxAge:       cfg.HistoryMaxAge,
+		interfaces:          cache.New[[]Interface](cfg.CacheTTL),
+	}
+
+	if err := m.openHistory(historyDB, cfg.CacheSizeKB); err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
 	}
 
-	// Load history
-	if err := m.loadHistory(); err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("load history: %w", err)
+	if cfg.HistoryFile != "" {
+		if err := m.importHistoryFile(cfg.HistoryFile); err != nil {
+			m.db.Close()
+			return nil, fmt.Errorf("import history: %w", err)
+		}
+	}
+
+	if err := m.pruneHistory(context.Background()); err != nil {
+		m.db.Close()
+		return nil, err
 	}
 
 	return m, nil
 }
 
+// Close closes the history database
+func (m *Manager) Close() error {
+	return m.db.Close()
+}
+
 // ListInterfaces returns all network interfaces
-func (m *Manager) ListInterfaces() ([]Interface, error) {
+func (m *Manager) ListInterfaces(ctx context.Context) ([]Interface, error) {
+	return m.interfaces.Get(ctx, "", m.listInterfaces)
+}
+
+func (m *Manager) listInterfaces(ctx context.Context) ([]Interface, error) {
 	interfaces := []Interface{}
 
 	// Read interface names from /sys/class/net
@@ -111,7 +148,7 @@ func (m *Manager) ListInterfaces() ([]Interface, error) {
 			continue
 		}
 
-		iface, err := m.getInterfaceInfo(entry.Name())
+		iface, err := m.getInterfaceInfo(ctx, entry.Name())
 		if err != nil {
 			continue
 		}
@@ -123,8 +160,8 @@ func (m *Manager) ListInterfaces() ([]Interface, error) {
 }
 
 // GetInterface returns information about a specific interface
-func (m *Manager) GetInterface(name string) (*Interface, error) {
-	iface, err := m.getInterfaceInfo(name)
+func (m *Manager) GetInterface(ctx context.Context, name string) (*Interface, error) {
+	iface, err := m.getInterfaceInfo(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -132,82 +169,116 @@ func (m *Manager) GetInterface(name string) (*Interface, error) {
 }
 
 // SetIPConfig sets IP configuration for an interface
-func (m *Manager) SetIPConfig(config *IPConfig, user, reason string) error {
+func (m *Manager) SetIPConfig(ctx context.Context, config *IPConfig, user, reason string) (err error) {
+	ctx, span := telemetry.Start(ctx, "netmanager.set_ip_config")
+	span.SetAttribute("interface", config.Interface)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	defer m.interfaces.Invalidate()
 
-	// Prevent configuration of non-management interface
-	if m.managementInterface != "" && config.Interface != m.managementInterface {
-		return fmt.Errorf("can only configure management interface %s", m.managementInterface)
+	if err := m.checkIPConfig(config); err != nil {
+		return err
+	}
+
+	currentConfig, _ := m.getCurrentIPConfig(ctx, config.Interface)
+
+	// Refuse to take an address another host already answers for
+	if config.Method == "static" && (currentConfig == nil || currentConfig.Address != config.Address) {
+		if err := telemetry.Run(ctx, "netmanager.probe_address_conflict", func(ctx context.Context) error {
+			return probeAddressConflict(ctx, config.Interface, config.Address)
+		}); err != nil {
+			return err
+		}
 	}
 
 	// Save current config to history before changing
-	currentConfig, _ := m.getCurrentIPConfig(config.Interface)
 	if currentConfig != nil {
-		m.addToHistory(config.Interface, *currentConfig, user, "backup before change")
+		if err := m.addToHistory(ctx, config.Interface, *currentConfig, user, "backup before change"); err != nil {
+			return fmt.Errorf("save current config: %w", err)
+		}
 	}
 
 	// Apply configuration
-	if err := m.applyIPConfig(config); err != nil {
+	if err := m.applyIPConfig(ctx, config); err != nil {
 		return fmt.Errorf("apply config: %w", err)
 	}
 
 	// Add new config to history
-	m.addToHistory(config.Interface, *config, user, reason)
+	return m.addToHistory(ctx, config.Interface, *config, user, reason)
+}
+
+// PlanIPConfig validates config and returns the commands and files
+// SetIPConfig would apply, without changing anything. The address conflict
+// probe is not run.
+func (m *Manager) PlanIPConfig(ctx context.Context, config *IPConfig) (*dryrun.Plan, error) {
+	if err := m.checkIPConfig(config); err != nil {
+		return nil, err
+	}
 
-	return m.saveHistory()
+	plan := dryrun.New()
+	for _, command := range ipConfigCommands(config) {
+		plan.AddCommand(command.args[0], command.args[1:]...)
+	}
+	if config.Method == "static" && len(config.DNSServers) > 0 {
+		plan.AddFile(resolvConf, resolvConfContent(config.DNSServers))
+	}
+	return plan, nil
+}
+
+// checkIPConfig validates a configuration for this host
+func (m *Manager) checkIPConfig(config *IPConfig) error {
+	// Prevent configuration of non-management interface
+	if m.managementInterface != "" && config.Interface != m.managementInterface {
+		return fmt.Errorf("can only configure management interface %s", m.managementInterface)
+	}
+
+	if err := ValidateIPConfig(config); err != nil {
+		return err
+	}
+	return checkInterfaceExists(config.Interface)
 }
 
 // RollbackConfig rolls back to a previous configuration
-func (m *Manager) RollbackConfig(historyID string, user string) error {
+func (m *Manager) RollbackConfig(ctx context.Context, historyID string, user string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	defer m.interfaces.Invalidate()
 
-	var targetConfig *ConfigHistory
-	for i := range m.history {
-		if m.history[i].ID == historyID {
-			targetConfig = &m.history[i]
-			break
-		}
-	}
-
-	if targetConfig == nil {
-		return fmt.Errorf("configuration %s not found in history", historyID)
+	targetConfig, err := m.rollbackTarget(ctx, historyID)
+	if err != nil {
+		return err
 	}
 
 	// Apply historical configuration
-	if err := m.applyIPConfig(&targetConfig.Config); err != nil {
+	if err := m.applyIPConfig(ctx, &targetConfig.Config); err != nil {
 		return fmt.Errorf("apply rollback config: %w", err)
 	}
 
 	// Add rollback to history
-	m.addToHistory(targetConfig.Interface, targetConfig.Config, user, fmt.Sprintf("rollback to %s", historyID))
-
-	return m.saveHistory()
+	return m.addToHistory(ctx, targetConfig.Interface, targetConfig.Config, user, fmt.Sprintf("rollback to %s", historyID))
 }
 
-// ListConfigHistory returns configuration history
-func (m *Manager) ListConfigHistory(iface string) []ConfigHistory {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	if iface == "" {
-		return m.history
+// rollbackTarget loads a history entry and validates it for reapplying
+func (m *Manager) rollbackTarget(ctx context.Context, historyID string) (*ConfigHistory, error) {
+	target, err := m.GetConfigHistory(ctx, historyID)
+	if err != nil {
+		return nil, err
 	}
-
-	filtered := []ConfigHistory{}
-	for _, h := range m.history {
-		if h.Interface == iface {
-			filtered = append(filtered, h)
-		}
+	if err := ValidateIPConfig(&target.Config); err != nil {
+		return nil, fmt.Errorf("history entry %s: %w", historyID, err)
 	}
-	return filtered
+	return target, nil
 }
 
 // EnableInterface enables a network interface
-func (m *Manager) EnableInterface(name string) error {
-	cmd := exec.Command("ip", "link", "set", name, "up")
-	output, err := cmd.CombinedOutput()
+func (m *Manager) EnableInterface(ctx context.Context, name string) error {
+	output, err := sysexec.CombinedOutput(ctx, "ip", "link", "set", name, "up")
+	m.interfaces.Invalidate()
 	if err != nil {
 		return fmt.Errorf("enable interface: %w, output: %s", err, string(output))
 	}
@@ -215,14 +286,14 @@ func (m *Manager) EnableInterface(name string) error {
 }
 
 // DisableInterface disables a network interface
-func (m *Manager) DisableInterface(name string) error {
+func (m *Manager) DisableInterface(ctx context.Context, name string) error {
 	// Prevent disabling management interface
 	if m.managementInterface != "" && name == m.managementInterface {
 		return fmt.Errorf("cannot disable management interface")
 	}
 
-	cmd := exec.Command("ip", "link", "set", name, "down")
-	output, err := cmd.CombinedOutput()
+	output, err := sysexec.CombinedOutput(ctx, "ip", "link", "set", name, "down")
+	m.interfaces.Invalidate()
 	if err != nil {
 		return fmt.Errorf("disable interface: %w, output: %s", err, string(output))
 	}
@@ -230,16 +301,18 @@ func (m *Manager) DisableInterface(name string) error {
 }
 
 // ListListeningPorts returns all listening ports
-func (m *Manager) ListListeningPorts() ([]PortInfo, error) {
+func (m *Manager) ListListeningPorts(ctx context.Context) ([]PortInfo, error) {
 	ports := []PortInfo{}
 
 	// Parse netstat or ss output
-	cmd := exec.Command("ss", "-tulpn")
-	output, err := cmd.CombinedOutput()
+	output, err := sysexec.CombinedOutput(ctx, "ss", "-tulpn")
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to get port info: %w", err)
+		}
+
 		// Fallback to netstat if ss is not available
-		cmd = exec.Command("netstat", "-tulpn")
-		output, err = cmd.CombinedOutput()
+		output, err = sysexec.CombinedOutput(ctx, "netstat", "-tulpn")
 		if err != nil {
 			return nil, fmt.Errorf("failed to get port info: %w", err)
 		}
@@ -259,9 +332,10 @@ func (m *Manager) ListListeningPorts() ([]PortInfo, error) {
 	return ports, nil
 }
 
-// GetTrafficStats returns traffic statistics for all interfaces
-func (m *Manager) GetTrafficStats() (map[string]Interface, error) {
-	interfaces, err := m.ListInterfaces()
+// GetTrafficStats returns traffic statistics for all interfaces. Counters
+// are always read afresh since clients compute rates from them.
+func (m *Manager) GetTrafficStats(ctx context.Context) (map[string]Interface, error) {
+	interfaces, err := m.listInterfaces(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +350,7 @@ func (m *Manager) GetTrafficStats() (map[string]Interface, error) {
 
 // Private methods
 
-func (m *Manager) getInterfaceInfo(name string) (Interface, error) {
+func (m *Manager) getInterfaceInfo(ctx context.Context, name string) (Interface, error) {
 	iface := Interface{
 		Name:        name,
 		LastUpdated: time.Now(),
@@ -342,8 +416,7 @@ func (m *Manager) getInterfaceInfo(name string) (Interface, error) {
 	}
 
 	// Get IP addresses using 'ip' command
-	cmd := exec.Command("ip", "-o", "addr", "show", name)
-	output, err := cmd.CombinedOutput()
+	output, err := sysexec.CombinedOutput(ctx, "ip", "-o", "addr", "show", name)
 	if err == nil {
 		scanner := bufio.NewScanner(bytes.NewReader(output))
 		for scanner.Scan() {
@@ -372,15 +445,14 @@ func (m *Manager) getInterfaceInfo(name string) (Interface, error) {
 	return iface, nil
 }
 
-func (m *Manager) getCurrentIPConfig(iface string) (*IPConfig, error) {
+func (m *Manager) getCurrentIPConfig(ctx context.Context, iface string) (*IPConfig, error) {
 	config := &IPConfig{
 		Interface: iface,
 	}
 
 	// Try to determine if using DHCP or static
 	// This is simplified - real implementation would check network manager config
-	cmd := exec.Command("ip", "addr", "show", iface)
-	output, err := cmd.CombinedOutput()
+	output, err := sysexec.CombinedOutput(ctx, "ip", "addr", "show", iface)
 	if err != nil {
 		return nil, err
 	}
@@ -392,23 +464,19 @@ func (m *Manager) getCurrentIPConfig(iface string) (*IPConfig, error) {
 			fields := strings.Fields(line)
 			for i, field := range fields {
 				if field == "inet" && i+1 < len(fields) {
-					parts := strings.Split(fields[i+1], "/")
-					if len(parts) > 0 {
-						config.Address = parts[0]
-					}
-					if len(parts) > 1 {
-						// Convert CIDR to netmask (simplified)
-						config.Netmask = parts[1]
-					}
+					// ip reports CIDR notation, e.g. 192.168.1.10/24
+					config.Address = fields[i+1]
 					break
 				}
 			}
 		}
 	}
+	if err := NormalizeIPConfig(config); err != nil {
+		return nil, fmt.Errorf("parse address of %s: %w", iface, err)
+	}
 
 	// Get gateway
-	cmd = exec.Command("ip", "route", "show", "dev", iface)
-	output, err = cmd.CombinedOutput()
+	output, err = sysexec.CombinedOutput(ctx, "ip", "route", "show", "dev", iface)
 	if err == nil {
 		lines = strings.Split(string(output), "\n")
 		for _, line := range lines {
@@ -429,83 +497,99 @@ func (m *Manager) getCurrentIPConfig(iface string) (*IPConfig, error) {
 	return config, nil
 }
 
-func (m *Manager) applyIPConfig(config *IPConfig) error {
-	if config.Method == "dhcp" {
+// ipCommand is one command run to apply an IP configuration
+type ipCommand struct {
+	step   string // Names the step in errors
+	args   []string
+	ignore string // Output that marks a harmless failure
+}
+
+// ipConfigCommands lists the commands that apply config, shared by
+// applyIPConfig and dry runs
+func ipConfigCommands(config *IPConfig) []ipCommand {
+	switch config.Method {
+	case "dhcp":
 		// Request DHCP configuration
-		cmd := exec.Command("dhclient", config.Interface)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("dhclient failed: %w, output: %s", err, string(output))
-		}
-	} else if config.Method == "static" {
-		// Flush existing addresses
-		cmd := exec.Command("ip", "addr", "flush", "dev", config.Interface)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("flush addresses: %w, output: %s", err, string(output))
-		}
+		return []ipCommand{{step: "dhclient failed", args: []string{"dhclient", config.Interface}}}
+	case "static":
+	default:
+		return nil
+	}
 
-		// Add static IP
-		if config.Address != "" && config.Netmask != "" {
-			cmd = exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%s", config.Address, config.Netmask), "dev", config.Interface)
-			if output, err := cmd.CombinedOutput(); err != nil {
-				return fmt.Errorf("add address: %w, output: %s", err, string(output))
-			}
-		}
+	// Flush existing addresses
+	commands := []ipCommand{{step: "flush addresses", args: []string{"ip", "addr", "flush", "dev", config.Interface}}}
 
-		// Add gateway
-		if config.Gateway != "" {
-			cmd = exec.Command("ip", "route", "add", "default", "via", config.Gateway, "dev", config.Interface)
-			output, err := cmd.CombinedOutput()
-			if err != nil && !strings.Contains(string(output), "File exists") {
-				return fmt.Errorf("add gateway: %w, output: %s", err, string(output))
-			}
+	// Add static IP
+	if cidr := config.CIDR(); cidr != "" {
+		commands = append(commands, ipCommand{step: "add address", args: []string{"ip", "addr", "add", cidr, "dev", config.Interface}})
+	}
+
+	// Add gateway
+	if config.Gateway != "" {
+		commands = append(commands, ipCommand{
+			step:   "add gateway",
+			args:   []string{"ip", "route", "add", "default", "via", config.Gateway, "dev", config.Interface},
+			ignore: "File exists",
+		})
+	}
+	return commands
+}
+
+func (m *Manager) applyIPConfig(ctx context.Context, config *IPConfig) error {
+	for _, command := range ipConfigCommands(config) {
+		output, err := sysexec.CombinedOutput(ctx, command.args[0], command.args[1:]...)
+		if err != nil && (command.ignore == "" || !strings.Contains(string(output), command.ignore)) {
+			return fmt.Errorf("%s: %w, output: %s", command.step, err, string(output))
 		}
+	}
 
-		// Update DNS if provided
-		if len(config.DNSServers) > 0 {
-			if err := m.updateDNS(config.DNSServers); err != nil {
-				return fmt.Errorf("update DNS: %w", err)
-			}
+	// Update DNS if provided
+	if config.Method == "static" && len(config.DNSServers) > 0 {
+		if err := m.updateDNS(ctx, config.DNSServers); err != nil {
+			return fmt.Errorf("update DNS: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func (m *Manager) updateDNS(servers []string) error {
+const resolvConf = "/etc/resolv.conf"
+
+func resolvConfContent(servers []string) string {
 	content := "# Generated by mingyue-agent\n"
 	for _, server := range servers {
 		content += fmt.Sprintf("nameserver %s\n", server)
 	}
+	return content
+}
 
-	// Backup existing resolv.conf
-	if _, err := os.Stat("/etc/resolv.conf"); err == nil {
-		os.Rename("/etc/resolv.conf", "/etc/resolv.conf.bak")
+func (m *Manager) updateDNS(ctx context.Context, servers []string) error {
+	// Replace a link to a resolver's generated file instead of writing
+	// through it
+	if info, err := os.Lstat(resolvConf); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(resolvConf); err != nil {
+			return fmt.Errorf("remove resolv.conf link: %w", err)
+		}
 	}
 
-	if err := os.WriteFile("/etc/resolv.conf", []byte(content), 0644); err != nil {
+	if err := os.WriteFile(resolvConf, []byte(resolvConfContent(servers)), 0644); err != nil {
 		return fmt.Errorf("write resolv.conf: %w", err)
 	}
 
+	if err := m.history.Record(ctx, "set dns servers", resolvConf); err != nil {
+		log.Printf("warning: record resolv.conf: %v", err)
+	}
 	return nil
 }
 
-func (m *Manager) addToHistory(iface string, config IPConfig, user, reason string) {
-	history := ConfigHistory{
-		ID:        fmt.Sprintf("%s-%d", iface, time.Now().Unix()),
-		Timestamp: time.Now(),
-		Interface: iface,
-		Config:    config,
-		User:      user,
-		Reason:    reason,
-	}
-
-	m.history = append(m.history, history)
+// SetConfigRepo records resolv.conf in history whenever DNS servers are set
+func (m *Manager) SetConfigRepo(ctx context.Context, history *configrepo.Repo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	// Keep only last 100 entries
-	if len(m.history) > 100 {
-		m.history = m.history[len(m.history)-100:]
-	}
+	m.history = history
+	// The resolver reads the file on every lookup
+	return history.Track(ctx, resolvConf, nil)
 }
 
 func (m *Manager) parsePortLine(line string) *PortInfo {
@@ -551,34 +635,3 @@ func (m *Manager) parsePortLine(line string) *PortInfo {
 		Process:  process,
 	}
 }
-
-func (m *Manager) saveHistory() error {
-	dir := filepath.Dir(m.historyFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("create history directory %s: %w\n\nPlease ensure the directory exists and has correct permissions:\n  sudo mkdir -p %s\n  sudo chown -R $(whoami):$(whoami) %s", dir, err, dir, dir)
-	}
-
-	data, err := json.MarshalIndent(m.history, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshal history: %w", err)
-	}
-
-	if err := os.WriteFile(m.historyFile, data, 0600); err != nil {
-		return fmt.Errorf("write history file: %w", err)
-	}
-
-	return nil
-}
-
-func (m *Manager) loadHistory() error {
-	data, err := os.ReadFile(m.historyFile)
-	if err != nil {
-		return err
-	}
-
-	if err := json.Unmarshal(data, &m.history); err != nil {
-		return fmt.Errorf("unmarshal history: %w", err)
-	}
-
-	return nil
-}
@@ -0,0 +1,168 @@
+package netmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// Validation error codes returned in ValidationError.Code
+const (
+	InvalidInterface   = "invalid_interface"
+	InvalidMethod      = "invalid_method"
+	InvalidAddress     = "invalid_address"
+	InvalidNetmask     = "invalid_netmask"
+	InvalidGateway     = "invalid_gateway"
+	GatewayNotInSubnet = "gateway_not_in_subnet"
+	InvalidDNS         = "invalid_dns"
+	AddressConflict    = "address_conflict"
+)
+
+// ValidationError describes an IP configuration rejected before it is applied
+type ValidationError struct {
+	Code    string                 `json:"code"`
+	Field   string                 `json:"field"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(code, field, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Code:    code,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// ValidateIPConfig checks a configuration without touching the system.
+// Static configs are normalized with NormalizeIPConfig.
+func ValidateIPConfig(config *IPConfig) error {
+	if config.Interface == "" || strings.ContainsAny(config.Interface, "/ \t") || len(config.Interface) > 15 {
+		return invalid(InvalidInterface, "interface", "invalid interface name %q", config.Interface)
+	}
+
+	switch config.Method {
+	case "dhcp":
+		return nil
+	case "static":
+	default:
+		return invalid(InvalidMethod, "method", "method must be static or dhcp, got %q", config.Method)
+	}
+
+	if config.Address == "" {
+		return invalid(InvalidAddress, "address", "address is required for a static config")
+	}
+	if err := NormalizeIPConfig(config); err != nil {
+		return err
+	}
+
+	addr := netip.MustParseAddr(config.Address)
+	if addr.Zone() != "" || addr.IsUnspecified() || addr.IsLoopback() || addr.IsMulticast() {
+		return invalid(InvalidAddress, "address", "%s cannot be assigned to an interface", addr)
+	}
+
+	bits := config.Prefix
+	prefix := netip.PrefixFrom(addr, bits)
+
+	// The network and broadcast addresses of an IPv4 subnet are not usable
+	if addr.Is4() && bits < 31 {
+		network := prefix.Masked().Addr()
+		if addr == network || addr == lastAddr(prefix) {
+			return invalid(InvalidAddress, "address", "%s is the network or broadcast address of %s", addr, prefix.Masked())
+		}
+	}
+
+	if config.Gateway != "" {
+		gateway, err := netip.ParseAddr(config.Gateway)
+		if err != nil {
+			return invalid(InvalidGateway, "gateway", "invalid gateway %q", config.Gateway)
+		}
+		gateway = gateway.Unmap()
+		if gateway.BitLen() != addr.BitLen() {
+			return invalid(InvalidGateway, "gateway", "gateway %s and address %s are different IP versions", gateway, addr)
+		}
+		if gateway == addr {
+			return invalid(InvalidGateway, "gateway", "gateway cannot be the interface address")
+		}
+		// IPv6 gateways are usually link-local and outside the prefix
+		if !(addr.Is6() && gateway.IsLinkLocalUnicast()) && !prefix.Contains(gateway) {
+			err := invalid(GatewayNotInSubnet, "gateway", "gateway %s is not in subnet %s", gateway, prefix.Masked())
+			err.Details = map[string]interface{}{"subnet": prefix.Masked().String()}
+			return err
+		}
+	}
+
+	for i, server := range config.DNSServers {
+		if _, err := netip.ParseAddr(server); err != nil {
+			err := invalid(InvalidDNS, "dns_servers", "invalid DNS server %q", server)
+			err.Details = map[string]interface{}{"index": i}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lastAddr returns the highest address in prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	for i := len(b) - 1; hostBits > 0; i-- {
+		if hostBits >= 8 {
+			b[i] = 0xff
+			hostBits -= 8
+		} else {
+			b[i] |= byte(1<<hostBits - 1)
+			hostBits = 0
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// checkInterfaceExists rejects configs for interfaces the kernel doesn't know
+func checkInterfaceExists(name string) error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", name)); err != nil {
+		return invalid(InvalidInterface, "interface", "interface %s does not exist", name)
+	}
+	return nil
+}
+
+// probeAddressConflict runs ARP duplicate address detection for an IPv4
+// address. It is skipped when arping is not installed.
+func probeAddressConflict(ctx context.Context, iface, address string) error {
+	addr, err := netip.ParseAddr(address)
+	if err != nil || !addr.Is4() {
+		return nil
+	}
+	if _, err := exec.LookPath("arping"); err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// With -D, arping exits 1 when another host answers for the address
+	output, err := sysexec.CombinedOutput(ctx, "arping", "-D", "-c", "2", "-w", "3", "-I", iface, address)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		err := invalid(AddressConflict, "address", "%s is already in use on the network", address)
+		if reply := strings.TrimSpace(string(output)); reply != "" {
+			err.Details = map[string]interface{}{"reply": reply}
+		}
+		return err
+	}
+	return nil
+}
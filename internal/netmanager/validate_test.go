@@ -0,0 +1,47 @@
+package netmanager
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateIPConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config IPConfig
+		code   string
+	}{
+		{"dhcp", IPConfig{Interface: "eth0", Method: "dhcp"}, ""},
+		{"static", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "24", Gateway: "192.168.1.1", DNSServers: []string{"1.1.1.1"}}, ""},
+		{"dotted netmask", IPConfig{Interface: "eth0", Method: "static", Address: "10.0.0.5", Netmask: "255.255.0.0"}, ""},
+		{"ipv6 link-local gateway", IPConfig{Interface: "eth0", Method: "static", Address: "2001:db8::10", Netmask: "64", Gateway: "fe80::1"}, ""},
+		{"bad interface", IPConfig{Interface: "eth0/../x", Method: "dhcp"}, InvalidInterface},
+		{"bad method", IPConfig{Interface: "eth0", Method: "manual"}, InvalidMethod},
+		{"bad address", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.300", Netmask: "24"}, InvalidAddress},
+		{"broadcast address", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.255", Netmask: "24"}, InvalidAddress},
+		{"missing netmask", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10"}, InvalidNetmask},
+		{"non-contiguous mask", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "255.0.255.0"}, InvalidNetmask},
+		{"prefix too long", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "33"}, InvalidNetmask},
+		{"gateway outside subnet", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "24", Gateway: "192.168.2.1"}, GatewayNotInSubnet},
+		{"gateway wrong family", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "24", Gateway: "2001:db8::1"}, InvalidGateway},
+		{"bad dns", IPConfig{Interface: "eth0", Method: "static", Address: "192.168.1.10", Netmask: "24", DNSServers: []string{"dns.example"}}, InvalidDNS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			err := ValidateIPConfig(&config)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("expected valid config, got %v", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Code != tt.code {
+				t.Fatalf("expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/pkg/plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// RoutePrefix is the path under which plugin routes are served:
+// /api/v1/plugins/<plugin name>/<route path>
+const RoutePrefix = "/api/v1/plugins/"
+
+// maxBodySize limits request bodies forwarded to plugins
+const maxBodySize = 10 << 20
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Definition declares a plugin process
+type Definition struct {
+	Name    string
+	Command string
+	Args    []string
+	Env     []string
+}
+
+// Status describes a running or failed plugin
+type Status struct {
+	Name      string           `json:"name"`
+	Command   string           `json:"command"`
+	State     string           `json:"state"` // starting, running, restarting, stopped
+	PID       int              `json:"pid,omitempty"`
+	Manifest  *plugin.Manifest `json:"manifest,omitempty"`
+	StartedAt time.Time        `json:"started_at,omitempty"`
+	Restarts  int              `json:"restarts"`
+	LastError string           `json:"last_error,omitempty"`
+}
+
+type instance struct {
+	def    Definition
+	socket string
+	mu     sync.RWMutex
+	status Status
+	client *plugin.Client
+}
+
+func (p *instance) snapshot() Status {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status := p.status
+	return status
+}
+
+// ready returns the client and manifest of a running plugin
+func (p *instance) ready() (*plugin.Client, *plugin.Manifest, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.status.State != "running" {
+		return nil, nil, false
+	}
+	return p.client, p.status.Manifest, true
+}
+
+// Manager supervises plugin processes and routes API calls, scheduled tasks
+// and events to them
+type Manager struct {
+	socketDir string
+	bus       *events.Bus
+	scheduler *scheduler.Scheduler
+	plugins   map[string]*instance
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// Config represents plugin manager configuration
+type Config struct {
+	SocketDir string
+	Plugins   []Definition
+	Bus       *events.Bus          // Optional; events are not delivered without it
+	Scheduler *scheduler.Scheduler // Optional; task types are not registered without it
+}
+
+// New validates plugin definitions. Call Start to launch the processes.
+func New(cfg *Config) (*Manager, error) {
+	socketDir := cfg.SocketDir
+	if socketDir == "" {
+		socketDir = "/run/mingyue-agent/plugins"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		socketDir: socketDir,
+		bus:       cfg.Bus,
+		scheduler: cfg.Scheduler,
+		plugins:   make(map[string]*instance),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	for _, def := range cfg.Plugins {
+		if !validName.MatchString(def.Name) {
+			cancel()
+			return nil, fmt.Errorf("invalid plugin name: %q", def.Name)
+		}
+		if _, exists := m.plugins[def.Name]; exists {
+			cancel()
+			return nil, fmt.Errorf("duplicate plugin name: %s", def.Name)
+		}
+		if !filepath.IsAbs(def.Command) {
+			cancel()
+			return nil, fmt.Errorf("plugin %s: command must be an absolute path", def.Name)
+		}
+
+		m.plugins[def.Name] = &instance{
+			def:    def,
+			socket: filepath.Join(socketDir, def.Name+".sock"),
+			status: Status{Name: def.Name, Command: def.Command, State: "stopped"},
+		}
+	}
+
+	return m, nil
+}
+
+// Start launches every plugin and restarts them when they exit
+func (m *Manager) Start() error {
+	if len(m.plugins) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.socketDir, 0700); err != nil {
+		return fmt.Errorf("create socket directory: %w", err)
+	}
+
+	for _, p := range m.plugins {
+		m.wg.Add(1)
+		go m.supervise(p)
+	}
+
+	return nil
+}
+
+// Stop terminates all plugin processes
+func (m *Manager) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// List returns the status of every plugin sorted by name
+func (m *Manager) List() []Status {
+	statuses := make([]Status, 0, len(m.plugins))
+	for _, p := range m.plugins {
+		statuses = append(statuses, p.snapshot())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// supervise runs a plugin until the manager stops, restarting it with
+// exponential backoff when it exits
+func (m *Manager) supervise(p *instance) {
+	defer m.wg.Done()
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := m.run(p)
+		if m.ctx.Err() != nil {
+			p.setState("stopped", nil)
+			return
+		}
+
+		log.Printf("plugin %s exited: %v (restarting in %s)", p.def.Name, err, backoff)
+		p.setState("restarting", err)
+		p.mu.Lock()
+		p.status.Restarts++
+		p.mu.Unlock()
+
+		select {
+		case <-m.ctx.Done():
+			p.setState("stopped", nil)
+			return
+		case <-time.After(backoff):
+		}
+
+		// A plugin that stayed up for a while gets a fresh backoff
+		if time.Since(started) > 5*time.Minute {
+			backoff = time.Second
+		} else if backoff < 5*time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// run starts the process, connects to it and blocks until it exits
+func (m *Manager) run(p *instance) error {
+	p.setState("starting", nil)
+	os.Remove(p.socket)
+
+	cmd := exec.CommandContext(m.ctx, p.def.Command, p.def.Args...)
+	cmd.Env = append(os.Environ(), p.def.Env...)
+	cmd.Env = append(cmd.Env, plugin.SocketEnv+"="+p.socket)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start process: %w", err)
+	}
+	go logOutput(p.def.Name, stdout)
+	go logOutput(p.def.Name, stderr)
+
+	var exitErr error
+	exited := make(chan struct{})
+	go func() {
+		exitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	conn, manifest, err := m.connect(p, exited)
+	if err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return err
+	}
+	defer conn.Close()
+
+	p.mu.Lock()
+	p.client = plugin.NewClient(conn)
+	p.status.State = "running"
+	p.status.PID = cmd.Process.Pid
+	p.status.Manifest = manifest
+	p.status.StartedAt = time.Now()
+	p.status.LastError = ""
+	p.mu.Unlock()
+
+	m.registerTasks(p, manifest)
+
+	var sub *events.Subscription
+	if m.bus != nil && len(manifest.EventTypes) > 0 {
+		sub = m.bus.Subscribe(&events.Filter{Types: manifest.EventTypes}, 256)
+		go m.forwardEvents(p, sub)
+	}
+
+	<-exited
+	if sub != nil {
+		sub.Close()
+	}
+	return exitErr
+}
+
+// connect waits for the plugin socket and fetches its manifest
+func (m *Manager) connect(p *instance, exited <-chan struct{}) (*grpc.ClientConn, *plugin.Manifest, error) {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if _, err := os.Stat(p.socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("plugin did not create %s within 30s", p.socket)
+		}
+
+		select {
+		case <-exited:
+			return nil, nil, fmt.Errorf("process exited during startup")
+		case <-m.ctx.Done():
+			return nil, nil, m.ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	conn, err := grpc.NewClient("unix://"+p.socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to plugin: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+
+	manifest, err := plugin.NewClient(conn).Describe(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("describe plugin: %w", err)
+	}
+	if manifest.Name != p.def.Name {
+		conn.Close()
+		return nil, nil, fmt.Errorf("plugin reports name %q, configured as %q", manifest.Name, p.def.Name)
+	}
+
+	return conn, manifest, nil
+}
+
+// registerTasks exposes plugin task types to the scheduler as
+// <plugin name>.<type>. Handlers look the client up on every run so they
+// survive plugin restarts.
+func (m *Manager) registerTasks(p *instance, manifest *plugin.Manifest) {
+	if m.scheduler == nil {
+		return
+	}
+
+	for _, taskType := range manifest.TaskTypes {
+		taskType := taskType
+		m.scheduler.RegisterHandler(p.def.Name+"."+taskType, func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+			client, _, ok := p.ready()
+			if !ok {
+				return nil, fmt.Errorf("plugin %s is not running", p.def.Name)
+			}
+
+			resp, err := client.RunTask(ctx, &plugin.TaskRequest{TaskType: taskType, Params: params})
+			if err != nil {
+				return nil, err
+			}
+			if resp.Error != "" {
+				return resp.Result, fmt.Errorf("%s", resp.Error)
+			}
+			return resp.Result, nil
+		})
+	}
+}
+
+func (m *Manager) forwardEvents(p *instance, sub *events.Subscription) {
+	for event := range sub.C {
+		client, _, ok := p.ready()
+		if !ok {
+			continue
+		}
+
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(m.ctx, 5*time.Second)
+		err = client.HandleEvent(ctx, &plugin.Event{
+			ID:        event.ID,
+			Type:      event.Type,
+			Timestamp: event.Timestamp.Format(time.RFC3339Nano),
+			Data:      data,
+		})
+		cancel()
+		if err != nil {
+			log.Printf("plugin %s: deliver %s: %v", p.def.Name, event.Type, err)
+		}
+	}
+}
+
+// Handle routes /api/v1/plugins/<name>/<path> to the plugin that declared a
+// matching route on behalf of user. It returns an error status when no
+// plugin or route matches.
+func (m *Manager) Handle(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+	rest := strings.TrimPrefix(r.URL.Path, RoutePrefix)
+	name, path, _ := strings.Cut(rest, "/")
+	path = "/" + path
+
+	p, exists := m.plugins[name]
+	if !exists {
+		return http.StatusNotFound, fmt.Errorf("plugin %s not found", name)
+	}
+
+	client, manifest, ok := p.ready()
+	if !ok {
+		return http.StatusServiceUnavailable, fmt.Errorf("plugin %s is not running", name)
+	}
+
+	if !routeMatches(manifest.Routes, r.Method, path) {
+		return http.StatusNotFound, fmt.Errorf("plugin %s has no route %s %s", name, r.Method, path)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("read request body: %w", err)
+	}
+	if len(body) > maxBodySize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBodySize)
+	}
+
+	headers := r.Header.Clone()
+	headers.Del("Authorization")
+	headers.Del("X-API-Key")
+	headers.Del("Cookie")
+
+	resp, err := client.HandleHTTP(r.Context(), &plugin.HTTPRequest{
+		Method:  r.Method,
+		Path:    path,
+		Query:   r.URL.Query(),
+		Headers: headers,
+		Body:    body,
+		User:    user,
+	})
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("plugin %s: %w", name, err)
+	}
+
+	for key, values := range resp.Headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(resp.Body)
+
+	return status, nil
+}
+
+func routeMatches(routes []plugin.Route, method, path string) bool {
+	for _, route := range routes {
+		if route.Method != "" && !strings.EqualFold(route.Method, method) {
+			continue
+		}
+		if route.Path == path || (strings.HasSuffix(route.Path, "/") && strings.HasPrefix(path, route.Path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *instance) setState(state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.status.State = state
+	if state != "running" {
+		p.status.PID = 0
+		p.client = nil
+	}
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+}
+
+func logOutput(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Printf("plugin %s: %s", name, scanner.Text())
+	}
+}
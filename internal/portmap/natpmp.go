@@ -0,0 +1,166 @@
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natpmpPort is the port gateways listen on for NAT-PMP requests
+const natpmpPort = 5351
+
+// natpmpAttempts bounds retransmissions; the wait doubles from 250ms
+const natpmpAttempts = 4
+
+// natpmpClient maps ports with NAT-PMP (RFC 6886)
+type natpmpClient struct {
+	gateway string // host:port
+}
+
+// natpmpResultCodes describes the result codes of RFC 6886 section 3.5
+var natpmpResultCodes = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+func newNATPMPClient(gateway string) *natpmpClient {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, strconv.Itoa(natpmpPort))
+	}
+	return &natpmpClient{gateway: gateway}
+}
+
+func (c *natpmpClient) method() string { return MethodNATPMP }
+
+func (c *natpmpClient) gatewayAddr() string { return c.gateway }
+
+func (c *natpmpClient) externalIP(ctx context.Context) (string, error) {
+	resp, err := c.request(ctx, []byte{0, 0}, 12)
+	if err != nil {
+		return "", fmt.Errorf("get external address: %w", err)
+	}
+	return net.IP(resp[8:12]).String(), nil
+}
+
+func (c *natpmpClient) addMapping(ctx context.Context, protocol string, internalPort, externalPort int, lease time.Duration, description string) (int, time.Duration, error) {
+	resp, err := c.request(ctx, natpmpMapRequest(protocol, internalPort, externalPort, lease), 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("map port: %w", err)
+	}
+	// The gateway may assign another external port and shorten the lease
+	mapped := int(binary.BigEndian.Uint16(resp[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return mapped, granted, nil
+}
+
+func (c *natpmpClient) deleteMapping(ctx context.Context, protocol string, internalPort, externalPort int) error {
+	// A lifetime of 0 with external port 0 deletes the mapping
+	if _, err := c.request(ctx, natpmpMapRequest(protocol, internalPort, 0, 0), 16); err != nil {
+		return fmt.Errorf("delete mapping: %w", err)
+	}
+	return nil
+}
+
+func natpmpMapRequest(protocol string, internalPort, externalPort int, lease time.Duration) []byte {
+	req := make([]byte, 12)
+	req[1] = 1 // UDP
+	if protocol == ProtocolTCP {
+		req[1] = 2
+	}
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lease/time.Second))
+	return req
+}
+
+// request sends req to the gateway, retransmitting until a response of at
+// least size bytes for the same opcode arrives
+func (c *natpmpClient) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 16)
+	for attempt := 0; attempt < natpmpAttempts; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(wait)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// Skip stray packets such as address change announcements
+			if n < size || buf[0] != 0 || buf[1] != req[1]+128 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+				if reason, ok := natpmpResultCodes[code]; ok {
+					return nil, fmt.Errorf("gateway returned %s", reason)
+				}
+				return nil, fmt.Errorf("gateway returned result code %d", code)
+			}
+			return buf[:n], nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("no response from %s", c.gateway)
+}
+
+// defaultGateway returns the IPv4 gateway of the default route
+func defaultGateway() (string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., addresses in little-endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip.String(), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no default route")
+}
@@ -0,0 +1,538 @@
+// Package portmap requests port mappings on the home router with UPnP IGD or
+// NAT-PMP, so remote access can be set up without configuring the router by
+// hand. Mappings are kept in a state file, renewed before their lease ends
+// and requested again after restarts.
+package portmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// Methods of talking to the router
+const (
+	MethodAuto   = "auto"
+	MethodUPnP   = "upnp"
+	MethodNATPMP = "natpmp"
+)
+
+// Mapping protocols
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// Mapping states
+const (
+	StateActive = "active"
+	StateFailed = "failed"
+)
+
+var (
+	// ErrNotFound is returned for unknown mappings
+	ErrNotFound = errors.New("mapping not found")
+	// ErrExists is returned when the internal port is already mapped
+	ErrExists = errors.New("mapping already exists")
+	// ErrConflict is returned when the router maps the external port to
+	// another host
+	ErrConflict = errors.New("external port is mapped to another host")
+	// ErrInvalid is returned for invalid mapping requests
+	ErrInvalid = errors.New("invalid mapping")
+	// ErrUnavailable is returned when no router answers UPnP or NAT-PMP
+	ErrUnavailable = errors.New("no port mapping gateway available")
+)
+
+// retryInterval is how long a failed mapping waits before it is requested
+// again
+const retryInterval = time.Minute
+
+// client talks to the router
+type client interface {
+	method() string
+	gatewayAddr() string
+	externalIP(ctx context.Context) (string, error)
+	// addMapping returns the external port and lease the router granted; a
+	// lease of 0 does not expire
+	addMapping(ctx context.Context, protocol string, internalPort, externalPort int, lease time.Duration, description string) (int, time.Duration, error)
+	deleteMapping(ctx context.Context, protocol string, internalPort, externalPort int) error
+}
+
+// Mapping is a port forwarded from the router to this host
+type Mapping struct {
+	ID           string    `json:"id"`
+	Protocol     string    `json:"protocol"`
+	InternalPort int       `json:"internal_port"`
+	ExternalPort int       `json:"external_port"` // Requested port; the router may assign another
+	MappedPort   int       `json:"mapped_port,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	LeaseSec     int       `json:"lease_sec"` // Granted lease; 0 does not expire
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+	RenewAt      time.Time `json:"renew_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Request asks for a new mapping
+type Request struct {
+	Protocol     string `json:"protocol"`
+	InternalPort int    `json:"internal_port"`
+	ExternalPort int    `json:"external_port"` // Same as InternalPort if 0
+	Description  string `json:"description"`
+}
+
+// Status reports the router and the mappings
+type Status struct {
+	Available  bool       `json:"available"`
+	Method     string     `json:"method,omitempty"`
+	Gateway    string     `json:"gateway,omitempty"`
+	ExternalIP string     `json:"external_ip,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Mappings   []*Mapping `json:"mappings"`
+}
+
+// Config configures the port mapping manager
+type Config struct {
+	StateFile       string
+	Method          string        // auto, upnp or natpmp
+	Gateway         string        // NAT-PMP gateway; the default route if empty
+	Lease           time.Duration // Requested lease of mappings
+	DiscoverTimeout time.Duration // How long to wait for UPnP gateways
+}
+
+// Manager maintains port mappings on the router
+type Manager struct {
+	stateFile       string
+	method          string
+	gateway         string
+	lease           time.Duration
+	discoverTimeout time.Duration
+	mappings        map[string]*Mapping
+	client          client
+	bus             *events.Bus
+	mu              sync.Mutex // Guards mappings and client
+	opMu            sync.Mutex // Serializes requests to the router
+	stop            chan struct{}
+	done            chan struct{}
+	newClient       func(ctx context.Context) (client, error)
+}
+
+// New creates a port mapping manager and starts renewing saved mappings
+func New(cfg *Config) (*Manager, error) {
+	method := cfg.Method
+	if method == "" {
+		method = MethodAuto
+	}
+	if method != MethodAuto && method != MethodUPnP && method != MethodNATPMP {
+		return nil, fmt.Errorf("invalid port mapping method %q", method)
+	}
+
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "/var/lib/mingyue-agent/portmap-state.json"
+	}
+
+	lease := cfg.Lease
+	if lease == 0 {
+		lease = time.Hour
+	}
+
+	discoverTimeout := cfg.DiscoverTimeout
+	if discoverTimeout == 0 {
+		discoverTimeout = 3 * time.Second
+	}
+
+	m := &Manager{
+		stateFile:       stateFile,
+		method:          method,
+		gateway:         cfg.Gateway,
+		lease:           lease,
+		discoverTimeout: discoverTimeout,
+		mappings:        make(map[string]*Mapping),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	m.newClient = m.discover
+
+	var saved []*Mapping
+	if err := statefile.Read(m.stateFile, &saved); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+	for _, mapping := range saved {
+		// Leases may have ended while the agent was down
+		mapping.RenewAt = time.Time{}
+		m.mappings[mapping.ID] = mapping
+	}
+
+	go m.renewLoop()
+	return m, nil
+}
+
+// SetEventBus publishes mapping state changes on bus
+func (m *Manager) SetEventBus(bus *events.Bus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bus = bus
+}
+
+// Stop stops renewing mappings. Mappings stay on the router until their
+// lease ends and are requested again on the next start.
+func (m *Manager) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+// List returns the mappings ordered by ID
+func (m *Manager) List() []*Mapping {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mappings := make([]*Mapping, 0, len(m.mappings))
+	for _, mapping := range m.mappings {
+		mappingCopy := *mapping
+		mappings = append(mappings, &mappingCopy)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].ID < mappings[j].ID
+	})
+	return mappings
+}
+
+// Status discovers the router if needed and reports its external address
+// along with the mappings
+func (m *Manager) Status(ctx context.Context) *Status {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+
+	status := &Status{}
+	c, err := m.getClient(ctx)
+	if err == nil {
+		status.Method = c.method()
+		status.Gateway = c.gatewayAddr()
+		status.ExternalIP, err = c.externalIP(ctx)
+		if err != nil {
+			m.resetClient()
+		}
+	}
+	status.Available = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Mappings = m.List()
+	return status
+}
+
+// Add requests a mapping from the router and keeps renewing it
+func (m *Manager) Add(ctx context.Context, req *Request) (*Mapping, error) {
+	if err := validate(req); err != nil {
+		return nil, err
+	}
+	if req.ExternalPort == 0 {
+		req.ExternalPort = req.InternalPort
+	}
+	id := fmt.Sprintf("%s-%d", req.Protocol, req.InternalPort)
+
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+
+	m.mu.Lock()
+	_, exists := m.mappings[id]
+	m.mu.Unlock()
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrExists, id)
+	}
+
+	mapping := &Mapping{
+		ID:           id,
+		Protocol:     req.Protocol,
+		InternalPort: req.InternalPort,
+		ExternalPort: req.ExternalPort,
+		Description:  req.Description,
+		CreatedAt:    time.Now(),
+	}
+	if err := m.request(ctx, mapping); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mappings[id] = mapping
+	if err := m.saveState(); err != nil {
+		return nil, err
+	}
+	mappingCopy := *mapping
+	return &mappingCopy, nil
+}
+
+// Remove releases a mapping on the router and stops renewing it. The mapping
+// is forgotten even if the router can't be reached, since it then expires
+// with its lease.
+func (m *Manager) Remove(ctx context.Context, id string) error {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+
+	m.mu.Lock()
+	mapping, exists := m.mappings[id]
+	if !exists {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	delete(m.mappings, id)
+	err := m.saveState()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if mapping.State != StateActive {
+		return nil
+	}
+	c, err := m.getClient(ctx)
+	if err == nil {
+		err = c.deleteMapping(ctx, mapping.Protocol, mapping.InternalPort, mapping.MappedPort)
+	}
+	if err != nil {
+		log.Printf("warning: release port mapping %s: %v", id, err)
+	}
+	return nil
+}
+
+// Refresh forgets the discovered router and requests all mappings again,
+// e.g. after the router was replaced
+func (m *Manager) Refresh(ctx context.Context) *Status {
+	m.opMu.Lock()
+	m.resetClient()
+	m.mu.Lock()
+	for _, mapping := range m.mappings {
+		mapping.RenewAt = time.Time{}
+	}
+	m.mu.Unlock()
+	m.opMu.Unlock()
+
+	m.renewDue(ctx)
+	return m.Status(ctx)
+}
+
+func validate(req *Request) error {
+	if req.Protocol != ProtocolTCP && req.Protocol != ProtocolUDP {
+		return fmt.Errorf("%w: protocol must be tcp or udp", ErrInvalid)
+	}
+	if req.InternalPort < 1 || req.InternalPort > 65535 {
+		return fmt.Errorf("%w: internal_port must be 1-65535", ErrInvalid)
+	}
+	if req.ExternalPort < 0 || req.ExternalPort > 65535 {
+		return fmt.Errorf("%w: external_port must be 1-65535", ErrInvalid)
+	}
+	if len(req.Description) > 64 {
+		return fmt.Errorf("%w: description is longer than 64 characters", ErrInvalid)
+	}
+	return nil
+}
+
+// request asks the router for mapping and records the outcome on it.
+// Callers hold m.opMu.
+func (m *Manager) request(ctx context.Context, mapping *Mapping) error {
+	c, err := m.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	description := mapping.Description
+	if description == "" {
+		description = "mingyue-agent " + mapping.ID
+	}
+	mapped, granted, err := c.addMapping(ctx, mapping.Protocol, mapping.InternalPort, mapping.ExternalPort, m.lease, description)
+	if err != nil {
+		if !errors.Is(err, ErrConflict) {
+			// The router may have restarted with another control URL
+			m.resetClient()
+		}
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	mapping.MappedPort = mapped
+	mapping.State = StateActive
+	mapping.Error = ""
+	mapping.LeaseSec = int(granted / time.Second)
+	if granted > 0 {
+		mapping.ExpiresAt = now.Add(granted)
+		mapping.RenewAt = now.Add(granted / 2)
+	} else {
+		// Permanent mappings are requested again in case the router
+		// forgot them on a reboot
+		mapping.ExpiresAt = time.Time{}
+		mapping.RenewAt = now.Add(m.lease)
+	}
+	return nil
+}
+
+// getClient returns the router client, discovering it on first use.
+// Callers hold m.opMu.
+func (m *Manager) getClient(ctx context.Context) (client, error) {
+	m.mu.Lock()
+	c := m.client
+	m.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	c, err := m.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.client = c
+	m.mu.Unlock()
+	return c, nil
+}
+
+func (m *Manager) resetClient() {
+	m.mu.Lock()
+	m.client = nil
+	m.mu.Unlock()
+}
+
+// discover finds a router speaking the configured protocol. In auto mode
+// UPnP is tried first, since NAT-PMP can only be probed with timeouts.
+func (m *Manager) discover(ctx context.Context) (client, error) {
+	var errs []error
+	if m.method != MethodNATPMP {
+		c, err := discoverUPnP(ctx, m.discoverTimeout)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, fmt.Errorf("upnp: %w", err))
+	}
+
+	if m.method != MethodUPnP {
+		gateway := m.gateway
+		if gateway == "" {
+			var err error
+			if gateway, err = defaultGateway(); err != nil {
+				errs = append(errs, fmt.Errorf("natpmp: find gateway: %w", err))
+				return nil, fmt.Errorf("%w: %v", ErrUnavailable, errors.Join(errs...))
+			}
+		}
+		c := newNATPMPClient(gateway)
+		_, err := c.externalIP(ctx)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, fmt.Errorf("natpmp: %w", err))
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrUnavailable, errors.Join(errs...))
+}
+
+func (m *Manager) renewLoop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+
+	for {
+		m.renewDue(ctx)
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// renewDue requests mappings whose renewal time has come
+func (m *Manager) renewDue(ctx context.Context) {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+
+	now := time.Now()
+	m.mu.Lock()
+	var due []*Mapping
+	for _, mapping := range m.mappings {
+		if !mapping.RenewAt.After(now) {
+			due = append(due, mapping)
+		}
+	}
+	m.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	for _, mapping := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		m.mu.Lock()
+		_, exists := m.mappings[mapping.ID]
+		previous := mapping.State
+		m.mu.Unlock()
+		if !exists {
+			continue
+		}
+
+		err := m.request(ctx, mapping)
+
+		m.mu.Lock()
+		if err != nil {
+			mapping.State = StateFailed
+			mapping.Error = err.Error()
+			mapping.RenewAt = time.Now().Add(retryInterval)
+		}
+		if mapping.State != previous {
+			m.bus.Publish("portmap.state", map[string]interface{}{
+				"id":            mapping.ID,
+				"state":         mapping.State,
+				"external_port": mapping.MappedPort,
+				"error":         mapping.Error,
+			})
+		}
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.saveState(); err != nil {
+		log.Printf("warning: save port mappings: %v", err)
+	}
+}
+
+// saveState writes the mappings. Callers hold m.mu.
+func (m *Manager) saveState() error {
+	mappings := make([]*Mapping, 0, len(m.mappings))
+	for _, mapping := range m.mappings {
+		mappings = append(mappings, mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].ID < mappings[j].ID
+	})
+
+	data, err := json.MarshalIndent(mappings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	if err := statefile.Write(m.stateFile, data, statefile.PrivateMode); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+	return nil
+}
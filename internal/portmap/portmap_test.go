@@ -0,0 +1,217 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATPMP is a NAT-PMP gateway that assigns the next external port
+type fakeNATPMP struct {
+	conn     net.PacketConn
+	mu       sync.Mutex
+	requests [][]byte
+}
+
+func startNATPMP(t *testing.T) *fakeNATPMP {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	g := &fakeNATPMP{conn: conn}
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := append([]byte(nil), buf[:n]...)
+			g.mu.Lock()
+			g.requests = append(g.requests, req)
+			g.mu.Unlock()
+
+			if req[1] == 0 {
+				resp := make([]byte, 12)
+				resp[1] = 128
+				copy(resp[8:], net.IPv4(203, 0, 113, 7).To4())
+				conn.WriteTo(resp, addr)
+				continue
+			}
+			resp := make([]byte, 16)
+			resp[1] = req[1] + 128
+			copy(resp[8:10], req[4:6])
+			external := binary.BigEndian.Uint16(req[6:8])
+			if external != 0 {
+				external++
+			}
+			binary.BigEndian.PutUint16(resp[10:12], external)
+			// Grant twice the requested lease
+			binary.BigEndian.PutUint32(resp[12:16], 2*binary.BigEndian.Uint32(req[8:12]))
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return g
+}
+
+func (g *fakeNATPMP) last() []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests[len(g.requests)-1]
+}
+
+func TestNATPMPMappings(t *testing.T) {
+	gateway := startNATPMP(t)
+	stateFile := filepath.Join(t.TempDir(), "portmap.json")
+	cfg := &Config{
+		StateFile: stateFile,
+		Method:    MethodNATPMP,
+		Gateway:   gateway.conn.LocalAddr().String(),
+		Lease:     time.Hour,
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := m.Add(ctx, &Request{Protocol: "sctp", InternalPort: 22}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+
+	mapping, err := m.Add(ctx, &Request{Protocol: ProtocolTCP, InternalPort: 8443})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if mapping.State != StateActive || mapping.MappedPort != 8444 || mapping.LeaseSec != 7200 {
+		t.Fatalf("unexpected mapping %+v", mapping)
+	}
+	if !mapping.RenewAt.Before(mapping.ExpiresAt) {
+		t.Fatalf("expected renewal before the lease ends, got %+v", mapping)
+	}
+	if _, err := m.Add(ctx, &Request{Protocol: ProtocolTCP, InternalPort: 8443}); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+
+	status := m.Status(ctx)
+	if !status.Available || status.Method != MethodNATPMP || status.ExternalIP != "203.0.113.7" || len(status.Mappings) != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// Mappings are requested again after a restart
+	m.Stop()
+	m, err = New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer m.Stop()
+	if mappings := m.List(); len(mappings) != 1 || mappings[0].ID != "tcp-8443" {
+		t.Fatalf("expected the saved mapping, got %+v", mappings)
+	}
+
+	if err := m.Remove(ctx, "tcp-8443"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if req := gateway.last(); req[1] != 2 || binary.BigEndian.Uint32(req[8:12]) != 0 {
+		t.Fatalf("expected a deletion request, got %v", req)
+	}
+	if err := m.Remove(ctx, "tcp-8443"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestUPnPMappings(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	var mux http.ServeMux
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList><device>
+      <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+      <deviceList><device>
+        <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+        <serviceList><service>
+          <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+          <controlURL>/ctl/IPConn</controlURL>
+        </service></serviceList>
+      </device></deviceList>
+    </device></deviceList>
+  </device>
+</root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		mu.Lock()
+		actions = append(actions, action)
+		mu.Unlock()
+
+		fault := func(code int) {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>refused</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code)
+		}
+		switch {
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>198.51.100.4</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		case strings.Contains(string(body), "<NewExternalPort>443<"):
+			fault(upnpConflictInMappingEntry)
+		case !strings.Contains(string(body), "<NewLeaseDuration>0<"):
+			fault(upnpOnlyPermanentLeasesSupported)
+		default:
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body/></s:Envelope>`)
+		}
+	})
+	server := httptest.NewServer(&mux)
+	defer server.Close()
+
+	m, err := New(&Config{StateFile: filepath.Join(t.TempDir(), "portmap.json"), Method: MethodUPnP})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer m.Stop()
+	m.newClient = func(ctx context.Context) (client, error) {
+		return newUPnPClient(ctx, server.URL+"/desc.xml")
+	}
+
+	ctx := context.Background()
+	mapping, err := m.Add(ctx, &Request{Protocol: ProtocolUDP, InternalPort: 51820, Description: "wireguard"})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	// The gateway only accepts permanent leases
+	if mapping.MappedPort != 51820 || mapping.LeaseSec != 0 || !mapping.ExpiresAt.IsZero() {
+		t.Fatalf("unexpected mapping %+v", mapping)
+	}
+	if _, err := m.Add(ctx, &Request{Protocol: ProtocolTCP, InternalPort: 8443, ExternalPort: 443}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	if status := m.Status(ctx); status.ExternalIP != "198.51.100.4" || status.Method != MethodUPnP {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if err := m.Remove(ctx, mapping.ID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if last := actions[len(actions)-1]; last != `"urn:schemas-upnp-org:service:WANIPConnection:1#DeletePortMapping"` {
+		t.Fatalf("expected DeletePortMapping, got %s", last)
+	}
+}
@@ -0,0 +1,327 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ssdpAddr = "239.255.255.250:1900"
+
+// upnpSearchTargets are the device types searched for with SSDP
+var upnpSearchTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// upnpServiceTypes are the WAN connection services that map ports, in order
+// of preference
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP error codes of the WANIPConnection service
+const (
+	upnpConflictInMappingEntry       = 718
+	upnpOnlyPermanentLeasesSupported = 725
+)
+
+// upnpClient maps ports through the WAN connection service of an Internet
+// Gateway Device
+type upnpClient struct {
+	controlURL  string
+	serviceType string
+	internalIP  string // Address of this host as seen by the gateway
+	gateway     string
+	http        *http.Client
+}
+
+// upnpError is a SOAP fault returned by the gateway
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.Code, e.Description)
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// discoverUPnP searches the local network for an Internet Gateway Device
+func discoverUPnP(ctx context.Context, timeout time.Duration) (*upnpClient, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("listen for ssdp: %w", err)
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range upnpSearchTargets {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + target + "\r\n\r\n"
+		if _, err := conn.WriteTo([]byte(msg), dst); err != nil {
+			return nil, fmt.Errorf("send ssdp search: %w", err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+
+	tried := make(map[string]bool)
+	var lastErr error
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		location := resp.Header.Get("Location")
+		if location == "" || tried[location] {
+			continue
+		}
+		tried[location] = true
+
+		client, err := newUPnPClient(ctx, location)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return client, nil
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.New("no upnp gateway found")
+}
+
+// newUPnPClient reads the device description at location and finds the
+// WAN connection service
+func newUPnPClient(ctx context.Context, location string) (*upnpClient, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("parse location %q: %w", location, err)
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get device description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get device description: %s", resp.Status)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("parse device description: %w", err)
+	}
+
+	service := findUPnPService(&root.Device)
+	if service == nil {
+		return nil, fmt.Errorf("%s has no wan connection service", location)
+	}
+	if root.URLBase != "" {
+		if urlBase, err := url.Parse(root.URLBase); err == nil {
+			base = urlBase
+		}
+	}
+	controlURL, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse control url %q: %w", service.ControlURL, err)
+	}
+
+	// The gateway forwards to the address we reach it from
+	conn, err := net.Dial("udp", controlURL.Host)
+	if err != nil {
+		if conn, err = net.Dial("udp", net.JoinHostPort(controlURL.Hostname(), "80")); err != nil {
+			return nil, fmt.Errorf("find local address: %w", err)
+		}
+	}
+	internalIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	conn.Close()
+
+	return &upnpClient{
+		controlURL:  controlURL.String(),
+		serviceType: service.ServiceType,
+		internalIP:  internalIP,
+		gateway:     controlURL.Hostname(),
+		http:        httpClient,
+	}, nil
+}
+
+// findUPnPService returns the preferred WAN connection service of device or
+// its embedded devices
+func findUPnPService(device *upnpDevice) *upnpService {
+	var all []upnpService
+	var walk func(*upnpDevice)
+	walk = func(d *upnpDevice) {
+		all = append(all, d.Services...)
+		for i := range d.Devices {
+			walk(&d.Devices[i])
+		}
+	}
+	walk(device)
+
+	for _, serviceType := range upnpServiceTypes {
+		for i := range all {
+			if all[i].ServiceType == serviceType {
+				return &all[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (c *upnpClient) method() string { return MethodUPnP }
+
+func (c *upnpClient) gatewayAddr() string { return c.gateway }
+
+func (c *upnpClient) externalIP(ctx context.Context) (string, error) {
+	var result struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := c.call(ctx, "GetExternalIPAddress", nil, &result); err != nil {
+		return "", fmt.Errorf("get external address: %w", err)
+	}
+	return result.IP, nil
+}
+
+func (c *upnpClient) addMapping(ctx context.Context, protocol string, internalPort, externalPort int, lease time.Duration, description string) (int, time.Duration, error) {
+	err := c.addPortMapping(ctx, protocol, internalPort, externalPort, lease, description)
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.Code == upnpOnlyPermanentLeasesSupported && lease != 0 {
+		// Older gateways only accept mappings without expiry
+		lease = 0
+		err = c.addPortMapping(ctx, protocol, internalPort, externalPort, lease, description)
+	}
+	if err != nil {
+		if errors.As(err, &upnpErr) && upnpErr.Code == upnpConflictInMappingEntry {
+			return 0, 0, fmt.Errorf("map port: %w", ErrConflict)
+		}
+		return 0, 0, fmt.Errorf("map port: %w", err)
+	}
+	return externalPort, lease, nil
+}
+
+func (c *upnpClient) addPortMapping(ctx context.Context, protocol string, internalPort, externalPort int, lease time.Duration, description string) error {
+	return c.call(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", strconv.Itoa(internalPort)},
+		{"NewInternalClient", c.internalIP},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", description},
+		{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+	}, nil)
+}
+
+func (c *upnpClient) deleteMapping(ctx context.Context, protocol string, internalPort, externalPort int) error {
+	err := c.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("delete mapping: %w", err)
+	}
+	return nil
+}
+
+// call invokes a SOAP action of the WAN connection service and decodes the
+// response envelope into result
+func (c *upnpClient) call(ctx context.Context, action string, args [][2]string, result interface{}) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + c.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.controlURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+c.serviceType+"#"+action+`"`)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.Unmarshal(data, &fault) == nil && fault.Code != 0 {
+			return &upnpError{Code: fault.Code, Description: fault.Description}
+		}
+		return fmt.Errorf("%s: %s", action, resp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("parse %s response: %w", action, err)
+	}
+	return nil
+}
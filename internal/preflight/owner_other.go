@@ -0,0 +1,10 @@
+//go:build !unix
+
+package preflight
+
+import "os"
+
+func fileOwner(info os.FileInfo) (uint32, bool) {
+	// Windows and other non-Unix systems have no Unix-style UID
+	return 0, false
+}
@@ -0,0 +1,427 @@
+// Package preflight checks that the host can run the agent with a given
+// configuration: config values, directory permissions, external tools,
+// listen addresses and database integrity.
+package preflight
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Check results
+const (
+	StatusOK      = "ok"
+	StatusWarning = "warning" // Degraded but the agent can run
+	StatusFatal   = "fatal"   // The agent must not start
+)
+
+// Check is the result of a single preflight check
+type Check struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+}
+
+// Report collects the results of all checks
+type Report struct {
+	Checks   []Check `json:"checks"`
+	Warnings int     `json:"warnings"`
+	Fatal    int     `json:"fatal"`
+}
+
+// HasFatal reports whether any check failed fatally
+func (r *Report) HasFatal() bool {
+	return r.Fatal > 0
+}
+
+// FatalChecks returns the checks that failed fatally
+func (r *Report) FatalChecks() []Check {
+	var checks []Check
+	for _, check := range r.Checks {
+		if check.Status == StatusFatal {
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// Print writes the report as aligned text
+func (r *Report) Print(w io.Writer) {
+	category := ""
+	for _, check := range r.Checks {
+		if check.Category != category {
+			category = check.Category
+			fmt.Fprintf(w, "%s:\n", category)
+		}
+		line := fmt.Sprintf("  [%-7s] %s", strings.ToUpper(check.Status), check.Name)
+		if check.Message != "" {
+			line += ": " + check.Message
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "\n%d checks, %d warnings, %d fatal\n", len(r.Checks), r.Warnings, r.Fatal)
+}
+
+func (r *Report) add(category, name, status, message string) {
+	r.Checks = append(r.Checks, Check{
+		Category: category,
+		Name:     name,
+		Status:   status,
+		Message:  message,
+	})
+	switch status {
+	case StatusWarning:
+		r.Warnings++
+	case StatusFatal:
+		r.Fatal++
+	}
+}
+
+// Run performs all checks against cfg. It does not modify the system apart
+// from short-lived write probes and listeners.
+func Run(cfg *config.Config) *Report {
+	report := &Report{}
+	checkConfig(report, cfg)
+	checkDirectories(report, cfg)
+	checkStateFiles(report, cfg)
+	checkTools(report, cfg)
+	checkListeners(report, cfg)
+	checkDatabases(report, cfg)
+	return report
+}
+
+func checkConfig(r *Report, cfg *config.Config) {
+	if err := cfg.Validate(); err != nil {
+		r.add("config", "validation", StatusFatal, err.Error())
+	} else {
+		r.add("config", "validation", StatusOK, "")
+	}
+
+	if !cfg.Security.TokenAuth {
+		r.add("config", "token_auth", StatusWarning, "API authentication is disabled")
+	}
+	if cfg.Features.NetDisk && cfg.NetDisk.EncryptionKey == config.DefaultEncryptionKey {
+		r.add("config", "netdisk.encryption_key", StatusWarning, "default key in use; stored credentials are not protected")
+	}
+	if cfg.API.EnableHTTP {
+		for _, l := range cfg.HTTPListeners() {
+			host, _, _ := net.SplitHostPort(l.Addr)
+			if !l.TLS() && host != "127.0.0.1" && host != "::1" && host != "localhost" {
+				r.add("config", "tls", StatusWarning, fmt.Sprintf("HTTP API on %s without TLS", l.Addr))
+			}
+		}
+	}
+}
+
+// requiredDirs lists directories the agent writes to at startup
+func requiredDirs(cfg *config.Config) map[string]string {
+	dirs := map[string]string{
+		"agent log": agentLogDir(cfg),
+	}
+	if cfg.Features.NetDisk {
+		dirs["network disk state"] = filepath.Dir(cfg.NetDisk.StateFile)
+	}
+	if cfg.Features.Network {
+		dirs["network history"] = filepath.Dir(cfg.Network.HistoryDB)
+	}
+	if cfg.Features.ShareMgr {
+		dirs["share state"] = filepath.Dir(cfg.ShareMgr.StateFile)
+	}
+	if cfg.History.Dir != "" {
+		dirs["configuration history"] = cfg.History.Dir
+	}
+	if cfg.API.EnableUDS {
+		dirs["unix socket"] = filepath.Dir(cfg.Server.UDSPath)
+	}
+	if cfg.Audit.Enabled && cfg.Audit.LogPath != "" {
+		dirs["audit log"] = filepath.Dir(cfg.Audit.LogPath)
+	}
+	return dirs
+}
+
+func checkDirectories(r *Report, cfg *config.Config) {
+	dirs := requiredDirs(cfg)
+	for _, name := range sortedKeys(dirs) {
+		if err := ensureWritableDir(dirs[name]); err != nil {
+			r.add("directories", name, StatusFatal, err.Error())
+		} else {
+			r.add("directories", name, StatusOK, dirs[name])
+		}
+	}
+
+	if cfg.Audit.Enabled && cfg.Audit.LogPath != "" {
+		if err := ensureWritableFile(cfg.Audit.LogPath); err != nil {
+			r.add("directories", "audit log file", StatusFatal, err.Error())
+		} else {
+			r.add("directories", "audit log file", StatusOK, cfg.Audit.LogPath)
+		}
+	}
+}
+
+// stateFiles lists files that hold agent state, including credentials
+func stateFiles(cfg *config.Config) map[string]string {
+	files := map[string]string{
+		"auth database":   cfg.Security.AuthDB,
+		"maintenance":     cfg.Security.MaintenanceFile,
+		"upload policies": cfg.Security.UploadPolicyFile,
+		"crash output":    filepath.Join(cfg.Crash.Dir, "crash.out"),
+	}
+	if cfg.Features.Scheduler {
+		files["scheduler database"] = cfg.Scheduler.DBPath
+	}
+	if cfg.Features.Indexer {
+		files["indexer database"] = cfg.Indexer.DBPath
+	}
+	if cfg.Features.Network {
+		files["network history"] = cfg.Network.HistoryDB
+	}
+	if cfg.Features.NetDisk {
+		files["network disk state"] = cfg.NetDisk.StateFile
+	}
+	if cfg.Features.ShareMgr {
+		files["share state"] = cfg.ShareMgr.StateFile
+	}
+	if cfg.Features.PortMap {
+		files["port mapping state"] = cfg.PortMap.StateFile
+	}
+	if cfg.Features.WAN {
+		files["wan history"] = cfg.WAN.HistoryFile
+	}
+	if cfg.Features.Rsync {
+		files["rsync state"] = cfg.Rsync.StateFile
+	}
+	if cfg.Features.Alerts {
+		files["alerts"] = cfg.Alerts.StateFile
+	}
+	return files
+}
+
+// checkStateFiles makes sure state directories belong to the user the agent
+// runs as and that nobody else can change, or read, the state in them
+func checkStateFiles(r *Report, cfg *config.Config) {
+	files := stateFiles(cfg)
+	dirs := make(map[string]string)
+	for name, path := range files {
+		if path != "" {
+			dirs[filepath.Dir(path)] = name
+		}
+	}
+
+	uid := os.Geteuid()
+	for _, dir := range sortedKeys(dirs) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			continue // checkDirectories reports missing directories
+		}
+		name := dir
+		if owner, ok := fileOwner(info); ok && uid >= 0 && int(owner) != uid {
+			r.add("state", name, StatusFatal, fmt.Sprintf("owned by uid %d, but the agent runs as uid %d", owner, uid))
+			continue
+		}
+		switch mode := info.Mode().Perm(); {
+		case mode&0002 != 0:
+			r.add("state", name, StatusFatal, fmt.Sprintf("world-writable (mode %04o)", mode))
+		case mode&0022 != 0:
+			r.add("state", name, StatusWarning, fmt.Sprintf("writable by group (mode %04o); use 0700 or 0750", mode))
+		default:
+			r.add("state", name, StatusOK, fmt.Sprintf("mode %04o", mode))
+		}
+	}
+
+	for _, name := range sortedKeys(files) {
+		info, err := os.Stat(files[name])
+		if err != nil {
+			continue
+		}
+		if mode := info.Mode().Perm(); mode&0077 != 0 {
+			r.add("state", name+" permissions", StatusWarning,
+				fmt.Sprintf("%s has mode %04o; the agent restricts it to %04o when it next opens or saves it", files[name], mode, statefile.PrivateMode))
+		}
+	}
+}
+
+// tools lists external commands used by each subsystem
+var tools = []struct {
+	feature  func(config.FeaturesConfig) bool
+	name     string
+	commands []string
+}{
+	{func(f config.FeaturesConfig) bool { return f.Disks }, "disks", []string{"lsblk", "blkid", "mount", "umount", "smartctl"}},
+	{func(f config.FeaturesConfig) bool { return f.NetDisk }, "netdisk", []string{"mount", "umount"}},
+	{func(f config.FeaturesConfig) bool { return f.Network }, "network", []string{"ip", "ss", "arping"}},
+	{func(f config.FeaturesConfig) bool { return f.ShareMgr }, "sharemgr", []string{"testparm", "smbstatus", "exportfs", "systemctl"}},
+	{func(f config.FeaturesConfig) bool { return f.Rsync }, "rsync", []string{"rsync", "systemctl"}},
+	{func(f config.FeaturesConfig) bool { return f.WAN }, "wan", []string{"ping"}},
+}
+
+func checkTools(r *Report, cfg *config.Config) {
+	checked := make(map[string]bool)
+	for _, group := range tools {
+		if !group.feature(cfg.Features) {
+			continue
+		}
+		for _, command := range group.commands {
+			if checked[command] {
+				continue
+			}
+			checked[command] = true
+
+			if path, err := exec.LookPath(command); err != nil {
+				r.add("tools", command, StatusWarning, fmt.Sprintf("not found; %s operations that need it will fail", group.name))
+			} else {
+				r.add("tools", command, StatusOK, path)
+			}
+		}
+	}
+}
+
+func checkListeners(r *Report, cfg *config.Config) {
+	if cfg.API.EnableHTTP {
+		for _, l := range cfg.HTTPListeners() {
+			host, port, err := net.SplitHostPort(l.Addr)
+			if err != nil {
+				r.add("listeners", "http", StatusFatal, err.Error())
+				continue
+			}
+			checkPort(r, "http", host, port)
+		}
+	}
+	if cfg.API.EnableGRPC {
+		checkPort(r, "grpc", cfg.Server.ListenAddr, cfg.Server.GRPCPort)
+	}
+	if cfg.FTP.Enabled {
+		checkPort(r, "ftp", cfg.FTP.ListenAddr, cfg.FTP.Port)
+	}
+	if cfg.SFTP.Enabled {
+		checkPort(r, "sftp", cfg.SFTP.ListenAddr, cfg.SFTP.Port)
+	}
+	if cfg.API.EnableUDS {
+		// The server replaces a stale socket file, but one that still
+		// accepts connections belongs to a running agent
+		if conn, err := net.DialTimeout("unix", cfg.Server.UDSPath, time.Second); err == nil {
+			conn.Close()
+			r.add("listeners", "uds", StatusFatal, fmt.Sprintf("%s is in use by a running process", cfg.Server.UDSPath))
+		} else {
+			r.add("listeners", "uds", StatusOK, cfg.Server.UDSPath)
+		}
+	}
+}
+
+func checkPort(r *Report, name, host string, port any) {
+	addr := net.JoinHostPort(host, fmt.Sprint(port))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		r.add("listeners", name, StatusFatal, fmt.Sprintf("cannot bind %s: %v", addr, err))
+		return
+	}
+	lis.Close()
+	r.add("listeners", name, StatusOK, addr)
+}
+
+func checkDatabases(r *Report, cfg *config.Config) {
+	dbs := map[string]string{
+		"auth": cfg.Security.AuthDB,
+	}
+	if cfg.Features.Scheduler {
+		dbs["scheduler"] = cfg.Scheduler.DBPath
+	}
+	if cfg.Features.Indexer {
+		dbs["indexer"] = cfg.Indexer.DBPath
+	}
+	if cfg.Features.Network {
+		dbs["network history"] = cfg.Network.HistoryDB
+	}
+
+	for _, name := range sortedKeys(dbs) {
+		path := dbs[name]
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			r.add("databases", name, StatusOK, "will be created at "+path)
+			continue
+		}
+		if err := checkIntegrity(path); err != nil {
+			r.add("databases", name, StatusFatal, err.Error())
+		} else {
+			r.add("databases", name, StatusOK, path)
+		}
+	}
+}
+
+// checkIntegrity runs SQLite's quick_check on an existing database
+func checkIntegrity(path string) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("check %s: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s is corrupt: %s", path, result)
+	}
+	return nil
+}
+
+func ensureWritableDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("directory does not exist: %s", path)
+		}
+		return fmt.Errorf("cannot access directory: %s (%v)", path, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("path exists but is not a directory: %s", path)
+	}
+
+	testFile := filepath.Join(path, ".mingyue-agent-write-test")
+	if err := os.WriteFile(testFile, []byte("test"), 0644); err != nil {
+		return fmt.Errorf("directory is not writable: %s (%v)", path, err)
+	}
+
+	if err := os.Remove(testFile); err != nil {
+		return fmt.Errorf("remove write test file: %s (%v)", path, err)
+	}
+
+	return nil
+}
+
+func ensureWritableFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %s (%v)", path, err)
+	}
+	return file.Close()
+}
+
+func agentLogDir(cfg *config.Config) string {
+	if cfg.Audit.Enabled && cfg.Audit.LogPath != "" {
+		return filepath.Dir(cfg.Audit.LogPath)
+	}
+	return "/var/log/mingyue-agent"
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,86 @@
+package preflight
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+)
+
+func findCheck(t *testing.T, report *Report, category, name string) Check {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Category == category && check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("check %s/%s not found", category, name)
+	return Check{}
+}
+
+func TestListenerInUseIsFatal(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+
+	report := &Report{}
+	checkPort(report, "http", "127.0.0.1", lis.Addr().(*net.TCPAddr).Port)
+
+	if check := findCheck(t, report, "listeners", "http"); check.Status != StatusFatal {
+		t.Fatalf("expected fatal, got %s", check.Status)
+	}
+	if !report.HasFatal() {
+		t.Fatal("expected report to have fatal issues")
+	}
+}
+
+func TestCorruptDatabaseIsFatal(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "auth.db")
+	if err := os.WriteFile(corrupt, []byte("not a database file, just some bytes"), 0600); err != nil {
+		t.Fatalf("write db: %v", err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Security.AuthDB = corrupt
+	cfg.Features.Scheduler = true
+	cfg.Scheduler.DBPath = filepath.Join(dir, "scheduler.db")
+
+	report := &Report{}
+	checkDatabases(report, cfg)
+
+	if check := findCheck(t, report, "databases", "auth"); check.Status != StatusFatal {
+		t.Fatalf("expected corrupt database to be fatal, got %s", check.Status)
+	}
+	if check := findCheck(t, report, "databases", "scheduler"); check.Status != StatusOK {
+		t.Fatalf("expected missing database to be ok, got %s: %s", check.Status, check.Message)
+	}
+}
+
+func TestStatePermissions(t *testing.T) {
+	dir := t.TempDir()
+	authDB := filepath.Join(dir, "auth.db")
+	if err := os.WriteFile(authDB, nil, 0644); err != nil {
+		t.Fatalf("write db: %v", err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Security.AuthDB = authDB
+
+	report := &Report{}
+	checkStateFiles(report, cfg)
+
+	if check := findCheck(t, report, "state", dir); check.Status != StatusFatal {
+		t.Fatalf("expected world-writable state directory to be fatal, got %s: %s", check.Status, check.Message)
+	}
+	if check := findCheck(t, report, "state", "auth database permissions"); check.Status != StatusWarning {
+		t.Fatalf("expected readable auth database to warn, got %s", check.Status)
+	}
+}
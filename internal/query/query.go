@@ -0,0 +1,203 @@
+// Package query parses field selections in the style of GraphQL, such as
+// "shares{name,healthy} disks{device,smart{temperature}}", and trims JSON
+// values down to the selected fields. It lets clients ask for several
+// resources at once and receive only what they show.
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Limits keep a query from costing more to parse than to answer
+const (
+	MaxLength = 4096
+	MaxDepth  = 8
+)
+
+// Field is a selected field. A field without subfields selects its whole
+// value.
+type Field struct {
+	Name   string
+	Fields []Field
+}
+
+// Find returns the subfield called name, or nil
+func Find(fields []Field, name string) *Field {
+	for i := range fields {
+		if fields[i].Name == name {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// SyntaxError reports where a query is malformed
+type SyntaxError struct {
+	Offset  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query syntax error at offset %d: %s", e.Offset, e.Message)
+}
+
+// Parse parses a selection: names separated by commas or whitespace, each
+// optionally followed by a braced selection of its subfields. A name
+// selected twice has its subfields merged.
+func Parse(input string) ([]Field, error) {
+	if len(input) > MaxLength {
+		return nil, &SyntaxError{Offset: MaxLength, Message: fmt.Sprintf("query is longer than %d bytes", MaxLength)}
+	}
+	p := &parser{input: input}
+	fields, err := p.selection(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos])
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty query")
+	}
+	return fields, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: p.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+// selection parses fields up to a closing brace or the end of the input
+func (p *parser) selection(depth int) ([]Field, error) {
+	if depth > MaxDepth {
+		return nil, p.errorf("selection nested deeper than %d levels", MaxDepth)
+	}
+
+	var fields []Field
+	for {
+		p.skipSeparators()
+		if p.pos >= len(p.input) || p.input[p.pos] == '}' {
+			return fields, nil
+		}
+
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("expected a field name, got %q", p.input[p.pos])
+		}
+		field := Field{Name: name}
+
+		p.skipSpace()
+		if p.pos < len(p.input) && p.input[p.pos] == '{' {
+			p.pos++
+			sub, err := p.selection(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if p.pos >= len(p.input) {
+				return nil, p.errorf("missing closing brace for %q", name)
+			}
+			if len(sub) == 0 {
+				return nil, p.errorf("empty selection for %q", name)
+			}
+			p.pos++
+			field.Fields = sub
+		}
+		fields = merge(fields, field)
+	}
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && isSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *parser) skipSeparators() {
+	for p.pos < len(p.input) && (isSpace(p.input[p.pos]) || p.input[p.pos] == ',') {
+		p.pos++
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// merge adds field to fields, combining it with an earlier field of the
+// same name. Selecting a whole value wins over selecting parts of it.
+func merge(fields []Field, field Field) []Field {
+	existing := Find(fields, field.Name)
+	if existing == nil {
+		return append(fields, field)
+	}
+	if existing.Fields == nil || field.Fields == nil {
+		existing.Fields = nil
+		return fields
+	}
+	for _, sub := range field.Fields {
+		existing.Fields = merge(existing.Fields, sub)
+	}
+	return fields
+}
+
+// Select marshals value to JSON and keeps only the selected fields of its
+// objects. Selections apply to each element of an array, and unknown
+// names are ignored. A nil selection keeps the whole value.
+func Select(value interface{}, fields []Field) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return json.RawMessage(data), nil
+	}
+
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return trim(decoded, fields), nil
+}
+
+func trim(value interface{}, fields []Field) interface{} {
+	if fields == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		kept := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if child, ok := v[field.Name]; ok {
+				kept[field.Name] = trim(child, field.Fields)
+			}
+		}
+		return kept
+	case []interface{}:
+		for i := range v {
+			v[i] = trim(v[i], fields)
+		}
+		return v
+	}
+	// Scalars have no fields to select
+	return value
+}
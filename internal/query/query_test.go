@@ -0,0 +1,83 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	fields, err := Parse("shares{name,healthy}\n disks { device smart{temperature} } disks{model}, status")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []Field{
+		{Name: "shares", Fields: []Field{{Name: "name"}, {Name: "healthy"}}},
+		{Name: "disks", Fields: []Field{
+			{Name: "device"},
+			{Name: "smart", Fields: []Field{{Name: "temperature"}}},
+			{Name: "model"},
+		}},
+		{Name: "status"},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("unexpected fields\n got %+v\nwant %+v", fields, want)
+	}
+
+	// Selecting a whole value wins over selecting parts of it
+	fields, _ = Parse("disks{device} disks")
+	if len(fields) != 1 || fields[0].Fields != nil {
+		t.Fatalf("expected the whole disks value, got %+v", fields)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"shares{",
+		"shares{}",
+		"shares}",
+		"shares{name-x}",
+		strings.Repeat("a{", MaxDepth+2) + "b" + strings.Repeat("}", MaxDepth+2),
+		strings.Repeat("a,", MaxLength),
+	} {
+		var syntaxErr *SyntaxError
+		if _, err := Parse(input); !errors.As(err, &syntaxErr) {
+			t.Errorf("expected a syntax error for %.20q, got %v", input, err)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	type smart struct {
+		Healthy     bool `json:"healthy"`
+		Temperature int  `json:"temperature"`
+	}
+	type disk struct {
+		Device string `json:"device"`
+		Size   uint64 `json:"size"`
+		SMART  *smart `json:"smart"`
+	}
+	disks := []disk{
+		{Device: "/dev/sda", Size: 18446744073709551615, SMART: &smart{Healthy: true, Temperature: 38}},
+		{Device: "/dev/sdb"},
+	}
+
+	fields, _ := Parse("device size smart{temperature} unknown")
+	selected, err := Select(disks, fields)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	data, _ := json.Marshal(selected)
+	want := `[{"device":"/dev/sda","size":18446744073709551615,"smart":{"temperature":38}},{"device":"/dev/sdb","size":0,"smart":null}]`
+	if string(data) != want {
+		t.Fatalf("unexpected selection\n got %s\nwant %s", data, want)
+	}
+
+	whole, _ := Select(disks[1], nil)
+	if data, _ := json.Marshal(whole); string(data) != `{"device":"/dev/sdb","size":0,"smart":null}` {
+		t.Fatalf("expected the whole value, got %s", data)
+	}
+}
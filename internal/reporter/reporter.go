@@ -0,0 +1,124 @@
+package reporter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/monitor"
+)
+
+// Reporter periodically publishes system state on the event bus so that
+// consumers such as the MQTT bridge receive it without polling the API
+type Reporter struct {
+	bus           *events.Bus
+	monitor       *monitor.Monitor
+	disks         *diskmanager.Manager
+	statsInterval time.Duration
+	smartInterval time.Duration
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// Config represents state reporter configuration
+type Config struct {
+	Monitor       *monitor.Monitor
+	Disks         *diskmanager.Manager
+	StatsInterval time.Duration
+	SMARTInterval time.Duration
+}
+
+// New creates a new state reporter
+func New(cfg *Config, bus *events.Bus) *Reporter {
+	statsInterval := cfg.StatsInterval
+	if statsInterval == 0 {
+		statsInterval = time.Minute
+	}
+
+	smartInterval := cfg.SMARTInterval
+	if smartInterval == 0 {
+		smartInterval = 30 * time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Reporter{
+		bus:           bus,
+		monitor:       cfg.Monitor,
+		disks:         cfg.Disks,
+		statsInterval: statsInterval,
+		smartInterval: smartInterval,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// Start begins publishing "system.stats" and "disk.smart" events
+func (r *Reporter) Start() {
+	if r.monitor != nil {
+		r.wg.Add(1)
+		go r.loop(r.statsInterval, r.publishStats)
+	}
+	if r.disks != nil {
+		r.wg.Add(1)
+		go r.loop(r.smartInterval, r.publishSMART)
+	}
+}
+
+// Stop stops publishing and cancels running disk queries
+func (r *Reporter) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *Reporter) loop(interval time.Duration, publish func(context.Context)) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		publish(r.ctx)
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reporter) publishStats(ctx context.Context) {
+	stats, err := r.monitor.GetStats()
+	if err != nil {
+		return
+	}
+	r.bus.Publish("system.stats", stats)
+}
+
+func (r *Reporter) publishSMART(ctx context.Context) {
+	disks, err := r.disks.ListDisks(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, disk := range disks {
+		info, err := r.disks.GetSMARTInfo(ctx, disk.Device)
+		if err != nil {
+			continue
+		}
+
+		r.bus.Publish("disk.smart", map[string]interface{}{
+			"device":         disk.Device,
+			"name":           strings.TrimPrefix(disk.Device, "/dev/"),
+			"model":          disk.Model,
+			"healthy":        info.Healthy,
+			"temperature":    info.Temperature,
+			"power_on_hours": info.PowerOnHours,
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package reports
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"time"
+)
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Hostname}} report {{time .Until}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #f0f0f0; }
+.bad { color: #b00; font-weight: bold; }
+.empty { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Hostname}}</h1>
+<p>{{time .Since}} to {{time .Until}}</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Disks</th><td>{{.Summary.Disks}}{{if .Summary.UnhealthyDisks}} <span class="bad">({{.Summary.UnhealthyDisks}} unhealthy)</span>{{end}}</td></tr>
+<tr><th>Volumes over 90% full</th><td{{if .Summary.FullVolumes}} class="bad"{{end}}>{{.Summary.FullVolumes}}</td></tr>
+<tr><th>Backups</th><td>{{.Summary.BackupsOK}} succeeded{{if .Summary.BackupsFailed}}, <span class="bad">{{.Summary.BackupsFailed}} failed</span>{{end}}</td></tr>
+<tr><th>Changes</th><td>{{.Summary.Changes}}</td></tr>
+<tr><th>Open alerts</th><td{{if .Summary.OpenAlerts}} class="bad"{{end}}>{{.Summary.OpenAlerts}}</td></tr>
+</table>
+
+<h2>Storage</h2>
+{{if .Storage}}<table>
+<tr><th>Mount point</th><th>Device</th><th>Size</th><th>Used</th><th>Used %</th></tr>
+{{range .Storage}}<tr><td>{{.MountPoint}}</td><td>{{.Device}}</td><td>{{bytes .Size}}</td><td>{{bytes .Used}}</td><td{{if ge .UsedPercent 90.0}} class="bad"{{end}}>{{printf "%.1f" .UsedPercent}}</td></tr>
+{{end}}</table>{{else}}<p class="empty">No volumes found.</p>{{end}}
+
+<h2>Disk Health</h2>
+{{if .Disks}}<table>
+<tr><th>Device</th><th>Model</th><th>SMART</th><th>Temperature</th><th>Power-on hours</th></tr>
+{{range .Disks}}<tr><td>{{.Device}}</td><td>{{.Model}}</td>{{if .Error}}<td class="empty">{{.Error}}</td>{{else if .Healthy}}<td>passed</td>{{else}}<td class="bad">FAILED</td>{{end}}<td>{{.Temperature}} °C</td><td>{{.PowerOnHours}}</td></tr>
+{{end}}</table>{{else}}<p class="empty">No disks found.</p>{{end}}
+
+<h2>Backups</h2>
+{{if .Backups}}<table>
+<tr><th>Task</th><th>Started</th><th>Status</th><th>Error</th></tr>
+{{range .Backups}}<tr><td>{{.Task}}</td><td>{{time .StartedAt}}</td><td{{if eq .Status "failed"}} class="bad"{{end}}>{{.Status}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{else}}<p class="empty">No backups ran in this period.</p>{{end}}
+
+<h2>Top Changes</h2>
+{{if .Changes}}<table>
+<tr><th>Resource</th><th>Changes</th><th>Actions</th><th>Last by</th><th>Last at</th></tr>
+{{range .Changes}}<tr><td>{{.Resource}}</td><td>{{.Count}}</td><td>{{range $i, $a := .Actions}}{{if $i}}, {{end}}{{$a}}{{end}}</td><td>{{.LastUser}}</td><td>{{time .LastAt}}</td></tr>
+{{end}}</table>{{else}}<p class="empty">No changes in this period.</p>{{end}}
+
+<h2>Open Alerts</h2>
+{{if .Alerts}}<table>
+<tr><th>Severity</th><th>Alert</th><th>State</th><th>Raised</th></tr>
+{{range .Alerts}}<tr><td{{if eq .Severity "critical"}} class="bad"{{end}}>{{.Severity}}</td><td>{{.Message}}</td><td>{{.State}}</td><td>{{time .RaisedAt}}</td></tr>
+{{end}}</table>{{else}}<p class="empty">No open alerts.</p>{{end}}
+
+<p class="empty">Generated {{time .GeneratedAt}} ({{.ID}})</p>
+</body>
+</html>
+`))
+
+// renderHTML formats a report as a self-contained HTML page
+func renderHTML(report *Report) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatBytes renders a size with a binary unit, like 1.5 GiB
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
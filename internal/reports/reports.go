@@ -0,0 +1,525 @@
+// Package reports produces periodic summaries of the agent: storage usage,
+// SMART health, backup results, the most changed resources and open
+// alerts. Each report is written as HTML for people and JSON for programs
+// into the reports directory, which the files API can browse.
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/alerts"
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/monitor"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+)
+
+// TaskType is the scheduler task type that generates a report. Its
+// optional period_hours parameter sets the period covered.
+const TaskType = "report"
+
+// topChanges is how many changed resources a report lists
+const topChanges = 10
+
+// Report is the content of a report
+type Report struct {
+	ID          string          `json:"id"`
+	Hostname    string          `json:"hostname"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Since       time.Time       `json:"since"`
+	Until       time.Time       `json:"until"`
+	Summary     Summary         `json:"summary"`
+	Storage     []Storage       `json:"storage"`
+	Disks       []DiskHealth    `json:"disks"`
+	Backups     []BackupRun     `json:"backups"`
+	Changes     []Change        `json:"changes"`
+	Alerts      []*alerts.Alert `json:"alerts"`
+}
+
+// Summary counts the findings of a report
+type Summary struct {
+	Disks          int `json:"disks"`
+	UnhealthyDisks int `json:"unhealthy_disks"`
+	FullVolumes    int `json:"full_volumes"` // Volumes at least 90% full
+	BackupsOK      int `json:"backups_ok"`
+	BackupsFailed  int `json:"backups_failed"`
+	Changes        int `json:"changes"` // Successful changes in the audit log
+	OpenAlerts     int `json:"open_alerts"`
+}
+
+// Storage is the usage of a mounted volume
+type Storage struct {
+	MountPoint  string  `json:"mount_point"`
+	Device      string  `json:"device,omitempty"`
+	FileSystem  string  `json:"filesystem,omitempty"`
+	Size        uint64  `json:"size"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// DiskHealth is the SMART status of a disk
+type DiskHealth struct {
+	Device       string `json:"device"`
+	Model        string `json:"model"`
+	Healthy      bool   `json:"healthy"`
+	Temperature  int    `json:"temperature"`
+	PowerOnHours int    `json:"power_on_hours"`
+	Error        string `json:"error,omitempty"` // Why SMART data is missing
+}
+
+// BackupRun is one execution of a backup task
+type BackupRun struct {
+	Task        string    `json:"task"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Change counts successful changes to a resource
+type Change struct {
+	Resource string    `json:"resource"`
+	Count    int       `json:"count"`
+	Actions  []string  `json:"actions"`
+	LastUser string    `json:"last_user"`
+	LastAt   time.Time `json:"last_at"`
+}
+
+// Info describes a stored report
+type Info struct {
+	ID          string    `json:"id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	Summary     Summary   `json:"summary"`
+	HTMLPath    string    `json:"html_path"`
+	JSONPath    string    `json:"json_path"`
+}
+
+// Generator builds reports from the other managers. Any of them may be nil;
+// their sections are then left empty.
+type Generator struct {
+	dir       string
+	keep      int
+	monitor   *monitor.Monitor
+	disks     *diskmanager.Manager
+	scheduler *scheduler.Scheduler
+	alerts    *alerts.Manager
+	audit     *audit.Logger
+	bus       *events.Bus
+}
+
+// Config represents report generator configuration
+type Config struct {
+	Dir       string
+	Keep      int // Number of reports kept; older ones are deleted
+	Monitor   *monitor.Monitor
+	Disks     *diskmanager.Manager
+	Scheduler *scheduler.Scheduler
+	Alerts    *alerts.Manager
+	Audit     *audit.Logger
+	Bus       *events.Bus
+}
+
+// New creates a report generator and its reports directory
+func New(cfg *Config) (*Generator, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "/var/lib/mingyue-agent/reports"
+	}
+
+	keep := cfg.Keep
+	if keep == 0 {
+		keep = 30
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create reports directory: %w", err)
+	}
+
+	return &Generator{
+		dir:       dir,
+		keep:      keep,
+		monitor:   cfg.Monitor,
+		disks:     cfg.Disks,
+		scheduler: cfg.Scheduler,
+		alerts:    cfg.Alerts,
+		audit:     cfg.Audit,
+		bus:       cfg.Bus,
+	}, nil
+}
+
+// Dir returns the reports directory
+func (g *Generator) Dir() string {
+	return g.dir
+}
+
+// Generate builds a report covering the last period, stores it and
+// publishes a report.generated event
+func (g *Generator) Generate(ctx context.Context, period time.Duration) (*Info, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("period must be positive")
+	}
+
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	id := "report-" + now.UTC().Format("20060102-150405")
+	// Reports generated within the same second get a suffix
+	for i := 2; g.exists(id); i++ {
+		id = fmt.Sprintf("report-%s-%d", now.UTC().Format("20060102-150405"), i)
+	}
+	report := &Report{
+		ID:          id,
+		Hostname:    hostname,
+		GeneratedAt: now,
+		Since:       now.Add(-period),
+		Until:       now,
+	}
+
+	report.Storage = g.storage(ctx)
+	report.Disks = g.diskHealth(ctx)
+	report.Backups = g.backups(ctx, report.Since)
+	changes, total := g.changes(report.Since, report.Until)
+	report.Changes = changes
+	report.Alerts = []*alerts.Alert{}
+	if g.alerts != nil {
+		report.Alerts = g.alerts.List(false)
+	}
+
+	report.Summary = summarize(report)
+	report.Summary.Changes = total
+
+	info, err := g.write(report)
+	if err != nil {
+		return nil, err
+	}
+	g.prune()
+
+	g.bus.Publish("report.generated", info)
+	return info, nil
+}
+
+// TaskHandler generates reports for scheduler tasks of type TaskType. It
+// audits each run so webhooks deliver it.
+func (g *Generator) TaskHandler() scheduler.TaskHandler {
+	return func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		period := 24 * time.Hour
+		if hours, ok := params["period_hours"].(float64); ok && hours > 0 {
+			period = time.Duration(hours * float64(time.Hour))
+		}
+
+		info, err := g.Generate(ctx, period)
+		entry := &audit.Entry{
+			Timestamp: time.Now(),
+			User:      "scheduler",
+			Action:    "report.generate",
+			Resource:  g.dir,
+			Result:    "success",
+		}
+		if err != nil {
+			entry.Result = "error"
+			entry.Details = map[string]interface{}{"error": err.Error()}
+		} else {
+			entry.Resource = info.HTMLPath
+			entry.Details = map[string]interface{}{"id": info.ID, "summary": info.Summary}
+		}
+		if g.audit != nil {
+			g.audit.Log(ctx, entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"report":    info.ID,
+			"html_path": info.HTMLPath,
+			"json_path": info.JSONPath,
+		}, nil
+	}
+}
+
+// List returns the stored reports, newest first
+func (g *Generator) List() ([]*Info, error) {
+	paths, err := filepath.Glob(filepath.Join(g.dir, "report-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []*Info{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var report Report
+		if err := json.Unmarshal(data, &report); err != nil {
+			continue
+		}
+		infos = append(infos, g.info(&report))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].GeneratedAt.After(infos[j].GeneratedAt)
+	})
+	return infos, nil
+}
+
+func (g *Generator) info(report *Report) *Info {
+	return &Info{
+		ID:          report.ID,
+		GeneratedAt: report.GeneratedAt,
+		Since:       report.Since,
+		Until:       report.Until,
+		Summary:     report.Summary,
+		HTMLPath:    filepath.Join(g.dir, report.ID+".html"),
+		JSONPath:    filepath.Join(g.dir, report.ID+".json"),
+	}
+}
+
+func (g *Generator) write(report *Report) (*Info, error) {
+	info := g.info(report)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal report: %w", err)
+	}
+	page, err := renderHTML(report)
+	if err != nil {
+		return nil, fmt.Errorf("render report: %w", err)
+	}
+
+	if err := os.WriteFile(info.HTMLPath, page, 0640); err != nil {
+		return nil, fmt.Errorf("write report: %w", err)
+	}
+	// The JSON file is written last; List only sees complete reports
+	if err := os.WriteFile(info.JSONPath, data, 0640); err != nil {
+		return nil, fmt.Errorf("write report: %w", err)
+	}
+	return info, nil
+}
+
+func (g *Generator) exists(id string) bool {
+	_, err := os.Stat(filepath.Join(g.dir, id+".json"))
+	return err == nil
+}
+
+// prune deletes all but the newest g.keep reports
+func (g *Generator) prune() {
+	infos, err := g.List()
+	if err != nil || len(infos) <= g.keep {
+		return
+	}
+	for _, info := range infos[g.keep:] {
+		os.Remove(info.JSONPath)
+		os.Remove(info.HTMLPath)
+	}
+}
+
+func (g *Generator) storage(ctx context.Context) []Storage {
+	storage := []Storage{}
+	if g.disks != nil {
+		if partitions, err := g.disks.ListPartitions(ctx); err == nil {
+			for _, p := range partitions {
+				if p.MountPoint == "" || p.Size == 0 {
+					continue
+				}
+				storage = append(storage, Storage{
+					MountPoint:  p.MountPoint,
+					Device:      p.Device,
+					FileSystem:  p.FileSystem,
+					Size:        p.Size,
+					Used:        p.Used,
+					UsedPercent: p.UsedPct,
+				})
+			}
+		}
+	}
+
+	// Without partition data, at least report the root filesystem
+	if len(storage) == 0 && g.monitor != nil {
+		if stats, err := g.monitor.GetStats(); err == nil && stats.Disk.Total > 0 {
+			storage = append(storage, Storage{
+				MountPoint:  "/",
+				Size:        stats.Disk.Total,
+				Used:        stats.Disk.Used,
+				UsedPercent: stats.Disk.UsedPercent,
+			})
+		}
+	}
+	sort.Slice(storage, func(i, j int) bool {
+		return storage[i].MountPoint < storage[j].MountPoint
+	})
+	return storage
+}
+
+func (g *Generator) diskHealth(ctx context.Context) []DiskHealth {
+	health := []DiskHealth{}
+	if g.disks == nil {
+		return health
+	}
+	disks, err := g.disks.ListDisks(ctx)
+	if err != nil {
+		return health
+	}
+
+	for _, disk := range disks {
+		entry := DiskHealth{Device: disk.Device, Model: disk.Model}
+		info, err := g.disks.GetSMARTInfo(ctx, disk.Device)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Healthy = info.Healthy
+			entry.Temperature = info.Temperature
+			entry.PowerOnHours = info.PowerOnHours
+		}
+		health = append(health, entry)
+	}
+	return health
+}
+
+// backups lists runs of backup tasks since since, newest first. Backup
+// tasks have the type "backup" or, for plugins, "<plugin>.backup".
+func (g *Generator) backups(ctx context.Context, since time.Time) []BackupRun {
+	runs := []BackupRun{}
+	if g.scheduler == nil {
+		return runs
+	}
+
+	for _, task := range g.scheduler.ListTasks() {
+		if task.Type != "backup" && !strings.HasSuffix(task.Type, ".backup") {
+			continue
+		}
+		executions, err := g.scheduler.GetExecutionHistory(ctx, task.ID, 100)
+		if err != nil {
+			continue
+		}
+		for _, exec := range executions {
+			if exec.StartedAt.Before(since) {
+				continue
+			}
+			run := BackupRun{
+				Task:      task.Name,
+				StartedAt: exec.StartedAt,
+				Status:    exec.Status,
+				Error:     exec.Error,
+			}
+			if exec.CompletedAt != nil {
+				run.CompletedAt = *exec.CompletedAt
+			}
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+	return runs
+}
+
+// readOnlyActions are audited actions that change nothing
+var readOnlyActions = map[string]bool{
+	"disk.smart":       true,
+	"security.advisor": true,
+	"cluster.proxy":    true,
+	"auth.failed":      true,
+	"auth.denied":      true,
+	"auth.impersonate": true,
+}
+
+// isChange reports whether an audited action changed something
+func isChange(action string) bool {
+	if readOnlyActions[action] {
+		return false
+	}
+	verb := action[strings.LastIndex(action, ".")+1:]
+	for _, prefix := range []string{"list", "get", "download", "read", "export", "search"} {
+		if strings.HasPrefix(verb, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// changes returns the resources changed most often between since and
+// until, and the total number of successful changes
+func (g *Generator) changes(since, until time.Time) ([]Change, int) {
+	changes := []Change{}
+	entries, err := g.audit.Query(audit.QueryFilter{Result: "success", Since: since, Until: until})
+	if err != nil {
+		return changes, 0
+	}
+
+	byResource := make(map[string]*Change)
+	total := 0
+	// Entries are newest first, so the first one seen is the last change
+	for _, entry := range entries {
+		if entry.Resource == "" || !isChange(entry.Action) {
+			continue
+		}
+		total++
+		change, ok := byResource[entry.Resource]
+		if !ok {
+			change = &Change{Resource: entry.Resource, LastUser: entry.User, LastAt: entry.Timestamp}
+			byResource[entry.Resource] = change
+		}
+		change.Count++
+		if !containsString(change.Actions, entry.Action) {
+			change.Actions = append(change.Actions, entry.Action)
+		}
+	}
+
+	for _, change := range byResource {
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Count != changes[j].Count {
+			return changes[i].Count > changes[j].Count
+		}
+		return changes[i].Resource < changes[j].Resource
+	})
+	if len(changes) > topChanges {
+		changes = changes[:topChanges]
+	}
+	return changes, total
+}
+
+func summarize(report *Report) Summary {
+	summary := Summary{
+		Disks:      len(report.Disks),
+		OpenAlerts: len(report.Alerts),
+	}
+	for _, disk := range report.Disks {
+		if disk.Error == "" && !disk.Healthy {
+			summary.UnhealthyDisks++
+		}
+	}
+	for _, volume := range report.Storage {
+		if volume.UsedPercent >= 90 {
+			summary.FullVolumes++
+		}
+	}
+	for _, run := range report.Backups {
+		switch run.Status {
+		case "success":
+			summary.BackupsOK++
+		case "failed":
+			summary.BackupsFailed++
+		}
+	}
+	return summary
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package reports
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+func TestGenerateWritesAndPrunesReports(t *testing.T) {
+	dir := t.TempDir()
+	auditLogger, err := audit.New(filepath.Join(dir, "audit.log"), false, "", true)
+	if err != nil {
+		t.Fatalf("audit.New: %v", err)
+	}
+	ctx := context.Background()
+	for _, entry := range []*audit.Entry{
+		{User: "alice", Action: "upload", Resource: "/data/a.txt", Result: "success"},
+		{User: "bob", Action: "delete", Resource: "/data/a.txt", Result: "success"},
+		{User: "bob", Action: "list", Resource: "/data", Result: "success"},
+		{User: "bob", Action: "share.add", Resource: "/data/photos", Result: "error"},
+	} {
+		auditLogger.Log(ctx, entry)
+	}
+
+	g, err := New(&Config{Dir: filepath.Join(dir, "reports"), Keep: 2, Audit: auditLogger})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	info, err := g.Generate(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if info.Summary.Changes != 2 {
+		t.Fatalf("expected 2 changes, got %+v", info.Summary)
+	}
+	page, err := os.ReadFile(info.HTMLPath)
+	if err != nil {
+		t.Fatalf("read HTML report: %v", err)
+	}
+	if !strings.Contains(string(page), "/data/a.txt") {
+		t.Fatalf("HTML report is missing the changed file")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Generate(ctx, time.Hour); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+	infos, err := g.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 reports after pruning, got %d", len(infos))
+	}
+	if _, err := os.Stat(info.HTMLPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the oldest report to be pruned")
+	}
+}
+
+func TestIsChange(t *testing.T) {
+	for action, want := range map[string]bool{
+		"upload":                  true,
+		"share.add":               true,
+		"list":                    false,
+		"get_info":                false,
+		"network.list_interfaces": false,
+		"disk.smart":              false,
+	} {
+		if got := isChange(action); got != want {
+			t.Errorf("isChange(%q) = %v, want %v", action, got, want)
+		}
+	}
+}
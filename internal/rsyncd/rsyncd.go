@@ -0,0 +1,531 @@
+// Package rsyncd manages the modules of the rsync daemon. It generates
+// rsyncd.conf and the secrets file holding the passwords of rsync users, and
+// starts and stops the daemon. The daemon reads its configuration on every
+// connection, so changes apply without a restart.
+package rsyncd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/configrepo"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+var (
+	// ErrNotFound is returned for unknown modules and users
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when adding a module whose name is taken
+	ErrExists = errors.New("already exists")
+	// ErrInUse is returned when removing a user modules still allow
+	ErrInUse = errors.New("user is in use")
+	// ErrInvalid matches errors about invalid modules and users
+	ErrInvalid = errors.New("invalid")
+)
+
+// invalidError is an error about invalid input that matches ErrInvalid
+type invalidError struct{ error }
+
+func (e invalidError) Is(target error) bool { return target == ErrInvalid }
+
+func invalidf(format string, args ...interface{}) error {
+	return invalidError{fmt.Errorf(format, args...)}
+}
+
+// validName matches module and user names; rsync reads both from
+// configuration files, so they must not contain separators
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validOption matches the names of extra rsyncd.conf module parameters
+var validOption = regexp.MustCompile(`^[a-z][a-z ]*[a-z]$`)
+
+// Module is an rsync daemon module exporting a directory
+type Module struct {
+	Name       string            `json:"name"`
+	Path       string            `json:"path"`
+	Comment    string            `json:"comment,omitempty"`
+	ReadOnly   bool              `json:"read_only"`
+	Users      []string          `json:"users,omitempty"`       // Users allowed in; anyone if empty
+	HostsAllow []string          `json:"hosts_allow,omitempty"` // Addresses, CIDRs or host names; any host if empty
+	Options    map[string]string `json:"options,omitempty"`     // Further rsyncd.conf parameters, like "uid"
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// Status describes the rsync daemon
+type Status struct {
+	Service string `json:"service"`
+	State   string `json:"state"` // As reported by systemctl is-active
+	Running bool   `json:"running"`
+	Modules int    `json:"modules"`
+	Users   int    `json:"users"`
+}
+
+// Config configures the rsync daemon manager
+type Config struct {
+	ConfigFile   string
+	SecretsFile  string
+	StateFile    string
+	ServiceName  string // systemd unit of the daemon
+	AllowedPaths []string
+}
+
+// Manager manages rsync daemon modules and users
+type Manager struct {
+	configFile   string
+	secretsFile  string
+	stateFile    string
+	serviceName  string
+	allowedPaths []string
+	modules      map[string]*Module
+	secrets      map[string]string
+	history      *configrepo.Repo
+	mu           sync.RWMutex
+}
+
+// New creates a manager, loading modules from the state file and users
+// from the secrets file
+func New(cfg *Config) (*Manager, error) {
+	m := &Manager{
+		configFile:   cfg.ConfigFile,
+		secretsFile:  cfg.SecretsFile,
+		stateFile:    cfg.StateFile,
+		serviceName:  cfg.ServiceName,
+		allowedPaths: cfg.AllowedPaths,
+		modules:      make(map[string]*Module),
+		secrets:      make(map[string]string),
+	}
+	if m.configFile == "" {
+		m.configFile = "/etc/rsyncd.conf"
+	}
+	if m.secretsFile == "" {
+		m.secretsFile = "/etc/rsyncd.secrets"
+	}
+	if m.stateFile == "" {
+		m.stateFile = "/var/lib/mingyue-agent/rsync-state.json"
+	}
+	if m.serviceName == "" {
+		m.serviceName = "rsync"
+	}
+
+	if err := statefile.Read(m.stateFile, &m.modules); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+	if m.modules == nil {
+		m.modules = make(map[string]*Module)
+	}
+	if err := m.loadSecrets(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load secrets: %w", err)
+	}
+
+	return m, nil
+}
+
+// ListModules returns all modules, ordered by name
+func (m *Manager) ListModules() []*Module {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	modules := make([]*Module, 0, len(m.modules))
+	for _, module := range m.modules {
+		modules = append(modules, cloneModule(module))
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].Name < modules[j].Name
+	})
+	return modules
+}
+
+// GetModule returns the module called name
+func (m *Manager) GetModule(name string) (*Module, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	module, ok := m.modules[name]
+	if !ok {
+		return nil, fmt.Errorf("module %s: %w", name, ErrNotFound)
+	}
+	return cloneModule(module), nil
+}
+
+// AddModule adds a module and writes the daemon configuration
+func (m *Manager) AddModule(ctx context.Context, module *Module) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.modules[module.Name]; ok {
+		return fmt.Errorf("module %s: %w", module.Name, ErrExists)
+	}
+	if err := m.validate(module); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	module = cloneModule(module)
+	module.CreatedAt = now
+	module.UpdatedAt = now
+
+	return m.commit(ctx, "add module "+module.Name, func(modules map[string]*Module) {
+		modules[module.Name] = module
+	})
+}
+
+// UpdateModule replaces the settings of the module called name. The name
+// itself can't be changed, since clients refer to modules by name.
+func (m *Manager) UpdateModule(ctx context.Context, name string, updates *Module) (*Module, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.modules[name]
+	if !ok {
+		return nil, fmt.Errorf("module %s: %w", name, ErrNotFound)
+	}
+
+	module := cloneModule(updates)
+	module.Name = name
+	module.CreatedAt = existing.CreatedAt
+	module.UpdatedAt = time.Now()
+	if err := m.validate(module); err != nil {
+		return nil, err
+	}
+
+	if err := m.commit(ctx, "update module "+name, func(modules map[string]*Module) {
+		modules[name] = module
+	}); err != nil {
+		return nil, err
+	}
+	return cloneModule(module), nil
+}
+
+// RemoveModule removes the module called name
+func (m *Manager) RemoveModule(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.modules[name]; !ok {
+		return fmt.Errorf("module %s: %w", name, ErrNotFound)
+	}
+	return m.commit(ctx, "remove module "+name, func(modules map[string]*Module) {
+		delete(modules, name)
+	})
+}
+
+// ListUsers returns the names of rsync users, ordered by name
+func (m *Manager) ListUsers() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listUsers()
+}
+
+// SetUser creates an rsync user or changes its password. rsync users are
+// separate from system accounts and only exist in the secrets file.
+func (m *Manager) SetUser(name, password string) error {
+	if !validName.MatchString(name) {
+		return invalidf("invalid user name %q", name)
+	}
+	if password == "" || strings.ContainsAny(password, "\r\n") {
+		return invalidf("password must be a single non-empty line")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, existed := m.secrets[name]
+	m.secrets[name] = password
+	if err := m.writeSecrets(); err != nil {
+		if existed {
+			m.secrets[name] = previous
+		} else {
+			delete(m.secrets, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemoveUser removes an rsync user no module allows any more
+func (m *Manager) RemoveUser(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	password, ok := m.secrets[name]
+	if !ok {
+		return fmt.Errorf("user %s: %w", name, ErrNotFound)
+	}
+	for _, module := range m.modules {
+		if slices.Contains(module.Users, name) {
+			return fmt.Errorf("%w by module %s", ErrInUse, module.Name)
+		}
+	}
+
+	delete(m.secrets, name)
+	if err := m.writeSecrets(); err != nil {
+		m.secrets[name] = password
+		return err
+	}
+	return nil
+}
+
+// Start starts the rsync daemon
+func (m *Manager) Start(ctx context.Context) error {
+	return m.systemctl(ctx, "start")
+}
+
+// Stop stops the rsync daemon
+func (m *Manager) Stop(ctx context.Context) error {
+	return m.systemctl(ctx, "stop")
+}
+
+// Status reports whether the rsync daemon is running
+func (m *Manager) Status(ctx context.Context) *Status {
+	// is-active exits non-zero for stopped units; its output still says why
+	output, _ := sysexec.Output(ctx, "systemctl", "is-active", m.serviceName)
+	state := strings.TrimSpace(string(output))
+	if state == "" {
+		state = "unknown"
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return &Status{
+		Service: m.serviceName,
+		State:   state,
+		Running: state == "active",
+		Modules: len(m.modules),
+		Users:   len(m.secrets),
+	}
+}
+
+func (m *Manager) systemctl(ctx context.Context, action string) error {
+	// Make sure the daemon reads a configuration matching the state
+	m.mu.RLock()
+	err := m.writeConfig(m.modules)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if output, err := sysexec.CombinedOutput(ctx, "systemctl", action, m.serviceName); err != nil {
+		return fmt.Errorf("%s %s: %w, output: %s", action, m.serviceName, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// validate checks module before it is written to rsyncd.conf. Values must
+// fit on one line, or they could inject further parameters or modules.
+func (m *Manager) validate(module *Module) error {
+	if !validName.MatchString(module.Name) {
+		return invalidf("invalid module name %q", module.Name)
+	}
+	if !filepath.IsAbs(module.Path) || !m.isAllowedPath(module.Path) {
+		return invalidf("path %s is not allowed", module.Path)
+	}
+	if info, err := os.Stat(module.Path); err != nil || !info.IsDir() {
+		return invalidf("path %s is not a directory", module.Path)
+	}
+	if strings.ContainsAny(module.Path+module.Comment, "\r\n") {
+		return invalidf("path and comment must be single lines")
+	}
+	for _, user := range module.Users {
+		if _, ok := m.secrets[user]; !ok {
+			return invalidf("unknown user %s", user)
+		}
+	}
+	for _, host := range module.HostsAllow {
+		if host == "" || strings.ContainsAny(host, " \t\r\n,") {
+			return invalidf("invalid host %q", host)
+		}
+	}
+	for key, value := range module.Options {
+		if !validOption.MatchString(key) || strings.ContainsAny(value, "\r\n") {
+			return invalidf("invalid option %q", key)
+		}
+		switch key {
+		case "path", "comment", "read only", "auth users", "secrets file", "hosts allow", "hosts deny":
+			return invalidf("option %q is set through module fields", key)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) isAllowedPath(path string) bool {
+	path = filepath.Clean(path)
+	for _, allowed := range m.allowedPaths {
+		rel, err := filepath.Rel(filepath.Clean(allowed), path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// commit applies change to a copy of the modules, writes the daemon
+// configuration and state, and keeps the change only if both succeed. The
+// configuration is then recorded in history as summary.
+func (m *Manager) commit(ctx context.Context, summary string, change func(map[string]*Module)) error {
+	modules := make(map[string]*Module, len(m.modules)+1)
+	for name, module := range m.modules {
+		modules[name] = module
+	}
+	change(modules)
+
+	if err := m.writeConfig(modules); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(modules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	if err := statefile.Write(m.stateFile, data, statefile.PrivateMode); err != nil {
+		// Put back the configuration matching the state on disk
+		m.writeConfig(m.modules)
+		return fmt.Errorf("write state file: %w", err)
+	}
+
+	m.modules = modules
+	if err := m.history.Record(ctx, summary, m.configFile); err != nil {
+		log.Printf("warning: record rsyncd config: %v", err)
+	}
+	return nil
+}
+
+// SetConfigRepo records rsyncd.conf in history on every module change. The
+// secrets file holds passwords and is left out.
+func (m *Manager) SetConfigRepo(ctx context.Context, history *configrepo.Repo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.history = history
+	// The daemon reads its configuration on every connection
+	return history.Track(ctx, m.configFile, nil)
+}
+
+// writeConfig writes rsyncd.conf for modules
+func (m *Manager) writeConfig(modules map[string]*Module) error {
+	tmp := m.configFile + ".new"
+	if err := os.WriteFile(tmp, []byte(m.renderConfig(modules)), 0644); err != nil {
+		return fmt.Errorf("write rsyncd config: %w", err)
+	}
+	if err := os.Rename(tmp, m.configFile); err != nil {
+		return fmt.Errorf("move rsyncd config: %w", err)
+	}
+	return nil
+}
+
+// renderConfig formats rsyncd.conf with one section per module
+func (m *Manager) renderConfig(modules map[string]*Module) string {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# Generated by mingyue-agent; manual changes are overwritten\n")
+	b.WriteString("use chroot = yes\n")
+	b.WriteString("log file = /var/log/rsyncd.log\n")
+	for _, name := range names {
+		module := modules[name]
+		fmt.Fprintf(&b, "\n[%s]\n", module.Name)
+		fmt.Fprintf(&b, "\tpath = %s\n", module.Path)
+		if module.Comment != "" {
+			fmt.Fprintf(&b, "\tcomment = %s\n", module.Comment)
+		}
+		fmt.Fprintf(&b, "\tread only = %s\n", yesNo(module.ReadOnly))
+		if len(module.Users) > 0 {
+			fmt.Fprintf(&b, "\tauth users = %s\n", strings.Join(module.Users, ", "))
+			fmt.Fprintf(&b, "\tsecrets file = %s\n", m.secretsFile)
+		}
+		if len(module.HostsAllow) > 0 {
+			fmt.Fprintf(&b, "\thosts allow = %s\n", strings.Join(module.HostsAllow, " "))
+			b.WriteString("\thosts deny = *\n")
+		}
+		keys := make([]string, 0, len(module.Options))
+		for key := range module.Options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "\t%s = %s\n", key, module.Options[key])
+		}
+	}
+	return b.String()
+}
+
+// writeSecrets writes the secrets file. rsync refuses secrets files that
+// others can read, so it is private.
+func (m *Manager) writeSecrets() error {
+	var b bytes.Buffer
+	for _, name := range m.listUsers() {
+		fmt.Fprintf(&b, "%s:%s\n", name, m.secrets[name])
+	}
+	if err := statefile.Write(m.secretsFile, b.Bytes(), statefile.PrivateMode); err != nil {
+		return fmt.Errorf("write secrets file: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) listUsers() []string {
+	users := make([]string, 0, len(m.secrets))
+	for name := range m.secrets {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// loadSecrets reads users from the secrets file, skipping comments
+func (m *Manager) loadSecrets() error {
+	f, err := os.Open(m.secretsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, password, ok := strings.Cut(line, ":"); ok {
+			m.secrets[name] = password
+		}
+	}
+	return scanner.Err()
+}
+
+func cloneModule(module *Module) *Module {
+	c := *module
+	c.Users = slices.Clone(module.Users)
+	c.HostsAllow = slices.Clone(module.HostsAllow)
+	if module.Options != nil {
+		c.Options = make(map[string]string, len(module.Options))
+		for key, value := range module.Options {
+			c.Options[key] = value
+		}
+	}
+	return &c
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
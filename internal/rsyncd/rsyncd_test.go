@@ -0,0 +1,114 @@
+package rsyncd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	dir := t.TempDir()
+	m, err := New(&Config{
+		ConfigFile:   filepath.Join(dir, "rsyncd.conf"),
+		SecretsFile:  filepath.Join(dir, "rsyncd.secrets"),
+		StateFile:    filepath.Join(dir, "rsync-state.json"),
+		AllowedPaths: []string{dir},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return m, dir
+}
+
+func TestModulesAndUsers(t *testing.T) {
+	m, dir := newTestManager(t)
+	data := filepath.Join(dir, "photos")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	module := &Module{Name: "photos", Path: data, ReadOnly: true, Users: []string{"alice"}, HostsAllow: []string{"192.168.1.0/24"}}
+	if err := m.AddModule(context.Background(), module); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("expected a module with an unknown user to be rejected")
+	}
+	if err := m.SetUser("alice", "s3cret"); err != nil {
+		t.Fatalf("SetUser: %v", err)
+	}
+	if err := m.AddModule(context.Background(), module); err != nil {
+		t.Fatalf("AddModule: %v", err)
+	}
+	if err := m.AddModule(context.Background(), module); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+
+	conf, err := os.ReadFile(m.configFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, line := range []string{
+		"[photos]",
+		"\tpath = " + data,
+		"\tread only = yes",
+		"\tauth users = alice",
+		"\tsecrets file = " + m.secretsFile,
+		"\thosts allow = 192.168.1.0/24",
+		"\thosts deny = *",
+	} {
+		if !strings.Contains(string(conf), line+"\n") {
+			t.Errorf("expected %q in rsyncd.conf:\n%s", line, conf)
+		}
+	}
+
+	info, err := os.Stat(m.secretsFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a private secrets file, got %v (%v)", info, err)
+	}
+	if secrets, _ := os.ReadFile(m.secretsFile); string(secrets) != "alice:s3cret\n" {
+		t.Fatalf("unexpected secrets file %q", secrets)
+	}
+
+	if err := m.RemoveUser("alice"); !errors.Is(err, ErrInUse) {
+		t.Fatalf("expected ErrInUse for a user of a module, got %v", err)
+	}
+
+	// Modules and users survive a restart
+	reloaded, err := New(&Config{
+		ConfigFile:   m.configFile,
+		SecretsFile:  m.secretsFile,
+		StateFile:    m.stateFile,
+		AllowedPaths: []string{dir},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, err := reloaded.GetModule("photos"); err != nil || !got.ReadOnly {
+		t.Fatalf("expected the module after reloading, got %+v (%v)", got, err)
+	}
+	if users := reloaded.ListUsers(); len(users) != 1 || users[0] != "alice" {
+		t.Fatalf("expected alice after reloading, got %v", users)
+	}
+}
+
+func TestValidateRejectsInjection(t *testing.T) {
+	m, dir := newTestManager(t)
+
+	for _, module := range []*Module{
+		{Name: "bad name", Path: dir},
+		{Name: "outside", Path: "/etc"},
+		{Name: "comment", Path: dir, Comment: "x\n[root]\npath = /"},
+		{Name: "hosts", Path: dir, HostsAllow: []string{"10.0.0.1, *"}},
+		{Name: "option", Path: dir, Options: map[string]string{"path": "/"}},
+		{Name: "value", Path: dir, Options: map[string]string{"uid": "root\nread only = no"}},
+	} {
+		if err := m.AddModule(context.Background(), module); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected module %q to be rejected", module.Name)
+		}
+	}
+	if err := m.SetUser("bob", "line\nbreak"); err == nil {
+		t.Fatalf("expected a multi-line password to be rejected")
+	}
+}
@@ -0,0 +1,513 @@
+// Package rules runs automation when files change: a rule names a
+// directory, a file name pattern and the file events it reacts to, and the
+// scheduler task handlers to run as its actions, such as generating a
+// thumbnail and copying the file elsewhere.
+package rules
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
+)
+
+// Errors of rule lookups and validation
+var (
+	ErrNotFound    = errors.New("rule not found")
+	ErrInvalidRule = errors.New("invalid rule")
+)
+
+// Action is a scheduler task handler run when a rule matches. String
+// params, and strings in list params, may use the placeholders {path},
+// {name} and {dir} of the file, and {rel}, its path below the rule's path.
+type Action struct {
+	Type   string                 `json:"type"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// Rule runs its actions, in order, for files below Path whose name
+// matches Pattern when one of Events is published for them
+type Rule struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Enabled bool     `json:"enabled"`
+	Events  []string `json:"events"`            // file.created by default
+	Path    string   `json:"path"`              // Directory watched, with everything below it
+	Pattern string   `json:"pattern,omitempty"` // Glob matched against file names, like *.jpg
+	Actions []Action `json:"actions"`
+
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	LastTriggered *time.Time `json:"last_triggered,omitempty"`
+	Triggered     int        `json:"triggered"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Manager stores rules and runs them for file events on the bus
+type Manager struct {
+	stateFile     string
+	rules         map[string]*Rule
+	allowedPaths  []string
+	actionTimeout time.Duration
+	scheduler     *scheduler.Scheduler
+	watcher       *watcher.Watcher
+	bus           *events.Bus
+	jobs          *jobs.Manager
+	audit         *audit.Logger
+	saver         *statefile.Debouncer
+	mu            sync.RWMutex
+	sub           *events.Subscription
+	done          chan struct{}
+}
+
+// Config represents rule manager configuration
+type Config struct {
+	StateFile string
+	// AllowedPaths bounds the directories rules may watch
+	AllowedPaths []string
+	// ActionTimeout bounds each action of a run
+	ActionTimeout time.Duration
+	// Scheduler provides the task handlers actions run
+	Scheduler *scheduler.Scheduler
+	// Watcher, if not nil, is pointed at the paths of enabled rules
+	Watcher *watcher.Watcher
+	Bus     *events.Bus
+	Jobs    *jobs.Manager
+	Audit   *audit.Logger
+}
+
+// New creates a new rule manager. Rules run once Start is called.
+func New(cfg *Config) (*Manager, error) {
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "/var/lib/mingyue-agent/rules.json"
+	}
+
+	actionTimeout := cfg.ActionTimeout
+	if actionTimeout == 0 {
+		actionTimeout = 30 * time.Minute
+	}
+
+	m := &Manager{
+		stateFile:     stateFile,
+		rules:         make(map[string]*Rule),
+		allowedPaths:  cfg.AllowedPaths,
+		actionTimeout: actionTimeout,
+		scheduler:     cfg.Scheduler,
+		watcher:       cfg.Watcher,
+		bus:           cfg.Bus,
+		jobs:          cfg.Jobs,
+		audit:         cfg.Audit,
+	}
+	m.saver = statefile.NewDebouncer(statefile.DefaultDelay, func() {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		if err := m.saveState(); err != nil {
+			log.Printf("warning: save rules: %v", err)
+		}
+	})
+
+	if err := m.loadState(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+
+	return m, nil
+}
+
+// Start watches the paths of enabled rules and runs rules for the file
+// events published on the bus
+func (m *Manager) Start() {
+	m.mu.Lock()
+	m.updateWatches()
+	m.mu.Unlock()
+
+	// Copies into a watched tree arrive in bursts
+	m.sub = m.bus.Subscribe(events.ParseFilter("file.*"), 4096)
+	m.done = make(chan struct{})
+	go m.run()
+}
+
+// Stop stops running rules and saves their trigger counts
+func (m *Manager) Stop() {
+	if m.sub != nil {
+		m.sub.Close()
+		<-m.done
+	}
+	m.saver.Flush()
+}
+
+// AddRule validates and stores a new rule, enabled
+func (m *Manager) AddRule(rule *Rule) (*Rule, error) {
+	if err := m.validate(rule); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	rule.ID = generateID()
+	rule.Enabled = true
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+	rule.LastTriggered = nil
+	rule.Triggered = 0
+	rule.LastError = ""
+
+	m.rules[rule.ID] = rule
+	if err := m.saveState(); err != nil {
+		delete(m.rules, rule.ID)
+		return nil, err
+	}
+	m.updateWatches()
+
+	created := *rule
+	return &created, nil
+}
+
+// UpdateRule replaces the definition of a rule, keeping its trigger counts
+func (m *Manager) UpdateRule(rule *Rule) (*Rule, error) {
+	if err := m.validate(rule); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, exists := m.rules[rule.ID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, rule.ID)
+	}
+
+	previous := *existing
+	existing.Name = rule.Name
+	existing.Enabled = rule.Enabled
+	existing.Events = rule.Events
+	existing.Path = rule.Path
+	existing.Pattern = rule.Pattern
+	existing.Actions = rule.Actions
+	existing.UpdatedAt = time.Now()
+	if err := m.saveState(); err != nil {
+		*existing = previous
+		return nil, err
+	}
+	m.updateWatches()
+
+	updated := *existing
+	return &updated, nil
+}
+
+// RemoveRule deletes a rule
+func (m *Manager) RemoveRule(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rule, exists := m.rules[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	delete(m.rules, id)
+	if err := m.saveState(); err != nil {
+		m.rules[id] = rule
+		return err
+	}
+	m.updateWatches()
+	return nil
+}
+
+// GetRule returns a rule
+func (m *Manager) GetRule(id string) (*Rule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rule, exists := m.rules[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	copied := *rule
+	return &copied, nil
+}
+
+// ListRules returns all rules, oldest first
+func (m *Manager) ListRules() []*Rule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rules := make([]*Rule, 0, len(m.rules))
+	for _, rule := range m.rules {
+		copied := *rule
+		rules = append(rules, &copied)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules
+}
+
+// validate checks rule and fills in its defaults
+func (m *Manager) validate(rule *Rule) error {
+	if strings.TrimSpace(rule.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidRule)
+	}
+
+	if !filepath.IsAbs(rule.Path) {
+		return fmt.Errorf("%w: path must be absolute", ErrInvalidRule)
+	}
+	rule.Path = filepath.Clean(rule.Path)
+	if !m.allowed(rule.Path) {
+		return fmt.Errorf("%w: path %s is outside the allowed paths", ErrInvalidRule, rule.Path)
+	}
+
+	if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+		return fmt.Errorf("%w: pattern: %v", ErrInvalidRule, err)
+	}
+
+	if len(rule.Events) == 0 {
+		rule.Events = []string{watcher.EventCreated}
+	}
+	for _, event := range rule.Events {
+		switch event {
+		case watcher.EventCreated, watcher.EventModified, watcher.EventDeleted:
+		default:
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidRule, event)
+		}
+	}
+
+	if len(rule.Actions) == 0 {
+		return fmt.Errorf("%w: at least one action is required", ErrInvalidRule)
+	}
+	for _, action := range rule.Actions {
+		if _, ok := m.scheduler.Handler(action.Type); !ok {
+			return fmt.Errorf("%w: no handler for action type %q", ErrInvalidRule, action.Type)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) allowed(path string) bool {
+	for _, allowed := range m.allowedPaths {
+		allowed = filepath.Clean(allowed)
+		if path == allowed || strings.HasPrefix(path, allowed+string(filepath.Separator)) || allowed == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// updateWatches points the watcher at the paths of enabled rules. m.mu
+// must be held.
+func (m *Manager) updateWatches() {
+	if m.watcher == nil {
+		return
+	}
+
+	var roots []string
+	for _, rule := range m.rules {
+		if rule.Enabled {
+			roots = append(roots, rule.Path)
+		}
+	}
+	if err := m.watcher.SetRoots(roots); err != nil {
+		log.Printf("warning: watch rule paths: %v", err)
+	}
+}
+
+func (m *Manager) run() {
+	defer close(m.done)
+
+	for event := range m.sub.C {
+		file, ok := event.Data.(*watcher.FileEvent)
+		if !ok || file.Dir {
+			continue
+		}
+		for _, rule := range m.matching(event.Type, file.Path) {
+			m.trigger(rule, event.Type, file.Path)
+		}
+	}
+}
+
+// matching returns copies of the enabled rules matching an event
+func (m *Manager) matching(eventType, path string) []*Rule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matched []*Rule
+	for _, rule := range m.rules {
+		if rule.Matches(eventType, path) {
+			copied := *rule
+			matched = append(matched, &copied)
+		}
+	}
+	return matched
+}
+
+// Matches reports whether the rule is enabled and runs for eventType
+// published for path
+func (r *Rule) Matches(eventType, path string) bool {
+	if !r.Enabled {
+		return false
+	}
+	if !strings.HasPrefix(path, r.Path+string(filepath.Separator)) {
+		return false
+	}
+	if r.Pattern != "" {
+		if ok, _ := filepath.Match(r.Pattern, filepath.Base(path)); !ok {
+			return false
+		}
+	}
+	for _, event := range r.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// trigger runs the actions of rule for path as a background job
+func (m *Manager) trigger(rule *Rule, eventType, path string) {
+	m.jobs.Submit("rule.run", path, func(ctx context.Context) error {
+		err := m.runActions(ctx, rule, path)
+
+		entry := &audit.Entry{
+			Timestamp: time.Now(),
+			User:      "rules",
+			Action:    "rule.run",
+			Resource:  path,
+			Result:    "success",
+			Details:   map[string]interface{}{"rule": rule.ID, "name": rule.Name, "event": eventType},
+		}
+		if err != nil {
+			entry.Result = "failed"
+			entry.Details["error"] = err.Error()
+		}
+		if m.audit != nil {
+			m.audit.Log(ctx, entry)
+		}
+
+		m.recordRun(rule.ID, err)
+		return err
+	})
+}
+
+// runActions runs the actions of rule in order, stopping at the first
+// that fails
+func (m *Manager) runActions(ctx context.Context, rule *Rule, path string) error {
+	rel, _ := filepath.Rel(rule.Path, path)
+	replacer := strings.NewReplacer(
+		"{path}", path,
+		"{name}", filepath.Base(path),
+		"{dir}", filepath.Dir(path),
+		"{rel}", rel,
+	)
+
+	for i, action := range rule.Actions {
+		handler, ok := m.scheduler.Handler(action.Type)
+		if !ok {
+			return fmt.Errorf("action %d: no handler for %s", i+1, action.Type)
+		}
+
+		actionCtx, cancel := context.WithTimeout(ctx, m.actionTimeout)
+		_, err := handler(actionCtx, expandParams(action.Params, replacer))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("action %d (%s): %w", i+1, action.Type, err)
+		}
+	}
+	return nil
+}
+
+// expandParams returns a copy of params with placeholders replaced
+func expandParams(params map[string]interface{}, replacer *strings.Replacer) map[string]interface{} {
+	expanded := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		switch value := value.(type) {
+		case string:
+			expanded[key] = replacer.Replace(value)
+		case []interface{}:
+			list := make([]interface{}, len(value))
+			for i, item := range value {
+				if s, ok := item.(string); ok {
+					item = replacer.Replace(s)
+				}
+				list[i] = item
+			}
+			expanded[key] = list
+		default:
+			expanded[key] = value
+		}
+	}
+	return expanded
+}
+
+func (m *Manager) recordRun(id string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rule, exists := m.rules[id]
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	rule.LastTriggered = &now
+	rule.Triggered++
+	rule.LastError = ""
+	if err != nil {
+		rule.LastError = err.Error()
+	}
+	m.saver.Trigger()
+}
+
+func (m *Manager) saveState() error {
+	dir := filepath.Dir(m.stateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(m.rules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := statefile.Write(m.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Manager) loadState() error {
+	var rules map[string]*Rule
+	if err := statefile.Read(m.stateFile, &rules); err != nil {
+		return err
+	}
+
+	if rules != nil {
+		m.rules = rules
+	}
+	return nil
+}
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
+)
+
+func TestRuleRunsActionsForWatchedFiles(t *testing.T) {
+	dir := t.TempDir()
+	camera := filepath.Join(dir, "camera")
+	if err := os.MkdirAll(camera, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sched, err := scheduler.New(scheduler.Config{DBPath: filepath.Join(dir, "scheduler.db")})
+	if err != nil {
+		t.Fatalf("scheduler.New: %v", err)
+	}
+	runs := make(chan map[string]interface{}, 10)
+	sched.RegisterHandler("test.record", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		runs <- params
+		return nil, nil
+	})
+
+	bus := events.NewBus(100)
+	fileWatcher, err := watcher.New(watcher.Config{}, bus)
+	if errors.Is(err, watcher.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("watcher.New: %v", err)
+	}
+	defer fileWatcher.Close()
+
+	m, err := New(&Config{
+		StateFile:    filepath.Join(dir, "rules.json"),
+		AllowedPaths: []string{dir},
+		Scheduler:    sched,
+		Watcher:      fileWatcher,
+		Bus:          bus,
+		Jobs:         jobs.New(&jobs.Config{}),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	m.Start()
+	defer m.Stop()
+
+	invalid := []*Rule{
+		{Name: "outside", Path: "/etc", Actions: []Action{{Type: "test.record"}}},
+		{Name: "pattern", Path: camera, Pattern: "[", Actions: []Action{{Type: "test.record"}}},
+		{Name: "action", Path: camera, Actions: []Action{{Type: "unknown"}}},
+	}
+	for _, rule := range invalid {
+		if _, err := m.AddRule(rule); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("%s: expected ErrInvalidRule, got %v", rule.Name, err)
+		}
+	}
+
+	rule, err := m.AddRule(&Rule{
+		Name:    "photos",
+		Path:    camera,
+		Pattern: "*.jpg",
+		Actions: []Action{{Type: "test.record", Params: map[string]interface{}{
+			"path":     "{path}",
+			"dst_path": "/data/photos/inbox/{name}",
+		}}},
+	})
+	if err != nil {
+		t.Fatalf("AddRule: %v", err)
+	}
+
+	// Created after the rule, so its files are only seen through the
+	// watch added for the new directory
+	day := filepath.Join(camera, "2026-10-16")
+	if err := os.Mkdir(day, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(day, "notes.txt"), []byte("skip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	photo := filepath.Join(day, "IMG_0001.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case params := <-runs:
+		if params["path"] != photo || params["dst_path"] != "/data/photos/inbox/IMG_0001.jpg" {
+			t.Fatalf("unexpected params %v", params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rule did not run")
+	}
+	select {
+	case params := <-runs:
+		t.Fatalf("rule ran again for %v", params["path"])
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := m.GetRule(rule.ID)
+		if err != nil {
+			t.Fatalf("GetRule: %v", err)
+		}
+		if got.Triggered == 1 && got.LastError == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one recorded run, got %+v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := m.RemoveRule(rule.ID); err != nil {
+		t.Fatalf("RemoveRule: %v", err)
+	}
+	if _, err := m.GetRule(rule.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
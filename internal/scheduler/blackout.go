@@ -0,0 +1,179 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Blackout is a daily window, such as 19:00-23:00 local time, in which
+// scheduled runs do not start. Runs that fall into it are moved to its end.
+// A window whose end is not after its start runs past midnight.
+type Blackout struct {
+	Start string `json:"start" yaml:"start"` // HH:MM
+	End   string `json:"end" yaml:"end"`     // HH:MM
+	// Days limits the window to the weekdays it starts on, as mon, tue,
+	// ... sun; it applies every day when empty
+	Days []string `json:"days,omitempty" yaml:"days,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maxBlackoutShifts bounds how often a run is moved to the end of a window,
+// in case overlapping windows cover the whole week
+const maxBlackoutShifts = 32
+
+// Validate checks the times and days of the window
+func (b *Blackout) Validate() error {
+	start, err := parseClock(b.Start)
+	if err != nil {
+		return fmt.Errorf("blackout start: %w", err)
+	}
+	end, err := parseClock(b.End)
+	if err != nil {
+		return fmt.Errorf("blackout end: %w", err)
+	}
+	if start == end {
+		return fmt.Errorf("blackout %s-%s is empty", b.Start, b.End)
+	}
+	for _, day := range b.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("blackout day %q: expected mon, tue, wed, thu, fri, sat or sun", day)
+		}
+	}
+	return nil
+}
+
+// String formats the window as "19:00-23:00 mon,fri"
+func (b Blackout) String() string {
+	s := b.Start + "-" + b.End
+	if len(b.Days) > 0 {
+		s += " " + strings.Join(b.Days, ",")
+	}
+	return s
+}
+
+// ValidateBlackouts checks every window of blackouts
+func ValidateBlackouts(blackouts []Blackout) error {
+	for i := range blackouts {
+		if err := blackouts[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalBlackouts encodes blackouts for the tasks table
+func marshalBlackouts(blackouts []Blackout) (string, error) {
+	if len(blackouts) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(blackouts)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseClock returns the offset of an HH:MM time from midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// until returns the end of the occurrence of the window that t falls into,
+// or false if it falls into none. The window is assumed to be valid.
+func (b *Blackout) until(t time.Time) (time.Time, bool) {
+	start, _ := parseClock(b.Start)
+	end, _ := parseClock(b.End)
+	if end <= start {
+		end += 24 * time.Hour
+	}
+
+	// An occurrence that started the day before may still be open
+	for _, daysBack := range []int{0, 1} {
+		day := time.Date(t.Year(), t.Month(), t.Day()-daysBack, 0, 0, 0, 0, t.Location())
+		if !b.onDay(day.Weekday()) {
+			continue
+		}
+		from, to := day.Add(start), day.Add(end)
+		if !t.Before(from) && t.Before(to) {
+			return to, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (b *Blackout) onDay(weekday time.Weekday) bool {
+	if len(b.Days) == 0 {
+		return true
+	}
+	for _, day := range b.Days {
+		if weekdays[strings.ToLower(day)] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// avoidBlackouts moves t past every window it falls into
+func avoidBlackouts(t time.Time, blackouts []Blackout) time.Time {
+	for shifts := 0; shifts < maxBlackoutShifts; shifts++ {
+		moved := false
+		for i := range blackouts {
+			if end, ok := blackouts[i].until(t); ok {
+				t, moved = end, true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return t
+}
+
+// blackoutsFor returns the windows that apply to task: its own, and the
+// global ones unless it opts out of them
+func (s *Scheduler) blackoutsFor(task *Task) []Blackout {
+	if task.IgnoreGlobalBlackouts {
+		return task.Blackouts
+	}
+	return append(append([]Blackout{}, s.blackouts...), task.Blackouts...)
+}
+
+// inBlackout reports whether t falls into a window of task, and until when
+func (s *Scheduler) inBlackout(task *Task, t time.Time) (time.Time, bool) {
+	for _, blackout := range s.blackoutsFor(task) {
+		if end, ok := blackout.until(t); ok {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// PreviewRuns returns the next count times task would be started from now
+// on, moved out of blackout windows, assuming each run finishes at once
+func (s *Scheduler) PreviewRuns(task *Task, count int) []time.Time {
+	runs := []time.Time{}
+	if task.Schedule == "" {
+		return runs
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from := time.Now()
+	for len(runs) < count {
+		next := s.nextRunAfter(task, from)
+		runs = append(runs, next)
+		from = next
+	}
+	return runs
+}
@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Stall watchdog check interval bounds
+const (
+	minStallCheck = 100 * time.Millisecond
+	maxStallCheck = time.Minute
+)
+
+// activeRun is an execution in progress, watched for heartbeats
+type activeRun struct {
+	task     *Task
+	cancel   context.CancelFunc
+	lastBeat atomic.Int64 // Unix nanoseconds
+	stalled  atomic.Bool
+	canceled atomic.Bool // Canceled by the watchdog
+}
+
+type runContextKey struct{}
+
+// Heartbeat tells the scheduler that the task running with ctx is making
+// progress. Handlers that may run longer than the stall timeout, such as
+// scans and copies, call it as they go; a run without heartbeats for the
+// stall timeout is reported as stalled. Outside a task it does nothing.
+func Heartbeat(ctx context.Context) {
+	if run, _ := ctx.Value(runContextKey{}).(*activeRun); run != nil {
+		run.lastBeat.Store(time.Now().UnixNano())
+	}
+}
+
+// beginRun registers an execution of task with the watchdog and returns
+// the context its handler runs with
+func (s *Scheduler) beginRun(ctx context.Context, task *Task) (context.Context, *activeRun) {
+	ctx, cancel := context.WithCancel(ctx)
+	run := &activeRun{task: task, cancel: cancel}
+	run.lastBeat.Store(time.Now().UnixNano())
+
+	s.mu.Lock()
+	s.active[run] = true
+	s.mu.Unlock()
+	return context.WithValue(ctx, runContextKey{}, run), run
+}
+
+// endRun unregisters run, resolving its stall if there was one
+func (s *Scheduler) endRun(run *activeRun) {
+	run.cancel()
+
+	s.mu.Lock()
+	delete(s.active, run)
+	s.mu.Unlock()
+	s.setStalled(run.task.ID, false)
+
+	if run.stalled.Load() {
+		s.publishHealth(run.task, true, fmt.Sprintf("task %s finished", run.task.Name))
+	}
+}
+
+// watchStalls marks runs without heartbeats for the stall timeout as
+// stalled, and cancels them if configured to
+func (s *Scheduler) watchStalls(ctx context.Context) {
+	defer s.wg.Done()
+
+	interval := min(max(s.stallTimeout/4, minStallCheck), maxStallCheck)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.checkStalls(time.Now())
+		}
+	}
+}
+
+func (s *Scheduler) checkStalls(now time.Time) {
+	s.mu.Lock()
+	runs := make([]*activeRun, 0, len(s.active))
+	for run := range s.active {
+		runs = append(runs, run)
+	}
+	s.mu.Unlock()
+
+	for _, run := range runs {
+		silent := now.Sub(time.Unix(0, run.lastBeat.Load()))
+		stalled := silent >= s.stallTimeout
+		if stalled == run.stalled.Load() {
+			continue
+		}
+		run.stalled.Store(stalled)
+
+		s.setStalled(run.task.ID, stalled)
+
+		if !stalled {
+			s.publishHealth(run.task, true, fmt.Sprintf("task %s is making progress again", run.task.Name))
+			continue
+		}
+		message := fmt.Sprintf("task %s sent no heartbeat for %s", run.task.Name, s.stallTimeout)
+		if s.cancelStalled {
+			message += "; canceled"
+		}
+		log.Printf("scheduler: %s", message)
+		// Published before canceling, so it precedes the event of the run
+		// finishing
+		s.publishHealth(run.task, false, message)
+		if s.cancelStalled {
+			run.canceled.Store(true)
+			run.cancel()
+		}
+	}
+}
+
+// publishHealth reports a stall, or its end, as a task.health event
+func (s *Scheduler) publishHealth(task *Task, healthy bool, message string) {
+	if s.bus == nil {
+		return
+	}
+	s.bus.Publish("task.health", map[string]interface{}{
+		"id":      task.ID,
+		"name":    task.Name,
+		"healthy": healthy,
+		"message": message,
+	})
+}
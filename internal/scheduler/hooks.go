@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Errors of hook triggers
+var (
+	ErrHookNotFound = errors.New("hook not found")
+	ErrHookParam    = errors.New("param may not be set by the hook")
+	ErrTaskDisabled = errors.New("task is disabled")
+	ErrTaskRunning  = errors.New("task is already running")
+)
+
+// CreateHook gives a task a new hook token, replacing the one it had, and
+// returns it. Only a hash of the token is stored, so it cannot be shown
+// again.
+func (s *Scheduler) CreateHook(ctx context.Context, taskID string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("generate hook token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	if err := s.setHookHash(ctx, taskID, hashHookToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DeleteHook revokes the hook token of a task
+func (s *Scheduler) DeleteHook(ctx context.Context, taskID string) error {
+	return s.setHookHash(ctx, taskID, "")
+}
+
+func (s *Scheduler) setHookHash(ctx context.Context, taskID, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[taskID]; !ok {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
+	}
+	if _, err := s.db.ExecContext(ctx, "UPDATE tasks SET hook_hash = ? WHERE id = ?", hash, taskID); err != nil {
+		return fmt.Errorf("save hook: %w", err)
+	}
+	s.setTask(taskID, func(task *Task) {
+		task.hookHash = hash
+		task.Hook = hash != ""
+	})
+	return nil
+}
+
+// TriggerHook starts the task whose hook token is token in the background
+// and returns its ID. params override the task's own, but only those the
+// task lists in HookParams.
+func (s *Scheduler) TriggerHook(ctx context.Context, token string, params map[string]interface{}) (string, error) {
+	hash := hashHookToken(token)
+
+	s.mu.Lock()
+	var task *Task
+	for _, t := range s.tasks {
+		if t.hookHash != "" && t.hookHash == hash {
+			task = t
+			break
+		}
+	}
+	if task == nil {
+		s.mu.Unlock()
+		return "", ErrHookNotFound
+	}
+	if !task.Enabled {
+		s.mu.Unlock()
+		return "", fmt.Errorf("%w: %s", ErrTaskDisabled, task.ID)
+	}
+	if _, running := s.running[task.ID]; running || task.Status == "running" {
+		s.mu.Unlock()
+		return "", fmt.Errorf("%w: %s", ErrTaskRunning, task.ID)
+	}
+
+	merged := maps.Clone(task.Params)
+	if merged == nil {
+		merged = make(map[string]interface{}, len(params))
+	}
+	for name, value := range params {
+		if !slices.Contains(task.HookParams, name) {
+			s.mu.Unlock()
+			return "", fmt.Errorf("%w: %s", ErrHookParam, name)
+		}
+		merged[name] = value
+	}
+
+	// The run outlives the request that triggered it
+	taskCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	s.running[task.ID] = cancel
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, task.ID)
+			s.mu.Unlock()
+			cancel()
+		}()
+
+		s.executeTask(taskCtx, task, merged)
+	}()
+	return task.ID, nil
+}
+
+// hashHookToken returns the form hook tokens are stored and looked up in.
+// Tokens are random, so a fast hash is enough.
+func hashHookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func marshalHookParams(params []string) (string, error) {
+	if len(params) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
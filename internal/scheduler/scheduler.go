@@ -7,12 +7,24 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Task owners. Portal-owned tasks are created, updated and removed by the
+// portal sync; local-owned tasks are never touched by it.
+const (
+	SourceLocal  = "local"
+	SourcePortal = "portal"
+)
+
 // Task represents a scheduled task
 type Task struct {
 	ID        string                 `json:"id"`
@@ -24,8 +36,31 @@ type Task struct {
 	LastRun   *time.Time             `json:"last_run,omitempty"`
 	NextRun   *time.Time             `json:"next_run,omitempty"`
 	Status    string                 `json:"status"` // idle, running, failed
+	Source    string                 `json:"source"` // local or portal
 	CreatedAt time.Time              `json:"created_at"`
 	UpdatedAt time.Time              `json:"updated_at"`
+
+	// Version counts changes to the settings of the task, not its runs.
+	// Updates that carry a version fail with ErrTaskConflict once the task
+	// has changed since it was read.
+	Version int64 `json:"version"`
+
+	// Hook is set while the task has a hook token, with which it can be
+	// triggered through /api/v1/hooks/<token>. HookParams names the params
+	// a hook request may override.
+	Hook       bool     `json:"hook"`
+	HookParams []string `json:"hook_params,omitempty"`
+
+	// Blackouts are windows in which the task is not started on schedule,
+	// on top of the global ones unless IgnoreGlobalBlackouts is set
+	Blackouts             []Blackout `json:"blackouts,omitempty"`
+	IgnoreGlobalBlackouts bool       `json:"ignore_global_blackouts,omitempty"`
+
+	// Stalled is set while a run has not sent a heartbeat for the stall
+	// timeout
+	Stalled bool `json:"stalled,omitempty"`
+
+	hookHash string // SHA-256 of the hook token
 }
 
 // TaskExecution represents a task execution record
@@ -37,6 +72,7 @@ type TaskExecution struct {
 	Status      string                 `json:"status"` // running, success, failed
 	Result      map[string]interface{} `json:"result,omitempty"`
 	Error       string                 `json:"error,omitempty"`
+	Usage       *ResourceUsage         `json:"usage,omitempty"` // Set once completed
 }
 
 // TaskHandler is a function that executes a task
@@ -51,6 +87,15 @@ type Scheduler struct {
 	running  map[string]context.CancelFunc
 	stopCh   chan struct{}
 	wg       sync.WaitGroup
+
+	maxConcurrent int
+	blackouts     []Blackout
+	executions    executions
+
+	bus           *events.Bus
+	stallTimeout  time.Duration
+	cancelStalled bool
+	active        map[*activeRun]bool
 }
 
 // Config holds scheduler configuration
@@ -59,6 +104,13 @@ type Config struct {
 	SyncInterval     time.Duration // How often to sync tasks from WebUI
 	PersistenceFile  string
 	OfflineTolerance bool
+	CacheSizeKB      int        // SQLite page cache size; 0 uses the SQLite default
+	MaxConcurrent    int        // Scheduled tasks run at once; 0 is unlimited
+	Blackouts        []Blackout // Windows in which no task is started on schedule
+	// Runs without a heartbeat for StallTimeout are reported as stalled,
+	// and canceled if CancelStalled is set; 0 disables the watchdog
+	StallTimeout  time.Duration
+	CancelStalled bool
 }
 
 // New creates a new scheduler
@@ -69,6 +121,9 @@ func New(config Config) (*Scheduler, error) {
 	if config.SyncInterval == 0 {
 		config.SyncInterval = 5 * time.Minute
 	}
+	if err := ValidateBlackouts(config.Blackouts); err != nil {
+		return nil, err
+	}
 
 	// Ensure DB directory exists
 	dbDir := filepath.Dir(config.DBPath)
@@ -76,7 +131,16 @@ func New(config Config) (*Scheduler, error) {
 		return nil, fmt.Errorf("create database directory %s: %w\n\nPlease ensure the directory exists and has correct permissions:\n  sudo mkdir -p %s\n  sudo chown -R $(whoami):$(whoami) %s", dbDir, err, dbDir, dbDir)
 	}
 
-	db, err := sql.Open("sqlite3", config.DBPath)
+	dsn := config.DBPath
+	if config.CacheSizeKB > 0 {
+		dsn += fmt.Sprintf("?_cache_size=-%d", config.CacheSizeKB)
+	}
+
+	if err := statefile.PrepareDB(config.DBPath); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -87,6 +151,12 @@ func New(config Config) (*Scheduler, error) {
 		tasks:    make(map[string]*Task),
 		running:  make(map[string]context.CancelFunc),
 		stopCh:   make(chan struct{}),
+
+		maxConcurrent: config.MaxConcurrent,
+		blackouts:     config.Blackouts,
+		stallTimeout:  config.StallTimeout,
+		cancelStalled: config.CancelStalled,
+		active:        make(map[*activeRun]bool),
 	}
 
 	if err := s.initDB(); err != nil {
@@ -94,6 +164,11 @@ func New(config Config) (*Scheduler, error) {
 		return nil, fmt.Errorf("initialize database: %w", err)
 	}
 
+	if err := s.recoverInterrupted(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("recover interrupted executions: %w", err)
+	}
+
 	// Load persisted tasks
 	if err := s.loadTasks(); err != nil {
 		db.Close()
@@ -134,7 +209,74 @@ func (s *Scheduler) initDB() error {
 	CREATE INDEX IF NOT EXISTS idx_started_at ON task_executions(started_at);
 	`
 
-	_, err := s.db.Exec(schema)
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+
+	if err := s.ensureColumn("tasks", "source", "TEXT DEFAULT 'local'"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("tasks", "hook_hash", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("tasks", "hook_params", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("tasks", "blackouts", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("tasks", "ignore_global_blackouts", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("tasks", "version", "INTEGER DEFAULT 1"); err != nil {
+		return err
+	}
+	return s.ensureColumn("task_executions", "usage", "TEXT DEFAULT ''")
+}
+
+// ensureColumn adds a column to databases created before it existed. The
+// portal sync needed it first: agents upgraded to it keep their tasks
+// table, which has no source column to tell portal-owned tasks apart.
+func (s *Scheduler) ensureColumn(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// recoverInterrupted marks executions left running by a previous process as
+// failed so they are reported and their tasks become runnable again. The
+// portal sync depends on it: CompletedExecutionsAfter stops at the first
+// running execution, so one left by a crash would stop reporting for good.
+func (s *Scheduler) recoverInterrupted() error {
+	if _, err := s.db.Exec(`
+		UPDATE task_executions
+		SET status = 'failed', completed_at = started_at, error = 'interrupted by agent restart'
+		WHERE status = 'running'
+	`); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec("UPDATE tasks SET status = 'failed' WHERE status = 'running'")
 	return err
 }
 
@@ -143,7 +285,9 @@ func (s *Scheduler) loadTasks() error {
 	defer s.mu.Unlock()
 
 	rows, err := s.db.Query(`
-		SELECT id, name, type, schedule, params, enabled, last_run, next_run, status, created_at, updated_at
+		SELECT id, name, type, schedule, params, enabled, last_run, next_run, status, COALESCE(source, 'local'), created_at, updated_at,
+			COALESCE(hook_hash, ''), COALESCE(hook_params, ''), COALESCE(blackouts, ''), COALESCE(ignore_global_blackouts, 0),
+			COALESCE(version, 1)
 		FROM tasks
 	`)
 	if err != nil {
@@ -153,12 +297,13 @@ func (s *Scheduler) loadTasks() error {
 
 	for rows.Next() {
 		var task Task
-		var paramsJSON string
-		var enabled int
+		var paramsJSON, hookParams, blackouts string
+		var enabled, ignoreGlobalBlackouts int
 		var lastRun, nextRun, createdAt, updatedAt int64
 
 		err := rows.Scan(&task.ID, &task.Name, &task.Type, &task.Schedule, &paramsJSON,
-			&enabled, &lastRun, &nextRun, &task.Status, &createdAt, &updatedAt)
+			&enabled, &lastRun, &nextRun, &task.Status, &task.Source, &createdAt, &updatedAt,
+			&task.hookHash, &hookParams, &blackouts, &ignoreGlobalBlackouts, &task.Version)
 		if err != nil {
 			continue
 		}
@@ -174,6 +319,14 @@ func (s *Scheduler) loadTasks() error {
 		}
 		task.CreatedAt = time.Unix(createdAt, 0)
 		task.UpdatedAt = time.Unix(updatedAt, 0)
+		task.Hook = task.hookHash != ""
+		if hookParams != "" {
+			json.Unmarshal([]byte(hookParams), &task.HookParams)
+		}
+		if blackouts != "" {
+			json.Unmarshal([]byte(blackouts), &task.Blackouts)
+		}
+		task.IgnoreGlobalBlackouts = ignoreGlobalBlackouts != 0
 
 		if err := json.Unmarshal([]byte(paramsJSON), &task.Params); err == nil {
 			s.tasks[task.ID] = &task
@@ -191,8 +344,18 @@ func (s *Scheduler) RegisterHandler(taskType string, handler TaskHandler) {
 	s.handlers[taskType] = handler
 }
 
+// Handler returns the handler registered for taskType, for callers that
+// run task handlers outside of scheduled tasks
+func (s *Scheduler) Handler(taskType string) (TaskHandler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	handler, ok := s.handlers[taskType]
+	return handler, ok
+}
+
 // AddTask adds a new task
-func (s *Scheduler) AddTask(task *Task) error {
+func (s *Scheduler) AddTask(ctx context.Context, task *Task) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -200,13 +363,26 @@ func (s *Scheduler) AddTask(task *Task) error {
 		task.ID = fmt.Sprintf("task-%d", time.Now().UnixNano())
 	}
 
+	if _, exists := s.tasks[task.ID]; exists {
+		return fmt.Errorf("task already exists: %s", task.ID)
+	}
+	if err := ValidateBlackouts(task.Blackouts); err != nil {
+		return err
+	}
+
 	task.CreatedAt = time.Now()
 	task.UpdatedAt = time.Now()
 	task.Status = "idle"
+	task.Version = 1
+	task.hookHash = ""
+	task.Hook = false
+	if task.Source == "" {
+		task.Source = SourceLocal
+	}
 
 	// Calculate next run based on schedule
 	if task.Schedule != "" {
-		nextRun := s.calculateNextRun(task.Schedule)
+		nextRun := s.nextRunAfter(task, time.Now())
 		task.NextRun = &nextRun
 	}
 
@@ -214,58 +390,121 @@ func (s *Scheduler) AddTask(task *Task) error {
 	if err != nil {
 		return err
 	}
+	hookParams, err := marshalHookParams(task.HookParams)
+	if err != nil {
+		return err
+	}
+	blackouts, err := marshalBlackouts(task.Blackouts)
+	if err != nil {
+		return err
+	}
 
 	var nextRunUnix int64
 	if task.NextRun != nil {
 		nextRunUnix = task.NextRun.Unix()
 	}
 
-	_, err = s.db.Exec(`
-		INSERT INTO tasks (id, name, type, schedule, params, enabled, next_run, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO tasks (id, name, type, schedule, params, enabled, next_run, status, source, created_at, updated_at, hook_params, blackouts, ignore_global_blackouts, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, task.ID, task.Name, task.Type, task.Schedule, string(paramsJSON),
-		boolToInt(task.Enabled), nextRunUnix, task.Status, task.CreatedAt.Unix(), task.UpdatedAt.Unix())
+		boolToInt(task.Enabled), nextRunUnix, task.Status, task.Source, task.CreatedAt.Unix(), task.UpdatedAt.Unix(), hookParams,
+		blackouts, boolToInt(task.IgnoreGlobalBlackouts), task.Version)
 	if err != nil {
 		return err
 	}
 
-	s.tasks[task.ID] = task
+	stored := *task
+	s.tasks[task.ID] = &stored
 	return nil
 }
 
-// UpdateTask updates an existing task
-func (s *Scheduler) UpdateTask(task *Task) error {
+// UpdateTask replaces the settings of an existing task with those of
+// task. If task.Version is set, it must be the stored version, or
+// ErrTaskConflict is returned so the caller can read the task again. The
+// run state belongs to the scheduler and is kept, except that a new
+// schedule or new blackouts plan the next run anew. On success task is set
+// to the stored task.
+func (s *Scheduler) UpdateTask(ctx context.Context, task *Task) error {
+	if err := ValidateBlackouts(task.Blackouts); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	task.UpdatedAt = time.Now()
-
-	paramsJSON, err := json.Marshal(task.Params)
+	existing, ok := s.tasks[task.ID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, task.ID)
+	}
+	if task.Version != 0 && task.Version != existing.Version {
+		return fmt.Errorf("%w: %s is at version %d", ErrTaskConflict, task.ID, existing.Version)
+	}
+
+	updated := *task
+	// Ownership only changes through the portal sync, and hook tokens
+	// through CreateHook and DeleteHook
+	if updated.Source == "" {
+		updated.Source = existing.Source
+	}
+	updated.hookHash = existing.hookHash
+	updated.Hook = existing.Hook
+	updated.Status = existing.Status
+	updated.LastRun = existing.LastRun
+	updated.NextRun = existing.NextRun
+	updated.Stalled = existing.Stalled
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = time.Now()
+	updated.Version = existing.Version + 1
+
+	rescheduled := existing.Schedule != updated.Schedule ||
+		existing.IgnoreGlobalBlackouts != updated.IgnoreGlobalBlackouts ||
+		!reflect.DeepEqual(existing.Blackouts, updated.Blackouts)
+	switch {
+	case updated.Schedule == "":
+		updated.NextRun = nil
+	case rescheduled || updated.NextRun == nil:
+		nextRun := s.nextRunAfter(&updated, time.Now())
+		updated.NextRun = &nextRun
+	}
+
+	paramsJSON, err := json.Marshal(updated.Params)
+	if err != nil {
+		return err
+	}
+	hookParams, err := marshalHookParams(updated.HookParams)
+	if err != nil {
+		return err
+	}
+	blackouts, err := marshalBlackouts(updated.Blackouts)
 	if err != nil {
 		return err
 	}
 
 	var nextRunUnix int64
-	if task.NextRun != nil {
-		nextRunUnix = task.NextRun.Unix()
+	if updated.NextRun != nil {
+		nextRunUnix = updated.NextRun.Unix()
 	}
 
-	_, err = s.db.Exec(`
+	_, err = s.db.ExecContext(ctx, `
 		UPDATE tasks
-		SET name = ?, type = ?, schedule = ?, params = ?, enabled = ?, next_run = ?, status = ?, updated_at = ?
+		SET name = ?, type = ?, schedule = ?, params = ?, enabled = ?, next_run = ?, source = ?, updated_at = ?, hook_params = ?,
+			blackouts = ?, ignore_global_blackouts = ?, version = ?
 		WHERE id = ?
-	`, task.Name, task.Type, task.Schedule, string(paramsJSON),
-		boolToInt(task.Enabled), nextRunUnix, task.Status, task.UpdatedAt.Unix(), task.ID)
+	`, updated.Name, updated.Type, updated.Schedule, string(paramsJSON),
+		boolToInt(updated.Enabled), nextRunUnix, updated.Source, updated.UpdatedAt.Unix(), hookParams,
+		blackouts, boolToInt(updated.IgnoreGlobalBlackouts), updated.Version, updated.ID)
 	if err != nil {
 		return err
 	}
 
-	s.tasks[task.ID] = task
+	s.tasks[task.ID] = &updated
+	*task = updated
 	return nil
 }
 
 // DeleteTask deletes a task
-func (s *Scheduler) DeleteTask(taskID string) error {
+func (s *Scheduler) DeleteTask(ctx context.Context, taskID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -275,7 +514,7 @@ func (s *Scheduler) DeleteTask(taskID string) error {
 		delete(s.running, taskID)
 	}
 
-	_, err := s.db.Exec("DELETE FROM tasks WHERE id = ?", taskID)
+	_, err := s.db.ExecContext(ctx, "DELETE FROM tasks WHERE id = ?", taskID)
 	if err != nil {
 		return err
 	}
@@ -291,13 +530,13 @@ func (s *Scheduler) GetTask(taskID string) (*Task, error) {
 
 	task, ok := s.tasks[taskID]
 	if !ok {
-		return nil, fmt.Errorf("task not found: %s", taskID)
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, taskID)
 	}
 
 	return task, nil
 }
 
-// ListTasks returns all tasks
+// ListTasks returns all tasks, ordered by ID
 func (s *Scheduler) ListTasks() []*Task {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -306,6 +545,9 @@ func (s *Scheduler) ListTasks() []*Task {
 	for _, task := range s.tasks {
 		tasks = append(tasks, task)
 	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].ID < tasks[j].ID
+	})
 
 	return tasks
 }
@@ -317,10 +559,12 @@ func (s *Scheduler) ExecuteTask(ctx context.Context, taskID string) (*TaskExecut
 		return nil, err
 	}
 
-	return s.executeTask(ctx, task)
+	return s.executeTask(ctx, task, task.Params)
 }
 
-func (s *Scheduler) executeTask(ctx context.Context, task *Task) (*TaskExecution, error) {
+// executeTask runs task with params, which are the task's own unless a
+// hook overrides some of them
+func (s *Scheduler) executeTask(ctx context.Context, task *Task, params map[string]interface{}) (*TaskExecution, error) {
 	s.mu.RLock()
 	handler, ok := s.handlers[task.Type]
 	s.mu.RUnlock()
@@ -336,7 +580,7 @@ func (s *Scheduler) executeTask(ctx context.Context, task *Task) (*TaskExecution
 	}
 
 	// Record execution start
-	result, err := s.db.Exec(`
+	result, err := s.db.ExecContext(ctx, `
 		INSERT INTO task_executions (task_id, started_at, status)
 		VALUES (?, ?, ?)
 	`, task.ID, execution.StartedAt.Unix(), "running")
@@ -347,14 +591,21 @@ func (s *Scheduler) executeTask(ctx context.Context, task *Task) (*TaskExecution
 	execID, _ := result.LastInsertId()
 	execution.ID = execID
 
-	// Update task status
-	s.mu.Lock()
-	task.Status = "running"
-	task.LastRun = &execution.StartedAt
-	s.mu.Unlock()
+	s.startRun(ctx, task.ID, execution.StartedAt)
 
 	// Execute the task
-	taskResult, execErr := handler(ctx, task.Params)
+	taskCtx, span := telemetry.Start(ctx, "scheduler.task "+task.Type)
+	span.SetAttribute("task.id", task.ID)
+	taskCtx, run := s.beginRun(taskCtx, task)
+	meter := s.executions.startMeter()
+	taskResult, execErr := handler(taskCtx, params)
+	execution.Usage = meter.finish()
+	s.endRun(run)
+	if execErr != nil && run.canceled.Load() {
+		execErr = fmt.Errorf("canceled after no heartbeat for %s: %w", s.stallTimeout, execErr)
+	}
+	span.SetError(execErr)
+	span.End()
 
 	// Update execution record
 	completedAt := time.Now()
@@ -369,23 +620,17 @@ func (s *Scheduler) executeTask(ctx context.Context, task *Task) (*TaskExecution
 	}
 
 	resultJSON, _ := json.Marshal(taskResult)
+	usageJSON, _ := json.Marshal(execution.Usage)
 
-	_, err = s.db.Exec(`
+	// Record the outcome even when the run was cancelled
+	recordCtx := context.WithoutCancel(ctx)
+	_, err = s.db.ExecContext(recordCtx, `
 		UPDATE task_executions
-		SET completed_at = ?, status = ?, result = ?, error = ?
+		SET completed_at = ?, status = ?, result = ?, error = ?, usage = ?
 		WHERE id = ?
-	`, completedAt.Unix(), execution.Status, string(resultJSON), execution.Error, execID)
+	`, completedAt.Unix(), execution.Status, string(resultJSON), execution.Error, string(usageJSON), execID)
 
-	// Update task status and schedule next run
-	s.mu.Lock()
-	task.Status = execution.Status
-	if task.Schedule != "" {
-		nextRun := s.calculateNextRun(task.Schedule)
-		task.NextRun = &nextRun
-	}
-	s.mu.Unlock()
-
-	s.UpdateTask(task)
+	s.finishRun(recordCtx, task.ID, execution.Status)
 
 	return execution, execErr
 }
@@ -394,9 +639,18 @@ func (s *Scheduler) executeTask(ctx context.Context, task *Task) (*TaskExecution
 func (s *Scheduler) Start(ctx context.Context) error {
 	s.wg.Add(1)
 	go s.run(ctx)
+	if s.stallTimeout > 0 {
+		s.wg.Add(1)
+		go s.watchStalls(ctx)
+	}
 	return nil
 }
 
+// SetBus publishes task.health events when runs stall and recover
+func (s *Scheduler) SetBus(bus *events.Bus) {
+	s.bus = bus
+}
+
 func (s *Scheduler) run(ctx context.Context) {
 	defer s.wg.Done()
 
@@ -418,25 +672,38 @@ func (s *Scheduler) run(ctx context.Context) {
 func (s *Scheduler) checkAndExecuteTasks(ctx context.Context) {
 	now := time.Now()
 
-	s.mu.RLock()
+	// A task that became due inside a blackout window, such as one that was
+	// planned before the window was configured, waits for the window to end
+	s.mu.Lock()
 	var tasksToRun []*Task
 	for _, task := range s.tasks {
 		if !task.Enabled {
 			continue
 		}
-		if task.Status == "running" {
+		if _, running := s.running[task.ID]; running || task.Status == "running" {
 			continue
 		}
-		if task.NextRun != nil && task.NextRun.Before(now) {
-			tasksToRun = append(tasksToRun, task)
+		if task.NextRun == nil || !task.NextRun.Before(now) {
+			continue
+		}
+		if end, ok := s.inBlackout(task, now); ok {
+			// Saved so the task does not start right away after a restart
+			s.saveRunState(ctx, s.setTask(task.ID, func(task *Task) { task.NextRun = &end }))
+			continue
 		}
+		tasksToRun = append(tasksToRun, task)
 	}
-	s.mu.RUnlock()
+	s.mu.Unlock()
 
-	// Execute tasks concurrently
+	// Execute tasks concurrently; tasks over the limit stay due and are
+	// picked up on a later tick
 	for _, task := range tasksToRun {
-		taskCtx, cancel := context.WithCancel(ctx)
 		s.mu.Lock()
+		if s.maxConcurrent > 0 && len(s.running) >= s.maxConcurrent {
+			s.mu.Unlock()
+			break
+		}
+		taskCtx, cancel := context.WithCancel(ctx)
 		s.running[task.ID] = cancel
 		s.mu.Unlock()
 
@@ -447,12 +714,18 @@ func (s *Scheduler) checkAndExecuteTasks(ctx context.Context) {
 				s.mu.Unlock()
 			}()
 
-			s.executeTask(taskCtx, t)
+			s.executeTask(taskCtx, t, t.Params)
 		}(task)
 	}
 }
 
-func (s *Scheduler) calculateNextRun(schedule string) time.Time {
+// nextRunAfter returns the time task runs next after from, moved out of the
+// blackout windows that apply to it
+func (s *Scheduler) nextRunAfter(task *Task, from time.Time) time.Time {
+	return avoidBlackouts(from.Add(scheduleInterval(task.Schedule)), s.blackoutsFor(task))
+}
+
+func scheduleInterval(schedule string) time.Duration {
 	// Simplified cron-like parsing
 	// For now, support simple intervals like "every 1h", "every 30m", "daily", etc.
 
@@ -473,7 +746,7 @@ func (s *Scheduler) calculateNextRun(schedule string) time.Time {
 		duration = 1 * time.Hour
 	}
 
-	return time.Now().Add(duration)
+	return duration
 }
 
 // Stop stops the scheduler
@@ -503,10 +776,61 @@ func (s *Scheduler) Stop(ctx context.Context) error {
 	return s.db.Close()
 }
 
+// CompletedExecutionsAfter returns up to limit finished executions with an ID
+// greater than afterID in ID order. It stops at the first execution that is
+// still running so a cursor advanced over the result never skips one.
+func (s *Scheduler) CompletedExecutionsAfter(ctx context.Context, afterID int64, limit int) ([]*TaskExecution, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, task_id, started_at, COALESCE(completed_at, 0), status, COALESCE(result, ''), COALESCE(error, ''),
+			COALESCE(usage, '')
+		FROM task_executions
+		WHERE id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var executions []*TaskExecution
+	for rows.Next() {
+		var exec TaskExecution
+		var startedAt, completedAt int64
+		var resultJSON, usageJSON string
+
+		if err := rows.Scan(&exec.ID, &exec.TaskID, &startedAt, &completedAt,
+			&exec.Status, &resultJSON, &exec.Error, &usageJSON); err != nil {
+			return nil, err
+		}
+
+		if exec.Status == "running" {
+			break
+		}
+
+		exec.StartedAt = time.Unix(startedAt, 0)
+		if completedAt > 0 {
+			t := time.Unix(completedAt, 0)
+			exec.CompletedAt = &t
+		}
+
+		if resultJSON != "" {
+			json.Unmarshal([]byte(resultJSON), &exec.Result)
+		}
+		if usageJSON != "" {
+			json.Unmarshal([]byte(usageJSON), &exec.Usage)
+		}
+
+		executions = append(executions, &exec)
+	}
+
+	return executions, rows.Err()
+}
+
 // GetExecutionHistory returns execution history for a task
-func (s *Scheduler) GetExecutionHistory(taskID string, limit int) ([]*TaskExecution, error) {
-	rows, err := s.db.Query(`
-		SELECT id, task_id, started_at, completed_at, status, result, error
+func (s *Scheduler) GetExecutionHistory(ctx context.Context, taskID string, limit int) ([]*TaskExecution, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, task_id, started_at, completed_at, status, result, error, COALESCE(usage, '')
 		FROM task_executions
 		WHERE task_id = ?
 		ORDER BY started_at DESC
@@ -521,10 +845,10 @@ func (s *Scheduler) GetExecutionHistory(taskID string, limit int) ([]*TaskExecut
 	for rows.Next() {
 		var exec TaskExecution
 		var startedAt, completedAt int64
-		var resultJSON string
+		var resultJSON, usageJSON string
 
 		err := rows.Scan(&exec.ID, &exec.TaskID, &startedAt, &completedAt,
-			&exec.Status, &resultJSON, &exec.Error)
+			&exec.Status, &resultJSON, &exec.Error, &usageJSON)
 		if err != nil {
 			continue
 		}
@@ -538,6 +862,9 @@ func (s *Scheduler) GetExecutionHistory(taskID string, limit int) ([]*TaskExecut
 		if resultJSON != "" {
 			json.Unmarshal([]byte(resultJSON), &exec.Result)
 		}
+		if usageJSON != "" {
+			json.Unmarshal([]byte(usageJSON), &exec.Usage)
+		}
 
 		executions = append(executions, &exec)
 	}
@@ -0,0 +1,136 @@
+package scheduler
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	sched, err := New(Config{DBPath: filepath.Join(t.TempDir(), "scheduler.db"), MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer sched.Stop(context.Background())
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	sched.RegisterHandler("block", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		started <- params["name"].(string)
+		<-release
+		return nil, nil
+	})
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	for _, id := range []string{"a", "b"} {
+		if err := sched.AddTask(ctx, &Task{ID: id, Name: id, Type: "block", Schedule: "daily", Enabled: true, Params: map[string]interface{}{"name": id}}); err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		sched.mu.Lock()
+		sched.setTask(id, func(task *Task) { task.NextRun = &past })
+		sched.mu.Unlock()
+	}
+
+	sched.checkAndExecuteTasks(ctx)
+	first := waitStarted(t, started)
+
+	// The other task stays due while the limit is reached
+	sched.checkAndExecuteTasks(ctx)
+	select {
+	case id := <-started:
+		t.Fatalf("expected %s to wait for %s, but it started", id, first)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sched.mu.RLock()
+		running := len(sched.running)
+		sched.mu.RUnlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the first task to finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sched.checkAndExecuteTasks(ctx)
+	if second := waitStarted(t, started); second == first {
+		t.Fatalf("expected the waiting task to run, got %s again", second)
+	}
+	close(release)
+}
+
+func TestBlackoutPushSurvivesRestart(t *testing.T) {
+	now := time.Now()
+	blackouts := []Blackout{{
+		Start: now.Add(-time.Hour).Format("15:04"),
+		End:   now.Add(time.Hour).Format("15:04"),
+	}}
+	dbPath := filepath.Join(t.TempDir(), "scheduler.db")
+	sched, err := New(Config{DBPath: dbPath, Blackouts: blackouts})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ran := make(chan string, 1)
+	sched.RegisterHandler("report", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		ran <- "report"
+		return nil, nil
+	})
+	ctx := context.Background()
+	if err := sched.AddTask(ctx, &Task{ID: "report", Name: "report", Type: "report", Schedule: "daily", Enabled: true}); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	// Planned before the window was configured, so due inside it
+	past := now.Add(-time.Minute)
+	sched.mu.Lock()
+	sched.saveRunState(ctx, sched.setTask("report", func(task *Task) { task.NextRun = &past }))
+	sched.mu.Unlock()
+
+	sched.checkAndExecuteTasks(ctx)
+	select {
+	case <-ran:
+		t.Fatal("expected the task not to run inside the blackout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	task, err := sched.GetTask("report")
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if task.NextRun == nil || !task.NextRun.After(now) {
+		t.Fatalf("expected the run to move to the end of the window, got %v", task.NextRun)
+	}
+	pushed := task.NextRun.Unix()
+	sched.Stop(ctx)
+
+	sched, err = New(Config{DBPath: dbPath, Blackouts: blackouts})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer sched.Stop(ctx)
+	task, err = sched.GetTask("report")
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if task.NextRun == nil || task.NextRun.Unix() != pushed {
+		t.Fatalf("expected the pushed run to be reloaded, got %v", task.NextRun)
+	}
+}
+
+func waitStarted(t *testing.T, started <-chan string) string {
+	t.Helper()
+	select {
+	case id := <-started:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a task to start")
+		return ""
+	}
+}
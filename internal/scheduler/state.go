@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Errors of task lookups and updates
+var (
+	ErrTaskNotFound = errors.New("task not found")
+	ErrTaskConflict = errors.New("task was changed since it was read")
+)
+
+// setTask stores a copy of the task with id, changed by change, and
+// returns it, or nil if the task was deleted. Stored tasks are never
+// modified in place, so those returned by GetTask and ListTasks can be
+// read without the lock while runs and updates go on. The caller holds
+// s.mu.
+func (s *Scheduler) setTask(id string, change func(task *Task)) *Task {
+	current, ok := s.tasks[id]
+	if !ok {
+		return nil
+	}
+	updated := *current
+	change(&updated)
+	s.tasks[id] = &updated
+	return &updated
+}
+
+// startRun marks the task with id as running since startedAt
+func (s *Scheduler) startRun(ctx context.Context, id string, startedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task := s.setTask(id, func(task *Task) {
+		task.Status = "running"
+		task.LastRun = &startedAt
+	})
+	if task != nil {
+		s.saveRunState(ctx, task)
+	}
+}
+
+// finishRun records how a run of the task with id ended and plans its
+// next run. A task deleted while it ran stays deleted.
+func (s *Scheduler) finishRun(ctx context.Context, id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task := s.setTask(id, func(task *Task) {
+		task.Status = status
+		if task.Schedule != "" {
+			nextRun := s.nextRunAfter(task, time.Now())
+			task.NextRun = &nextRun
+		}
+	})
+	if task != nil {
+		s.saveRunState(ctx, task)
+	}
+}
+
+// setStalled sets whether the run of the task with id is stalled
+func (s *Scheduler) setStalled(id string, stalled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setTask(id, func(task *Task) {
+		task.Stalled = stalled
+	})
+}
+
+// saveRunState persists the status, last and next run of task, leaving
+// its settings and version alone. The caller holds s.mu, which orders the
+// write with those of UpdateTask.
+func (s *Scheduler) saveRunState(ctx context.Context, task *Task) {
+	var lastRun, nextRun int64
+	if task.LastRun != nil {
+		lastRun = task.LastRun.Unix()
+	}
+	if task.NextRun != nil {
+		nextRun = task.NextRun.Unix()
+	}
+	if _, err := s.db.ExecContext(ctx, "UPDATE tasks SET status = ?, last_run = ?, next_run = ? WHERE id = ?",
+		task.Status, lastRun, nextRun, task.ID); err != nil {
+		log.Printf("scheduler: save run state of task %s: %v", task.ID, err)
+	}
+}
@@ -0,0 +1,437 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// SyncResult summarizes one reconciliation with the portal
+type SyncResult struct {
+	Added     []string `json:"added,omitempty"`
+	Updated   []string `json:"updated,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"` // Portal tasks whose ID is taken by a local-owned task
+	Deferred  []string `json:"deferred,omitempty"`  // Changed portal tasks skipped because they are running
+	Reported  int      `json:"reported"`
+}
+
+// SyncStatus describes the state of the portal sync
+type SyncStatus struct {
+	PortalURL             string      `json:"portal_url"`
+	AgentID               string      `json:"agent_id"`
+	Interval              string      `json:"interval"`
+	LastSync              time.Time   `json:"last_sync,omitempty"`
+	LastSuccess           time.Time   `json:"last_success,omitempty"`
+	LastError             string      `json:"last_error,omitempty"`
+	LastResult            *SyncResult `json:"last_result,omitempty"`
+	LastReportedExecution int64       `json:"last_reported_execution"`
+}
+
+// ExecutionReport is the body POSTed to the portal with finished executions
+// of portal-owned tasks
+type ExecutionReport struct {
+	AgentID    string           `json:"agent_id"`
+	Executions []*TaskExecution `json:"executions"`
+}
+
+// Syncer pulls task definitions from the portal, reconciles them with the
+// local scheduler and pushes execution results of portal-owned tasks back.
+// When the portal is unreachable the scheduler keeps running the last synced
+// definitions.
+type Syncer struct {
+	scheduler *Scheduler
+	portalURL string
+	token     string
+	agentID   string
+	interval  time.Duration
+	stateFile string
+	client    *http.Client
+	status    SyncStatus
+	mu        sync.Mutex // Serializes sync runs and guards status
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// SyncConfig represents portal sync configuration
+type SyncConfig struct {
+	PortalURL string
+	Token     string
+	AgentID   string
+	Interval  time.Duration
+	StateFile string
+	Timeout   time.Duration
+}
+
+// NewSyncer creates a portal sync client for sched. Call Start to begin
+// periodic syncing.
+func NewSyncer(sched *Scheduler, cfg *SyncConfig) (*Syncer, error) {
+	parsed, err := url.Parse(cfg.PortalURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid portal URL: %s", cfg.PortalURL)
+	}
+
+	if cfg.AgentID == "" {
+		return nil, fmt.Errorf("agent ID is required")
+	}
+
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "/var/lib/mingyue-agent/scheduler-sync.json"
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	s := &Syncer{
+		scheduler: sched,
+		portalURL: strings.TrimSuffix(cfg.PortalURL, "/"),
+		token:     cfg.Token,
+		agentID:   cfg.AgentID,
+		interval:  interval,
+		stateFile: stateFile,
+		client:    httpclient.New(timeout),
+		stopCh:    make(chan struct{}),
+	}
+
+	if err := s.loadState(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+
+	s.status.PortalURL = s.portalURL
+	s.status.AgentID = s.agentID
+	s.status.Interval = interval.String()
+
+	return s, nil
+}
+
+// Start syncs immediately and then every interval
+func (s *Syncer) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Stop stops periodic syncing
+func (s *Syncer) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+// Status returns the state of the last sync
+func (s *Syncer) Status() SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+// Sync pulls task definitions, reconciles them and reports finished
+// executions. Results are reported even when pulling definitions fails.
+func (s *Syncer) Sync(ctx context.Context) (*SyncResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := &SyncResult{}
+	var syncErr error
+
+	remote, err := s.fetchTasks(ctx)
+	if err != nil {
+		syncErr = err
+	} else {
+		s.reconcile(ctx, remote, result)
+	}
+
+	reported, err := s.reportExecutions(ctx)
+	result.Reported = reported
+	if err != nil && syncErr == nil {
+		syncErr = err
+	}
+
+	s.status.LastSync = time.Now()
+	s.status.LastResult = result
+	if syncErr != nil {
+		s.status.LastError = syncErr.Error()
+	} else {
+		s.status.LastError = ""
+		s.status.LastSuccess = s.status.LastSync
+	}
+
+	if err := s.saveState(); err != nil {
+		log.Printf("save scheduler sync state: %v", err)
+	}
+
+	return result, syncErr
+}
+
+func (s *Syncer) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+		if _, err := s.Sync(ctx); err != nil {
+			log.Printf("scheduler portal sync: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile applies the portal's task list to the scheduler. Only
+// portal-owned tasks are added, updated or removed.
+func (s *Syncer) reconcile(ctx context.Context, remote []*Task, result *SyncResult) {
+	local := make(map[string]*Task)
+	for _, task := range s.scheduler.ListTasks() {
+		local[task.ID] = task
+	}
+
+	seen := make(map[string]bool)
+	for _, task := range remote {
+		if task.ID == "" {
+			continue
+		}
+		seen[task.ID] = true
+
+		existing, exists := local[task.ID]
+		if !exists {
+			added := &Task{
+				ID:       task.ID,
+				Name:     task.Name,
+				Type:     task.Type,
+				Schedule: task.Schedule,
+				Params:   task.Params,
+				Enabled:  task.Enabled,
+				Source:   SourcePortal,
+			}
+			if err := s.scheduler.AddTask(ctx, added); err != nil {
+				log.Printf("scheduler portal sync: add task %s: %v", task.ID, err)
+				continue
+			}
+			result.Added = append(result.Added, task.ID)
+			continue
+		}
+
+		if existing.Source != SourcePortal {
+			result.Conflicts = append(result.Conflicts, task.ID)
+			continue
+		}
+
+		if !definitionChanged(existing, task) {
+			continue
+		}
+
+		// The running execution updates its task when it finishes, which
+		// would overwrite the new definition; apply it on the next sync
+		if existing.Status == "running" {
+			result.Deferred = append(result.Deferred, task.ID)
+			continue
+		}
+
+		updated := *existing
+		updated.Name = task.Name
+		updated.Type = task.Type
+		updated.Params = task.Params
+		updated.Enabled = task.Enabled
+		if updated.Schedule != task.Schedule {
+			updated.Schedule = task.Schedule
+			updated.NextRun = nil
+			if task.Schedule != "" {
+				nextRun := s.scheduler.nextRunAfter(&updated, time.Now())
+				updated.NextRun = &nextRun
+			}
+		}
+
+		if err := s.scheduler.UpdateTask(ctx, &updated); err != nil {
+			log.Printf("scheduler portal sync: update task %s: %v", task.ID, err)
+			continue
+		}
+		result.Updated = append(result.Updated, task.ID)
+	}
+
+	for id, task := range local {
+		if task.Source != SourcePortal || seen[id] {
+			continue
+		}
+		if err := s.scheduler.DeleteTask(ctx, id); err != nil {
+			log.Printf("scheduler portal sync: remove task %s: %v", id, err)
+			continue
+		}
+		result.Removed = append(result.Removed, id)
+	}
+}
+
+func definitionChanged(local, remote *Task) bool {
+	if local.Name != remote.Name || local.Type != remote.Type ||
+		local.Schedule != remote.Schedule || local.Enabled != remote.Enabled {
+		return true
+	}
+	if len(local.Params) == 0 && len(remote.Params) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(local.Params, remote.Params)
+}
+
+func (s *Syncer) fetchTasks(ctx context.Context) ([]*Task, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, "/tasks", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch portal tasks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch portal tasks: portal responded with status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Tasks []*Task `json:"tasks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode portal tasks: %w", err)
+	}
+
+	return body.Tasks, nil
+}
+
+// reportExecutions pushes finished executions of portal-owned tasks in
+// batches, advancing the cursor only after the portal accepts a batch
+func (s *Syncer) reportExecutions(ctx context.Context) (int, error) {
+	const batchSize = 100
+	reported := 0
+
+	for {
+		executions, err := s.scheduler.CompletedExecutionsAfter(ctx, s.status.LastReportedExecution, batchSize)
+		if err != nil {
+			return reported, fmt.Errorf("list executions: %w", err)
+		}
+		if len(executions) == 0 {
+			return reported, nil
+		}
+
+		var portalExecutions []*TaskExecution
+		for _, exec := range executions {
+			if task, err := s.scheduler.GetTask(exec.TaskID); err == nil && task.Source == SourcePortal {
+				portalExecutions = append(portalExecutions, exec)
+			}
+		}
+
+		if len(portalExecutions) > 0 {
+			if err := s.pushExecutions(ctx, portalExecutions); err != nil {
+				return reported, err
+			}
+			reported += len(portalExecutions)
+		}
+
+		s.status.LastReportedExecution = executions[len(executions)-1].ID
+		if len(executions) < batchSize {
+			return reported, nil
+		}
+	}
+}
+
+func (s *Syncer) pushExecutions(ctx context.Context, executions []*TaskExecution) error {
+	body, err := json.Marshal(ExecutionReport{
+		AgentID:    s.agentID,
+		Executions: executions,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal execution report: %w", err)
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPost, "/tasks/results", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("push execution results: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("push execution results: portal responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *Syncer) newRequest(ctx context.Context, method, path string, body *bytes.Reader) (*http.Request, error) {
+	endpoint := fmt.Sprintf("%s/api/v1/agents/%s%s", s.portalURL, url.PathEscape(s.agentID), path)
+
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequestWithContext(ctx, method, endpoint, body)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, endpoint, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", "mingyue-agent-scheduler")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	return req, nil
+}
+
+func (s *Syncer) saveState() error {
+	dir := filepath.Dir(s.stateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(s.status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := statefile.Write(s.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Syncer) loadState() error {
+	if err := statefile.Read(s.stateFile, &s.status); err != nil {
+		return err
+	}
+
+	return nil
+}
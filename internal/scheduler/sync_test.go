@@ -0,0 +1,156 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// testPortal serves a task list and records the executions reported to it
+type testPortal struct {
+	mu       sync.Mutex
+	tasks    []*Task
+	reported []*TaskExecution
+}
+
+func (p *testPortal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/api/v1/agents/nas/tasks":
+		json.NewEncoder(w).Encode(map[string]interface{}{"tasks": p.tasks})
+	case "/api/v1/agents/nas/tasks/results":
+		var report ExecutionReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.AgentID != "nas" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.reported = append(p.reported, report.Executions...)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestSyncer(t *testing.T, portal *testPortal) (*Scheduler, *Syncer) {
+	t.Helper()
+	dir := t.TempDir()
+	sched, err := New(Config{DBPath: filepath.Join(dir, "scheduler.db")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { sched.Stop(context.Background()) })
+	sched.RegisterHandler("noop", func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+
+	srv := httptest.NewServer(portal)
+	t.Cleanup(srv.Close)
+	syncer, err := NewSyncer(sched, &SyncConfig{PortalURL: srv.URL, AgentID: "nas", StateFile: filepath.Join(dir, "sync.json")})
+	if err != nil {
+		t.Fatalf("NewSyncer: %v", err)
+	}
+	return sched, syncer
+}
+
+func TestReconcile(t *testing.T) {
+	sched, syncer := newTestSyncer(t, &testPortal{})
+	ctx := context.Background()
+	for _, task := range []*Task{
+		{ID: "backup", Name: "Backup", Type: "noop"},
+		{ID: "index", Name: "Index", Type: "noop", Source: SourcePortal},
+		{ID: "scrub", Name: "Scrub", Type: "noop", Source: SourcePortal},
+		{ID: "old", Name: "Old", Type: "noop", Source: SourcePortal},
+		{ID: "busy", Name: "Busy", Type: "noop", Source: SourcePortal},
+	} {
+		if err := sched.AddTask(ctx, task); err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+	}
+	sched.setTask("busy", func(task *Task) { task.Status = "running" })
+
+	remote := []*Task{
+		{ID: "backup", Name: "Portal backup", Type: "noop"},
+		{ID: "index", Name: "Index", Type: "noop"},
+		{ID: "scrub", Name: "Monthly scrub", Type: "noop", Schedule: "@monthly", Params: map[string]interface{}{"pool": "tank"}},
+		{ID: "busy", Name: "Busy, renamed", Type: "noop"},
+		{ID: "sync", Name: "Sync", Type: "noop", Enabled: true},
+		{Name: "No ID", Type: "noop"},
+	}
+	result := &SyncResult{}
+	syncer.reconcile(ctx, remote, result)
+
+	expected := &SyncResult{
+		Added:     []string{"sync"},
+		Updated:   []string{"scrub"},
+		Removed:   []string{"old"},
+		Conflicts: []string{"backup"},
+		Deferred:  []string{"busy"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+
+	if task, _ := sched.GetTask("backup"); task.Name != "Backup" || task.Source != SourceLocal {
+		t.Errorf("expected the local task to be left alone, got %+v", task)
+	}
+	if task, _ := sched.GetTask("scrub"); task.Name != "Monthly scrub" || task.NextRun == nil || task.Params["pool"] != "tank" {
+		t.Errorf("expected the portal task to be updated and scheduled, got %+v", task)
+	}
+	if task, _ := sched.GetTask("sync"); task.Source != SourcePortal || !task.Enabled {
+		t.Errorf("expected an enabled portal task, got %+v", task)
+	}
+	if _, err := sched.GetTask("old"); err == nil {
+		t.Error("expected the portal task missing from the portal to be removed")
+	}
+	var ids []string
+	for _, task := range sched.ListTasks() {
+		ids = append(ids, task.ID)
+	}
+	sort.Strings(ids)
+	if want := []string{"backup", "busy", "index", "scrub", "sync"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected tasks %v, got %v", want, ids)
+	}
+}
+
+func TestSyncReportsPortalExecutions(t *testing.T) {
+	portal := &testPortal{tasks: []*Task{{ID: "index", Name: "Index", Type: "noop"}}}
+	sched, syncer := newTestSyncer(t, portal)
+	ctx := context.Background()
+
+	if result, err := syncer.Sync(ctx); err != nil || !reflect.DeepEqual(result.Added, []string{"index"}) {
+		t.Fatalf("expected the portal task to be added, got %+v, %v", result, err)
+	}
+	if err := sched.AddTask(ctx, &Task{ID: "local", Name: "Local", Type: "noop"}); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	for _, id := range []string{"index", "local", "index"} {
+		if _, err := sched.ExecuteTask(ctx, id); err != nil {
+			t.Fatalf("ExecuteTask %s: %v", id, err)
+		}
+	}
+
+	result, err := syncer.Sync(ctx)
+	if err != nil || result.Reported != 2 {
+		t.Fatalf("expected 2 executions reported, got %+v, %v", result, err)
+	}
+	for _, exec := range portal.reported {
+		if exec.TaskID != "index" || exec.Status != "success" {
+			t.Errorf("unexpected execution reported: %+v", exec)
+		}
+	}
+
+	// The cursor moved past everything reported
+	if result, err := syncer.Sync(ctx); err != nil || result.Reported != 0 {
+		t.Fatalf("expected nothing left to report, got %+v, %v", result, err)
+	}
+	if status := syncer.Status(); status.LastError != "" || status.LastReportedExecution == 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResourceUsage is what a task execution consumed. Handlers run inside the
+// agent process, so CPU time and IO are the agent's, including commands it
+// ran and waited for, while the task ran; when other tasks ran at the same
+// time, Shared is set and the figures include their usage too.
+type ResourceUsage struct {
+	WallSeconds  float64 `json:"wall_seconds"`
+	UserCPU      float64 `json:"user_cpu_seconds"`
+	SystemCPU    float64 `json:"system_cpu_seconds"`
+	PeakRSSBytes int64   `json:"peak_rss_bytes,omitempty"`
+	ReadBytes    int64   `json:"read_bytes"`  // Read from storage
+	WriteBytes   int64   `json:"write_bytes"` // Written to storage
+	Shared       bool    `json:"shared,omitempty"`
+	Unsupported  bool    `json:"unsupported,omitempty"` // Only wall time is measured on this platform
+}
+
+// usageSampleInterval is how often the resident set size is sampled for the
+// peak of a running task
+const usageSampleInterval = time.Second
+
+// executions counts task executions started and running, so measurements
+// overlapping others can be marked shared
+type executions struct {
+	started atomic.Int64
+	running atomic.Int64
+}
+
+// usageMeter measures one execution
+type usageMeter struct {
+	counters  *executions
+	start     time.Time
+	startedAt int64 // executions.started when this one started
+	shared    bool
+	before    processCounters
+
+	peak atomic.Int64
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// processCounters are cumulative counters of the agent process
+type processCounters struct {
+	userCPU, systemCPU    time.Duration
+	readBytes, writeBytes int64
+	childMaxRSS           int64 // Largest resident set of a finished child
+}
+
+func (e *executions) startMeter() *usageMeter {
+	m := &usageMeter{
+		counters:  e,
+		start:     time.Now(),
+		startedAt: e.started.Add(1),
+		shared:    e.running.Add(1) > 1,
+		before:    readProcessCounters(),
+		stop:      make(chan struct{}),
+	}
+	m.peak.Store(readRSS())
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(usageSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.sample()
+			}
+		}
+	}()
+	return m
+}
+
+func (m *usageMeter) sample() {
+	rss := readRSS()
+	for {
+		peak := m.peak.Load()
+		if rss <= peak || m.peak.CompareAndSwap(peak, rss) {
+			return
+		}
+	}
+}
+
+// finish stops measuring and returns the usage
+func (m *usageMeter) finish() *ResourceUsage {
+	close(m.stop)
+	m.wg.Wait()
+	m.sample()
+	after := readProcessCounters()
+	m.counters.running.Add(-1)
+
+	usage := &ResourceUsage{
+		WallSeconds:  time.Since(m.start).Seconds(),
+		UserCPU:      (after.userCPU - m.before.userCPU).Seconds(),
+		SystemCPU:    (after.systemCPU - m.before.systemCPU).Seconds(),
+		PeakRSSBytes: m.peak.Load(),
+		ReadBytes:    after.readBytes - m.before.readBytes,
+		WriteBytes:   after.writeBytes - m.before.writeBytes,
+		Shared:       m.shared || m.counters.started.Load() != m.startedAt,
+		Unsupported:  !usageSupported,
+	}
+	// A command started by the task may have needed more memory than the
+	// agent itself
+	if after.childMaxRSS > m.before.childMaxRSS && after.childMaxRSS > usage.PeakRSSBytes {
+		usage.PeakRSSBytes = after.childMaxRSS
+	}
+	return usage
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package scheduler
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usageSupported = true
+
+func readProcessCounters() processCounters {
+	var c processCounters
+	var self, children syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &self) == nil && syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children) == nil {
+		c.userCPU = time.Duration(self.Utime.Nano() + children.Utime.Nano())
+		c.systemCPU = time.Duration(self.Stime.Nano() + children.Stime.Nano())
+		c.childMaxRSS = children.Maxrss << 10 // KiB
+	}
+
+	// Includes the IO of children that have been waited for
+	fields := procFields("/proc/self/io")
+	c.readBytes = fields["read_bytes"]
+	c.writeBytes = fields["write_bytes"]
+	return c
+}
+
+// readRSS returns the resident set size of the agent in bytes
+func readRSS() int64 {
+	return procFields("/proc/self/status")["VmRSS"] << 10
+}
+
+// procFields parses "name: value" lines of a /proc file, ignoring units
+func procFields(path string) map[string]int64 {
+	fields := map[string]int64{}
+	f, err := os.Open(path)
+	if err != nil {
+		return fields
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		number, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if n, err := strconv.ParseInt(number, 10, 64); err == nil {
+			fields[name] = n
+		}
+	}
+	return fields
+}
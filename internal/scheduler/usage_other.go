@@ -0,0 +1,9 @@
+//go:build !linux
+
+package scheduler
+
+const usageSupported = false
+
+func readProcessCounters() processCounters { return processCounters{} }
+
+func readRSS() int64 { return 0 }
@@ -1,79 +1,785 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
 
 	_ "github.com/KOPElan/mingyue-agent/docs"
+	"github.com/KOPElan/mingyue-agent/internal/advisor"
+	"github.com/KOPElan/mingyue-agent/internal/alerts"
 	"github.com/KOPElan/mingyue-agent/internal/api"
 	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/bundle"
+	"github.com/KOPElan/mingyue-agent/internal/cluster"
 	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/configrepo"
+	"github.com/KOPElan/mingyue-agent/internal/crashreport"
+	"github.com/KOPElan/mingyue-agent/internal/credcrypt"
 	"github.com/KOPElan/mingyue-agent/internal/diskmanager"
+	"github.com/KOPElan/mingyue-agent/internal/events"
 	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+	"github.com/KOPElan/mingyue-agent/internal/indexer"
+	"github.com/KOPElan/mingyue-agent/internal/jobs"
+	"github.com/KOPElan/mingyue-agent/internal/maintenance"
 	"github.com/KOPElan/mingyue-agent/internal/monitor"
+	"github.com/KOPElan/mingyue-agent/internal/mqtt"
 	"github.com/KOPElan/mingyue-agent/internal/netdisk"
 	"github.com/KOPElan/mingyue-agent/internal/netmanager"
+	"github.com/KOPElan/mingyue-agent/internal/plugins"
+	"github.com/KOPElan/mingyue-agent/internal/portmap"
+	"github.com/KOPElan/mingyue-agent/internal/reporter"
+	"github.com/KOPElan/mingyue-agent/internal/reports"
+	"github.com/KOPElan/mingyue-agent/internal/rsyncd"
+	"github.com/KOPElan/mingyue-agent/internal/rules"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/sftpd"
 	"github.com/KOPElan/mingyue-agent/internal/sharemanager"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
+	"github.com/KOPElan/mingyue-agent/internal/thumbnail"
+	"github.com/KOPElan/mingyue-agent/internal/wanprobe"
+	"github.com/KOPElan/mingyue-agent/internal/watcher"
+	"github.com/KOPElan/mingyue-agent/internal/webhook"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
+// Handler serves the API. Stop ends the background workers started with
+// it.
+type Handler struct {
+	http.Handler
+	stops []func()
+}
+
+// Stop ends the background workers, last started first
+func (h *Handler) Stop() {
+	for i := len(h.stops) - 1; i >= 0; i-- {
+		h.stops[i]()
+	}
+	h.stops = nil
+}
+
 // NewHTTPMux builds the HTTP handlers for the API server.
-func NewHTTPMux(cfg *config.Config, auditLogger *audit.Logger) (*http.ServeMux, error) {
+func NewHTTPMux(cfg *config.Config, auditLogger *audit.Logger) (*Handler, error) {
+	var stops []func()
+	// Shared by audit pushes, webhooks, portal sync and other outbound
+	// requests
+	err := httpclient.Configure(httpclient.Options{
+		MaxIdleConns:        cfg.Outbound.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.Outbound.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(cfg.Outbound.IdleConnTimeoutSec) * time.Second,
+		KeepAlive:           time.Duration(cfg.Outbound.KeepAliveSec) * time.Second,
+		DialTimeout:         time.Duration(cfg.Outbound.DialTimeoutSec) * time.Second,
+		TLSHandshakeTimeout: time.Duration(cfg.Outbound.TLSHandshakeTimeoutSec) * time.Second,
+		CAFile:              cfg.Outbound.CAFile,
+		Pins:                cfg.Outbound.Pins,
+		Proxy:               cfg.Outbound.Proxy,
+		NoProxy:             cfg.Outbound.NoProxy,
+		Offline:             cfg.Outbound.Offline,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("configure outbound http: %w", err)
+	}
+
 	mux := http.NewServeMux()
 	api.RegisterHTTPHandlers(mux, auditLogger, cfg)
 
+	// Request tracing; per-endpoint metrics are always collected
+	if cfg.Telemetry.Tracing {
+		err := telemetry.Setup(&telemetry.Config{
+			ServiceName:   cfg.Telemetry.ServiceName,
+			Endpoint:      cfg.Telemetry.OTLPEndpoint,
+			Headers:       cfg.Telemetry.OTLPHeaders,
+			SampleRatio:   cfg.Telemetry.SampleRatio,
+			SlowThreshold: time.Duration(cfg.Telemetry.SlowRequestMs) * time.Millisecond,
+			SlowKeep:      cfg.Telemetry.SlowKeep,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("set up tracing: %w", err)
+		}
+	}
+
+	// Event bus shared by managers, the event stream and the MQTT bridge
+	eventBus := events.NewBus(1000)
+	eventBus.AttachAudit(auditLogger)
+
+	// Background jobs for slow operations such as network mounts
+	jobMgr := jobs.New(&jobs.Config{Bus: eventBus})
+	jobAPI := api.NewJobHandlers(jobMgr)
+	jobAPI.Register(mux)
+
+	// Agent-wide maintenance switch
+	maintenanceMode, err := maintenance.New(&maintenance.Config{
+		StateFile: cfg.Security.MaintenanceFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create maintenance mode: %w", err)
+	}
+	maintenanceMode.SetEventBus(eventBus)
+	maintenanceAPI := api.NewMaintenanceHandlers(maintenanceMode, auditLogger)
+	maintenanceAPI.Register(mux)
+
+	// Reports only; the daemon installs the crash output before serving
+	api.NewCrashHandlers(crashreport.New(&crashreport.Config{
+		Dir:  cfg.Crash.Dir,
+		Keep: cfg.Crash.Keep,
+	}), auditLogger).Register(mux)
+
+	// History of generated configuration files; without git, changes are
+	// applied but not recorded
+	var history *configrepo.Repo
+	if cfg.History.Dir != "" {
+		history, err = configrepo.New(&configrepo.Config{Dir: cfg.History.Dir})
+		if err != nil {
+			log.Printf("warning: configuration changes will not be recorded: %v", err)
+		}
+	}
+	api.NewConfigHistoryHandlers(history, auditLogger).Register(mux)
+
 	// Swagger UI
 	mux.Handle("/swagger/", httpSwagger.WrapHandler)
 
+	// Monitor and disk managers are stateless; the MQTT reporter uses them
+	// even when their routes are disabled
 	mon := monitor.New()
-	monitorAPI := api.NewMonitorAPI(mon, auditLogger)
-	monitorAPI.Register(mux)
+	if cfg.Features.Monitor {
+		monitorAPI := api.NewMonitorAPI(mon, auditLogger)
+		monitorAPI.Register(mux)
+		api.NewTelemetryHandlers().Register(mux)
+	}
 
-	fileMgr := filemanager.New(cfg.Security.AllowedPaths, auditLogger)
-	fileAPI := api.NewFileAPI(fileMgr, auditLogger, cfg.Security.MaxUploadSize)
-	fileAPI.Register(mux)
+	// Watches directories for the live file browser and file rules;
+	// inotify is only available on Linux
+	var fileWatcher *watcher.Watcher
+	var watcherErr error
+	ignored := ignore.New(cfg.Ignore.Patterns)
+	if cfg.Features.Files || cfg.Features.Rules {
+		fileWatcher, watcherErr = watcher.New(watcher.Config{
+			Exclude: []string{filemanager.TrashDirName, filemanager.VersionsDirName},
+			Ignore:  ignored,
+		}, eventBus)
+	}
+
+	var fileMgr *filemanager.Manager
+	var wopiAPI *api.WOPIHandlers
+	if cfg.Features.Files {
+		allowedPaths := cfg.Security.AllowedPaths
+		if cfg.Features.Reports {
+			allowedPaths = append(slices.Clone(allowedPaths), cfg.Reports.Dir)
+		}
+		fileMgr = filemanager.New(allowedPaths, auditLogger)
+		fileMgr.SetFollowEscapingSymlinks(cfg.Security.FollowSymlinks)
+		fileMgr.SetIgnore(ignored)
+		uploadPolicies, err := filemanager.NewPolicyStore(cfg.Security.UploadPolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("create upload policy store: %w", err)
+		}
+		fileMgr.SetPolicyStore(uploadPolicies)
+		fileMgr.SetUsageCache(time.Duration(cfg.Cache.UsageTTLSec) * time.Second)
+		if err := fileMgr.SetUploadSessions(cfg.Security.UploadSessionDir, time.Duration(cfg.Security.UploadSessionTTL)*time.Hour); err != nil {
+			return nil, err
+		}
+		if cfg.Security.TrashDir != "" {
+			if err := fileMgr.SetTrash(cfg.Security.TrashDir, time.Duration(cfg.Security.TrashRetention)*24*time.Hour); err != nil {
+				return nil, err
+			}
+		}
+		if len(cfg.Quota.Users) > 0 || len(cfg.Quota.Dirs) > 0 {
+			quotas := &filemanager.QuotaConfig{
+				StateFile: cfg.Quota.StateFile,
+				Grace:     time.Duration(cfg.Quota.GraceHours) * time.Hour,
+				Rescan:    time.Duration(cfg.Quota.RescanSec) * time.Second,
+			}
+			for _, limit := range cfg.Quota.Users {
+				quotas.Users = append(quotas.Users, filemanager.QuotaLimit{Subject: limit.Name, Soft: limit.Soft, Hard: limit.Hard, Grace: time.Duration(limit.GraceHours) * time.Hour})
+			}
+			for _, limit := range cfg.Quota.Dirs {
+				quotas.Dirs = append(quotas.Dirs, filemanager.QuotaLimit{Subject: limit.Name, Soft: limit.Soft, Hard: limit.Hard, Grace: time.Duration(limit.GraceHours) * time.Hour})
+			}
+			if err := fileMgr.SetQuotas(quotas); err != nil {
+				return nil, fmt.Errorf("set quotas: %w", err)
+			}
+		}
+		if len(cfg.Versions.Dirs) > 0 {
+			var dirs []filemanager.VersionDir
+			for _, dir := range cfg.Versions.Dirs {
+				dirs = append(dirs, filemanager.VersionDir{Path: dir.Path, Keep: dir.Keep})
+			}
+			fileMgr.SetVersioning(dirs)
+		}
+		if cfg.Scan.Enabled {
+			scanner := filemanager.NewClamdScanner(cfg.Scan.ClamdSocket, time.Duration(cfg.Scan.TimeoutSec)*time.Second, int64(cfg.Scan.MaxFileSizeMB)<<20)
+			if err := fileMgr.SetScanner(scanner, cfg.Scan.QuarantineDir); err != nil {
+				return nil, err
+			}
+		}
+		fileAPI := api.NewFileAPI(fileMgr, auditLogger, cfg.Security.MaxUploadSize)
+		if err := fileAPI.SetTransferLimits(api.TransferLimits{
+			Client:   api.RateLimits{DownloadKBps: cfg.Security.DownloadRateKBps, UploadKBps: cfg.Security.UploadRateKBps},
+			Transfer: api.RateLimits{DownloadKBps: cfg.Security.TransferDownKBps, UploadKBps: cfg.Security.TransferUpKBps},
+			Global:   api.RateLimits{DownloadKBps: cfg.Security.GlobalDownKBps, UploadKBps: cfg.Security.GlobalUpKBps},
+		}); err != nil {
+			return nil, fmt.Errorf("set transfer limits: %w", err)
+		}
+		fileAPI.SetJobs(jobMgr)
+		if fileWatcher != nil {
+			fileMgr.SetWatcher(fileWatcher)
+			fileAPI.SetEventBus(eventBus)
+		} else {
+			log.Printf("warning: live file watches are disabled: %v", watcherErr)
+		}
+		fileAPI.Register(mux)
+		wopiAPI = api.NewWOPIHandlers(fileMgr, cfg.Security.MaxUploadSize)
+		wopiAPI.Register(mux)
+		if cfg.Features.WebDAV {
+			api.NewWebDAVHandlers(fileMgr, cfg.Security.MaxUploadSize).Register(mux)
+		}
+	}
 
 	diskMgr := diskmanager.New(cfg.Security.AllowedPaths)
-	diskAPI := api.NewDiskHandlers(diskMgr, auditLogger)
-	diskAPI.Register(mux)
+	diskMgr.SetCacheTTL(time.Duration(cfg.Cache.DiskTTLSec)*time.Second, time.Duration(cfg.Cache.SMARTTTLSec)*time.Second)
+	// Without an encryption key, LUKS keys are not remembered
+	credentials, _ := credcrypt.New(cfg.NetDisk.EncryptionKey)
+	diskMgr.SetLUKSKeys(credentials, cfg.Disk.KeyfileDir, cfg.Disk.LUKSKeysFile)
+	if cfg.Features.Disks {
+		diskAPI := api.NewDiskHandlers(diskMgr, auditLogger)
+		diskAPI.Register(mux)
+	}
 
 	// Network disk management
-	netDiskMgr, err := netdisk.New(&netdisk.Config{
-		AllowedHosts:       cfg.NetDisk.AllowedHosts,
-		AllowedMountPoints: cfg.NetDisk.AllowedMountPoints,
-		EncryptionKey:      cfg.NetDisk.EncryptionKey,
-		StateFile:          cfg.NetDisk.StateFile,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("create network disk manager: %w", err)
+	var netDiskMgr *netdisk.Manager
+	if cfg.Features.NetDisk {
+		var err error
+		netDiskMgr, err = netdisk.New(&netdisk.Config{
+			AllowedHosts:       cfg.NetDisk.AllowedHosts,
+			AllowedMountPoints: cfg.NetDisk.AllowedMountPoints,
+			EncryptionKey:      cfg.NetDisk.EncryptionKey,
+			StateFile:          cfg.NetDisk.StateFile,
+			MonitorInterval:    time.Duration(cfg.NetDisk.MonitorIntervalSec) * time.Second,
+			MountTimeout:       time.Duration(cfg.NetDisk.MountTimeoutSec) * time.Second,
+			CheckTimeout:       time.Duration(cfg.NetDisk.CheckTimeoutSec) * time.Second,
+			CheckWorkers:       cfg.Resources.MaxWorkers,
+			DeleteGrace:        time.Duration(cfg.NetDisk.DeleteGraceHours) * time.Hour,
+			Namespace:          cfg.NetDisk.Namespace,
+			NamespaceDir:       cfg.NetDisk.NamespaceDir,
+			IdleTimeout:        time.Duration(cfg.NetDisk.IdleTimeoutMin) * time.Minute,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create network disk manager: %w", err)
+		}
+		netDiskMgr.SetEventBus(eventBus)
+		if fileMgr != nil {
+			fileMgr.SetOnDemandMount(netDiskMgr.Access)
+		}
+		netDiskAPI := api.NewNetDiskHandlers(netDiskMgr, auditLogger)
+		netDiskAPI.SetJobs(jobMgr)
+		netDiskAPI.Register(mux)
 	}
-	netDiskAPI := api.NewNetDiskHandlers(netDiskMgr, auditLogger)
-	netDiskAPI.Register(mux)
 
 	// Network management
-	netMgr, err := netmanager.New(&netmanager.Config{
-		ManagementInterface: cfg.Network.ManagementInterface,
-		HistoryFile:         cfg.Network.HistoryFile,
+	var netMgr *netmanager.Manager
+	if cfg.Features.Network {
+		var err error
+		netMgr, err = netmanager.New(&netmanager.Config{
+			ManagementInterface: cfg.Network.ManagementInterface,
+			HistoryDB:           cfg.Network.HistoryDB,
+			HistoryFile:         cfg.Network.HistoryFile,
+			HistoryMaxEntries:   cfg.Network.HistoryMaxEntries,
+			HistoryMaxAge:       time.Duration(cfg.Network.HistoryRetentionDays) * 24 * time.Hour,
+			CacheSizeKB:         cfg.Resources.SQLiteCacheKB,
+			CacheTTL:            time.Duration(cfg.Cache.NetworkTTLSec) * time.Second,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create network manager: %w", err)
+		}
+		if err := netMgr.SetConfigRepo(context.Background(), history); err != nil {
+			log.Printf("warning: record network configuration: %v", err)
+		}
+		netMgrAPI := api.NewNetManagerHandlers(netMgr, auditLogger)
+		netMgrAPI.Register(mux)
+	}
+
+	// Router port mappings
+	if cfg.Features.PortMap {
+		portMapper, err := portmap.New(&portmap.Config{
+			StateFile: cfg.PortMap.StateFile,
+			Method:    cfg.PortMap.Method,
+			Gateway:   cfg.PortMap.Gateway,
+			Lease:     time.Duration(cfg.PortMap.LeaseSec) * time.Second,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create port mapper: %w", err)
+		}
+		portMapper.SetEventBus(eventBus)
+		api.NewPortMapHandlers(portMapper, auditLogger).Register(mux)
+	}
+
+	// Share management
+	var shareMgr *sharemanager.Manager
+	if cfg.Features.ShareMgr {
+		var err error
+		shareMgr, err = sharemanager.New(&sharemanager.Config{
+			AllowedPaths:   cfg.ShareMgr.AllowedPaths,
+			SambaConfig:    cfg.ShareMgr.SambaConfig,
+			NFSConfig:      cfg.ShareMgr.NFSConfig,
+			StateFile:      cfg.ShareMgr.StateFile,
+			TemplateDir:    cfg.ShareMgr.TemplateDir,
+			AuditEnabled:   cfg.ShareMgr.SambaAudit,
+			AuditFacility:  cfg.ShareMgr.SambaAuditFacility,
+			StatsFile:      cfg.ShareMgr.StatsFile,
+			StatsRetention: time.Duration(cfg.ShareMgr.StatsRetentionDays) * 24 * time.Hour,
+			CheckTimeout:   time.Duration(cfg.ShareMgr.CheckTimeoutSec) * time.Second,
+			CheckWorkers:   cfg.Resources.MaxWorkers,
+			DeleteGrace:    time.Duration(cfg.ShareMgr.DeleteGraceHours) * time.Hour,
+			DLNA: sharemanager.DLNAConfig{
+				ConfigFile:   cfg.ShareMgr.DLNAConfig,
+				FriendlyName: cfg.ShareMgr.DLNAFriendlyName,
+				Port:         cfg.ShareMgr.DLNAPort,
+				DBDir:        cfg.ShareMgr.DLNADBDir,
+				ServiceName:  cfg.ShareMgr.DLNAService,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create share manager: %w", err)
+		}
+		shareMgr.SetEventBus(eventBus)
+		if err := shareMgr.SetConfigRepo(context.Background(), history); err != nil {
+			log.Printf("warning: record share configuration: %v", err)
+		}
+		shareAPI := api.NewShareHandlers(shareMgr, auditLogger)
+		shareAPI.Register(mux)
+	}
+
+	// rsync daemon modules
+	if cfg.Features.Rsync {
+		rsyncMgr, err := rsyncd.New(&rsyncd.Config{
+			ConfigFile:   cfg.Rsync.ConfigFile,
+			SecretsFile:  cfg.Rsync.SecretsFile,
+			StateFile:    cfg.Rsync.StateFile,
+			ServiceName:  cfg.Rsync.ServiceName,
+			AllowedPaths: cfg.ShareMgr.AllowedPaths,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create rsync manager: %w", err)
+		}
+		if err := rsyncMgr.SetConfigRepo(context.Background(), history); err != nil {
+			log.Printf("warning: record rsync configuration: %v", err)
+		}
+		api.NewRsyncHandlers(rsyncMgr, auditLogger).Register(mux)
+	}
+
+	// File indexing and thumbnails
+	var idx *indexer.Indexer
+	var thumb *thumbnail.Generator
+	if cfg.Features.Indexer {
+		var err error
+		idx, err = indexer.New(&indexer.Config{
+			DBPath:      cfg.Indexer.DBPath,
+			CacheSizeKB: cfg.Resources.SQLiteCacheKB,
+			SkipHashes:  !cfg.Indexer.HashFiles,
+			Ignore:      ignored,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create indexer: %w", err)
+		}
+		if enrich := cfg.Indexer.Enrich; enrich.URL != "" {
+			idx.AddEnricher(indexer.NewHTTPEnricher(enrich.URL, enrich.Token,
+				time.Duration(enrich.TimeoutSec)*time.Second, int64(enrich.MaxSizeMB)<<20))
+		}
+		thumb, err = thumbnail.New(thumbnail.Config{
+			CacheDir: cfg.Indexer.ThumbnailDir,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create thumbnail generator: %w", err)
+		}
+		indexerAPI := api.NewIndexerHandlers(idx, thumb, auditLogger)
+		if fileMgr != nil {
+			indexerAPI.SetFileManager(fileMgr)
+			fileMgr.SetScanRecorder(func(ctx context.Context, path string, result *filemanager.ScanResult) {
+				if err := idx.RecordScan(ctx, path, result.Engine, result.Verdict); err != nil {
+					log.Printf("warning: record scan of %s: %v", path, err)
+				}
+			})
+		}
+		indexerAPI.Register(mux)
+	}
+
+	// Security advisor; checks for disabled subsystems are skipped
+	if cfg.Features.Advisor {
+		securityAdvisor := advisor.New(&advisor.Config{
+			Agent:        cfg,
+			Shares:       shareMgr,
+			Network:      netMgr,
+			WANInterface: cfg.Network.WANInterface,
+		})
+		advisorAPI := api.NewAdvisorHandlers(securityAdvisor, auditLogger)
+		advisorAPI.Register(mux)
+	}
+
+	auditAPI := api.NewAuditHandlers(auditLogger)
+	auditAPI.Register(mux)
+
+	// Event stream
+	if cfg.Features.Events {
+		eventAPI := api.NewEventHandlers(eventBus)
+		eventAPI.Register(mux)
+	}
+
+	// Audit event webhooks
+	if cfg.Features.Webhooks {
+		webhookMgr, err := webhook.New(&webhook.Config{
+			StateFile: cfg.Audit.WebhookFile,
+			Workers:   cfg.Resources.MaxWorkers,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create webhook manager: %w", err)
+		}
+		webhookMgr.Attach(auditLogger)
+		stops = append(stops, webhookMgr.Stop)
+		webhookAPI := api.NewWebhookHandlers(webhookMgr, auditLogger)
+		webhookAPI.Register(mux)
+	}
+
+	// Task scheduler, optionally synced with the portal
+	var sched *scheduler.Scheduler
+	var schedulerAPI *api.SchedulerHandlers
+	if cfg.Features.Scheduler {
+		var err error
+		sched, err = scheduler.New(scheduler.Config{
+			DBPath:        cfg.Scheduler.DBPath,
+			CacheSizeKB:   cfg.Resources.SQLiteCacheKB,
+			MaxConcurrent: cfg.Resources.MaxWorkers,
+			Blackouts:     schedulerBlackouts(cfg.Scheduler.Blackouts),
+			StallTimeout:  time.Duration(cfg.Scheduler.StallTimeoutSec) * time.Second,
+			CancelStalled: cfg.Scheduler.CancelStalled,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create scheduler: %w", err)
+		}
+		sched.SetBus(eventBus)
+		if err := sched.Start(context.Background()); err != nil {
+			return nil, fmt.Errorf("start scheduler: %w", err)
+		}
+		schedulerAPI = api.NewSchedulerHandlers(sched, auditLogger)
+		if cfg.Scheduler.PortalURL != "" {
+			agentID := cfg.Scheduler.AgentID
+			if agentID == "" {
+				agentID, _ = os.Hostname()
+			}
+
+			syncer, err := scheduler.NewSyncer(sched, &scheduler.SyncConfig{
+				PortalURL: cfg.Scheduler.PortalURL,
+				Token:     cfg.Scheduler.PortalToken,
+				AgentID:   agentID,
+				Interval:  time.Duration(cfg.Scheduler.SyncIntervalSec) * time.Second,
+				StateFile: cfg.Scheduler.SyncStateFile,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("create scheduler sync: %w", err)
+			}
+			syncer.Start()
+			schedulerAPI.SetSyncer(syncer)
+		}
+		schedulerAPI.Register(mux)
+
+		if fileMgr != nil {
+			sched.RegisterHandler(filemanager.CopyTaskType, fileMgr.CopyTaskHandler())
+			sched.RegisterHandler(filemanager.MoveTaskType, fileMgr.MoveTaskHandler())
+		}
+		if idx != nil {
+			sched.RegisterHandler(indexer.TaskType, idx.TaskHandler())
+			sched.RegisterHandler(indexer.EnrichTaskType, idx.EnrichTaskHandler())
+			sched.RegisterHandler(thumbnail.TaskType, thumb.TaskHandler())
+		}
+	}
+
+	// External plugin processes
+	var pluginDefs []plugins.Definition
+	for _, entry := range cfg.Plugins.Entries {
+		if entry.Enabled {
+			pluginDefs = append(pluginDefs, plugins.Definition{
+				Name:    entry.Name,
+				Command: entry.Command,
+				Args:    entry.Args,
+				Env:     entry.Env,
+			})
+		}
+	}
+	pluginMgr, err := plugins.New(&plugins.Config{
+		SocketDir: cfg.Plugins.SocketDir,
+		Plugins:   pluginDefs,
+		Bus:       eventBus,
+		Scheduler: sched,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("create network manager: %w", err)
+		return nil, fmt.Errorf("create plugin manager: %w", err)
+	}
+	if err := pluginMgr.Start(); err != nil {
+		return nil, fmt.Errorf("start plugins: %w", err)
 	}
-	netMgrAPI := api.NewNetManagerHandlers(netMgr, auditLogger)
-	netMgrAPI.Register(mux)
+	pluginAPI := api.NewPluginHandlers(pluginMgr, auditLogger)
+	pluginAPI.Register(mux)
 
-	// Share management
-	shareMgr, err := sharemanager.New(&sharemanager.Config{
-		AllowedPaths: cfg.ShareMgr.AllowedPaths,
-		SambaConfig:  cfg.ShareMgr.SambaConfig,
-		NFSConfig:    cfg.ShareMgr.NFSConfig,
-		BackupDir:    cfg.ShareMgr.BackupDir,
-		StateFile:    cfg.ShareMgr.StateFile,
+	// Sibling agent discovery and gateway proxying
+	if cfg.Cluster.Advertise || cfg.Cluster.Gateway {
+		hostname, _ := os.Hostname()
+		agentID := cfg.Cluster.AgentID
+		if agentID == "" {
+			agentID = hostname
+		}
+
+		clusterMgr, err := cluster.New(&cluster.Config{
+			AgentID:           agentID,
+			Hostname:          hostname,
+			Port:              cfg.Server.HTTPPort,
+			TLS:               cfg.API.TLSCert != "" && cfg.API.TLSKey != "",
+			Advertise:         cfg.Cluster.Advertise && cfg.API.EnableHTTP,
+			Gateway:           cfg.Cluster.Gateway,
+			StaticPeers:       cfg.Cluster.StaticPeers,
+			DiscoveryInterval: time.Duration(cfg.Cluster.DiscoveryIntervalSec) * time.Second,
+			PeerToken:         cfg.Cluster.PeerToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create cluster manager: %w", err)
+		}
+		if err := clusterMgr.Start(); err != nil {
+			return nil, fmt.Errorf("start cluster manager: %w", err)
+		}
+		clusterAPI := api.NewClusterHandlers(clusterMgr, auditLogger)
+		clusterAPI.Register(mux)
+	}
+
+	// Authentication and brute-force protection
+	authMgr, err := auth.New(auth.Config{
+		DBPath:        cfg.Security.AuthDB,
+		DBKeyFile:     cfg.Security.AuthDBKeyFile,
+		RequireAuth:   cfg.Security.TokenAuth,
+		EnableMTLS:    cfg.Security.EnableMTLS,
+		MaxFailures:   cfg.Security.BanMaxFailures,
+		FailureWindow: time.Duration(cfg.Security.BanWindowMin) * time.Minute,
+		BanDuration:   time.Duration(cfg.Security.BanDurationMin) * time.Minute,
+		SessionExpiry: time.Duration(cfg.Security.SessionExpiryMin) * time.Minute,
+		RefreshExpiry: time.Duration(cfg.Security.RefreshExpiryDays) * 24 * time.Hour,
+		CacheSizeKB:   cfg.Resources.SQLiteCacheKB,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("create share manager: %w", err)
+		return nil, fmt.Errorf("create auth manager: %w", err)
+	}
+	authAPI := api.NewAuthHandlers(authMgr, auditLogger)
+	authAPI.Register(mux)
+	if schedulerAPI != nil {
+		// Unknown hook tokens count as failed authentications
+		schedulerAPI.SetAuth(authMgr)
+	}
+	if wopiAPI != nil {
+		// As are invalid WOPI access tokens
+		wopiAPI.SetAuth(authMgr)
+	}
+
+	// SFTP server for the allowed paths, logging in with API credentials
+	if cfg.SFTP.Enabled && fileMgr != nil {
+		maxSize := cfg.SFTP.MaxUploadSize
+		if maxSize == 0 {
+			maxSize = cfg.Security.MaxUploadSize
+		}
+		sftpServer, err := sftpd.New(sftpd.Config{
+			Addr:        net.JoinHostPort(cfg.SFTP.ListenAddr, strconv.Itoa(cfg.SFTP.Port)),
+			HostKeyPath: cfg.SFTP.HostKey,
+			Files:       fileMgr,
+			Auth:        authMgr,
+			Maintenance: maintenanceMode,
+			MaxFileSize: maxSize,
+			Audit:       auditLogger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create sftp server: %w", err)
+		}
+		if err := sftpServer.Listen(); err != nil {
+			return nil, fmt.Errorf("start sftp server: %w", err)
+		}
+		go func() {
+			if err := sftpServer.Serve(); err != nil {
+				fmt.Printf("SFTP server error: %v\n", err)
+			}
+		}()
+	}
+
+	// Alert center, fed by health events on the bus
+	var alertMgr *alerts.Manager
+	if cfg.Features.Alerts {
+		alertMgr, err = alerts.New(&alerts.Config{
+			StateFile:      cfg.Alerts.StateFile,
+			LowDiskPercent: cfg.Alerts.LowDiskPercent,
+			Retention:      time.Duration(cfg.Alerts.RetentionDays) * 24 * time.Hour,
+			Bus:            eventBus,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create alert manager: %w", err)
+		}
+		alertMgr.Start()
+		stops = append(stops, alertMgr.Stop)
+		alertAPI := api.NewAlertHandlers(alertMgr, auditLogger)
+		alertAPI.Register(mux)
 	}
-	shareAPI := api.NewShareHandlers(shareMgr, auditLogger)
-	shareAPI.Register(mux)
 
-	return mux, nil
+	// Periodic reports, generated by scheduler tasks or on request
+	if cfg.Features.Reports {
+		reportGen, err := reports.New(&reports.Config{
+			Dir:       cfg.Reports.Dir,
+			Keep:      cfg.Reports.Keep,
+			Monitor:   mon,
+			Disks:     diskMgr,
+			Scheduler: sched,
+			Alerts:    alertMgr,
+			Audit:     auditLogger,
+			Bus:       eventBus,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create report generator: %w", err)
+		}
+		if sched != nil {
+			sched.RegisterHandler(reports.TaskType, reportGen.TaskHandler())
+		}
+		reportAPI := api.NewReportHandlers(reportGen, auditLogger)
+		reportAPI.SetJobs(jobMgr)
+		reportAPI.Register(mux)
+	}
+
+	// Internet quality probes and speedtests
+	if cfg.Features.WAN && cfg.Outbound.Offline {
+		log.Printf("warning: WAN monitoring is disabled in offline mode")
+	} else if cfg.Features.WAN {
+		wanMgr, err := wanprobe.New(&wanprobe.Config{
+			Targets:           cfg.WAN.Targets,
+			Interval:          time.Duration(cfg.WAN.IntervalSec) * time.Second,
+			Samples:           cfg.WAN.Samples,
+			Timeout:           time.Duration(cfg.WAN.TimeoutMs) * time.Millisecond,
+			SpeedtestURL:      cfg.WAN.SpeedtestURL,
+			SpeedtestMaxBytes: int64(cfg.WAN.SpeedtestMaxMB) << 20,
+			HistoryFile:       cfg.WAN.HistoryFile,
+			Retention:         time.Duration(cfg.WAN.RetentionDays) * 24 * time.Hour,
+			Thresholds: wanprobe.Thresholds{
+				LatencyMs:       cfg.WAN.LatencyMs,
+				JitterMs:        cfg.WAN.JitterMs,
+				LossPercent:     cfg.WAN.LossPercent,
+				MinDownloadMbps: cfg.WAN.MinDownloadMbps,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create wan monitor: %w", err)
+		}
+		wanMgr.SetEventBus(eventBus)
+		wanMgr.Start()
+		stops = append(stops, wanMgr.Stop)
+		if sched != nil {
+			sched.RegisterHandler(wanprobe.TaskType, wanMgr.TaskHandler())
+		}
+		wanAPI := api.NewWANHandlers(wanMgr, auditLogger)
+		wanAPI.SetJobs(jobMgr)
+		wanAPI.Register(mux)
+	}
+
+	// File-event automation, running scheduler task handlers. Registered
+	// after every subsystem has added its handlers, which rules are
+	// validated against.
+	if cfg.Features.Rules && sched != nil {
+		if fileWatcher == nil {
+			log.Printf("warning: file rules will not run: %v", watcherErr)
+		}
+		ruleMgr, err := rules.New(&rules.Config{
+			StateFile:    cfg.Scheduler.RulesFile,
+			AllowedPaths: cfg.Security.AllowedPaths,
+			Scheduler:    sched,
+			Watcher:      fileWatcher,
+			Bus:          eventBus,
+			Jobs:         jobMgr,
+			Audit:        auditLogger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create rule manager: %w", err)
+		}
+		ruleMgr.Start()
+		stops = append(stops, ruleMgr.Stop)
+		api.NewRuleHandlers(ruleMgr, auditLogger).Register(mux)
+	}
+
+	// Declarative bundles of the objects of the enabled features
+	api.NewBundleHandlers(bundle.New(&bundle.Config{
+		Shares:    shareMgr,
+		NetDisks:  netDiskMgr,
+		Scheduler: sched,
+	}), auditLogger).Register(mux)
+
+	// Dashboard bootstrap; sources of disabled features are left nil
+	overview := api.OverviewConfig{
+		Shares:      shareMgr,
+		Alerts:      alertMgr,
+		Scheduler:   sched,
+		Jobs:        jobMgr,
+		Maintenance: maintenanceMode,
+	}
+	if cfg.Features.Monitor {
+		overview.Monitor = mon
+	}
+	if cfg.Features.Disks {
+		overview.Disks = diskMgr
+	}
+	api.NewOverviewHandlers(overview).Register(mux)
+	if cfg.Features.Query {
+		api.NewQueryHandlers(api.QueryConfig{OverviewConfig: overview, Network: netMgr}).Register(mux)
+	}
+
+	// Disk space and SMART health feed both MQTT and the alert center
+	if cfg.MQTT.Enabled || cfg.Features.Alerts {
+		systemReporter := reporter.New(&reporter.Config{
+			Monitor:       mon,
+			Disks:         diskMgr,
+			StatsInterval: time.Duration(cfg.MQTT.StatsIntervalSec) * time.Second,
+			SMARTInterval: time.Duration(cfg.MQTT.SMARTIntervalSec) * time.Second,
+		}, eventBus)
+		systemReporter.Start()
+		stops = append(stops, systemReporter.Stop)
+	}
+
+	if cfg.MQTT.Enabled {
+		agentID := cfg.MQTT.AgentID
+		if agentID == "" {
+			agentID, _ = os.Hostname()
+		}
+
+		bridge := mqtt.NewBridge(&mqtt.BridgeConfig{
+			Broker:      cfg.MQTT.Broker,
+			ClientID:    cfg.MQTT.ClientID,
+			Username:    cfg.MQTT.Username,
+			Password:    cfg.MQTT.Password,
+			TopicPrefix: cfg.MQTT.TopicPrefix,
+			AgentID:     agentID,
+			Retain:      cfg.MQTT.Retain,
+			EventTypes:  cfg.MQTT.EventTypes,
+		}, eventBus)
+		bridge.Start()
+		stops = append(stops, bridge.Stop)
+	}
+
+	return &Handler{
+		Handler: api.Instrument(mux, api.Compress(api.AuthGuard(authMgr, auditLogger, api.CheckGuard(api.MaintenanceGuard(maintenanceMode, api.RecordChanges(mux)))))),
+		stops:   stops,
+	}, nil
+}
+
+// schedulerBlackouts converts the configured blackout windows
+func schedulerBlackouts(windows []config.BlackoutWindow) []scheduler.Blackout {
+	var blackouts []scheduler.Blackout
+	for _, w := range windows {
+		blackouts = append(blackouts, scheduler.Blackout{Start: w.Start, End: w.End, Days: w.Days})
+	}
+	return blackouts
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/KOPElan/mingyue-agent/internal/config"
+)
+
+// Listener is an open listener of the HTTP API
+type Listener struct {
+	net.Listener
+	Config config.ListenerConfig
+}
+
+// URL returns the base URL of the listener
+func (l *Listener) URL() string {
+	scheme := "http"
+	if l.Config.TLS() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, l.Addr())
+}
+
+// Serve serves srv on the listener, over TLS if the listener has a
+// certificate. One server may serve several listeners.
+func (l *Listener) Serve(srv *http.Server) error {
+	if l.Config.TLS() {
+		return srv.ServeTLS(l.Listener, l.Config.TLSCert, l.Config.TLSKey)
+	}
+	return srv.Serve(l.Listener)
+}
+
+// ListenHTTP opens every listener of the HTTP API, or none if one fails
+func ListenHTTP(cfg *config.Config) ([]*Listener, error) {
+	configs := cfg.HTTPListeners()
+	var listeners []*Listener
+	for _, lc := range configs {
+		lis, err := listen(lc, listenNetwork(lc, configs))
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", lc.Addr, err)
+		}
+		listeners = append(listeners, &Listener{Listener: lis, Config: lc})
+	}
+	return listeners, nil
+}
+
+func listen(lc config.ListenerConfig, network string) (net.Listener, error) {
+	var listenConfig net.ListenConfig
+	if lc.Interface != "" {
+		listenConfig.Control = bindToDevice(lc.Interface)
+	}
+	return listenConfig.Listen(context.Background(), network, lc.Addr)
+}
+
+// listenNetwork returns the network to listen on. Go listens on both
+// IPv4 and IPv6 for 0.0.0.0 and [::]; when both are listed on the same
+// port, each keeps to its own family.
+func listenNetwork(lc config.ListenerConfig, all []config.ListenerConfig) string {
+	host, port, err := net.SplitHostPort(lc.Addr)
+	if err != nil {
+		return "tcp"
+	}
+	var other, network string
+	switch host {
+	case "0.0.0.0":
+		other, network = "::", "tcp4"
+	case "::":
+		other, network = "0.0.0.0", "tcp6"
+	default:
+		return "tcp"
+	}
+	for _, l := range all {
+		otherHost, otherPort, err := net.SplitHostPort(l.Addr)
+		if err == nil && otherHost == other && otherPort == port && l.Interface == lc.Interface {
+			return network
+		}
+	}
+	return "tcp"
+}
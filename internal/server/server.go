@@ -2,25 +2,34 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/KOPElan/mingyue-agent/internal/api"
 	"github.com/KOPElan/mingyue-agent/internal/audit"
 	"github.com/KOPElan/mingyue-agent/internal/config"
+	"github.com/KOPElan/mingyue-agent/internal/ftpd"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
 	"google.golang.org/grpc"
 )
 
 type Server struct {
 	config      *config.Config
 	audit       *audit.Logger
+	handler     *Handler
 	httpServer  *http.Server
 	grpcServer  *grpc.Server
 	udsListener net.Listener
+	ftpServer   *ftpd.Server
 	wg          sync.WaitGroup
 }
 
@@ -30,15 +39,19 @@ func New(cfg *config.Config, auditLogger *audit.Logger) (*Server, error) {
 		audit:  auditLogger,
 	}
 
-	if cfg.API.EnableHTTP {
-		mux, err := NewHTTPMux(cfg, auditLogger)
+	// HTTP and UDS listeners share one handler so managers and their
+	// background workers are only created once
+	if cfg.API.EnableHTTP || cfg.API.EnableUDS {
+		handler, err := NewHTTPMux(cfg, auditLogger)
 		if err != nil {
 			return nil, err
 		}
+		s.handler = handler
+	}
 
+	if cfg.API.EnableHTTP {
 		s.httpServer = &http.Server{
-			Addr:         fmt.Sprintf("%s:%d", cfg.Server.ListenAddr, cfg.Server.HTTPPort),
-			Handler:      mux,
+			Handler:      s.handler,
 			ReadTimeout:  15 * time.Second,
 			WriteTimeout: 15 * time.Second,
 			IdleTimeout:  60 * time.Second,
@@ -49,24 +62,73 @@ func New(cfg *config.Config, auditLogger *audit.Logger) (*Server, error) {
 		s.grpcServer = grpc.NewServer()
 	}
 
+	if cfg.FTP.Enabled {
+		ftpServer, err := newFTPServer(cfg, auditLogger)
+		if err != nil {
+			return nil, fmt.Errorf("create ftp server: %w", err)
+		}
+		s.ftpServer = ftpServer
+	}
+
 	return s, nil
 }
 
+// newFTPServer creates the FTP drop server, offering FTPS with the FTP
+// certificate or else the API one
+func newFTPServer(cfg *config.Config, auditLogger *audit.Logger) (*ftpd.Server, error) {
+	passiveMin, passiveMax, err := cfg.FTP.PassiveRange()
+	if err != nil {
+		return nil, err
+	}
+
+	certFile, keyFile := cfg.FTP.TLSCert, cfg.FTP.TLSKey
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = cfg.API.TLSCert, cfg.API.TLSKey
+	}
+	var tlsConfig *tls.Config
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load ftp certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	maxSize := cfg.FTP.MaxUploadSize
+	if maxSize == 0 {
+		maxSize = cfg.Security.MaxUploadSize
+	}
+
+	return ftpd.New(ftpd.Config{
+		Addr:        net.JoinHostPort(cfg.FTP.ListenAddr, strconv.Itoa(cfg.FTP.Port)),
+		Root:        cfg.FTP.DropDir,
+		Username:    cfg.FTP.Username,
+		Password:    cfg.FTP.Password,
+		PassiveMin:  passiveMin,
+		PassiveMax:  passiveMax,
+		PublicHost:  cfg.FTP.PublicHost,
+		TLS:         tlsConfig,
+		RequireTLS:  cfg.FTP.RequireTLS,
+		MaxFileSize: maxSize,
+		Audit:       auditLogger,
+	})
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	if s.config.API.EnableHTTP {
-		s.wg.Add(1)
-		go func() {
-			defer s.wg.Done()
-			var err error
-			if s.config.API.TLSCert != "" && s.config.API.TLSKey != "" {
-				err = s.httpServer.ListenAndServeTLS(s.config.API.TLSCert, s.config.API.TLSKey)
-			} else {
-				err = s.httpServer.ListenAndServe()
-			}
-			if err != nil && err != http.ErrServerClosed {
-				fmt.Printf("HTTP server error: %v\n", err)
-			}
-		}()
+		listeners, err := ListenHTTP(s.config)
+		if err != nil {
+			return err
+		}
+		for _, lis := range listeners {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				if err := lis.Serve(s.httpServer); err != nil && err != http.ErrServerClosed {
+					fmt.Printf("HTTP server error on %s: %v\n", lis.Addr(), err)
+				}
+			}()
+		}
 	}
 
 	if s.config.API.EnableGRPC {
@@ -104,23 +166,48 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 		s.udsListener = lis
 
-		if err := os.Chmod(s.config.Server.UDSPath, 0666); err != nil {
-			return fmt.Errorf("chmod UDS socket: %w", err)
+		// Only root, the agent's user and uds_group may connect, and they
+		// are trusted without credentials. Windows has no Unix permission
+		// bits; socket access follows the directory ACL there.
+		trust := &api.LocalTrust{UIDs: []int{0, os.Geteuid()}, GID: -1}
+		if runtime.GOOS != "windows" {
+			if s.config.Server.UDSGroup != "" {
+				gid, err := lookupGroup(s.config.Server.UDSGroup)
+				if err != nil {
+					return fmt.Errorf("UDS group: %w", err)
+				}
+				if err := os.Chown(s.config.Server.UDSPath, -1, gid); err != nil {
+					return fmt.Errorf("chown UDS socket: %w", err)
+				}
+				trust.GID = gid
+			}
+			if err := os.Chmod(s.config.Server.UDSPath, 0660); err != nil {
+				return fmt.Errorf("chmod UDS socket: %w", err)
+			}
 		}
 
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
 
-			mux, err := NewHTTPMux(s.config, s.audit)
-			if err != nil {
+			// Same handler as TCP; requests without credentials from
+			// trusted users are served as the local user who connected
+			srv := &http.Server{Handler: s.handler, ConnContext: trust.ConnContext}
+			if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
 				fmt.Printf("UDS server error: %v\n", err)
-				return
 			}
+		}()
+	}
 
-			srv := &http.Server{Handler: mux}
-			if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
-				fmt.Printf("UDS server error: %v\n", err)
+	if s.ftpServer != nil {
+		if err := s.ftpServer.Listen(); err != nil {
+			return fmt.Errorf("start ftp server: %w", err)
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.ftpServer.Serve(); err != nil {
+				fmt.Printf("FTP server error: %v\n", err)
 			}
 		}()
 	}
@@ -141,6 +228,12 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		s.grpcServer.GracefulStop()
 	}
 
+	if s.ftpServer != nil {
+		if err := s.ftpServer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
 	if s.udsListener != nil {
 		if err := s.udsListener.Close(); err != nil && firstErr == nil {
 			firstErr = err
@@ -148,6 +241,15 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		os.Remove(s.config.Server.UDSPath)
 	}
 
+	if s.handler != nil {
+		s.handler.Stop()
+	}
+
+	// Export the spans of the last requests
+	if err := telemetry.Shutdown(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
 	done := make(chan struct{})
 	go func() {
 		s.wg.Wait()
@@ -162,3 +264,15 @@ func (s *Server) Shutdown(ctx context.Context) error {
 
 	return firstErr
 }
+
+// lookupGroup returns the ID of a group given by name or number
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(group.Gid)
+}
@@ -0,0 +1,586 @@
+package sftpd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"golang.org/x/net/webdav"
+)
+
+// SFTP version 3, the version spoken by OpenSSH and most clients
+// (draft-ietf-secsh-filexfer-02)
+const sftpVersion = 3
+
+// Packet types
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+)
+
+// Status codes
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Open flags
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Attribute flags
+const (
+	attrSize        = 0x01
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+)
+
+const (
+	// maxPacket is the largest request accepted, as in OpenSSH
+	maxPacket = 256 * 1024
+	// maxRead bounds the data returned for one read request
+	maxRead = 64 * 1024
+	// readdirBatch is the number of entries returned per readdir request
+	readdirBatch = 128
+)
+
+// errMalformed is returned for requests that end early
+var errMalformed = errors.New("malformed request")
+
+// session serves the SFTP protocol on one SSH channel
+type session struct {
+	server  *Server
+	channel io.ReadWriter
+	fs      webdav.FileSystem
+	user    string
+	scopes  []string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	handles map[string]*handle
+	next    uint64
+}
+
+// handle is an open file or directory
+type handle struct {
+	file   webdav.File
+	dir    bool
+	write  bool
+	offset int64 // Where the next write must start; uploads are sequential
+}
+
+func newSession(server *Server, channel io.ReadWriter, user string, scopes []string) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		server:  server,
+		channel: channel,
+		fs:      server.cfg.Files.SFTP(user, server.cfg.MaxFileSize),
+		user:    user,
+		scopes:  scopes,
+		ctx:     ctx,
+		cancel:  cancel,
+		handles: make(map[string]*handle),
+	}
+}
+
+// serve handles requests until the client disconnects. Uploads still open
+// then are discarded, since the context is canceled before they are closed.
+func (s *session) serve() {
+	defer func() {
+		s.cancel()
+		for _, h := range s.handles {
+			h.file.Close()
+		}
+	}()
+
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(s.channel, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length < 1 || length > maxPacket {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(s.channel, packet); err != nil {
+			return
+		}
+		if err := s.handle(packet[0], &reader{b: packet[1:]}); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one request. Only failures to send end the session.
+func (s *session) handle(kind byte, r *reader) error {
+	if kind == fxpInit {
+		// Extensions are not offered
+		return s.send(newPacket(fxpVersion).uint32(sftpVersion))
+	}
+
+	id := r.uint32()
+	if r.err != nil {
+		return s.sendStatus(id, fxBadMessage, r.err.Error())
+	}
+
+	switch kind {
+	case fxpRealpath:
+		name := cleanPath(r.string())
+		if r.err != nil {
+			break
+		}
+		return s.send(newPacket(fxpName).uint32(id).uint32(1).string(name).string(name).uint32(0))
+
+	case fxpStat, fxpLstat:
+		name := cleanPath(r.string())
+		if r.err != nil {
+			break
+		}
+		info, err := s.fs.Stat(s.ctx, name)
+		if err != nil {
+			return s.sendError(id, err)
+		}
+		return s.send(newPacket(fxpAttrs).uint32(id).attrs(info))
+
+	case fxpFstat:
+		h, ok := s.handles[r.string()]
+		if r.err != nil {
+			break
+		}
+		if !ok {
+			return s.sendStatus(id, fxFailure, "invalid handle")
+		}
+		info, err := h.file.Stat()
+		if err != nil {
+			return s.sendError(id, err)
+		}
+		return s.send(newPacket(fxpAttrs).uint32(id).attrs(info))
+
+	case fxpOpendir:
+		name := cleanPath(r.string())
+		if r.err != nil {
+			break
+		}
+		return s.openDir(id, name)
+
+	case fxpReaddir:
+		h, ok := s.handles[r.string()]
+		if r.err != nil {
+			break
+		}
+		if !ok || !h.dir {
+			return s.sendStatus(id, fxFailure, "invalid handle")
+		}
+		return s.readDir(id, h)
+
+	case fxpOpen:
+		name := cleanPath(r.string())
+		flags := r.uint32()
+		if r.err != nil {
+			break
+		}
+		// The requested attributes are ignored
+		return s.open(id, name, flags)
+
+	case fxpRead:
+		h, ok := s.handles[r.string()]
+		offset := r.uint64()
+		length := r.uint32()
+		if r.err != nil {
+			break
+		}
+		if !ok || h.dir || h.write {
+			return s.sendStatus(id, fxFailure, "invalid handle")
+		}
+		return s.read(id, h, int64(offset), length)
+
+	case fxpWrite:
+		h, ok := s.handles[r.string()]
+		offset := r.uint64()
+		data := r.bytes()
+		if r.err != nil {
+			break
+		}
+		if !ok || !h.write {
+			return s.sendStatus(id, fxFailure, "invalid handle")
+		}
+		if int64(offset) != h.offset {
+			return s.sendStatus(id, fxOpUnsupported, "writes must be sequential")
+		}
+		n, err := h.file.Write(data)
+		h.offset += int64(n)
+		if err != nil {
+			return s.sendError(id, err)
+		}
+		return s.sendStatus(id, fxOK, "")
+
+	case fxpClose:
+		key := r.string()
+		if r.err != nil {
+			break
+		}
+		h, ok := s.handles[key]
+		if !ok {
+			return s.sendStatus(id, fxFailure, "invalid handle")
+		}
+		delete(s.handles, key)
+		if err := h.file.Close(); err != nil {
+			return s.sendError(id, err)
+		}
+		return s.sendStatus(id, fxOK, "")
+
+	case fxpMkdir:
+		name := cleanPath(r.string())
+		if r.err != nil {
+			break
+		}
+		if code, message, ok := s.writable(); !ok {
+			return s.sendStatus(id, code, message)
+		}
+		if err := s.fs.Mkdir(s.ctx, name, 0755); err != nil {
+			return s.sendError(id, err)
+		}
+		return s.sendStatus(id, fxOK, "")
+
+	case fxpRemove, fxpRmdir:
+		name := cleanPath(r.string())
+		if r.err != nil {
+			break
+		}
+		return s.remove(id, name, kind == fxpRmdir)
+
+	case fxpRename:
+		oldName := cleanPath(r.string())
+		newName := cleanPath(r.string())
+		if r.err != nil {
+			break
+		}
+		if code, message, ok := s.writable(); !ok {
+			return s.sendStatus(id, code, message)
+		}
+		// Version 3 renames never replace files
+		if _, err := s.fs.Stat(s.ctx, newName); err == nil {
+			return s.sendStatus(id, fxFailure, "destination already exists")
+		}
+		if err := s.fs.Rename(s.ctx, oldName, newName); err != nil {
+			return s.sendError(id, err)
+		}
+		return s.sendStatus(id, fxOK, "")
+
+	case fxpSetstat, fxpFsetstat:
+		// Permissions and times are managed by the agent
+		return s.sendStatus(id, fxOpUnsupported, "changing attributes is not supported")
+
+	case fxpReadlink, fxpSymlink:
+		return s.sendStatus(id, fxOpUnsupported, "symbolic links are not supported")
+
+	default:
+		return s.sendStatus(id, fxOpUnsupported, "operation not supported")
+	}
+	return s.sendStatus(id, fxBadMessage, r.err.Error())
+}
+
+// writable reports whether the session may change files, with the status
+// to refuse changes with
+func (s *session) writable() (uint32, string, bool) {
+	if len(s.scopes) > 0 && !auth.Grants(s.scopes, auth.ScopeFilesWrite) {
+		return fxPermissionDenied, "token lacks the " + auth.ScopeFilesWrite + " scope", false
+	}
+	if s.server.inMaintenance() {
+		return fxFailure, "agent is in maintenance mode", false
+	}
+	return fxOK, "", true
+}
+
+// addHandle stores an open file and returns its handle
+func (s *session) addHandle(id uint32, h *handle) error {
+	if len(s.handles) >= maxHandles {
+		h.file.Close()
+		return s.sendStatus(id, fxFailure, "too many open files")
+	}
+	s.next++
+	key := strconv.FormatUint(s.next, 10)
+	s.handles[key] = h
+	return s.send(newPacket(fxpHandle).uint32(id).string(key))
+}
+
+func (s *session) openDir(id uint32, name string) error {
+	f, err := s.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		f.Close()
+		return s.sendStatus(id, fxFailure, "not a directory")
+	}
+	return s.addHandle(id, &handle{file: f, dir: true})
+}
+
+func (s *session) readDir(id uint32, h *handle) error {
+	// Listings leave out hidden entries, so a batch can come back empty
+	for {
+		infos, err := h.file.Readdir(readdirBatch)
+		if len(infos) > 0 {
+			p := newPacket(fxpName).uint32(id).uint32(uint32(len(infos)))
+			for _, info := range infos {
+				p = p.string(info.Name()).string(longName(info, s.user)).attrs(info)
+			}
+			return s.send(p)
+		}
+		if errors.Is(err, io.EOF) {
+			return s.sendStatus(id, fxEOF, "")
+		}
+		if err != nil {
+			return s.sendError(id, err)
+		}
+	}
+}
+
+// open opens a file for reading, or for replacing it. Uploads replace files
+// once closed, so appending to or updating files in place is refused.
+func (s *session) open(id uint32, name string, flags uint32) error {
+	if flags&(fxfWrite|fxfAppend) == 0 {
+		f, err := s.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return s.sendError(id, err)
+		}
+		return s.addHandle(id, &handle{file: f})
+	}
+
+	if code, message, ok := s.writable(); !ok {
+		return s.sendStatus(id, code, message)
+	}
+	if flags&(fxfRead|fxfAppend) != 0 {
+		return s.sendStatus(id, fxOpUnsupported, "files can only be opened for reading or replacing")
+	}
+	_, statErr := s.fs.Stat(s.ctx, name)
+	if flags&fxfExcl != 0 && statErr == nil {
+		return s.sendStatus(id, fxFailure, "file already exists")
+	}
+	// Creating a missing file is the same as replacing it
+	if flags&fxfTrunc == 0 && !(flags&fxfCreat != 0 && errors.Is(statErr, os.ErrNotExist)) {
+		return s.sendStatus(id, fxOpUnsupported, "files can only be replaced, not updated in place")
+	}
+	f, err := s.fs.OpenFile(s.ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	return s.addHandle(id, &handle{file: f, write: true})
+}
+
+func (s *session) read(id uint32, h *handle, offset int64, length uint32) error {
+	buf := make([]byte, min(length, maxRead))
+	var n int
+	var err error
+	if readerAt, ok := h.file.(io.ReaderAt); ok {
+		n, err = readerAt.ReadAt(buf, offset)
+	} else if _, err = h.file.Seek(offset, io.SeekStart); err == nil {
+		n, err = io.ReadFull(h.file, buf)
+	}
+	if n > 0 {
+		return s.send(newPacket(fxpData).uint32(id).bytes(buf[:n]))
+	}
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return s.sendStatus(id, fxEOF, "")
+	}
+	return s.sendError(id, err)
+}
+
+// remove deletes a file, or an empty directory for rmdir. Deletes go to the
+// trash when it is enabled.
+func (s *session) remove(id uint32, name string, dir bool) error {
+	if code, message, ok := s.writable(); !ok {
+		return s.sendStatus(id, code, message)
+	}
+	info, err := s.fs.Stat(s.ctx, name)
+	if err != nil {
+		return s.sendError(id, err)
+	}
+	if info.IsDir() != dir {
+		if dir {
+			return s.sendStatus(id, fxFailure, "not a directory")
+		}
+		return s.sendStatus(id, fxFailure, "is a directory")
+	}
+	if dir {
+		f, err := s.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return s.sendError(id, err)
+		}
+		entries, _ := f.Readdir(1)
+		f.Close()
+		if len(entries) > 0 {
+			return s.sendStatus(id, fxFailure, "directory not empty")
+		}
+	}
+	if err := s.fs.RemoveAll(s.ctx, name); err != nil {
+		return s.sendError(id, err)
+	}
+	return s.sendStatus(id, fxOK, "")
+}
+
+func (s *session) send(p packet) error {
+	binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+	_, err := s.channel.Write(p)
+	return err
+}
+
+func (s *session) sendStatus(id, code uint32, message string) error {
+	return s.send(newPacket(fxpStatus).uint32(id).uint32(code).string(message).string(""))
+}
+
+// sendError reports err with the closest status code
+func (s *session) sendError(id uint32, err error) error {
+	code := uint32(fxFailure)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = fxNoSuchFile
+	case errors.Is(err, os.ErrPermission):
+		code = fxPermissionDenied
+	}
+	return s.sendStatus(id, code, err.Error())
+}
+
+// cleanPath makes a client path absolute. Clients start in the root.
+func cleanPath(name string) string {
+	return path.Join("/", name)
+}
+
+// longName formats an entry like ls -l, which clients show as is
+func longName(info os.FileInfo, owner string) string {
+	modTime := info.ModTime()
+	stamp := modTime.Format("Jan _2 15:04")
+	if time.Since(modTime) > 180*24*time.Hour || modTime.After(time.Now()) {
+		stamp = modTime.Format("Jan _2  2006")
+	}
+	if owner == "" {
+		owner = "agent"
+	}
+	return fmt.Sprintf("%s 1 %-8s %-8s %8d %s %s", info.Mode().String(), owner, owner, info.Size(), stamp, info.Name())
+}
+
+// packet is a response under construction, starting with room for its
+// length
+type packet []byte
+
+func newPacket(kind byte) packet {
+	return packet{0, 0, 0, 0, kind}
+}
+
+func (p packet) uint32(v uint32) packet {
+	return binary.BigEndian.AppendUint32(p, v)
+}
+
+func (p packet) uint64(v uint64) packet {
+	return binary.BigEndian.AppendUint64(p, v)
+}
+
+func (p packet) string(s string) packet {
+	return append(p.uint32(uint32(len(s))), s...)
+}
+
+func (p packet) bytes(b []byte) packet {
+	return append(p.uint32(uint32(len(b))), b...)
+}
+
+// attrs appends the size, permissions and times of info
+func (p packet) attrs(info os.FileInfo) packet {
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		mode |= 0040000
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= 0120000
+	default:
+		mode |= 0100000
+	}
+	mtime := uint32(info.ModTime().Unix())
+	return p.uint32(attrSize | attrPermissions | attrACModTime).
+		uint64(uint64(info.Size())).
+		uint32(mode).
+		uint32(mtime).
+		uint32(mtime)
+}
+
+// reader decodes a request, remembering the first error
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if r.err != nil || len(r.b) < 8 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.b)) < n {
+		r.err = errMalformed
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
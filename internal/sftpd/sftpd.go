@@ -0,0 +1,318 @@
+// Package sftpd is an SFTP server over SSH for command-line users and
+// tools like rsync-less backups and file managers with SFTP support. It
+// serves the allowed directories of the file manager the way the WebDAV
+// endpoint does, with the same path checks, upload policies, quotas, trash
+// and audit trail. Clients log in with an API token or session ID as the
+// password; the user name is ignored and changes are made as the token's
+// user. Shell, exec and port forwarding requests are refused.
+package sftpd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"github.com/KOPElan/mingyue-agent/internal/maintenance"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxConnections bounds concurrent SSH connections
+	maxConnections = 16
+	// handshakeTimeout closes connections that don't log in
+	handshakeTimeout = 30 * time.Second
+	// maxHandles bounds open files and directories per SFTP session
+	maxHandles = 64
+)
+
+// Permissions extensions carrying the identity of a login
+const (
+	extUser   = "user"
+	extScopes = "scopes"
+)
+
+// Config configures the SFTP server
+type Config struct {
+	Addr        string // host:port to listen on
+	HostKeyPath string // ed25519 host key, generated if missing
+	Files       *filemanager.Manager
+	Auth        *auth.AuthManager
+	Maintenance *maintenance.Mode // Changes are refused while enabled; optional
+	MaxFileSize int64             // 0 for unlimited
+	Audit       *audit.Logger
+}
+
+// Server accepts SSH connections offering the SFTP subsystem
+type Server struct {
+	cfg      Config
+	ssh      *ssh.ServerConfig
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// New creates a server for cfg, loading or generating its host key
+func New(cfg Config) (*Server, error) {
+	if cfg.Files == nil || cfg.Auth == nil {
+		return nil, errors.New("file manager and auth manager are required")
+	}
+	signer, err := loadHostKey(cfg.HostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:   cfg,
+		conns: make(map[net.Conn]struct{}),
+	}
+	s.ssh = &ssh.ServerConfig{
+		PasswordCallback: s.checkPassword,
+		ServerVersion:    "SSH-2.0-mingyue-agent",
+	}
+	s.ssh.AddHostKey(signer)
+	return s, nil
+}
+
+// loadHostKey reads the host key at path, creating one on first start so
+// clients see the same key across restarts
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate host key: %w", err)
+		}
+		block, err := ssh.MarshalPrivateKey(key, "mingyue-agent")
+		if err != nil {
+			return nil, fmt.Errorf("encode host key: %w", err)
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("create host key directory: %w", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("write host key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("read host key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse host key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// Listen binds the SSH port. It is separate from Serve so startup errors
+// can be reported synchronously.
+func (s *Server) Listen() error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", s.cfg.Addr, err)
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	return nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until Close is called
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if len(s.conns) >= maxConnections {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and ends open sessions
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serveConn runs the SSH protocol on conn, starting an SFTP session for
+// each session channel that asks for the subsystem
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.ssh)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(reqs)
+
+	user := sshConn.Permissions.Extensions[extUser]
+	var scopes []string
+	if encoded := sshConn.Permissions.Extensions[extScopes]; encoded != "" {
+		scopes = strings.Split(encoded, ",")
+	}
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sftp sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "subsystem" || string(req.Payload[min(4, len(req.Payload)):]) != "sftp" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				go ssh.DiscardRequests(requests)
+				newSession(s, channel, user, scopes).serve()
+				return
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// checkPassword accepts API tokens and session IDs. Failures count towards
+// the ban threshold of the auth manager like those of the API.
+func (s *Server) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	ip := sourceIP(meta.RemoteAddr())
+	if _, banned := s.cfg.Auth.IsBanned(ip); banned {
+		return nil, errors.New("source address is banned")
+	}
+
+	credential := string(password)
+	userID := ""
+	var scopes []string
+	if token, err := s.cfg.Auth.ValidateToken(credential); err == nil {
+		userID = token.UserID
+		scopes = token.Scopes
+	} else if session, err := s.cfg.Auth.ValidateSession(context.Background(), credential); err == nil {
+		userID = session.UserID
+	}
+
+	// Tokens without scopes have full access, like in the API
+	if userID != "" && len(scopes) > 0 && !auth.Grants(scopes, auth.ScopeFilesRead) {
+		s.logAudit(userID, "sftp.login", "", "failed", ip, map[string]interface{}{"required_scope": auth.ScopeFilesRead})
+		return nil, errors.New("token lacks the required scope")
+	}
+	if userID == "" {
+		ban, _ := s.cfg.Auth.RecordAuthFailure(ip)
+		s.logAudit("anonymous", "sftp.login", "", "failed", ip, map[string]interface{}{"user": meta.User()})
+		if ban != nil {
+			s.logAudit("system", "auth.ban", ip, "success", ip, map[string]interface{}{
+				"reason":     ban.Reason,
+				"expires_at": ban.ExpiresAt,
+			})
+		}
+		return nil, errors.New("invalid credentials")
+	}
+
+	s.cfg.Auth.RecordAuthSuccess(ip)
+	s.logAudit(userID, "sftp.login", "", "success", ip, nil)
+	return &ssh.Permissions{Extensions: map[string]string{
+		extUser:   userID,
+		extScopes: strings.Join(scopes, ","),
+	}}, nil
+}
+
+// inMaintenance reports whether changes are refused
+func (s *Server) inMaintenance() bool {
+	return s.cfg.Maintenance != nil && s.cfg.Maintenance.Enabled()
+}
+
+// sourceIP returns the IP of addr without the port
+func sourceIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (s *Server) logAudit(user, action, resource, result, sourceIP string, details map[string]interface{}) {
+	if s.cfg.Audit == nil {
+		return
+	}
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    action,
+		Resource:  resource,
+		Result:    result,
+		SourceIP:  sourceIP,
+		Details:   details,
+	}
+	if err := s.cfg.Audit.Log(context.Background(), entry); err != nil {
+		log.Printf("warning: audit sftp %s: %v", action, err)
+	}
+}
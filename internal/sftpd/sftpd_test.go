@@ -0,0 +1,232 @@
+package sftpd
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/auth"
+	"github.com/KOPElan/mingyue-agent/internal/filemanager"
+	"golang.org/x/crypto/ssh"
+)
+
+type testServer struct {
+	server *Server
+	auth   *auth.AuthManager
+	dir    string
+}
+
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	authMgr, err := auth.New(auth.Config{DBPath: filepath.Join(t.TempDir(), "auth.db")})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	t.Cleanup(func() { authMgr.Close() })
+
+	server, err := New(Config{
+		Addr:        "127.0.0.1:0",
+		HostKeyPath: filepath.Join(t.TempDir(), "host_key"),
+		Files:       filemanager.New([]string{dir}, nil),
+		Auth:        authMgr,
+		MaxFileSize: 16,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return &testServer{server: server, auth: authMgr, dir: dir}
+}
+
+func (ts *testServer) token(t *testing.T, scopes ...string) string {
+	t.Helper()
+	token, err := ts.auth.CreateToken(context.Background(), "alice", "sftp", scopes, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	return token.Token
+}
+
+func (ts *testServer) dial(password string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", ts.server.Addr().String(), &ssh.ClientConfig{
+		User:            "anyone",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// client sends SFTP requests and reads their responses
+type client struct {
+	t  *testing.T
+	in io.Writer
+	r  io.Reader
+	id uint32
+}
+
+func (ts *testServer) open(t *testing.T, password string) *client {
+	t.Helper()
+	conn, err := ts.dial(password)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sess, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	in, _ := sess.StdinPipe()
+	out, _ := sess.StdoutPipe()
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("RequestSubsystem: %v", err)
+	}
+
+	c := &client{t: t, in: in, r: out}
+	c.write(newPacket(fxpInit).uint32(sftpVersion))
+	if kind, r := c.read(); kind != fxpVersion || r.uint32() != sftpVersion {
+		t.Fatalf("unexpected version reply %d", kind)
+	}
+	return c
+}
+
+func (c *client) write(p packet) {
+	c.t.Helper()
+	binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+	if _, err := c.in.Write(p); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+func (c *client) read() (byte, *reader) {
+	c.t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return body[0], &reader{b: body[1:]}
+}
+
+// request sends a request of kind with the next ID, built by args
+func (c *client) request(kind byte, args func(packet) packet) (byte, *reader) {
+	c.t.Helper()
+	c.id++
+	c.write(args(newPacket(kind).uint32(c.id)))
+	reply, r := c.read()
+	if id := r.uint32(); id != c.id {
+		c.t.Fatalf("reply for request %d, expected %d", id, c.id)
+	}
+	return reply, r
+}
+
+// status sends a request expecting a status reply and returns its code
+func (c *client) status(kind byte, args func(packet) packet) uint32 {
+	c.t.Helper()
+	reply, r := c.request(kind, args)
+	if reply != fxpStatus {
+		c.t.Fatalf("expected status, got %d", reply)
+	}
+	return r.uint32()
+}
+
+// handle opens name and returns its handle
+func (c *client) handle(name string, flags uint32) string {
+	c.t.Helper()
+	reply, r := c.request(fxpOpen, func(p packet) packet { return p.string(name).uint32(flags).uint32(0) })
+	if reply != fxpHandle {
+		c.t.Fatalf("open %s: expected handle, got status %d", name, r.uint32())
+	}
+	return r.string()
+}
+
+func TestSFTPSession(t *testing.T) {
+	ts := startServer(t)
+	c := ts.open(t, ts.token(t))
+
+	// The allowed directory is a folder at the root
+	reply, r := c.request(fxpOpendir, func(p packet) packet { return p.string("/") })
+	if reply != fxpHandle {
+		t.Fatalf("opendir: expected handle, got %d", reply)
+	}
+	dir := r.string()
+	reply, r = c.request(fxpReaddir, func(p packet) packet { return p.string(dir) })
+	if reply != fxpName || r.uint32() != 1 || r.string() != "data" {
+		t.Fatalf("expected the data folder in the root listing")
+	}
+
+	h := c.handle("/data/hello.txt", fxfWrite|fxfCreat|fxfTrunc)
+	if code := c.status(fxpWrite, func(p packet) packet { return p.string(h).uint64(0).bytes([]byte("hello")) }); code != fxOK {
+		t.Fatalf("write: status %d", code)
+	}
+	if code := c.status(fxpClose, func(p packet) packet { return p.string(h) }); code != fxOK {
+		t.Fatalf("close: status %d", code)
+	}
+	if data, err := os.ReadFile(filepath.Join(ts.dir, "hello.txt")); err != nil || string(data) != "hello" {
+		t.Fatalf("expected uploaded file, got %q (%v)", data, err)
+	}
+
+	h = c.handle("/data/hello.txt", fxfRead)
+	reply, r = c.request(fxpRead, func(p packet) packet { return p.string(h).uint64(1).uint32(100) })
+	if reply != fxpData || string(r.bytes()) != "ello" {
+		t.Fatalf("expected file data from offset 1")
+	}
+
+	// Uploads are held to the size limit and leave the file alone
+	h = c.handle("/data/hello.txt", fxfWrite|fxfCreat|fxfTrunc)
+	if code := c.status(fxpWrite, func(p packet) packet { return p.string(h).uint64(0).bytes(make([]byte, 32)) }); code != fxFailure {
+		t.Fatalf("oversized write: expected failure, got %d", code)
+	}
+	c.status(fxpClose, func(p packet) packet { return p.string(h) })
+	if data, _ := os.ReadFile(filepath.Join(ts.dir, "hello.txt")); string(data) != "hello" {
+		t.Fatalf("rejected upload replaced the file: %q", data)
+	}
+
+	if code := c.status(fxpRename, func(p packet) packet { return p.string("/data/hello.txt").string("/data/moved.txt") }); code != fxOK {
+		t.Fatalf("rename: status %d", code)
+	}
+	if code := c.status(fxpRemove, func(p packet) packet { return p.string("/data/moved.txt") }); code != fxOK {
+		t.Fatalf("remove: status %d", code)
+	}
+	if code := c.status(fxpStat, func(p packet) packet { return p.string("/data/moved.txt") }); code != fxNoSuchFile {
+		t.Fatalf("stat removed file: expected no such file, got %d", code)
+	}
+
+	// Paths can't leave the allowed directories
+	if code := c.status(fxpStat, func(p packet) packet { return p.string("/../etc/passwd") }); code != fxNoSuchFile {
+		t.Fatalf("stat outside: expected no such file, got %d", code)
+	}
+}
+
+func TestSFTPScopesAndCredentials(t *testing.T) {
+	ts := startServer(t)
+
+	if _, err := ts.dial("wrong"); err == nil {
+		t.Fatalf("expected login with a wrong password to fail")
+	}
+	if _, err := ts.dial(ts.token(t, auth.ScopeDiskRead)); err == nil {
+		t.Fatalf("expected login without files:read to fail")
+	}
+
+	c := ts.open(t, ts.token(t, auth.ScopeFilesRead))
+	if code := c.status(fxpMkdir, func(p packet) packet { return p.string("/data/new").uint32(0) }); code != fxPermissionDenied {
+		t.Fatalf("mkdir with files:read: expected permission denied, got %d", code)
+	}
+	if reply, _ := c.request(fxpStat, func(p packet) packet { return p.string("/data") }); reply != fxpAttrs {
+		t.Fatalf("stat with files:read: expected attributes, got %d", reply)
+	}
+}
@@ -0,0 +1,227 @@
+package sharemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// DLNA media types restrict what miniDLNA indexes in a folder
+const (
+	DLNAMediaAll      = ""
+	DLNAMediaAudio    = "audio"
+	DLNAMediaVideo    = "video"
+	DLNAMediaPictures = "pictures"
+)
+
+var (
+	// ErrDLNANotConfigured is returned when publishing folders without a
+	// miniDLNA configuration file
+	ErrDLNANotConfigured = errors.New("dlna is not configured")
+	// ErrInvalidDLNA is returned for media settings miniDLNA can't use
+	ErrInvalidDLNA = errors.New("invalid dlna settings")
+)
+
+// dlnaMediaFlags maps media types to miniDLNA media_dir prefixes
+var dlnaMediaFlags = map[string]string{
+	DLNAMediaAll:      "",
+	DLNAMediaAudio:    "A,",
+	DLNAMediaVideo:    "V,",
+	DLNAMediaPictures: "P,",
+}
+
+// DLNAConfig configures the miniDLNA integration. Media folders are only
+// published when ConfigFile is set, because the agent then owns the file.
+type DLNAConfig struct {
+	ConfigFile   string // minidlna.conf rewritten on every change
+	FriendlyName string // Server name shown on TVs; the host name if empty
+	Port         int    // HTTP port of the media server
+	DBDir        string // Where miniDLNA keeps its media index
+	ServiceName  string // systemd unit restarted when folders change
+}
+
+// DLNAFolder is a share published to the media server
+type DLNAFolder struct {
+	ShareID string `json:"share_id"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Media   string `json:"media,omitempty"`
+}
+
+// DLNAStatus describes the media server
+type DLNAStatus struct {
+	Enabled    bool         `json:"enabled"`
+	ConfigFile string       `json:"config_file,omitempty"`
+	Service    string       `json:"service,omitempty"`
+	State      string       `json:"state,omitempty"`
+	Folders    []DLNAFolder `json:"folders"`
+}
+
+// SetDLNA publishes a share's folder to the media server, or stops publishing
+// it. media limits indexing to one of the DLNAMedia types.
+func (m *Manager) SetDLNA(ctx context.Context, id string, enabled bool, media string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.dlna.ConfigFile == "" {
+		return ErrDLNANotConfigured
+	}
+
+	share, exists := m.shares[id]
+	if !exists {
+		return fmt.Errorf("share %s not found", id)
+	}
+
+	updated := *share
+	updated.DLNA = enabled
+	updated.DLNAMedia = media
+	if err := checkDLNA(&updated); err != nil {
+		return err
+	}
+
+	previous := *share
+	share.DLNA = updated.DLNA
+	share.DLNAMedia = updated.DLNAMedia
+	share.UpdatedAt = time.Now()
+
+	if err := m.applyDLNA(ctx); err != nil {
+		*share = previous
+		return fmt.Errorf("apply dlna configuration: %w", err)
+	}
+
+	return m.saveState()
+}
+
+// DLNAStatus returns the published folders and the state of the media server
+func (m *Manager) DLNAStatus(ctx context.Context) *DLNAStatus {
+	m.mu.RLock()
+	status := &DLNAStatus{
+		Enabled:    m.dlna.ConfigFile != "",
+		ConfigFile: m.dlna.ConfigFile,
+		Folders:    []DLNAFolder{},
+	}
+	for _, share := range dlnaShares(m.shares) {
+		status.Folders = append(status.Folders, DLNAFolder{
+			ShareID: share.ID,
+			Name:    share.Name,
+			Path:    share.Path,
+			Media:   share.DLNAMedia,
+		})
+	}
+	m.mu.RUnlock()
+
+	if !status.Enabled {
+		return status
+	}
+
+	status.Service = m.dlna.ServiceName
+	// is-active exits non-zero for inactive units but still prints the state
+	output, _ := sysexec.Output(ctx, "systemctl", "is-active", m.dlna.ServiceName)
+	status.State = strings.TrimSpace(string(output))
+	if status.State == "" {
+		status.State = "unknown"
+	}
+	return status
+}
+
+// checkDLNA validates the media settings of a share
+func checkDLNA(share *Share) error {
+	if _, ok := dlnaMediaFlags[share.DLNAMedia]; !ok {
+		return fmt.Errorf("%w: dlna_media %q is not audio, video or pictures", ErrInvalidDLNA, share.DLNAMedia)
+	}
+	// minidlna.conf has one setting per line
+	if share.DLNA && strings.ContainsAny(share.Path, "\r\n") {
+		return fmt.Errorf("%w: share path %q contains a line break", ErrInvalidDLNA, share.Path)
+	}
+	return nil
+}
+
+// dlnaShares returns the enabled shares published over DLNA, ordered by ID
+func dlnaShares(shares map[string]*Share) []*Share {
+	var published []*Share
+	for _, share := range shares {
+		if share.Enabled && share.DLNA {
+			published = append(published, share)
+		}
+	}
+	sort.Slice(published, func(i, j int) bool {
+		return published[i].ID < published[j].ID
+	})
+	return published
+}
+
+// renderDLNAConfig generates minidlna.conf for the published shares
+func (m *Manager) renderDLNAConfig(shares []*Share) string {
+	var b strings.Builder
+	b.WriteString("# Generated by mingyue-agent. Manual changes are overwritten.\n")
+	fmt.Fprintf(&b, "port=%d\n", m.dlna.Port)
+	if m.dlna.FriendlyName != "" {
+		fmt.Fprintf(&b, "friendly_name=%s\n", m.dlna.FriendlyName)
+	}
+	fmt.Fprintf(&b, "db_dir=%s\n", m.dlna.DBDir)
+	// Rescan folders as files change, so new media shows up without a restart
+	b.WriteString("inotify=yes\n")
+	for _, share := range shares {
+		fmt.Fprintf(&b, "media_dir=%s%s\n", dlnaMediaFlags[share.DLNAMedia], share.Path)
+	}
+	return b.String()
+}
+
+// applyDLNA rewrites minidlna.conf and restarts the media server when the
+// published folders changed. The server is stopped when nothing is
+// published. Callers hold m.mu.
+func (m *Manager) applyDLNA(ctx context.Context) error {
+	if m.dlna.ConfigFile == "" {
+		return nil
+	}
+
+	shares := dlnaShares(m.shares)
+	content := m.renderDLNAConfig(shares)
+	// miniDLNA rebuilds its index on restart, so avoid restarts that don't
+	// change anything, like edits of unrelated shares
+	if current, err := os.ReadFile(m.dlna.ConfigFile); err == nil && bytes.Equal(current, []byte(content)) {
+		return nil
+	}
+
+	if err := os.WriteFile(m.dlna.ConfigFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("write dlna config: %w", err)
+	}
+
+	action := "restart"
+	if len(shares) == 0 {
+		action = "stop"
+	}
+	output, err := sysexec.CombinedOutput(ctx, "systemctl", action, m.dlna.ServiceName)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w, output: %s", action, m.dlna.ServiceName, err, string(output))
+	}
+	return nil
+}
+
+// planDLNA mirrors applyDLNA for a dry run
+func (m *Manager) planDLNA(plan *dryrun.Plan, shares map[string]*Share) {
+	if m.dlna.ConfigFile == "" {
+		return
+	}
+
+	published := dlnaShares(shares)
+	content := m.renderDLNAConfig(published)
+	if current, err := os.ReadFile(m.dlna.ConfigFile); err == nil && bytes.Equal(current, []byte(content)) {
+		return
+	}
+
+	plan.AddFile(m.dlna.ConfigFile, content)
+	if len(published) == 0 {
+		plan.AddCommand("systemctl", "stop", m.dlna.ServiceName)
+	} else {
+		plan.AddCommand("systemctl", "restart", m.dlna.ServiceName)
+	}
+}
@@ -0,0 +1,41 @@
+package sharemanager
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRenderDLNAConfig(t *testing.T) {
+	m := &Manager{dlna: DLNAConfig{Port: 8200, DBDir: "/var/cache/minidlna", FriendlyName: "NAS"}}
+	shares := map[string]*Share{
+		"movies":  {ID: "movies", Path: "/data/movies", Enabled: true, DLNA: true, DLNAMedia: DLNAMediaVideo},
+		"music":   {ID: "music", Path: "/data/music", Enabled: true, DLNA: true},
+		"private": {ID: "private", Path: "/data/private", Enabled: true},
+		"old":     {ID: "old", Path: "/data/old", DLNA: true},
+	}
+
+	want := "# Generated by mingyue-agent. Manual changes are overwritten.\n" +
+		"port=8200\n" +
+		"friendly_name=NAS\n" +
+		"db_dir=/var/cache/minidlna\n" +
+		"inotify=yes\n" +
+		"media_dir=V,/data/movies\n" +
+		"media_dir=/data/music\n"
+	if got := m.renderDLNAConfig(dlnaShares(shares)); got != want {
+		t.Fatalf("unexpected minidlna.conf:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCheckDLNA(t *testing.T) {
+	for _, share := range []*Share{
+		{Path: "/data/media", DLNA: true, DLNAMedia: "movies"},
+		{Path: "/data/media\nmedia_dir=/", DLNA: true},
+	} {
+		if err := checkDLNA(share); !errors.Is(err, ErrInvalidDLNA) {
+			t.Errorf("expected %+v to be rejected, got %v", share, err)
+		}
+	}
+	if err := checkDLNA(&Share{Path: "/data/media", DLNA: true, DLNAMedia: DLNAMediaPictures}); err != nil {
+		t.Fatalf("checkDLNA: %v", err)
+	}
+}
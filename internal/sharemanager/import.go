@@ -0,0 +1,284 @@
+package sharemanager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportSkip is a share found in the system configuration that was not
+// imported
+type ImportSkip struct {
+	Name   string    `json:"name"`
+	Type   ShareType `json:"type"`
+	Path   string    `json:"path"`
+	Reason string    `json:"reason"`
+}
+
+// ImportReport lists the outcome of importing the system configuration
+type ImportReport struct {
+	Imported []*Share     `json:"imported"`
+	Skipped  []ImportSkip `json:"skipped"`
+}
+
+// sambaSkipSections are smb.conf sections that do not describe a share
+var sambaSkipSections = map[string]bool{
+	"global":   true,
+	"homes":    true,
+	"printers": true,
+	"print$":   true,
+}
+
+// nfsDefaultOptions are export options the NFS template always sets
+var nfsDefaultOptions = map[string]bool{
+	"ro":               true,
+	"rw":               true,
+	"sync":             true,
+	"no_subtree_check": true,
+}
+
+// ImportShares adopts the shares already configured in the Samba and NFS
+// configuration files, so an existing server does not need them to be
+// recreated. Imported shares are marked as such and are written out with
+// the templates on the next configuration change. Shares already managed,
+// outside the allowed paths or using settings the templates cannot express
+// are skipped with a reason.
+func (m *Manager) ImportShares(ctx context.Context) (*ImportReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	samba, err := parseSambaShares(m.sambaConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read samba config: %w", err)
+	}
+	nfs, nfsSkipped, err := parseNFSExports(m.nfsConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read nfs config: %w", err)
+	}
+
+	report := &ImportReport{Imported: []*Share{}, Skipped: append([]ImportSkip{}, nfsSkipped...)}
+	now := time.Now()
+	for i, share := range append(samba, nfs...) {
+		if reason := m.importConflict(share); reason != "" {
+			report.Skipped = append(report.Skipped, ImportSkip{Name: share.Name, Type: share.Type, Path: share.Path, Reason: reason})
+			continue
+		}
+
+		share.ID = fmt.Sprintf("%s-%d-%d", share.Name, now.Unix(), i)
+		share.Enabled = true
+		share.Imported = true
+		share.CreatedAt = now
+		share.UpdatedAt = now
+		m.shares[share.ID] = share
+
+		shareCopy := *share
+		report.Imported = append(report.Imported, &shareCopy)
+	}
+	if len(report.Imported) == 0 {
+		return report, nil
+	}
+
+	if err := m.saveState(); err != nil {
+		for _, share := range report.Imported {
+			delete(m.shares, share.ID)
+		}
+		return nil, err
+	}
+
+	m.bus.Publish("share.imported", map[string]interface{}{
+		"count": len(report.Imported),
+	})
+	return report, nil
+}
+
+// importConflict returns why share cannot be imported, or "" if it can
+func (m *Manager) importConflict(share *Share) string {
+	if share.Path == "" {
+		return "no path"
+	}
+	if !m.isAllowedPath(share.Path) {
+		return "path is not in allowed paths"
+	}
+	for _, existing := range m.shares {
+		if existing.Type != share.Type {
+			continue
+		}
+		if share.Type == ShareTypeSamba && strings.EqualFold(existing.Name, share.Name) {
+			return "a share with this name is already managed"
+		}
+		if share.Type == ShareTypeNFS && filepath.Clean(existing.Path) == filepath.Clean(share.Path) {
+			return "an export of this path is already managed"
+		}
+	}
+	return ""
+}
+
+// parseSambaShares reads the share sections of an smb.conf file. The
+// parameters the share template writes itself become fields of the share
+// and the others are kept as options.
+func parseSambaShares(path string) ([]*Share, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var shares []*Share
+	var current *Share
+	var pending string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// A trailing backslash continues the line
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		line = strings.TrimSpace(pending + line)
+		pending = ""
+
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			current = nil
+			if !sambaSkipSections[strings.ToLower(name)] {
+				current = &Share{Name: name, Type: ShareTypeSamba, AccessMode: AccessModeReadOnly, Options: map[string]string{}}
+				shares = append(shares, current)
+			}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.Join(strings.Fields(key), " "))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "path", "directory":
+			current.Path = value
+		case "comment":
+			current.Description = value
+		case "read only":
+			current.AccessMode = sambaAccessMode(!sambaBool(value))
+		case "writable", "writeable", "write ok":
+			current.AccessMode = sambaAccessMode(sambaBool(value))
+		case "valid users":
+			for _, user := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				if group, ok := strings.CutPrefix(user, "@"); ok {
+					current.Groups = append(current.Groups, group)
+				} else {
+					current.Users = append(current.Users, user)
+				}
+			}
+		default:
+			current.Options[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// The template only grants access to users, so groups stay options
+	for _, share := range shares {
+		if len(share.Groups) > 0 {
+			valid := append([]string{}, share.Users...)
+			for _, group := range share.Groups {
+				valid = append(valid, "@"+group)
+			}
+			share.Options["valid users"] = strings.Join(valid, " ")
+		}
+		if len(share.Options) == 0 {
+			share.Options = nil
+		}
+	}
+	return shares, nil
+}
+
+// sambaBool parses a Samba boolean parameter
+func sambaBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "yes", "true", "1", "on":
+		return true
+	}
+	return false
+}
+
+func sambaAccessMode(writable bool) AccessMode {
+	if writable {
+		return AccessModeReadWrite
+	}
+	return AccessModeReadOnly
+}
+
+// parseNFSExports reads an exports file. The NFS template exports to all
+// hosts, so exports restricted to some clients are skipped rather than
+// opened up.
+func parseNFSExports(path string) ([]*Share, []ImportSkip, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var shares []*Share
+	var skipped []ImportSkip
+	content := strings.ReplaceAll(string(data), "\\\n", " ")
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		exportPath := fields[0]
+		if unquoted, err := strconv.Unquote(exportPath); err == nil {
+			exportPath = unquoted
+		}
+		share := &Share{
+			Name:       filepath.Base(exportPath),
+			Type:       ShareTypeNFS,
+			Path:       exportPath,
+			AccessMode: AccessModeReadOnly,
+		}
+
+		if len(fields) > 2 {
+			skipped = append(skipped, ImportSkip{Name: share.Name, Type: share.Type, Path: share.Path, Reason: "exports to several clients"})
+			continue
+		}
+		// A path alone is exported to all hosts with default options
+		client, options := "*", ""
+		if len(fields) == 2 {
+			client, options, _ = strings.Cut(strings.TrimSuffix(fields[1], ")"), "(")
+		}
+		if client != "*" {
+			skipped = append(skipped, ImportSkip{Name: share.Name, Type: share.Type, Path: share.Path, Reason: "exports to " + client + " only"})
+			continue
+		}
+
+		for _, option := range strings.Split(options, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			if key == "rw" {
+				share.AccessMode = AccessModeReadWrite
+			}
+			if key == "" || nfsDefaultOptions[key] {
+				continue
+			}
+			if share.Options == nil {
+				share.Options = map[string]string{}
+			}
+			share.Options[key] = value
+		}
+		shares = append(shares, share)
+	}
+	return shares, skipped, nil
+}
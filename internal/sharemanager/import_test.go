@@ -0,0 +1,82 @@
+package sharemanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportShares(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"media", "backup"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+	}
+	smbConf := filepath.Join(dir, "smb.conf")
+	os.WriteFile(smbConf, []byte(`[global]
+   workgroup = HOME
+[homes]
+   browseable = no
+; old share
+[Media]
+   path = `+dir+`/media
+   comment = Movies
+   writable = yes
+   valid users = alice, @family
+   vfs objects = \
+      catia fruit
+[system]
+   path = /etc
+`), 0644)
+	exports := filepath.Join(dir, "exports")
+	os.WriteFile(exports, []byte(`# exports
+`+dir+`/backup *(rw,sync,no_subtree_check,all_squash,anonuid=1000)
+`+dir+`/media 192.168.1.0/24(ro)
+`), 0644)
+
+	m, err := New(&Config{
+		AllowedPaths: []string{dir},
+		SambaConfig:  smbConf,
+		NFSConfig:    exports,
+		StateFile:    filepath.Join(dir, "state.json"),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer m.Stop()
+
+	report, err := m.ImportShares(context.Background())
+	if err != nil {
+		t.Fatalf("ImportShares: %v", err)
+	}
+	if len(report.Imported) != 2 || len(report.Skipped) != 2 {
+		t.Fatalf("expected 2 imported and 2 skipped, got %+v", report)
+	}
+
+	media := report.Imported[0]
+	if media.Name != "Media" || media.Type != ShareTypeSamba || media.AccessMode != AccessModeReadWrite ||
+		media.Description != "Movies" || !media.Imported || !media.Enabled {
+		t.Fatalf("unexpected samba share %+v", media)
+	}
+	if len(media.Users) != 1 || media.Users[0] != "alice" || len(media.Groups) != 1 || media.Groups[0] != "family" {
+		t.Fatalf("unexpected users %v and groups %v", media.Users, media.Groups)
+	}
+	if media.Options["vfs objects"] != "catia fruit" || media.Options["valid users"] != "alice @family" {
+		t.Fatalf("unexpected options %v", media.Options)
+	}
+
+	backup := report.Imported[1]
+	if backup.Type != ShareTypeNFS || backup.AccessMode != AccessModeReadWrite ||
+		len(backup.Options) != 2 || backup.Options["anonuid"] != "1000" {
+		t.Fatalf("unexpected nfs share %+v", backup)
+	}
+
+	// Importing again finds everything already managed
+	report, err = m.ImportShares(context.Background())
+	if err != nil {
+		t.Fatalf("ImportShares: %v", err)
+	}
+	if len(report.Imported) != 0 || len(m.ListShares()) != 2 {
+		t.Fatalf("expected nothing new, got %+v", report)
+	}
+}
@@ -1,15 +1,25 @@
 package sharemanager
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/configrepo"
+	"github.com/KOPElan/mingyue-agent/internal/dryrun"
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/healthcheck"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
 )
 
 // ShareType represents the share protocol type
@@ -20,6 +30,10 @@ const (
 	ShareTypeNFS   ShareType = "nfs"
 )
 
+// ErrNotPendingDelete is returned when confirming or restoring the deletion
+// of a share that is not scheduled for deletion
+var ErrNotPendingDelete = errors.New("share is not pending deletion")
+
 // AccessMode represents share access mode
 type AccessMode string
 
@@ -40,10 +54,52 @@ type Share struct {
 	AccessMode  AccessMode        `json:"access_mode"`
 	Options     map[string]string `json:"options"`
 	Enabled     bool              `json:"enabled"`
+	DLNA        bool              `json:"dlna"`                 // Publish to TVs and media players through miniDLNA
+	DLNAMedia   string            `json:"dlna_media,omitempty"` // Index only audio, video or pictures
+	Imported    bool              `json:"imported,omitempty"`   // Adopted from the existing system configuration
 	Healthy     bool              `json:"healthy"`
 	LastChecked time.Time         `json:"last_checked"`
 	CreatedAt   time.Time         `json:"created_at"`
 	UpdatedAt   time.Time         `json:"updated_at"`
+	// DeleteAt is set while the share is pending deletion. It keeps being
+	// served until then so live clients are not cut off by mistake.
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+// GuestAccess reports whether the share can be accessed without authenticating
+// as a specific user. NFS shares count as guest access when requests are not
+// authenticated at all (sec=none) or every client is squashed to the
+// anonymous user, unless only Kerberos security is allowed.
+func (s *Share) GuestAccess() bool {
+	switch s.Type {
+	case ShareTypeSamba:
+		for _, key := range []string{"guest ok", "public"} {
+			switch strings.ToLower(s.Options[key]) {
+			case "yes", "true", "1":
+				return true
+			}
+		}
+		return false
+	case ShareTypeNFS:
+		kerberosOnly := false
+		if sec := s.Options["sec"]; sec != "" {
+			kerberosOnly = true
+			for _, flavor := range strings.Split(sec, ":") {
+				if flavor == "none" {
+					return true
+				}
+				if !strings.HasPrefix(flavor, "krb5") {
+					kerberosOnly = false
+				}
+			}
+		}
+		if kerberosOnly {
+			return false
+		}
+		_, squashed := s.Options["all_squash"]
+		return squashed
+	}
+	return false
 }
 
 // Manager handles share management operations
@@ -52,11 +108,27 @@ type Manager struct {
 	allowedPaths    []string
 	sambaConfig     string
 	nfsConfig       string
-	backupDir       string
 	stateFile       string
+	templateDir     string
 	mu              sync.RWMutex
 	monitorInterval time.Duration
+	checkTimeout    time.Duration
+	checkWorkers    int
+	deleteGrace     time.Duration
 	stopMonitor     chan struct{}
+	auditEnabled    bool
+	auditFacility   string
+	statsFile       string
+	statsInterval   time.Duration
+	statsRetention  time.Duration
+	stats           map[string]*ShareStats
+	nfsLast         map[string]nfsExportCounters
+	statsUnsaved    bool // Guarded by statsMu
+	statsMu         sync.RWMutex
+	dlna            DLNAConfig
+	bus             *events.Bus
+	saver           *statefile.Debouncer
+	history         *configrepo.Repo
 }
 
 // Config represents share manager configuration
@@ -64,9 +136,18 @@ type Config struct {
 	AllowedPaths    []string
 	SambaConfig     string
 	NFSConfig       string
-	BackupDir       string
 	StateFile       string
+	TemplateDir     string // Holds templates overriding the built-in Samba and NFS ones
 	MonitorInterval time.Duration
+	CheckTimeout    time.Duration // Bounds the health check of a single share path
+	CheckWorkers    int           // Limits how many shares are checked at once
+	DeleteGrace     time.Duration // How long removed shares stay until they are deleted
+	AuditEnabled    bool          // Enable vfs_full_audit on generated Samba shares
+	AuditFacility   string        // Syslog facility used by vfs_full_audit
+	StatsFile       string
+	StatsInterval   time.Duration
+	StatsRetention  time.Duration
+	DLNA            DLNAConfig
 }
 
 // New creates a new share manager
@@ -81,11 +162,6 @@ func New(cfg *Config) (*Manager, error) {
 		nfsConfig = "/etc/exports"
 	}
 
-	backupDir := cfg.BackupDir
-	if backupDir == "" {
-		backupDir = "/var/lib/mingyue-agent/share-backups"
-	}
-
 	stateFile := cfg.StateFile
 	if stateFile == "" {
 		stateFile = "/var/lib/mingyue-agent/share-state.json"
@@ -96,9 +172,40 @@ func New(cfg *Config) (*Manager, error) {
 		monitorInterval = 1 * time.Minute
 	}
 
-	// Verify backup directory is accessible
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		return nil, fmt.Errorf("create backup directory %s: %w\n\nPlease ensure the directory exists and has correct permissions:\n  sudo mkdir -p %s\n  sudo chown -R $(whoami):$(whoami) %s", backupDir, err, backupDir, backupDir)
+	checkTimeout := cfg.CheckTimeout
+	if checkTimeout == 0 {
+		checkTimeout = 10 * time.Second
+	}
+
+	deleteGrace := cfg.DeleteGrace
+	if deleteGrace == 0 {
+		deleteGrace = 24 * time.Hour
+	}
+
+	auditFacility := cfg.AuditFacility
+	if auditFacility == "" {
+		auditFacility = "local5"
+	}
+
+	statsInterval := cfg.StatsInterval
+	if statsInterval == 0 {
+		statsInterval = 5 * time.Minute
+	}
+
+	statsRetention := cfg.StatsRetention
+	if statsRetention == 0 {
+		statsRetention = 90 * 24 * time.Hour
+	}
+
+	dlna := cfg.DLNA
+	if dlna.Port == 0 {
+		dlna.Port = 8200
+	}
+	if dlna.DBDir == "" {
+		dlna.DBDir = "/var/cache/minidlna"
+	}
+	if dlna.ServiceName == "" {
+		dlna.ServiceName = "minidlna"
 	}
 
 	// Verify state file directory is accessible
@@ -112,10 +219,31 @@ func New(cfg *Config) (*Manager, error) {
 		allowedPaths:    cfg.AllowedPaths,
 		sambaConfig:     sambaConfig,
 		nfsConfig:       nfsConfig,
-		backupDir:       backupDir,
 		stateFile:       stateFile,
+		templateDir:     cfg.TemplateDir,
 		monitorInterval: monitorInterval,
+		checkTimeout:    checkTimeout,
+		checkWorkers:    cfg.CheckWorkers,
+		deleteGrace:     deleteGrace,
 		stopMonitor:     make(chan struct{}),
+		auditEnabled:    cfg.AuditEnabled,
+		auditFacility:   auditFacility,
+		statsFile:       cfg.StatsFile,
+		statsInterval:   statsInterval,
+		statsRetention:  statsRetention,
+		stats:           make(map[string]*ShareStats),
+		nfsLast:         make(map[string]nfsExportCounters),
+		dlna:            dlna,
+	}
+
+	m.saver = statefile.NewDebouncer(statefile.DefaultDelay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.saveState()
+	})
+
+	if err := m.checkTemplates(); err != nil {
+		return nil, fmt.Errorf("load share templates: %w", err)
 	}
 
 	// Load persisted state
@@ -123,14 +251,19 @@ func New(cfg *Config) (*Manager, error) {
 		return nil, fmt.Errorf("load state: %w", err)
 	}
 
-	// Start health monitor
+	if err := m.loadStats(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load stats: %w", err)
+	}
+
+	// Start health monitor and access statistics sampler
 	go m.healthMonitor()
+	go m.statsSampler()
 
 	return m, nil
 }
 
 // AddShare adds a new share
-func (m *Manager) AddShare(share *Share) error {
+func (m *Manager) AddShare(ctx context.Context, share *Share) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -138,14 +271,11 @@ func (m *Manager) AddShare(share *Share) error {
 		share.ID = fmt.Sprintf("%s-%d", share.Name, time.Now().Unix())
 	}
 
-	// Validate path is in allowed list
-	if !m.isAllowedPath(share.Path) {
-		return fmt.Errorf("path %s is not in allowed paths", share.Path)
+	if err := m.checkPath(share.Path); err != nil {
+		return err
 	}
-
-	// Ensure path exists
-	if _, err := os.Stat(share.Path); err != nil {
-		return fmt.Errorf("share path does not exist: %w", err)
+	if err := checkDLNA(share); err != nil {
+		return err
 	}
 
 	now := time.Now()
@@ -156,7 +286,7 @@ func (m *Manager) AddShare(share *Share) error {
 	m.shares[share.ID] = share
 
 	// Apply configuration
-	if err := m.applyConfiguration(); err != nil {
+	if err := m.applyConfiguration(ctx); err != nil {
 		delete(m.shares, share.ID)
 		return fmt.Errorf("apply configuration: %w", err)
 	}
@@ -165,7 +295,7 @@ func (m *Manager) AddShare(share *Share) error {
 }
 
 // UpdateShare updates an existing share
-func (m *Manager) UpdateShare(id string, updates *Share) error {
+func (m *Manager) UpdateShare(ctx context.Context, id string, updates *Share) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -174,6 +304,121 @@ func (m *Manager) UpdateShare(id string, updates *Share) error {
 		return fmt.Errorf("share %s not found", id)
 	}
 
+	if err := m.applyUpdates(share, updates); err != nil {
+		return err
+	}
+
+	// Apply configuration
+	if err := m.applyConfiguration(ctx); err != nil {
+		return fmt.Errorf("apply configuration: %w", err)
+	}
+
+	return m.saveState()
+}
+
+// ReplaceShare sets every setting of an existing share to those of share,
+// unlike UpdateShare, which leaves the empty fields of its updates alone.
+// A share pending deletion is restored.
+func (m *Manager) ReplaceShare(ctx context.Context, id string, share *Share) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, exists := m.shares[id]
+	if !exists {
+		return fmt.Errorf("share %s not found", id)
+	}
+	if err := m.checkPath(share.Path); err != nil {
+		return err
+	}
+	if err := checkDLNA(share); err != nil {
+		return err
+	}
+
+	previous := *existing
+	existing.Name = share.Name
+	existing.Path = share.Path
+	existing.Description = share.Description
+	existing.Users = share.Users
+	existing.Groups = share.Groups
+	existing.AccessMode = share.AccessMode
+	existing.Options = share.Options
+	existing.Enabled = share.Enabled
+	existing.DLNA = share.DLNA
+	existing.DLNAMedia = share.DLNAMedia
+	existing.DeleteAt = nil
+	existing.UpdatedAt = time.Now()
+
+	if err := m.applyConfiguration(ctx); err != nil {
+		*existing = previous
+		return fmt.Errorf("apply configuration: %w", err)
+	}
+
+	return m.saveState()
+}
+
+// PlanAddShare validates share and returns the configuration files and
+// commands AddShare would apply, without changing anything
+func (m *Manager) PlanAddShare(share *Share) (*dryrun.Plan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := m.checkPath(share.Path); err != nil {
+		return nil, err
+	}
+	if err := checkDLNA(share); err != nil {
+		return nil, err
+	}
+
+	added := *share
+	added.Enabled = true
+	shares := m.sharesWith(&added)
+	return m.planConfiguration(shares)
+}
+
+// PlanUpdateShare validates updates and returns the configuration files and
+// commands UpdateShare would apply, without changing anything
+func (m *Manager) PlanUpdateShare(id string, updates *Share) (*dryrun.Plan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	share, exists := m.shares[id]
+	if !exists {
+		return nil, fmt.Errorf("share %s not found", id)
+	}
+
+	updated := *share
+	if err := m.applyUpdates(&updated, updates); err != nil {
+		return nil, err
+	}
+	return m.planConfiguration(m.sharesWith(&updated))
+}
+
+// sharesWith returns the shares with share added or replaced
+func (m *Manager) sharesWith(share *Share) map[string]*Share {
+	shares := make(map[string]*Share, len(m.shares)+1)
+	for id, existing := range m.shares {
+		shares[id] = existing
+	}
+	shares[share.ID] = share
+	return shares
+}
+
+// checkPath checks that a share path is allowed and exists
+func (m *Manager) checkPath(path string) error {
+	// Validate path is in allowed list
+	if !m.isAllowedPath(path) {
+		return fmt.Errorf("path %s is not in allowed paths", path)
+	}
+
+	// Ensure path exists
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("share path does not exist: %w", err)
+	}
+	return nil
+}
+
+// applyUpdates copies the fields set in updates to share
+func (m *Manager) applyUpdates(share *Share, updates *Share) error {
 	// Validate path if changed
 	if updates.Path != "" && updates.Path != share.Path {
 		if !m.isAllowedPath(updates.Path) {
@@ -203,35 +448,130 @@ func (m *Manager) UpdateShare(id string, updates *Share) error {
 	}
 
 	share.UpdatedAt = time.Now()
+	return nil
+}
 
-	// Apply configuration
-	if err := m.applyConfiguration(); err != nil {
-		return fmt.Errorf("apply configuration: %w", err)
+// RemoveShare schedules a share for deletion after the grace period. The
+// share keeps being served until then and can be restored with RestoreShare
+// or deleted at once with ConfirmRemoveShare.
+func (m *Manager) RemoveShare(ctx context.Context, id string) (*Share, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, exists := m.shares[id]
+	if !exists {
+		return nil, fmt.Errorf("share %s not found", id)
 	}
 
-	return m.saveState()
+	if share.DeleteAt == nil {
+		deleteAt := time.Now().Add(m.deleteGrace)
+		share.DeleteAt = &deleteAt
+		if err := m.saveState(); err != nil {
+			share.DeleteAt = nil
+			return nil, err
+		}
+		m.bus.Publish("share.delete_pending", map[string]interface{}{
+			"id":        share.ID,
+			"name":      share.Name,
+			"delete_at": deleteAt,
+		})
+	}
+
+	shareCopy := *share
+	return &shareCopy, nil
 }
 
-// RemoveShare removes a share
-func (m *Manager) RemoveShare(id string) error {
+// ConfirmRemoveShare deletes a share pending deletion without waiting for
+// the grace period
+func (m *Manager) ConfirmRemoveShare(ctx context.Context, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, exists := m.shares[id]; !exists {
+	share, exists := m.shares[id]
+	if !exists {
 		return fmt.Errorf("share %s not found", id)
 	}
+	if share.DeleteAt == nil {
+		return ErrNotPendingDelete
+	}
 
-	delete(m.shares, id)
+	return m.deleteShares(ctx, []string{id})
+}
 
-	// Apply configuration
-	if err := m.applyConfiguration(); err != nil {
+// RestoreShare cancels the pending deletion of a share
+func (m *Manager) RestoreShare(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	share, exists := m.shares[id]
+	if !exists {
+		return fmt.Errorf("share %s not found", id)
+	}
+	if share.DeleteAt == nil {
+		return ErrNotPendingDelete
+	}
+
+	deleteAt := share.DeleteAt
+	share.DeleteAt = nil
+	if err := m.saveState(); err != nil {
+		share.DeleteAt = deleteAt
+		return err
+	}
+
+	m.bus.Publish("share.restored", map[string]interface{}{
+		"id":   share.ID,
+		"name": share.Name,
+	})
+	return nil
+}
+
+// deleteShares removes shares and rewrites the configuration. The shares
+// are put back if the configuration cannot be applied. Callers hold m.mu.
+func (m *Manager) deleteShares(ctx context.Context, ids []string) error {
+	removed := make(map[string]*Share, len(ids))
+	for _, id := range ids {
+		removed[id] = m.shares[id]
+		delete(m.shares, id)
+	}
+
+	if err := m.applyConfiguration(ctx); err != nil {
+		for id, share := range removed {
+			m.shares[id] = share
+		}
 		return fmt.Errorf("apply configuration: %w", err)
 	}
 
+	for _, share := range removed {
+		m.bus.Publish("share.deleted", map[string]interface{}{
+			"id":   share.ID,
+			"name": share.Name,
+		})
+	}
 	return m.saveState()
 }
 
-// ListShares returns all shares
+// deleteExpired deletes shares whose grace period has ended
+func (m *Manager) deleteExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var expired []string
+	for id, share := range m.shares {
+		if share.DeleteAt != nil && !share.DeleteAt.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	if err := m.deleteShares(context.Background(), expired); err != nil {
+		log.Printf("warning: delete expired shares: %v", err)
+	}
+}
+
+// ListShares returns all shares, ordered by ID
 func (m *Manager) ListShares() []*Share {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -241,6 +581,9 @@ func (m *Manager) ListShares() []*Share {
 		shareCopy := *share
 		shares = append(shares, &shareCopy)
 	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ID < shares[j].ID
+	})
 	return shares
 }
 
@@ -259,7 +602,7 @@ func (m *Manager) GetShare(id string) (*Share, error) {
 }
 
 // EnableShare enables a share
-func (m *Manager) EnableShare(id string) error {
+func (m *Manager) EnableShare(ctx context.Context, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -271,7 +614,7 @@ func (m *Manager) EnableShare(id string) error {
 	share.Enabled = true
 	share.UpdatedAt = time.Now()
 
-	if err := m.applyConfiguration(); err != nil {
+	if err := m.applyConfiguration(ctx); err != nil {
 		return fmt.Errorf("apply configuration: %w", err)
 	}
 
@@ -279,7 +622,7 @@ func (m *Manager) EnableShare(id string) error {
 }
 
 // DisableShare disables a share
-func (m *Manager) DisableShare(id string) error {
+func (m *Manager) DisableShare(ctx context.Context, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -291,39 +634,68 @@ func (m *Manager) DisableShare(id string) error {
 	share.Enabled = false
 	share.UpdatedAt = time.Now()
 
-	if err := m.applyConfiguration(); err != nil {
+	if err := m.applyConfiguration(ctx); err != nil {
 		return fmt.Errorf("apply configuration: %w", err)
 	}
 
 	return m.saveState()
 }
 
-// RollbackConfig rolls back to a previous configuration
-func (m *Manager) RollbackConfig(timestamp time.Time) error {
+// RollbackConfig puts back the Samba configuration in effect at timestamp,
+// as recorded in the configuration history
+func (m *Manager) RollbackConfig(ctx context.Context, timestamp time.Time) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	backupFile := filepath.Join(m.backupDir, fmt.Sprintf("smb.conf.%d", timestamp.Unix()))
-	if _, err := os.Stat(backupFile); err != nil {
-		return fmt.Errorf("backup not found: %w", err)
+	id, err := m.history.Before(ctx, m.sambaConfig, timestamp)
+	if err != nil {
+		return fmt.Errorf("find samba config: %w", err)
 	}
-
-	// Restore samba config
-	if err := m.restoreConfig(backupFile, m.sambaConfig); err != nil {
+	if _, err := m.history.Revert(ctx, id, m.sambaConfig); err != nil {
 		return fmt.Errorf("restore samba config: %w", err)
 	}
+	return nil
+}
 
-	// Reload samba
-	if err := m.reloadSamba(); err != nil {
-		return fmt.Errorf("reload samba: %w", err)
-	}
+// SetConfigRepo records every applied Samba, NFS and miniDLNA configuration
+// in history and lets it revert them
+func (m *Manager) SetConfigRepo(ctx context.Context, history *configrepo.Repo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	m.history = history
+	if err := history.Track(ctx, m.sambaConfig, func(ctx context.Context) error {
+		if err := m.testSambaConfig(ctx); err != nil {
+			return err
+		}
+		return m.reloadSamba(ctx)
+	}); err != nil {
+		return err
+	}
+	if err := history.Track(ctx, m.nfsConfig, m.reloadNFS); err != nil {
+		return err
+	}
+	if m.dlna.ConfigFile != "" {
+		return history.Track(ctx, m.dlna.ConfigFile, func(ctx context.Context) error {
+			return sysexec.Run(ctx, "systemctl", "restart", m.dlna.ServiceName)
+		})
+	}
 	return nil
 }
 
+// SetEventBus publishes share health changes on bus
+func (m *Manager) SetEventBus(bus *events.Bus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bus = bus
+}
+
 // Stop stops the share manager
 func (m *Manager) Stop() {
 	close(m.stopMonitor)
+	m.saver.Flush()
+	m.saveStats()
 }
 
 // Private methods
@@ -356,252 +728,196 @@ func (m *Manager) isAllowedPath(path string) bool {
 	return false
 }
 
-func (m *Manager) applyConfiguration() error {
-	// Backup current configurations
-	if err := m.backupConfigs(); err != nil {
-		return fmt.Errorf("backup configs: %w", err)
-	}
+func (m *Manager) applyConfiguration(ctx context.Context) error {
+	// Each phase is traced so slow applies can be broken down
+	ctx, span := telemetry.Start(ctx, "sharemanager.apply")
+	defer span.End()
 
 	// Generate and apply Samba configuration
-	sambaShares := []*Share{}
-	nfsShares := []*Share{}
-
-	for _, share := range m.shares {
-		if !share.Enabled {
-			continue
-		}
-		if share.Type == ShareTypeSamba {
-			sambaShares = append(sambaShares, share)
-		} else if share.Type == ShareTypeNFS {
-			nfsShares = append(nfsShares, share)
-		}
-	}
-
-	// Generate Samba config
+	sambaShares, nfsShares := splitShares(m.shares)
+	span.SetAttribute("shares.samba", len(sambaShares))
+	span.SetAttribute("shares.nfs", len(nfsShares))
 	if len(sambaShares) > 0 {
-		if err := m.generateSambaConfig(sambaShares); err != nil {
-			return fmt.Errorf("generate samba config: %w", err)
-		}
-
-		// Test configuration
-		if err := m.testSambaConfig(); err != nil {
-			// Rollback on error
-			m.restoreLatestBackup()
-			return fmt.Errorf("invalid samba config: %w", err)
-		}
-
-		// Reload Samba
-		if err := m.reloadSamba(); err != nil {
-			return fmt.Errorf("reload samba: %w", err)
+		if err := telemetry.Run(ctx, "sharemanager.apply_samba", func(ctx context.Context) error {
+			return m.applySamba(ctx, sambaShares)
+		}); err != nil {
+			span.SetError(err)
+			return err
 		}
 	}
 
 	// Generate NFS config
 	if len(nfsShares) > 0 {
-		if err := m.generateNFSConfig(nfsShares); err != nil {
-			return fmt.Errorf("generate nfs config: %w", err)
+		if err := telemetry.Run(ctx, "sharemanager.apply_nfs", func(ctx context.Context) error {
+			return m.applyNFS(ctx, nfsShares)
+		}); err != nil {
+			span.SetError(err)
+			return err
 		}
+	}
 
-		// Reload NFS exports
-		if err := m.reloadNFS(); err != nil {
-			return fmt.Errorf("reload nfs: %w", err)
-		}
+	// Publish media folders
+	if err := telemetry.Run(ctx, "sharemanager.apply_dlna", m.applyDLNA); err != nil {
+		span.SetError(err)
+		return fmt.Errorf("apply dlna configuration: %w", err)
 	}
 
+	if err := m.history.Record(ctx, "apply share configuration", m.configFiles()...); err != nil {
+		log.Printf("warning: record share configuration: %v", err)
+	}
 	return nil
 }
 
-func (m *Manager) generateSambaConfig(shares []*Share) error {
-	tmpl := `# Generated by mingyue-agent at {{ .Timestamp }}
-[global]
-   workgroup = WORKGROUP
-   server string = Mingyue Agent Share
-   security = user
-   map to guest = Bad User
-   log file = /var/log/samba/log.%m
-   max log size = 50
-
-{{ range .Shares }}
-[{{ .Name }}]
-   path = {{ .Path }}
-   {{ if .Description }}comment = {{ .Description }}{{ end }}
-   {{ if eq .AccessMode "ro" }}read only = yes{{ else }}read only = no{{ end }}
-   browseable = yes
-   {{ if .Users }}valid users = {{ join .Users " " }}{{ end }}
-   create mask = 0664
-   directory mask = 0775
-{{ range $key, $value := .Options }}   {{ $key }} = {{ $value }}
-{{ end }}
-{{ end }}
-`
-
-	t, err := template.New("samba").Funcs(template.FuncMap{
-		"join": strings.Join,
-	}).Parse(tmpl)
-	if err != nil {
-		return fmt.Errorf("parse template: %w", err)
+// configFiles lists the configuration files generated for shares
+func (m *Manager) configFiles() []string {
+	files := []string{m.sambaConfig, m.nfsConfig}
+	if m.dlna.ConfigFile != "" {
+		files = append(files, m.dlna.ConfigFile)
 	}
+	return files
+}
 
-	file, err := os.Create(m.sambaConfig + ".new")
-	if err != nil {
-		return fmt.Errorf("create config file: %w", err)
+func (m *Manager) applySamba(ctx context.Context, shares []*Share) error {
+	previous, readErr := os.ReadFile(m.sambaConfig)
+	if err := m.generateSambaConfig(shares); err != nil {
+		return fmt.Errorf("generate samba config: %w", err)
 	}
-	defer file.Close()
 
-	data := struct {
-		Timestamp time.Time
-		Shares    []*Share
-	}{
-		Timestamp: time.Now(),
-		Shares:    shares,
+	// Test configuration
+	if err := m.testSambaConfig(ctx); err != nil {
+		// Put back the configuration Samba is running with
+		if readErr == nil {
+			os.WriteFile(m.sambaConfig, previous, 0644)
+		} else if os.IsNotExist(readErr) {
+			os.Remove(m.sambaConfig)
+		}
+		return fmt.Errorf("invalid samba config: %w", err)
 	}
 
-	if err := t.Execute(file, data); err != nil {
-		return fmt.Errorf("execute template: %w", err)
+	// Reload Samba
+	if err := m.reloadSamba(ctx); err != nil {
+		return fmt.Errorf("reload samba: %w", err)
 	}
+	return nil
+}
 
-	// Move new config to actual location
-	if err := os.Rename(m.sambaConfig+".new", m.sambaConfig); err != nil {
-		return fmt.Errorf("move config: %w", err)
+func (m *Manager) applyNFS(ctx context.Context, shares []*Share) error {
+	if err := m.generateNFSConfig(shares); err != nil {
+		return fmt.Errorf("generate nfs config: %w", err)
 	}
 
+	// Reload NFS exports
+	if err := m.reloadNFS(ctx); err != nil {
+		return fmt.Errorf("reload nfs: %w", err)
+	}
 	return nil
 }
 
-func (m *Manager) generateNFSConfig(shares []*Share) error {
-	content := "# Generated by mingyue-agent\n"
+// splitShares returns the enabled Samba and NFS shares
+func splitShares(shares map[string]*Share) (samba, nfs []*Share) {
 	for _, share := range shares {
-		line := fmt.Sprintf("%s *(", share.Path)
-		if share.AccessMode == AccessModeReadOnly {
-			line += "ro"
-		} else {
-			line += "rw"
+		if !share.Enabled {
+			continue
 		}
-		line += ",sync,no_subtree_check"
-		for key, value := range share.Options {
-			if value == "" {
-				line += "," + key
-			} else {
-				line += "," + key + "=" + value
-			}
+		if share.Type == ShareTypeSamba {
+			samba = append(samba, share)
+		} else if share.Type == ShareTypeNFS {
+			nfs = append(nfs, share)
 		}
-		line += ")\n"
-		content += line
-	}
-
-	if err := os.WriteFile(m.nfsConfig, []byte(content), 0644); err != nil {
-		return fmt.Errorf("write nfs config: %w", err)
 	}
-
-	return nil
+	return samba, nfs
 }
 
-func (m *Manager) testSambaConfig() error {
-	cmd := exec.Command("testparm", "-s", m.sambaConfig)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("testparm failed: %w, output: %s", err, string(output))
+// planConfiguration mirrors applyConfiguration for a dry run
+func (m *Manager) planConfiguration(shares map[string]*Share) (*dryrun.Plan, error) {
+	plan := dryrun.New()
+	sambaShares, nfsShares := splitShares(shares)
+
+	if len(sambaShares) > 0 {
+		content, err := m.renderSambaConfig(sambaShares)
+		if err != nil {
+			return nil, fmt.Errorf("generate samba config: %w", err)
+		}
+		plan.AddFile(m.sambaConfig, content)
+		plan.AddCommand("testparm", "-s", m.sambaConfig)
+		plan.AddCommand("systemctl", "reload", "smbd")
 	}
-	return nil
-}
 
-func (m *Manager) reloadSamba() error {
-	// Try systemctl reload first
-	cmd := exec.Command("systemctl", "reload", "smbd")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// Fallback to service command
-		cmd = exec.Command("service", "smbd", "reload")
-		output, err = cmd.CombinedOutput()
+	if len(nfsShares) > 0 {
+		content, err := m.renderNFSConfig(nfsShares)
 		if err != nil {
-			return fmt.Errorf("reload smbd: %w, output: %s", err, string(output))
+			return nil, fmt.Errorf("generate nfs config: %w", err)
 		}
+		plan.AddFile(m.nfsConfig, content)
+		plan.AddCommand("exportfs", "-ra")
 	}
-	return nil
+
+	m.planDLNA(plan, shares)
+	return plan, nil
 }
 
-func (m *Manager) reloadNFS() error {
-	cmd := exec.Command("exportfs", "-ra")
-	output, err := cmd.CombinedOutput()
+func (m *Manager) generateSambaConfig(shares []*Share) error {
+	content, err := m.renderSambaConfig(shares)
 	if err != nil {
-		return fmt.Errorf("exportfs: %w, output: %s", err, string(output))
+		return err
 	}
-	return nil
-}
-
-func (m *Manager) backupConfigs() error {
-	timestamp := time.Now().Unix()
 
-	// Backup Samba config
-	if _, err := os.Stat(m.sambaConfig); err == nil {
-		backupFile := filepath.Join(m.backupDir, fmt.Sprintf("smb.conf.%d", timestamp))
-		if err := m.copyFile(m.sambaConfig, backupFile); err != nil {
-			return fmt.Errorf("backup samba config: %w", err)
-		}
+	if err := os.WriteFile(m.sambaConfig+".new", []byte(content), 0644); err != nil {
+		return fmt.Errorf("create config file: %w", err)
 	}
 
-	// Backup NFS config
-	if _, err := os.Stat(m.nfsConfig); err == nil {
-		backupFile := filepath.Join(m.backupDir, fmt.Sprintf("exports.%d", timestamp))
-		if err := m.copyFile(m.nfsConfig, backupFile); err != nil {
-			return fmt.Errorf("backup nfs config: %w", err)
-		}
+	// Move new config to actual location
+	if err := os.Rename(m.sambaConfig+".new", m.sambaConfig); err != nil {
+		return fmt.Errorf("move config: %w", err)
 	}
 
-	// Clean old backups (keep last 10)
-	m.cleanOldBackups(10)
-
 	return nil
 }
 
-func (m *Manager) restoreConfig(backupFile, targetFile string) error {
-	return m.copyFile(backupFile, targetFile)
-}
-
-func (m *Manager) restoreLatestBackup() error {
-	// Find latest backup
-	files, err := os.ReadDir(m.backupDir)
+func (m *Manager) generateNFSConfig(shares []*Share) error {
+	content, err := m.renderNFSConfig(shares)
 	if err != nil {
 		return err
 	}
 
-	var latestSamba string
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), "smb.conf.") && file.Name() > latestSamba {
-			latestSamba = file.Name()
-		}
-	}
-
-	if latestSamba != "" {
-		backupFile := filepath.Join(m.backupDir, latestSamba)
-		return m.restoreConfig(backupFile, m.sambaConfig)
+	if err := os.WriteFile(m.nfsConfig, []byte(content), 0644); err != nil {
+		return fmt.Errorf("write nfs config: %w", err)
 	}
 
-	return fmt.Errorf("no backup found")
+	return nil
 }
 
-func (m *Manager) copyFile(src, dst string) error {
-	data, err := os.ReadFile(src)
+func (m *Manager) testSambaConfig(ctx context.Context) error {
+	output, err := sysexec.CombinedOutput(ctx, "testparm", "-s", m.sambaConfig)
 	if err != nil {
-		return err
+		return fmt.Errorf("testparm failed: %w, output: %s", err, string(output))
 	}
-	return os.WriteFile(dst, data, 0644)
+	return nil
 }
 
-func (m *Manager) cleanOldBackups(keep int) {
-	files, err := os.ReadDir(m.backupDir)
+func (m *Manager) reloadSamba(ctx context.Context) error {
+	// Try systemctl reload first
+	output, err := sysexec.CombinedOutput(ctx, "systemctl", "reload", "smbd")
 	if err != nil {
-		return
-	}
+		if ctx.Err() != nil {
+			return fmt.Errorf("reload smbd: %w", err)
+		}
 
-	if len(files) <= keep {
-		return
+		// Fallback to service command
+		output, err = sysexec.CombinedOutput(ctx, "service", "smbd", "reload")
+		if err != nil {
+			return fmt.Errorf("reload smbd: %w, output: %s", err, string(output))
+		}
 	}
+	return nil
+}
 
-	// Sort by name (timestamp-based) and remove oldest
-	for i := 0; i < len(files)-keep; i++ {
-		os.Remove(filepath.Join(m.backupDir, files[i].Name()))
+func (m *Manager) reloadNFS(ctx context.Context) error {
+	output, err := sysexec.CombinedOutput(ctx, "exportfs", "-ra")
+	if err != nil {
+		return fmt.Errorf("exportfs: %w, output: %s", err, string(output))
 	}
+	return nil
 }
 
 func (m *Manager) healthMonitor() {
@@ -611,6 +927,7 @@ func (m *Manager) healthMonitor() {
 	for {
 		select {
 		case <-ticker.C:
+			m.deleteExpired()
 			m.checkAllShares()
 		case <-m.stopMonitor:
 			return
@@ -619,21 +936,50 @@ func (m *Manager) healthMonitor() {
 }
 
 func (m *Manager) checkAllShares() {
+	m.mu.RLock()
+	var ids, paths []string
+	for id, share := range m.shares {
+		if share.Enabled {
+			ids = append(ids, id)
+			paths = append(paths, share.Path)
+		}
+	}
+	m.mu.RUnlock()
+
+	// Check if paths are still accessible without holding the lock, so a
+	// hung filesystem does not block API reads
+	healthy := make([]bool, len(ids))
+	healthcheck.ForEach(len(ids), m.checkWorkers, func(i int) {
+		healthy[i] = healthcheck.Stat(paths[i], m.checkTimeout) == nil
+	})
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, share := range m.shares {
-		if !share.Enabled {
+	now := time.Now()
+	changed := false
+	for i, id := range ids {
+		share, exists := m.shares[id]
+		if !exists || share.Path != paths[i] {
 			continue
 		}
-
-		// Check if path is still accessible
-		_, err := os.Stat(share.Path)
-		share.Healthy = err == nil
-		share.LastChecked = time.Now()
+		if healthy[i] != share.Healthy {
+			changed = true
+			m.bus.Publish("share.health", map[string]interface{}{
+				"id":      share.ID,
+				"name":    share.Name,
+				"path":    share.Path,
+				"healthy": healthy[i],
+			})
+		}
+		share.Healthy = healthy[i]
+		share.LastChecked = now
 	}
 
-	m.saveState()
+	// LastChecked alone is not worth a state write
+	if changed {
+		m.saver.Trigger()
+	}
 }
 
 func (m *Manager) saveState() error {
@@ -647,7 +993,7 @@ func (m *Manager) saveState() error {
 		return fmt.Errorf("marshal state: %w", err)
 	}
 
-	if err := os.WriteFile(m.stateFile, data, 0600); err != nil {
+	if err := statefile.Write(m.stateFile, data, 0600); err != nil {
 		return fmt.Errorf("write state file: %w", err)
 	}
 
@@ -655,14 +1001,9 @@ func (m *Manager) saveState() error {
 }
 
 func (m *Manager) loadState() error {
-	data, err := os.ReadFile(m.stateFile)
-	if err != nil {
-		return err
-	}
-
 	var shares map[string]*Share
-	if err := json.Unmarshal(data, &shares); err != nil {
-		return fmt.Errorf("unmarshal state: %w", err)
+	if err := statefile.Read(m.stateFile, &shares); err != nil {
+		return err
 	}
 
 	m.shares = shares
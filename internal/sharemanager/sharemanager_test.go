@@ -0,0 +1,159 @@
+package sharemanager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+func TestGuestAccess(t *testing.T) {
+	tests := []struct {
+		name  string
+		share Share
+		want  bool
+	}{
+		{"samba private", Share{Type: ShareTypeSamba}, false},
+		{"samba guest ok", Share{Type: ShareTypeSamba, Options: map[string]string{"guest ok": "yes"}}, true},
+		{"samba public", Share{Type: ShareTypeSamba, Options: map[string]string{"public": "True"}}, true},
+		{"samba guest off", Share{Type: ShareTypeSamba, Options: map[string]string{"guest ok": "no"}}, false},
+		{"nfs default", Share{Type: ShareTypeNFS}, false},
+		{"nfs root squash", Share{Type: ShareTypeNFS, Options: map[string]string{"root_squash": ""}}, false},
+		{"nfs sys", Share{Type: ShareTypeNFS, Options: map[string]string{"sec": "sys"}}, false},
+		{"nfs all squash", Share{Type: ShareTypeNFS, Options: map[string]string{"all_squash": "", "anonuid": "1000"}}, true},
+		{"nfs sec none", Share{Type: ShareTypeNFS, Options: map[string]string{"sec": "sys:none"}}, true},
+		{"nfs kerberos squash", Share{Type: ShareTypeNFS, Options: map[string]string{"sec": "krb5p", "all_squash": ""}}, false},
+		{"nfs mixed squash", Share{Type: ShareTypeNFS, Options: map[string]string{"sec": "krb5:sys", "all_squash": ""}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.share.GuestAccess(); got != tt.want {
+				t.Fatalf("GuestAccess = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingDeletion(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"media", "backup"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+	}
+	smbConf := filepath.Join(dir, "smb.conf")
+	os.WriteFile(smbConf, []byte("[Media]\n   path = "+dir+"/media\n"), 0644)
+	exports := filepath.Join(dir, "exports")
+	os.WriteFile(exports, []byte(dir+"/backup *(rw,sync,no_subtree_check)\n"), 0644)
+
+	cfg := &Config{
+		AllowedPaths: []string{dir},
+		SambaConfig:  smbConf,
+		NFSConfig:    exports,
+		StateFile:    filepath.Join(dir, "state.json"),
+		DeleteGrace:  time.Hour,
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer m.Stop()
+	ctx := context.Background()
+	report, err := m.ImportShares(ctx)
+	if err != nil || len(report.Imported) != 2 {
+		t.Fatalf("ImportShares: %+v %v", report, err)
+	}
+	bus := events.NewBus(0)
+	m.SetEventBus(bus)
+	media, backup := report.Imported[0].ID, report.Imported[1].ID
+
+	if _, err := m.RemoveShare(ctx, "missing"); err == nil {
+		t.Fatal("expected removing an unknown share to fail")
+	}
+	if err := m.RestoreShare(ctx, media); !errors.Is(err, ErrNotPendingDelete) {
+		t.Fatalf("expected restoring a live share to fail, got %v", err)
+	}
+	if err := m.ConfirmRemoveShare(ctx, media); !errors.Is(err, ErrNotPendingDelete) {
+		t.Fatalf("expected confirming a live share to fail, got %v", err)
+	}
+
+	// Removing schedules the deletion, and removing again keeps the schedule
+	removed, err := m.RemoveShare(ctx, media)
+	if err != nil || removed.DeleteAt == nil || time.Until(*removed.DeleteAt) < 59*time.Minute {
+		t.Fatalf("expected the share to be deleted in an hour, got %+v %v", removed, err)
+	}
+	again, err := m.RemoveShare(ctx, media)
+	if err != nil || !again.DeleteAt.Equal(*removed.DeleteAt) {
+		t.Fatalf("expected the deletion to keep its time, got %+v %v", again, err)
+	}
+	if len(m.ListShares()) != 2 {
+		t.Fatal("expected the pending share to be listed until it is deleted")
+	}
+
+	// The schedule survives a restart
+	reloaded, err := New(cfg)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	reloaded.Stop()
+	if share, err := reloaded.GetShare(media); err != nil || share.DeleteAt == nil || !share.DeleteAt.Equal(*removed.DeleteAt) {
+		t.Fatalf("expected the pending deletion to be persisted, got %+v %v", share, err)
+	}
+
+	if err := m.RestoreShare(ctx, media); err != nil {
+		t.Fatalf("RestoreShare: %v", err)
+	}
+	if share, _ := m.GetShare(media); share.DeleteAt != nil {
+		t.Fatalf("expected the restored share to stay, got %+v", share)
+	}
+
+	// Shares whose grace period has ended are deleted by the monitor
+	for _, id := range []string{media, backup} {
+		if _, err := m.RemoveShare(ctx, id); err != nil {
+			t.Fatalf("RemoveShare: %v", err)
+		}
+	}
+	m.deleteExpired()
+	if len(m.ListShares()) != 2 {
+		t.Fatal("expected shares in their grace period to stay")
+	}
+	m.mu.Lock()
+	past := time.Now().Add(-time.Second)
+	m.shares[media].DeleteAt = &past
+	m.shares[backup].DeleteAt = &past
+	m.mu.Unlock()
+
+	m.deleteExpired()
+	if shares := m.ListShares(); len(shares) != 0 {
+		t.Fatalf("expected the expired shares to be deleted, got %+v", shares)
+	}
+
+	// Confirming skips the rest of the grace period
+	m.mu.Lock()
+	m.shares["photos"] = &Share{ID: "photos", Name: "Photos", Type: ShareTypeSamba, Path: filepath.Join(dir, "media")}
+	m.mu.Unlock()
+	if _, err := m.RemoveShare(ctx, "photos"); err != nil {
+		t.Fatalf("RemoveShare: %v", err)
+	}
+	if err := m.ConfirmRemoveShare(ctx, "photos"); err != nil {
+		t.Fatalf("ConfirmRemoveShare: %v", err)
+	}
+	if _, err := m.GetShare("photos"); err == nil {
+		t.Fatal("expected the confirmed share to be deleted")
+	}
+
+	_, published, _ := bus.SubscribeFrom(0, nil, 0)
+	var types []string
+	for _, event := range published {
+		types = append(types, event.Type)
+	}
+	want := []string{"share.delete_pending", "share.restored", "share.delete_pending", "share.delete_pending",
+		"share.deleted", "share.deleted", "share.delete_pending", "share.deleted"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+}
@@ -0,0 +1,428 @@
+package sharemanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+const nfsExportStatsFile = "/proc/fs/nfsd/export_stats"
+
+// UsageBucket aggregates share activity over one hour
+type UsageBucket struct {
+	Hour            time.Time `json:"hour"`
+	PeakConnections int       `json:"peak_connections"`
+	BytesRead       uint64    `json:"bytes_read"`
+	BytesWritten    uint64    `json:"bytes_written"`
+}
+
+// ShareStats holds access statistics and usage history for a share
+type ShareStats struct {
+	ShareID           string        `json:"share_id"`
+	Name              string        `json:"name"`
+	Type              ShareType     `json:"type"`
+	Path              string        `json:"path"`
+	Connections       int           `json:"connections"`
+	LastAccess        time.Time     `json:"last_access"`
+	TotalBytesRead    uint64        `json:"total_bytes_read"`
+	TotalBytesWritten uint64        `json:"total_bytes_written"`
+	TrackedSince      time.Time     `json:"tracked_since"`
+	History           []UsageBucket `json:"history"`
+}
+
+// nfsExportCounters holds the cumulative counters reported for one NFS export
+type nfsExportCounters struct {
+	Clients      int
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// GetShareStats returns access statistics for a share, limited to history newer than since
+func (m *Manager) GetShareStats(id string, since time.Time) (*ShareStats, error) {
+	m.statsMu.RLock()
+	defer m.statsMu.RUnlock()
+
+	stats, exists := m.stats[id]
+	if !exists {
+		return nil, fmt.Errorf("no statistics for share %s", id)
+	}
+
+	return stats.since(since), nil
+}
+
+// ListShareStats returns access statistics for all tracked shares
+func (m *Manager) ListShareStats(since time.Time) []*ShareStats {
+	m.statsMu.RLock()
+	defer m.statsMu.RUnlock()
+
+	result := make([]*ShareStats, 0, len(m.stats))
+	for _, stats := range m.stats {
+		result = append(result, stats.since(since))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// ListUnusedShares returns shares that have not been accessed for at least idle.
+// Shares tracked for less than idle are not reported.
+func (m *Manager) ListUnusedShares(idle time.Duration) []*ShareStats {
+	m.statsMu.RLock()
+	defer m.statsMu.RUnlock()
+
+	cutoff := time.Now().Add(-idle)
+	result := []*ShareStats{}
+	for _, stats := range m.stats {
+		if stats.TrackedSince.After(cutoff) {
+			continue
+		}
+		if stats.LastAccess.Before(cutoff) {
+			result = append(result, stats.since(time.Now()))
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastAccess.Before(result[j].LastAccess)
+	})
+
+	return result
+}
+
+func (s *ShareStats) since(since time.Time) *ShareStats {
+	copied := *s
+	copied.History = []UsageBucket{}
+	for _, bucket := range s.History {
+		if !bucket.Hour.Before(since.Truncate(time.Hour)) {
+			copied.History = append(copied.History, bucket)
+		}
+	}
+	return &copied
+}
+
+func (m *Manager) statsSampler() {
+	ticker := time.NewTicker(m.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.sampleStats()
+		case <-m.stopMonitor:
+			return
+		}
+	}
+}
+
+// sampleStats records a sample and saves the statistics when it changed
+// them. A new last access alone is not worth a write to flash storage; it
+// is saved with the next change, at the latest with the next hour's bucket,
+// or by Stop.
+func (m *Manager) sampleStats() {
+	if m.recordStats(time.Now(), sampleSambaConnections(context.Background()), sampleNFSExports(nfsExportStatsFile)) {
+		m.saveStats()
+	}
+}
+
+// recordStats adds a sample of Samba connections per share name and NFS
+// counters per export path to the statistics of the current shares. It
+// reports whether anything but the last access times changed.
+func (m *Manager) recordStats(now time.Time, smbConnections map[string]int, nfsCounters map[string]nfsExportCounters) bool {
+	m.mu.RLock()
+	shares := make([]*Share, 0, len(m.shares))
+	for _, share := range m.shares {
+		shares = append(shares, share)
+	}
+	m.mu.RUnlock()
+
+	hour := now.Truncate(time.Hour)
+	cutoff := now.Add(-m.statsRetention)
+
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	changed := false
+	current := make(map[string]bool, len(shares))
+	for _, share := range shares {
+		current[share.ID] = true
+
+		stats, exists := m.stats[share.ID]
+		if !exists {
+			stats = &ShareStats{ShareID: share.ID, TrackedSince: now}
+			m.stats[share.ID] = stats
+		}
+		if stats.Name != share.Name || stats.Type != share.Type || stats.Path != share.Path {
+			changed = true
+		}
+		stats.Name = share.Name
+		stats.Type = share.Type
+		stats.Path = share.Path
+
+		var connections int
+		var bytesRead, bytesWritten uint64
+		switch share.Type {
+		case ShareTypeSamba:
+			connections = smbConnections[share.Name]
+		case ShareTypeNFS:
+			counters := nfsCounters[share.Path]
+			connections = counters.Clients
+			// The first sample after a start is the baseline; the counters
+			// hold everything since nfsd started
+			if last, sampled := m.nfsLast[share.Path]; sampled {
+				bytesRead = counterDelta(last.BytesRead, counters.BytesRead)
+				bytesWritten = counterDelta(last.BytesWritten, counters.BytesWritten)
+			}
+			m.nfsLast[share.Path] = counters
+		}
+
+		if connections != stats.Connections || bytesRead > 0 || bytesWritten > 0 {
+			changed = true
+		}
+		stats.Connections = connections
+		stats.TotalBytesRead += bytesRead
+		stats.TotalBytesWritten += bytesWritten
+		if connections > 0 || bytesRead > 0 || bytesWritten > 0 {
+			stats.LastAccess = now
+			m.statsUnsaved = true
+		}
+
+		if n := len(stats.History); n == 0 || !stats.History[n-1].Hour.Equal(hour) {
+			stats.History = append(stats.History, UsageBucket{Hour: hour})
+			changed = true
+		}
+		bucket := &stats.History[len(stats.History)-1]
+		if connections > bucket.PeakConnections {
+			bucket.PeakConnections = connections
+		}
+		bucket.BytesRead += bytesRead
+		bucket.BytesWritten += bytesWritten
+
+		// Drop history older than the retention window
+		keep := 0
+		for keep < len(stats.History) && stats.History[keep].Hour.Before(cutoff) {
+			keep++
+		}
+		stats.History = stats.History[keep:]
+		changed = changed || keep > 0
+	}
+
+	// Forget statistics of removed shares
+	for id := range m.stats {
+		if !current[id] {
+			delete(m.stats, id)
+			changed = true
+		}
+	}
+
+	if changed {
+		m.statsUnsaved = true
+	}
+	return changed
+}
+
+// counterDelta returns the increase of a cumulative counter, treating a
+// decrease as a reset (nfsd restart or export cache flush)
+func counterDelta(previous, current uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// sampleSambaConnections counts active connections per Samba share using smbstatus
+func sampleSambaConnections(ctx context.Context) map[string]int {
+	connections := make(map[string]int)
+
+	if _, err := exec.LookPath("smbstatus"); err != nil {
+		return connections
+	}
+
+	output, err := sysexec.Output(ctx, "smbstatus", "-S")
+	if err != nil {
+		return connections
+	}
+
+	return parseSmbstatusShares(output)
+}
+
+// parseSmbstatusShares parses the share table printed by "smbstatus -S"
+func parseSmbstatusShares(output []byte) map[string]int {
+	connections := make(map[string]int)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	header := ""
+	pidColumn := -1 // Set once the table starts
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if strings.HasPrefix(line, "---") {
+			pidColumn = max(strings.Index(header, "pid"), 0)
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if pidColumn < 0 {
+			header = line
+			continue
+		}
+
+		name, ok := smbstatusShareName(line, pidColumn)
+		if !ok || strings.HasSuffix(name, "$") {
+			continue
+		}
+		connections[name]++
+	}
+
+	return connections
+}
+
+// smbstatusShareName returns the share of a row of the share table: the
+// text before the PID. Share names may contain spaces and numbers, and long
+// ones push the other columns right, so the PID is the first number at or
+// after the PID column of the header that is padded to the column's width
+// of 7 like smbstatus pads it.
+func smbstatusShareName(line string, pidColumn int) (string, bool) {
+	end := 0
+	for {
+		start := end
+		for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+			start++
+		}
+		if start == len(line) {
+			return "", false
+		}
+		end = start
+		for end < len(line) && line[end] != ' ' && line[end] != '\t' {
+			end++
+		}
+		if start == 0 || start < pidColumn || end == len(line) {
+			continue
+		}
+		if _, err := strconv.ParseUint(line[start:end], 10, 32); err != nil {
+			continue
+		}
+		next := max(start+8, end+1)
+		if next < len(line) && strings.TrimSpace(line[end:next]) == "" && line[next] != ' ' {
+			return strings.TrimSpace(line[:start]), true
+		}
+	}
+}
+
+// sampleNFSExports reads per-export client counts and IO counters from nfsd
+func sampleNFSExports(path string) map[string]nfsExportCounters {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return map[string]nfsExportCounters{}
+	}
+
+	return parseNFSExportStats(data)
+}
+
+// parseNFSExportStats parses /proc/fs/nfsd/export_stats. Each export/client
+// pair is listed on an unindented line followed by indented counters.
+func parseNFSExportStats(data []byte) map[string]nfsExportCounters {
+	counters := make(map[string]nfsExportCounters)
+
+	var current string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			fields := strings.Fields(line)
+			current = filepath.Clean(fields[0])
+			entry := counters[current]
+			entry.Clients++
+			counters[current] = entry
+			continue
+		}
+
+		if current == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		entry := counters[current]
+		switch key {
+		case "io_read":
+			entry.BytesRead += n
+		case "io_write":
+			entry.BytesWritten += n
+		}
+		counters[current] = entry
+	}
+
+	return counters
+}
+
+// saveStats writes the statistics if samples were recorded since they were
+// last saved
+func (m *Manager) saveStats() error {
+	if m.statsFile == "" {
+		return nil
+	}
+
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	if !m.statsUnsaved {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.statsFile), 0755); err != nil {
+		return fmt.Errorf("create stats directory: %w", err)
+	}
+
+	data, err := json.Marshal(m.stats)
+	if err != nil {
+		return fmt.Errorf("marshal stats: %w", err)
+	}
+
+	if err := statefile.Write(m.statsFile, data, 0600); err != nil {
+		return fmt.Errorf("write stats file: %w", err)
+	}
+
+	m.statsUnsaved = false
+	return nil
+}
+
+func (m *Manager) loadStats() error {
+	if m.statsFile == "" {
+		return nil
+	}
+
+	var stats map[string]*ShareStats
+	if err := statefile.Read(m.statsFile, &stats); err != nil {
+		return err
+	}
+
+	if stats != nil {
+		m.stats = stats
+	}
+	return nil
+}
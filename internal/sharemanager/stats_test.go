@@ -0,0 +1,176 @@
+package sharemanager
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSmbstatusShares(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected map[string]int
+	}{
+		{
+			"shares and hidden shares",
+			`
+Service      pid     Machine       Connected at                     Encryption   Signing
+---------------------------------------------------------------------------------------------
+IPC$         4321    192.168.1.20  Fri Oct 16 09:12:01 AM 2026 UTC  -            -
+media        4321    192.168.1.20  Fri Oct 16 09:12:01 AM 2026 UTC  -            -
+media        4388    192.168.1.31  Fri Oct 16 09:40:12 AM 2026 UTC  -            -
+backup       1234567 nas-client    Fri Oct 16 09:41:00 AM 2026 UTC  -            -
+`,
+			map[string]int{"media": 2, "backup": 1},
+		},
+		{
+			"names with spaces and numbers",
+			`
+Service      pid     Machine       Connected at                     Encryption   Signing
+---------------------------------------------------------------------------------------------
+my photos    4321    192.168.1.20  Fri Oct 16 09:12:01 AM 2026 UTC  -            -
+backup 2     4322    192.168.1.20  Fri Oct 16 09:12:01 AM 2026 UTC  -            -
+family archive 2020 4323    192.168.1.20  Fri Oct 16 09:12:01 AM 2026 UTC  -            -
+`,
+			map[string]int{"my photos": 1, "backup 2": 1, "family archive 2020": 1},
+		},
+		{"no table", "smbstatus: not running\n", map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSmbstatusShares([]byte(tt.output)); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseNFSExportStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected map[string]nfsExportCounters
+	}{
+		{
+			"two clients of one export",
+			`# Version 1.1
+/srv/nfs/media 192.168.1.20
+	io_read: 4096
+	io_write: 1024
+/srv/nfs/media/ 192.168.1.31
+	io_read: 100
+	ops: 12
+/srv/nfs/backup 192.168.1.20
+	io_write: 8
+`,
+			map[string]nfsExportCounters{
+				"/srv/nfs/media":  {Clients: 2, BytesRead: 4196, BytesWritten: 1024},
+				"/srv/nfs/backup": {Clients: 1, BytesWritten: 8},
+			},
+		},
+		{
+			"counters without an export",
+			"\tio_read: 10\nbad line without counters\n\tio_read: x\n",
+			map[string]nfsExportCounters{"bad": {Clients: 1}},
+		},
+		{"empty", "", map[string]nfsExportCounters{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseNFSExportStats([]byte(tt.data)); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct{ previous, current, expected uint64 }{
+		{100, 150, 50},
+		{100, 100, 0},
+		{100, 30, 30}, // Reset
+	}
+	for _, tt := range tests {
+		if got := counterDelta(tt.previous, tt.current); got != tt.expected {
+			t.Errorf("counterDelta(%d, %d): expected %d, got %d", tt.previous, tt.current, tt.expected, got)
+		}
+	}
+}
+
+func TestRecordStatsNFSBaseline(t *testing.T) {
+	m := &Manager{
+		shares:         map[string]*Share{"media": {ID: "media", Name: "media", Type: ShareTypeNFS, Path: "/srv/nfs/media"}},
+		stats:          make(map[string]*ShareStats),
+		nfsLast:        make(map[string]nfsExportCounters),
+		statsRetention: 24 * time.Hour,
+	}
+	now := time.Now()
+	sample := func(read, written uint64) {
+		now = now.Add(time.Minute)
+		m.recordStats(now, nil, map[string]nfsExportCounters{
+			"/srv/nfs/media": {Clients: 1, BytesRead: read, BytesWritten: written},
+		})
+	}
+
+	// Counters since nfsd started, before the agent did
+	sample(10<<30, 1<<30)
+	stats := m.stats["media"]
+	if stats.TotalBytesRead != 0 || stats.TotalBytesWritten != 0 || stats.History[0].BytesRead != 0 {
+		t.Fatalf("expected the first sample to be a baseline, got %+v", stats)
+	}
+
+	sample(10<<30+500, 1<<30+20)
+	if stats.TotalBytesRead != 500 || stats.TotalBytesWritten != 20 {
+		t.Fatalf("expected 500 bytes read and 20 written, got %d and %d", stats.TotalBytesRead, stats.TotalBytesWritten)
+	}
+	if stats.Connections != 1 || !stats.LastAccess.Equal(now) {
+		t.Fatalf("expected one connection at the last sample, got %+v", stats)
+	}
+}
+
+func TestStatsSavedOnChange(t *testing.T) {
+	statsFile := filepath.Join(t.TempDir(), "stats.json")
+	m := &Manager{
+		shares:         map[string]*Share{"media": {ID: "media", Name: "media", Type: ShareTypeSamba, Path: "/srv/media"}},
+		stats:          make(map[string]*ShareStats),
+		nfsLast:        make(map[string]nfsExportCounters),
+		statsFile:      statsFile,
+		statsRetention: 24 * time.Hour,
+	}
+	now := time.Now().Truncate(time.Hour)
+	sample := func(connections int) bool {
+		now = now.Add(time.Minute)
+		changed := m.recordStats(now, map[string]int{"media": connections}, nil)
+		if changed {
+			m.saveStats()
+		}
+		return changed
+	}
+	saved := func() bool {
+		_, err := os.Stat(statsFile)
+		os.Remove(statsFile)
+		return err == nil
+	}
+
+	if !sample(1) || !saved() {
+		t.Fatal("expected the first sample to be saved")
+	}
+	if sample(1) || saved() {
+		t.Fatal("expected an unchanged connection count not to be saved")
+	}
+	if !sample(2) || !saved() {
+		t.Fatal("expected a new connection count to be saved")
+	}
+
+	// The last access of the unchanged sample is saved on Stop
+	sample(2)
+	if m.saveStats(); !saved() {
+		t.Fatal("expected the pending last access to be saved")
+	}
+	if m.saveStats(); saved() {
+		t.Fatal("expected nothing to be saved without new samples")
+	}
+}
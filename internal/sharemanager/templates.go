@@ -0,0 +1,180 @@
+package sharemanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Template files that override the built-in templates when present in the
+// template directory
+const (
+	SambaGlobalTemplate = "samba-global.tmpl" // The [global] section
+	SambaShareTemplate  = "samba-share.tmpl"  // Rendered once per Samba share
+	NFSExportTemplate   = "nfs-export.tmpl"   // One /etc/exports line per NFS share
+)
+
+var builtinTemplates = map[string]string{
+	SambaGlobalTemplate: `[global]
+   workgroup = WORKGROUP
+   server string = Mingyue Agent Share
+   security = user
+   map to guest = Bad User
+   log file = /var/log/samba/log.%m
+   max log size = 50
+`,
+
+	SambaShareTemplate: `
+[{{ .Name }}]
+   path = {{ .Path }}
+   {{ if .Description }}comment = {{ .Description }}{{ end }}
+   {{ if eq .AccessMode "ro" }}read only = yes{{ else }}read only = no{{ end }}
+   browseable = yes
+   {{ if .Users }}valid users = {{ join .Users " " }}{{ end }}
+   create mask = 0664
+   directory mask = 0775
+{{ if .VFSObjects }}   vfs objects = {{ .VFSObjects }}
+{{ end }}{{ if .Audit }}   full_audit:prefix = %u|%I|%S
+   full_audit:success = mkdirat renameat unlinkat openat pwrite write fchmod fchown
+   full_audit:failure = unlinkat renameat
+   full_audit:facility = {{ .AuditFacility }}
+   full_audit:priority = notice
+{{ end }}{{ range $key, $value := .Options }}   {{ $key }} = {{ $value }}
+{{ end }}`,
+
+	NFSExportTemplate: `{{ .Path }} *({{ if eq .AccessMode "ro" }}ro{{ else }}rw{{ end }},sync,no_subtree_check` +
+		`{{ range $key, $value := .Options }},{{ $key }}{{ if $value }}={{ $value }}{{ end }}{{ end }})`,
+}
+
+// globalData is passed to the Samba global template
+type globalData struct {
+	Timestamp     time.Time
+	Shares        []*Share
+	Audit         bool
+	AuditFacility string
+}
+
+// shareData is passed to the per-share templates
+type shareData struct {
+	*Share
+	Options       map[string]string // Samba shares: without "vfs objects"
+	Audit         bool
+	AuditFacility string
+	VFSObjects    string // Samba shares: the share's VFS modules and full_audit
+}
+
+// loadTemplate parses the operator's template from the template directory,
+// or the built-in one when there is none
+func (m *Manager) loadTemplate(name string) (*template.Template, error) {
+	text := builtinTemplates[name]
+	if m.templateDir != "" {
+		path := filepath.Join(m.templateDir, name)
+		data, err := os.ReadFile(path)
+		if err == nil {
+			text = string(data)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("read template %s: %w", path, err)
+		}
+	}
+
+	t, err := template.New(name).Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// checkTemplates parses all templates so mistakes surface at startup
+func (m *Manager) checkTemplates() error {
+	for name := range builtinTemplates {
+		if _, err := m.loadTemplate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) renderSambaConfig(shares []*Share) (string, error) {
+	global, err := m.loadTemplate(SambaGlobalTemplate)
+	if err != nil {
+		return "", err
+	}
+	share, err := m.loadTemplate(SambaShareTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# Generated by mingyue-agent at %s\n", time.Now())
+	if err := global.Execute(&buf, globalData{
+		Timestamp:     time.Now(),
+		Shares:        shares,
+		Audit:         m.auditEnabled,
+		AuditFacility: m.auditFacility,
+	}); err != nil {
+		return "", fmt.Errorf("execute template %s: %w", SambaGlobalTemplate, err)
+	}
+
+	for _, s := range shares {
+		if err := share.Execute(&buf, m.sambaShareData(s)); err != nil {
+			return "", fmt.Errorf("execute template %s for share %s: %w", SambaShareTemplate, s.Name, err)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+func (m *Manager) renderNFSConfig(shares []*Share) (string, error) {
+	export, err := m.loadTemplate(NFSExportTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	buf.WriteString("# Generated by mingyue-agent\n")
+	for _, s := range shares {
+		var line strings.Builder
+		if err := export.Execute(&line, m.shareData(s)); err != nil {
+			return "", fmt.Errorf("execute template %s for share %s: %w", NFSExportTemplate, s.Name, err)
+		}
+		buf.WriteString(strings.TrimRight(line.String(), "\n") + "\n")
+	}
+	return buf.String(), nil
+}
+
+func (m *Manager) shareData(share *Share) shareData {
+	return shareData{
+		Share:         share,
+		Options:       share.Options,
+		Audit:         m.auditEnabled,
+		AuditFacility: m.auditFacility,
+	}
+}
+
+// sambaShareData returns the template data of a Samba share, with the VFS
+// modules of its "vfs objects" option and full_audit merged, as Samba only
+// reads one "vfs objects" line per share
+func (m *Manager) sambaShareData(share *Share) shareData {
+	data := m.shareData(share)
+	data.Options = make(map[string]string, len(share.Options))
+	var modules []string
+	for key, value := range share.Options {
+		// Samba ignores case and spaces in option names
+		if name := strings.ToLower(strings.ReplaceAll(key, " ", "")); name == "vfsobjects" || name == "vfsobject" {
+			modules = append(modules, strings.Fields(value)...)
+			continue
+		}
+		data.Options[key] = value
+	}
+	if data.Audit && !slices.Contains(modules, "full_audit") {
+		modules = append(modules, "full_audit")
+	}
+	data.VFSObjects = strings.Join(modules, " ")
+	return data
+}
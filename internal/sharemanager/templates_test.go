@@ -0,0 +1,88 @@
+package sharemanager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderBuiltinTemplates(t *testing.T) {
+	m := &Manager{}
+	shares := []*Share{{
+		Name:       "media",
+		Path:       "/data/media",
+		AccessMode: AccessModeReadOnly,
+		Users:      []string{"alice", "bob"},
+		Options:    map[string]string{"all_squash": "", "anonuid": "1000"},
+	}}
+
+	samba, err := m.renderSambaConfig(shares)
+	if err != nil {
+		t.Fatalf("renderSambaConfig: %v", err)
+	}
+	for _, want := range []string{"[global]", "[media]", "path = /data/media", "read only = yes", "valid users = alice bob"} {
+		if !strings.Contains(samba, want) {
+			t.Errorf("samba config missing %q:\n%s", want, samba)
+		}
+	}
+
+	nfs, err := m.renderNFSConfig(shares)
+	if err != nil {
+		t.Fatalf("renderNFSConfig: %v", err)
+	}
+	if want := "/data/media *(ro,sync,no_subtree_check,all_squash,anonuid=1000)\n"; !strings.HasSuffix(nfs, want) {
+		t.Fatalf("expected export line %q, got:\n%s", want, nfs)
+	}
+}
+
+func TestCustomTemplates(t *testing.T) {
+	dir := t.TempDir()
+	global := "[global]\n   workgroup = HOME\n"
+	if err := os.WriteFile(filepath.Join(dir, SambaGlobalTemplate), []byte(global), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{templateDir: dir}
+	samba, err := m.renderSambaConfig([]*Share{{Name: "media", Path: "/data/media"}})
+	if err != nil {
+		t.Fatalf("renderSambaConfig: %v", err)
+	}
+	if !strings.Contains(samba, "workgroup = HOME") || strings.Contains(samba, "WORKGROUP") {
+		t.Fatalf("custom global section not used:\n%s", samba)
+	}
+	if !strings.Contains(samba, "[media]") {
+		t.Fatalf("built-in share template not used:\n%s", samba)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, NFSExportTemplate), []byte("{{ .Path"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkTemplates(); err == nil {
+		t.Fatalf("expected a parse error for a broken template")
+	}
+}
+
+func TestRenderSambaAuditVFSObjects(t *testing.T) {
+	m := &Manager{auditEnabled: true, auditFacility: "local5"}
+	samba, err := m.renderSambaConfig([]*Share{
+		{Name: "mac", Path: "/data/mac", Options: map[string]string{"vfs objects": "catia fruit streams_xattr", "fruit:metadata": "stream"}},
+		{Name: "plain", Path: "/data/plain"},
+	})
+	if err != nil {
+		t.Fatalf("renderSambaConfig: %v", err)
+	}
+	if strings.Count(samba, "vfs objects") != 2 {
+		t.Fatalf("expected one vfs objects line per share:\n%s", samba)
+	}
+	for _, want := range []string{
+		"vfs objects = catia fruit streams_xattr full_audit\n",
+		"vfs objects = full_audit\n",
+		"fruit:metadata = stream\n",
+		"full_audit:facility = local5\n",
+	} {
+		if !strings.Contains(samba, want) {
+			t.Errorf("samba config missing %q:\n%s", want, samba)
+		}
+	}
+}
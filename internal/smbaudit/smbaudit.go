@@ -0,0 +1,295 @@
+package smbaudit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// syslogTag is the program name vfs_full_audit logs under
+const syslogTag = "smbd_audit:"
+
+// Event is a single file operation reported by vfs_full_audit
+type Event struct {
+	Time      time.Time // From the syslog line; when it was read if the line has none
+	User      string
+	SourceIP  string
+	Share     string
+	Operation string
+	Success   bool
+	Paths     []string
+	Raw       string
+}
+
+// Ingester tails the Samba audit syslog file and records events in the audit log
+type Ingester struct {
+	logPath      string
+	stateFile    string
+	pollInterval time.Duration
+	audit        *audit.Logger
+	offset       int64
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+}
+
+// Config represents Samba audit ingestion configuration
+type Config struct {
+	LogPath      string
+	StateFile    string
+	PollInterval time.Duration
+}
+
+type ingestState struct {
+	Offset int64 `json:"offset"`
+}
+
+// New creates a new Samba audit ingester
+func New(cfg *Config, auditLogger *audit.Logger) (*Ingester, error) {
+	if cfg.LogPath == "" {
+		return nil, fmt.Errorf("samba audit log path is required")
+	}
+
+	pollInterval := cfg.PollInterval
+	if pollInterval == 0 {
+		pollInterval = 2 * time.Second
+	}
+
+	ing := &Ingester{
+		logPath:      cfg.LogPath,
+		stateFile:    cfg.StateFile,
+		pollInterval: pollInterval,
+		audit:        auditLogger,
+		stopCh:       make(chan struct{}),
+	}
+
+	if err := ing.loadState(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+
+	return ing, nil
+}
+
+// Start begins tailing the audit log in the background
+func (ing *Ingester) Start(ctx context.Context) {
+	ing.wg.Add(1)
+	go ing.run(ctx)
+}
+
+// Stop stops tailing the audit log
+func (ing *Ingester) Stop() {
+	close(ing.stopCh)
+	ing.wg.Wait()
+}
+
+func (ing *Ingester) run(ctx context.Context) {
+	defer ing.wg.Done()
+
+	ticker := time.NewTicker(ing.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ing.poll(ctx); err != nil && !os.IsNotExist(err) {
+			log.Printf("samba audit ingestion: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ing.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ing *Ingester) poll(ctx context.Context) error {
+	f, err := os.Open(ing.logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+
+	// The file was rotated or truncated; start over from the beginning
+	if info.Size() < ing.offset {
+		ing.offset = 0
+	}
+	if info.Size() == ing.offset {
+		return nil
+	}
+
+	if _, err := f.Seek(ing.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek audit log: %w", err)
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Leave partial lines for the next poll
+			break
+		}
+		ing.offset += int64(len(line))
+
+		event, ok := ParseLine(strings.TrimRight(line, "\r\n"))
+		if !ok {
+			continue
+		}
+		ing.record(ctx, event)
+	}
+
+	return ing.saveState()
+}
+
+func (ing *Ingester) record(ctx context.Context, event *Event) {
+	if ing.audit == nil {
+		return
+	}
+
+	result := "success"
+	if !event.Success {
+		result = "failed"
+	}
+
+	resource := ""
+	if len(event.Paths) > 0 {
+		resource = event.Paths[0]
+	}
+
+	details := map[string]interface{}{
+		"protocol":  "smb",
+		"share":     event.Share,
+		"operation": event.Operation,
+	}
+	if len(event.Paths) > 1 {
+		details["target"] = event.Paths[1]
+	}
+
+	ing.audit.Log(ctx, &audit.Entry{
+		Timestamp: event.Time,
+		User:      event.User,
+		Action:    "smb." + event.Operation,
+		Resource:  resource,
+		Result:    result,
+		SourceIP:  event.SourceIP,
+		Details:   details,
+	})
+}
+
+// ParseLine parses a syslog line written by vfs_full_audit using the
+// "%u|%I|%S" prefix configured by the share manager, e.g.
+//
+//	Jan 10 12:00:00 nas smbd_audit: alice|192.168.1.20|photos|unlinkat|ok|/data/photos/a.jpg
+//
+// Lines may start with a traditional or an RFC 3339 timestamp, as rsyslog
+// writes them by default on newer systems.
+func ParseLine(line string) (*Event, bool) {
+	return parseLine(line, time.Now())
+}
+
+// parseLine parses a line read at now, which dates lines without a
+// timestamp and supplies the year of traditional ones
+func parseLine(line string, now time.Time) (*Event, bool) {
+	idx := strings.Index(line, syslogTag)
+	if idx < 0 {
+		return nil, false
+	}
+
+	fields := strings.Split(strings.TrimSpace(line[idx+len(syslogTag):]), "|")
+	if len(fields) < 5 {
+		return nil, false
+	}
+
+	event := &Event{
+		Time:      syslogTime(line[:idx], now),
+		User:      fields[0],
+		SourceIP:  fields[1],
+		Share:     fields[2],
+		Operation: fields[3],
+		Success:   fields[4] == "ok",
+		Raw:       line,
+	}
+	for _, path := range fields[5:] {
+		if path == "" {
+			continue
+		}
+		event.Paths = append(event.Paths, path)
+	}
+
+	return event, true
+}
+
+// syslogTime returns the timestamp at the start of a syslog line, or now.
+// Traditional timestamps have no year; they are taken to be in the last
+// year, unless that puts them more than a day ahead of now.
+func syslogTime(prefix string, now time.Time) time.Time {
+	fields := strings.Fields(prefix)
+	if len(fields) == 0 {
+		return now
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		return t
+	}
+	if len(fields) < 3 {
+		return now
+	}
+	t, err := time.ParseInLocation(time.Stamp, strings.Join(fields[:3], " "), now.Location())
+	if err != nil {
+		return now
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+func (ing *Ingester) saveState() error {
+	if ing.stateFile == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ing.stateFile), 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	data, err := json.Marshal(ingestState{Offset: ing.offset})
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := statefile.Write(ing.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+
+	return nil
+}
+
+func (ing *Ingester) loadState() error {
+	if ing.stateFile == "" {
+		return nil
+	}
+
+	var state ingestState
+	if err := statefile.Read(ing.stateFile, &state); err != nil {
+		return err
+	}
+
+	ing.offset = state.Offset
+	return nil
+}
@@ -0,0 +1,73 @@
+package smbaudit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Date(2026, time.January, 3, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		line     string
+		expected *Event
+	}{
+		{
+			"traditional timestamp",
+			"Jan  2 23:59:58 nas smbd_audit: alice|192.168.1.20|photos|unlinkat|ok|/data/photos/a.jpg",
+			&Event{
+				Time: time.Date(2026, time.January, 2, 23, 59, 58, 0, time.UTC),
+				User: "alice", SourceIP: "192.168.1.20", Share: "photos", Operation: "unlinkat", Success: true,
+				Paths: []string{"/data/photos/a.jpg"},
+			},
+		},
+		{
+			"timestamp of the previous year",
+			"Dec 31 23:00:00 nas smbd_audit: bob|192.168.1.31|docs|renameat|fail|/data/docs/a|/data/docs/b",
+			&Event{
+				Time: time.Date(2025, time.December, 31, 23, 0, 0, 0, time.UTC),
+				User: "bob", SourceIP: "192.168.1.31", Share: "docs", Operation: "renameat", Success: false,
+				Paths: []string{"/data/docs/a", "/data/docs/b"},
+			},
+		},
+		{
+			"RFC 3339 timestamp",
+			"2026-01-02T10:15:30.123456+01:00 nas smbd_audit: carol|10.0.0.5|media|mkdirat|ok|/data/media/new|",
+			&Event{
+				Time: time.Date(2026, time.January, 2, 10, 15, 30, 123456000, time.FixedZone("", 3600)),
+				User: "carol", SourceIP: "10.0.0.5", Share: "media", Operation: "mkdirat", Success: true,
+				Paths: []string{"/data/media/new"},
+			},
+		},
+		{
+			"no timestamp",
+			"smbd_audit: dave|10.0.0.6|media|openat|ok",
+			&Event{Time: now, User: "dave", SourceIP: "10.0.0.6", Share: "media", Operation: "openat", Success: true},
+		},
+		{"other program", "Jan  2 23:59:58 nas smbd[123]: connection closed", nil},
+		{"too few fields", "Jan  2 23:59:58 nas smbd_audit: alice|192.168.1.20|photos", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := parseLine(tt.line, now)
+			if tt.expected == nil {
+				if ok {
+					t.Fatalf("expected the line to be skipped, got %+v", event)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("expected the line to be parsed")
+			}
+			if !event.Time.Equal(tt.expected.Time) {
+				t.Errorf("expected time %s, got %s", tt.expected.Time, event.Time)
+			}
+			event.Time, tt.expected.Time = time.Time{}, time.Time{}
+			tt.expected.Raw = tt.line
+			if !reflect.DeepEqual(event, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, event)
+			}
+		})
+	}
+}
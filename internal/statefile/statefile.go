@@ -0,0 +1,223 @@
+// Package statefile writes the agent's JSON state files safely: a crash or
+// power loss leaves either the old or the new file, never a truncated one.
+// The previous generation is kept as a backup that Read falls back to.
+package statefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BackupSuffix is appended to a state file's path to name its backup
+const BackupSuffix = ".bak"
+
+// PrivateMode is the mode of state files and databases, which can hold
+// credentials and must only be readable by the agent
+const PrivateMode os.FileMode = 0600
+
+// sqliteSidecars are the files SQLite keeps next to a database
+var sqliteSidecars = []string{"-journal", "-wal", "-shm"}
+
+// PrepareDB makes the SQLite database at path private before it is opened:
+// a new database is created empty with PrivateMode, and an existing one and
+// its journal files are restricted to it. SQLite creates journals with the
+// mode of their database, so they stay private too.
+func PrepareDB(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, PrivateMode)
+	if err != nil {
+		return fmt.Errorf("create database %s: %w", path, err)
+	}
+	f.Close()
+
+	for _, suffix := range append([]string{""}, sqliteSidecars...) {
+		if err := os.Chmod(path+suffix, PrivateMode); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("restrict %s: %w", path+suffix, err)
+		}
+	}
+	return nil
+}
+
+// Read unmarshals the JSON state file at path into v. If the file is
+// missing, unreadable or corrupt but its backup is intact, the backup is
+// used and a warning logged. When neither exists the error from reading
+// path is returned, so os.IsNotExist works on it.
+func Read(path string, v interface{}) error {
+	err := readJSON(path, v)
+	if err == nil {
+		return nil
+	}
+
+	backup := path + BackupSuffix
+	if readJSON(backup, v) != nil {
+		return err
+	}
+
+	log.Printf("warning: state file %s is unusable (%v); restored from %s", path, err, backup)
+	return nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// Write replaces path with data by writing a temporary file in the same
+// directory, syncing it and renaming it over path. The replaced file is kept
+// as path+BackupSuffix.
+func Write(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+
+	if err := keepBackup(path); err != nil {
+		return fmt.Errorf("back up %s: %w", path, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// keepBackup makes the current file the backup generation. A hard link
+// keeps the old contents after the rename replaces path; filesystems without
+// hard links get a copy.
+func keepBackup(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	backup := path + BackupSuffix
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(path, backup); err == nil {
+		return nil
+	}
+	return copyFile(path, backup)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DefaultDelay is how long a Debouncer waits for more changes before saving
+const DefaultDelay = 10 * time.Second
+
+// Debouncer coalesces bursts of save requests into a single save after a
+// quiet period, to limit writes to flash storage
+type Debouncer struct {
+	delay   time.Duration
+	save    func()
+	timer   *time.Timer
+	pending bool
+	mu      sync.Mutex
+}
+
+// NewDebouncer creates a debouncer that calls save delay after the last
+// Trigger
+func NewDebouncer(delay time.Duration, save func()) *Debouncer {
+	return &Debouncer{
+		delay: delay,
+		save:  save,
+	}
+}
+
+// Trigger schedules a save, postponing any save already scheduled
+func (d *Debouncer) Trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(d.delay, d.fire)
+}
+
+// Flush runs a scheduled save immediately; call it on shutdown
+func (d *Debouncer) Flush() {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	pending := d.pending
+	d.pending = false
+	d.mu.Unlock()
+
+	if pending {
+		d.save()
+	}
+}
+
+func (d *Debouncer) fire() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = false
+	d.mu.Unlock()
+
+	if pending {
+		d.save()
+	}
+}
@@ -0,0 +1,122 @@
+package statefile
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	if err := Write(path, []byte("old"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := Write(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("expected new content, got %q (%v)", data, err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	backup, err := os.ReadFile(path + BackupSuffix)
+	if err != nil || string(backup) != "old" {
+		t.Fatalf("expected previous generation in backup, got %q (%v)", backup, err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("expected temp files to be cleaned up, found %d entries", len(entries))
+	}
+}
+
+func TestReadFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	var state map[string]int
+	if err := Read(path, &state); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error for missing file, got %v", err)
+	}
+
+	if err := Write(path, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := Write(path, []byte(`{"a":2}`), 0600); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	// Simulate a torn write
+	if err := os.WriteFile(path, []byte(`{"a":`), 0600); err != nil {
+		t.Fatalf("corrupt: %v", err)
+	}
+	if err := Read(path, &state); err != nil {
+		t.Fatalf("read with backup: %v", err)
+	}
+	if state["a"] != 1 {
+		t.Fatalf("expected backup contents, got %v", state)
+	}
+
+	os.Remove(path + BackupSuffix)
+	if err := Read(path, &state); err == nil {
+		t.Fatal("expected error for corrupt file without backup")
+	}
+}
+
+func TestDebouncerCoalescesSaves(t *testing.T) {
+	var saves int32
+	d := NewDebouncer(50*time.Millisecond, func() { atomic.AddInt32(&saves, 1) })
+
+	for i := 0; i < 5; i++ {
+		d.Trigger()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&saves); n != 1 {
+		t.Fatalf("expected 1 save, got %d", n)
+	}
+
+	d.Trigger()
+	d.Flush()
+	if n := atomic.LoadInt32(&saves); n != 2 {
+		t.Fatalf("expected flush to save, got %d saves", n)
+	}
+	d.Flush()
+	if n := atomic.LoadInt32(&saves); n != 2 {
+		t.Fatalf("expected no save without changes, got %d saves", n)
+	}
+}
+
+func TestPrepareDBRestrictsMode(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "auth.db")
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatalf("write db: %v", err)
+	}
+	if err := os.WriteFile(existing+"-wal", nil, 0644); err != nil {
+		t.Fatalf("write wal: %v", err)
+	}
+	created := filepath.Join(dir, "scheduler.db")
+
+	for _, path := range []string{existing, created} {
+		if err := PrepareDB(path); err != nil {
+			t.Fatalf("PrepareDB(%s): %v", path, err)
+		}
+	}
+	for _, path := range []string{existing, existing + "-wal", created} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat %s: %v", path, err)
+		}
+		if mode := info.Mode().Perm(); mode != PrivateMode {
+			t.Errorf("%s: expected mode %04o, got %04o", path, PrivateMode, mode)
+		}
+	}
+}
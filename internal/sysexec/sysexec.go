@@ -0,0 +1,119 @@
+// Package sysexec runs external commands bound to a context so that
+// cancelled API requests and shutdowns do not leave tools such as mount or
+// smartctl running. Commands run on behalf of a traced operation are
+// recorded as spans of it.
+package sysexec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/telemetry"
+)
+
+// DefaultTimeout bounds commands whose context has no deadline
+const DefaultTimeout = 30 * time.Second
+
+// waitDelay is how long to wait for output pipes after the process is
+// killed; helpers spawned by mount can otherwise keep them open
+const waitDelay = 5 * time.Second
+
+// Run runs a command and waits for it to finish
+func Run(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, name)
+	err := wrap(ctx, name, command(ctx, name, args...).Run())
+	endSpan(span, err)
+	return err
+}
+
+// Output runs a command and returns its standard output
+func Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, name)
+	output, err := command(ctx, name, args...).Output()
+	err = wrap(ctx, name, err)
+	endSpan(span, err)
+	return output, err
+}
+
+// CombinedOutput runs a command and returns its standard output and error
+func CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, name)
+	output, err := command(ctx, name, args...).CombinedOutput()
+	err = wrap(ctx, name, err)
+	endSpan(span, err)
+	return output, err
+}
+
+// CombinedOutputInput is CombinedOutput with input on standard input, for
+// secrets that must not show up in the process list
+func CombinedOutputInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, name)
+	cmd := command(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	err = wrap(ctx, name, err)
+	endSpan(span, err)
+	return output, err
+}
+
+// IsTimeout reports whether err is caused by a deadline
+func IsTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultTimeout)
+}
+
+// startSpan times a command under the traced operation in ctx. Arguments
+// are left out since they may carry passwords.
+func startSpan(ctx context.Context, name string) (context.Context, *telemetry.Span) {
+	ctx, span := telemetry.StartChild(ctx, "exec "+name, telemetry.KindInternal)
+	span.SetAttribute("exec.command", name)
+	return ctx, span
+}
+
+func endSpan(span *telemetry.Span, err error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		span.SetAttribute("exec.exit_code", exitErr.ExitCode())
+	}
+	span.SetError(err)
+	span.End()
+}
+
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+// wrap replaces the "signal: killed" error of a command stopped by its
+// context with one that matches context.DeadlineExceeded or context.Canceled
+func wrap(ctx context.Context, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctxErr := ctx.Err(); {
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		return fmt.Errorf("%s timed out: %w", name, ctxErr)
+	case ctxErr != nil:
+		return fmt.Errorf("%s cancelled: %w", name, ctxErr)
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package sysexec
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestDeadlineStopsCommand(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Run(ctx, "sleep", "10")
+	if !IsTimeout(err) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command was not stopped, ran for %s", elapsed)
+	}
+}
+
+func TestCancelIsNotTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err := Run(ctx, "sleep", "10")
+	if !errors.Is(err, context.Canceled) || IsTimeout(err) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+}
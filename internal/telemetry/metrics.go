@@ -0,0 +1,131 @@
+package telemetry
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxEndpoints bounds the endpoints tracked; requests for further paths are
+// counted under OtherPath so scans of unknown URLs can't grow memory
+const maxEndpoints = 512
+
+// OtherPath collects requests of untracked paths
+const OtherPath = "(other)"
+
+// latencyBounds are the upper bounds of the latency histogram in
+// milliseconds; a last bucket counts slower requests
+var latencyBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// EndpointStats summarizes the requests of one method and path since the
+// agent started
+type EndpointStats struct {
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Count        int64     `json:"count"`
+	ClientErrors int64     `json:"client_errors"` // 4xx responses
+	ServerErrors int64     `json:"server_errors"` // 5xx responses
+	AvgMs        float64   `json:"avg_ms"`
+	MaxMs        float64   `json:"max_ms"`
+	P50Ms        float64   `json:"p50_ms"` // Estimated from the histogram
+	P95Ms        float64   `json:"p95_ms"`
+	P99Ms        float64   `json:"p99_ms"`
+	LastAt       time.Time `json:"last_at"`
+	totalMs      float64
+	buckets      []int64
+}
+
+type endpointKey struct {
+	method string
+	path   string
+}
+
+var (
+	metricsMu sync.Mutex
+	endpoints = make(map[endpointKey]*EndpointStats)
+)
+
+// RecordRequest counts a finished request
+func RecordRequest(method, path string, status int, duration time.Duration) {
+	ms := float64(duration.Microseconds()) / 1000
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	key := endpointKey{method, path}
+	stats, exists := endpoints[key]
+	if !exists {
+		if len(endpoints) >= maxEndpoints {
+			key.path = OtherPath
+			stats = endpoints[key]
+		}
+		if stats == nil {
+			stats = &EndpointStats{Method: method, Path: key.path, buckets: make([]int64, len(latencyBounds)+1)}
+			endpoints[key] = stats
+		}
+	}
+
+	stats.Count++
+	switch {
+	case status >= 500:
+		stats.ServerErrors++
+	case status >= 400:
+		stats.ClientErrors++
+	}
+	stats.totalMs += ms
+	stats.MaxMs = math.Max(stats.MaxMs, ms)
+	stats.LastAt = time.Now()
+	stats.buckets[sort.SearchFloat64s(latencyBounds, ms)]++
+}
+
+// Endpoints returns the request statistics, slowest average first
+func Endpoints() []*EndpointStats {
+	metricsMu.Lock()
+	list := make([]*EndpointStats, 0, len(endpoints))
+	for _, stats := range endpoints {
+		snapshot := *stats
+		snapshot.buckets = append([]int64(nil), stats.buckets...)
+		list = append(list, &snapshot)
+	}
+	metricsMu.Unlock()
+
+	for _, stats := range list {
+		stats.AvgMs = math.Round(stats.totalMs/float64(stats.Count)*100) / 100
+		stats.P50Ms = stats.quantile(0.5)
+		stats.P95Ms = stats.quantile(0.95)
+		stats.P99Ms = stats.quantile(0.99)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].AvgMs != list[j].AvgMs {
+			return list[i].AvgMs > list[j].AvgMs
+		}
+		if list[i].Path != list[j].Path {
+			return list[i].Path < list[j].Path
+		}
+		return list[i].Method < list[j].Method
+	})
+	return list
+}
+
+// quantile estimates a latency quantile as the upper bound of the bucket
+// it falls in, capped at the slowest request seen
+func (s *EndpointStats) quantile(q float64) float64 {
+	rank := int64(math.Ceil(q * float64(s.Count)))
+	var seen int64
+	for i, count := range s.buckets {
+		seen += count
+		if seen >= rank && i < len(latencyBounds) {
+			return math.Min(latencyBounds[i], s.MaxMs)
+		}
+	}
+	return s.MaxMs
+}
+
+// ResetEndpoints clears the request statistics
+func ResetEndpoints() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	endpoints = make(map[endpointKey]*EndpointStats)
+}
@@ -0,0 +1,399 @@
+// Package telemetry records per-endpoint request metrics and traces of API
+// requests, manager operations and the commands they run, so slow
+// operations can be broken down by phase. Traces follow W3C Trace Context,
+// are exported to an OpenTelemetry collector over OTLP/HTTP and the slowest
+// recent requests are kept in memory for the API.
+//
+// Tracing is process-wide like the commands of sysexec: Setup installs the
+// tracer and Start is a cheap no-op until it has been called.
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	mathrand "math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds
+const (
+	KindInternal = "internal"
+	KindServer   = "server"
+	KindClient   = "client"
+)
+
+// maxSpansPerTrace bounds the spans kept for a slow trace
+const maxSpansPerTrace = 256
+
+// Config configures tracing
+type Config struct {
+	ServiceName    string
+	Endpoint       string            // OTLP/HTTP collector URL; spans are only kept locally if empty
+	Headers        map[string]string // Sent with every export, e.g. for authentication
+	SampleRatio    float64           // Share of traces exported; requests with a sampled traceparent always are
+	SlowThreshold  time.Duration     // Requests at least this slow are kept with all their spans
+	SlowKeep       int               // Number of slow traces kept
+	ExportInterval time.Duration
+}
+
+// SpanData is a finished span
+type SpanData struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	DurationMs float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Trace is a slow request with the spans recorded under it, in the order
+// they started
+type Trace struct {
+	TraceID    string      `json:"trace_id"`
+	Name       string      `json:"name"`
+	Start      time.Time   `json:"start"`
+	DurationMs float64     `json:"duration_ms"`
+	Error      string      `json:"error,omitempty"`
+	Spans      []*SpanData `json:"spans"`
+}
+
+// Tracer creates spans and hands finished ones to the exporter and the slow
+// trace store
+type Tracer struct {
+	sampleRatio   float64
+	slowThreshold time.Duration
+	slowKeep      int
+	exporter      *exporter
+	mu            sync.Mutex // Guards slow and the children of root spans
+	slow          []*Trace   // Newest last
+}
+
+var current atomic.Pointer[Tracer]
+
+// Setup installs a tracer built from cfg, replacing and flushing the
+// previous one
+func Setup(cfg *Config) error {
+	sampleRatio := cfg.SampleRatio
+	if sampleRatio < 0 || sampleRatio > 1 || math.IsNaN(sampleRatio) {
+		return fmt.Errorf("sample ratio must be between 0 and 1")
+	}
+
+	slowThreshold := cfg.SlowThreshold
+	if slowThreshold == 0 {
+		slowThreshold = time.Second
+	}
+
+	slowKeep := cfg.SlowKeep
+	if slowKeep == 0 {
+		slowKeep = 50
+	}
+
+	t := &Tracer{
+		sampleRatio:   sampleRatio,
+		slowThreshold: slowThreshold,
+		slowKeep:      slowKeep,
+	}
+	if cfg.Endpoint != "" {
+		exp, err := newExporter(cfg)
+		if err != nil {
+			return err
+		}
+		t.exporter = exp
+	}
+
+	if previous := current.Swap(t); previous != nil {
+		previous.shutdown(context.Background())
+	}
+	return nil
+}
+
+// Shutdown exports the remaining spans and stops tracing
+func Shutdown(ctx context.Context) error {
+	if t := current.Swap(nil); t != nil {
+		return t.shutdown(ctx)
+	}
+	return nil
+}
+
+func (t *Tracer) shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
+
+// Enabled reports whether spans are recorded
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// SlowTraces returns the kept slow traces, newest first
+func SlowTraces() []*Trace {
+	t := current.Load()
+	if t == nil {
+		return []*Trace{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	traces := make([]*Trace, 0, len(t.slow))
+	for i := len(t.slow) - 1; i >= 0; i-- {
+		traces = append(traces, t.slow[i])
+	}
+	return traces
+}
+
+// SlowTrace returns a kept slow trace by ID
+func SlowTrace(traceID string) (*Trace, bool) {
+	for _, trace := range SlowTraces() {
+		if trace.TraceID == traceID {
+			return trace, true
+		}
+	}
+	return nil, false
+}
+
+// Span is an operation being timed. A nil Span is valid and records
+// nothing, so callers need not check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	data     SpanData
+	root     *Span       // First span of the trace in this process
+	children []*SpanData // Finished spans under a root; guarded by tracer.mu
+	closed   bool        // Root has been recorded; guarded by tracer.mu
+	sampled  bool
+	mu       sync.Mutex
+	ended    bool
+}
+
+type spanKey struct{}
+
+// remoteParent is a span of another process, from a traceparent header
+type remoteParent struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+type remoteKey struct{}
+
+// Start starts a span named name, as a child of the span in ctx if there is
+// one, and returns a context carrying it
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindInternal)
+}
+
+// StartKind starts a span of the given kind
+func StartKind(ctx context.Context, name, kind string) (context.Context, *Span) {
+	return start(ctx, name, kind)
+}
+
+// StartChild starts a span only if ctx already carries one. Frequent
+// operations like commands use it so that only work done on behalf of a
+// traced operation is recorded.
+func StartChild(ctx context.Context, name, kind string) (context.Context, *Span) {
+	if FromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return start(ctx, name, kind)
+}
+
+func start(ctx context.Context, name, kind string) (context.Context, *Span) {
+	t := current.Load()
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			SpanID: newID(8),
+			Name:   name,
+			Kind:   kind,
+			Start:  time.Now(),
+		},
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentID = parent.data.SpanID
+		span.root = parent.root
+		span.sampled = parent.sampled
+	} else {
+		span.root = span
+		if remote, ok := ctx.Value(remoteKey{}).(*remoteParent); ok {
+			span.data.TraceID = remote.traceID
+			span.data.ParentID = remote.spanID
+			span.sampled = remote.sampled || t.sample()
+		} else {
+			span.data.TraceID = newID(16)
+			span.sampled = t.sample()
+		}
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *Tracer) sample() bool {
+	return t.sampleRatio >= 1 || (t.sampleRatio > 0 && mathrand.Float64() < t.sampleRatio)
+}
+
+// Run times fn as a span named name, marking the span failed if fn returns
+// an error
+func Run(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, span := Start(ctx, name)
+	err := fn(ctx)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// FromContext returns the span carried by ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// TraceID returns the trace ID of the span, or "" for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.data.TraceID
+}
+
+// SetAttribute records a key-value pair on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the span as failed with err; a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.data.DurationMs = float64(s.data.End.Sub(s.data.Start).Microseconds()) / 1000
+	data := s.data
+	s.mu.Unlock()
+
+	if s.sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.enqueue(&data)
+	}
+	s.tracer.record(s, &data)
+}
+
+// record keeps span data with the root span of its trace until the root
+// ends, then keeps the whole trace if the root was slow. Spans that end
+// after their root, like background work, are left out.
+func (t *Tracer) record(s *Span, data *SpanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s.root != s {
+		if !s.root.closed && len(s.root.children) < maxSpansPerTrace {
+			s.root.children = append(s.root.children, data)
+		}
+		return
+	}
+	children := s.children
+	s.children = nil
+	s.closed = true
+	if data.End.Sub(data.Start) < t.slowThreshold {
+		return
+	}
+
+	// Spans end before their parents, so order them by start time
+	all := append([]*SpanData{data}, children...)
+	for i := 1; i < len(all); i++ {
+		for j := i; j > 0 && all[j].Start.Before(all[j-1].Start); j-- {
+			all[j], all[j-1] = all[j-1], all[j]
+		}
+	}
+	t.slow = append(t.slow, &Trace{
+		TraceID:    data.TraceID,
+		Name:       data.Name,
+		Start:      data.Start,
+		DurationMs: data.DurationMs,
+		Error:      data.Error,
+		Spans:      all,
+	})
+	if len(t.slow) > t.slowKeep {
+		t.slow = t.slow[len(t.slow)-t.slowKeep:]
+	}
+}
+
+// Extract returns a context carrying the remote parent of a W3C
+// traceparent header. Malformed headers are ignored.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return ctx
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return ctx
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return context.WithValue(ctx, remoteKey{}, &remoteParent{
+		traceID: strings.ToLower(parts[1]),
+		spanID:  strings.ToLower(parts[2]),
+		sampled: flags[0]&1 != 0,
+	})
+}
+
+// Traceparent returns the W3C traceparent header for the span in ctx, or
+// "" if there is none
+func Traceparent(ctx context.Context) string {
+	span := FromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	return "00-" + span.data.TraceID + "-" + span.data.SpanID + "-" + flags
+}
+
+func newID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
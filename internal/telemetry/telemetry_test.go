@@ -0,0 +1,152 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowTracesAndExport(t *testing.T) {
+	var mu sync.Mutex
+	var exported []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		exported = append(exported, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	err := Setup(&Config{
+		Endpoint:      collector.URL,
+		Headers:       map[string]string{"Authorization": "Bearer secret"},
+		SampleRatio:   1,
+		SlowThreshold: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	defer Shutdown(context.Background())
+
+	// A fast request is not kept
+	_, fast := StartKind(context.Background(), "GET /api/v1/shares", KindServer)
+	fast.End()
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	ctx, root := StartKind(Extract(context.Background(), parent), "POST /api/v1/shares/create", KindServer)
+	if Traceparent(ctx) == "" || root.TraceID() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Fatalf("expected the remote trace to continue, got %q", root.TraceID())
+	}
+	Run(ctx, "sharemanager.backup", func(context.Context) error { return nil })
+	Run(ctx, "sharemanager.apply_samba", func(ctx context.Context) error {
+		_, exec := StartChild(ctx, "exec testparm", KindInternal)
+		time.Sleep(25 * time.Millisecond)
+		exec.SetError(errors.New("exit status 1"))
+		exec.End()
+		return errors.New("invalid samba config")
+	})
+	root.End()
+
+	traces := SlowTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected one slow trace, got %d", len(traces))
+	}
+	trace := traces[0]
+	if trace.Name != "POST /api/v1/shares/create" || len(trace.Spans) != 4 {
+		t.Fatalf("unexpected trace %+v", trace)
+	}
+	names := []string{"POST /api/v1/shares/create", "sharemanager.backup", "sharemanager.apply_samba", "exec testparm"}
+	for i, span := range trace.Spans {
+		if span.Name != names[i] {
+			t.Fatalf("expected span %d to be %s, got %s", i, names[i], span.Name)
+		}
+	}
+	if exec := trace.Spans[3]; exec.ParentID != trace.Spans[2].SpanID || exec.Error == "" {
+		t.Fatalf("unexpected exec span %+v", exec)
+	}
+	if _, found := SlowTrace(trace.TraceID); !found {
+		t.Fatal("expected to find the trace by ID")
+	}
+
+	// Shutdown exports what is queued
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exported) != 5 {
+		t.Fatalf("expected 5 exported spans, got %d", len(exported))
+	}
+	for _, span := range exported {
+		if span.Name == "sharemanager.apply_samba" && span.Status.Code != otlpStatusError {
+			t.Fatalf("expected an error status, got %+v", span)
+		}
+		if span.Name == "POST /api/v1/shares/create" && (span.Kind != 2 || span.ParentSpanID != "b7ad6b7169203331") {
+			t.Fatalf("unexpected server span %+v", span)
+		}
+	}
+}
+
+func TestDisabledTracing(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop")
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("ignored"))
+	span.End()
+	if span != nil || FromContext(ctx) != nil || Traceparent(ctx) != "" {
+		t.Fatal("expected no span while tracing is disabled")
+	}
+	if _, child := StartChild(ctx, "exec ls", KindInternal); child != nil {
+		t.Fatal("expected no child span without a parent")
+	}
+}
+
+func TestExtractRejectsMalformedHeaders(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-zzzzzzzzzzzzzzzz-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	} {
+		if ctx := Extract(context.Background(), header); ctx.Value(remoteKey{}) != nil {
+			t.Fatalf("expected %q to be ignored", header)
+		}
+	}
+}
+
+func TestEndpointMetrics(t *testing.T) {
+	ResetEndpoints()
+	defer ResetEndpoints()
+
+	for i := 0; i < 98; i++ {
+		RecordRequest(http.MethodGet, "/api/v1/shares", http.StatusOK, 3*time.Millisecond)
+	}
+	RecordRequest(http.MethodGet, "/api/v1/shares", http.StatusNotFound, 40*time.Millisecond)
+	RecordRequest(http.MethodGet, "/api/v1/shares", http.StatusBadGateway, 2*time.Second)
+	RecordRequest(http.MethodPost, "/api/v1/shares/create", http.StatusOK, 30*time.Second)
+
+	stats := Endpoints()
+	if len(stats) != 2 || stats[0].Path != "/api/v1/shares/create" {
+		t.Fatalf("expected the slowest endpoint first, got %+v", stats)
+	}
+	shares := stats[1]
+	if shares.Count != 100 || shares.ClientErrors != 1 || shares.ServerErrors != 1 {
+		t.Fatalf("unexpected counts %+v", shares)
+	}
+	if shares.P50Ms != 5 || shares.P99Ms != 50 || shares.MaxMs != 2000 {
+		t.Fatalf("unexpected latency %+v", shares)
+	}
+}
@@ -0,0 +1,232 @@
+// Package throttle limits transfer rates with token buckets. Transfers of
+// the same client share a bucket, so opening parallel downloads does not
+// raise a client's share of the uplink.
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// minBurst bounds how finely transfers are split, so slow rates still move
+// data in reasonably sized chunks
+const minBurst = 32 * 1024
+
+// idleTimeout is how long an unused bucket is kept
+const idleTimeout = 10 * time.Minute
+
+// Bucket is a token bucket refilled at a fixed number of bytes per second
+type Bucket struct {
+	mu       sync.Mutex
+	rate     float64 // Bytes per second
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+// NewBucket creates a full bucket for bytesPerSec. The burst is one second
+// worth of data.
+func NewBucket(bytesPerSec int64) *Bucket {
+	burst := float64(max(bytesPerSec, minBurst))
+	now := time.Now()
+	return &Bucket{
+		rate:     float64(bytesPerSec),
+		burst:    burst,
+		tokens:   burst,
+		last:     now,
+		lastUsed: now,
+	}
+}
+
+// SetRate changes the rate of the bucket, for transfers already running
+// too. A rate <= 0 lets everything through.
+func (b *Bucket) SetRate(bytesPerSec int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(bytesPerSec)
+	b.burst = float64(max(bytesPerSec, minBurst))
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// Rate returns the rate of the bucket in bytes per second
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// chunk is the largest transfer that should be charged at once
+func (b *Bucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.burst)
+}
+
+// Wait charges n bytes to the bucket and sleeps until they are covered.
+// The bucket may go into debt, so a large read is paid for afterwards
+// instead of being refused.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	if b.rate <= 0 {
+		b.last = now
+		b.lastUsed = now
+		b.mu.Unlock()
+		return nil
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.lastUsed = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Limiter hands out one bucket per client key
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewLimiter creates an empty limiter
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*Bucket)}
+}
+
+// Bucket returns the bucket of key, limited to bytesPerSec. A key whose
+// rate changed gets a new bucket. It returns nil for bytesPerSec <= 0,
+// which means unlimited.
+func (l *Limiter) Bucket(key string, bytesPerSec int64) *Bucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, bucket := range l.buckets {
+		bucket.mu.Lock()
+		idle := now.Sub(bucket.lastUsed) > idleTimeout
+		bucket.mu.Unlock()
+		if idle {
+			delete(l.buckets, k)
+		}
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok || bucket.rate != float64(bytesPerSec) {
+		bucket = NewBucket(bytesPerSec)
+		l.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// Reader limits reads from r to the rates of buckets, so each of them
+// holds. Nil buckets are skipped, and r is returned unchanged if all are.
+func Reader(ctx context.Context, r io.Reader, buckets ...*Bucket) io.Reader {
+	buckets = active(buckets)
+	if len(buckets) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, buckets: buckets}
+}
+
+type reader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*Bucket
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if size := chunk(r.buckets); len(p) > size {
+		p = p[:size]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := wait(r.ctx, r.buckets, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Writer limits writes to w to the rates of buckets, so each of them
+// holds. Nil buckets are skipped, and w is returned unchanged if all are.
+func Writer(ctx context.Context, w io.Writer, buckets ...*Bucket) io.Writer {
+	buckets = active(buckets)
+	if len(buckets) == 0 {
+		return w
+	}
+	return &writer{ctx: ctx, w: w, buckets: buckets}
+}
+
+type writer struct {
+	ctx     context.Context
+	w       io.Writer
+	buckets []*Bucket
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), chunk(w.buckets))]
+		if err := wait(w.ctx, w.buckets, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func active(buckets []*Bucket) []*Bucket {
+	var result []*Bucket
+	for _, bucket := range buckets {
+		if bucket != nil {
+			result = append(result, bucket)
+		}
+	}
+	return result
+}
+
+// chunk is the largest transfer all of buckets should be charged at once
+func chunk(buckets []*Bucket) int {
+	size := buckets[0].chunk()
+	for _, bucket := range buckets[1:] {
+		size = min(size, bucket.chunk())
+	}
+	return size
+}
+
+// wait charges n bytes to each of buckets in turn
+func wait(ctx context.Context, buckets []*Bucket, n int) error {
+	for _, bucket := range buckets {
+		if err := bucket.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriterLimitsRate(t *testing.T) {
+	// The first second is covered by the burst; the rest is throttled
+	const rate = 64 * 1024
+	bucket := NewBucket(rate)
+	var out bytes.Buffer
+
+	start := time.Now()
+	n, err := io.Copy(Writer(context.Background(), &out, bucket), bytes.NewReader(make([]byte, rate+rate/2)))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if n != rate+rate/2 || out.Len() != int(n) {
+		t.Fatalf("expected all data to be written, got %d", n)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected about half a second of throttling, took %s", elapsed)
+	}
+}
+
+func TestReaderStopsWithContext(t *testing.T) {
+	bucket := NewBucket(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Drain the burst so the next read has to wait
+	bucket.Wait(context.Background(), minBurst)
+	_, err := io.ReadAll(Reader(ctx, bytes.NewReader(make([]byte, 4096)), bucket))
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestLimiterSharesBuckets(t *testing.T) {
+	limiter := NewLimiter()
+	if limiter.Bucket("ip:10.0.0.5", 0) != nil {
+		t.Fatalf("a zero rate should be unlimited")
+	}
+
+	first := limiter.Bucket("token:guest", 1024)
+	if limiter.Bucket("token:guest", 1024) != first {
+		t.Fatalf("transfers of one client should share a bucket")
+	}
+	if limiter.Bucket("token:guest", 2048) == first {
+		t.Fatalf("a changed rate should replace the bucket")
+	}
+	if limiter.Bucket("ip:10.0.0.5", 1024) == first {
+		t.Fatalf("clients should not share buckets")
+	}
+}
+
+func TestSlowestBucketWinsAndRatesChange(t *testing.T) {
+	const rate = 64 * 1024
+	fast, slow := NewBucket(10*rate), NewBucket(rate)
+	var out bytes.Buffer
+
+	start := time.Now()
+	if _, err := io.Copy(Writer(context.Background(), &out, fast, nil, slow), bytes.NewReader(make([]byte, rate+rate/2))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected the slower bucket to limit the transfer, took %s", elapsed)
+	}
+
+	// The slow bucket is in debt now, until it is lifted
+	slow.SetRate(0)
+	start = time.Now()
+	if _, err := io.Copy(Writer(context.Background(), &out, slow), bytes.NewReader(make([]byte, 4*rate))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("expected a lifted limit to apply at once, took %s", elapsed)
+	}
+}
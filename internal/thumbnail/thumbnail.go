@@ -8,8 +8,14 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
 )
 
+// TaskType is the scheduler task type that generates the thumbnail of the
+// file named by its path parameter
+const TaskType = "thumbnail.generate"
+
 // Config holds thumbnail generation configuration
 type Config struct {
 	CacheDir      string
@@ -369,3 +375,19 @@ func md5Sum(s string) []byte {
 	// Simplified for now
 	return []byte(s)
 }
+
+// TaskHandler generates thumbnails for scheduler tasks of type TaskType
+func (g *Generator) TaskHandler() scheduler.TaskHandler {
+	return func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		path, _ := params["path"].(string)
+		if path == "" {
+			return nil, fmt.Errorf("path is required")
+		}
+
+		info, err := g.Generate(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"thumb_path": info.ThumbPath, "size": info.Size}, nil
+	}
+}
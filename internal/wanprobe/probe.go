@@ -0,0 +1,189 @@
+package wanprobe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+	"github.com/KOPElan/mingyue-agent/internal/sysexec"
+)
+
+// Probe methods
+const (
+	MethodICMP = "icmp"
+	MethodTCP  = "tcp"
+)
+
+var (
+	pingTimeRe  = regexp.MustCompile(`time[=<]([0-9.]+) ?ms`)
+	pingCountRe = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+)
+
+// probeTarget measures the round trips to target. Targets with a port are
+// probed with TCP connects, which need no privileges and pass firewalls that
+// drop ICMP; other targets are pinged.
+func probeTarget(ctx context.Context, target string, samples int, timeout time.Duration) *Result {
+	result := &Result{Target: target, Time: time.Now(), Sent: samples}
+
+	var rtts []float64
+	var err error
+	if _, _, splitErr := net.SplitHostPort(target); splitErr == nil {
+		result.Method = MethodTCP
+		rtts = tcpProbe(ctx, target, samples, timeout)
+	} else {
+		result.Method = MethodICMP
+		rtts, err = ping(ctx, target, samples, timeout)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		result.LossPercent = 100
+		return result
+	}
+
+	summarize(result, rtts)
+	return result
+}
+
+// summarize fills in the loss, latency and jitter of result from the round
+// trip times of the answered samples
+func summarize(result *Result, rtts []float64) {
+	result.Received = len(rtts)
+	if result.Sent > 0 {
+		result.LossPercent = round(100 * float64(result.Sent-result.Received) / float64(result.Sent))
+	}
+	if len(rtts) == 0 {
+		return
+	}
+
+	sum, min, max := 0.0, rtts[0], rtts[0]
+	for _, rtt := range rtts {
+		sum += rtt
+		min = math.Min(min, rtt)
+		max = math.Max(max, rtt)
+	}
+	result.LatencyMs = round(sum / float64(len(rtts)))
+	result.MinMs = round(min)
+	result.MaxMs = round(max)
+
+	// Jitter is the mean difference between consecutive round trips
+	if len(rtts) > 1 {
+		diffs := 0.0
+		for i := 1; i < len(rtts); i++ {
+			diffs += math.Abs(rtts[i] - rtts[i-1])
+		}
+		result.JitterMs = round(diffs / float64(len(rtts)-1))
+	}
+}
+
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// tcpProbe times TCP connects to addr; failed connects count as lost
+func tcpProbe(ctx context.Context, addr string, samples int, timeout time.Duration) []float64 {
+	var rtts []float64
+	dialer := net.Dialer{Timeout: timeout}
+	for i := 0; i < samples && ctx.Err() == nil; i++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			continue
+		}
+		rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+		conn.Close()
+		// Space samples out like ping does, so one hiccup doesn't hit them all
+		if i < samples-1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}
+	return rtts
+}
+
+// ping sends samples ICMP echo requests with the system ping command
+func ping(ctx context.Context, host string, samples int, timeout time.Duration) ([]float64, error) {
+	waitSec := int(math.Ceil(timeout.Seconds()))
+	if waitSec < 1 {
+		waitSec = 1
+	}
+	// ping exits non-zero when replies are missing, so judge by its output
+	output, err := sysexec.CombinedOutput(ctx, "ping", "-n", "-c", strconv.Itoa(samples), "-i", "0.2",
+		"-W", strconv.Itoa(waitSec), host)
+	rtts, parseErr := parsePing(string(output))
+	if parseErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("ping %s: %w: %s", host, err, strings.TrimSpace(string(output)))
+		}
+		return nil, parseErr
+	}
+	return rtts, nil
+}
+
+// parsePing reads the round trip times from ping output
+func parsePing(output string) ([]float64, error) {
+	if !pingCountRe.MatchString(output) {
+		return nil, fmt.Errorf("unexpected ping output: %s", strings.TrimSpace(output))
+	}
+	var rtts []float64
+	for _, match := range pingTimeRe.FindAllStringSubmatch(output, -1) {
+		if rtt, err := strconv.ParseFloat(match[1], 64); err == nil {
+			rtts = append(rtts, rtt)
+		}
+	}
+	return rtts, nil
+}
+
+// speedtest downloads up to maxBytes from url and reports the throughput
+func speedtest(ctx context.Context, url string, maxBytes int64, timeout time.Duration) *SpeedResult {
+	result := &SpeedResult{Time: time.Now(), URL: url}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// Ask for raw bytes so compression doesn't inflate the figure
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	start := time.Now()
+	resp, err := httpclient.New(0).Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("download returned %s", resp.Status)
+		return result
+	}
+
+	// Running into the timeout still yields a measurement
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxBytes))
+	elapsed := time.Since(start)
+	if n == 0 {
+		if err == nil {
+			err = fmt.Errorf("empty download")
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Bytes = n
+	result.DurationMs = elapsed.Milliseconds()
+	result.DownloadMbps = round(float64(n) * 8 / elapsed.Seconds() / 1e6)
+	return result
+}
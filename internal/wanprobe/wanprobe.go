@@ -0,0 +1,455 @@
+// Package wanprobe measures the quality of the internet connection. It
+// periodically probes latency, jitter and packet loss to a set of targets,
+// optionally runs download speedtests, keeps a history of the results and
+// publishes events when the connection degrades, so complaints that the
+// internet feels slow have data behind them.
+package wanprobe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/scheduler"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+// TaskType is the scheduler task type that runs a speedtest
+const TaskType = "wan.speedtest"
+
+var (
+	// ErrNoSpeedtest is returned when no speedtest URL is configured
+	ErrNoSpeedtest = errors.New("no speedtest url configured")
+	// ErrBusy is returned when a speedtest is already running
+	ErrBusy = errors.New("speedtest already running")
+)
+
+// Result is one probe of a target
+type Result struct {
+	Target      string    `json:"target"`
+	Method      string    `json:"method"` // icmp or tcp
+	Time        time.Time `json:"time"`
+	Sent        int       `json:"sent"`
+	Received    int       `json:"received"`
+	LossPercent float64   `json:"loss_percent"`
+	LatencyMs   float64   `json:"latency_ms"` // Mean round trip
+	MinMs       float64   `json:"min_ms"`
+	MaxMs       float64   `json:"max_ms"`
+	JitterMs    float64   `json:"jitter_ms"`
+	Degraded    bool      `json:"degraded"`
+	Reasons     []string  `json:"reasons,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// SpeedResult is one speedtest
+type SpeedResult struct {
+	Time         time.Time `json:"time"`
+	URL          string    `json:"url"`
+	Bytes        int64     `json:"bytes"`
+	DurationMs   int64     `json:"duration_ms"`
+	DownloadMbps float64   `json:"download_mbps"`
+	Degraded     bool      `json:"degraded"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Thresholds beyond which the connection counts as degraded; zero disables
+// a threshold
+type Thresholds struct {
+	LatencyMs       float64 `json:"latency_ms"`
+	JitterMs        float64 `json:"jitter_ms"`
+	LossPercent     float64 `json:"loss_percent"`
+	MinDownloadMbps float64 `json:"min_download_mbps"`
+}
+
+// Status reports the latest results
+type Status struct {
+	Degraded   bool         `json:"degraded"`
+	Targets    []*Result    `json:"targets"`
+	Speedtest  *SpeedResult `json:"speedtest,omitempty"`
+	Thresholds Thresholds   `json:"thresholds"`
+	IntervalS  int          `json:"interval_sec"`
+}
+
+// History holds the stored results, oldest first
+type History struct {
+	Probes     []*Result      `json:"probes"`
+	Speedtests []*SpeedResult `json:"speedtests"`
+}
+
+// Config configures the WAN quality monitor
+type Config struct {
+	Targets           []string      // Hosts to ping, or host:port to time TCP connects
+	Interval          time.Duration // Between probes
+	Samples           int           // Pings or connects per target and probe
+	Timeout           time.Duration // Per sample
+	SpeedtestURL      string        // File downloaded by speedtests; disabled if empty
+	SpeedtestMaxBytes int64         // Download cap of speedtests
+	SpeedtestTimeout  time.Duration
+	HistoryFile       string
+	Retention         time.Duration
+	Thresholds        Thresholds
+}
+
+// Manager runs the probes and keeps their history
+type Manager struct {
+	targets           []string
+	interval          time.Duration
+	samples           int
+	timeout           time.Duration
+	speedtestURL      string
+	speedtestMaxBytes int64
+	speedtestTimeout  time.Duration
+	historyFile       string
+	retention         time.Duration
+	thresholds        Thresholds
+	history           History
+	bus               *events.Bus
+	mu                sync.Mutex // Guards history and bus
+	probeMu           sync.Mutex // Serializes probes
+	speedMu           sync.Mutex // Held while a speedtest runs
+	stop              chan struct{}
+	done              chan struct{}
+	probe             func(ctx context.Context, target string, samples int, timeout time.Duration) *Result
+}
+
+// New creates a WAN quality monitor. Call Start to begin probing.
+func New(cfg *Config) (*Manager, error) {
+	targets := cfg.Targets
+	if len(targets) == 0 {
+		targets = []string{"1.1.1.1", "8.8.8.8"}
+	}
+	for _, target := range targets {
+		if strings.TrimSpace(target) == "" || strings.HasPrefix(target, "-") {
+			return nil, fmt.Errorf("invalid probe target %q", target)
+		}
+	}
+
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+
+	samples := cfg.Samples
+	if samples == 0 {
+		samples = 10
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	maxBytes := cfg.SpeedtestMaxBytes
+	if maxBytes == 0 {
+		maxBytes = 25 << 20
+	}
+
+	speedtestTimeout := cfg.SpeedtestTimeout
+	if speedtestTimeout == 0 {
+		speedtestTimeout = time.Minute
+	}
+
+	historyFile := cfg.HistoryFile
+	if historyFile == "" {
+		historyFile = "/var/lib/mingyue-agent/wan-history.json"
+	}
+
+	retention := cfg.Retention
+	if retention == 0 {
+		retention = 7 * 24 * time.Hour
+	}
+
+	m := &Manager{
+		targets:           targets,
+		interval:          interval,
+		samples:           samples,
+		timeout:           timeout,
+		speedtestURL:      cfg.SpeedtestURL,
+		speedtestMaxBytes: maxBytes,
+		speedtestTimeout:  speedtestTimeout,
+		historyFile:       historyFile,
+		retention:         retention,
+		thresholds:        cfg.Thresholds,
+		probe:             probeTarget,
+	}
+
+	if err := statefile.Read(m.historyFile, &m.history); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load history: %w", err)
+	}
+	return m, nil
+}
+
+// SetEventBus publishes wan.quality and wan.speedtest events on bus
+func (m *Manager) SetEventBus(bus *events.Bus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bus = bus
+}
+
+// Start probes the targets every interval
+func (m *Manager) Start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.loop()
+}
+
+// Stop stops probing and cancels a running speedtest
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+
+	// Wait for the speedtest to record what it measured
+	m.speedMu.Lock()
+	m.speedMu.Unlock()
+}
+
+func (m *Manager) loop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+
+	for {
+		m.Probe(ctx)
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Probe measures all targets concurrently and records the results
+func (m *Manager) Probe(ctx context.Context) []*Result {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+
+	results := make([]*Result, len(m.targets))
+	var wg sync.WaitGroup
+	for i, target := range m.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.probe(ctx, target, m.samples, m.timeout)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		// Cut short by shutdown, so the figures are meaningless
+		return results
+	}
+
+	for _, result := range results {
+		result.Reasons = m.check(result)
+		result.Degraded = len(result.Reasons) > 0
+	}
+
+	m.mu.Lock()
+	m.history.Probes = append(m.history.Probes, results...)
+	m.pruneAndSave()
+	bus := m.bus
+	m.mu.Unlock()
+
+	for _, result := range results {
+		message := fmt.Sprintf("%s: %.1f ms latency, %.1f ms jitter, %.0f%% loss",
+			result.Target, result.LatencyMs, result.JitterMs, result.LossPercent)
+		if result.Degraded {
+			message = fmt.Sprintf("internet connection degraded to %s (%s)",
+				result.Target, strings.Join(result.Reasons, ", "))
+		}
+		bus.Publish("wan.quality", map[string]interface{}{
+			"target":       result.Target,
+			"healthy":      !result.Degraded,
+			"latency_ms":   result.LatencyMs,
+			"jitter_ms":    result.JitterMs,
+			"loss_percent": result.LossPercent,
+			"message":      message,
+		})
+	}
+	return results
+}
+
+// check returns the thresholds result exceeds
+func (m *Manager) check(result *Result) []string {
+	if result.Error != "" {
+		return []string{result.Error}
+	}
+	var reasons []string
+	if t := m.thresholds.LossPercent; t > 0 && result.LossPercent >= t {
+		reasons = append(reasons, fmt.Sprintf("%.0f%% packet loss", result.LossPercent))
+	}
+	// Latency and jitter are unknown when every sample was lost
+	if result.Received == 0 {
+		return reasons
+	}
+	if t := m.thresholds.LatencyMs; t > 0 && result.LatencyMs >= t {
+		reasons = append(reasons, fmt.Sprintf("%.1f ms latency", result.LatencyMs))
+	}
+	if t := m.thresholds.JitterMs; t > 0 && result.JitterMs >= t {
+		reasons = append(reasons, fmt.Sprintf("%.1f ms jitter", result.JitterMs))
+	}
+	return reasons
+}
+
+// Speedtest downloads the configured speedtest file and records the
+// throughput. Only one speedtest runs at a time.
+func (m *Manager) Speedtest(ctx context.Context) (*SpeedResult, error) {
+	if m.speedtestURL == "" {
+		return nil, ErrNoSpeedtest
+	}
+	if !m.speedMu.TryLock() {
+		return nil, ErrBusy
+	}
+	defer m.speedMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	result := speedtest(ctx, m.speedtestURL, m.speedtestMaxBytes, m.speedtestTimeout)
+	if result.Error == "" {
+		min := m.thresholds.MinDownloadMbps
+		result.Degraded = min > 0 && result.DownloadMbps < min
+	}
+
+	m.mu.Lock()
+	m.history.Speedtests = append(m.history.Speedtests, result)
+	m.pruneAndSave()
+	bus := m.bus
+	m.mu.Unlock()
+
+	if result.Error != "" {
+		return result, fmt.Errorf("speedtest: %s", result.Error)
+	}
+	message := fmt.Sprintf("download speed %.1f Mbps", result.DownloadMbps)
+	if result.Degraded {
+		message = fmt.Sprintf("download speed %.1f Mbps is below %.1f Mbps",
+			result.DownloadMbps, m.thresholds.MinDownloadMbps)
+	}
+	bus.Publish("wan.speedtest", map[string]interface{}{
+		"target":        "download",
+		"healthy":       !result.Degraded,
+		"download_mbps": result.DownloadMbps,
+		"message":       message,
+	})
+	return result, nil
+}
+
+// TaskHandler runs speedtests for scheduler tasks of type TaskType
+func (m *Manager) TaskHandler() scheduler.TaskHandler {
+	return func(ctx context.Context, params map[string]interface{}) (map[string]interface{}, error) {
+		result, err := m.Speedtest(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"download_mbps": result.DownloadMbps,
+			"bytes":         result.Bytes,
+			"degraded":      result.Degraded,
+		}, nil
+	}
+}
+
+// Status returns the latest result of each target and speedtest
+func (m *Manager) Status() *Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := &Status{
+		Targets:    []*Result{},
+		Thresholds: m.thresholds,
+		IntervalS:  int(m.interval / time.Second),
+	}
+	for _, target := range m.targets {
+		for i := len(m.history.Probes) - 1; i >= 0; i-- {
+			if m.history.Probes[i].Target == target {
+				latest := *m.history.Probes[i]
+				status.Targets = append(status.Targets, &latest)
+				status.Degraded = status.Degraded || latest.Degraded
+				break
+			}
+		}
+	}
+	if n := len(m.history.Speedtests); n > 0 {
+		latest := *m.history.Speedtests[n-1]
+		status.Speedtest = &latest
+		status.Degraded = status.Degraded || latest.Degraded
+	}
+	return status
+}
+
+// History returns the results since the given time, limited to target if
+// it is not empty
+func (m *Manager) History(target string, since time.Time) *History {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := &History{Probes: []*Result{}, Speedtests: []*SpeedResult{}}
+	for _, result := range m.history.Probes {
+		if result.Time.Before(since) || (target != "" && result.Target != target) {
+			continue
+		}
+		history.Probes = append(history.Probes, result)
+	}
+	if target == "" {
+		for _, result := range m.history.Speedtests {
+			if !result.Time.Before(since) {
+				history.Speedtests = append(history.Speedtests, result)
+			}
+		}
+	}
+	return history
+}
+
+// pruneAndSave drops results older than the retention and writes the
+// history. Callers hold m.mu.
+func (m *Manager) pruneAndSave() {
+	cutoff := time.Now().Add(-m.retention)
+	probes := m.history.Probes[:0]
+	for _, result := range m.history.Probes {
+		if result.Time.After(cutoff) {
+			probes = append(probes, result)
+		}
+	}
+	m.history.Probes = probes
+	speedtests := m.history.Speedtests[:0]
+	for _, result := range m.history.Speedtests {
+		if result.Time.After(cutoff) {
+			speedtests = append(speedtests, result)
+		}
+	}
+	m.history.Speedtests = speedtests
+
+	data, err := json.Marshal(m.history)
+	if err != nil {
+		log.Printf("warning: marshal wan history: %v", err)
+		return
+	}
+	if err := statefile.Write(m.historyFile, data, statefile.PrivateMode); err != nil {
+		log.Printf("warning: save wan history: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package wanprobe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+func TestParsePing(t *testing.T) {
+	output := `PING 1.1.1.1 (1.1.1.1) 56(84) bytes of data.
+64 bytes from 1.1.1.1: icmp_seq=1 ttl=57 time=10.0 ms
+64 bytes from 1.1.1.1: icmp_seq=2 ttl=57 time=14.0 ms
+64 bytes from 1.1.1.1: icmp_seq=4 ttl=57 time=12.0 ms
+
+--- 1.1.1.1 ping statistics ---
+4 packets transmitted, 3 received, 25% packet loss, time 603ms
+rtt min/avg/max/mdev = 10.000/12.000/14.000/1.633 ms
+`
+	rtts, err := parsePing(output)
+	if err != nil {
+		t.Fatalf("parsePing: %v", err)
+	}
+
+	result := &Result{Sent: 4}
+	summarize(result, rtts)
+	if result.Received != 3 || result.LossPercent != 25 || result.LatencyMs != 12 ||
+		result.MinMs != 10 || result.MaxMs != 14 || result.JitterMs != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if _, err := parsePing("ping: unknown host nowhere"); err == nil {
+		t.Fatal("expected an error for unexpected output")
+	}
+}
+
+func TestProbeDegradation(t *testing.T) {
+	bus := events.NewBus(0)
+	sub := bus.Subscribe(&events.Filter{Types: []string{"wan.quality"}}, 8)
+	defer sub.Close()
+
+	historyFile := filepath.Join(t.TempDir(), "wan.json")
+	cfg := &Config{
+		Targets:     []string{"good", "lossy"},
+		HistoryFile: historyFile,
+		Thresholds:  Thresholds{LatencyMs: 100, LossPercent: 5},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	m.SetEventBus(bus)
+	m.probe = func(ctx context.Context, target string, samples int, timeout time.Duration) *Result {
+		result := &Result{Target: target, Time: time.Now(), Sent: 10}
+		if target == "lossy" {
+			summarize(result, []float64{150, 160, 170, 180, 190, 200, 210, 220})
+		} else {
+			summarize(result, []float64{10, 11, 12, 13, 14, 15, 16, 17, 18, 19})
+		}
+		return result
+	}
+
+	m.Probe(context.Background())
+	status := m.Status()
+	if !status.Degraded || len(status.Targets) != 2 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.Targets[0].Degraded {
+		t.Fatalf("expected the good target to be healthy, got %+v", status.Targets[0])
+	}
+	if lossy := status.Targets[1]; !lossy.Degraded || len(lossy.Reasons) != 2 {
+		t.Fatalf("expected loss and latency reasons, got %+v", lossy)
+	}
+
+	for i := 0; i < 2; i++ {
+		event := <-sub.C
+		data := event.Data.(map[string]interface{})
+		healthy := data["healthy"].(bool)
+		if healthy != (data["target"] == "good") {
+			t.Fatalf("unexpected event %+v", data)
+		}
+	}
+
+	// History survives restarts
+	m, err = New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if history := m.History("lossy", time.Now().Add(-time.Hour)); len(history.Probes) != 1 {
+		t.Fatalf("expected one probe of lossy, got %+v", history)
+	}
+	if history := m.History("", time.Now().Add(time.Minute)); len(history.Probes) != 0 {
+		t.Fatalf("expected no probes after now, got %+v", history)
+	}
+}
+
+func TestSpeedtest(t *testing.T) {
+	payload := strings.Repeat("x", 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer server.Close()
+
+	m, err := New(&Config{HistoryFile: filepath.Join(t.TempDir(), "wan.json")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := m.Speedtest(context.Background()); !errors.Is(err, ErrNoSpeedtest) {
+		t.Fatalf("expected ErrNoSpeedtest, got %v", err)
+	}
+
+	m, err = New(&Config{
+		HistoryFile:       filepath.Join(t.TempDir(), "wan.json"),
+		SpeedtestURL:      server.URL,
+		SpeedtestMaxBytes: 512 << 10,
+		Thresholds:        Thresholds{MinDownloadMbps: 1e9},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	result, err := m.Speedtest(context.Background())
+	if err != nil {
+		t.Fatalf("Speedtest: %v", err)
+	}
+	if result.Bytes != 512<<10 || result.DownloadMbps <= 0 || !result.Degraded {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if status := m.Status(); status.Speedtest == nil || !status.Degraded {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestStopCancelsSpeedtest(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 64<<10)))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	m, err := New(&Config{
+		Targets:      []string{"good"},
+		HistoryFile:  filepath.Join(t.TempDir(), "wan.json"),
+		SpeedtestURL: server.URL,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	m.probe = func(ctx context.Context, target string, samples int, timeout time.Duration) *Result {
+		return &Result{Target: target, Time: time.Now(), Sent: samples, Received: samples}
+	}
+	m.Start()
+
+	finished := make(chan struct{})
+	go func() {
+		m.Speedtest(context.Background())
+		close(finished)
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Stop to cancel the speedtest")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("expected Stop to wait for the speedtest")
+	}
+	if status := m.Status(); status.Speedtest == nil {
+		t.Fatal("expected the canceled speedtest to be recorded")
+	}
+}
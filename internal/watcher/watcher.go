@@ -0,0 +1,48 @@
+// Package watcher reports files appearing, changing and disappearing below
+// a set of directories as events on the event bus. It uses inotify, so it
+// only works on Linux.
+package watcher
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+)
+
+// Event types published on the bus, with a FileEvent as their data
+const (
+	// EventCreated is published once a new file has been written and
+	// closed, or moved into a watched directory
+	EventCreated = "file.created"
+	// EventModified is published when an existing file is written and
+	// closed
+	EventModified = "file.modified"
+	// EventDeleted is published when a file is removed or moved away
+	EventDeleted = "file.deleted"
+)
+
+// ErrUnsupported is returned where the system cannot watch files
+var ErrUnsupported = errors.New("file watching is not supported on this system")
+
+// FileEvent is the data of file events
+type FileEvent struct {
+	Path string `json:"path"`
+	Dir  bool   `json:"dir,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// Config represents watcher configuration
+type Config struct {
+	// Exclude names directories that are never watched, like the trash
+	Exclude []string
+	// Ignore leaves out files and directories nobody cares about, like
+	// node_modules, so their events are not published
+	Ignore *ignore.Matcher
+}
+
+// within reports whether path is root or below it
+func within(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
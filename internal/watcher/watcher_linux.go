@@ -0,0 +1,325 @@
+//go:build linux
+
+package watcher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/KOPElan/mingyue-agent/internal/events"
+	"github.com/KOPElan/mingyue-agent/internal/ignore"
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the inotify events of a watched directory
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_DELETE | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// maxPending bounds the files remembered between being created and closed
+const maxPending = 10000
+
+// Watcher watches directory trees with inotify
+type Watcher struct {
+	bus     *events.Bus
+	exclude map[string]bool
+	ignore  *ignore.Matcher
+	fd      int
+	file    *os.File // fd, read through the runtime poller so Close stops run
+	done    chan struct{}
+
+	mu      sync.Mutex
+	roots   []string        // Union of static and watched
+	static  []string        // Set with SetRoots
+	watched map[string]int  // Added with Watch, counting its callers
+	watches map[int]string  // Watch descriptor to directory
+	dirs    map[string]int  // Directory to watch descriptor
+	pending map[string]bool // Files created but not yet closed
+}
+
+// New creates a watcher publishing to bus. It watches nothing until
+// SetRoots is called.
+func New(cfg Config, bus *events.Bus) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("init inotify: %w", err)
+	}
+
+	w := &Watcher{
+		bus:     bus,
+		exclude: make(map[string]bool),
+		ignore:  cfg.Ignore,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		done:    make(chan struct{}),
+		watches: make(map[int]string),
+		dirs:    make(map[string]int),
+		pending: make(map[string]bool),
+		watched: make(map[string]int),
+	}
+	for _, name := range cfg.Exclude {
+		w.exclude[name] = true
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// SetRoots watches the directories in roots with everything below them
+// and stops watching anything else not added with Watch. Roots that cannot
+// be watched are reported, but do not keep the others from being watched.
+func (w *Watcher) SetRoots(roots []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.static = w.static[:0]
+	for _, root := range roots {
+		w.static = append(w.static, filepath.Clean(root))
+	}
+	return w.update()
+}
+
+// Watch watches dir with everything below it until release is called, on
+// top of the roots set with SetRoots. Several callers may watch the same
+// directory.
+func (w *Watcher) Watch(dir string) (release func(), err error) {
+	dir = filepath.Clean(dir)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watched[dir] == 0 {
+		if err := w.addTree(dir, false); err != nil {
+			return nil, err
+		}
+		w.roots = append(w.roots, dir)
+	}
+	w.watched[dir]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+
+			w.watched[dir]--
+			if w.watched[dir] == 0 {
+				delete(w.watched, dir)
+				w.prune()
+			}
+		})
+	}, nil
+}
+
+// update watches the static and watched roots and nothing else. w.mu must
+// be held.
+func (w *Watcher) update() error {
+	w.prune()
+
+	var errs []error
+	for _, root := range w.roots {
+		if err := w.addTree(root, false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prune stops watching directories outside the static and watched roots.
+// w.mu must be held.
+func (w *Watcher) prune() {
+	w.roots = append(w.roots[:0], w.static...)
+	for dir := range w.watched {
+		w.roots = append(w.roots, dir)
+	}
+
+	for dir := range w.dirs {
+		if !w.covered(dir) {
+			w.forget(dir)
+		}
+	}
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	err := w.file.Close()
+	<-w.done
+	return err
+}
+
+func (w *Watcher) covered(dir string) bool {
+	for _, root := range w.roots {
+		if within(dir, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTree watches dir and the directories below it. With announce, what
+// is found is published as created, for directories that appeared while
+// being watched and may have been filled before their watch was added.
+func (w *Watcher) addTree(dir string, announce bool) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return fmt.Errorf("watch %s: %w", dir, err)
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			if announce && !w.ignore.Ignored(path, false) {
+				w.publishFile(EventCreated, path)
+			}
+			return nil
+		}
+
+		if path != dir && (w.exclude[entry.Name()] || w.ignore.Ignored(path, true)) {
+			return filepath.SkipDir
+		}
+		if _, watched := w.dirs[path]; !watched {
+			wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+			if err != nil {
+				if path == dir {
+					return fmt.Errorf("watch %s: %w", dir, err)
+				}
+				// Usually fs.inotify.max_user_watches
+				log.Printf("warning: watch %s: %v", path, err)
+				return filepath.SkipDir
+			}
+			w.watches[wd] = path
+			w.dirs[path] = wd
+		}
+		if announce && path != dir {
+			w.publish(EventCreated, path, true, 0)
+		}
+		return nil
+	})
+}
+
+// forget stops watching dir and the directories below it
+func (w *Watcher) forget(dir string) {
+	for path, wd := range w.dirs {
+		if within(path, dir) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, path)
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("warning: read file events: %v", err)
+			}
+			return
+		}
+
+		w.mu.Lock()
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + length
+			if offset > n {
+				break
+			}
+			w.handle(int(wd), mask, strings.TrimRight(string(buf[start:offset]), "\x00"))
+		}
+		w.mu.Unlock()
+	}
+}
+
+// handle turns an inotify event into bus events
+func (w *Watcher) handle(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		log.Printf("warning: file event queue overflowed; events were lost")
+		return
+	}
+	dir, ok := w.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		if ok {
+			delete(w.watches, wd)
+			if w.dirs[dir] == wd {
+				delete(w.dirs, dir)
+			}
+		}
+		return
+	}
+	if !ok || name == "" {
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&unix.IN_ISDIR != 0
+	if isDir && w.exclude[name] || w.ignore.Ignored(path, isDir) {
+		return
+	}
+
+	switch {
+	case mask&unix.IN_CREATE != 0:
+		if isDir {
+			w.publish(EventCreated, path, true, 0)
+			if err := w.addTree(path, true); err != nil {
+				log.Printf("warning: %v", err)
+			}
+			return
+		}
+		// Regular files are announced once written; links never are
+		if info, err := os.Lstat(path); err == nil && !info.Mode().IsRegular() {
+			w.publish(EventCreated, path, false, 0)
+			return
+		}
+		if len(w.pending) >= maxPending {
+			clear(w.pending)
+		}
+		w.pending[path] = true
+	case mask&unix.IN_CLOSE_WRITE != 0:
+		event := EventModified
+		if w.pending[path] {
+			delete(w.pending, path)
+			event = EventCreated
+		}
+		w.publishFile(event, path)
+	case mask&unix.IN_MOVED_TO != 0:
+		if isDir {
+			w.publish(EventCreated, path, true, 0)
+			if err := w.addTree(path, true); err != nil {
+				log.Printf("warning: %v", err)
+			}
+			return
+		}
+		w.publishFile(EventCreated, path)
+	case mask&(unix.IN_MOVED_FROM|unix.IN_DELETE) != 0:
+		delete(w.pending, path)
+		if isDir {
+			w.forget(path)
+		}
+		w.publish(EventDeleted, path, isDir, 0)
+	}
+}
+
+func (w *Watcher) publishFile(event, path string) {
+	var size int64
+	if info, err := os.Lstat(path); err == nil {
+		size = info.Size()
+	}
+	w.publish(event, path, false, size)
+}
+
+func (w *Watcher) publish(event, path string, dir bool, size int64) {
+	w.bus.Publish(event, &FileEvent{Path: path, Dir: dir, Size: size})
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package watcher
+
+import (
+	"github.com/KOPElan/mingyue-agent/internal/events"
+)
+
+// Watcher watches directory trees; without inotify it cannot
+type Watcher struct{}
+
+// New returns ErrUnsupported, as only Linux can watch files
+func New(cfg Config, bus *events.Bus) (*Watcher, error) {
+	return nil, ErrUnsupported
+}
+
+// SetRoots returns ErrUnsupported
+func (w *Watcher) SetRoots(roots []string) error {
+	return ErrUnsupported
+}
+
+// Watch returns ErrUnsupported
+func (w *Watcher) Watch(dir string) (release func(), err error) {
+	return nil, ErrUnsupported
+}
+
+// Close does nothing
+func (w *Watcher) Close() error {
+	return nil
+}
@@ -0,0 +1,439 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+	"github.com/KOPElan/mingyue-agent/internal/httpclient"
+	"github.com/KOPElan/mingyue-agent/internal/statefile"
+)
+
+const (
+	// SignatureHeader carries "sha256=<hex HMAC of timestamp.body>"
+	SignatureHeader = "X-Mingyue-Signature"
+	// TimestampHeader carries the Unix time the delivery was signed at
+	TimestampHeader = "X-Mingyue-Timestamp"
+	// DeliveryHeader carries a unique delivery ID shared by all retries
+	DeliveryHeader = "X-Mingyue-Delivery"
+	// EventHeader carries the audit action of the delivered entry
+	EventHeader = "X-Mingyue-Event"
+)
+
+// Subscription represents a webhook receiving matching audit entries
+type Subscription struct {
+	ID           string    `json:"id"`
+	URL          string    `json:"url"`
+	Secret       string    `json:"secret,omitempty"` // Only shown on creation
+	Action       string    `json:"action,omitempty"`
+	Resource     string    `json:"resource,omitempty"`
+	Result       string    `json:"result,omitempty"`
+	Enabled      bool      `json:"enabled"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastDelivery time.Time `json:"last_delivery,omitempty"`
+	LastStatus   string    `json:"last_status,omitempty"`
+	Failures     int       `json:"failures"`
+}
+
+func (s *Subscription) filter() *audit.QueryFilter {
+	return &audit.QueryFilter{
+		Action:   s.Action,
+		Resource: s.Resource,
+		Result:   s.Result,
+	}
+}
+
+// Payload is the JSON body POSTed to subscribers
+type Payload struct {
+	DeliveryID     string       `json:"delivery_id"`
+	SubscriptionID string       `json:"subscription_id"`
+	Event          *audit.Entry `json:"event"`
+}
+
+type delivery struct {
+	id           string
+	subscription string
+	entry        *audit.Entry
+}
+
+// Manager stores webhook subscriptions and delivers audit entries to them
+type Manager struct {
+	stateFile     string
+	subscriptions map[string]*Subscription
+	mu            sync.RWMutex
+	entries       chan *audit.Entry
+	queue         chan delivery
+	client        *http.Client
+	maxAttempts   int
+	retryDelay    time.Duration
+	stopCh        chan struct{}
+	wg            sync.WaitGroup
+}
+
+// Config represents webhook manager configuration
+type Config struct {
+	StateFile   string
+	Timeout     time.Duration
+	MaxAttempts int
+	RetryDelay  time.Duration // Initial delay, doubled after every failed attempt
+	Workers     int
+}
+
+// New creates a new webhook manager and starts its delivery workers
+func New(cfg *Config) (*Manager, error) {
+	stateFile := cfg.StateFile
+	if stateFile == "" {
+		stateFile = "/var/lib/mingyue-agent/webhooks.json"
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = 5
+	}
+
+	retryDelay := cfg.RetryDelay
+	if retryDelay == 0 {
+		retryDelay = 2 * time.Second
+	}
+
+	workers := cfg.Workers
+	if workers == 0 {
+		workers = 2
+	}
+
+	m := &Manager{
+		stateFile:     stateFile,
+		subscriptions: make(map[string]*Subscription),
+		entries:       make(chan *audit.Entry, 1000),
+		queue:         make(chan delivery, 1000),
+		client:        httpclient.New(timeout),
+		maxAttempts:   maxAttempts,
+		retryDelay:    retryDelay,
+		stopCh:        make(chan struct{}),
+	}
+
+	if err := m.loadState(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+
+	m.wg.Add(1)
+	go m.dispatcher()
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+
+	return m, nil
+}
+
+// Attach subscribes the manager to entries written to the audit log
+func (m *Manager) Attach(auditLogger *audit.Logger) {
+	auditLogger.AddHook(m.Dispatch)
+}
+
+// Dispatch hands entry to the dispatcher, which queues it for every enabled
+// subscription whose filter matches. It runs as an audit hook with the log
+// locked, so it never waits: entries are dropped when the backlog is full.
+func (m *Manager) Dispatch(entry *audit.Entry) {
+	select {
+	case m.entries <- entry:
+	default:
+		log.Printf("webhook backlog full, dropping %s", entry.Action)
+	}
+}
+
+// AddSubscription registers a new webhook. A secret is generated when none is given.
+func (m *Manager) AddSubscription(sub *Subscription) (*Subscription, error) {
+	parsed, err := url.Parse(sub.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL: %s", sub.URL)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub.ID = generateID()
+	if sub.Secret == "" {
+		sub.Secret = generateID() + generateID()
+	}
+	sub.Enabled = true
+	sub.CreatedAt = time.Now()
+	sub.Failures = 0
+
+	m.subscriptions[sub.ID] = sub
+	if err := m.saveState(); err != nil {
+		delete(m.subscriptions, sub.ID)
+		return nil, err
+	}
+
+	created := *sub
+	return &created, nil
+}
+
+// RemoveSubscription deletes a webhook
+func (m *Manager) RemoveSubscription(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.subscriptions[id]; !exists {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+
+	delete(m.subscriptions, id)
+	return m.saveState()
+}
+
+// ListSubscriptions returns all webhooks without their secrets
+func (m *Manager) ListSubscriptions() []*Subscription {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	subs := make([]*Subscription, 0, len(m.subscriptions))
+	for _, sub := range m.subscriptions {
+		copied := *sub
+		copied.Secret = ""
+		subs = append(subs, &copied)
+	}
+
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+	})
+
+	return subs
+}
+
+// Test queues a synthetic entry for a single webhook
+func (m *Manager) Test(id, user string) error {
+	m.mu.RLock()
+	_, exists := m.subscriptions[id]
+	m.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+
+	entry := &audit.Entry{
+		Timestamp: time.Now(),
+		User:      user,
+		Action:    "webhook.test",
+		Resource:  id,
+		Result:    "success",
+	}
+
+	select {
+	case m.queue <- delivery{id: generateID(), subscription: id, entry: entry}:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue is full")
+	}
+}
+
+// Stop stops the delivery workers. Queued deliveries are discarded.
+func (m *Manager) Stop() {
+	close(m.stopCh)
+	m.wg.Wait()
+}
+
+// Sign returns the signature header value for body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatcher matches dispatched entries against the subscriptions and queues
+// a delivery for each match
+func (m *Manager) dispatcher() {
+	defer m.wg.Done()
+
+	for {
+		var entry *audit.Entry
+		select {
+		case <-m.stopCh:
+			return
+		case entry = <-m.entries:
+		}
+
+		m.mu.RLock()
+		matched := []string{}
+		for _, sub := range m.subscriptions {
+			if sub.Enabled && sub.filter().Matches(entry) {
+				matched = append(matched, sub.ID)
+			}
+		}
+		m.mu.RUnlock()
+
+		for _, id := range matched {
+			select {
+			case <-m.stopCh:
+				return
+			case m.queue <- delivery{id: generateID(), subscription: id, entry: entry}:
+			}
+		}
+	}
+}
+
+func (m *Manager) worker() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case d := <-m.queue:
+			m.deliver(d)
+		}
+	}
+}
+
+// deliver POSTs d with exponential backoff until it succeeds or attempts run out
+func (m *Manager) deliver(d delivery) {
+	delay := m.retryDelay
+	var lastErr error
+
+	for attempt := 1; attempt <= m.maxAttempts; attempt++ {
+		m.mu.RLock()
+		sub, exists := m.subscriptions[d.subscription]
+		var target Subscription
+		if exists {
+			target = *sub
+		}
+		m.mu.RUnlock()
+		if !exists {
+			return
+		}
+
+		lastErr = m.post(&target, d)
+		if lastErr == nil {
+			m.recordResult(d.subscription, "ok")
+			return
+		}
+
+		if attempt == m.maxAttempts {
+			break
+		}
+
+		select {
+		case <-m.stopCh:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	log.Printf("webhook %s delivery %s failed after %d attempts: %v", d.subscription, d.id, m.maxAttempts, lastErr)
+	m.recordResult(d.subscription, lastErr.Error())
+}
+
+func (m *Manager) post(sub *Subscription, d delivery) error {
+	body, err := json.Marshal(Payload{
+		DeliveryID:     d.id,
+		SubscriptionID: sub.ID,
+		Event:          d.entry,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mingyue-agent-webhook")
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, timestamp, body))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(DeliveryHeader, d.id)
+	req.Header.Set(EventHeader, d.entry.Action)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (m *Manager) recordResult(id, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, exists := m.subscriptions[id]
+	if !exists {
+		return
+	}
+
+	sub.LastDelivery = time.Now()
+	sub.LastStatus = status
+	if status == "ok" {
+		sub.Failures = 0
+	} else {
+		sub.Failures++
+	}
+
+	if err := m.saveState(); err != nil {
+		log.Printf("save webhook state: %v", err)
+	}
+}
+
+func (m *Manager) saveState() error {
+	dir := filepath.Dir(m.stateFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(m.subscriptions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := statefile.Write(m.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("write state file: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Manager) loadState() error {
+	var subscriptions map[string]*Subscription
+	if err := statefile.Read(m.stateFile, &subscriptions); err != nil {
+		return err
+	}
+
+	if subscriptions != nil {
+		m.subscriptions = subscriptions
+	}
+	return nil
+}
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,194 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KOPElan/mingyue-agent/internal/audit"
+)
+
+type receivedDelivery struct {
+	header  http.Header
+	payload Payload
+	valid   bool
+}
+
+// receiver records deliveries and answers them with the given status codes
+// in turn, then with 200
+func receiver(t *testing.T, secret string, statuses ...int) (*httptest.Server, <-chan receivedDelivery) {
+	t.Helper()
+
+	var mu sync.Mutex
+	received := make(chan receivedDelivery, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+
+		d := receivedDelivery{header: r.Header, valid: r.Header.Get(SignatureHeader) == Sign(secret, timestamp, body)}
+		json.Unmarshal(body, &d.payload)
+		received <- d
+
+		mu.Lock()
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func newTestManager(t *testing.T, maxAttempts int) (*Manager, *audit.Logger) {
+	t.Helper()
+
+	m, err := New(&Config{
+		StateFile:   filepath.Join(t.TempDir(), "webhooks.json"),
+		MaxAttempts: maxAttempts,
+		RetryDelay:  time.Millisecond,
+		Workers:     1,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(m.Stop)
+
+	auditLogger, err := audit.New("", false, "", true)
+	if err != nil {
+		t.Fatalf("audit.New: %v", err)
+	}
+	m.Attach(auditLogger)
+	return m, auditLogger
+}
+
+func next(t *testing.T, received <-chan receivedDelivery) receivedDelivery {
+	t.Helper()
+	select {
+	case d := <-received:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		return receivedDelivery{}
+	}
+}
+
+func waitForStatus(t *testing.T, m *Manager, id, status string) *Subscription {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, sub := range m.ListSubscriptions() {
+			if sub.ID == id && sub.LastStatus == status {
+				return sub
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("subscription %s never reached status %q: %+v", id, status, m.ListSubscriptions())
+	return nil
+}
+
+func TestDeliverySignedAndRetried(t *testing.T) {
+	server, received := receiver(t, "s3cret", http.StatusInternalServerError, http.StatusBadGateway)
+	m, auditLogger := newTestManager(t, 5)
+
+	sub, err := m.AddSubscription(&Subscription{URL: server.URL, Secret: "s3cret", Action: "share.*"})
+	if err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+
+	auditLogger.Log(context.Background(), &audit.Entry{User: "alice", Action: "disk.mount", Resource: "/dev/sdb1", Result: "success"})
+	auditLogger.Log(context.Background(), &audit.Entry{User: "alice", Action: "share.add", Resource: "/data/photos", Result: "success"})
+
+	first := next(t, received)
+	for attempt := 2; attempt <= 3; attempt++ {
+		retry := next(t, received)
+		if retry.header.Get(DeliveryHeader) != first.header.Get(DeliveryHeader) {
+			t.Fatalf("attempt %d: expected delivery ID %s, got %s", attempt, first.header.Get(DeliveryHeader), retry.header.Get(DeliveryHeader))
+		}
+		if !retry.valid {
+			t.Fatalf("attempt %d: invalid signature %s", attempt, retry.header.Get(SignatureHeader))
+		}
+	}
+
+	if !first.valid {
+		t.Fatalf("invalid signature %s", first.header.Get(SignatureHeader))
+	}
+	if first.header.Get(EventHeader) != "share.add" || first.payload.SubscriptionID != sub.ID ||
+		first.payload.DeliveryID != first.header.Get(DeliveryHeader) || first.payload.Event.Resource != "/data/photos" {
+		t.Fatalf("unexpected delivery %v %+v", first.header, first.payload)
+	}
+
+	if delivered := waitForStatus(t, m, sub.ID, "ok"); delivered.Failures != 0 || delivered.Secret != "" {
+		t.Fatalf("unexpected subscription after delivery: %+v", delivered)
+	}
+	select {
+	case d := <-received:
+		t.Fatalf("expected the unmatched entry not to be delivered, got %s", d.header.Get(EventHeader))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	server, received := receiver(t, "s3cret", http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	m, _ := newTestManager(t, 2)
+
+	sub, err := m.AddSubscription(&Subscription{URL: server.URL, Secret: "s3cret", Action: "share.add"})
+	if err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+
+	// Test deliveries bypass the filter
+	if err := m.Test(sub.ID, "alice"); err != nil {
+		t.Fatalf("Test: %v", err)
+	}
+	if d := next(t, received); d.header.Get(EventHeader) != "webhook.test" {
+		t.Fatalf("expected a test event, got %s", d.header.Get(EventHeader))
+	}
+	next(t, received)
+
+	failed := waitForStatus(t, m, sub.ID, "webhook responded with status 500")
+	if failed.Failures != 1 {
+		t.Fatalf("expected one failed delivery, got %d", failed.Failures)
+	}
+	select {
+	case <-received:
+		t.Fatal("expected no attempts past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAddSubscriptionValidatesURL(t *testing.T) {
+	m, _ := newTestManager(t, 1)
+
+	for _, target := range []string{"", "ftp://example.com/hook", "http://", "not a url"} {
+		if _, err := m.AddSubscription(&Subscription{URL: target}); err == nil {
+			t.Errorf("expected %q to be rejected", target)
+		}
+	}
+
+	sub, err := m.AddSubscription(&Subscription{URL: "https://example.com/hook"})
+	if err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+	if len(sub.Secret) != 32 {
+		t.Fatalf("expected a generated secret, got %q", sub.Secret)
+	}
+
+	reloaded, err := New(&Config{StateFile: m.stateFile})
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	defer reloaded.Stop()
+	if subs := reloaded.ListSubscriptions(); len(subs) != 1 || subs[0].ID != sub.ID || !subs[0].Enabled {
+		t.Fatalf("expected the subscription to persist, got %+v", subs)
+	}
+}
@@ -0,0 +1,190 @@
+// Package plugin defines the protocol between the agent and plugin processes
+// and helpers for writing plugins in Go.
+//
+// Plugins are external processes started by the agent. Each plugin serves the
+// gRPC service mingyue.plugin.v1.Plugin on the Unix socket named by the
+// MINGYUE_PLUGIN_SOCKET environment variable. Messages are JSON encoded
+// (content type application/grpc+json) so plugins in other languages only
+// need a gRPC library with a JSON codec, not generated protobuf code.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	// ServiceName is the fully qualified gRPC service name
+	ServiceName = "mingyue.plugin.v1.Plugin"
+	// CodecName is the gRPC content subtype used for all calls
+	CodecName = "json"
+	// SocketEnv names the environment variable holding the socket path
+	SocketEnv = "MINGYUE_PLUGIN_SOCKET"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return CodecName }
+
+// Route is an HTTP route served by a plugin. Path is relative to
+// /api/v1/plugins/<plugin name>; a path ending in "/" matches as a prefix.
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// Manifest describes what a plugin provides
+type Manifest struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	Routes     []Route  `json:"routes,omitempty"`
+	TaskTypes  []string `json:"task_types,omitempty"`  // Registered with the scheduler as <plugin name>.<type>
+	EventTypes []string `json:"event_types,omitempty"` // Event bus patterns, e.g. "share.*"
+}
+
+// HTTPRequest is an API request routed to a plugin. Credentials are
+// stripped; User carries the authenticated user.
+type HTTPRequest struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"` // Relative to /api/v1/plugins/<plugin name>
+	Query   map[string][]string `json:"query,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+	User    string              `json:"user,omitempty"`
+}
+
+// HTTPResponse is the plugin's reply to an HTTPRequest
+type HTTPResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+}
+
+// TaskRequest runs a scheduled task provided by the plugin
+type TaskRequest struct {
+	TaskType string                 `json:"task_type"` // Without the plugin name prefix
+	Params   map[string]interface{} `json:"params,omitempty"`
+}
+
+// TaskResponse is the result of a task run
+type TaskResponse struct {
+	Result map[string]interface{} `json:"result,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// Event is an agent event delivered to subscribed plugins
+type Event struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	Timestamp string          `json:"timestamp"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Empty is used for calls without a request or response body
+type Empty struct{}
+
+// Plugin is implemented by plugin processes
+type Plugin interface {
+	Describe(ctx context.Context) (*Manifest, error)
+	HandleHTTP(ctx context.Context, req *HTTPRequest) (*HTTPResponse, error)
+	RunTask(ctx context.Context, req *TaskRequest) (*TaskResponse, error)
+	HandleEvent(ctx context.Context, event *Event) error
+}
+
+// Serve serves impl on the socket named by MINGYUE_PLUGIN_SOCKET until the
+// listener fails. Plugins call it from main.
+func Serve(impl Plugin) error {
+	socket := os.Getenv(SocketEnv)
+	if socket == "" {
+		return fmt.Errorf("%s is not set; plugins must be started by the agent", SocketEnv)
+	}
+
+	os.Remove(socket)
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", socket, err)
+	}
+
+	server := grpc.NewServer()
+	server.RegisterService(&serviceDesc, impl)
+	return server.Serve(lis)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*Plugin)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Describe", Handler: unaryHandler(func(ctx context.Context, impl Plugin, _ *Empty) (any, error) {
+			return impl.Describe(ctx)
+		})},
+		{MethodName: "HandleHTTP", Handler: unaryHandler(func(ctx context.Context, impl Plugin, req *HTTPRequest) (any, error) {
+			return impl.HandleHTTP(ctx, req)
+		})},
+		{MethodName: "RunTask", Handler: unaryHandler(func(ctx context.Context, impl Plugin, req *TaskRequest) (any, error) {
+			return impl.RunTask(ctx, req)
+		})},
+		{MethodName: "HandleEvent", Handler: unaryHandler(func(ctx context.Context, impl Plugin, event *Event) (any, error) {
+			return &Empty{}, impl.HandleEvent(ctx, event)
+		})},
+	},
+}
+
+func unaryHandler[Req any](call func(context.Context, Plugin, *Req) (any, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		return call(ctx, srv.(Plugin), req)
+	}
+}
+
+// Client calls a plugin process. The agent uses it; it is exported so
+// plugins can be exercised from tests.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// NewClient wraps a connection to a plugin socket
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{conn: conn}
+}
+
+// Describe returns the plugin manifest
+func (c *Client) Describe(ctx context.Context) (*Manifest, error) {
+	manifest := &Manifest{}
+	return manifest, c.invoke(ctx, "Describe", &Empty{}, manifest)
+}
+
+// HandleHTTP forwards an API request
+func (c *Client) HandleHTTP(ctx context.Context, req *HTTPRequest) (*HTTPResponse, error) {
+	resp := &HTTPResponse{}
+	return resp, c.invoke(ctx, "HandleHTTP", req, resp)
+}
+
+// RunTask runs a plugin task
+func (c *Client) RunTask(ctx context.Context, req *TaskRequest) (*TaskResponse, error) {
+	resp := &TaskResponse{}
+	return resp, c.invoke(ctx, "RunTask", req, resp)
+}
+
+// HandleEvent delivers an event
+func (c *Client) HandleEvent(ctx context.Context, event *Event) error {
+	return c.invoke(ctx, "HandleEvent", event, &Empty{})
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp any) error {
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp, grpc.CallContentSubtype(CodecName))
+}
@@ -77,7 +77,7 @@ create_directories() {
 
     # Create application-specific data directories
     log_info "Creating application data directories..."
-    mkdir -p "$DATA_DIR/share-backups"
+    mkdir -p "$DATA_DIR/config-history"
 
     # Set ownership
     chown -R "$USER:$GROUP" "$LOG_DIR"
@@ -93,15 +93,16 @@ create_directories() {
     chmod 755 "$CONFIG_DIR"
     chmod 755 "$LOG_DIR"
     chmod 755 "$RUN_DIR"
-    chmod 755 "$DATA_DIR"
-    chmod 755 "$DATA_DIR/share-backups"
+    # State holds credentials; only the agent may read it
+    chmod 700 "$DATA_DIR"
+    chmod 700 "$DATA_DIR/config-history"
     
     log_info "Directory structure created:"
     log_info "  Config: $CONFIG_DIR"
     log_info "  Logs:   $LOG_DIR"
     log_info "  Run:    $RUN_DIR"
     log_info "  Data:   $DATA_DIR"
-    log_info "  - Share backups: $DATA_DIR/share-backups"
+    log_info "  - Configuration history: $DATA_DIR/config-history"
 }
 
 install_binary() {
@@ -227,7 +228,7 @@ verify_installation() {
         "$LOG_DIR:Log directory"
         "$RUN_DIR:Runtime directory"
         "$DATA_DIR:Data directory"
-        "$DATA_DIR/share-backups:Share backups directory"
+        "$DATA_DIR/config-history:Configuration history directory"
     )
 
     local log_files=(
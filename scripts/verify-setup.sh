@@ -214,7 +214,7 @@ main() {
     echo ""
     
     log_info "Checking application-specific directories..."
-    check_directory "$DATA_DIR/share-backups" "Share backups directory" "$USER:$GROUP" true || all_ok=false
+    check_directory "$DATA_DIR/config-history" "Configuration history directory" "$USER:$GROUP" true || all_ok=false
     echo ""
 
     log_info "Checking log files..."
@@ -245,7 +245,7 @@ main() {
         log_error "Some checks failed. Please review the errors above and fix them."
         echo ""
         echo "Quick fix commands:"
-        echo "  sudo mkdir -p $DATA_DIR/share-backups"
+        echo "  sudo mkdir -p $DATA_DIR/config-history"
         echo "  sudo chown -R $USER:$GROUP $LOG_DIR $RUN_DIR $DATA_DIR"
         echo "  sudo chmod -R 755 $LOG_DIR $RUN_DIR $DATA_DIR"
         exit 1